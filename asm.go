@@ -0,0 +1,465 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Register is eBPF register:
+// R0 - return value / helper result, R1-R5 - helper arguments (R1 - context on entry),
+// R6-R9 - callee saved, R10 - read only frame pointer
+type Register uint8
+
+const (
+	R0 Register = iota
+	R1
+	R2
+	R3
+	R4
+	R5
+	R6
+	R7
+	R8
+	R9
+	R10
+)
+
+// Instruction classes, must be in sync with linux/bpf.h
+const (
+	classLd    = 0x00
+	classLdx   = 0x01
+	classSt    = 0x02
+	classStx   = 0x03
+	classAlu   = 0x04
+	classJmp   = 0x05
+	classJmp32 = 0x06
+	classAlu64 = 0x07
+
+	modeImm  = 0x00
+	modeAbs  = 0x20
+	modeInd  = 0x40
+	modeMem  = 0x60
+	modeXadd = 0xc0
+
+	aluEnd   = 0xd0
+	endToBig = 0x08
+
+	// Source operand: immediate constant / register
+	srcK = 0x00
+	srcX = 0x08
+
+	jumpCall = 0x80
+	jumpExit = 0x90
+)
+
+// MemSize is size of memory access for Load / Store instructions
+type MemSize uint8
+
+const (
+	SizeWord   MemSize = 0x00 // 4 bytes
+	SizeHalf   MemSize = 0x08 // 2 bytes
+	SizeByte   MemSize = 0x10 // 1 byte
+	SizeDouble MemSize = 0x18 // 8 bytes
+)
+
+// AluOp is arithmetic operation
+type AluOp uint8
+
+const (
+	AluOpAdd  AluOp = 0x00
+	AluOpSub  AluOp = 0x10
+	AluOpMul  AluOp = 0x20
+	AluOpDiv  AluOp = 0x30
+	AluOpOr   AluOp = 0x40
+	AluOpAnd  AluOp = 0x50
+	AluOpLsh  AluOp = 0x60
+	AluOpRsh  AluOp = 0x70
+	AluOpNeg  AluOp = 0x80
+	AluOpMod  AluOp = 0x90
+	AluOpXor  AluOp = 0xa0
+	AluOpMov  AluOp = 0xb0
+	AluOpArsh AluOp = 0xc0
+)
+
+// JumpOp is condition of conditional jump
+type JumpOp uint8
+
+const (
+	JumpOpAlways JumpOp = 0x00
+	JumpOpEq     JumpOp = 0x10
+	JumpOpGt     JumpOp = 0x20
+	JumpOpGe     JumpOp = 0x30
+	JumpOpSet    JumpOp = 0x40
+	JumpOpNe     JumpOp = 0x50
+	JumpOpSGt    JumpOp = 0x60
+	JumpOpSGe    JumpOp = 0x70
+	JumpOpLt     JumpOp = 0xa0
+	JumpOpLe     JumpOp = 0xb0
+	JumpOpSLt    JumpOp = 0xc0
+	JumpOpSLe    JumpOp = 0xd0
+)
+
+// HelperFunc is ID of kernel helper function, see "enum bpf_func_id" in linux/bpf.h
+type HelperFunc int32
+
+const (
+	HelperMapLookupElem      HelperFunc = 1
+	HelperMapUpdateElem      HelperFunc = 2
+	HelperMapDeleteElem      HelperFunc = 3
+	HelperProbeRead          HelperFunc = 4
+	HelperKtimeGetNs         HelperFunc = 5
+	HelperTracePrintk        HelperFunc = 6
+	HelperGetPrandomU32      HelperFunc = 7
+	HelperGetSmpProcessorId  HelperFunc = 8
+	HelperTailCall           HelperFunc = 12
+	HelperGetCurrentPidTgid  HelperFunc = 14
+	HelperGetCurrentUidGid   HelperFunc = 15
+	HelperGetCurrentComm     HelperFunc = 16
+	HelperRedirect           HelperFunc = 23
+	HelperPerfEventOutput    HelperFunc = 25
+	HelperSkbLoadBytes       HelperFunc = 26
+	HelperGetStackid         HelperFunc = 27
+	HelperGetHashRecalc      HelperFunc = 34
+	HelperGetCurrentTask     HelperFunc = 35
+	HelperXdpAdjustHead      HelperFunc = 44
+	HelperRedirectMap        HelperFunc = 51
+	HelperSockOpsCbFlagsSet  HelperFunc = 59
+	HelperSkbLoadBytesRel    HelperFunc = 68
+	HelperFibLookup          HelperFunc = 69
+	HelperLwtPushEncap       HelperFunc = 73
+	HelperLwtSeg6Action      HelperFunc = 76
+	HelperSkbCgroupID        HelperFunc = 79
+	HelperSkRelease          HelperFunc = 86
+	HelperProbeReadUser      HelperFunc = 112
+	HelperProbeReadKernel    HelperFunc = 113
+	HelperProbeReadKernelStr HelperFunc = 115
+	HelperSkAssign           HelperFunc = 124
+	HelperRingbufOutput      HelperFunc = 130
+	HelperRingbufReserve     HelperFunc = 131
+	HelperRingbufSubmit      HelperFunc = 132
+	HelperRingbufDiscard     HelperFunc = 133
+	HelperGetAttachCookie    HelperFunc = 174
+)
+
+// Instruction is single eBPF instruction for programs built from Go code
+// (instead of compiled into ELF by clang):
+//
+//	insns := goebpf.Instructions{
+//		goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpDrop)),
+//		goebpf.LoadMem(goebpf.SizeWord, goebpf.R2, goebpf.R1, 0),
+//		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R2, 0, "exit"),
+//		goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpPass)),
+//		goebpf.Exit().WithLabel("exit"),
+//	}
+//	prog, err := goebpf.NewProgram("filter", goebpf.ProgramTypeXdp, "GPL", insns)
+//	...
+//	err = prog.Load()
+type Instruction struct {
+	OpCode   uint8
+	Dst      Register
+	Src      Register
+	Offset   int16
+	Constant int64
+	// Name of this instruction to be used as jump target
+	Label string
+	// Jumps: name of target instruction, Offset calculated by Assemble()
+	Target string
+	// Load map fd instruction: map which fd will be used at Assemble() time
+	Map Map
+	// Kernel function call: function resolved in kernel BTF at Assemble() time
+	KernelFunc string
+}
+
+// WithLabel returns copy of instruction marked with label, to be used as jump target
+func (i Instruction) WithLabel(label string) Instruction {
+	i.Label = label
+	return i
+}
+
+// Returns amount of 8 bytes slots instruction takes
+func (i *Instruction) slots() int {
+	if i.isLoadImm64() {
+		return 2
+	}
+	return 1
+}
+
+func (i *Instruction) isLoadImm64() bool {
+	return i.OpCode == classLd|modeImm|uint8(SizeDouble)
+}
+
+func (i *Instruction) isJump() bool {
+	class := i.OpCode & 0x07
+	op := i.OpCode & 0xf0
+	return (class == classJmp || class == classJmp32) && op != jumpCall && op != jumpExit
+}
+
+// Alu64Imm creates "dst = dst <op> imm" instruction
+func Alu64Imm(op AluOp, dst Register, imm int32) Instruction {
+	return Instruction{OpCode: classAlu64 | uint8(op) | srcK, Dst: dst, Constant: int64(imm)}
+}
+
+// Alu64Reg creates "dst = dst <op> src" instruction
+func Alu64Reg(op AluOp, dst, src Register) Instruction {
+	return Instruction{OpCode: classAlu64 | uint8(op) | srcX, Dst: dst, Src: src}
+}
+
+// Alu32Imm creates 32 bit "dst = dst <op> imm" instruction, upper half of dst is zeroed
+func Alu32Imm(op AluOp, dst Register, imm int32) Instruction {
+	return Instruction{OpCode: classAlu | uint8(op) | srcK, Dst: dst, Constant: int64(imm)}
+}
+
+// Alu32Reg creates 32 bit "dst = dst <op> src" instruction, upper half of dst is zeroed
+func Alu32Reg(op AluOp, dst, src Register) Instruction {
+	return Instruction{OpCode: classAlu | uint8(op) | srcX, Dst: dst, Src: src}
+}
+
+// Mov64Imm creates "dst = imm" instruction
+func Mov64Imm(dst Register, imm int32) Instruction {
+	return Alu64Imm(AluOpMov, dst, imm)
+}
+
+// Mov64Reg creates "dst = src" instruction
+func Mov64Reg(dst, src Register) Instruction {
+	return Alu64Reg(AluOpMov, dst, src)
+}
+
+// LoadImm64 creates "dst = imm" instruction for 64 bit constant (takes 2 slots)
+func LoadImm64(dst Register, imm int64) Instruction {
+	return Instruction{OpCode: classLd | modeImm | uint8(SizeDouble), Dst: dst, Constant: imm}
+}
+
+// ToBigEndian creates "dst = htobe<bits>(dst)" instruction, bits is 16, 32 or 64.
+// Since conversion is symmetric it works as "ntoh" as well.
+func ToBigEndian(dst Register, bits int32) Instruction {
+	return Instruction{OpCode: classAlu | aluEnd | endToBig, Dst: dst, Constant: int64(bits)}
+}
+
+// LoadMapFd creates "dst = map" instruction, to be used as map argument of helpers.
+// Map must be created before Assemble() / NewProgram().
+func LoadMapFd(dst Register, m Map) Instruction {
+	i := LoadImm64(dst, 0)
+	i.Src = bpfPseudoMapFd
+	i.Map = m
+	return i
+}
+
+// LoadMem creates "dst = *(size *)(src + offset)" instruction
+func LoadMem(size MemSize, dst, src Register, offset int16) Instruction {
+	return Instruction{OpCode: classLdx | modeMem | uint8(size), Dst: dst, Src: src, Offset: offset}
+}
+
+// LoadAbs creates legacy "R0 = ntoh(*(size *)(skb->data + imm))" instruction.
+// Available only for socket filters, R6 must point to program context.
+func LoadAbs(size MemSize, imm int32) Instruction {
+	return Instruction{OpCode: classLd | modeAbs | uint8(size), Constant: int64(imm)}
+}
+
+// LoadInd creates legacy "R0 = ntoh(*(size *)(skb->data + src + imm))" instruction.
+// Available only for socket filters, R6 must point to program context.
+func LoadInd(size MemSize, src Register, imm int32) Instruction {
+	return Instruction{OpCode: classLd | modeInd | uint8(size), Src: src, Constant: int64(imm)}
+}
+
+// StoreMem creates "*(size *)(dst + offset) = src" instruction
+func StoreMem(size MemSize, dst Register, offset int16, src Register) Instruction {
+	return Instruction{OpCode: classStx | modeMem | uint8(size), Dst: dst, Src: src, Offset: offset}
+}
+
+// StoreImm creates "*(size *)(dst + offset) = imm" instruction
+func StoreImm(size MemSize, dst Register, offset int16, imm int32) Instruction {
+	return Instruction{OpCode: classSt | modeMem | uint8(size), Dst: dst, Offset: offset, Constant: int64(imm)}
+}
+
+// AtomicAdd creates "lock *(size *)(dst + offset) += src" instruction,
+// size must be SizeWord or SizeDouble
+func AtomicAdd(size MemSize, dst Register, offset int16, src Register) Instruction {
+	return Instruction{OpCode: classStx | modeXadd | uint8(size), Dst: dst, Src: src, Offset: offset}
+}
+
+// JumpImm creates "if dst <op> imm goto target" instruction
+func JumpImm(op JumpOp, dst Register, imm int32, target string) Instruction {
+	return Instruction{OpCode: classJmp | uint8(op) | srcK, Dst: dst, Constant: int64(imm), Target: target}
+}
+
+// JumpReg creates "if dst <op> src goto target" instruction
+func JumpReg(op JumpOp, dst, src Register, target string) Instruction {
+	return Instruction{OpCode: classJmp | uint8(op) | srcX, Dst: dst, Src: src, Target: target}
+}
+
+// Jump creates unconditional "goto target" instruction
+func Jump(target string) Instruction {
+	return Instruction{OpCode: classJmp | uint8(JumpOpAlways), Target: target}
+}
+
+// Call creates call of kernel helper function. Arguments are R1-R5, result is in R0
+func Call(fn HelperFunc) Instruction {
+	return Instruction{OpCode: classJmp | jumpCall, Constant: int64(fn)}
+}
+
+// CallKernelFunc creates call of kernel function exported to eBPF programs
+// (kfunc, linux 5.13+), e.g. "bpf_task_from_pid". Functions of loaded kernel
+// modules are supported (linux 5.14+), module may be given explicitly, e.g.
+// "nf_conntrack:bpf_skb_ct_lookup". Arguments are R1-R5, result is in R0.
+func CallKernelFunc(name string) Instruction {
+	return Instruction{OpCode: classJmp | jumpCall, Src: bpfPseudoKfuncCall, KernelFunc: name}
+}
+
+// Exit creates "return R0" instruction
+func Exit() Instruction {
+	return Instruction{OpCode: classJmp | jumpExit}
+}
+
+// Instructions is eBPF program built from Go code, see Instruction
+type Instructions []Instruction
+
+// Assemble resolves jump labels / map / kernel function references and returns
+// eBPF bytecode. Calls of kernel module functions can't be expressed in bytecode
+// alone, use NewProgram() for them.
+func (insns Instructions) Assemble() ([]byte, error) {
+	bytecode, modules, err := insns.assemble()
+	if err != nil {
+		return nil, err
+	}
+	if len(modules) > 0 {
+		return nil, fmt.Errorf("Calls of kernel module '%s' functions require NewProgram()", modules[0])
+	}
+
+	return bytecode, nil
+}
+
+// Assembles program, returning kernel modules of called kernel functions as well:
+// call refers module by its index in list plus one
+func (insns Instructions) assemble() ([]byte, []string, error) {
+	// Slot index of every label
+	labels := make(map[string]int)
+	slot := 0
+	for idx := range insns {
+		if label := insns[idx].Label; label != "" {
+			if _, ok := labels[label]; ok {
+				return nil, nil, fmt.Errorf("Duplicate label '%s'", label)
+			}
+			labels[label] = slot
+		}
+		slot += insns[idx].slots()
+	}
+	if slot > bpfMaxInstructions {
+		return nil, nil, fmt.Errorf("Program is too big: %d instructions", slot)
+	}
+
+	result := make([]byte, 0, slot*bpfInstructionLen)
+	var modules []string
+	slot = 0
+	for idx := range insns {
+		insn := insns[idx]
+		if insn.isJump() {
+			if insn.Target == "" {
+				return nil, nil, fmt.Errorf("Instruction %d: jump without target", idx)
+			}
+			target, ok := labels[insn.Target]
+			if !ok {
+				return nil, nil, fmt.Errorf("Instruction %d: unknown label '%s'", idx, insn.Target)
+			}
+			// Offset is relative to next instruction
+			offset := target - slot - 1
+			if offset < -32768 || offset > 32767 {
+				return nil, nil, fmt.Errorf("Instruction %d: jump to '%s' is too far", idx, insn.Target)
+			}
+			insn.Offset = int16(offset)
+		}
+		if insn.Map != nil {
+			if insn.Map.GetFd() == 0 {
+				return nil, nil, fmt.Errorf("Instruction %d: map '%s' is not created", idx, insn.Map.GetName())
+			}
+			insn.Constant = int64(insn.Map.GetFd())
+		}
+		if insn.KernelFunc != "" {
+			fn, err := findKernelFunc(DefaultBtfPath, insn.KernelFunc)
+			if err != nil {
+				return nil, nil, fmt.Errorf("Instruction %d: %v", idx, err)
+			}
+			insn.Constant = int64(fn.btfID)
+			insn.Offset = 0
+			if fn.module != "" {
+				insn.Offset = int16(moduleIndex(&modules, fn.module) + 1)
+			}
+		}
+		if insn.Dst > R10 || insn.Src > R10 && !insn.isLoadImm64() {
+			return nil, nil, fmt.Errorf("Instruction %d: invalid register", idx)
+		}
+		result = append(result, insn.encode()...)
+		slot += insn.slots()
+	}
+
+	return result, modules, nil
+}
+
+// Returns index of module in list, adding it if needed
+func moduleIndex(modules *[]string, module string) int {
+	for idx, m := range *modules {
+		if m == module {
+			return idx
+		}
+	}
+	*modules = append(*modules, module)
+
+	return len(*modules) - 1
+}
+
+// Converts instruction into binary form, LoadImm64 produces 2 slots
+func (i *Instruction) encode() []byte {
+	raw := bpfInstruction{
+		code:   i.OpCode,
+		dstReg: uint8(i.Dst),
+		srcReg: uint8(i.Src),
+		offset: uint16(i.Offset),
+		imm:    uint32(i.Constant),
+	}
+	res := raw.save(hostByteOrder)
+	if i.isLoadImm64() {
+		// Second (pseudo) instruction carries upper 32 bits of constant
+		hi := make([]byte, bpfInstructionLen)
+		hostByteOrder.PutUint32(hi[4:], uint32(uint64(i.Constant)>>32))
+		res = append(res, hi...)
+	}
+	return res
+}
+
+// Program types which can be created from instructions
+var programTypeCreators = map[ProgramType]programCreator{
+	ProgramTypeXdp:          newXdpProgram,
+	ProgramTypeSocketFilter: newSocketFilterProgram,
+	ProgramTypePerfEvent:    newPerfEventProgram,
+	ProgramTypeSockOps:      newSockOpsProgram,
+	ProgramTypeTracepoint:   newTracepointProgram,
+	ProgramTypeKprobe:       newUprobeProgram(false), // attached to uprobes only
+	ProgramTypeCgroupSkb:    newCgroupSkbProgram,
+	ProgramTypeSkLookup:     newSkLookupProgram,
+	ProgramTypeLwtIn:        newLwtProgram(ProgramTypeLwtIn),
+	ProgramTypeLwtOut:       newLwtProgram(ProgramTypeLwtOut),
+	ProgramTypeLwtXmit:      newLwtProgram(ProgramTypeLwtXmit),
+	ProgramTypeLwtSeg6Local: newLwtProgram(ProgramTypeLwtSeg6Local),
+}
+
+// NewProgram creates program from instructions, without ELF file.
+// Program is ready to be loaded by Load().
+func NewProgram(name string, progType ProgramType, license string, insns Instructions) (Program, error) {
+	create, ok := programTypeCreators[progType]
+	if !ok {
+		return nil, &NotSupportedError{Feature: fmt.Sprintf("Program type %v", progType)}
+	}
+	if len(insns) == 0 {
+		return nil, errors.New("Empty program")
+	}
+	bytecode, modules, err := insns.assemble()
+	if err != nil {
+		return nil, err
+	}
+	prog := create(name, license, bytecode)
+	prog.(baseProgramAccessor).base().kfuncModules = modules
+
+	return prog, nil
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Map with fixed fd, used to check map fd relocation
+type asmTestMap struct {
+	Map
+	fd int
+}
+
+func (m *asmTestMap) GetFd() int {
+	return m.fd
+}
+
+func (m *asmTestMap) GetName() string {
+	return "test"
+}
+
+func TestAssembleSimple(t *testing.T) {
+	insns := Instructions{
+		Mov64Imm(R0, 2),
+		AtomicAdd(SizeDouble, R1, 8, R2),
+		Exit(),
+	}
+	bytecode, err := insns.Assemble()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{
+		0xb7, 0x00, 0x00, 0x00, 0x02, 0x00, 0x00, 0x00,
+		0xdb, 0x21, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00,
+		0x95, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}, bytecode)
+}
+
+func TestAssembleLoadImm64(t *testing.T) {
+	insns := Instructions{
+		LoadImm64(R1, 0x1122334455667788),
+		LoadMapFd(R2, &asmTestMap{fd: 7}),
+	}
+	bytecode, err := insns.Assemble()
+	require.NoError(t, err)
+	assert.Equal(t, []byte{
+		0x18, 0x01, 0x00, 0x00, 0x88, 0x77, 0x66, 0x55,
+		0x00, 0x00, 0x00, 0x00, 0x44, 0x33, 0x22, 0x11,
+		0x18, 0x12, 0x00, 0x00, 0x07, 0x00, 0x00, 0x00,
+		0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00,
+	}, bytecode)
+
+	// Map is not created yet
+	insns = Instructions{LoadMapFd(R1, &asmTestMap{})}
+	_, err = insns.Assemble()
+	assert.Error(t, err)
+}
+
+func TestAssembleJumps(t *testing.T) {
+	insns := Instructions{
+		LoadMem(SizeWord, R2, R1, 4).WithLabel("start"),
+		JumpImm(JumpOpEq, R2, 0, "exit"),
+		LoadImm64(R3, 1),
+		Jump("start"),
+		Exit().WithLabel("exit"),
+	}
+	bytecode, err := insns.Assemble()
+	require.NoError(t, err)
+	require.Len(t, bytecode, 6*bpfInstructionLen)
+
+	// Forward jump skips LoadImm64 (2 slots) and Jump
+	insn := &bpfInstruction{}
+	require.NoError(t, insn.load(bytecode[bpfInstructionLen:], hostByteOrder))
+	assert.Equal(t, uint8(0x15), insn.code)
+	assert.Equal(t, int16(3), int16(insn.offset))
+	// Backward jump
+	require.NoError(t, insn.load(bytecode[4*bpfInstructionLen:], hostByteOrder))
+	assert.Equal(t, uint8(0x05), insn.code)
+	assert.Equal(t, int16(-5), int16(insn.offset))
+}
+
+func TestAssembleErrors(t *testing.T) {
+	cases := []Instructions{
+		{Jump("nowhere"), Exit()},
+		{Exit().WithLabel("a"), Exit().WithLabel("a")},
+		{Mov64Imm(Register(11), 0), Exit()},
+	}
+	for _, insns := range cases {
+		_, err := insns.Assemble()
+		assert.Error(t, err)
+	}
+}
+
+func TestNewProgram(t *testing.T) {
+	insns := Instructions{
+		Mov64Imm(R0, int32(XdpPass)),
+		Exit(),
+	}
+	prog, err := NewProgram("pass", ProgramTypeXdp, "GPL", insns)
+	require.NoError(t, err)
+	assert.Equal(t, "pass", prog.GetName())
+	assert.Equal(t, ProgramTypeXdp, prog.GetType())
+	assert.Equal(t, 2*bpfInstructionLen, prog.GetSize())
+	assert.Equal(t, "GPL", prog.GetLicense())
+
+	_, err = NewProgram("pass", ProgramTypeSchedAct, "GPL", insns)
+	assert.Error(t, err)
+	_, err = NewProgram("empty", ProgramTypeXdp, "GPL", nil)
+	assert.Error(t, err)
+}
+
+func TestAssembleKernelModuleFunc(t *testing.T) {
+	var modules []string
+	assert.Equal(t, 0, moduleIndex(&modules, "nf_conntrack"))
+	assert.Equal(t, 1, moduleIndex(&modules, "nf_nat"))
+	assert.Equal(t, 0, moduleIndex(&modules, "nf_conntrack"))
+	assert.Equal(t, []string{"nf_conntrack", "nf_nat"}, modules)
+
+	insn := CallKernelFunc("bpf_task_from_pid")
+	assert.Equal(t, Register(bpfPseudoKfuncCall), insn.Src)
+	assert.False(t, insn.isJump())
+}
@@ -0,0 +1,81 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"sync"
+)
+
+// AttachTarget is program along with argument for its Attach() call,
+// e.g. interface name for XDP program
+type AttachTarget struct {
+	Program Program
+	Data    interface{}
+}
+
+// AttachGroup is set of programs attached by single call, see NewAttachGroup()
+type AttachGroup struct {
+	mu       sync.Mutex
+	attached []Program
+}
+
+// NewAttachGroup attaches all targets, in given order, and returns handle to detach them
+// all at once. It is all-or-nothing: if any of programs fails to attach, programs attached
+// so far are detached back (in reverse order) and error is returned.
+// Rollback itself may fail (e.g. kernel refuses to detach program): then group of programs
+// left attached is returned along with error, so caller can retry Detach() of it.
+//
+//	group, err := goebpf.NewAttachGroup(
+//		goebpf.AttachTarget{Program: bpf.GetProgramByName("xdp_public"), Data: "eth0"},
+//		goebpf.AttachTarget{Program: bpf.GetProgramByName("xdp_private"), Data: "eth1"},
+//	)
+//	defer group.Detach()
+func NewAttachGroup(targets ...AttachTarget) (*AttachGroup, error) {
+	g := &AttachGroup{}
+	for _, target := range targets {
+		if err := target.Program.Attach(target.Data); err != nil {
+			err = fmt.Errorf("Unable to attach program '%s': %v", target.Program.GetName(), err)
+			if derr := g.Detach(); derr != nil {
+				return g, fmt.Errorf("%v, also rollback failed: %v", err, derr)
+			}
+			return nil, err
+		}
+		g.attached = append(g.attached, target.Program)
+	}
+
+	return g, nil
+}
+
+// Programs returns programs attached by group, in order of attachment
+func (g *AttachGroup) Programs() []Program {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return append([]Program(nil), g.attached...)
+}
+
+// Detach detaches all programs of group in reverse order. All programs are
+// tried regardless of failures, the first error (if any) is returned.
+// Programs failed to detach stay in group, so Detach() can be retried.
+// Detaching already detached group does nothing.
+func (g *AttachGroup) Detach() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	var res error
+	var failed []Program
+	for i := len(g.attached) - 1; i >= 0; i-- {
+		prog := g.attached[i]
+		if err := prog.Detach(); err != nil {
+			if res == nil {
+				res = fmt.Errorf("Unable to detach program '%s': %v", prog.GetName(), err)
+			}
+			failed = append([]Program{prog}, failed...)
+		}
+	}
+	g.attached = failed
+
+	return res
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Program which only records Attach() / Detach() calls
+type attachTestProgram struct {
+	Program
+	name      string
+	attachErr error
+	detachErr error
+	log       *[]string
+}
+
+func (p *attachTestProgram) GetName() string {
+	return p.name
+}
+
+func (p *attachTestProgram) Attach(data interface{}) error {
+	if p.attachErr != nil {
+		return p.attachErr
+	}
+	*p.log = append(*p.log, "attach "+p.name+" "+data.(string))
+	return nil
+}
+
+func (p *attachTestProgram) Detach() error {
+	*p.log = append(*p.log, "detach "+p.name)
+	return p.detachErr
+}
+
+func TestAttachGroup(t *testing.T) {
+	var log []string
+	p1 := &attachTestProgram{name: "p1", log: &log}
+	p2 := &attachTestProgram{name: "p2", log: &log}
+
+	group, err := NewAttachGroup(AttachTarget{p1, "eth0"}, AttachTarget{p2, "eth1"})
+	require.NoError(t, err)
+	assert.Equal(t, []Program{p1, p2}, group.Programs())
+
+	assert.NoError(t, group.Detach())
+	assert.Empty(t, group.Programs())
+	// Second Detach() does nothing
+	assert.NoError(t, group.Detach())
+	assert.Equal(t, []string{"attach p1 eth0", "attach p2 eth1", "detach p2", "detach p1"}, log)
+
+	// Detach failures don't stop others from detaching
+	log = nil
+	p1.detachErr = errors.New("busy")
+	group, err = NewAttachGroup(AttachTarget{p1, "eth0"}, AttachTarget{p2, "eth1"})
+	require.NoError(t, err)
+	assert.EqualError(t, group.Detach(), "Unable to detach program 'p1': busy")
+	assert.Equal(t, []string{"attach p1 eth0", "attach p2 eth1", "detach p2", "detach p1"}, log)
+	// Failed ones stay in group to be retried
+	assert.Equal(t, []Program{p1}, group.Programs())
+	p1.detachErr = nil
+	assert.NoError(t, group.Detach())
+	assert.Empty(t, group.Programs())
+	assert.Equal(t, "detach p1", log[len(log)-1])
+}
+
+func TestAttachGroupRollback(t *testing.T) {
+	var log []string
+	p1 := &attachTestProgram{name: "p1", log: &log}
+	p2 := &attachTestProgram{name: "p2", log: &log}
+	p3 := &attachTestProgram{name: "p3", log: &log, attachErr: errors.New("no such device")}
+
+	group, err := NewAttachGroup(AttachTarget{p1, "eth0"}, AttachTarget{p2, "eth1"}, AttachTarget{p3, "eth2"})
+	assert.EqualError(t, err, "Unable to attach program 'p3': no such device")
+	assert.Nil(t, group)
+	assert.Equal(t, []string{"attach p1 eth0", "attach p2 eth1", "detach p2", "detach p1"}, log)
+
+	// Rollback failure is reported as well, along with programs left attached
+	log = nil
+	p1.detachErr = errors.New("busy")
+	group, err = NewAttachGroup(AttachTarget{p1, "eth0"}, AttachTarget{p2, "eth1"}, AttachTarget{p3, "eth2"})
+	assert.EqualError(t, err, "Unable to attach program 'p3': no such device, "+
+		"also rollback failed: Unable to detach program 'p1': busy")
+	require.NotNil(t, group)
+	assert.Equal(t, []Program{p1}, group.Programs())
+	p1.detachErr = nil
+	assert.NoError(t, group.Detach())
+	assert.Equal(t, []string{"attach p1 eth0", "attach p2 eth1", "detach p2", "detach p1", "detach p1"}, log)
+}
@@ -0,0 +1,208 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"unsafe"
+)
+
+// Sources of audit records
+const (
+	AuditSourceBpf     = "bpf"
+	AuditSourceNetlink = "netlink"
+)
+
+// AuditRecord describes single bpf(2) syscall / netlink request made by library
+type AuditRecord struct {
+	Time time.Time
+	// AuditSourceBpf / AuditSourceNetlink
+	Source string
+	// bpf(2) command (e.g. "BPF_PROG_LOAD") or netlink request (e.g. "LinkSetXdpFd")
+	Op string
+	// Map / program / pin path / network interface operation is about,
+	// empty if unknown (e.g. objects opened by ID)
+	Object string
+	// Value returned by bpf(2) (usually fd), nil error on success
+	Result int
+	Err    error
+}
+
+func (r AuditRecord) String() string {
+	res := fmt.Sprintf("%s %s %s", r.Time.Format(time.RFC3339Nano), r.Source, r.Op)
+	if r.Object != "" {
+		res += fmt.Sprintf(" '%s'", r.Object)
+	}
+	if r.Err != nil {
+		return res + fmt.Sprintf(": %v", r.Err)
+	}
+	if r.Source == AuditSourceBpf {
+		return res + fmt.Sprintf(" = %d", r.Result)
+	}
+	return res + ": ok"
+}
+
+// AuditSink receives records of all bpf(2) / netlink operations of library.
+// It is called synchronously from any goroutine right after operation,
+// so it must be thread safe and fast (e.g. send record to channel).
+type AuditSink func(rec AuditRecord)
+
+// State of audit: sink and names of objects by fd, tracked while sink is set
+var audit = struct {
+	sync.RWMutex
+	sink  AuditSink
+	names map[int]string
+}{}
+
+// SetAuditSink makes library report every bpf(2) syscall / netlink request it
+// makes (command, object, result) to sink, nil disables audit. Sink should be
+// set before any maps / programs are created, so records of operations on them
+// have names of objects. Note that map element operations are reported as well,
+// sink is expected to filter out what is not needed.
+func SetAuditSink(sink AuditSink) {
+	audit.Lock()
+	defer audit.Unlock()
+
+	audit.sink = sink
+	audit.names = nil
+	if sink != nil {
+		audit.names = map[int]string{}
+	}
+}
+
+// RecordAudit reports operation to audit sink (if any), for extension packages
+// making netlink requests / syscalls on their own (e.g. goebpf_tc)
+func RecordAudit(source, op, object string, err error) {
+	audit.RLock()
+	sink := audit.sink
+	audit.RUnlock()
+	if sink == nil {
+		return
+	}
+
+	sink(AuditRecord{
+		Time:   time.Now(),
+		Source: source,
+		Op:     op,
+		Object: object,
+		Err:    err,
+	})
+}
+
+// Names of bpf(2) commands by number
+var bpfCmdNames = map[int]string{
+	bpfCmdMapCreate:         "BPF_MAP_CREATE",
+	bpfCmdMapLookupElem:     "BPF_MAP_LOOKUP_ELEM",
+	bpfCmdMapUpdateElem:     "BPF_MAP_UPDATE_ELEM",
+	bpfCmdMapDeleteElem:     "BPF_MAP_DELETE_ELEM",
+	bpfCmdMapGetNextKey:     "BPF_MAP_GET_NEXT_KEY",
+	bpfCmdProgLoad:          "BPF_PROG_LOAD",
+	bpfCmdObjPin:            "BPF_OBJ_PIN",
+	bpfCmdObjGet:            "BPF_OBJ_GET",
+	bpfCmdProgAttach:        "BPF_PROG_ATTACH",
+	bpfCmdProgDetach:        "BPF_PROG_DETACH",
+	bpfCmdProgTestRun:       "BPF_PROG_TEST_RUN",
+	bpfCmdProgGetNextId:     "BPF_PROG_GET_NEXT_ID",
+	bpfCmdMapGetNextId:      "BPF_MAP_GET_NEXT_ID",
+	bpfCmdProgGetFdById:     "BPF_PROG_GET_FD_BY_ID",
+	bpfCmdMapGetFdById:      "BPF_MAP_GET_FD_BY_ID",
+	bpfCmdObjGetInfoByFd:    "BPF_OBJ_GET_INFO_BY_FD",
+	bpfCmdRawTracepointOpen: "BPF_RAW_TRACEPOINT_OPEN",
+	bpfCmdBtfLoad:           "BPF_BTF_LOAD",
+	bpfCmdBtfGetFdById:      "BPF_BTF_GET_FD_BY_ID",
+	bpfCmdMapFreeze:         "BPF_MAP_FREEZE",
+	bpfCmdBtfGetNextId:      "BPF_BTF_GET_NEXT_ID",
+	bpfCmdMapLookupBatch:    "BPF_MAP_LOOKUP_BATCH",
+	bpfCmdMapDeleteBatch:    "BPF_MAP_DELETE_BATCH",
+	bpfCmdLinkCreate:        "BPF_LINK_CREATE",
+	bpfCmdLinkUpdate:        "BPF_LINK_UPDATE",
+	bpfCmdLinkGetFdById:     "BPF_LINK_GET_FD_BY_ID",
+	bpfCmdLinkGetNextId:     "BPF_LINK_GET_NEXT_ID",
+	bpfCmdLinkDetach:        "BPF_LINK_DETACH",
+	bpfCmdProgBindMap:       "BPF_PROG_BIND_MAP",
+	bpfCmdTokenCreate:       "BPF_TOKEN_CREATE",
+}
+
+// Reports bpf(2) syscall to audit sink (if any). Object is taken from
+// attributes: name of map / program being created, pin path, or name
+// of map / program fd command works with.
+func auditBpfSyscall(cmd int, attr unsafe.Pointer, res int, err error) {
+	audit.RLock()
+	sink := audit.sink
+	audit.RUnlock()
+	if sink == nil {
+		return
+	}
+
+	op, ok := bpfCmdNames[cmd]
+	if !ok {
+		op = fmt.Sprintf("BPF_CMD_%d", cmd)
+	}
+	var object string
+	fdName := func(fd uint32) string {
+		audit.RLock()
+		defer audit.RUnlock()
+		return audit.names[int(fd)]
+	}
+	switch cmd {
+	case bpfCmdMapCreate:
+		object = NullTerminatedStringToString((*bpfMapCreateAttr)(attr).mapName[:])
+	case bpfCmdProgLoad:
+		object = NullTerminatedStringToString((*bpfProgLoadAttr)(attr).progName[:])
+	case bpfCmdObjPin, bpfCmdObjGet:
+		object = goString((*bpfObjAttr)(attr).pathname.ptr)
+	case bpfCmdMapLookupElem, bpfCmdMapUpdateElem, bpfCmdMapDeleteElem, bpfCmdMapGetNextKey, bpfCmdMapFreeze:
+		object = fdName((*bpfMapElemAttr)(attr).mapFd)
+	case bpfCmdMapLookupBatch, bpfCmdMapDeleteBatch:
+		object = fdName((*bpfMapBatchAttr)(attr).mapFd)
+	case bpfCmdProgAttach, bpfCmdProgDetach:
+		object = fdName((*bpfProgAttachAttr)(attr).attachBpfFd)
+	case bpfCmdProgTestRun:
+		object = fdName((*bpfProgTestRunAttr)(attr).progFd)
+	case bpfCmdLinkCreate:
+		object = fdName((*bpfLinkCreateAttr)(attr).progFd)
+	case bpfCmdProgBindMap:
+		object = fdName((*bpfProgBindMapAttr)(attr).progFd)
+	}
+
+	// Remember names of new fds for further operations
+	if err == nil && object != "" &&
+		(cmd == bpfCmdMapCreate || cmd == bpfCmdProgLoad || cmd == bpfCmdObjGet) {
+		audit.Lock()
+		if audit.names != nil {
+			audit.names[res] = object
+		}
+		audit.Unlock()
+	}
+
+	sink(AuditRecord{
+		Time:   time.Now(),
+		Source: AuditSourceBpf,
+		Op:     op,
+		Object: object,
+		Result: res,
+		Err:    err,
+	})
+}
+
+// Replaces name of fd reported by further operations, e.g. kernel name
+// of object just created by its full name
+func auditNameFd(fd int, name string) {
+	audit.Lock()
+	defer audit.Unlock()
+	if _, ok := audit.names[fd]; ok {
+		audit.names[fd] = name
+	}
+}
+
+// Forgets name of closed fd, fd number is going to be reused
+func auditCloseFd(fd int) {
+	audit.Lock()
+	defer audit.Unlock()
+	if audit.names != nil {
+		delete(audit.names, fd)
+	}
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditBpfSyscall(t *testing.T) {
+	var records []AuditRecord
+	SetAuditSink(func(rec AuditRecord) {
+		records = append(records, rec)
+	})
+	defer SetAuditSink(nil)
+
+	// Map created: name is remembered for operations by fd
+	create := bpfMapCreateAttr{}
+	copy(create.mapName[:], "audit_map")
+	auditBpfSyscall(bpfCmdMapCreate, unsafe.Pointer(&create), 1000, nil)
+	elem := bpfMapElemAttr{mapFd: 1000}
+	auditBpfSyscall(bpfCmdMapUpdateElem, unsafe.Pointer(&elem), 0, nil)
+	pin := bpfObjAttr{pathname: newBpfPointer(cString("/sys/fs/bpf/audit_map")), bpfFd: 1000}
+	auditBpfSyscall(bpfCmdObjPin, unsafe.Pointer(&pin), 0, syscall.EPERM)
+	// Fd closed: number may be reused by object library doesn't know name of
+	auditCloseFd(1000)
+	auditBpfSyscall(bpfCmdMapLookupElem, unsafe.Pointer(&elem), -1, syscall.ENOENT)
+
+	require.Len(t, records, 4)
+	assert.Equal(t, AuditSourceBpf, records[0].Source)
+	assert.Equal(t, "BPF_MAP_CREATE", records[0].Op)
+	assert.Equal(t, "audit_map", records[0].Object)
+	assert.Equal(t, 1000, records[0].Result)
+	assert.NoError(t, records[0].Err)
+	assert.WithinDuration(t, time.Now(), records[0].Time, time.Minute)
+
+	assert.Equal(t, "BPF_MAP_UPDATE_ELEM", records[1].Op)
+	assert.Equal(t, "audit_map", records[1].Object)
+	assert.Equal(t, "BPF_OBJ_PIN", records[2].Op)
+	assert.Equal(t, "/sys/fs/bpf/audit_map", records[2].Object)
+	assert.Equal(t, syscall.EPERM, records[2].Err)
+	assert.Equal(t, "BPF_MAP_LOOKUP_ELEM", records[3].Op)
+	assert.Equal(t, "", records[3].Object)
+
+	// Disabled
+	SetAuditSink(nil)
+	auditBpfSyscall(bpfCmdMapCreate, unsafe.Pointer(&create), 1001, nil)
+	RecordAudit(AuditSourceNetlink, "LinkSetXdpFd", "eth0", nil)
+	assert.Len(t, records, 4)
+}
+
+func TestRecordAudit(t *testing.T) {
+	var records []AuditRecord
+	SetAuditSink(func(rec AuditRecord) {
+		records = append(records, rec)
+	})
+	defer SetAuditSink(nil)
+
+	RecordAudit(AuditSourceNetlink, "LinkSetXdpFd", "eth0", nil)
+	RecordAudit(AuditSourceNetlink, "LinkByName", "eth9", errors.New("Link not found"))
+	require.Len(t, records, 2)
+
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	records[0].Time = ts
+	records[1].Time = ts
+	assert.Equal(t, "2024-01-02T03:04:05Z netlink LinkSetXdpFd 'eth0': ok", records[0].String())
+	assert.Equal(t, "2024-01-02T03:04:05Z netlink LinkByName 'eth9': Link not found", records[1].String())
+	assert.Equal(t, "2024-01-02T03:04:05Z bpf BPF_PROG_LOAD 'xdp_prog' = 5",
+		AuditRecord{Time: ts, Source: AuditSourceBpf, Op: "BPF_PROG_LOAD", Object: "xdp_prog", Result: 5}.String())
+}
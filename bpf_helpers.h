@@ -47,6 +47,7 @@ enum bpf_map_type {
   BPF_MAP_TYPE_QUEUE,
   BPF_MAP_TYPE_STACK,
   BPF_MAP_TYPE_SK_STORAGE,
+  BPF_MAP_TYPE_DEVMAP_HASH,
 };
 
 /* flags for BPF_MAP_UPDATE_ELEM command */
@@ -55,6 +56,10 @@ enum bpf_map_type {
 #define BPF_EXIST   2 /* update existing element */
 #define BPF_F_LOCK  4 /* spin_lock-ed map_lookup/map_update */
 
+/* flags for bpf_redirect_map() of DEVMAP / DEVMAP_HASH (linux 5.13+) */
+#define BPF_F_BROADCAST       (1ULL << 3) /* redirect to all interfaces of map */
+#define BPF_F_EXCLUDE_INGRESS (1ULL << 4) /* except ingress one when broadcasting */
+
 // A helper structure used by eBPF C program
 // to describe map attributes to BPF program loader
 struct bpf_map_def {
@@ -124,6 +129,10 @@ struct xdp_md {
   __u32 data;
   __u32 data_end;
   __u32 data_meta;
+  /* Below access go through struct xdp_rxq_info */
+  __u32 ingress_ifindex; /* rxq->dev->ifindex */
+  __u32 rx_queue_index;  /* rxq->queue_index  */
+  __u32 egress_ifindex;  /* txq->dev->ifindex */
 };
 
 /* user accessible mirror of in-kernel sk_buff.
@@ -179,10 +188,83 @@ struct bpf_sock_tuple {
 	};
 };
 
+// Flags / result codes of bpf_fib_lookup()
+#define BPF_FIB_LOOKUP_DIRECT (1U << 0) /* skip FIB rules, use main table only */
+#define BPF_FIB_LOOKUP_OUTPUT (1U << 1) /* perform lookup from egress perspective */
+
+enum {
+  BPF_FIB_LKUP_RET_SUCCESS,      /* lookup successful */
+  BPF_FIB_LKUP_RET_BLACKHOLE,    /* dest is blackholed; can be dropped */
+  BPF_FIB_LKUP_RET_UNREACHABLE,  /* dest is unreachable; can be dropped */
+  BPF_FIB_LKUP_RET_PROHIBIT,     /* dest not allowed; can be dropped */
+  BPF_FIB_LKUP_RET_NOT_FWDED,    /* packet is not forwarded */
+  BPF_FIB_LKUP_RET_FWD_DISABLED, /* fwding is not enabled on ingress */
+  BPF_FIB_LKUP_RET_UNSUPP_LWT,   /* fwd requires encapsulation */
+  BPF_FIB_LKUP_RET_NO_NEIGH,     /* no neighbor entry for nh */
+  BPF_FIB_LKUP_RET_FRAG_NEEDED,  /* fragmentation required to fwd */
+};
+
+struct bpf_fib_lookup {
+	/* input:  network family for lookup (AF_INET, AF_INET6)
+	 * output: network family of egress nexthop
+	 */
+	__u8	family;
+
+	/* set if lookup is to consider L4 data - e.g., FIB rules */
+	__u8	l4_protocol;
+	__be16	sport;
+	__be16	dport;
+
+	/* total length of packet from network header - used for MTU check */
+	union {
+		__u16	tot_len;
+		__u16	mtu_result; /* output: MTU value if FRAG_NEEDED */
+	};
+
+	/* input: L3 device index for lookup
+	 * output: device index from FIB lookup
+	 */
+	__u32	ifindex;
+
+	union {
+		/* inputs to lookup */
+		__u8	tos;		/* AF_INET  */
+		__be32	flowinfo;	/* AF_INET6, flow_label + priority */
+
+		/* output: metric of fib result (IPv4/IPv6 only) */
+		__u32	rt_metric;
+	};
+
+	union {
+		__be32		ipv4_src;
+		__u32		ipv6_src[4];  /* in6_addr; network order */
+	};
+
+	/* input to bpf_fib_lookup, ipv{4,6}_dst is destination address in
+	 * network header. output: bpf_fib_lookup sets to gateway address
+	 * if FIB lookup returns gateway route
+	 */
+	union {
+		__be32		ipv4_dst;
+		__u32		ipv6_dst[4];  /* in6_addr; network order */
+	};
+
+	/* output */
+	__be16	h_vlan_proto;
+	__be16	h_vlan_TCI;
+	__u8	smac[6];     /* ETH_ALEN */
+	__u8	dmac[6];     /* ETH_ALEN */
+};
+
 struct bpf_spin_lock {
 	__u32	val;
 };
 
+struct bpf_timer {
+	__u64	:64;
+	__u64	:64;
+} __attribute__((aligned(8)));
+
 struct bpf_sysctl {
 	__u32	write;		/* Sysctl is being read (= 0) or written (= 1).
 				 * Allows 1,2,4-byte read, but no write.
@@ -560,7 +642,7 @@ static int (*bpf_get_stack)(void *ctx, void *buf, __u32 size, __u64 flags) = (vo
 static int (*bpf_skb_load_bytes_relative)(void *ctx, __u32 offset, void *to, __u32 len, __u32 start_header) = (void*) // NOLINT
      BPF_FUNC_skb_load_bytes_relative;
 
-static int (*bpf_fib_lookup)(void *ctx, void *params, int plen, __u32 flags) = (void*) // NOLINT
+static int (*bpf_fib_lookup)(void *ctx, struct bpf_fib_lookup *params, int plen, __u32 flags) = (void*) // NOLINT
      BPF_FUNC_fib_lookup;
 
 static int (*bpf_sock_hash_update)(void *ctx, void *map, void *key, __u64 flags) = (void*) // NOLINT
@@ -666,6 +748,29 @@ static int (*bpf_sk_storage_delete)(void *map, struct bpf_sock *sk) = (void*) //
 static int (*bpf_send_signal)(unsigned sig) = (void *) // NOLINT
     BPF_FUNC_send_signal;
 
+// bpf_timer helpers, linux 5.15+ (IDs are beyond __BPF_FUNC_MAPPER above).
+// Map holding timers must be described by BPF_ANNOTATE_KV_PAIR() and
+// program compiled with -g, so loader creates map with BTF.
+#define BPF_FUNC_timer_init 169
+#define BPF_FUNC_timer_set_callback 170
+#define BPF_FUNC_timer_start 171
+#define BPF_FUNC_timer_cancel 172
+
+static long (*bpf_timer_init)(struct bpf_timer *timer, void *map,
+                              __u64 flags) = (void *) // NOLINT
+    BPF_FUNC_timer_init;
+
+static long (*bpf_timer_set_callback)(struct bpf_timer *timer,
+                                      void *callback_fn) = (void *) // NOLINT
+    BPF_FUNC_timer_set_callback;
+
+static long (*bpf_timer_start)(struct bpf_timer *timer, __u64 nsecs,
+                               __u64 flags) = (void *) // NOLINT
+    BPF_FUNC_timer_start;
+
+static long (*bpf_timer_cancel)(struct bpf_timer *timer) = (void *) // NOLINT
+    BPF_FUNC_timer_cancel;
+
 // Adjust the xdp_md.data by delta
 //     ctx: pointer to xdp_md
 //     delta: An positive/negative integer to be added to ctx.data
@@ -704,6 +809,24 @@ static int (*bpf_xdp_adjust_head)(const void *ctx, int delta) = (void *) // NOLI
 #define BPF_MAP_DEF(name) struct bpf_map_def SEC("maps") name
 #define BPF_MAP_ADD(x)
 
+// Describes key / value types of map in BTF (requires -g), needed for
+// maps with struct bpf_spin_lock / struct bpf_timer in values:
+//   BPF_ANNOTATE_KV_PAIR(timers, __u32, struct elem);
+#define BPF_ANNOTATE_KV_PAIR(name, type_key, type_val)        \
+  struct ____btf_map_##name {                                 \
+    type_key key;                                             \
+    type_val value;                                           \
+  };                                                          \
+  struct ____btf_map_##name                                   \
+      __attribute__((section(".maps." #name), used))          \
+      ____btf_map_##name = {}
+
+// Embeds program metadata shown by "bpftool prog show" / ProgramInfo.Metadata
+// (requires -g, linux 5.10+):
+//   BPF_METADATA(version, "1.2.3");
+#define BPF_METADATA(name, value) \
+  volatile const char bpf_metadata_##name[] SEC(".rodata") = value
+
 ///// end of __BPF__ /////
 
 #else
@@ -716,6 +839,9 @@ static int (*bpf_xdp_adjust_head)(const void *ctx, int delta) = (void *) // NOLI
 // Also disable "unused function" warning -
 // since eBPF programs define functions mostly in headers.
 #define INLINE static __attribute__((unused))
+// Program metadata makes sense for kernel only
+#define BPF_METADATA(name, value) \
+  static const char bpf_metadata_##name[] __attribute__((unused)) = value
 
 // Disable warnings for "pragma unroll(all)"
 #pragma GCC diagnostic ignored "-Wunknown-pragmas"
@@ -776,6 +902,9 @@ int bpf_map_delete_elem(const void *map, const void *key);
 // bpf_tail_call() is nothing: only relevant for BPF arch
 #define bpf_tail_call(ctx, map, index)
 
+// BTF is only relevant for BPF arch
+#define BPF_ANNOTATE_KV_PAIR(name, type_key, type_val)
+
 // adjust_meta / ajdust_header are simple functions to move pointer
 
 UNUSED static int bpf_xdp_adjust_meta(struct xdp_md *ctx, int offset) {
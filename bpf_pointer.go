@@ -0,0 +1,19 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+//go:build !386 && !arm && !mips && !mipsle
+// +build !386,!arm,!mips,!mipsle
+
+package goebpf
+
+import (
+	"unsafe"
+)
+
+// bpfPointer is pointer field of bpf_attr / bpf_*_info (__aligned_u64).
+// It keeps unsafe.Pointer, so referenced memory stays alive / is not moved
+// while syscall is in progress. 32 bit architectures pad it to 8 bytes,
+// see bpf_pointer_32*.go.
+type bpfPointer struct {
+	ptr unsafe.Pointer
+}
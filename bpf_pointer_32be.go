@@ -0,0 +1,18 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+//go:build mips
+// +build mips
+
+package goebpf
+
+import (
+	"unsafe"
+)
+
+// bpfPointer is pointer field of bpf_attr / bpf_*_info (__aligned_u64),
+// big endian: pointer is the least significant half of u64
+type bpfPointer struct {
+	_   uint32
+	ptr unsafe.Pointer
+}
@@ -0,0 +1,18 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+//go:build 386 || arm || mipsle
+// +build 386 arm mipsle
+
+package goebpf
+
+import (
+	"unsafe"
+)
+
+// bpfPointer is pointer field of bpf_attr / bpf_*_info (__aligned_u64),
+// little endian: pointer is the least significant half of u64
+type bpfPointer struct {
+	ptr unsafe.Pointer
+	_   uint32
+}
@@ -0,0 +1,67 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package main
+
+import (
+	"sort"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_btf"
+)
+
+// Reads maps / programs of ELF file the way goebpf loader does, without loading it
+func readElfObjects(fn string) (*goebpf.ElfReport, error) {
+	return goebpf.ParseElf(fn)
+}
+
+// Returns sorted names of C key / value types of maps, known from BTF of ELF
+func mapTypeNames(maps []goebpf.ElfMap) []string {
+	seen := make(map[string]bool)
+	var res []string
+	for _, m := range maps {
+		for _, name := range []string{m.KeyType, m.ValueType} {
+			if name != "" && !seen[name] {
+				seen[name] = true
+				res = append(res, name)
+			}
+		}
+	}
+	sort.Strings(res)
+
+	return res
+}
+
+// Generates Go declarations of key / value types of maps (from BTF of ELF)
+// and of extra types (from BTF of ELF or btfFile, if set)
+func generateTypes(elfFile, btfFile string, maps []goebpf.ElfMap, extra []string) ([]byte, error) {
+	names := mapTypeNames(maps)
+	if len(names) == 0 && len(extra) == 0 {
+		return nil, nil
+	}
+	var res []byte
+	if btfFile != "" && len(extra) > 0 {
+		spec, err := goebpf_btf.LoadSpecFromFile(btfFile)
+		if err != nil {
+			return nil, err
+		}
+		if res, err = goebpf_btf.GenerateGoTypes(spec, extra); err != nil {
+			return nil, err
+		}
+		extra = nil
+	}
+	names = append(names, extra...)
+	if len(names) == 0 {
+		return res, nil
+	}
+	spec, err := goebpf_btf.LoadSpecFromElf(elfFile)
+	if err != nil {
+		return nil, err
+	}
+	src, err := goebpf_btf.GenerateGoTypes(spec, names)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(res, src...), nil
+}
@@ -0,0 +1,123 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"go/format"
+	"io"
+	"text/template"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_btf"
+)
+
+var skeletonTemplate = template.Must(template.New("skeleton").Funcs(template.FuncMap{
+	"goName": goebpf_btf.GoName,
+}).Parse(`// Code generated by goebpf-gen from {{.Source}}. DO NOT EDIT.
+
+package {{.Package}}
+
+import (
+	"fmt"
+
+	"github.com/dropbox/goebpf"
+)
+
+// {{.Type}} holds all eBPF programs and maps from {{.Source}}
+type {{.Type}} struct {
+	bpf      goebpf.System
+	attached []goebpf.Program
+{{range .Programs}}
+	// {{.Type}} program "{{.Name}}"
+	{{goName .Name}} goebpf.Program
+{{- end}}
+{{range .Maps}}
+	// {{.Type}} map "{{.Name}}": key {{with .KeyType}}{{goName .}}, {{end}}{{.KeySize}} bytes, value {{with .ValueType}}{{goName .}}, {{end}}{{.ValueSize}} bytes, max entries {{.MaxEntries}}
+	{{goName .Name}} goebpf.Map
+{{- end}}
+}
+
+// Load{{.Type}} reads ELF file, creates all maps and loads all programs into kernel
+func Load{{.Type}}(elfFile string) (*{{.Type}}, error) {
+	o := &{{.Type}}{
+		bpf: goebpf.NewDefaultEbpfSystem(),
+	}
+	if err := o.bpf.LoadElf(elfFile); err != nil {
+		return nil, err
+	}
+	// Maps are created by LoadElf() already
+	fail := func(err error) (*{{.Type}}, error) {
+		o.Close()
+		return nil, err
+	}
+{{range .Programs}}
+	if o.{{goName .Name}} = o.bpf.GetProgramByName("{{.Name}}"); o.{{goName .Name}} == nil {
+		return fail(fmt.Errorf("Program '{{.Name}}' not found in '%s'", elfFile))
+	}
+{{- end}}
+{{range .Maps}}
+	if o.{{goName .Name}} = o.bpf.GetMapByName("{{.Name}}"); o.{{goName .Name}} == nil {
+		return fail(fmt.Errorf("Map '{{.Name}}' not found in '%s'", elfFile))
+	}
+{{- end}}
+{{range .Programs}}
+	if err := o.{{goName .Name}}.Load(); err != nil {
+		return fail(fmt.Errorf("Program '{{.Name}}': %v", err))
+	}
+{{- end}}
+
+	return o, nil
+}
+{{range .Programs}}
+// Attach{{goName .Name}} attaches program "{{.Name}}", it will be detached by Close()
+func (o *{{$.Type}}) Attach{{goName .Name}}(data interface{}) error {
+	if err := o.{{goName .Name}}.Attach(data); err != nil {
+		return err
+	}
+	o.attached = append(o.attached, o.{{goName .Name}})
+	return nil
+}
+{{end}}
+// Close detaches all attached programs, unloads programs and destroys maps
+func (o *{{.Type}}) Close() error {
+	var result error
+	for _, prog := range o.attached {
+		if err := prog.Detach(); err != nil && result == nil {
+			result = err
+		}
+	}
+	o.attached = nil
+	if err := o.bpf.Close(); err != nil && result == nil {
+		result = err
+	}
+	return result
+}
+{{if .Types}}
+{{.Types}}
+{{- end}}
+`))
+
+type skeletonParams struct {
+	Source  string
+	Package string
+	Type    string
+	// Go declarations of C types, generated from BTF
+	Types string
+	*goebpf.ElfReport
+}
+
+// Writes formatted Go source of skeleton
+func generateSkeleton(w io.Writer, params *skeletonParams) error {
+	var buf bytes.Buffer
+	if err := skeletonTemplate.Execute(&buf, params); err != nil {
+		return err
+	}
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(src)
+	return err
+}
@@ -0,0 +1,56 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package main
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+)
+
+func TestGenerateSkeleton(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := generateSkeleton(buf, &skeletonParams{
+		Source:  "xdp.elf",
+		Package: "fw",
+		Type:    "XdpObjects",
+		Types:   "type IpKey struct { Prefix uint32; Addr uint32 }",
+		ElfReport: &goebpf.ElfReport{
+			Maps: []goebpf.ElfMap{
+				{Name: "blacklist", Type: goebpf.MapTypeLPMTrie, KeySize: 8, ValueSize: 4, MaxEntries: 16,
+					KeyType: "ip_key"},
+				{Name: "counters", Type: goebpf.MapTypeArray, KeySize: 4, ValueSize: 8, MaxEntries: 1},
+			},
+			Programs: []goebpf.ElfProgram{
+				{Name: "firewall", Type: goebpf.ProgramTypeXdp},
+			},
+		},
+	})
+	require.NoError(t, err)
+
+	src := buf.String()
+	assert.Contains(t, src, "package fw\n")
+	assert.Contains(t, src, "\tFirewall goebpf.Program\n")
+	assert.Contains(t, src, "\tBlacklist goebpf.Map\n")
+	assert.Contains(t, src, `map "blacklist": key IpKey, 8 bytes, value 4 bytes, max entries 16`)
+	assert.Contains(t, src, `map "counters": key 4 bytes, value 8 bytes, max entries 1`)
+	assert.Contains(t, src, "func LoadXdpObjects(elfFile string) (*XdpObjects, error) {")
+	assert.Contains(t, src, "func (o *XdpObjects) AttachFirewall(data interface{}) error {")
+	assert.Contains(t, src, `o.bpf.GetMapByName("blacklist")`)
+	assert.Contains(t, src, "type IpKey struct {")
+}
+
+func TestMapTypeNames(t *testing.T) {
+	assert.Empty(t, mapTypeNames(nil))
+	assert.Equal(t, []string{"__u32", "counters", "ip_key"}, mapTypeNames([]goebpf.ElfMap{
+		{Name: "blacklist", KeyType: "ip_key", ValueType: "__u32"},
+		{Name: "counters", KeyType: "__u32", ValueType: "counters"},
+		// No BTF
+		{Name: "events"},
+	}))
+}
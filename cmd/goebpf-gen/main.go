@@ -0,0 +1,94 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// goebpf-gen generates typed Go "skeleton" for compiled eBPF ELF file:
+// struct with field for each program / map, Load / Attach / Close methods.
+// So instead of
+//
+//	m := bpf.GetMapByName("protocols")
+//	if m == nil { ... }
+//
+// generated code is used:
+//
+//	objs, err := LoadXdpObjects("xdp.elf")
+//	...
+//	defer objs.Close()
+//	objs.AttachPacketCount("eth0")
+//	objs.Protocols.LookupInt(6)
+//
+// Maps are exposed as generic goebpf.Map. If ELF file has BTF (compiled with -g)
+// Go versions of C types used as keys / values of maps (BPF_ANNOTATE_KV_PAIR)
+// are generated as well, so keys / values can be encoded without guessing layout.
+// Additional C types (e.g. events sent through perf / ring buffer) are given by -types flag:
+//
+//	goebpf-gen -elf xdp.elf -types event
+//
+// Typical usage is go:generate directive:
+//
+//	//go:generate goebpf-gen -elf ebpf_prog/xdp.elf -pkg main -out xdp_skeleton.go
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dropbox/goebpf/goebpf_btf"
+)
+
+var elfFile = flag.String("elf", "", "clang/llvm compiled binary file")
+var pkg = flag.String("pkg", "main", "Package name of generated file")
+var typeName = flag.String("type", "", "Name of generated type, derived from ELF file name by default (xdp.elf -> XdpObjects)")
+var out = flag.String("out", "", "Output file, stdout if not set")
+var types = flag.String("types", "", "Comma separated list of extra C types to generate Go declarations for (requires BTF)")
+var btfFile = flag.String("btf", "", "Read -types from raw BTF file (e.g. /sys/kernel/btf/vmlinux) instead of ELF")
+
+func fatalError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+func main() {
+	flag.Parse()
+	if *elfFile == "" {
+		fatalError("-elf is required.")
+	}
+
+	objs, err := readElfObjects(*elfFile)
+	if err != nil {
+		fatalError("Unable to read '%s': %v", *elfFile, err)
+	}
+	if *typeName == "" {
+		base := filepath.Base(*elfFile)
+		*typeName = goebpf_btf.GoName(strings.TrimSuffix(base, filepath.Ext(base))) + "Objects"
+	}
+
+	var extraTypes []string
+	if *types != "" {
+		extraTypes = strings.Split(*types, ",")
+	}
+	typesSrc, err := generateTypes(*elfFile, *btfFile, objs.Maps, extraTypes)
+	if err != nil {
+		fatalError("Unable to generate types: %v", err)
+	}
+
+	w := os.Stdout
+	if *out != "" {
+		if w, err = os.Create(*out); err != nil {
+			fatalError("%v", err)
+		}
+		defer w.Close()
+	}
+	err = generateSkeleton(w, &skeletonParams{
+		Source:    filepath.Base(*elfFile),
+		Package:   *pkg,
+		Type:      *typeName,
+		Types:     string(typesSrc),
+		ElfReport: objs,
+	})
+	if err != nil {
+		fatalError("Unable to generate skeleton: %v", err)
+	}
+}
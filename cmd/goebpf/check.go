@@ -0,0 +1,57 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dropbox/goebpf"
+)
+
+func checkElf(args []string) error {
+	fs := newFlagSet("check")
+	elf := fs.String("elf", "", "clang/llvm compiled binary file")
+	strict := fs.Bool("strict", false, "fail on anything not supported by goebpf")
+	fs.Parse(args)
+	if *elf == "" {
+		return errors.New("-elf is required")
+	}
+
+	compat := goebpf.ElfCompatPermissive
+	if *strict {
+		compat = goebpf.ElfCompatStrict
+	}
+	report, err := goebpf.ParseElf(*elf, goebpf.WithElfCompatibility(compat))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("License: %s\nByte order: %v\n\nMaps:\n", report.License, report.ByteOrder)
+	for _, m := range report.Maps {
+		fmt.Printf("  %-20s %-24v key %d, value %d, max entries %d\n",
+			m.Name, m.Type, m.KeySize, m.ValueSize, m.MaxEntries)
+	}
+	fmt.Printf("\nPrograms:\n")
+	for _, prog := range report.Programs {
+		onDemand := ""
+		if prog.OnDemand {
+			onDemand = ", on demand"
+		}
+		fmt.Printf("  %-20s %-24v %d instructions%s\n", prog.Name, prog.Type, prog.Instructions, onDemand)
+	}
+	fmt.Printf("\nRequired kernel features:\n")
+	for _, req := range report.Requirements {
+		fmt.Printf("  %v\n", req)
+	}
+	fmt.Printf("\nMinimal kernel version: %s\n", goebpf.KernelVersionString(report.MinKernelVersion()))
+	if len(report.Warnings) > 0 {
+		fmt.Printf("\nSkipped as not supported:\n")
+		for _, w := range report.Warnings {
+			fmt.Printf("  %v\n", w)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,44 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/dropbox/goebpf/goebpf_clang"
+)
+
+// Repeatable string flag
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+func compile(args []string) error {
+	fs := newFlagSet("compile")
+	opts := &goebpf_clang.Options{}
+	var includes, defines stringList
+	fs.StringVar(&opts.Source, "c", "", "C source file")
+	fs.StringVar(&opts.Output, "o", "", "Output ELF file")
+	fs.StringVar(&opts.Clang, "clang", "", "Path to clang, $CLANG or 'clang' by default")
+	fs.BoolVar(&opts.Debug, "g", false, "Produce debug info (BTF)")
+	fs.BoolVar(&opts.Force, "f", false, "Compile even if output is up to date")
+	fs.Var(&includes, "I", "Include directory (repeatable)")
+	fs.Var(&defines, "D", "Preprocessor definition, e.g. -D DEBUG (repeatable)")
+	fs.Parse(args)
+	if opts.Source == "" || opts.Output == "" {
+		return errors.New("-c and -o are required")
+	}
+	opts.IncludeDirs = includes
+	opts.Defines = defines
+
+	return goebpf_clang.Compile(opts)
+}
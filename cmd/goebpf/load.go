@@ -0,0 +1,65 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dropbox/goebpf"
+)
+
+func loadElf(args []string) error {
+	fs := newFlagSet("load")
+	elf := fs.String("elf", "", "clang/llvm compiled binary file")
+	pin := fs.String("pin", "", "Directory on bpffs to pin programs / maps to (each one by its name)")
+	fs.Parse(args)
+	if *elf == "" {
+		return errors.New("-elf is required")
+	}
+
+	bpf := goebpf.NewDefaultEbpfSystem()
+	if err := bpf.LoadElf(*elf); err != nil {
+		return err
+	}
+	if *pin != "" {
+		if err := os.MkdirAll(*pin, 0700); err != nil {
+			return err
+		}
+	}
+
+	for _, prog := range bpf.GetPrograms() {
+		if err := prog.Load(); err != nil {
+			return fmt.Errorf("Program '%s': %v", prog.GetName(), err)
+		}
+		fmt.Printf("Program '%s' (%v) loaded, fd %d\n", prog.GetName(), prog.GetType(), prog.GetFd())
+		if *pin == "" {
+			continue
+		}
+		path := filepath.Join(*pin, prog.GetName())
+		if err := prog.Pin(path); err != nil {
+			return fmt.Errorf("Program '%s': %v", prog.GetName(), err)
+		}
+		fmt.Printf("Program '%s' pinned to '%s'\n", prog.GetName(), path)
+	}
+	for _, m := range bpf.GetMaps() {
+		em, ok := m.(*goebpf.EbpfMap)
+		if *pin == "" || !ok || em.PersistentPath != "" {
+			// Map is pinned already by its definition
+			continue
+		}
+		path := filepath.Join(*pin, em.Name)
+		if err := em.Pin(path); err != nil {
+			return fmt.Errorf("Map '%s': %v", em.Name, err)
+		}
+		fmt.Printf("Map '%s' pinned to '%s'\n", em.Name, path)
+	}
+	if *pin == "" {
+		fmt.Println("Nothing pinned: programs will be unloaded on exit")
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// goebpf is bpftool-like command line utility built on top of goebpf library:
+//
+//	goebpf prog list
+//	goebpf prog show -id 42
+//	goebpf map list
+//	goebpf map dump -id 7 -format json
+//	goebpf compile -c xdp.c -o xdp.elf
+//	goebpf check -elf xdp.elf
+//	goebpf load -elf xdp.elf -pin /sys/fs/bpf/xdp
+//	goebpf xdp attach -elf xdp.elf -program firewall -iface eth0 -mode drv
+//	goebpf xdp detach -iface eth0
+//
+// Most of commands (except check / compile) require root privileges.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Single CLI command, like "prog list"
+type command struct {
+	help string
+	run  func(args []string) error
+}
+
+var commands = map[string]command{
+	"prog list":  {"List all eBPF programs loaded into kernel", progList},
+	"prog show":  {"Show detailed information about program", progShow},
+	"map list":   {"List all eBPF maps", mapList},
+	"map dump":   {"Dump content of map as JSON / CSV", mapDump},
+	"load":       {"Load ELF file into kernel, optionally pin programs / maps", loadElf},
+	"check":      {"Parse / validate ELF file without loading it (no privileges needed)", checkElf},
+	"compile":    {"Compile C source into eBPF ELF file by clang", compile},
+	"xdp attach": {"Load XDP program from ELF file and attach it to network interface", xdpAttach},
+	"xdp detach": {"Detach XDP program from network interface", xdpDetach},
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [flags]\n\nCommands:\n", os.Args[0])
+	var names []string
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(os.Stderr, "  %-12s %s\n", name, commands[name].help)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for command flags.\n", os.Args[0])
+}
+
+// Finds command by first one or two arguments, returns command name and the rest of args
+func findCommand(args []string) (string, []string, bool) {
+	if len(args) >= 2 {
+		name := strings.Join(args[:2], " ")
+		if _, ok := commands[name]; ok {
+			return name, args[2:], true
+		}
+	}
+	if len(args) >= 1 {
+		if _, ok := commands[args[0]]; ok {
+			return args[0], args[1:], true
+		}
+	}
+	return "", nil, false
+}
+
+// Creates flag set for command, exits on -h / parse error
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage of '%s':\n", name)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+func fatalError(format string, args ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", args...)
+	os.Exit(1)
+}
+
+func main() {
+	name, args, ok := findCommand(os.Args[1:])
+	if !ok {
+		usage()
+		os.Exit(2)
+	}
+	if err := commands[name].run(args); err != nil {
+		fatalError("%s: %v", name, err)
+	}
+}
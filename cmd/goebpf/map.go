@@ -0,0 +1,79 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Opens existing map by ID, ready for lookups
+func openMap(id int) (*goebpf.EbpfMap, error) {
+	m, err := goebpf.NewMapFromExistingMapById(id)
+	if err != nil {
+		return nil, err
+	}
+	// Map has fd already, Create() just finishes initialization
+	if err = m.Create(); err != nil {
+		m.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+func mapList(args []string) error {
+	fs := newFlagSet("map list")
+	fs.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tNAME\tKEY\tVALUE\tMAX ENTRIES\tFLAGS")
+	id, err := goebpf.GetNextMapId(0)
+	for ; err == nil; id, err = goebpf.GetNextMapId(id) {
+		m, err := goebpf.NewMapFromExistingMapById(id)
+		if err != nil {
+			// Map may be destroyed in between
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%v\t%s\t%d\t%d\t%d\t0x%x\n", id, m.Type, m.Name,
+			m.KeySize, m.ValueSize, m.MaxEntries, m.Flags)
+		m.Close()
+	}
+	if err != goebpf.ErrNoMoreIds {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func mapDump(args []string) error {
+	fs := newFlagSet("map dump")
+	id := fs.Int("id", 0, "Map ID")
+	format := fs.String("format", "json", "Output format: json or csv")
+	fs.Parse(args)
+	if *id == 0 {
+		return errors.New("-id is required")
+	}
+
+	var dumpFormat goebpf.DumpFormat
+	switch *format {
+	case "json":
+		dumpFormat = goebpf.DumpFormatJSON
+	case "csv":
+		dumpFormat = goebpf.DumpFormatCSV
+	default:
+		return fmt.Errorf("Unknown format '%s'", *format)
+	}
+
+	m, err := openMap(*id)
+	if err != nil {
+		return err
+	}
+	defer m.Close()
+
+	return m.Dump(os.Stdout, dumpFormat)
+}
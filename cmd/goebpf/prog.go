@@ -0,0 +1,74 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/dropbox/goebpf"
+)
+
+func progList(args []string) error {
+	fs := newFlagSet("prog list")
+	fs.Parse(args)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tTYPE\tNAME\tTAG\tLOADED\tMAPS")
+	id, err := goebpf.GetNextProgramId(0)
+	for ; err == nil; id, err = goebpf.GetNextProgramId(id) {
+		info, err := goebpf.GetProgramInfoById(id)
+		if err != nil {
+			// Program may be unloaded in between
+			continue
+		}
+		fmt.Fprintf(w, "%d\t%v\t%s\t%s\t%s\t%d\n", info.Id, info.Type, info.Name, info.Tag,
+			info.LoadTime.Format("2006-01-02 15:04:05"), len(info.Maps))
+	}
+	if err != goebpf.ErrNoMoreIds {
+		return err
+	}
+
+	return w.Flush()
+}
+
+func progShow(args []string) error {
+	fs := newFlagSet("prog show")
+	id := fs.Int("id", 0, "Program ID")
+	fs.Parse(args)
+	if *id == 0 {
+		return errors.New("-id is required")
+	}
+
+	info, err := goebpf.GetProgramInfoById(*id)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "ID:\t%d\n", info.Id)
+	fmt.Fprintf(w, "Name:\t%s\n", info.Name)
+	fmt.Fprintf(w, "Type:\t%v\n", info.Type)
+	fmt.Fprintf(w, "Tag:\t%s\n", info.Tag)
+	fmt.Fprintf(w, "Loaded at:\t%v\n", info.LoadTime)
+	fmt.Fprintf(w, "Created by UID:\t%d\n", info.CreatedByUid)
+	fmt.Fprintf(w, "Bytecode size:\t%d\n", info.XlatedProgramLen)
+	fmt.Fprintf(w, "JITed size:\t%d\n", info.JitedProgramLen)
+	if info.Ifindex != 0 {
+		fmt.Fprintf(w, "Offloaded to ifindex:\t%d\n", info.Ifindex)
+	}
+	var names []string
+	for name := range info.Maps {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(w, "Map:\t%s (fd %d)\n", name, info.Maps[name].GetFd())
+	}
+
+	return w.Flush()
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/dropbox/goebpf"
+	"github.com/vishvananda/netlink"
+)
+
+var xdpModes = map[string]goebpf.XdpAttachMode{
+	"":        goebpf.XdpAttachModeNone,
+	"generic": goebpf.XdpAttachModeSkb,
+	"skb":     goebpf.XdpAttachModeSkb,
+	"drv":     goebpf.XdpAttachModeDrv,
+	"native":  goebpf.XdpAttachModeDrv,
+	"hw":      goebpf.XdpAttachModeHw,
+	"offload": goebpf.XdpAttachModeHw,
+}
+
+func xdpAttach(args []string) error {
+	fs := newFlagSet("xdp attach")
+	elf := fs.String("elf", "", "clang/llvm compiled binary file")
+	programName := fs.String("program", "", "Name of XDP program (function name)")
+	iface := fs.String("iface", "", "Interface to attach XDP program to")
+	modeName := fs.String("mode", "", "Attach mode: generic / drv / hw, kernel decides if not set")
+	fs.Parse(args)
+	if *elf == "" || *programName == "" || *iface == "" {
+		return errors.New("-elf, -program and -iface are required")
+	}
+	mode, ok := xdpModes[*modeName]
+	if !ok {
+		return fmt.Errorf("Unknown mode '%s'", *modeName)
+	}
+
+	// Hardware offload requires programs / maps to be created on device itself
+	bpf := goebpf.NewDefaultEbpfSystem()
+	if mode == goebpf.XdpAttachModeHw {
+		bpf = goebpf.NewOffloadEbpfSystem(*iface)
+	}
+	if err := bpf.LoadElf(*elf); err != nil {
+		return err
+	}
+	xdp := bpf.GetProgramByName(*programName)
+	if xdp == nil {
+		return fmt.Errorf("Program '%s' not found", *programName)
+	}
+	if xdp.GetType() != goebpf.ProgramTypeXdp {
+		return fmt.Errorf("Program '%s' is %v, not XDP", *programName, xdp.GetType())
+	}
+	if err := xdp.Load(); err != nil {
+		return err
+	}
+	// Attachment outlives process: kernel holds reference to program
+	if err := xdp.Attach(&goebpf.XdpAttachParams{Interface: *iface, Mode: mode}); err != nil {
+		return err
+	}
+	fmt.Printf("XDP program '%s' attached to '%s'\n", *programName, *iface)
+
+	return nil
+}
+
+func xdpDetach(args []string) error {
+	fs := newFlagSet("xdp detach")
+	iface := fs.String("iface", "", "Interface to detach XDP program from")
+	fs.Parse(args)
+	if *iface == "" {
+		return errors.New("-iface is required")
+	}
+
+	link, err := netlink.LinkByName(*iface)
+	if err != nil {
+		return fmt.Errorf("LinkByName() failed: %v", err)
+	}
+	// Program, attached not by this process, is unknown - just remove whatever is attached
+	if err = netlink.LinkSetXdpFd(link, -1); err != nil {
+		return fmt.Errorf("LinkSetXdpFd() failed: %v", err)
+	}
+	fmt.Printf("XDP program detached from '%s'\n", *iface)
+
+	return nil
+}
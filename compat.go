@@ -0,0 +1,273 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// KernelFeature is optional kernel capability application may rely on,
+// see CompatMatrix
+type KernelFeature int
+
+const (
+	FeatureRingBuf KernelFeature = iota + 1
+	FeaturePerfBuffer
+	FeatureXdpLink
+	FeatureXdpNetlink
+	FeatureTcx
+	FeatureTcClsact
+	FeatureFentry
+	FeatureKprobe
+	FeatureMapBatch
+	FeatureMapElement
+	FeatureLRUHash
+	FeatureHash
+	FeatureDevMapHash
+	FeatureDevMap
+	FeatureXdpBroadcast
+	FeatureSpinLock
+	FeatureTimer
+	FeatureAttachCookie
+)
+
+// Kernel version feature appeared in, along with feature to use instead
+// on older kernels (0 if there is no replacement)
+type kernelFeatureInfo struct {
+	name     string
+	version  int
+	fallback KernelFeature
+}
+
+var kernelFeatures = map[KernelFeature]kernelFeatureInfo{
+	FeatureRingBuf:      {"BPF ring buffer", mapTypeKernelVersions[MapTypeRingBuf], FeaturePerfBuffer},
+	FeaturePerfBuffer:   {"Perf event buffer", mapTypeKernelVersions[MapTypePerfEventArray], 0},
+	FeatureXdpLink:      {"XDP BPF link", kernelVersion(5, 9), FeatureXdpNetlink},
+	FeatureXdpNetlink:   {"XDP netlink attach", programTypeKernelVersions[ProgramTypeXdp], 0},
+	FeatureTcx:          {"TCX BPF link", kernelVersion(6, 6), FeatureTcClsact},
+	FeatureTcClsact:     {"tc clsact qdisc", kernelVersion(4, 5), 0},
+	FeatureFentry:       {"fentry / fexit", kernelVersion(5, 5), FeatureKprobe},
+	FeatureKprobe:       {"kprobe", kernelVersion(4, 1), 0},
+	FeatureMapBatch:     {"Map batch operations", kernelVersion(5, 6), FeatureMapElement},
+	FeatureMapElement:   {"Map element operations", mapTypeKernelVersions[MapTypeHash], 0},
+	FeatureLRUHash:      {"LRU Hash map", mapTypeKernelVersions[MapTypeLRUHash], FeatureHash},
+	FeatureHash:         {"Hash map", mapTypeKernelVersions[MapTypeHash], 0},
+	FeatureDevMapHash:   {"DevMap hash map", mapTypeKernelVersions[MapTypeDevMapHash], FeatureDevMap},
+	FeatureDevMap:       {"DevMap map", mapTypeKernelVersions[MapTypeDevMap], 0},
+	FeatureXdpBroadcast: {"XDP broadcast redirect", kernelVersion(5, 13), 0},
+	FeatureSpinLock:     {"bpf_spin_lock", kernelVersion(5, 1), 0},
+	FeatureTimer:        {"bpf_timer", kernelVersion(5, 15), 0},
+	FeatureAttachCookie: {"BPF cookie", kernelVersion(5, 15), 0},
+}
+
+func (f KernelFeature) String() string {
+	if info, ok := kernelFeatures[f]; ok {
+		return info.name
+	}
+	return fmt.Sprintf("KernelFeature(%d)", int(f))
+}
+
+// KernelVersion returns kernel version feature appeared in,
+// KERNEL_VERSION(a, b, c) format
+func (f KernelFeature) KernelVersion() int {
+	return kernelFeatures[f].version
+}
+
+// Fallback returns feature to use instead of f on kernels without it,
+// 0 if there is none
+func (f KernelFeature) Fallback() KernelFeature {
+	return kernelFeatures[f].fallback
+}
+
+// CompatMatrix tells which features are available on target kernel and
+// picks fallbacks for missing ones, so single binary runs on fleet of
+// kernels (e.g. 4.19 to 6.x):
+//
+//	compat, err := goebpf.DetectCompatMatrix()
+//	plan := compat.Plan(goebpf.FeatureRingBuf, goebpf.FeatureXdpLink, goebpf.FeatureTimer)
+//	if plan.Selected(goebpf.FeatureRingBuf) == goebpf.FeaturePerfBuffer {
+//		// Read events by goebpf_perf instead of RingBufReader
+//	}
+//	for _, f := range plan.Unavailable() {
+//		log.Printf("%v is not available, feature disabled", f)
+//	}
+//
+// Matrix of running kernel (DetectCompatMatrix) probes features, so ones
+// backported by distribution or disabled by configuration are detected.
+// Matrix of target kernel (NewCompatMatrix) decides availability by kernel
+// version, use SetSupported() for features known to be backported.
+type CompatMatrix struct {
+	// Kernel version in KERNEL_VERSION(a, b, c) format
+	Version   int
+	overrides map[KernelFeature]bool
+}
+
+// NewCompatMatrix creates matrix of target kernel version, KERNEL_VERSION(a, b, c)
+// format, e.g. from ParseKernelRelease("4.19.0"). Availability of features
+// is decided by version only.
+func NewCompatMatrix(version int) *CompatMatrix {
+	return &CompatMatrix{
+		Version:   version,
+		overrides: make(map[KernelFeature]bool),
+	}
+}
+
+// DetectCompatMatrix creates matrix of running kernel: features are probed
+// by test-creating maps / programs / links. Features which can't be probed
+// (or probe is inconclusive, e.g. without CAP_BPF) are decided by version.
+func DetectCompatMatrix() (*CompatMatrix, error) {
+	version, err := GetKernelVersion()
+	if err != nil {
+		return nil, err
+	}
+	c := NewCompatMatrix(version)
+	for f, probe := range featureProbes {
+		if supported, err := probe(version); err == nil {
+			c.overrides[f] = supported
+		}
+	}
+	return c, nil
+}
+
+// ParseKernelRelease converts kernel release (e.g. "5.4.0-42-generic",
+// "uname -r" of target host) into KERNEL_VERSION(a, b, c) format
+func ParseKernelRelease(release string) (int, error) {
+	return parseKernelVersion(release)
+}
+
+// SetSupported overrides availability of feature decided by kernel version
+// or probe, e.g. for features backported by distribution or disabled by configuration
+func (c *CompatMatrix) SetSupported(f KernelFeature, supported bool) {
+	c.overrides[f] = supported
+}
+
+// Supported checks if target kernel has feature
+func (c *CompatMatrix) Supported(f KernelFeature) bool {
+	if supported, ok := c.overrides[f]; ok {
+		return supported
+	}
+	info, ok := kernelFeatures[f]
+	return ok && c.Version >= info.version
+}
+
+// Resolve returns f if it is supported, first supported fallback of f
+// otherwise. Fails with error matching ErrNotSupported if there is none.
+func (c *CompatMatrix) Resolve(f KernelFeature) (KernelFeature, error) {
+	for item := f; item != 0; item = item.Fallback() {
+		if c.Supported(item) {
+			return item, nil
+		}
+	}
+	return 0, &NotSupportedError{
+		Feature: fmt.Sprintf("%v (linux %s) on linux %s", f, KernelVersionString(f.KernelVersion()),
+			KernelVersionString(c.Version)),
+	}
+}
+
+// Plan resolves all requested features, see CompatPlan
+func (c *CompatMatrix) Plan(features ...KernelFeature) *CompatPlan {
+	plan := &CompatPlan{Version: c.Version}
+	for _, f := range features {
+		selected, _ := c.Resolve(f)
+		plan.Decisions = append(plan.Decisions, CompatDecision{Requested: f, Selected: selected})
+	}
+	return plan
+}
+
+// Unmet returns requirements target kernel doesn't satisfy,
+// e.g. requirements of ELF file (see ElfReport.Requirements)
+func (c *CompatMatrix) Unmet(reqs []KernelRequirement) []KernelRequirement {
+	var res []KernelRequirement
+	for _, req := range reqs {
+		if req.Version > c.Version {
+			res = append(res, req)
+		}
+	}
+	return res
+}
+
+// CompatDecision is feature requested from CompatMatrix along with one
+// selected for target kernel: itself, its fallback or 0 if unavailable
+type CompatDecision struct {
+	Requested KernelFeature
+	Selected  KernelFeature
+}
+
+func (d CompatDecision) String() string {
+	switch d.Selected {
+	case 0:
+		return fmt.Sprintf("%v: unavailable", d.Requested)
+	case d.Requested:
+		return fmt.Sprintf("%v: supported", d.Requested)
+	}
+	return fmt.Sprintf("%v: fallback to %v", d.Requested, d.Selected)
+}
+
+// CompatPlan is outcome of CompatMatrix.Plan()
+type CompatPlan struct {
+	Version   int
+	Decisions []CompatDecision
+}
+
+// Selected returns feature selected instead of requested f,
+// 0 if f is unavailable or was not requested
+func (p *CompatPlan) Selected(f KernelFeature) KernelFeature {
+	for _, d := range p.Decisions {
+		if d.Requested == f {
+			return d.Selected
+		}
+	}
+	return 0
+}
+
+// Unavailable returns requested features without supported fallback, sorted
+func (p *CompatPlan) Unavailable() []KernelFeature {
+	var res []KernelFeature
+	for _, d := range p.Decisions {
+		if d.Selected == 0 {
+			res = append(res, d.Requested)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
+
+// Fallbacks returns decisions where fallback is used instead of requested feature
+func (p *CompatPlan) Fallbacks() []CompatDecision {
+	var res []CompatDecision
+	for _, d := range p.Decisions {
+		if d.Selected != 0 && d.Selected != d.Requested {
+			res = append(res, d)
+		}
+	}
+	return res
+}
+
+// Err returns error matching ErrNotSupported listing unavailable features,
+// nil if all requested features (or their fallbacks) are available
+func (p *CompatPlan) Err() error {
+	unavailable := p.Unavailable()
+	if len(unavailable) == 0 {
+		return nil
+	}
+	names := make([]string, 0, len(unavailable))
+	for _, f := range unavailable {
+		names = append(names, f.String())
+	}
+	return &NotSupportedError{
+		Feature: fmt.Sprintf("%s on linux %s", strings.Join(names, ", "), KernelVersionString(p.Version)),
+	}
+}
+
+func (p *CompatPlan) String() string {
+	lines := make([]string, 0, len(p.Decisions))
+	for _, d := range p.Decisions {
+		lines = append(lines, d.String())
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,196 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// Attach type of link probed by DetectCompatMatrix(), enum bpf_attach_type
+const bpfAttachTypeTcxIngress = 46
+
+// Probe checks if running kernel (version) has feature by test-creating
+// map / program / link. Error means probe is inconclusive (e.g. lack of
+// privileges), so availability is decided by kernel version.
+type featureProbe func(version int) (bool, error)
+
+// Features which can't be probed safely (e.g. need BTF of map value, program
+// run or attach to real device, like XDP link) are absent, they are decided
+// by kernel version
+var featureProbes = map[KernelFeature]featureProbe{
+	FeatureRingBuf: func(int) (bool, error) {
+		return probeMap(MapTypeRingBuf, 0, 0, os.Getpagesize())
+	},
+	FeaturePerfBuffer: func(int) (bool, error) {
+		return probeMap(MapTypePerfEventArray, 4, 4, 1)
+	},
+	FeatureXdpNetlink: probeProgramType(ProgramTypeXdp),
+	FeatureTcx:        probeTcx,
+	FeatureTcClsact:   probeProgramType(ProgramTypeSchedCls),
+	FeatureFentry:     probeFentry,
+	FeatureKprobe:     probeProgramType(ProgramTypeKprobe),
+	FeatureMapBatch:   probeMapBatch,
+	FeatureMapElement: func(int) (bool, error) {
+		return probeMap(MapTypeHash, 4, 4, 1)
+	},
+	FeatureLRUHash: func(int) (bool, error) {
+		return probeMap(MapTypeLRUHash, 4, 4, 1)
+	},
+	FeatureHash: func(int) (bool, error) {
+		return probeMap(MapTypeHash, 4, 4, 1)
+	},
+	FeatureDevMapHash: func(int) (bool, error) {
+		return probeMap(MapTypeDevMapHash, 4, 4, 1)
+	},
+	FeatureDevMap: func(int) (bool, error) {
+		return probeMap(MapTypeDevMap, 4, 4, 1)
+	},
+	FeatureAttachCookie: probeAttachCookie,
+}
+
+// Converts error of test-created object into probe outcome: kernel rejects
+// unknown map / program / attach types and helpers by EINVAL (E2BIG for
+// attributes it doesn't know), other errors make probe inconclusive
+func probeResult(err error) (bool, error) {
+	switch err {
+	case nil:
+		return true, nil
+	case syscall.EINVAL, syscall.E2BIG, syscall.EOPNOTSUPP, errnoENOTSUPP:
+		return false, nil
+	}
+	return false, err
+}
+
+func probeMap(mapType MapType, keySize, valueSize, maxEntries int) (bool, error) {
+	fd, err := probeCreateMap(mapType, keySize, valueSize, maxEntries)
+	if err != nil {
+		return probeResult(err)
+	}
+	closeFd(fd)
+	return true, nil
+}
+
+func probeCreateMap(mapType MapType, keySize, valueSize, maxEntries int) (int, error) {
+	attr := bpfMapCreateAttr{
+		mapType:    uint32(mapType),
+		keySize:    uint32(keySize),
+		valueSize:  uint32(valueSize),
+		maxEntries: uint32(maxEntries),
+	}
+	return bpfSyscall(bpfCmdMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// Loads program of type running insns (returning 0 by default)
+func probeLoadProgram(progType ProgramType, version int, attachType, attachBtfID int, insns ...Instruction) (int, error) {
+	insns = append(insns, Mov64Imm(R0, 0), Exit())
+	bytecode, err := Instructions(insns).Assemble()
+	if err != nil {
+		return 0, err
+	}
+	attr := bpfProgLoadAttr{
+		progType:           uint32(progType),
+		insnCnt:            uint32(len(bytecode) / bpfInstructionLen),
+		insns:              newBpfPointer(unsafe.Pointer(&bytecode[0])),
+		license:            newBpfPointer(cString("GPL")),
+		kernVersion:        uint32(version),
+		expectedAttachType: uint32(attachType),
+		attachBtfID:        uint32(attachBtfID),
+	}
+	return bpfSyscall(bpfCmdProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func probeProgramType(progType ProgramType) featureProbe {
+	return func(version int) (bool, error) {
+		fd, err := probeLoadProgram(progType, version, 0, 0)
+		if err != nil {
+			return probeResult(err)
+		}
+		closeFd(fd)
+		return true, nil
+	}
+}
+
+// Creates link of program to target, returns raw errno
+func probeCreateLink(progFd, targetFd, attachType int) error {
+	attr := bpfLinkCreateAttr{
+		progFd:     uint32(progFd),
+		targetFd:   uint32(targetFd),
+		attachType: uint32(attachType),
+	}
+	fd, err := bpfSyscall(bpfCmdLinkCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == nil {
+		closeFd(fd)
+	}
+	return err
+}
+
+// TCX link to device index 0 fails by ENODEV once kernel knows attach type
+func probeTcx(version int) (bool, error) {
+	progFd, err := probeLoadProgram(ProgramTypeSchedCls, version, 0, 0)
+	if err != nil {
+		return false, err
+	}
+	defer closeFd(progFd)
+
+	err = probeCreateLink(progFd, 0, bpfAttachTypeTcxIngress)
+	if err == syscall.ENODEV {
+		return true, nil
+	}
+	return probeResult(err)
+}
+
+// Loads fentry program of bpf_fentry_test1(), kernel function
+// existing for BPF selftests
+func probeFentry(version int) (bool, error) {
+	btfID, err := kernelFuncBtfID("", "bpf_fentry_test1")
+	if err != nil {
+		if errors.Is(err, ErrNotSupported) {
+			// fentry requires kernel BTF
+			return false, nil
+		}
+		return false, err
+	}
+	fd, err := probeLoadProgram(ProgramTypeTracing, version, bpfAttachTypeTraceFentry, btfID)
+	if err != nil {
+		return probeResult(err)
+	}
+	closeFd(fd)
+	return true, nil
+}
+
+// Empty map reports ENOENT by batch lookup once kernel has batch operations
+func probeMapBatch(int) (bool, error) {
+	mapFd, err := probeCreateMap(MapTypeHash, 4, 4, 1)
+	if err != nil {
+		return false, err
+	}
+	defer closeFd(mapFd)
+
+	var batch, key, value [4]byte
+	attr := bpfMapBatchAttr{
+		outBatch: newBpfPointer(unsafe.Pointer(&batch[0])),
+		keys:     newBpfPointer(unsafe.Pointer(&key[0])),
+		values:   newBpfPointer(unsafe.Pointer(&value[0])),
+		count:    1,
+		mapFd:    uint32(mapFd),
+	}
+	_, err = bpfSyscall(bpfCmdMapLookupBatch, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err == syscall.ENOENT {
+		return true, nil
+	}
+	return probeResult(err)
+}
+
+// Loads kprobe program calling bpf_get_attach_cookie()
+func probeAttachCookie(version int) (bool, error) {
+	fd, err := probeLoadProgram(ProgramTypeKprobe, version, 0, 0, Call(HelperGetAttachCookie))
+	if err != nil {
+		return probeResult(err)
+	}
+	closeFd(fd)
+	return true, nil
+}
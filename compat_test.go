@@ -0,0 +1,121 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKernelFeatures(t *testing.T) {
+	for f := FeatureRingBuf; f <= FeatureAttachCookie; f++ {
+		info, ok := kernelFeatures[f]
+		require.True(t, ok, int(f))
+		assert.NotZero(t, info.version, f.String())
+		// Fallback is always available on older kernels
+		if fallback := f.Fallback(); fallback != 0 {
+			assert.Less(t, fallback.KernelVersion(), f.KernelVersion(), f.String())
+		}
+	}
+	assert.Equal(t, "BPF ring buffer", FeatureRingBuf.String())
+	assert.Equal(t, "KernelFeature(100)", KernelFeature(100).String())
+}
+
+func TestCompatMatrix(t *testing.T) {
+	version, err := ParseKernelRelease("4.19.0-17-amd64")
+	require.NoError(t, err)
+	c := NewCompatMatrix(version)
+
+	assert.True(t, c.Supported(FeaturePerfBuffer))
+	assert.False(t, c.Supported(FeatureRingBuf))
+	assert.False(t, c.Supported(KernelFeature(100)))
+
+	f, err := c.Resolve(FeatureRingBuf)
+	assert.NoError(t, err)
+	assert.Equal(t, FeaturePerfBuffer, f)
+	f, err = c.Resolve(FeatureTcx)
+	assert.NoError(t, err)
+	assert.Equal(t, FeatureTcClsact, f)
+	_, err = c.Resolve(FeatureTimer)
+	assert.True(t, errors.Is(err, ErrNotSupported))
+	assert.EqualError(t, err, "bpf_timer (linux 5.15.0) on linux 4.19.0 is not supported")
+
+	// Backported by distribution
+	c.SetSupported(FeatureRingBuf, true)
+	f, err = c.Resolve(FeatureRingBuf)
+	assert.NoError(t, err)
+	assert.Equal(t, FeatureRingBuf, f)
+
+	version, err = ParseKernelRelease("6.8.0")
+	require.NoError(t, err)
+	c = NewCompatMatrix(version)
+	for f := FeatureRingBuf; f <= FeatureAttachCookie; f++ {
+		assert.True(t, c.Supported(f), f.String())
+	}
+	// Disabled by configuration
+	c.SetSupported(FeatureXdpLink, false)
+	f, err = c.Resolve(FeatureXdpLink)
+	assert.NoError(t, err)
+	assert.Equal(t, FeatureXdpNetlink, f)
+}
+
+func TestCompatPlan(t *testing.T) {
+	plan := NewCompatMatrix(kernelVersion(5, 4)).Plan(FeatureRingBuf, FeatureXdpLink, FeatureSpinLock,
+		FeatureTimer, FeatureXdpBroadcast)
+	assert.Equal(t, FeaturePerfBuffer, plan.Selected(FeatureRingBuf))
+	assert.Equal(t, FeatureXdpNetlink, plan.Selected(FeatureXdpLink))
+	assert.Equal(t, FeatureSpinLock, plan.Selected(FeatureSpinLock))
+	assert.Equal(t, KernelFeature(0), plan.Selected(FeatureTimer))
+	assert.Equal(t, KernelFeature(0), plan.Selected(FeatureTcx))
+	assert.Equal(t, []KernelFeature{FeatureXdpBroadcast, FeatureTimer}, plan.Unavailable())
+	assert.Equal(t, []CompatDecision{
+		{Requested: FeatureRingBuf, Selected: FeaturePerfBuffer},
+		{Requested: FeatureXdpLink, Selected: FeatureXdpNetlink},
+	}, plan.Fallbacks())
+	assert.Equal(t, "BPF ring buffer: fallback to Perf event buffer\n"+
+		"XDP BPF link: fallback to XDP netlink attach\n"+
+		"bpf_spin_lock: supported\n"+
+		"bpf_timer: unavailable\n"+
+		"XDP broadcast redirect: unavailable", plan.String())
+
+	err := plan.Err()
+	assert.True(t, errors.Is(err, ErrNotSupported))
+	assert.EqualError(t, err, "XDP broadcast redirect, bpf_timer on linux 5.4.0 is not supported")
+	assert.NoError(t, NewCompatMatrix(kernelVersion(6, 1)).Plan(FeatureRingBuf, FeatureTimer).Err())
+}
+
+func TestCompatMatrixUnmet(t *testing.T) {
+	reqs := []KernelRequirement{
+		{Feature: "Hash map", Version: kernelVersion(3, 19)},
+		{Feature: "Ring buffer map", Version: kernelVersion(5, 8)},
+	}
+	assert.Equal(t, reqs[1:], NewCompatMatrix(kernelVersion(4, 19)).Unmet(reqs))
+	assert.Empty(t, NewCompatMatrix(kernelVersion(5, 8)).Unmet(reqs))
+}
+
+func TestProbeResult(t *testing.T) {
+	supported, err := probeResult(nil)
+	assert.NoError(t, err)
+	assert.True(t, supported)
+	// Unknown map / program type, helper, attributes
+	for _, errno := range []error{syscall.EINVAL, syscall.E2BIG, syscall.EOPNOTSUPP, errnoENOTSUPP} {
+		supported, err = probeResult(errno)
+		assert.NoError(t, err)
+		assert.False(t, supported)
+	}
+	// Inconclusive
+	_, err = probeResult(syscall.EPERM)
+	assert.Equal(t, syscall.EPERM, err)
+}
+
+func TestFeatureProbesNoDeviceAttach(t *testing.T) {
+	// XDP link can be probed only by attaching to real device, which would
+	// disturb traffic of host, so it is decided by version
+	_, probed := featureProbes[FeatureXdpLink]
+	assert.False(t, probed)
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// XdpRedirectFlags are flags of bpf_redirect_map() for DevMap / DevMapHash maps
+type XdpRedirectFlags uint64
+
+const (
+	// XdpRedirectBroadcast sends packet to every interface in map, not only
+	// to one at key (BPF_F_BROADCAST, linux 5.13+)
+	XdpRedirectBroadcast XdpRedirectFlags = 1 << 3
+	// XdpRedirectExcludeIngress skips interface packet came from when
+	// broadcasting (BPF_F_EXCLUDE_INGRESS, linux 5.13+)
+	XdpRedirectExcludeIngress XdpRedirectFlags = 1 << 4
+)
+
+func (f XdpRedirectFlags) String() string {
+	var res []string
+	if f&XdpRedirectBroadcast != 0 {
+		res = append(res, "BPF_F_BROADCAST")
+	}
+	if f&XdpRedirectExcludeIngress != 0 {
+		res = append(res, "BPF_F_EXCLUDE_INGRESS")
+	}
+	if rest := f &^ (XdpRedirectBroadcast | XdpRedirectExcludeIngress); rest != 0 || len(res) == 0 {
+		res = append(res, fmt.Sprintf("0x%x", uint64(rest)))
+	}
+	return strings.Join(res, "|")
+}
+
+// DevMap manages interfaces of DevMap / DevMapHash map, i.e. ports XDP program
+// redirects packets to by bpf_redirect_map(). With XdpRedirectBroadcast map
+// becomes multicast group: packet is sent to all its interfaces at once.
+//
+//	struct bpf_map_def SEC("maps") group = {
+//		.map_type = BPF_MAP_TYPE_DEVMAP_HASH,
+//		.key_size = sizeof(__u32),
+//		.value_size = sizeof(__u32),
+//		.max_entries = 64,
+//	};
+//
+//	SEC("xdp")
+//	int flood(struct xdp_md *ctx) {
+//		return bpf_redirect_map(&group, 0, BPF_F_BROADCAST | BPF_F_EXCLUDE_INGRESS);
+//	}
+//
+// Go side:
+//
+//	group, err := goebpf.NewDevMap(bpf.GetMapByName("group").(*goebpf.EbpfMap))
+//	err = group.Join("eth1")
+//	err = group.Join("eth2")
+//	...
+//	err = group.Leave("eth2")
+//
+// Interfaces must be in network namespace of calling thread.
+// Values are plain ifindexes: egress programs (struct bpf_devmap_val) are not supported.
+type DevMap struct {
+	m *EbpfMap
+}
+
+// NewDevMap creates helper for DevMap / DevMapHash map with __u32 keys and values
+// of ifindex (4 bytes) or struct bpf_devmap_val (8 bytes)
+func NewDevMap(m *EbpfMap) (*DevMap, error) {
+	if m.Type != MapTypeDevMap && m.Type != MapTypeDevMapHash {
+		return nil, fmt.Errorf("Map '%s' (%v) is not DevMap / DevMapHash", m.Name, m.Type)
+	}
+	if m.KeySize != 4 {
+		return nil, fmt.Errorf("Map '%s' key size is %d, expected 4 (__u32)", m.Name, m.KeySize)
+	}
+	if m.ValueSize != 4 && m.ValueSize != 8 {
+		return nil, fmt.Errorf("Map '%s' value size is %d, expected 4 (ifindex) or 8 (struct bpf_devmap_val)",
+			m.Name, m.ValueSize)
+	}
+
+	return &DevMap{m: m}, nil
+}
+
+// Map returns underlying map
+func (d *DevMap) Map() *EbpfMap {
+	return d.m
+}
+
+// SetIfindex makes key to redirect packets to interface ifindex
+func (d *DevMap) SetIfindex(key uint32, ifindex int) error {
+	if ifindex <= 0 {
+		return fmt.Errorf("Invalid ifindex %d", ifindex)
+	}
+	// struct bpf_devmap_val is ifindex followed by egress program fd, none if 0
+	value := make([]byte, d.m.ValueSize)
+	hostByteOrder.PutUint32(value, uint32(ifindex))
+
+	return d.m.Upsert(key, value)
+}
+
+// Set makes key to redirect packets to interface ifname
+func (d *DevMap) Set(key uint32, ifname string) error {
+	ifindex, err := devMapIfindex(ifname)
+	if err != nil {
+		return err
+	}
+	return d.SetIfindex(key, ifindex)
+}
+
+// Remove removes interface at key, no-op if there is none
+func (d *DevMap) Remove(key uint32) error {
+	err := d.m.Delete(key)
+	if err != nil && !errors.Is(err, ErrKeyNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Interfaces returns ifindexes of interfaces in map by keys
+func (d *DevMap) Interfaces() (map[uint32]int, error) {
+	res := make(map[uint32]int)
+	key, err := d.m.GetNextKey(nil)
+	for ; err == nil; key, err = d.m.GetNextKey(key) {
+		value, err := d.m.Lookup(key)
+		if err != nil {
+			// Element may be deleted in between
+			continue
+		}
+		res[hostByteOrder.Uint32(key)] = int(hostByteOrder.Uint32(value))
+	}
+	if err != ErrNoMoreKeys {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Join adds interface to map keyed by its ifindex, so map can be used as
+// multicast group (see XdpRedirectBroadcast). DevMap (array) must have
+// MaxEntries above largest ifindex, DevMapHash has no such limit.
+func (d *DevMap) Join(ifname string) error {
+	ifindex, err := devMapIfindex(ifname)
+	if err != nil {
+		return err
+	}
+	return d.SetIfindex(uint32(ifindex), ifindex)
+}
+
+// Leave removes interface added by Join(), no-op if it is not in map
+func (d *DevMap) Leave(ifname string) error {
+	ifindex, err := devMapIfindex(ifname)
+	if err != nil {
+		return err
+	}
+	return d.Remove(uint32(ifindex))
+}
+
+// Members returns sorted ifindexes of all interfaces in map
+func (d *DevMap) Members() ([]int, error) {
+	ifaces, err := d.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]int, 0, len(ifaces))
+	for _, ifindex := range ifaces {
+		res = append(res, ifindex)
+	}
+	sort.Ints(res)
+
+	return res, nil
+}
+
+// Resolves interface name into ifindex
+func devMapIfindex(ifname string) (int, error) {
+	iface, err := netlink.LinkByName(ifname)
+	RecordAudit(AuditSourceNetlink, "LinkByName", ifname, err)
+	if err != nil {
+		return 0, fmt.Errorf("LinkByName() failed: %v", err)
+	}
+	return iface.Attrs().Index, nil
+}
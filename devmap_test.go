@@ -0,0 +1,34 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXdpRedirectFlags(t *testing.T) {
+	assert.Equal(t, "BPF_F_BROADCAST|BPF_F_EXCLUDE_INGRESS", (XdpRedirectBroadcast | XdpRedirectExcludeIngress).String())
+	assert.Equal(t, "BPF_F_BROADCAST", XdpRedirectBroadcast.String())
+	assert.Equal(t, "BPF_F_EXCLUDE_INGRESS|0x1", (XdpRedirectExcludeIngress | 1).String())
+	assert.Equal(t, "0x0", XdpRedirectFlags(0).String())
+}
+
+func TestNewDevMapInvalid(t *testing.T) {
+	for _, m := range []*EbpfMap{
+		{Name: "ports", Type: MapTypeHash, KeySize: 4, ValueSize: 4, MaxEntries: 4},
+		{Name: "ports", Type: MapTypeDevMapHash, KeySize: 8, ValueSize: 4, MaxEntries: 4},
+		{Name: "ports", Type: MapTypeDevMap, KeySize: 4, ValueSize: 6, MaxEntries: 4},
+	} {
+		d, err := NewDevMap(m)
+		assert.Error(t, err)
+		assert.Nil(t, d)
+	}
+
+	d, err := NewDevMap(&EbpfMap{Name: "ports", Type: MapTypeDevMapHash, KeySize: 4, ValueSize: 8, MaxEntries: 4})
+	assert.NoError(t, err)
+	assert.Error(t, d.SetIfindex(1, 0))
+	assert.Error(t, d.Join("nonexisting0"))
+}
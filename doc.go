@@ -4,7 +4,7 @@
 /*
 Package goebpf provides simple and convenient interface to Linux eBPF system.
 
-Overview
+# Overview
 
 Extended Berkeley Packet Filter (eBPF) is a highly flexible and efficient virtual machine
 in the Linux kernel allowing to execute bytecode at various hook points in a safe manner.
@@ -19,7 +19,7 @@ Currently supported functionality:
 - Provides simple interface to interact with eBPF maps
 - Has mock versions of eBPF objects (program, map, etc) in order to make writing unittests simple.
 
-XDP
+# XDP
 
 eXpress Data Path - provides a bare metal, high performance, programmable packet processing
 at the closest at possible point to network driver. That makes it ideal for speed without
@@ -68,10 +68,9 @@ Once compiled can be used by goebpf in the following way:
 
 	// Interact with program is simply done through maps:
 	drops := bpf.GetMapByName("drops") // name also matches BPF_MAP_ADD(drops)
-	val, err := drops.LookupInt(0) // Get value from map at index 0
+	val, err := drops.LookupUint64(uint32(0)) // Get value from map at index 0
 	if err == nil {
 	    fmt.Printf("Drops: %d\n", val)
 	}
-
 */
 package goebpf
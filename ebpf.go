@@ -3,8 +3,15 @@
 
 package goebpf
 
+import (
+	"math"
+	"sync"
+)
+
 // System defines interface for eBPF system - top level
-// interface to interact with eBPF system
+// interface to interact with eBPF system.
+// All methods are safe for concurrent use: getters may be called while
+// another goroutine re-reads ELF file with LoadElf().
 type System interface {
 	// Read previously compiled eBPF program
 	LoadElf(fn string) error
@@ -16,6 +23,16 @@ type System interface {
 	GetPrograms() map[string]Program
 	// Returns Program or nil if not found
 	GetProgramByName(name string) Program
+	// Set logger for debug / trace messages (e.g. *log.Logger)
+	SetLogger(l Logger)
+	// Unload all programs / destroy all maps read by LoadElf()
+	Close() error
+	// Replace programs / maps by ones from new ELF file, keeping map data
+	// and moving attachments of programs to new ones
+	Reload(fn string) error
+	// Returns parts of ELF skipped by last LoadElf() / Reload() as unsupported,
+	// see WithElfCompatibility()
+	GetElfWarnings() []ElfWarning
 }
 
 // Program defines eBPF program interface
@@ -25,11 +42,17 @@ type Program interface {
 	// Pin (save, share) program into given location.
 	// Location must be mounted as bpffs (mount bpffs -t bpffs /some/location)
 	Pin(path string) error
-	// Unload program from kernel
+	// Unload program from kernel, does nothing if program is not loaded
 	Close() error
 	// Attach program to something - depends on program type.
-	// - XDP: Attach to network interface (data - iface name, e.g. "eth0")
+	// - XDP: Attach to network interface (data - iface name, e.g. "eth0" or *XdpAttachParams)
 	// - SocketFilter: Attach to socket (data - socket fd)
+	// - SockOps: Attach to cgroup v2 (data - cgroup path or SockOpsAttachParams)
+	// - Tracepoint: Attach to tracepoint (data - "category/name" or TracepointAttachParams)
+	// - CgroupSkb: Attach to cgroup v2 (data - CgroupSkbAttachParams)
+	// - SkLookup: Attach to network namespace (data - path, SkLookupAttachParams or nil for own one)
+	// - LwtIn / LwtOut / LwtXmit / LwtSeg6Local: Add (or replace) route running program (data - LwtAttachParams)
+	// - LSM: Attach to LSM hook program was loaded for (data - ignored)
 	Attach(data interface{}) error
 	// Detach previously attached program
 	Detach() error
@@ -57,7 +80,7 @@ type Map interface {
 	// Generic lookup. Accepts any type which will be
 	// converted to []byte eventually, returns bytes
 	Lookup(interface{}) ([]byte, error)
-	// The same, but does casting of return value to int / uint64
+	// The same, but does casting of return value to int (deprecated, width is implicit) / uint64
 	LookupInt(interface{}) (int, error)
 	LookupUint64(interface{}) (uint64, error)
 	// The same, but does casting of return value to string
@@ -66,47 +89,195 @@ type Map interface {
 	Update(interface{}, interface{}) error
 	Upsert(interface{}, interface{}) error
 	Delete(interface{}) error
+	// Returns key next to given one, nil - to get first key.
+	// Returns ErrNoMoreKeys when all keys enumerated.
+	GetNextKey(interface{}) ([]byte, error)
 }
 
 const (
-	// Maximum buffer size for kernel's eBPF verifier error log messages
-	logBufferSize = (256 * 1024)
+	// Initial buffer size for kernel's eBPF verifier log messages,
+	// grown up to maxLogBufferSize when log does not fit
+	logBufferSize    = (256 * 1024)
+	maxLogBufferSize = math.MaxUint32 >> 2
 )
 
 // System implementation
 type ebpfSystem struct {
+	// Guards maps / programs / logger. LoadElf() holds write lock for
+	// the whole load, so readers never observe partially loaded ELF
+	mu sync.RWMutex
+
 	Programs map[string]Program // eBPF programs by name
 	Maps     map[string]Map     // eBPF maps defined by Progs by name
+
+	// Hardware offload: name of network interface (SmartNIC) where
+	// all maps / programs from ELF will be created on
+	offloadIfname string
+	// Destination for debug messages
+	logger Logger
+	// Where persistent maps live, see WithBpffsRoot()
+	bpffsRoot string
+	// Location of persistent maps overriding ELF, see WithPinPathTemplate()
+	pinPathTemplate string
+	// Location of kernel BTF
+	btfPath string
+	// max_entries overrides of ELF defined maps by map name
+	mapMaxEntries map[string]int
+	// Pin policy of persistent maps: default one and overrides by map name,
+	// migration functions (MapPinMigrate) by map name
+	mapPinPolicy   MapPinPolicy
+	mapPinPolicies map[string]MapPinPolicy
+	mapMigrations  map[string]MapMigrateFunc
+	// Kernel properties, zero values are detected at runtime
+	features KernelFeatures
+	// Read ELF only, do not create any kernel objects
+	parseOnly bool
+	// Max number of programs loaded concurrently by Reload()
+	loadParallelism int
+	// Selective loading: programs / maps to read from ELF, nil means all
+	programFilter func(name string) bool
+	mapFilter     func(name string) bool
+	// Programs loaded into kernel by LoadElf(), see WithAutoload()
+	autoload       bool
+	autoloadFilter func(name string) bool
+	// BPF token all maps / programs are created with, see WithToken()
+	tokenFd int
+	// Verifier log level of programs: default one and overrides by program name
+	verifierLogLevel  VerifierLogLevel
+	verifierLogLevels map[string]VerifierLogLevel
+	// How unsupported parts of ELF are treated / what was skipped by last load
+	elfCompat   ElfCompatibility
+	elfWarnings []ElfWarning
+	// Restrictions of ELF contents, see WithElfPolicy()
+	elfPolicy *ElfPolicy
+	// Approval of ELF files before they are read, see WithElfVerifier()
+	elfVerifier ElfVerifier
+}
+
+// NewDefaultEbpfSystem creates default eBPF system.
+// Behavior can be customized by options, e.g.
+//
+//	bpf := goebpf.NewDefaultEbpfSystem(
+//		goebpf.WithLogger(log.New(os.Stderr, "", 0)),
+//		goebpf.WithMapMaxEntries("blacklist", 65536),
+//	)
+func NewDefaultEbpfSystem(opts ...Option) System {
+	s := &ebpfSystem{
+		Programs:        make(map[string]Program),
+		Maps:            make(map[string]Map),
+		logger:          nopLogger{},
+		bpffsRoot:       DefaultBpffsRoot,
+		btfPath:         DefaultBtfPath,
+		mapMaxEntries:   make(map[string]int),
+		mapPinPolicies:  make(map[string]MapPinPolicy),
+		mapMigrations:   make(map[string]MapMigrateFunc),
+		loadParallelism: 1,
+
+		verifierLogLevels: make(map[string]VerifierLogLevel),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s
+}
+
+// NewOffloadEbpfSystem creates eBPF system which offloads all maps and programs
+// read by LoadElf() into network device (SmartNIC) ifname.
+// Programs loaded this way can be attached only with XdpAttachModeHw to the same device.
+func NewOffloadEbpfSystem(ifname string, opts ...Option) System {
+	return NewDefaultEbpfSystem(append(opts, WithOffload(ifname))...)
+}
+
+// SetLogger sets destination for debug messages of loader and all programs
+// read by LoadElf(). By default nothing is logged.
+func (s *ebpfSystem) SetLogger(l Logger) {
+	if l == nil {
+		l = nopLogger{}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logger = l
+}
+
+// Close unloads all programs and destroys all maps read by LoadElf().
+// Attached XDP / socket filter programs stay attached - kernel keeps them alive
+// until Detach(), perf event programs are detached since their events are closed.
+// It is safe to call Close() multiple times.
+func (s *ebpfSystem) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var result error
+	for _, prog := range s.Programs {
+		if err := prog.Close(); err != nil && result == nil {
+			result = err
+		}
+	}
+	if err := closeMaps(s.Maps, nil); err != nil && result == nil {
+		result = err
+	}
+	s.Programs = make(map[string]Program)
+	s.Maps = make(map[string]Map)
+
+	return result
 }
 
-// NewDefaultEbpfSystem creates default eBPF system
-func NewDefaultEbpfSystem() System {
-	return &ebpfSystem{
-		Programs: make(map[string]Program),
-		Maps:     make(map[string]Map),
+// Helper to destroy all given maps except ones present in keep, returns first error
+func closeMaps(maps map[string]Map, keep map[string]Map) error {
+	var result error
+	for name, m := range maps {
+		if keep[name] == m {
+			continue
+		}
+		if err := m.Close(); err != nil && result == nil {
+			result = err
+		}
 	}
+	return result
 }
 
 // GetMaps returns all maps found in .elf file
 func (s *ebpfSystem) GetMaps() map[string]Map {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	return s.Maps
 }
 
 // GetPrograms returns all eBPF programs found in .elf file
 func (s *ebpfSystem) GetPrograms() map[string]Program {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	return s.Programs
 }
 
 // GetMapByName returns eBPF map by given name
 func (s *ebpfSystem) GetMapByName(name string) Map {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	if result, ok := s.Maps[name]; ok {
 		return result
 	}
 	return nil
 }
 
+// GetElfWarnings returns parts of ELF skipped by last LoadElf() / Reload()
+func (s *ebpfSystem) GetElfWarnings() []ElfWarning {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.elfWarnings
+}
+
 // GetProgramByName returns eBPF program by given name
 func (s *ebpfSystem) GetProgramByName(name string) Program {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
 	if result, ok := s.Programs[name]; ok {
 		return result
 	}
@@ -0,0 +1,31 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSystemClose(t *testing.T) {
+	s := NewDefaultEbpfSystem().(*ebpfSystem)
+	// Objects read by LoadElf() but never created / loaded
+	s.Maps["map1"] = &EbpfMap{Name: "map1", Type: MapTypeHash}
+	s.Programs["prog1"] = newXdpProgram("prog1", "GPL", nil)
+
+	assert.NoError(t, s.Close())
+	assert.Empty(t, s.GetMaps())
+	assert.Empty(t, s.GetPrograms())
+	assert.Nil(t, s.GetMapByName("map1"))
+
+	// Second close does nothing
+	assert.NoError(t, s.Close())
+}
+
+func TestSystemReloadParseOnly(t *testing.T) {
+	s := NewDefaultEbpfSystem(WithParseOnly())
+	err := s.Reload("/non/existing.elf")
+	assert.IsType(t, &NotSupportedError{}, err)
+}
@@ -0,0 +1,73 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ElfCompatibility defines how LoadElf() treats parts of ELF file it doesn't
+// support, e.g. ones produced by newer toolchain / meant for newer library version
+type ElfCompatibility int
+
+const (
+	// ElfCompatDefault skips unknown program sections, passes unknown map types
+	// to kernel as is and fails on unsupported relocations
+	ElfCompatDefault ElfCompatibility = iota
+	// ElfCompatStrict fails on anything unsupported
+	ElfCompatStrict
+	// ElfCompatPermissive skips anything unsupported: unknown program sections,
+	// maps of unknown types, programs with unsupported relocations
+	// (or using skipped maps). Everything skipped is reported by GetElfWarnings().
+	ElfCompatPermissive
+)
+
+func (c ElfCompatibility) String() string {
+	switch c {
+	case ElfCompatDefault:
+		return "Default"
+	case ElfCompatStrict:
+		return "Strict"
+	case ElfCompatPermissive:
+		return "Permissive"
+	}
+
+	return "Unknown"
+}
+
+// ElfWarning is part of ELF file skipped by LoadElf() as unsupported
+type ElfWarning struct {
+	// ELF section skipped part belongs to
+	Section string
+	Message string
+}
+
+func (w ElfWarning) String() string {
+	return fmt.Sprintf("section '%s': %s", w.Section, w.Message)
+}
+
+// WithElfCompatibility sets how LoadElf() / Reload() / ParseElf() treat
+// unsupported parts of ELF file, ElfCompatDefault by default
+func WithElfCompatibility(mode ElfCompatibility) Option {
+	return func(s *ebpfSystem) {
+		s.elfCompat = mode
+	}
+}
+
+// Reports unsupported part of ELF file: returns error in strict mode (or if
+// it isn't skippable by default), otherwise part is skipped with warning
+func (s *ebpfSystem) unsupported(skippable bool, section, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	if s.elfCompat == ElfCompatStrict || (s.elfCompat == ElfCompatDefault && !skippable) {
+		return errors.New(msg)
+	}
+	s.logger.Printf("goebpf: section '%s': %s, skipped", section, msg)
+	s.elfWarnings = append(s.elfWarnings, ElfWarning{
+		Section: section,
+		Message: msg,
+	})
+
+	return nil
+}
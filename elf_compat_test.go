@@ -0,0 +1,36 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestElfCompatibility(t *testing.T) {
+	// Default: only skippable parts are skipped
+	s := NewDefaultEbpfSystem().(*ebpfSystem)
+	assert.Equal(t, ElfCompatDefault, s.elfCompat)
+	assert.NoError(t, s.unsupported(true, "xdp_new", "Unknown program section"))
+	assert.EqualError(t, s.unsupported(false, "maps", "Unknown map RELO offset %d", 4),
+		"Unknown map RELO offset 4")
+	assert.Equal(t, []ElfWarning{{Section: "xdp_new", Message: "Unknown program section"}},
+		s.GetElfWarnings())
+
+	s = NewDefaultEbpfSystem(WithElfCompatibility(ElfCompatStrict)).(*ebpfSystem)
+	assert.Error(t, s.unsupported(true, "xdp_new", "Unknown program section"))
+	assert.Error(t, s.unsupported(false, "maps", "Unknown map RELO offset %d", 4))
+	assert.Empty(t, s.GetElfWarnings())
+
+	s = NewDefaultEbpfSystem(WithElfCompatibility(ElfCompatPermissive)).(*ebpfSystem)
+	assert.NoError(t, s.unsupported(true, "xdp_new", "Unknown program section"))
+	assert.NoError(t, s.unsupported(false, "maps", "Unknown map RELO offset %d", 4))
+	warnings := s.GetElfWarnings()
+	assert.Len(t, warnings, 2)
+	assert.Equal(t, "section 'maps': Unknown map RELO offset 4", warnings[1].String())
+
+	assert.Equal(t, "Permissive", ElfCompatPermissive.String())
+	assert.Equal(t, "Unknown", ElfCompatibility(10).String())
+}
@@ -0,0 +1,181 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// ElfPolicy restricts what ELF file loaded by LoadElf() / Reload() / ParseElf()
+// may contain, for products loading third-party (e.g. customer supplied) eBPF
+// objects. Maps / programs are checked before they are created in kernel,
+// so nothing violating policy is ever created. Zero value allows everything.
+//
+//	bpf := goebpf.NewDefaultEbpfSystem(goebpf.WithElfPolicy(goebpf.ElfPolicy{
+//		ProgramTypes:   []goebpf.ProgramType{goebpf.ProgramTypeXdp},
+//		MapTypes:       []goebpf.MapType{goebpf.MapTypeHash, goebpf.MapTypeArray},
+//		Helpers:        []goebpf.HelperFunc{goebpf.HelperMapLookupElem},
+//		MaxMapMemory:   16 << 20,
+//		DenyPersistent: true,
+//	}))
+//	err := bpf.LoadElf("plugin.elf")
+//	var violation *goebpf.ElfPolicyError
+//	if errors.As(err, &violation) {
+//		// rejected by policy
+//	}
+type ElfPolicy struct {
+	// Allowed program / map types, any type if empty
+	ProgramTypes []ProgramType
+	MapTypes     []MapType
+	// Allowed helper functions, any helper if nil. When set, calls of kernel
+	// functions (kfuncs) are denied as well, they bypass helper allowlist.
+	Helpers []HelperFunc
+	// Limits of single program / map, no limit if zero.
+	// Map memory is estimated for fully populated map, see GetMemoryUsage().
+	MaxInstructions int
+	MaxMapEntries   int
+	MaxMapMemory    uint64
+	// Deny maps pinned into bpffs (persistent_path in map definition),
+	// so objects can't outlive plugin / share state with others
+	DenyPersistent bool
+}
+
+// ElfPolicyError is returned when ELF file violates ElfPolicy
+type ElfPolicyError struct {
+	// Name of map / program violating policy
+	Object string
+	Reason string
+}
+
+func (e *ElfPolicyError) Error() string {
+	return fmt.Sprintf("'%s' violates ELF policy: %s", e.Object, e.Reason)
+}
+
+// WithElfPolicy restricts contents of ELF files read by system, see ElfPolicy
+func WithElfPolicy(policy ElfPolicy) Option {
+	return func(s *ebpfSystem) {
+		s.elfPolicy = &policy
+	}
+}
+
+func (p *ElfPolicy) violation(object, format string, args ...interface{}) error {
+	return &ElfPolicyError{
+		Object: object,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+// Checks map definition with all options of system applied
+func (p *ElfPolicy) checkMap(m *EbpfMap) error {
+	if len(p.MapTypes) > 0 && !containsMapType(p.MapTypes, m.Type) {
+		return p.violation(m.Name, "map type %v is not allowed", m.Type)
+	}
+	if p.MaxMapEntries > 0 && m.MaxEntries > p.MaxMapEntries {
+		return p.violation(m.Name, "%d max entries exceed limit of %d", m.MaxEntries, p.MaxMapEntries)
+	}
+	if p.MaxMapMemory > 0 {
+		numCpus, err := GetNumOfPossibleCpus()
+		if err != nil {
+			return err
+		}
+		if bytes := m.estimateMemory(numCpus); bytes > p.MaxMapMemory {
+			return p.violation(m.Name, "%d bytes of memory exceed limit of %d", bytes, p.MaxMapMemory)
+		}
+	}
+	if p.DenyPersistent && m.PersistentPath != "" {
+		return p.violation(m.Name, "persistent maps are not allowed (pinned at '%s')", m.PersistentPath)
+	}
+
+	return nil
+}
+
+// Checks program cut from ELF section
+func (p *ElfPolicy) checkProgram(name string, progType ProgramType, bytecode []byte, bo binary.ByteOrder) error {
+	if len(p.ProgramTypes) > 0 && !containsProgramType(p.ProgramTypes, progType) {
+		return p.violation(name, "program type %v is not allowed", progType)
+	}
+	if p.MaxInstructions > 0 && len(bytecode)/bpfInstructionLen > p.MaxInstructions {
+		return p.violation(name, "%d instructions exceed limit of %d",
+			len(bytecode)/bpfInstructionLen, p.MaxInstructions)
+	}
+	if p.Helpers == nil {
+		return nil
+	}
+	helpers, kfuncs, err := usedHelpers(bytecode, bo)
+	if err != nil {
+		return err
+	}
+	if kfuncs {
+		return p.violation(name, "kernel function calls are not allowed")
+	}
+	for _, helper := range helpers {
+		if !containsHelper(p.Helpers, helper) {
+			return p.violation(name, "helper %d is not allowed", helper)
+		}
+	}
+
+	return nil
+}
+
+// Scans call instructions of program: returns helper functions called
+// (sorted, without duplicates) and whether kernel functions are called
+func usedHelpers(bytecode []byte, bo binary.ByteOrder) ([]HelperFunc, bool, error) {
+	seen := map[HelperFunc]bool{}
+	kfuncs := false
+	for offset := 0; offset+bpfInstructionLen <= len(bytecode); offset += bpfInstructionLen {
+		var insn bpfInstruction
+		if err := insn.load(bytecode[offset:], bo); err != nil {
+			return nil, false, err
+		}
+		if insn.code != classJmp|jumpCall {
+			continue
+		}
+		// src_reg tells what is called: helper (imm is helper ID), kernel
+		// function (imm is BTF ID) or BPF-to-BPF call within program
+		switch insn.srcReg {
+		case 0:
+			seen[HelperFunc(insn.imm)] = true
+		case bpfPseudoKfuncCall:
+			kfuncs = true
+		}
+	}
+
+	var res []HelperFunc
+	for helper := range seen {
+		res = append(res, helper)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res, kfuncs, nil
+}
+
+func containsMapType(types []MapType, t MapType) bool {
+	for _, item := range types {
+		if item == t {
+			return true
+		}
+	}
+	return false
+}
+
+func containsProgramType(types []ProgramType, t ProgramType) bool {
+	for _, item := range types {
+		if item == t {
+			return true
+		}
+	}
+	return false
+}
+
+func containsHelper(helpers []HelperFunc, h HelperFunc) bool {
+	for _, item := range helpers {
+		if item == h {
+			return true
+		}
+	}
+	return false
+}
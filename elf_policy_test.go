@@ -0,0 +1,90 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElfPolicy(t *testing.T) {
+	data := buildTestElf()
+
+	// Everything ELF has is allowed
+	_, err := ParseElfData(data, WithElfPolicy(ElfPolicy{
+		ProgramTypes:    []ProgramType{ProgramTypeXdp},
+		MapTypes:        []MapType{MapTypeHash},
+		Helpers:         []HelperFunc{},
+		MaxInstructions: 4,
+		MaxMapEntries:   16,
+		MaxMapMemory:    1 << 20,
+		DenyPersistent:  true,
+	}))
+	assert.NoError(t, err)
+
+	violations := []struct {
+		policy ElfPolicy
+		object string
+	}{
+		{ElfPolicy{ProgramTypes: []ProgramType{ProgramTypeSocketFilter}}, "xdp_prog"},
+		{ElfPolicy{MaxInstructions: 3}, "xdp_prog"},
+		{ElfPolicy{MapTypes: []MapType{MapTypeArray}}, "test_map"},
+		{ElfPolicy{MaxMapEntries: 8}, "test_map"},
+		{ElfPolicy{MaxMapMemory: 512}, "test_map"},
+	}
+	for _, v := range violations {
+		_, err := ParseElfData(data, WithElfPolicy(v.policy))
+		var violation *ElfPolicyError
+		if assert.True(t, errors.As(err, &violation), "%+v", v.policy) {
+			assert.Equal(t, v.object, violation.Object)
+		}
+	}
+
+	// Options of system are applied before check
+	_, err = ParseElfData(data, WithMapMaxEntries("test_map", 1024), WithElfPolicy(ElfPolicy{MaxMapEntries: 16}))
+	assert.Error(t, err)
+
+	// Persistent maps
+	policy := &ElfPolicy{DenyPersistent: true}
+	assert.NoError(t, policy.checkMap(&EbpfMap{Name: "map1", Type: MapTypeHash}))
+	err = policy.checkMap(&EbpfMap{Name: "map2", Type: MapTypeHash, PersistentPath: "/sys/fs/bpf/map2"})
+	assert.EqualError(t, err, "'map2' violates ELF policy: persistent maps are not allowed (pinned at '/sys/fs/bpf/map2')")
+}
+
+func TestElfPolicyHelpers(t *testing.T) {
+	bytecode, err := Instructions{
+		Call(HelperKtimeGetNs),
+		Call(HelperMapLookupElem),
+		Call(HelperKtimeGetNs),
+		Mov64Imm(R0, 0),
+		Exit(),
+	}.Assemble()
+	require.NoError(t, err)
+
+	helpers, kfuncs, err := usedHelpers(bytecode, binary.LittleEndian)
+	require.NoError(t, err)
+	assert.Equal(t, []HelperFunc{HelperMapLookupElem, HelperKtimeGetNs}, helpers)
+	assert.False(t, kfuncs)
+
+	policy := &ElfPolicy{Helpers: []HelperFunc{HelperMapLookupElem, HelperKtimeGetNs}}
+	assert.NoError(t, policy.checkProgram("prog", ProgramTypeXdp, bytecode, binary.LittleEndian))
+	policy.Helpers = []HelperFunc{HelperMapLookupElem}
+	assert.EqualError(t, policy.checkProgram("prog", ProgramTypeXdp, bytecode, binary.LittleEndian),
+		"'prog' violates ELF policy: helper 5 is not allowed")
+	// Any helper allowed
+	policy.Helpers = nil
+	assert.NoError(t, policy.checkProgram("prog", ProgramTypeXdp, bytecode, binary.LittleEndian))
+
+	// Kernel function call
+	kfuncCall := (&bpfInstruction{code: classJmp | jumpCall, srcReg: bpfPseudoKfuncCall, imm: 100}).save(binary.LittleEndian)
+	_, kfuncs, err = usedHelpers(kfuncCall, binary.LittleEndian)
+	require.NoError(t, err)
+	assert.True(t, kfuncs)
+	policy.Helpers = []HelperFunc{}
+	assert.Error(t, policy.checkProgram("prog", ProgramTypeXdp, kfuncCall, binary.LittleEndian))
+}
@@ -0,0 +1,290 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"github.com/dropbox/goebpf/goebpf_btf"
+)
+
+// ElfReport describes everything LoadElf() would create in kernel,
+// produced by ParseElf() without any privileges required
+type ElfReport struct {
+	License string
+	// Byte order ELF is built for, must match host (see HostByteOrder()) to be loaded
+	ByteOrder binary.ByteOrder
+	Sections  []ElfSection
+	Maps      []ElfMap
+	Programs  []ElfProgram
+	// Kernel features required by ELF file, sorted by kernel version
+	Requirements []KernelRequirement
+	// Unsupported parts of ELF file skipped, see WithElfCompatibility()
+	Warnings []ElfWarning
+}
+
+// ElfSection is short info about single ELF section
+type ElfSection struct {
+	Name string
+	Type elf.SectionType
+	Size int
+}
+
+// ElfMap is eBPF map definition read from ELF file
+// (with all options of system, like WithMapMaxEntries(), applied)
+type ElfMap struct {
+	Name           string
+	Type           MapType
+	KeySize        int
+	ValueSize      int
+	MaxEntries     int
+	Flags          int
+	InnerMapName   string
+	PersistentPath string
+	// Value has struct bpf_spin_lock / struct bpf_timer (per BTF of map)
+	SpinLock bool
+	Timer    bool
+	// Names of C key / value types from BPF_ANNOTATE_KV_PAIR(), empty if ELF has no BTF
+	KeyType   string
+	ValueType string
+}
+
+// ElfProgram is eBPF program read from ELF file
+type ElfProgram struct {
+	Name         string
+	Type         ProgramType
+	License      string
+	Instructions int
+	// Never loaded by WithAutoload(), SEC("?name") in ELF
+	OnDemand bool
+	// Helper functions program calls, sorted
+	Helpers []HelperFunc
+}
+
+// KernelRequirement is kernel feature used by ELF file along with
+// kernel version feature first appeared in
+type KernelRequirement struct {
+	Feature string
+	// In KERNEL_VERSION(a, b, c) format, see GetKernelVersion()
+	Version int
+}
+
+func (r KernelRequirement) String() string {
+	return fmt.Sprintf("%s (%s)", r.Feature, KernelVersionString(r.Version))
+}
+
+// MinKernelVersion returns minimal kernel version ELF file can be loaded on
+func (r *ElfReport) MinKernelVersion() int {
+	var res int
+	for _, req := range r.Requirements {
+		if req.Version > res {
+			res = req.Version
+		}
+	}
+	return res
+}
+
+// KernelVersionString converts KERNEL_VERSION(a, b, c) into "a.b.c"
+func KernelVersionString(version int) string {
+	return fmt.Sprintf("%d.%d.%d", version>>16, (version>>8)&0xff, version&0xff)
+}
+
+func kernelVersion(major, minor int) int {
+	return (major << 16) + (minor << 8)
+}
+
+// Kernel versions map / program types were introduced in
+var mapTypeKernelVersions = map[MapType]int{
+	MapTypeHash:                kernelVersion(3, 19),
+	MapTypeArray:               kernelVersion(3, 19),
+	MapTypeProgArray:           kernelVersion(4, 2),
+	MapTypePerfEventArray:      kernelVersion(4, 3),
+	MapTypePerCPUHash:          kernelVersion(4, 6),
+	MapTypePerCPUArray:         kernelVersion(4, 6),
+	MapTypeStackTrace:          kernelVersion(4, 6),
+	MapTypeCgroupArray:         kernelVersion(4, 8),
+	MapTypeLRUHash:             kernelVersion(4, 10),
+	MapTypeLRUPerCPUHash:       kernelVersion(4, 10),
+	MapTypeLPMTrie:             kernelVersion(4, 11),
+	MapTypeArrayOfMaps:         kernelVersion(4, 12),
+	MapTypeHashOfMaps:          kernelVersion(4, 12),
+	MapTypeDevMap:              kernelVersion(4, 14),
+	MapTypeSockMap:             kernelVersion(4, 14),
+	MapTypeCPUMap:              kernelVersion(4, 15),
+	MapTypeXSKMap:              kernelVersion(4, 18),
+	MapTypeSockHash:            kernelVersion(4, 18),
+	MapTypeCGroupStorage:       kernelVersion(4, 19),
+	MapTypeReusePortSockArray:  kernelVersion(4, 19),
+	MapTypePerCpuCGroupStorage: kernelVersion(4, 20),
+	MapTypeQueue:               kernelVersion(4, 20),
+	MapTypeStack:               kernelVersion(4, 20),
+	MapTypeSKStorage:           kernelVersion(5, 2),
+	MapTypeDevMapHash:          kernelVersion(5, 4),
+	MapTypeRingBuf:             kernelVersion(5, 8),
+}
+
+var programTypeKernelVersions = map[ProgramType]int{
+	ProgramTypeSocketFilter: kernelVersion(3, 19),
+	ProgramTypeXdp:          kernelVersion(4, 8),
+	ProgramTypeKprobe:       kernelVersion(4, 1),
+	ProgramTypePerfEvent:    kernelVersion(4, 9),
+	ProgramTypeSockOps:      kernelVersion(4, 13),
+	ProgramTypeTracepoint:   kernelVersion(4, 7),
+	ProgramTypeTracing:      kernelVersion(5, 5),
+	ProgramTypeLSM:          kernelVersion(5, 7),
+	ProgramTypeCgroupSkb:    kernelVersion(4, 10),
+	ProgramTypeSkLookup:     kernelVersion(5, 9),
+	ProgramTypeLwtIn:        kernelVersion(4, 10),
+	ProgramTypeLwtOut:       kernelVersion(4, 10),
+	ProgramTypeLwtXmit:      kernelVersion(4, 10),
+	ProgramTypeLwtSeg6Local: kernelVersion(4, 18),
+}
+
+// ParseElf fully reads / validates ELF file like LoadElf() does,
+// but without creating any kernel objects, so no privileges are needed.
+// Options are the same as for NewDefaultEbpfSystem().
+// Main use case is validation of compiled eBPF programs in CI pipelines.
+func ParseElf(fn string, opts ...Option) (*ElfReport, error) {
+	s := NewDefaultEbpfSystem(append(opts, WithParseOnly())...).(*ebpfSystem)
+	data, err := s.readElfData(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.parseElfData(data)
+}
+
+// ParseElfData is ParseElf() of ELF file in memory. It makes no system calls,
+// so it is safe to validate untrusted input with it (e.g. third-party plugins
+// before loading them): malformed files are reported by errors, never by panics.
+// ElfVerifier (see WithElfVerifier()) is not called, there is no file to verify.
+func ParseElfData(data []byte, opts ...Option) (*ElfReport, error) {
+	s := NewDefaultEbpfSystem(append(opts, WithParseOnly())...).(*ebpfSystem)
+	return s.parseElfData(data)
+}
+
+// Reads ELF file in memory by parse only system, builds report of it
+func (s *ebpfSystem) parseElfData(data []byte) (*ElfReport, error) {
+	elfFile, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	s.Maps, s.Programs, err = s.readElfFile(elfFile, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ElfReport{
+		ByteOrder: elfFile.ByteOrder,
+	}
+	for _, section := range elfFile.Sections {
+		if section.Type == elf.SHT_NULL {
+			continue
+		}
+		if section.Name == LicenseSectionName {
+			data, err := section.Data()
+			if err != nil {
+				return nil, err
+			}
+			report.License = NullTerminatedStringToString(data)
+		}
+		report.Sections = append(report.Sections, ElfSection{
+			Name: section.Name,
+			Type: section.Type,
+			Size: int(section.Size),
+		})
+	}
+	for _, m := range s.Maps {
+		em := m.(*EbpfMap)
+		report.Maps = append(report.Maps, ElfMap{
+			Name:           em.Name,
+			Type:           em.Type,
+			KeySize:        em.KeySize,
+			ValueSize:      em.ValueSize,
+			MaxEntries:     em.MaxEntries,
+			Flags:          em.Flags,
+			InnerMapName:   em.InnerMapName,
+			PersistentPath: em.PersistentPath,
+			SpinLock:       em.spinLock,
+			Timer:          em.timer,
+			KeyType:        btfTypeName(em.btfKeyType),
+			ValueType:      btfTypeName(em.btfValueType),
+		})
+	}
+	for _, prog := range s.Programs {
+		base := prog.(baseProgramAccessor).base()
+		helpers, _, err := usedHelpers(base.bytecode, elfFile.ByteOrder)
+		if err != nil {
+			return nil, err
+		}
+		report.Programs = append(report.Programs, ElfProgram{
+			Name:         prog.GetName(),
+			Type:         prog.GetType(),
+			License:      prog.GetLicense(),
+			Instructions: prog.GetSize() / bpfInstructionLen,
+			OnDemand:     base.onDemand,
+			Helpers:      helpers,
+		})
+	}
+	// Stable output regardless of ELF layout
+	sort.Slice(report.Maps, func(i, j int) bool {
+		return report.Maps[i].Name < report.Maps[j].Name
+	})
+	sort.Slice(report.Programs, func(i, j int) bool {
+		return report.Programs[i].Name < report.Programs[j].Name
+	})
+	report.Requirements = report.kernelRequirements()
+	report.Warnings = s.GetElfWarnings()
+
+	return report, nil
+}
+
+// Returns name of BTF type, empty for anonymous / unknown one
+func btfTypeName(t *goebpf_btf.Type) string {
+	if t == nil {
+		return ""
+	}
+	return t.Name
+}
+
+// Builds list of kernel features ELF file relies on
+func (r *ElfReport) kernelRequirements() []KernelRequirement {
+	var res []KernelRequirement
+	seen := map[string]bool{}
+	add := func(feature string, version int) {
+		if !seen[feature] {
+			seen[feature] = true
+			res = append(res, KernelRequirement{Feature: feature, Version: version})
+		}
+	}
+
+	for _, m := range r.Maps {
+		add(fmt.Sprintf("%v map", m.Type), mapTypeKernelVersions[m.Type])
+		if m.PersistentPath != "" {
+			add("Object pinning", kernelVersion(4, 4))
+		}
+		if m.SpinLock {
+			add("bpf_spin_lock", kernelVersion(5, 1))
+		}
+		if m.Timer {
+			add("bpf_timer", kernelVersion(5, 15))
+		}
+	}
+	for _, prog := range r.Programs {
+		add(fmt.Sprintf("%v program", prog.Type), programTypeKernelVersions[prog.Type])
+	}
+	// Loader always passes names of maps / programs to kernel
+	if len(r.Maps) > 0 || len(r.Programs) > 0 {
+		add("Object names", kernelVersion(4, 15))
+	}
+
+	sort.SliceStable(res, func(i, j int) bool {
+		return res[i].Version < res[j].Version
+	})
+	return res
+}
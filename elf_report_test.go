@@ -0,0 +1,116 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElfReportRequirements(t *testing.T) {
+	report := &ElfReport{
+		Maps: []ElfMap{
+			{Name: "map1", Type: MapTypeLPMTrie},
+			{Name: "map2", Type: MapTypeHash, PersistentPath: "/sys/fs/bpf/map2"},
+			{Name: "map3", Type: MapTypeHash},
+		},
+		Programs: []ElfProgram{
+			{Name: "prog1", Type: ProgramTypeXdp},
+		},
+	}
+	reqs := report.kernelRequirements()
+	assert.Equal(t, []KernelRequirement{
+		{"Hash map", 0x031300},
+		{"Object pinning", 0x040400},
+		{"XDP program", 0x040800},
+		{"Longest prefix match trie map", 0x040b00},
+		{"Object names", 0x040f00},
+	}, reqs)
+
+	report.Requirements = reqs
+	assert.Equal(t, 0x040f00, report.MinKernelVersion())
+	assert.Equal(t, "XDP program (4.8.0)", reqs[2].String())
+
+	// Special fields in map values
+	report = &ElfReport{
+		Maps: []ElfMap{
+			{Name: "timers", Type: MapTypeHash, Timer: true, SpinLock: true},
+		},
+	}
+	report.Requirements = report.kernelRequirements()
+	assert.Equal(t, []KernelRequirement{
+		{"Hash map", 0x031300},
+		{"Object names", 0x040f00},
+		{"bpf_spin_lock", 0x050100},
+		{"bpf_timer", 0x050f00},
+	}, report.Requirements)
+
+	// Empty ELF requires nothing
+	assert.Empty(t, (&ElfReport{}).kernelRequirements())
+}
+
+func TestParseElfNonExisting(t *testing.T) {
+	report, err := ParseElf("/non/existing.elf")
+	assert.Error(t, err)
+	assert.Nil(t, report)
+}
+
+func TestParseElfData(t *testing.T) {
+	report, err := ParseElfData(buildTestElf())
+	require.NoError(t, err)
+	assert.Equal(t, "GPL", report.License)
+	assert.Equal(t, []ElfMap{{Name: "test_map", Type: MapTypeHash, KeySize: 4, ValueSize: 8, MaxEntries: 16}}, report.Maps)
+	require.Len(t, report.Programs, 1)
+	assert.Equal(t, "xdp_prog", report.Programs[0].Name)
+	assert.Equal(t, ProgramTypeXdp, report.Programs[0].Type)
+	assert.Equal(t, 4, report.Programs[0].Instructions)
+
+	// Garbage
+	_, err = ParseElfData([]byte("not an ELF file"))
+	assert.Error(t, err)
+}
+
+// Builds BTF of:
+//
+//	struct counters { unsigned long long packets; };
+//	BPF_ANNOTATE_KV_PAIR(test_map, __u32, struct counters);
+func buildTestMapBtf() []byte {
+	var types, strs bytes.Buffer
+	strs.WriteByte(0)
+	str := func(s string) uint32 {
+		off := uint32(strs.Len())
+		strs.WriteString(s + "\x00")
+		return off
+	}
+	add := func(words ...uint32) {
+		binary.Write(&types, binary.LittleEndian, words)
+	}
+	// [1] int, [2] typedef __u32, [3] unsigned long long
+	add(str("unsigned int"), 1<<24, 4, 32)
+	add(str("__u32"), 8<<24, 1)
+	add(str("unsigned long long"), 1<<24, 8, 64)
+	// [4] struct counters, [5] struct ____btf_map_test_map
+	add(str("counters"), 4<<24|1, 8, str("packets"), 3, 0)
+	add(str("____btf_map_test_map"), 4<<24|2, 16, str("key"), 2, 0, str("value"), 4, 64)
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []uint32{0x0001eb9f, 24, 0, uint32(types.Len()),
+		uint32(types.Len()), uint32(strs.Len())})
+	buf.Write(types.Bytes())
+	buf.Write(strs.Bytes())
+	return buf.Bytes()
+}
+
+func TestParseElfDataMapTypes(t *testing.T) {
+	report, err := ParseElfData(buildTestElfWithBtf(buildTestMapBtf()))
+	require.NoError(t, err)
+	require.Len(t, report.Maps, 1)
+	assert.Equal(t, "__u32", report.Maps[0].KeyType)
+	assert.Equal(t, "counters", report.Maps[0].ValueType)
+	assert.Empty(t, report.Warnings)
+}
@@ -0,0 +1,39 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"io/ioutil"
+)
+
+// ElfVerifier decides whether ELF file may be read, e.g. by checking its
+// detached signature (see goebpf_minisign for minisign / ed25519 one).
+// data is exact content of file which is going to be read, so file replaced
+// after verification is never loaded.
+type ElfVerifier func(fn string, data []byte) error
+
+// WithElfVerifier makes LoadElf() / Reload() / ParseElf() read only ELF files
+// approved by verifier, so fleets only run approved eBPF artifacts
+func WithElfVerifier(verifier ElfVerifier) Option {
+	return func(s *ebpfSystem) {
+		s.elfVerifier = verifier
+	}
+}
+
+// Reads ELF file into memory, checks it by verifier of system (if any)
+func (s *ebpfSystem) readElfData(fn string) ([]byte, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if s.elfVerifier != nil {
+		if err := s.elfVerifier(fn, data); err != nil {
+			return nil, fmt.Errorf("ELF file '%s' is not approved: %v", fn, err)
+		}
+		s.logger.Printf("goebpf: ELF file '%s' approved by verifier", fn)
+	}
+
+	return data, nil
+}
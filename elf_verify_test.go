@@ -0,0 +1,50 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestElfVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goebpf_verify")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "test.elf")
+	data := buildTestElf()
+	require.NoError(t, ioutil.WriteFile(fn, data, 0644))
+
+	// Verifier sees exact content of file
+	var verified []string
+	approve := func(name string, content []byte) error {
+		verified = append(verified, name)
+		if !bytes.Equal(content, data) {
+			return errors.New("content mismatch")
+		}
+		return nil
+	}
+	report, err := ParseElf(fn, WithElfVerifier(approve))
+	require.NoError(t, err)
+	assert.Len(t, report.Programs, 1)
+	assert.Equal(t, []string{fn}, verified)
+
+	// Not approved
+	reject := func(string, []byte) error {
+		return errors.New("unsigned")
+	}
+	_, err = ParseElf(fn, WithElfVerifier(reject))
+	assert.EqualError(t, err, "ELF file '"+fn+"' is not approved: unsigned")
+
+	// Parsing from memory is not verified
+	_, err = ParseElfData(data, WithElfVerifier(reject))
+	assert.NoError(t, err)
+}
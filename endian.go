@@ -0,0 +1,59 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"unsafe"
+)
+
+// eBPF programs, map keys / values and kernel structures always use
+// byte order of host, e.g. big endian on s390x
+var hostByteOrder = detectHostByteOrder()
+
+// EM_BPF, not defined by debug/elf of old Go versions
+const elfMachineBpf = elf.Machine(247)
+
+func detectHostByteOrder() binary.ByteOrder {
+	var x uint16 = 0x0102
+	if *(*byte)(unsafe.Pointer(&x)) == 0x01 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// HostByteOrder returns byte order of machine program is running on.
+// All integers in eBPF maps (keys, values) are stored in this byte order,
+// so it must be used to decode raw values returned by Lookup() / GetNextKey().
+func HostByteOrder() binary.ByteOrder {
+	return hostByteOrder
+}
+
+// Checks that ELF file is compiled for eBPF (old clang versions leave machine unset)
+func checkElfMachine(elfFile *elf.File) error {
+	if elfFile.Machine != elfMachineBpf && elfFile.Machine != elf.EM_NONE {
+		return fmt.Errorf("ELF file is built for %v, not for eBPF", elfFile.Machine)
+	}
+	return nil
+}
+
+// Checks that ELF file byte order matches host, otherwise kernel would reject programs.
+// clang's "-target bpf" produces objects for byte order of machine clang runs on,
+// so cross compiled programs must use "-target bpfel" / "-target bpfeb" explicitly.
+func checkElfByteOrder(elfFile *elf.File) error {
+	if elfFile.ByteOrder != hostByteOrder {
+		return fmt.Errorf("ELF file byte order is %v, host is %v (use clang -target bpfel / bpfeb)",
+			elfFile.ByteOrder, hostByteOrder)
+	}
+	return nil
+}
+
+// Reverses bytes of slice in place
+func reverseBytes(data []byte) {
+	for i, j := 0, len(data)-1; i < j; i, j = i+1, j-1 {
+		data[i], data[j] = data[j], data[i]
+	}
+}
@@ -0,0 +1,86 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostByteOrder(t *testing.T) {
+	switch runtime.GOARCH {
+	case "amd64", "386", "arm", "arm64", "riscv64", "ppc64le", "mipsle", "mips64le":
+		assert.Equal(t, binary.LittleEndian, HostByteOrder())
+	case "s390x", "ppc64", "mips", "mips64":
+		assert.Equal(t, binary.BigEndian, HostByteOrder())
+	}
+}
+
+func TestKeyValueToBytesBigEndian(t *testing.T) {
+	saved := hostByteOrder
+	hostByteOrder = binary.BigEndian
+	defer func() { hostByteOrder = saved }()
+
+	type run struct {
+		val   interface{}
+		size  int
+		bytes []byte
+	}
+	runs := []run{
+		{0xff, 1, []byte{0xff}},
+		{0xff00, 2, []byte{0xff, 0}},
+		{0x1, 4, []byte{0, 0, 0, 0x1}},
+		{0x7ffefdfc, 4, []byte{0x7f, 0xfe, 0xfd, 0xfc}},
+		{uint16(0x102), 2, []byte{0x1, 0x2}},
+		{uint32(0x1020304), 4, []byte{0x1, 0x2, 0x3, 0x4}},
+		{int32(-2), 4, []byte{0xff, 0xff, 0xff, 0xfe}},
+		{uint64(0x1020304), 8, []byte{0, 0, 0, 0, 0x1, 0x2, 0x3, 0x4}},
+		{"ab", 4, []byte{'a', 'b', 0, 0}},
+		{CreateLPMtrieKey("192.168.1.0/24"), 8, []byte{0x0, 0x0, 0x0, 0x18, 0xc0, 0xa8, 0x01, 0x0}},
+	}
+
+	for _, r := range runs {
+		res, err := KeyValueToBytes(r.val, r.size)
+		assert.NoError(t, err)
+		assert.Equal(t, r.bytes, res)
+		if _, ok := r.val.(int); ok {
+			assert.Equal(t, uint64(r.val.(int)), ParseFlexibleInteger(res))
+		}
+	}
+}
+
+func TestParseFlexibleIntegerBigEndian(t *testing.T) {
+	assert.Equal(t, uint64(0xff), ParseFlexibleIntegerBigEndian([]byte{0xff}))
+	assert.Equal(t, uint64(1000), ParseFlexibleIntegerBigEndian([]byte{0x3, 0xe8}))
+	assert.Equal(t, uint64(0x7f), ParseFlexibleIntegerBigEndian([]byte{0, 0, 0, 0x7f}))
+	assert.Equal(t, uint64(0x7ffefdfc), ParseFlexibleIntegerBigEndian([]byte{0x7f, 0xfe, 0xfd, 0xfc}))
+
+	// Host order
+	assert.Equal(t, uint64(1), ParseFlexibleInteger(func() []byte {
+		b := make([]byte, 4)
+		hostByteOrder.PutUint32(b, 1)
+		return b
+	}()))
+}
+
+func TestCheckElf(t *testing.T) {
+	newElf := func(machine elf.Machine, bo binary.ByteOrder) *elf.File {
+		return &elf.File{FileHeader: elf.FileHeader{Machine: machine, ByteOrder: bo}}
+	}
+	other := binary.ByteOrder(binary.BigEndian)
+	if hostByteOrder == binary.BigEndian {
+		other = binary.LittleEndian
+	}
+
+	assert.NoError(t, checkElfMachine(newElf(elfMachineBpf, hostByteOrder)))
+	assert.NoError(t, checkElfMachine(newElf(elf.EM_NONE, hostByteOrder)))
+	assert.Error(t, checkElfMachine(newElf(elf.EM_X86_64, hostByteOrder)))
+
+	assert.NoError(t, checkElfByteOrder(newElf(elfMachineBpf, hostByteOrder)))
+	assert.Error(t, checkElfByteOrder(newElf(elfMachineBpf, other)))
+}
@@ -0,0 +1,265 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"syscall"
+)
+
+// Linux kernel internal error code, returned by bpf(2) when feature / helper
+// is not supported by kernel / driver. Not exported by syscall package.
+const errnoENOTSUPP = syscall.Errno(524)
+
+// Sentinel errors describing common failure causes.
+// All errors returned by library for failed eBPF operations are matched against them
+// by errors.Is(), e.g.:
+//
+//	if _, err := m.Lookup(key); errors.Is(err, goebpf.ErrKeyNotExist) {
+//		// no such element
+//	}
+//
+// Typed errors (*SyscallError, *VerifierError, etc) return matching sentinel
+// error by Cause() as well.
+var (
+	// Program has been rejected by kernel verifier, see VerifierError for log
+	ErrVerifier = errors.New("Program rejected by verifier")
+	// Feature / map type / program type is not supported by kernel or library
+	ErrNotSupported = errors.New("Not supported")
+	// Not enough privileges (CAP_SYS_ADMIN / CAP_BPF) or locked memory limit
+	ErrPermission = errors.New("Permission denied")
+	// No room for new element in map, or map is too large
+	ErrMapFull = errors.New("Map is full")
+	// Element with given key does not exist in map
+	ErrKeyNotExist = errors.New("Key does not exist")
+	// Kernel function / symbol to attach to does not exist in running kernel
+	ErrSymbolNotFound = errors.New("Kernel symbol not found")
+	// Key / value passed to map operation does not match size of map key / value
+	ErrInvalidSize = errors.New("Invalid key / value size")
+)
+
+// Maps errno returned by bpf(2) into one of sentinel errors, or nil if there is no match
+func errnoCause(errno syscall.Errno) error {
+	switch errno {
+	case syscall.EPERM, syscall.EACCES:
+		return ErrPermission
+	case syscall.E2BIG:
+		return ErrMapFull
+	case syscall.ENOENT:
+		return ErrKeyNotExist
+	case syscall.EOPNOTSUPP, errnoENOTSUPP:
+		return ErrNotSupported
+	}
+	return nil
+}
+
+// SyscallError is returned when underlying system call (mostly bpf(2)) failed
+type SyscallError struct {
+	// Failed operation, e.g. "ebpf_map_lookup_elem()"
+	Op string
+	// Raw error code of system call
+	Errno syscall.Errno
+	// Human readable description of error code (strerror)
+	Msg string
+}
+
+// Creates *SyscallError from error returned by system call.
+// logBuf is optional NULL terminated message which takes precedence over errno description.
+func newSyscallError(op string, err error, logBuf []byte) *SyscallError {
+	e := &SyscallError{
+		Op:  op,
+		Msg: NullTerminatedStringToString(logBuf),
+	}
+	if errno, ok := err.(syscall.Errno); ok {
+		e.Errno = errno
+	}
+	if e.Msg == "" {
+		e.Msg = e.Errno.Error()
+	}
+	return e
+}
+
+// Creates *SyscallError from error of netlink request (e.g. XDP attach),
+// with message reported by kernel (extended ACK) if any, like
+// "LinkSetXdpFdWithFlags() failed: Underlying driver does not support XDP in native mode"
+func newNetlinkError(op string, err error) error {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return fmt.Errorf("%s failed: %v", op, err)
+	}
+	e := newSyscallError(op, errno, nil)
+	// netlink library appends extended ACK message to errno: "<errno>: <message>"
+	if msg := strings.TrimPrefix(err.Error(), errno.Error()+": "); msg != err.Error() && msg != "" {
+		e.Msg = msg
+	}
+	return e
+}
+
+func (e *SyscallError) Error() string {
+	return fmt.Sprintf("%s failed: %s", e.Op, e.Msg)
+}
+
+// Cause returns one of sentinel errors (like ErrKeyNotExist) matching
+// to error code, or nil if there is no match
+func (e *SyscallError) Cause() error {
+	return errnoCause(e.Errno)
+}
+
+// Unwrap returns raw error code, so errors.Is(err, syscall.ENOENT) works as well
+func (e *SyscallError) Unwrap() error {
+	return e.Errno
+}
+
+// Is implements matching against sentinel errors for errors.Is()
+func (e *SyscallError) Is(target error) bool {
+	cause := e.Cause()
+	return cause != nil && cause == target
+}
+
+// VerifierError is returned by Program.Load() when kernel rejected program
+type VerifierError struct {
+	// Name of program
+	Program string
+	// Raw error code returned by BPF_PROG_LOAD
+	Errno syscall.Errno
+	// Hardware offload: index of network interface program was loaded to
+	Ifindex int
+	// Verifier log
+	Log string
+}
+
+func (e *VerifierError) Error() string {
+	if e.Ifindex != 0 {
+		// Log may be produced by driver (e.g. nfp),
+		// so add errno to distinguish driver's verifier errors
+		return fmt.Sprintf("ebpf_prog_load() failed (offload to ifindex %d): %v: %s",
+			e.Ifindex, e.Errno, e.Log)
+	}
+	return fmt.Sprintf("ebpf_prog_load() failed: %s", e.Log)
+}
+
+// Cause always returns ErrVerifier
+func (e *VerifierError) Cause() error {
+	return ErrVerifier
+}
+
+// Unwrap returns raw error code
+func (e *VerifierError) Unwrap() error {
+	return e.Errno
+}
+
+// Is implements matching against ErrVerifier for errors.Is()
+func (e *VerifierError) Is(target error) bool {
+	return target == ErrVerifier
+}
+
+// NotSupportedError is returned when requested feature is not supported
+// by library or running kernel
+type NotSupportedError struct {
+	// What exactly is not supported, e.g. "LookupString for PerCPU Hash"
+	Feature string
+}
+
+func (e *NotSupportedError) Error() string {
+	return fmt.Sprintf("%s is not supported", e.Feature)
+}
+
+// Cause always returns ErrNotSupported
+func (e *NotSupportedError) Cause() error {
+	return ErrNotSupported
+}
+
+// Is implements matching against ErrNotSupported for errors.Is()
+func (e *NotSupportedError) Is(target error) bool {
+	return target == ErrNotSupported
+}
+
+// MapSizeError is returned by map operations when key / value size does not
+// match map definition. It is detected before syscall, kernel would fail with
+// bare EINVAL or, worse, read / write beyond buffer.
+type MapSizeError struct {
+	Map string
+	// "key" or "value"
+	Kind     string
+	Expected int
+	Got      int
+}
+
+func (e *MapSizeError) Error() string {
+	return fmt.Sprintf("Map '%s': invalid %s size %d, expected %d bytes", e.Map, e.Kind, e.Got, e.Expected)
+}
+
+// Cause always returns ErrInvalidSize
+func (e *MapSizeError) Cause() error {
+	return ErrInvalidSize
+}
+
+// Is implements matching against ErrInvalidSize for errors.Is()
+func (e *MapSizeError) Is(target error) bool {
+	return target == ErrInvalidSize
+}
+
+// LoadError adds context (map / program being created or loaded) to error
+// of loading ELF file. Underlying error (e.g. *SyscallError, *VerifierError)
+// is kept, so it is still matched by errors.Is() / errors.As().
+type LoadError struct {
+	// What has failed, e.g. "map.Create() failed" or "Program 'xdp_main'"
+	Context string
+	// Underlying error
+	Err error
+}
+
+func (e *LoadError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Context, e.Err)
+}
+
+// Cause returns sentinel error of underlying one, if it has Cause() as well,
+// or underlying error itself
+func (e *LoadError) Cause() error {
+	if c, ok := e.Err.(interface{ Cause() error }); ok {
+		return c.Cause()
+	}
+	return e.Err
+}
+
+// Unwrap returns underlying error
+func (e *LoadError) Unwrap() error {
+	return e.Err
+}
+
+// SymbolNotFoundError is returned when kernel function program is attached
+// to (kprobe, fentry / fexit) or calls does not exist in running kernel,
+// e.g. because it has been renamed / inlined in other kernel version
+type SymbolNotFoundError struct {
+	// Name of missing symbol
+	Symbol string
+	// Kernel module symbol has been looked up in, empty for whole kernel
+	Module string
+	// Existing symbols with similar names, closest first
+	Suggestions []string
+}
+
+func (e *SymbolNotFoundError) Error() string {
+	where := "kernel"
+	if e.Module != "" {
+		where = fmt.Sprintf("kernel module '%s'", e.Module)
+	}
+	msg := fmt.Sprintf("Symbol '%s' not found in %s", e.Symbol, where)
+	if len(e.Suggestions) > 0 {
+		msg += fmt.Sprintf(", did you mean '%s'?", strings.Join(e.Suggestions, "', '"))
+	}
+	return msg
+}
+
+// Cause always returns ErrSymbolNotFound
+func (e *SymbolNotFoundError) Cause() error {
+	return ErrSymbolNotFound
+}
+
+// Is implements matching against ErrSymbolNotFound for errors.Is()
+func (e *SymbolNotFoundError) Is(target error) bool {
+	return target == ErrSymbolNotFound
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSyscallError(t *testing.T) {
+	runs := map[syscall.Errno]error{
+		syscall.EPERM:      ErrPermission,
+		syscall.EACCES:     ErrPermission,
+		syscall.E2BIG:      ErrMapFull,
+		syscall.ENOENT:     ErrKeyNotExist,
+		syscall.EOPNOTSUPP: ErrNotSupported,
+		errnoENOTSUPP:      ErrNotSupported,
+		syscall.EINVAL:     nil,
+	}
+
+	for errno, cause := range runs {
+		err := newSyscallError("ebpf_map_lookup_elem()", errno, nil)
+		assert.Equal(t, cause, err.Cause())
+		assert.Equal(t, cause != nil, err.Is(cause))
+		assert.Equal(t, errno, err.Unwrap())
+		assert.False(t, err.Is(ErrVerifier))
+	}
+
+	// Explicit message takes precedence over Go's errno description
+	logBuf := []byte("No such file or directory\x00garbage")
+	err := newSyscallError("ebpf_map_lookup_elem()", syscall.ENOENT, logBuf)
+	assert.Equal(t, "ebpf_map_lookup_elem() failed: No such file or directory", err.Error())
+	err = newSyscallError("ebpf_map_lookup_elem()", syscall.ENOENT, nil)
+	assert.Equal(t, "ebpf_map_lookup_elem() failed: no such file or directory", err.Error())
+}
+
+func TestNetlinkError(t *testing.T) {
+	// Message of extended ACK, as formatted by netlink library
+	err := newNetlinkError("LinkSetXdpFdWithFlags()",
+		fmt.Errorf("%w: %s", syscall.EOPNOTSUPP, "Underlying driver does not support XDP in native mode"))
+	assert.EqualError(t, err, "LinkSetXdpFdWithFlags() failed: Underlying driver does not support XDP in native mode")
+	assert.True(t, errors.Is(err, ErrNotSupported))
+	assert.True(t, errors.Is(err, syscall.EOPNOTSUPP))
+
+	// No extended ACK (older kernels)
+	err = newNetlinkError("RouteDel()", syscall.ESRCH)
+	assert.EqualError(t, err, "RouteDel() failed: no such process")
+	assert.True(t, errors.Is(err, syscall.ESRCH))
+
+	// Not an errno
+	err = newNetlinkError("RouteDel()", errors.New("Link not found"))
+	assert.EqualError(t, err, "RouteDel() failed: Link not found")
+}
+
+func TestCloseFdErrno(t *testing.T) {
+	err := closeFd(1111) // Some non-existing fd
+	if assert.IsType(t, &SyscallError{}, err) {
+		assert.Equal(t, syscall.EBADF, err.(*SyscallError).Errno)
+	}
+}
+
+func TestVerifierError(t *testing.T) {
+	err := &VerifierError{
+		Program: "xdp0",
+		Errno:   syscall.EACCES,
+		Log:     "R0 !read_ok",
+	}
+	assert.Equal(t, "ebpf_prog_load() failed: R0 !read_ok", err.Error())
+	assert.True(t, err.Is(ErrVerifier))
+	assert.False(t, err.Is(ErrPermission))
+	assert.Equal(t, ErrVerifier, err.Cause())
+	assert.Equal(t, syscall.EACCES, err.Unwrap())
+
+	err.Ifindex = 3
+	assert.Equal(t, "ebpf_prog_load() failed (offload to ifindex 3): permission denied: R0 !read_ok",
+		err.Error())
+}
+
+func TestNotSupportedError(t *testing.T) {
+	m := &EbpfMap{
+		Type: MapTypePerCPUHash,
+	}
+	_, err := m.LookupString(1)
+	assert.Error(t, err)
+	if assert.IsType(t, &NotSupportedError{}, err) {
+		nerr := err.(*NotSupportedError)
+		assert.True(t, nerr.Is(ErrNotSupported))
+		assert.Equal(t, ErrNotSupported, nerr.Cause())
+	}
+}
+
+func TestSymbolNotFoundError(t *testing.T) {
+	err := &SymbolNotFoundError{Symbol: "tcp_conect", Suggestions: []string{"tcp_connect", "tcp_v4_connect"}}
+	assert.Equal(t, "Symbol 'tcp_conect' not found in kernel, did you mean 'tcp_connect', 'tcp_v4_connect'?", err.Error())
+	assert.True(t, err.Is(ErrSymbolNotFound))
+	assert.False(t, err.Is(ErrNotSupported))
+	assert.Equal(t, ErrSymbolNotFound, err.Cause())
+
+	err = &SymbolNotFoundError{Symbol: "nf_confirm", Module: "nf_conntrack"}
+	assert.Equal(t, "Symbol 'nf_confirm' not found in kernel module 'nf_conntrack'", err.Error())
+}
+
+func TestLoadError(t *testing.T) {
+	verr := &VerifierError{Program: "xdp0", Errno: syscall.EACCES, Log: "R0 !read_ok"}
+	err := &LoadError{Context: "Autoload failed", Err: &LoadError{Context: "Program 'xdp0'", Err: verr}}
+	assert.Equal(t, "Autoload failed: Program 'xdp0': ebpf_prog_load() failed: R0 !read_ok", err.Error())
+	assert.True(t, errors.Is(err, ErrVerifier))
+	assert.True(t, errors.Is(err, syscall.EACCES))
+	assert.Equal(t, ErrVerifier, err.Cause())
+
+	// Plain error is cause by itself
+	plain := errors.New("Inner map 'inner' does not exist")
+	err = &LoadError{Context: "loadAndCreateMaps() failed", Err: plain}
+	assert.Equal(t, plain, err.Cause())
+	assert.Equal(t, plain, err.Unwrap())
+}
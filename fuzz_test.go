@@ -0,0 +1,160 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"testing"
+)
+
+// Builds minimal ELF file like clang does for:
+//
+//	BPF_MAP_DEF(test_map) = {
+//		.map_type = BPF_MAP_TYPE_HASH,
+//		.key_size = 4,
+//		.value_size = 8,
+//		.max_entries = 16,
+//	};
+//	BPF_MAP_ADD(test_map);
+//
+//	SEC("xdp")
+//	int xdp_prog(struct xdp_md *ctx) {
+//		(void)&test_map;
+//		return XDP_PASS;
+//	}
+func buildTestElf() []byte {
+	return buildTestElfWithBtf(nil)
+}
+
+// Builds the same ELF file as buildTestElf() with .BTF section of given data
+// (compiled with -g), if any
+func buildTestElfWithBtf(btf []byte) []byte {
+	bo := binary.LittleEndian
+	strtab := []byte("\x00.strtab\x00.symtab\x00xdp\x00.relxdp\x00maps\x00license\x00.BTF\x00xdp_prog\x00test_map\x00")
+	var symtab []byte
+	symtab = append(symtab, make([]byte, 24)...)
+	symtab = append(symtab, testElfSymbol(testElfName(strtab, "xdp_prog"), elf.STB_GLOBAL, elf.STT_FUNC, 3)...)
+	symtab = append(symtab, testElfSymbol(testElfName(strtab, "test_map"), elf.STB_GLOBAL, elf.STT_OBJECT, 5)...)
+
+	// r1 = test_map ll; r0 = XDP_PASS; exit
+	code := []byte{
+		0x18, 0x01, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0,
+		0xb7, 0x00, 0, 0, 2, 0, 0, 0,
+		0x95, 0, 0, 0, 0, 0, 0, 0,
+	}
+	rel := make([]byte, 16)
+	bo.PutUint64(rel[8:], elf.R_INFO(2, 1)) // R_BPF_64_64)
+
+	mapDef := make([]byte, mapDefinitionSize)
+	bo.PutUint32(mapDef, uint32(MapTypeHash))
+	bo.PutUint32(mapDef[4:], 4)
+	bo.PutUint32(mapDef[8:], 8)
+	bo.PutUint32(mapDef[12:], 16)
+
+	sections := []testElfSection{
+		{},
+		{name: ".strtab", typ: elf.SHT_STRTAB, data: strtab},
+		{name: ".symtab", typ: elf.SHT_SYMTAB, data: symtab, link: 1, info: 1, entrySize: 24},
+		{name: "xdp", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR, data: code},
+		{name: ".relxdp", typ: elf.SHT_REL, data: rel, link: 2, info: 3, entrySize: 16},
+		{name: "maps", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_WRITE, data: mapDef},
+		{name: "license", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_WRITE, data: []byte("GPL\x00")},
+	}
+	if btf != nil {
+		sections = append(sections, testElfSection{name: ".BTF", typ: elf.SHT_PROGBITS, data: btf})
+	}
+
+	return writeTestElf(strtab, sections)
+}
+
+// Section of ELF file built by tests
+type testElfSection struct {
+	name      string
+	typ       elf.SectionType
+	flags     elf.SectionFlag
+	data      []byte
+	link      uint32
+	info      uint32
+	entrySize uint64
+}
+
+// Returns offset of name in string table
+func testElfName(strtab []byte, s string) uint32 {
+	return uint32(bytes.Index(strtab, []byte("\x00"+s+"\x00")) + 1)
+}
+
+// Returns entry of symbol table
+func testElfSymbol(name uint32, bind elf.SymBind, typ elf.SymType, section uint16) []byte {
+	res := make([]byte, 24)
+	binary.LittleEndian.PutUint32(res, name)
+	res[4] = elf.ST_INFO(bind, typ)
+	binary.LittleEndian.PutUint16(res[6:], section)
+	return res
+}
+
+// Writes little endian ELF file of sections, the first one is empty,
+// the second one is string table with names of sections
+func writeTestElf(strtab []byte, sections []testElfSection) []byte {
+	bo := binary.LittleEndian
+	// ELF header, data of sections, section headers
+	buf := &bytes.Buffer{}
+	var offsets []uint64
+	buf.Write(make([]byte, 64))
+	for _, s := range sections {
+		offsets = append(offsets, uint64(buf.Len()))
+		buf.Write(s.data)
+	}
+	shoff := uint64(buf.Len())
+	for idx, s := range sections {
+		var nameOffset uint32
+		if s.name != "" {
+			nameOffset = testElfName(strtab, s.name)
+		}
+		binary.Write(buf, bo, elf.Section64{
+			Name:      nameOffset,
+			Type:      uint32(s.typ),
+			Flags:     uint64(s.flags),
+			Off:       offsets[idx],
+			Size:      uint64(len(s.data)),
+			Link:      s.link,
+			Info:      s.info,
+			Addralign: 1,
+			Entsize:   s.entrySize,
+		})
+	}
+
+	res := buf.Bytes()
+	hdr := elf.Header64{
+		Type:      uint16(elf.ET_REL),
+		Machine:   uint16(elf.EM_BPF),
+		Version:   uint32(elf.EV_CURRENT),
+		Shoff:     shoff,
+		Ehsize:    64,
+		Shentsize: 64,
+		Shnum:     uint16(len(sections)),
+		Shstrndx:  1,
+	}
+	copy(hdr.Ident[:], elf.ELFMAG)
+	hdr.Ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	hdr.Ident[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	hdr.Ident[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	hdrBuf := &bytes.Buffer{}
+	binary.Write(hdrBuf, bo, hdr)
+	copy(res, hdrBuf.Bytes())
+
+	return res
+}
+
+// Object files of third-party plugins are untrusted input:
+// malformed ones must be rejected by errors, never by panics.
+func FuzzParseElfData(f *testing.F) {
+	f.Add(buildTestElf())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ParseElfData(data)
+	})
+}
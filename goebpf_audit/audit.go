@@ -0,0 +1,336 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_audit is process execution auditing: tracepoint programs on
+// sched_process_exec / sched_process_exit report every program execution
+// (with parent pid and command line) and process exit through ring buffer
+// (linux 5.8+):
+//
+//	a, err := goebpf_audit.New(goebpf_audit.DefaultRingSize)
+//	...
+//	defer a.Close()
+//	if err = a.Attach(); err != nil {
+//		...
+//	}
+//	for {
+//		e, err := a.Read()
+//		if err != nil {
+//			break
+//		}
+//		fmt.Println(e.Type, e.Pid, e.Ppid, e.Argv)
+//	}
+//
+// Parent pid / command line are read from kernel structs by programs, offsets
+// of their fields are taken from kernel BTF (/sys/kernel/btf/vmlinux), which
+// is required. Tracefs has to be mounted to attach programs.
+package goebpf_audit
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_btf"
+	"github.com/dropbox/goebpf/internal/maputil"
+)
+
+const (
+	// DefaultRingSize (bytes) fits bursts of exec events with full arguments
+	DefaultRingSize = 1 << 22
+	// Name of ring buffer map / programs
+	MapName         = "audit_events"
+	ExecProgramName = "audit_exec"
+	ExitProgramName = "audit_exit"
+)
+
+// EventType is kind of audit event
+type EventType int
+
+const (
+	EventExec EventType = 1
+	EventExit EventType = 2
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventExec:
+		return "Exec"
+	case EventExit:
+		return "Exit"
+	}
+
+	return "Unknown"
+}
+
+// Event is single audit event
+type Event struct {
+	Type EventType
+	// When event happened
+	Time time.Time
+	// Process (thread group) / thread ID, parent process ID
+	Pid  int
+	Tid  int
+	Ppid int
+	Uid  int
+	Gid  int
+	// Command name of process, new one for EventExec
+	Comm string
+	// EventExec: executed file and command line (truncated to 1024 bytes)
+	Filename string
+	Argv     []string
+	// EventExit: exit code / signal process was terminated by
+	ExitCode int
+	Signal   int
+}
+
+// Auditor reports exec / exit events of all processes of system
+type Auditor struct {
+	ring     *goebpf.EbpfMap
+	programs []goebpf.Program
+	reader   *goebpf.RingBufReader
+	// Number of records Read() skipped as malformed
+	malformed uint64
+}
+
+// Tracepoints programs are attached to, in order of Auditor.programs
+var tracepoints = []goebpf.TracepointAttachParams{
+	{Category: "sched", Name: "sched_process_exec"},
+	{Category: "sched", Name: "sched_process_exit"},
+}
+
+// New creates ring buffer of ringSize bytes (power of 2) and loads programs
+// writing into it. Programs are not attached yet, see Attach().
+func New(ringSize int) (*Auditor, error) {
+	offsets, err := kernelOffsets()
+	if err != nil {
+		return nil, err
+	}
+	ring := &goebpf.EbpfMap{
+		Name:       MapName,
+		Type:       goebpf.MapTypeRingBuf,
+		MaxEntries: ringSize,
+	}
+	if err = maputil.Create(ring); err != nil {
+		return nil, err
+	}
+	a := &Auditor{ring: ring}
+	for _, insns := range []goebpf.Instructions{
+		execInstructions(ring, offsets),
+		exitInstructions(ring, offsets),
+	} {
+		name := ExecProgramName
+		if len(a.programs) > 0 {
+			name = ExitProgramName
+		}
+		prog, err := goebpf.NewProgram(name, goebpf.ProgramTypeTracepoint, "GPL", insns)
+		if err == nil {
+			err = prog.Load()
+		}
+		if err != nil {
+			a.Close()
+			return nil, err
+		}
+		a.programs = append(a.programs, prog)
+	}
+	if a.reader, err = goebpf.NewRingBufReader(ring); err != nil {
+		a.Close()
+		return nil, err
+	}
+
+	return a, nil
+}
+
+// Programs returns loaded exec / exit programs
+func (a *Auditor) Programs() []goebpf.Program {
+	return a.programs
+}
+
+// Attach attaches programs to their tracepoints, all or nothing
+func (a *Auditor) Attach() error {
+	for i, prog := range a.programs {
+		if err := prog.Attach(tracepoints[i]); err != nil {
+			for _, attached := range a.programs[:i] {
+				attached.Detach()
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Read returns next event, blocking until there is one.
+// Malformed records are skipped, see Malformed().
+// Returns goebpf.ErrRingBufClosed once auditor is closed.
+func (a *Auditor) Read() (*Event, error) {
+	for {
+		record, err := a.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		e, err := ParseEvent(record)
+		if err != nil {
+			atomic.AddUint64(&a.malformed, 1)
+			continue
+		}
+		return e, nil
+	}
+}
+
+// Malformed returns number of records skipped by Read()
+func (a *Auditor) Malformed() uint64 {
+	return atomic.LoadUint64(&a.malformed)
+}
+
+// Close detaches programs, interrupts pending Read() and frees all resources
+func (a *Auditor) Close() error {
+	if a.reader != nil {
+		a.reader.Close()
+	}
+	for _, prog := range a.programs {
+		prog.Close()
+	}
+	return a.ring.Close()
+}
+
+// Record programs put into ring buffer:
+//
+//	struct audit_event {
+//		__u64 ktime;          // bpf_ktime_get_ns()
+//		__u32 type;           // 1 - exec, 2 - exit
+//		__u32 pid;
+//		__u32 tid;
+//		__u32 ppid;
+//		__u32 uid;
+//		__u32 gid;
+//		char  comm[16];
+//		__s32 exit_code;      // exit: task->exit_code
+//		__s32 filename_len;   // exec: including NULL terminator
+//		__s32 args_len;       // exec: mm->arg_end - mm->arg_start, up to 1024
+//		__u32 pad;
+//		char  filename[256];
+//		char  args[1024];     // NULL separated
+//	};
+const (
+	recordTimeOff        = 0
+	recordTypeOff        = 8
+	recordPidOff         = 12
+	recordTidOff         = 16
+	recordPpidOff        = 20
+	recordUidOff         = 24
+	recordGidOff         = 28
+	recordCommOff        = 32
+	recordExitCodeOff    = 48
+	recordFilenameLenOff = 52
+	recordArgsLenOff     = 56
+	recordFilenameOff    = 64
+	recordArgsOff        = recordFilenameOff + maxFilenameLen
+	recordSize           = recordArgsOff + maxArgsLen
+	commLen              = 16
+	maxFilenameLen       = 256
+	maxArgsLen           = 1024
+)
+
+// ParseEvent decodes record of ring buffer into event
+func ParseEvent(record []byte) (*Event, error) {
+	if len(record) < recordSize {
+		return nil, fmt.Errorf("Invalid record size %d, must be at least %d", len(record), recordSize)
+	}
+	bo := goebpf.HostByteOrder()
+	e := &Event{
+		Type: EventType(bo.Uint32(record[recordTypeOff:])),
+		Time: goebpf.KtimeToTime(bo.Uint64(record[recordTimeOff:])),
+		Pid:  int(bo.Uint32(record[recordPidOff:])),
+		Tid:  int(bo.Uint32(record[recordTidOff:])),
+		Ppid: int(bo.Uint32(record[recordPpidOff:])),
+		Uid:  int(bo.Uint32(record[recordUidOff:])),
+		Gid:  int(bo.Uint32(record[recordGidOff:])),
+		Comm: cString(record[recordCommOff : recordCommOff+commLen]),
+	}
+	switch e.Type {
+	case EventExec:
+		n := clampLen(int32(bo.Uint32(record[recordFilenameLenOff:])), maxFilenameLen)
+		e.Filename = cString(record[recordFilenameOff : recordFilenameOff+n])
+		n = clampLen(int32(bo.Uint32(record[recordArgsLenOff:])), maxArgsLen)
+		args := strings.TrimRight(string(record[recordArgsOff:recordArgsOff+n]), "\x00")
+		if args != "" {
+			e.Argv = strings.Split(args, "\x00")
+		}
+	case EventExit:
+		status := int(bo.Uint32(record[recordExitCodeOff:]))
+		e.ExitCode = (status >> 8) & 0xff
+		e.Signal = status & 0x7f
+	default:
+		return nil, fmt.Errorf("Invalid event type %d", e.Type)
+	}
+
+	return e, nil
+}
+
+// Length reported by program (may be negative error code) limited by max
+func clampLen(n int32, max int) int {
+	if n < 0 {
+		return 0
+	}
+	if int(n) > max {
+		return max
+	}
+	return int(n)
+}
+
+// Returns NULL terminated string
+func cString(data []byte) string {
+	if idx := bytes.IndexByte(data, 0); idx >= 0 {
+		data = data[:idx]
+	}
+	return string(data)
+}
+
+// Offsets of kernel struct fields used by programs
+type offsets struct {
+	realParent int // task_struct
+	tgid       int
+	mm         int
+	exitCode   int
+	argStart   int // mm_struct
+	argEnd     int
+}
+
+// Reads offsets of task_struct / mm_struct fields from kernel BTF
+func kernelOffsets() (*offsets, error) {
+	spec, err := goebpf_btf.LoadKernelSpec()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read kernel BTF: %v", err)
+	}
+	task, err := spec.TypeByName("task_struct", goebpf_btf.KindStruct)
+	if err != nil {
+		return nil, fmt.Errorf("task_struct: %v", err)
+	}
+	mm, err := spec.TypeByName("mm_struct", goebpf_btf.KindStruct)
+	if err != nil {
+		return nil, fmt.Errorf("mm_struct: %v", err)
+	}
+
+	res := &offsets{}
+	for _, f := range []struct {
+		t     *goebpf_btf.Type
+		field string
+		dst   *int
+	}{
+		{task, "real_parent", &res.realParent},
+		{task, "tgid", &res.tgid},
+		{task, "mm", &res.mm},
+		{task, "exit_code", &res.exitCode},
+		{mm, "arg_start", &res.argStart},
+		{mm, "arg_end", &res.argEnd},
+	} {
+		if *f.dst, err = goebpf_btf.FieldOffset(f.t, f.field); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
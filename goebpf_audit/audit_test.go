@@ -0,0 +1,81 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_audit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+)
+
+func eventRecord(eventType EventType) []byte {
+	bo := goebpf.HostByteOrder()
+	record := make([]byte, recordSize)
+	bo.PutUint32(record[recordTypeOff:], uint32(eventType))
+	bo.PutUint32(record[recordPidOff:], 100)
+	bo.PutUint32(record[recordTidOff:], 101)
+	bo.PutUint32(record[recordPpidOff:], 1)
+	bo.PutUint32(record[recordUidOff:], 1000)
+	bo.PutUint32(record[recordGidOff:], 2000)
+	copy(record[recordCommOff:], "bash")
+	return record
+}
+
+func TestParseEvent(t *testing.T) {
+	bo := goebpf.HostByteOrder()
+	now := time.Now()
+	record := eventRecord(EventExec)
+	bo.PutUint64(record[recordTimeOff:], uint64(now.Sub(goebpf.KtimeToTime(0))))
+	filename := "/usr/bin/ls\x00"
+	copy(record[recordFilenameOff:], filename)
+	bo.PutUint32(record[recordFilenameLenOff:], uint32(len(filename)))
+	args := "ls\x00-l\x00/tmp\x00"
+	copy(record[recordArgsOff:], args)
+	bo.PutUint32(record[recordArgsLenOff:], uint32(len(args)))
+
+	e, err := ParseEvent(record)
+	require.NoError(t, err)
+	assert.Equal(t, EventExec, e.Type)
+	assert.Equal(t, "Exec", e.Type.String())
+	assert.WithinDuration(t, now, e.Time, time.Millisecond)
+	assert.Equal(t, 100, e.Pid)
+	assert.Equal(t, 101, e.Tid)
+	assert.Equal(t, 1, e.Ppid)
+	assert.Equal(t, 1000, e.Uid)
+	assert.Equal(t, 2000, e.Gid)
+	assert.Equal(t, "bash", e.Comm)
+	assert.Equal(t, "/usr/bin/ls", e.Filename)
+	assert.Equal(t, []string{"ls", "-l", "/tmp"}, e.Argv)
+
+	// Errors of reading strings (negative lengths) are empty strings
+	bo.PutUint32(record[recordFilenameLenOff:], uint32(0xfffffff2))
+	bo.PutUint32(record[recordArgsLenOff:], 0)
+	e, err = ParseEvent(record)
+	require.NoError(t, err)
+	assert.Empty(t, e.Filename)
+	assert.Empty(t, e.Argv)
+
+	// Exit by signal / with exit code
+	record = eventRecord(EventExit)
+	bo.PutUint32(record[recordExitCodeOff:], 9)
+	e, err = ParseEvent(record)
+	require.NoError(t, err)
+	assert.Equal(t, "Exit", e.Type.String())
+	assert.Equal(t, 9, e.Signal)
+	assert.Equal(t, 0, e.ExitCode)
+	bo.PutUint32(record[recordExitCodeOff:], 2<<8)
+	e, err = ParseEvent(record)
+	require.NoError(t, err)
+	assert.Equal(t, 0, e.Signal)
+	assert.Equal(t, 2, e.ExitCode)
+
+	_, err = ParseEvent(eventRecord(EventType(3)))
+	assert.Error(t, err)
+	_, err = ParseEvent(record[:recordSize-1])
+	assert.Error(t, err)
+}
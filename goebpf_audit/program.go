@@ -0,0 +1,150 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_audit
+
+import (
+	"github.com/dropbox/goebpf"
+)
+
+// Fields of tracepoint records, see /sys/kernel/tracing/events/sched/*/format
+const (
+	execFilenameLocOff = 8  // __data_loc char[] filename
+	exitGroupDeadOff   = 32 // bool group_dead
+)
+
+// Stack layout: pointers / values read from kernel
+const (
+	stackPtr      = -8
+	stackArgStart = -16
+	stackArgEnd   = -24
+)
+
+// Reserves record of type in ring buffer (R7) and fills fields common
+// for all events. R8 is current task_struct afterwards.
+func reserveEvent(ring goebpf.Map, off *offsets, eventType int32) goebpf.Instructions {
+	return goebpf.Instructions{
+		goebpf.LoadMapFd(goebpf.R1, ring),
+		goebpf.Mov64Imm(goebpf.R2, recordSize),
+		goebpf.Mov64Imm(goebpf.R3, 0),
+		goebpf.Call(goebpf.HelperRingbufReserve),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "out"),
+		goebpf.Mov64Reg(goebpf.R7, goebpf.R0),
+
+		goebpf.Call(goebpf.HelperKtimeGetNs),
+		goebpf.StoreMem(goebpf.SizeDouble, goebpf.R7, recordTimeOff, goebpf.R0),
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R7, recordTypeOff, eventType),
+		goebpf.Call(goebpf.HelperGetCurrentPidTgid),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R7, recordTidOff, goebpf.R0),
+		goebpf.Alu64Imm(goebpf.AluOpRsh, goebpf.R0, 32),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R7, recordPidOff, goebpf.R0),
+		goebpf.Call(goebpf.HelperGetCurrentUidGid),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R7, recordUidOff, goebpf.R0),
+		goebpf.Alu64Imm(goebpf.AluOpRsh, goebpf.R0, 32),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R7, recordGidOff, goebpf.R0),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R7),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R1, recordCommOff),
+		goebpf.Mov64Imm(goebpf.R2, commLen),
+		goebpf.Call(goebpf.HelperGetCurrentComm),
+
+		// ppid = task->real_parent->tgid
+		goebpf.Call(goebpf.HelperGetCurrentTask),
+		goebpf.Mov64Reg(goebpf.R8, goebpf.R0),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R1, stackPtr),
+		goebpf.Mov64Imm(goebpf.R2, 8),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R8),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, int32(off.realParent)),
+		goebpf.Call(goebpf.HelperProbeReadKernel),
+		goebpf.LoadMem(goebpf.SizeDouble, goebpf.R3, goebpf.R10, stackPtr),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, int32(off.tgid)),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R7),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R1, recordPpidOff),
+		goebpf.Mov64Imm(goebpf.R2, 4),
+		goebpf.Call(goebpf.HelperProbeReadKernel),
+	}
+}
+
+// Submits record R7
+func submitEvent() goebpf.Instructions {
+	return goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R7),
+		goebpf.Mov64Imm(goebpf.R2, 0),
+		goebpf.Call(goebpf.HelperRingbufSubmit),
+		goebpf.Mov64Imm(goebpf.R0, 0).WithLabel("out"),
+		goebpf.Exit(),
+	}
+}
+
+// Reads 8 bytes of kernel memory at R9 + offset into stack
+func readKernelU64(stackOff int16, offset int) goebpf.Instructions {
+	return goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R1, int32(stackOff)),
+		goebpf.Mov64Imm(goebpf.R2, 8),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R9),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, int32(offset)),
+		goebpf.Call(goebpf.HelperProbeReadKernel),
+	}
+}
+
+// sched_process_exec program: executed file and command line of new program
+func execInstructions(ring goebpf.Map, off *offsets) goebpf.Instructions {
+	insns := goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R6, goebpf.R1),
+	}
+	insns = append(insns, reserveEvent(ring, off, int32(EventExec))...)
+	insns = append(insns,
+		// Filename is dynamic field of record: low 16 bits of __data_loc are offset
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R3, goebpf.R6, execFilenameLocOff),
+		goebpf.Alu64Imm(goebpf.AluOpAnd, goebpf.R3, 0xffff),
+		goebpf.Alu64Reg(goebpf.AluOpAdd, goebpf.R3, goebpf.R6),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R7),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R1, recordFilenameOff),
+		goebpf.Mov64Imm(goebpf.R2, maxFilenameLen),
+		goebpf.Call(goebpf.HelperProbeReadKernelStr),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R7, recordFilenameLenOff, goebpf.R0),
+
+		// Command line is arg_start..arg_end of (already new) user memory
+		goebpf.Mov64Reg(goebpf.R9, goebpf.R8),
+	)
+	insns = append(insns, readKernelU64(stackPtr, off.mm)...)
+	insns = append(insns, goebpf.LoadMem(goebpf.SizeDouble, goebpf.R9, goebpf.R10, stackPtr))
+	insns = append(insns, readKernelU64(stackArgStart, off.argStart)...)
+	insns = append(insns, readKernelU64(stackArgEnd, off.argEnd)...)
+	insns = append(insns,
+		goebpf.LoadMem(goebpf.SizeDouble, goebpf.R3, goebpf.R10, stackArgStart),
+		goebpf.LoadMem(goebpf.SizeDouble, goebpf.R2, goebpf.R10, stackArgEnd),
+		goebpf.Alu64Reg(goebpf.AluOpSub, goebpf.R2, goebpf.R3),
+		goebpf.JumpImm(goebpf.JumpOpSGe, goebpf.R2, 0, "args_le"),
+		goebpf.Mov64Imm(goebpf.R2, 0),
+		goebpf.JumpImm(goebpf.JumpOpSLe, goebpf.R2, maxArgsLen, "args").WithLabel("args_le"),
+		goebpf.Mov64Imm(goebpf.R2, maxArgsLen),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R7, recordArgsLenOff, goebpf.R2).WithLabel("args"),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R7),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R1, recordArgsOff),
+		goebpf.Call(goebpf.HelperProbeReadUser),
+	)
+
+	return append(insns, submitEvent()...)
+}
+
+// sched_process_exit program: exit code of process (last thread of it)
+func exitInstructions(ring goebpf.Map, off *offsets) goebpf.Instructions {
+	insns := goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R6, goebpf.R1),
+		goebpf.LoadMem(goebpf.SizeByte, goebpf.R1, goebpf.R6, exitGroupDeadOff),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R1, 0, "out"),
+	}
+	insns = append(insns, reserveEvent(ring, off, int32(EventExit))...)
+	insns = append(insns,
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R7),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R1, recordExitCodeOff),
+		goebpf.Mov64Imm(goebpf.R2, 4),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R8),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, int32(off.exitCode)),
+		goebpf.Call(goebpf.HelperProbeReadKernel),
+	)
+
+	return append(insns, submitEvent()...)
+}
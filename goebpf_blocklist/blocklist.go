@@ -0,0 +1,408 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_blocklist is ready to use IPv4 / IPv6 blocklist: networks are
+// stored in LPM trie maps and packets from them are dropped by XDP program,
+// entries may have TTL after which they are removed from Go side:
+//
+//	bl, err := goebpf_blocklist.New(goebpf_blocklist.DefaultMaxEntries)
+//	...
+//	defer bl.Close()
+//	err = bl.Add("10.0.0.0/8", 0)
+//	err = bl.Add("2001:db8::1", time.Hour)
+//	bl.StartExpiry(time.Second)
+//
+//	prog, err := bl.Program()
+//	...
+//	err = prog.Load()
+//	err = prog.Attach("eth0")
+//
+// Maps can also be defined by own eBPF program (e.g. to be persistent),
+// see NewFromMaps() for layout.
+package goebpf_blocklist
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/internal/maputil"
+	"github.com/dropbox/goebpf/internal/xdpsrc"
+)
+
+const (
+	// Names of maps used by FromSystem()
+	MapNameIPv4 = "blocklist_v4"
+	MapNameIPv6 = "blocklist_v6"
+	// DefaultMaxEntries is reasonable size of maps created by New()
+	DefaultMaxEntries = 16384
+	// Name of program returned by Program()
+	ProgramName = "xdp_blocklist"
+
+	// Key is struct bpf_lpm_trie_key: __u32 prefixlen + address
+	keySizeIPv4 = 4 + net.IPv4len
+	keySizeIPv6 = 4 + net.IPv6len
+	// Value is struct { __u64 expires; __u64 packets; }
+	valueSize     = 16
+	packetsOffset = 8
+)
+
+// Entry is blocked network
+type Entry struct {
+	Network *net.IPNet
+	// When entry is removed, zero if never
+	Expires time.Time
+	// Number of packets dropped because of entry
+	Packets uint64
+}
+
+// Blocklist is set of blocked IPv4 / IPv6 networks
+type Blocklist struct {
+	v4, v6 goebpf.Map
+	// Maps were created by New() and closed by Close()
+	ownMaps bool
+	// Serializes updates, so Expire() doesn't remove re-added entries
+	mu  sync.Mutex
+	now func() time.Time
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	err      error
+}
+
+// New creates blocklist along with its maps, able to hold maxEntries
+// IPv4 and maxEntries IPv6 networks
+func New(maxEntries int) (*Blocklist, error) {
+	v4 := &goebpf.EbpfMap{
+		Name:       MapNameIPv4,
+		Type:       goebpf.MapTypeLPMTrie,
+		KeySize:    keySizeIPv4,
+		ValueSize:  valueSize,
+		MaxEntries: maxEntries,
+	}
+	v6 := &goebpf.EbpfMap{
+		Name:       MapNameIPv6,
+		Type:       goebpf.MapTypeLPMTrie,
+		KeySize:    keySizeIPv6,
+		ValueSize:  valueSize,
+		MaxEntries: maxEntries,
+	}
+	if err := maputil.Create(v4, v6); err != nil {
+		return nil, err
+	}
+
+	bl, _ := NewFromMaps(v4, v6)
+	bl.ownMaps = true
+	return bl, nil
+}
+
+// NewFromMaps creates blocklist on top of existing maps, e.g. defined by own
+// eBPF program. Maps must be LPM tries with the following layout:
+//
+//	struct blocklist_key {
+//		__u32 prefixlen;
+//		__u8 addr[4];  // 16 for IPv6 map
+//	};
+//	struct blocklist_value {
+//		__u64 expires;  // unix time in nanoseconds, 0 - never
+//		__u64 packets;  // incremented by program on every drop
+//	};
+func NewFromMaps(v4, v6 goebpf.Map) (*Blocklist, error) {
+	if v4 == nil || v6 == nil {
+		return nil, errors.New("Both IPv4 and IPv6 maps are required")
+	}
+
+	return &Blocklist{
+		v4:  v4,
+		v6:  v6,
+		now: time.Now,
+	}, nil
+}
+
+// FromSystem creates blocklist on top of maps "blocklist_v4" / "blocklist_v6"
+// of loaded ELF file
+func FromSystem(bpf goebpf.System) (*Blocklist, error) {
+	maps, err := maputil.Find(bpf, MapNameIPv4, MapNameIPv6)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFromMaps(maps[0], maps[1])
+}
+
+// Add blocks network given in CIDR notation ("10.0.0.0/8") or single
+// address ("10.0.0.1"). Entry is removed by Expire() after ttl, 0 means never.
+// Adding existing network updates its ttl, dropped packets counter is kept.
+func (b *Blocklist) Add(network string, ttl time.Duration) error {
+	ipnet, err := parseNetwork(network)
+	if err != nil {
+		return err
+	}
+	if ttl < 0 {
+		return fmt.Errorf("Invalid TTL %v", ttl)
+	}
+	var expires int64
+	if ttl > 0 {
+		expires = b.now().Add(ttl).UnixNano()
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	m := b.mapOf(ipnet)
+	value := make([]byte, valueSize)
+	goebpf.HostByteOrder().PutUint64(value, uint64(expires))
+	// LPM trie reports existing key only when both prefix length and address match
+	err = m.Insert(ipnet, value)
+	if !errors.Is(err, syscall.EEXIST) {
+		return err
+	}
+	// Lookup returns the longest matching prefix, which is network itself here
+	old, err := m.Lookup(ipnet)
+	if err != nil {
+		return err
+	}
+	if len(old) == valueSize {
+		copy(value[packetsOffset:], old[packetsOffset:])
+	}
+
+	return m.Update(ipnet, value)
+}
+
+// Remove unblocks network previously added by Add()
+func (b *Blocklist) Remove(network string) error {
+	ipnet, err := parseNetwork(network)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.mapOf(ipnet).Delete(ipnet)
+}
+
+// List returns all blocked networks, including expired ones not yet removed
+// by Expire() (program keeps dropping packets from them until then)
+func (b *Blocklist) List() ([]Entry, error) {
+	var res []Entry
+	for _, m := range []goebpf.Map{b.v4, b.v6} {
+		entries, err := listMap(m)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, entries...)
+	}
+
+	return res, nil
+}
+
+// Expire removes entries which TTL is over, returns number of removed entries
+func (b *Blocklist) Expire() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	removed := 0
+	for _, m := range []goebpf.Map{b.v4, b.v6} {
+		entries, err := listMap(m)
+		if err != nil {
+			return removed, err
+		}
+		for _, e := range entries {
+			if e.Expires.IsZero() || e.Expires.After(now) {
+				continue
+			}
+			if err = m.Delete(e.Network); err != nil {
+				return removed, err
+			}
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// StartExpiry starts goroutine calling Expire() every interval,
+// until Close() or first error (see Err()). Must be called only once.
+func (b *Blocklist) StartExpiry(interval time.Duration) {
+	b.stop = make(chan struct{})
+	b.done = make(chan struct{})
+	go b.runExpiry(interval)
+}
+
+// Err returns error which stopped goroutine started by StartExpiry()
+func (b *Blocklist) Err() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.err
+}
+
+func (b *Blocklist) runExpiry(interval time.Duration) {
+	defer close(b.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+		if _, err := b.Expire(); err != nil {
+			b.mu.Lock()
+			b.err = err
+			b.mu.Unlock()
+			return
+		}
+	}
+}
+
+// Close stops expiry goroutine and closes maps created by New()
+func (b *Blocklist) Close() error {
+	if b.stop != nil {
+		b.stopOnce.Do(func() {
+			close(b.stop)
+		})
+		<-b.done
+	}
+	if !b.ownMaps {
+		return nil
+	}
+	return maputil.Close(b.v4, b.v6)
+}
+
+// Program returns XDP program dropping IPv4 / IPv6 packets which source
+// address belongs to blocked network (VLAN tagged frames are passed as is).
+// Program is not loaded yet, see goebpf.Program.
+func (b *Blocklist) Program() (goebpf.Program, error) {
+	return goebpf.NewProgram(ProgramName, goebpf.ProgramTypeXdp, "GPL", b.instructions())
+}
+
+func (b *Blocklist) instructions() goebpf.Instructions {
+	// Lookup key is struct bpf_lpm_trie_key on stack
+	insns := xdpsrc.Dispatch()
+	// IPv4: key {32, saddr} at fp-8
+	insns = append(insns, xdpsrc.IPv4Src(-keySizeIPv4+4)...)
+	insns = append(insns,
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, -keySizeIPv4, 32),
+		goebpf.LoadMapFd(goebpf.R1, b.v4),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, -keySizeIPv4),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.Jump("match"),
+	)
+	// IPv6: key {128, saddr} at fp-20
+	insns = append(insns, xdpsrc.IPv6Src(-keySizeIPv6+4)...)
+	insns = append(insns,
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, -keySizeIPv6, 128),
+		goebpf.LoadMapFd(goebpf.R1, b.v6),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, -keySizeIPv6),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+
+		// R0 = value or NULL
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "pass").WithLabel("match"),
+		goebpf.Mov64Imm(goebpf.R1, 1),
+		goebpf.AtomicAdd(goebpf.SizeDouble, goebpf.R0, packetsOffset, goebpf.R1),
+		goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpDrop)),
+		goebpf.Exit(),
+
+		goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpPass)).WithLabel("pass"),
+		goebpf.Exit(),
+	)
+
+	return insns
+}
+
+// Returns map network belongs to
+func (b *Blocklist) mapOf(ipnet *net.IPNet) goebpf.Map {
+	if len(ipnet.IP) == net.IPv4len {
+		return b.v4
+	}
+	return b.v6
+}
+
+// Parses network in CIDR notation or single address,
+// IP of result is 4 bytes long for IPv4
+func parseNetwork(s string) (*net.IPNet, error) {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("Invalid network '%s'", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+			bits = 8 * net.IPv4len
+		}
+		ipnet = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	if ip4 := ipnet.IP.To4(); ip4 != nil && len(ipnet.Mask) == net.IPv4len {
+		ipnet.IP = ip4
+	}
+
+	return ipnet, nil
+}
+
+// Decodes raw key / value of blocklist map
+func decodeEntry(key, value []byte) (Entry, error) {
+	if len(key) != keySizeIPv4 && len(key) != keySizeIPv6 {
+		return Entry{}, fmt.Errorf("Invalid key size %d", len(key))
+	}
+	if len(value) < valueSize {
+		return Entry{}, fmt.Errorf("Invalid value size %d", len(value))
+	}
+	bo := goebpf.HostByteOrder()
+	addr := append(net.IP(nil), key[4:]...)
+	prefixLen := int(bo.Uint32(key))
+	if prefixLen > 8*len(addr) {
+		return Entry{}, fmt.Errorf("Invalid prefix length %d", prefixLen)
+	}
+
+	e := Entry{
+		Network: &net.IPNet{IP: addr, Mask: net.CIDRMask(prefixLen, 8*len(addr))},
+		Packets: bo.Uint64(value[packetsOffset:]),
+	}
+	if expires := int64(bo.Uint64(value)); expires != 0 {
+		e.Expires = time.Unix(0, expires)
+	}
+
+	return e, nil
+}
+
+// Reads all entries of blocklist map
+func listMap(m goebpf.Map) ([]Entry, error) {
+	var res []Entry
+	var key interface{}
+	for {
+		next, err := m.GetNextKey(key)
+		if err == goebpf.ErrNoMoreKeys {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		key = next
+		value, err := m.Lookup(next)
+		if err != nil {
+			// Removed in the meantime
+			continue
+		}
+		e, err := decodeEntry(next, value)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, e)
+	}
+
+	return res, nil
+}
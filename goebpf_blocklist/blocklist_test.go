@@ -0,0 +1,79 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_blocklist
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+)
+
+func TestParseNetwork(t *testing.T) {
+	cases := map[string]string{
+		"10.0.0.0/8":     "10.0.0.0/8",
+		"10.1.2.3/8":     "10.0.0.0/8",
+		"10.1.2.3":       "10.1.2.3/32",
+		"fc00::/7":       "fc00::/7",
+		"2001:db8::1":    "2001:db8::1/128",
+		"::ffff:1.2.3.4": "1.2.3.4/32",
+	}
+	for in, out := range cases {
+		ipnet, err := parseNetwork(in)
+		require.NoError(t, err, in)
+		assert.Equal(t, out, ipnet.String(), in)
+	}
+	// IPv4 networks are 4 bytes long, to go into IPv4 map
+	ipnet, err := parseNetwork("10.1.2.3")
+	require.NoError(t, err)
+	assert.Len(t, ipnet.IP, net.IPv4len)
+
+	for _, in := range []string{"", "10.0.0.0/33", "host", "10.0.0.0/"} {
+		_, err := parseNetwork(in)
+		assert.Error(t, err, in)
+	}
+}
+
+func TestDecodeEntry(t *testing.T) {
+	bo := goebpf.HostByteOrder()
+	key := make([]byte, keySizeIPv4)
+	bo.PutUint32(key, 24)
+	copy(key[4:], []byte{192, 168, 1, 0})
+	value := make([]byte, valueSize)
+	expires := time.Unix(1600000000, 0)
+	bo.PutUint64(value, uint64(expires.UnixNano()))
+	bo.PutUint64(value[packetsOffset:], 5)
+
+	e, err := decodeEntry(key, value)
+	require.NoError(t, err)
+	assert.Equal(t, "192.168.1.0/24", e.Network.String())
+	assert.True(t, expires.Equal(e.Expires))
+	assert.Equal(t, uint64(5), e.Packets)
+
+	// Never expires
+	bo.PutUint64(value, 0)
+	e, err = decodeEntry(key, value)
+	require.NoError(t, err)
+	assert.True(t, e.Expires.IsZero())
+
+	// Invalid ones
+	bo.PutUint32(key, 33)
+	_, err = decodeEntry(key, value)
+	assert.Error(t, err)
+	_, err = decodeEntry(key[:5], value)
+	assert.Error(t, err)
+	_, err = decodeEntry(make([]byte, keySizeIPv6), value[:8])
+	assert.Error(t, err)
+}
+
+func TestNewFromMaps(t *testing.T) {
+	_, err := NewFromMaps(nil, &goebpf.EbpfMap{})
+	assert.Error(t, err)
+	_, err = NewFromMaps(&goebpf.EbpfMap{}, nil)
+	assert.Error(t, err)
+}
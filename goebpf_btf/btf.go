@@ -0,0 +1,694 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_btf reads BPF Type Format (BTF) type information, either
+// embedded into ELF file (".BTF" section, clang -g) or raw one provided
+// by kernel (/sys/kernel/btf/vmlinux), and converts C types into Go declarations.
+package goebpf_btf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	btfMagic = 0xeB9F
+	// ELF section BTF data lives in
+	ElfSectionName = ".BTF"
+	// Location of kernel's own BTF
+	VmlinuxPath = "/sys/kernel/btf/vmlinux"
+	// Directory of BTF of kernel (vmlinux) and loaded kernel modules (by module name)
+	KernelBtfDir = "/sys/kernel/btf"
+)
+
+// Kind of BTF type, must be in sync with BTF_KIND_* from <linux/btf.h>
+type Kind int
+
+const (
+	KindUnknown Kind = iota
+	KindInt
+	KindPtr
+	KindArray
+	KindStruct
+	KindUnion
+	KindEnum
+	KindFwd
+	KindTypedef
+	KindVolatile
+	KindConst
+	KindRestrict
+	KindFunc
+	KindFuncProto
+	KindVar
+	KindDatasec
+	KindFloat
+	KindDeclTag
+	KindTypeTag
+	KindEnum64
+)
+
+func (k Kind) String() string {
+	switch k {
+	case KindInt:
+		return "Int"
+	case KindPtr:
+		return "Ptr"
+	case KindArray:
+		return "Array"
+	case KindStruct:
+		return "Struct"
+	case KindUnion:
+		return "Union"
+	case KindEnum:
+		return "Enum"
+	case KindFwd:
+		return "Fwd"
+	case KindTypedef:
+		return "Typedef"
+	case KindVolatile:
+		return "Volatile"
+	case KindConst:
+		return "Const"
+	case KindRestrict:
+		return "Restrict"
+	case KindFunc:
+		return "Func"
+	case KindFuncProto:
+		return "FuncProto"
+	case KindVar:
+		return "Var"
+	case KindDatasec:
+		return "Datasec"
+	case KindFloat:
+		return "Float"
+	case KindDeclTag:
+		return "DeclTag"
+	case KindTypeTag:
+		return "TypeTag"
+	case KindEnum64:
+		return "Enum64"
+	}
+
+	return "Unknown"
+}
+
+// Encoding flags of KindInt types
+const (
+	IntSigned = 1 << 0
+	IntChar   = 1 << 1
+	IntBool   = 1 << 2
+)
+
+// Member is field of struct / union
+type Member struct {
+	Name string
+	Type *Type
+	// Offset from beginning of struct, in bits
+	BitOffset int
+	// Non zero for bitfields
+	BitSize int
+}
+
+// Type is single BTF type. Meaning of fields depends on Kind.
+type Type struct {
+	ID   int
+	Kind Kind
+	Name string
+	// Size in bytes for Int / Struct / Union / Enum / Float / Datasec
+	Size int
+	// Int: IntSigned / IntChar / IntBool
+	Encoding int
+	// Int: amount of bits used
+	Bits int
+	// Referenced type for Ptr / Typedef / qualifiers / Func / Var, element type for Array
+	Target *Type
+	// Array: amount of elements
+	Len int
+	// Struct / Union fields, Datasec variables (of Var kind)
+	Members []Member
+
+	// Type ID of Target, resolved after all types read
+	targetID  int
+	memberIDs []int
+}
+
+// Spec is set of types from one BTF blob
+type Spec struct {
+	// Types by ID, index 0 is void. Types of split BTF (kernel modules)
+	// follow types of base one.
+	types  []*Type
+	byName map[string][]*Type
+	// Strings section, referenced by split BTF as well
+	strs []byte
+	base *Spec
+}
+
+// ErrNotFound returned when there is no BTF / requested type
+var ErrNotFound = errors.New("Not found")
+
+// LoadSpecFromElf reads BTF from ".BTF" section of given ELF file
+func LoadSpecFromElf(fn string) (*Spec, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := ParseSpecFromElf(data)
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %v", fn, err)
+	}
+
+	return spec, nil
+}
+
+// ParseSpecFromElf reads BTF of ELF file in memory, without any system calls
+// (e.g. to validate untrusted object files)
+func ParseSpecFromElf(data []byte) (*Spec, error) {
+	elfFile, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	section := elfFile.Section(ElfSectionName)
+	if section == nil {
+		return nil, fmt.Errorf("No '%s' section (compiled without -g?): %v", ElfSectionName, ErrNotFound)
+	}
+	btfData, err := section.Data()
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSpec(btfData, elfFile.ByteOrder)
+}
+
+// LoadSpecFromFile reads raw BTF, like /sys/kernel/btf/vmlinux
+func LoadSpecFromFile(fn string) (*Spec, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSpec(data, binary.LittleEndian)
+}
+
+// LoadKernelSpec reads BTF of running kernel
+func LoadKernelSpec() (*Spec, error) {
+	return LoadSpecFromFile(VmlinuxPath)
+}
+
+// LoadKernelModuleSpec reads BTF of loaded kernel module (linux 5.11+), which
+// extends kernel BTF base (see LoadKernelSpec())
+func LoadKernelModuleSpec(module string, base *Spec) (*Spec, error) {
+	if module == "" || module == "vmlinux" || strings.ContainsAny(module, "/.") {
+		return nil, fmt.Errorf("Invalid kernel module name '%s'", module)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(KernelBtfDir, module))
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseSplitSpec(data, binary.LittleEndian, base)
+}
+
+// KernelModules returns names of loaded kernel modules having BTF
+func KernelModules() ([]string, error) {
+	files, err := ioutil.ReadDir(KernelBtfDir)
+	if err != nil {
+		return nil, err
+	}
+	var modules []string
+	for _, f := range files {
+		if f.Name() != "vmlinux" {
+			modules = append(modules, f.Name())
+		}
+	}
+
+	return modules, nil
+}
+
+type btfHeader struct {
+	Magic   uint16
+	Version uint8
+	Flags   uint8
+	HdrLen  uint32
+	TypeOff uint32
+	TypeLen uint32
+	StrOff  uint32
+	StrLen  uint32
+}
+
+type btfRawType struct {
+	NameOff uint32
+	Info    uint32
+	// Size or Type depending on kind
+	SizeType uint32
+}
+
+// ParseSpec parses raw BTF data. Byte order is detected automatically,
+// bo is only first guess.
+func ParseSpec(data []byte, bo binary.ByteOrder) (*Spec, error) {
+	return parseSpec(data, bo, nil)
+}
+
+// ParseSplitSpec parses split BTF data (e.g. of kernel module): its type
+// IDs and string offsets continue ones of base, types may refer to base types.
+func ParseSplitSpec(data []byte, bo binary.ByteOrder, base *Spec) (*Spec, error) {
+	if base == nil {
+		return nil, errors.New("Base BTF of split BTF must be set")
+	}
+	return parseSpec(data, bo, base)
+}
+
+func parseSpec(data []byte, bo binary.ByteOrder, base *Spec) (*Spec, error) {
+	var hdr btfHeader
+	if err := binary.Read(bytes.NewReader(data), bo, &hdr); err != nil {
+		return nil, fmt.Errorf("Invalid BTF header: %v", err)
+	}
+	if hdr.Magic != btfMagic {
+		// Try another byte order
+		if bo == binary.LittleEndian {
+			bo = binary.BigEndian
+		} else {
+			bo = binary.LittleEndian
+		}
+		binary.Read(bytes.NewReader(data), bo, &hdr)
+		if hdr.Magic != btfMagic {
+			return nil, errors.New("Invalid BTF magic")
+		}
+	}
+	start := uint64(hdr.HdrLen)
+	typesEnd := start + uint64(hdr.TypeOff) + uint64(hdr.TypeLen)
+	strEnd := start + uint64(hdr.StrOff) + uint64(hdr.StrLen)
+	if typesEnd > uint64(len(data)) || strEnd > uint64(len(data)) {
+		return nil, errors.New("Invalid BTF header: sections out of data")
+	}
+	strs := data[start+uint64(hdr.StrOff) : strEnd]
+	types := data[start+uint64(hdr.TypeOff) : typesEnd]
+
+	getString := func(off uint32) (string, error) {
+		sec := strs
+		if base != nil {
+			// Offsets below end of base strings refer to base ones
+			if int(off) < len(base.strs) {
+				sec = base.strs
+			} else {
+				off -= uint32(len(base.strs))
+			}
+		}
+		if int(off) >= len(sec) && off != 0 {
+			return "", fmt.Errorf("Invalid BTF string offset %d", off)
+		}
+		if len(sec) == 0 {
+			return "", nil
+		}
+		end := bytes.IndexByte(sec[off:], 0)
+		if end < 0 {
+			return "", fmt.Errorf("Unterminated BTF string at offset %d", off)
+		}
+		return string(sec[off : int(off)+end]), nil
+	}
+
+	spec := &Spec{
+		types:  []*Type{{Kind: KindUnknown, Name: "void"}},
+		byName: make(map[string][]*Type),
+		strs:   strs,
+		base:   base,
+	}
+	if base != nil {
+		spec.types = append([]*Type{}, base.types...)
+	}
+	first := len(spec.types)
+	reader := bytes.NewReader(types)
+	for reader.Len() > 0 {
+		var raw btfRawType
+		if err := binary.Read(reader, bo, &raw); err != nil {
+			return nil, fmt.Errorf("Unable to read BTF type %d: %v", len(spec.types), err)
+		}
+		name, err := getString(raw.NameOff)
+		if err != nil {
+			return nil, err
+		}
+		vlen := int(raw.Info & 0xffff)
+		kindFlag := raw.Info>>31 != 0
+		t := &Type{
+			ID:   len(spec.types),
+			Kind: Kind((raw.Info >> 24) & 0x1f),
+			Name: name,
+		}
+
+		switch t.Kind {
+		case KindInt:
+			var enc uint32
+			if err := binary.Read(reader, bo, &enc); err != nil {
+				return nil, err
+			}
+			t.Size = int(raw.SizeType)
+			t.Encoding = int(enc>>24) & 0xf
+			t.Bits = int(enc & 0xff)
+		case KindPtr, KindTypedef, KindVolatile, KindConst, KindRestrict, KindFunc, KindTypeTag:
+			t.targetID = int(raw.SizeType)
+		case KindArray:
+			var arr struct {
+				Type      uint32
+				IndexType uint32
+				Nelems    uint32
+			}
+			if err := binary.Read(reader, bo, &arr); err != nil {
+				return nil, err
+			}
+			t.targetID = int(arr.Type)
+			t.Len = int(arr.Nelems)
+		case KindStruct, KindUnion:
+			t.Size = int(raw.SizeType)
+			for i := 0; i < vlen; i++ {
+				var m struct {
+					NameOff uint32
+					Type    uint32
+					Offset  uint32
+				}
+				if err := binary.Read(reader, bo, &m); err != nil {
+					return nil, err
+				}
+				mname, err := getString(m.NameOff)
+				if err != nil {
+					return nil, err
+				}
+				member := Member{Name: mname, BitOffset: int(m.Offset)}
+				if kindFlag {
+					member.BitOffset = int(m.Offset & 0xffffff)
+					member.BitSize = int(m.Offset >> 24)
+				}
+				t.Members = append(t.Members, member)
+				t.memberIDs = append(t.memberIDs, int(m.Type))
+			}
+		case KindEnum:
+			t.Size = int(raw.SizeType)
+			if _, err := reader.Seek(int64(vlen*8), io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		case KindEnum64:
+			t.Size = int(raw.SizeType)
+			if _, err := reader.Seek(int64(vlen*12), io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		case KindFwd, KindFloat:
+			t.Size = int(raw.SizeType)
+		case KindFuncProto:
+			t.targetID = int(raw.SizeType)
+			if _, err := reader.Seek(int64(vlen*8), io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		case KindVar, KindDeclTag:
+			t.targetID = int(raw.SizeType)
+			if _, err := reader.Seek(4, io.SeekCurrent); err != nil {
+				return nil, err
+			}
+		case KindDatasec:
+			t.Size = int(raw.SizeType)
+			for i := 0; i < vlen; i++ {
+				// struct btf_var_secinfo
+				var v struct {
+					Type   uint32
+					Offset uint32
+					Size   uint32
+				}
+				if err := binary.Read(reader, bo, &v); err != nil {
+					return nil, err
+				}
+				t.Members = append(t.Members, Member{BitOffset: int(v.Offset) * 8})
+				t.memberIDs = append(t.memberIDs, int(v.Type))
+			}
+		default:
+			return nil, fmt.Errorf("Unsupported BTF kind %d of type %d", t.Kind, t.ID)
+		}
+		spec.types = append(spec.types, t)
+		if name != "" {
+			spec.byName[name] = append(spec.byName[name], t)
+		}
+	}
+
+	// Resolve references
+	resolve := func(id int) (*Type, error) {
+		if id < 0 || id >= len(spec.types) {
+			return nil, fmt.Errorf("Invalid BTF type reference %d", id)
+		}
+		return spec.types[id], nil
+	}
+	for _, t := range spec.types[first:] {
+		var err error
+		if t.targetID != 0 {
+			if t.Target, err = resolve(t.targetID); err != nil {
+				return nil, err
+			}
+		}
+		for idx, id := range t.memberIDs {
+			if t.Members[idx].Type, err = resolve(id); err != nil {
+				return nil, err
+			}
+			// Datasec variables are named by Var types
+			if t.Kind == KindDatasec {
+				t.Members[idx].Name = t.Members[idx].Type.Name
+			}
+		}
+	}
+
+	return spec, nil
+}
+
+// TypeByID returns type by its BTF type ID
+func (s *Spec) TypeByID(id int) (*Type, error) {
+	if id <= 0 || id >= len(s.types) {
+		return nil, ErrNotFound
+	}
+	return s.types[id], nil
+}
+
+// TypeByName returns first type with given name and kind. Types of split
+// BTF are looked up before types of its base.
+func (s *Spec) TypeByName(name string, kind Kind) (*Type, error) {
+	t, err := s.OwnTypeByName(name, kind)
+	if err == ErrNotFound && s.base != nil {
+		return s.base.TypeByName(name, kind)
+	}
+	return t, err
+}
+
+// OwnTypeByName is TypeByName() not looking into base of split BTF, e.g. to
+// find out whether function belongs to kernel module
+func (s *Spec) OwnTypeByName(name string, kind Kind) (*Type, error) {
+	for _, t := range s.byName[name] {
+		if t.Kind == kind {
+			return t, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// OwnNames returns sorted names of types of given kind, not including types
+// of base of split BTF, e.g. names of all kernel functions
+func (s *Spec) OwnNames(kind Kind) []string {
+	var names []string
+	for name, types := range s.byName {
+		for _, t := range types {
+			if t.Kind == kind {
+				names = append(names, name)
+				break
+			}
+		}
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Len returns amount of types in spec (excluding void), including types of
+// base of split BTF
+func (s *Spec) Len() int {
+	return len(s.types) - 1
+}
+
+// Skips typedefs and qualifiers (const, volatile, etc)
+func underlying(t *Type) *Type {
+	for t != nil {
+		switch t.Kind {
+		case KindTypedef, KindVolatile, KindConst, KindRestrict, KindTypeTag:
+			t = t.Target
+		default:
+			return t
+		}
+	}
+	return t
+}
+
+// SizeOf returns size of type in bytes
+func SizeOf(t *Type) (int, error) {
+	t = underlying(t)
+	if t == nil {
+		return 0, errors.New("Cannot get size of void")
+	}
+	switch t.Kind {
+	case KindInt, KindStruct, KindUnion, KindEnum, KindEnum64, KindFloat:
+		return t.Size, nil
+	case KindPtr:
+		// BPF is always 64 bit
+		return 8, nil
+	case KindArray:
+		size, err := SizeOf(t.Target)
+		return size * t.Len, err
+	}
+	return 0, fmt.Errorf("Cannot get size of %v type '%s'", t.Kind, t.Name)
+}
+
+// FormatValue renders raw value of type t (e.g. global variable) the way bpftool
+// does for metadata: integers as numbers, char arrays as strings, anything else as hex
+func FormatValue(t *Type, data []byte, bo binary.ByteOrder) string {
+	t = underlying(t)
+	if t != nil && t.Kind == KindInt && t.Size <= len(data) {
+		var val uint64
+		switch t.Size {
+		case 1:
+			val = uint64(data[0])
+		case 2:
+			val = uint64(bo.Uint16(data))
+		case 4:
+			val = uint64(bo.Uint32(data))
+		case 8:
+			val = bo.Uint64(data)
+		default:
+			return fmt.Sprintf("%x", data)
+		}
+		if t.Encoding&IntBool != 0 {
+			return strconv.FormatBool(val != 0)
+		}
+		if t.Encoding&IntSigned != 0 {
+			// Sign extend
+			shift := uint(64 - t.Size*8)
+			return strconv.FormatInt(int64(val<<shift)>>shift, 10)
+		}
+		return strconv.FormatUint(val, 10)
+	}
+	if t != nil && t.Kind == KindArray {
+		if elem := underlying(t.Target); elem != nil && elem.Kind == KindInt && elem.Size == 1 {
+			if idx := bytes.IndexByte(data, 0); idx >= 0 {
+				data = data[:idx]
+			}
+			return string(data)
+		}
+	}
+	return fmt.Sprintf("%x", data)
+}
+
+// SpinLockOffset returns byte offset of struct bpf_spin_lock field of map value type t.
+// Kernel allows spin lock only as top level member of struct value, so nested
+// structs are not searched. Returns false if value has no spin lock.
+func SpinLockOffset(t *Type) (int, bool) {
+	return specialFieldOffset(t, "bpf_spin_lock")
+}
+
+// TimerOffset returns byte offset of struct bpf_timer field of map value type t,
+// the same way as SpinLockOffset() does
+func TimerOffset(t *Type) (int, bool) {
+	return specialFieldOffset(t, "bpf_timer")
+}
+
+// Finds top level member of struct t having struct type structName
+func specialFieldOffset(t *Type, structName string) (int, bool) {
+	t = underlying(t)
+	if t == nil || t.Kind != KindStruct {
+		return 0, false
+	}
+	for _, m := range t.Members {
+		mt := underlying(m.Type)
+		if mt != nil && mt.Kind == KindStruct && mt.Name == structName {
+			return m.BitOffset / 8, true
+		}
+	}
+	return 0, false
+}
+
+// FieldOffset returns byte offset of field of struct / union t by dotted path,
+// e.g. "mm.arg_start" for nested structs (not pointers). Members of anonymous
+// structs / unions are found as if they were members of t itself, like C does.
+// Useful to read kernel structs (e.g. task_struct of kernel BTF) by programs.
+func FieldOffset(t *Type, path string) (int, error) {
+	offset := 0
+	for _, name := range strings.Split(path, ".") {
+		bits, field, ok := findMember(t, name)
+		if !ok || name == "" {
+			return 0, fmt.Errorf("No field '%s' in '%s': %v", name, path, ErrNotFound)
+		}
+		if bits%8 != 0 {
+			return 0, fmt.Errorf("Field '%s' is bitfield", path)
+		}
+		offset += bits / 8
+		t = field
+	}
+
+	return offset, nil
+}
+
+// Finds member of struct / union t by name, descending into anonymous members.
+// Returns bit offset and type of member.
+func findMember(t *Type, name string) (int, *Type, bool) {
+	t = underlying(t)
+	if t == nil || (t.Kind != KindStruct && t.Kind != KindUnion) {
+		return 0, nil, false
+	}
+	for _, m := range t.Members {
+		if m.Name == name {
+			return m.BitOffset, m.Type, true
+		}
+		if m.Name == "" {
+			if off, mt, ok := findMember(m.Type, name); ok {
+				return m.BitOffset + off, mt, true
+			}
+		}
+	}
+	return 0, nil, false
+}
+
+// SameLayout checks whether values of types a and b have the same memory
+// layout: sizes, integer encodings, array lengths and names / offsets of
+// struct / union members. Names of types themselves, typedefs and qualifiers
+// don't matter. Pointers are compared by kind only. Useful to detect changes
+// of map value types between versions of program.
+func SameLayout(a, b *Type) bool {
+	a, b = underlying(a), underlying(b)
+	if a == nil || b == nil {
+		return a == b
+	}
+	if a.Kind != b.Kind {
+		return false
+	}
+	switch a.Kind {
+	case KindInt:
+		return a.Size == b.Size && a.Encoding == b.Encoding && a.Bits == b.Bits
+	case KindEnum, KindEnum64, KindFloat:
+		return a.Size == b.Size
+	case KindPtr:
+		return true
+	case KindArray:
+		return a.Len == b.Len && SameLayout(a.Target, b.Target)
+	case KindStruct, KindUnion:
+		if a.Size != b.Size || len(a.Members) != len(b.Members) {
+			return false
+		}
+		for idx := range a.Members {
+			ma, mb := a.Members[idx], b.Members[idx]
+			if ma.Name != mb.Name || ma.BitOffset != mb.BitOffset || ma.BitSize != mb.BitSize ||
+				!SameLayout(ma.Type, mb.Type) {
+				return false
+			}
+		}
+		return true
+	}
+	return a.Size == b.Size && a.Name == b.Name
+}
@@ -0,0 +1,460 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_btf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Helper to build raw BTF blobs
+type btfBuilder struct {
+	types   bytes.Buffer
+	strings bytes.Buffer
+	nextID  int
+	// Split BTF: size of base strings section
+	strBase uint32
+}
+
+func newBtfBuilder() *btfBuilder {
+	b := &btfBuilder{nextID: 1}
+	b.strings.WriteByte(0)
+	return b
+}
+
+func (b *btfBuilder) str(s string) uint32 {
+	if s == "" {
+		return 0
+	}
+	off := b.strBase + uint32(b.strings.Len())
+	b.strings.WriteString(s)
+	b.strings.WriteByte(0)
+	return off
+}
+
+func (b *btfBuilder) add(name string, kind Kind, vlen int, kindFlag bool, sizeType uint32, extra ...uint32) int {
+	info := uint32(kind)<<24 | uint32(vlen)
+	if kindFlag {
+		info |= 1 << 31
+	}
+	binary.Write(&b.types, binary.LittleEndian, []uint32{b.str(name), info, sizeType})
+	binary.Write(&b.types, binary.LittleEndian, extra)
+	b.nextID++
+	return b.nextID - 1
+}
+
+func (b *btfBuilder) intType(name string, size int, encoding int) int {
+	return b.add(name, KindInt, 0, false, uint32(size), uint32(encoding)<<24|uint32(size*8))
+}
+
+// members: name, type id, bit offset, bit size
+func (b *btfBuilder) structType(name string, size int, members ...interface{}) int {
+	var extra []uint32
+	kindFlag := false
+	for i := 0; i < len(members); i += 4 {
+		bitSize := uint32(members[i+3].(int))
+		if bitSize != 0 {
+			kindFlag = true
+		}
+		extra = append(extra, b.str(members[i].(string)), uint32(members[i+1].(int)),
+			bitSize<<24|uint32(members[i+2].(int)))
+	}
+	return b.add(name, KindStruct, len(members)/4, kindFlag, uint32(size), extra...)
+}
+
+func (b *btfBuilder) bytes() []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, btfHeader{
+		Magic:   btfMagic,
+		Version: 1,
+		HdrLen:  24,
+		TypeOff: 0,
+		TypeLen: uint32(b.types.Len()),
+		StrOff:  uint32(b.types.Len()),
+		StrLen:  uint32(b.strings.Len()),
+	})
+	buf.Write(b.types.Bytes())
+	buf.Write(b.strings.Bytes())
+	return buf.Bytes()
+}
+
+// Builds:
+//
+//	typedef unsigned int __u32;
+//	struct inner { unsigned char a; unsigned long long b; };
+//	struct event {
+//		__u32 pid;
+//		char comm[16];
+//		struct inner in;
+//		void *ptr;
+//		unsigned int flag1:1, flag2:3;
+//		union { __u32 x; unsigned long long y; } u;
+//	};
+func buildTestSpec() []byte {
+	b := newBtfBuilder()
+	u8 := b.intType("unsigned char", 1, 0)
+	u32 := b.intType("unsigned int", 4, 0)
+	u64 := b.intType("unsigned long long", 8, 0)
+	char := b.intType("char", 1, IntSigned|IntChar)
+	typedefU32 := b.add("__u32", KindTypedef, 0, false, uint32(u32))
+	arr := b.add("", KindArray, 0, false, 0, uint32(char), uint32(u32), 16)
+	inner := b.structType("inner", 16, "a", u8, 0, 0, "b", u64, 64, 0)
+	ptr := b.add("", KindPtr, 0, false, 0)
+	union := b.add("", KindUnion, 2, false, 8,
+		b.str("x"), uint32(typedefU32), 0, b.str("y"), uint32(u64), 0)
+	// Layout clang produces for x86_64
+	b.structType("event", 64,
+		"pid", typedefU32, 0, 0,
+		"comm", arr, 32, 0,
+		"in", inner, 192, 0,
+		"ptr", ptr, 320, 0,
+		"flag1", u32, 384, 1,
+		"flag2", u32, 385, 3,
+		"u", union, 448, 0,
+	)
+	return b.bytes()
+}
+
+func TestParseSplitSpec(t *testing.T) {
+	baseData := buildTestSpec()
+	base, err := ParseSpec(baseData, binary.LittleEndian)
+	require.NoError(t, err)
+
+	// Module: int nf_func(struct inner *), with struct event of its own
+	b := &btfBuilder{nextID: base.Len() + 1, strBase: uint32(len(base.strs))}
+	inner, _ := base.TypeByName("inner", KindStruct)
+	ptr := b.add("", KindPtr, 0, false, uint32(inner.ID))
+	proto := b.add("", KindFuncProto, 1, false, 2, 0, uint32(ptr))
+	fn := b.add("nf_func", KindFunc, 0, false, uint32(proto))
+	b.structType("event", 4, "x", 2, 0, 0)
+
+	spec, err := ParseSplitSpec(b.bytes(), binary.LittleEndian, base)
+	require.NoError(t, err)
+	assert.Equal(t, base.Len()+4, spec.Len())
+	f, err := spec.TypeByName("nf_func", KindFunc)
+	require.NoError(t, err)
+	assert.Equal(t, fn, f.ID)
+	assert.Equal(t, "unsigned int", f.Target.Target.Name)
+	p, err := spec.TypeByID(ptr)
+	require.NoError(t, err)
+	assert.Equal(t, inner, p.Target)
+	f, err = spec.OwnTypeByName("nf_func", KindFunc)
+	require.NoError(t, err)
+	assert.Equal(t, fn, f.ID)
+
+	// Own types shadow base ones, base types are reachable
+	event, err := spec.TypeByName("event", KindStruct)
+	require.NoError(t, err)
+	assert.Equal(t, 4, event.Size)
+	_, err = spec.OwnTypeByName("inner", KindStruct)
+	assert.Equal(t, ErrNotFound, err)
+	found, err := spec.TypeByName("inner", KindStruct)
+	require.NoError(t, err)
+	assert.Equal(t, inner, found)
+	_, err = base.TypeByName("nf_func", KindFunc)
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, []string{"nf_func"}, spec.OwnNames(KindFunc))
+	assert.Equal(t, []string{"event"}, spec.OwnNames(KindStruct))
+	assert.Empty(t, base.OwnNames(KindFunc))
+
+	_, err = ParseSplitSpec(b.bytes(), binary.LittleEndian, nil)
+	assert.Error(t, err)
+	_, err = LoadKernelModuleSpec("../vmlinux", base)
+	assert.Error(t, err)
+}
+
+func TestParseSpec(t *testing.T) {
+	spec, err := ParseSpec(buildTestSpec(), binary.LittleEndian)
+	require.NoError(t, err)
+	assert.Equal(t, 10, spec.Len())
+
+	event, err := spec.TypeByName("event", KindStruct)
+	require.NoError(t, err)
+	assert.Equal(t, 64, event.Size)
+	require.Len(t, event.Members, 7)
+	assert.Equal(t, "__u32", event.Members[0].Type.Name)
+	assert.Equal(t, KindInt, underlying(event.Members[0].Type).Kind)
+	assert.Equal(t, 385, event.Members[5].BitOffset)
+	assert.Equal(t, 3, event.Members[5].BitSize)
+
+	size, err := SizeOf(event.Members[1].Type)
+	require.NoError(t, err)
+	assert.Equal(t, 16, size)
+
+	_, err = spec.TypeByName("event", KindUnion)
+	assert.Equal(t, ErrNotFound, err)
+	_, err = spec.TypeByID(100)
+	assert.Equal(t, ErrNotFound, err)
+
+	// Byte order detection
+	_, err = ParseSpec(buildTestSpec(), binary.BigEndian)
+	assert.NoError(t, err)
+	// Negative
+	_, err = ParseSpec([]byte{1, 2, 3}, binary.LittleEndian)
+	assert.Error(t, err)
+	data := buildTestSpec()
+	_, err = ParseSpec(data[:len(data)-10], binary.LittleEndian)
+	assert.Error(t, err)
+}
+
+// Go types GenerateGoTypes() produces from buildTestSpec()
+type testEvent struct {
+	Pid  uint32
+	Comm [16]int8
+	_    [4]byte
+	In   testInner
+	Ptr  uint64
+	_    [1]byte // bitfields: [flag1 flag2]
+	_    [7]byte
+	U    [8]byte
+}
+
+type testInner struct {
+	A uint8
+	_ [7]byte
+	B uint64
+}
+
+func TestGenerateGoTypes(t *testing.T) {
+	spec, err := ParseSpec(buildTestSpec(), binary.LittleEndian)
+	require.NoError(t, err)
+
+	src, err := GenerateGoTypes(spec, []string{"event"})
+	require.NoError(t, err)
+	assert.Equal(t, `// Event is Go version of C type 'event', 64 bytes
+type Event struct {
+	Pid  uint32
+	Comm [16]int8
+	_    [4]byte
+	In   Inner
+	Ptr  uint64
+	_    [1]byte // bitfields: [flag1 flag2]
+	_    [7]byte
+	U    [8]byte
+}
+
+// Inner is Go version of C type 'inner', 16 bytes
+type Inner struct {
+	A uint8
+	_ [7]byte
+	B uint64
+}
+`, string(src))
+
+	// Copies of generated types have layout of BTF ones
+	if unsafe.Sizeof(uintptr(0)) == 8 {
+		event, _ := spec.TypeByName("event", KindStruct)
+		inner, _ := spec.TypeByName("inner", KindStruct)
+		var e testEvent
+		assert.Equal(t, uintptr(event.Size), unsafe.Sizeof(e))
+		assert.Equal(t, uintptr(inner.Size), unsafe.Sizeof(e.In))
+		offsets := map[string]uintptr{
+			"pid":  unsafe.Offsetof(e.Pid),
+			"comm": unsafe.Offsetof(e.Comm),
+			"in":   unsafe.Offsetof(e.In),
+			"ptr":  unsafe.Offsetof(e.Ptr),
+			"u":    unsafe.Offsetof(e.U),
+		}
+		for _, m := range event.Members {
+			if offset, ok := offsets[m.Name]; ok {
+				assert.Equal(t, uintptr(m.BitOffset/8), offset, m.Name)
+			}
+		}
+		assert.Equal(t, uintptr(inner.Members[1].BitOffset/8), unsafe.Offsetof(e.In.B))
+	}
+
+	_, err = GenerateGoTypes(spec, []string{"nonexisting"})
+	assert.Error(t, err)
+}
+
+func TestGenerateGoTypesLayoutErrors(t *testing.T) {
+	b := newBtfBuilder()
+	u8 := b.intType("unsigned char", 1, 0)
+	u32 := b.intType("unsigned int", 4, 0)
+	u64 := b.intType("unsigned long long", 8, 0)
+	// __attribute__((packed)): Go would align b to 4 bytes
+	b.structType("packed", 5, "a", u8, 0, 0, "b", u32, 8, 0)
+	// Member beyond end of struct
+	b.structType("overflow", 4, "x", u64, 0, 0)
+	// Go would round size up to 8
+	b.structType("short", 12, "x", u64, 0, 0, "y", u32, 64, 0)
+	// Flexible array member is skipped
+	arr := b.add("", KindArray, 0, false, 0, uint32(u8), uint32(u32), 0)
+	b.structType("flex", 4, "len", u32, 0, 0, "data", arr, 32, 0)
+	spec, err := ParseSpec(b.bytes(), binary.LittleEndian)
+	require.NoError(t, err)
+
+	for _, name := range []string{"packed", "overflow", "short"} {
+		_, err := GenerateGoTypes(spec, []string{name})
+		assert.Error(t, err, name)
+	}
+	src, err := GenerateGoTypes(spec, []string{"flex"})
+	require.NoError(t, err)
+	assert.Contains(t, string(src), "// data: zero sized member at offset 4")
+}
+
+func TestGoName(t *testing.T) {
+	runs := map[string]string{
+		"packet_count": "PacketCount",
+		"txcnt":        "Txcnt",
+		"xdp-fw.v2":    "XdpFwV2",
+		"_private":     "Private",
+		"1st":          "X1st",
+	}
+
+	for name, expected := range runs {
+		assert.Equal(t, expected, GoName(name))
+	}
+}
+
+func TestSpinLockOffset(t *testing.T) {
+	u32 := &Type{Kind: KindInt, Name: "__u32", Size: 4}
+	lock := &Type{Kind: KindStruct, Name: "bpf_spin_lock", Size: 4, Members: []Member{{Name: "val", Type: u32}}}
+	value := &Type{Kind: KindStruct, Name: "value", Size: 8, Members: []Member{
+		{Name: "cnt", Type: u32},
+		{Name: "lock", Type: lock, BitOffset: 32},
+	}}
+	typedef := &Type{Kind: KindTypedef, Name: "value_t", Target: value}
+
+	off, ok := SpinLockOffset(typedef)
+	assert.True(t, ok)
+	assert.Equal(t, 4, off)
+
+	// No spin lock / not a struct
+	_, ok = SpinLockOffset(lock)
+	assert.False(t, ok)
+	_, ok = SpinLockOffset(u32)
+	assert.False(t, ok)
+	_, ok = SpinLockOffset(nil)
+	assert.False(t, ok)
+}
+
+func TestTimerOffset(t *testing.T) {
+	u64 := &Type{Kind: KindInt, Name: "__u64", Size: 8}
+	timer := &Type{Kind: KindStruct, Name: "bpf_timer", Size: 16}
+	value := &Type{Kind: KindStruct, Name: "elem", Size: 24, Members: []Member{
+		{Name: "t", Type: timer},
+		{Name: "cnt", Type: u64, BitOffset: 128},
+	}}
+
+	off, ok := TimerOffset(value)
+	assert.True(t, ok)
+	assert.Equal(t, 0, off)
+	_, ok = SpinLockOffset(value)
+	assert.False(t, ok)
+}
+
+func TestFormatValue(t *testing.T) {
+	spec, err := ParseSpec(buildTestSpec(), binary.LittleEndian)
+	require.NoError(t, err)
+	event, err := spec.TypeByName("event", KindStruct)
+	require.NoError(t, err)
+
+	// __u32 pid
+	assert.Equal(t, "258", FormatValue(event.Members[0].Type, []byte{2, 1, 0, 0}, binary.LittleEndian))
+	// char comm[16]
+	assert.Equal(t, "abc", FormatValue(event.Members[1].Type, []byte("abc\x00\x00\x00"), binary.LittleEndian))
+	// struct inner
+	assert.Equal(t, "0102", FormatValue(event.Members[2].Type, []byte{1, 2}, binary.LittleEndian))
+	// Signed / bool
+	b := newBtfBuilder()
+	b.intType("int", 4, IntSigned)
+	b.intType("_Bool", 1, IntBool)
+	spec, err = ParseSpec(b.bytes(), binary.LittleEndian)
+	require.NoError(t, err)
+	i32, _ := spec.TypeByName("int", KindInt)
+	assert.Equal(t, "-2", FormatValue(i32, []byte{0xfe, 0xff, 0xff, 0xff}, binary.LittleEndian))
+	boolean, _ := spec.TypeByName("_Bool", KindInt)
+	assert.Equal(t, "true", FormatValue(boolean, []byte{1}, binary.LittleEndian))
+	// Truncated
+	assert.Equal(t, "01", FormatValue(i32, []byte{1}, binary.LittleEndian))
+}
+
+func TestFieldOffset(t *testing.T) {
+	u32 := &Type{Kind: KindInt, Name: "__u32", Size: 4}
+	u64 := &Type{Kind: KindInt, Name: "__u64", Size: 8}
+	inner := &Type{Kind: KindStruct, Name: "inner", Size: 16, Members: []Member{
+		{Name: "a", Type: u64},
+		{Name: "b", Type: u64, BitOffset: 64},
+	}}
+	anon := &Type{Kind: KindStruct, Size: 24, Members: []Member{
+		{Name: "c", Type: u64},
+		{Name: "in", Type: inner, BitOffset: 64},
+	}}
+	outer := &Type{Kind: KindStruct, Name: "outer", Size: 40, Members: []Member{
+		{Name: "flags", Type: u32, BitSize: 3},
+		{Name: "x", Type: u32, BitOffset: 32},
+		{Type: anon, BitOffset: 128},
+	}}
+
+	for path, expected := range map[string]int{
+		"x":    4,
+		"c":    16,
+		"in":   24,
+		"in.b": 32,
+	} {
+		off, err := FieldOffset(outer, path)
+		require.NoError(t, err, path)
+		assert.Equal(t, expected, off, path)
+	}
+	for _, path := range []string{"y", "in.c", "x.a", ""} {
+		_, err := FieldOffset(outer, path)
+		assert.Error(t, err, path)
+	}
+
+	// Kernel types, if BTF is available
+	spec, err := LoadKernelSpec()
+	if err != nil {
+		return
+	}
+	task, err := spec.TypeByName("task_struct", KindStruct)
+	require.NoError(t, err)
+	_, err = FieldOffset(task, "real_parent")
+	assert.NoError(t, err)
+}
+
+func TestSameLayout(t *testing.T) {
+	u32 := &Type{Kind: KindInt, Name: "__u32", Size: 4, Bits: 32}
+	u64 := &Type{Kind: KindInt, Name: "__u64", Size: 8, Bits: 64}
+	s32 := &Type{Kind: KindInt, Name: "int", Size: 4, Bits: 32, Encoding: IntSigned}
+	v1 := &Type{Kind: KindStruct, Name: "value", Size: 16, Members: []Member{
+		{Name: "packets", Type: u64},
+		{Name: "bytes", Type: u64, BitOffset: 64},
+	}}
+	// Renamed struct behind typedef
+	v1copy := &Type{Kind: KindTypedef, Name: "value_t", Target: &Type{Kind: KindStruct, Name: "value_v1", Size: 16, Members: []Member{
+		{Name: "packets", Type: &Type{Kind: KindTypedef, Name: "u64", Target: u64}},
+		{Name: "bytes", Type: u64, BitOffset: 64},
+	}}}
+	// Field added
+	v2 := &Type{Kind: KindStruct, Name: "value", Size: 24, Members: []Member{
+		{Name: "packets", Type: u64},
+		{Name: "bytes", Type: u64, BitOffset: 64},
+		{Name: "drops", Type: u64, BitOffset: 128},
+	}}
+	// Field renamed
+	v3 := &Type{Kind: KindStruct, Name: "value", Size: 16, Members: []Member{
+		{Name: "pkts", Type: u64},
+		{Name: "bytes", Type: u64, BitOffset: 64},
+	}}
+
+	assert.True(t, SameLayout(v1, v1copy))
+	assert.False(t, SameLayout(v1, v2))
+	assert.False(t, SameLayout(v1, v3))
+	assert.False(t, SameLayout(u32, s32))
+	assert.False(t, SameLayout(u32, u64))
+	assert.False(t, SameLayout(u32, nil))
+	assert.True(t, SameLayout(nil, nil))
+	assert.True(t, SameLayout(
+		&Type{Kind: KindArray, Len: 4, Target: u32},
+		&Type{Kind: KindArray, Len: 4, Target: &Type{Kind: KindConst, Target: u32}}))
+	assert.False(t, SameLayout(
+		&Type{Kind: KindArray, Len: 4, Target: u32},
+		&Type{Kind: KindArray, Len: 8, Target: u32}))
+}
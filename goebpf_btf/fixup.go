@@ -0,0 +1,116 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_btf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// Size of raw type header (struct btf_type)
+const btfRawTypeSize = 12
+
+// Returns size of kind specific data following struct btf_type
+func extraSize(kind Kind, vlen int) (int, error) {
+	switch kind {
+	case KindInt, KindVar, KindDeclTag:
+		return 4, nil
+	case KindPtr, KindTypedef, KindVolatile, KindConst, KindRestrict,
+		KindFunc, KindTypeTag, KindFwd, KindFloat:
+		return 0, nil
+	case KindArray:
+		return 12, nil
+	case KindStruct, KindUnion, KindEnum64, KindDatasec:
+		return vlen * 12, nil
+	case KindEnum, KindFuncProto:
+		return vlen * 8, nil
+	}
+	return 0, fmt.Errorf("Unsupported BTF kind %d", kind)
+}
+
+// FixupDataSections prepares BTF read from ELF file for loading into kernel.
+// clang leaves sizes of data sections (Datasec) and offsets of variables inside
+// them zero: real values are known only from ELF section headers / symbols,
+// which are queried by sectionSize / varOffset callbacks (libbpf does the same).
+// data is patched in place, bo is byte order of ELF file.
+func FixupDataSections(data []byte, bo binary.ByteOrder,
+	sectionSize func(section string) (uint32, bool),
+	varOffset func(section, name string) (uint32, bool)) error {
+
+	var hdr btfHeader
+	if err := binary.Read(bytes.NewReader(data), bo, &hdr); err != nil {
+		return fmt.Errorf("Invalid BTF header: %v", err)
+	}
+	if hdr.Magic != btfMagic {
+		return errors.New("Invalid BTF magic")
+	}
+	start := uint64(hdr.HdrLen)
+	typesEnd := start + uint64(hdr.TypeOff) + uint64(hdr.TypeLen)
+	strEnd := start + uint64(hdr.StrOff) + uint64(hdr.StrLen)
+	if typesEnd > uint64(len(data)) || strEnd > uint64(len(data)) {
+		return errors.New("Invalid BTF header: sections out of data")
+	}
+	strs := data[start+uint64(hdr.StrOff) : strEnd]
+	types := data[start+uint64(hdr.TypeOff) : typesEnd]
+
+	getString := func(off uint32) string {
+		if int(off) >= len(strs) {
+			return ""
+		}
+		end := bytes.IndexByte(strs[off:], 0)
+		if end < 0 {
+			return ""
+		}
+		return string(strs[off : int(off)+end])
+	}
+
+	// First pass: names of all types (datasec refers to variables by ID)
+	// and positions of datasecs
+	names := []string{""}
+	var datasecs []int
+	for pos := 0; pos < len(types); {
+		if pos+btfRawTypeSize > len(types) {
+			return fmt.Errorf("Truncated BTF type %d", len(names))
+		}
+		info := bo.Uint32(types[pos+4:])
+		kind := Kind((info >> 24) & 0x1f)
+		extra, err := extraSize(kind, int(info&0xffff))
+		if err != nil {
+			return err
+		}
+		if pos+btfRawTypeSize+extra > len(types) {
+			return fmt.Errorf("Truncated BTF type %d", len(names))
+		}
+		if kind == KindDatasec {
+			datasecs = append(datasecs, pos)
+		}
+		names = append(names, getString(bo.Uint32(types[pos:])))
+		pos += btfRawTypeSize + extra
+	}
+
+	// Second pass: patch datasecs, struct btf_var_secinfo is {type, offset, size}
+	for _, pos := range datasecs {
+		section := getString(bo.Uint32(types[pos:]))
+		if bo.Uint32(types[pos+8:]) == 0 {
+			if size, ok := sectionSize(section); ok {
+				bo.PutUint32(types[pos+8:], size)
+			}
+		}
+		vlen := int(bo.Uint32(types[pos+4:]) & 0xffff)
+		for i := 0; i < vlen; i++ {
+			secinfo := types[pos+btfRawTypeSize+i*12:]
+			id := int(bo.Uint32(secinfo))
+			if id <= 0 || id >= len(names) {
+				return fmt.Errorf("Invalid BTF type reference %d in datasec '%s'", id, section)
+			}
+			if offset, ok := varOffset(section, names[id]); ok {
+				bo.PutUint32(secinfo[4:], offset)
+			}
+		}
+	}
+
+	return nil
+}
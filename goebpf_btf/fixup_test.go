@@ -0,0 +1,60 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_btf
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFixupDataSections(t *testing.T) {
+	// int a, b; in section ".data" as emitted by clang: zero size / offsets
+	b := newBtfBuilder()
+	i32 := b.intType("int", 4, IntSigned)
+	varA := b.add("a", KindVar, 0, false, uint32(i32), 1)
+	varB := b.add("b", KindVar, 0, false, uint32(i32), 1)
+	b.add(".data", KindDatasec, 2, false, 0,
+		uint32(varA), 0, 4,
+		uint32(varB), 0, 4,
+	)
+	data := b.bytes()
+
+	err := FixupDataSections(data, binary.LittleEndian,
+		func(section string) (uint32, bool) {
+			return 8, section == ".data"
+		},
+		func(section, name string) (uint32, bool) {
+			if name == "b" {
+				return 4, true
+			}
+			return 0, name == "a"
+		})
+	require.NoError(t, err)
+
+	// Datasec is the last type: header (24) + int (16) + 2 vars (16 each)
+	datasec := data[24+16+16+16:]
+	assert.Equal(t, uint32(8), binary.LittleEndian.Uint32(datasec[8:]))
+	assert.Equal(t, uint32(0), binary.LittleEndian.Uint32(datasec[12+4:]))
+	assert.Equal(t, uint32(4), binary.LittleEndian.Uint32(datasec[24+4:]))
+
+	// Result is still valid BTF, with variables at fixed offsets
+	spec, err := ParseSpec(data, binary.LittleEndian)
+	require.NoError(t, err)
+	sec, err := spec.TypeByName(".data", KindDatasec)
+	require.NoError(t, err)
+	assert.Equal(t, 8, sec.Size)
+	require.Len(t, sec.Members, 2)
+	assert.Equal(t, "b", sec.Members[1].Name)
+	assert.Equal(t, 32, sec.Members[1].BitOffset)
+	assert.Equal(t, KindVar, sec.Members[1].Type.Kind)
+	assert.Equal(t, "int", sec.Members[1].Type.Target.Name)
+
+	// Negative
+	assert.Error(t, FixupDataSections([]byte{1, 2, 3}, binary.LittleEndian, nil, nil))
+	data = buildTestSpec()
+	assert.Error(t, FixupDataSections(data[:len(data)-10], binary.LittleEndian, nil, nil))
+}
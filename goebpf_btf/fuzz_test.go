@@ -0,0 +1,37 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_btf
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+// BTF of third-party object files is untrusted input:
+// parsing / formatting must fail by errors, never by panics or hangs.
+func FuzzParseSpec(f *testing.F) {
+	f.Add(buildTestSpec())
+	b := newBtfBuilder()
+	b.intType("int", 4, IntSigned)
+	f.Add(b.bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		spec, err := ParseSpec(data, binary.LittleEndian)
+		if err != nil {
+			return
+		}
+		value := make([]byte, 64)
+		for id := 1; id < spec.Len(); id++ {
+			typ, err := spec.TypeByID(id)
+			if err != nil {
+				continue
+			}
+			SizeOf(typ)
+			FormatValue(typ, value, binary.LittleEndian)
+			SpinLockOffset(typ)
+			SameLayout(typ, typ)
+		}
+		GenerateGoTypes(spec, spec.OwnNames(KindStruct))
+	})
+}
@@ -0,0 +1,298 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_btf
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"sort"
+	"unicode"
+)
+
+// GoName converts C identifier into exported Go one, e.g. "packet_count" -> "PacketCount"
+func GoName(name string) string {
+	var b bytes.Buffer
+	upper := true
+	for _, r := range name {
+		if r == '_' || r == '-' || r == '.' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	result := b.String()
+	if result == "" || !unicode.IsLetter(rune(result[0])) {
+		result = "X" + result
+	}
+	return result
+}
+
+// Converts BTF types into Go declarations
+type goGenerator struct {
+	spec *Spec
+	// Go names of named types already generated / queued
+	names map[*Type]string
+	queue []*Type
+	out   bytes.Buffer
+}
+
+// GenerateGoTypes converts given C structs / unions / typedefs (by name)
+// into Go type declarations with explicit padding, so memory layout of Go struct
+// matches C one (on 64 bit platforms) and it can be used with binary.Read() or unsafe cast.
+// Types Go can't lay out the same way (e.g. packed structs with unaligned members) are errors.
+// All named structs referenced by given types are generated as well.
+// Pointers become uint64, unions and bitfields - byte arrays of the same size.
+// Result is gofmt'ed source without package clause.
+func GenerateGoTypes(spec *Spec, names []string) ([]byte, error) {
+	g := &goGenerator{
+		spec:  spec,
+		names: make(map[*Type]string),
+	}
+	for _, name := range names {
+		t, err := spec.lookupDeclaration(name)
+		if err != nil {
+			return nil, fmt.Errorf("Type '%s': %v", name, err)
+		}
+		g.enqueue(t, GoName(name))
+	}
+	for len(g.queue) > 0 {
+		t := g.queue[0]
+		g.queue = g.queue[1:]
+		if err := g.declare(t); err != nil {
+			return nil, err
+		}
+	}
+
+	src := append(bytes.TrimRight(g.out.Bytes(), "\n"), '\n')
+	return format.Source(src)
+}
+
+// Finds struct / union / typedef / enum by name
+func (s *Spec) lookupDeclaration(name string) (*Type, error) {
+	for _, kind := range []Kind{KindStruct, KindUnion, KindTypedef, KindEnum} {
+		if t, err := s.TypeByName(name, kind); err == nil {
+			return t, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+func (g *goGenerator) enqueue(t *Type, name string) string {
+	if existing, ok := g.names[t]; ok {
+		return existing
+	}
+	g.names[t] = name
+	g.queue = append(g.queue, t)
+	return name
+}
+
+// Emits "type Name ..." declaration
+func (g *goGenerator) declare(t *Type) error {
+	name := g.names[t]
+	size, err := SizeOf(t)
+	if err != nil {
+		return err
+	}
+	var body string
+	if u := underlying(t); u.Kind == KindStruct {
+		body, err = g.structBody(u)
+	} else {
+		body, err = g.typeExpr(u)
+	}
+	if err != nil {
+		return fmt.Errorf("Type '%s': %v", t.Name, err)
+	}
+	fmt.Fprintf(&g.out, "// %s is Go version of C type '%s', %d bytes\ntype %s %s\n\n", name, t.Name, size, name, body)
+
+	return nil
+}
+
+// Returns Go type expression for t
+func (g *goGenerator) typeExpr(t *Type) (string, error) {
+	orig := t
+	t = underlying(t)
+	if t == nil {
+		return "", fmt.Errorf("void type")
+	}
+
+	switch t.Kind {
+	case KindInt:
+		if t.Encoding&IntBool != 0 && t.Size == 1 {
+			return "bool", nil
+		}
+		switch t.Size {
+		case 1, 2, 4, 8:
+			prefix := "uint"
+			if t.Encoding&IntSigned != 0 {
+				prefix = "int"
+			}
+			return fmt.Sprintf("%s%d", prefix, t.Size*8), nil
+		}
+		return fmt.Sprintf("[%d]byte", t.Size), nil
+	case KindFloat:
+		if t.Size == 4 || t.Size == 8 {
+			return fmt.Sprintf("float%d", t.Size*8), nil
+		}
+		return fmt.Sprintf("[%d]byte", t.Size), nil
+	case KindEnum, KindEnum64:
+		switch t.Size {
+		case 1, 2, 4, 8:
+			return fmt.Sprintf("uint%d", t.Size*8), nil
+		}
+		return fmt.Sprintf("[%d]byte", t.Size), nil
+	case KindPtr:
+		return "uint64", nil
+	case KindArray:
+		elem, err := g.typeExpr(t.Target)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("[%d]%s", t.Len, elem), nil
+	case KindUnion:
+		return fmt.Sprintf("[%d]byte", t.Size), nil
+	case KindStruct:
+		if t.Name != "" {
+			return g.enqueue(t, GoName(t.Name)), nil
+		}
+		if orig.Kind == KindTypedef && orig.Name != "" {
+			// typedef struct { ... } name_t;
+			return g.enqueue(t, GoName(orig.Name)), nil
+		}
+		return g.structBody(t)
+	}
+
+	return "", fmt.Errorf("%v type '%s' cannot be represented in Go", t.Kind, t.Name)
+}
+
+// Returns alignment Go gives to type expression typeExpr() returns for t
+// (on 64 bit platforms). Members not aligned that way can't be represented in Go.
+func goAlign(t *Type) int {
+	t = underlying(t)
+	if t == nil {
+		return 1
+	}
+	switch t.Kind {
+	case KindInt, KindEnum, KindEnum64:
+		switch t.Size {
+		case 1, 2, 4, 8:
+			return t.Size
+		}
+	case KindFloat:
+		if t.Size == 4 || t.Size == 8 {
+			return t.Size
+		}
+	case KindPtr:
+		return 8
+	case KindArray:
+		return goAlign(t.Target)
+	case KindStruct:
+		align := 1
+		for _, m := range t.Members {
+			if m.BitSize != 0 || m.BitOffset%8 != 0 {
+				continue
+			}
+			if a := goAlign(m.Type); a > align {
+				align = a
+			}
+		}
+		return align
+	}
+	// Unions and odd sized types are byte arrays
+	return 1
+}
+
+// Returns "struct { ... }" with explicit padding, so Go layout is
+// the same as BTF one: every member at BTF offset, the same size.
+// Layouts Go can't reproduce (e.g. packed structs) are errors.
+func (g *goGenerator) structBody(t *Type) (string, error) {
+	members := make([]Member, len(t.Members))
+	copy(members, t.Members)
+	sort.SliceStable(members, func(i, j int) bool {
+		return members[i].BitOffset < members[j].BitOffset
+	})
+
+	var b bytes.Buffer
+	b.WriteString("struct {\n")
+	offset := 0
+	for idx := 0; idx < len(members); idx++ {
+		m := members[idx]
+		if m.BitSize != 0 || m.BitOffset%8 != 0 {
+			// Run of bitfields is replaced by bytes they occupy
+			start := m.BitOffset / 8
+			end := offset
+			var names []string
+			for ; idx < len(members) && (members[idx].BitSize != 0 || members[idx].BitOffset%8 != 0); idx++ {
+				bf := members[idx]
+				if last := (bf.BitOffset + bf.BitSize + 7) / 8; last > end {
+					end = last
+				}
+				names = append(names, bf.Name)
+			}
+			idx--
+			if end > t.Size {
+				return "", fmt.Errorf("Bitfields %v exceed size of '%s'", names, t.Name)
+			}
+			if start < offset {
+				start = offset
+			}
+			if start > offset {
+				fmt.Fprintf(&b, "_ [%d]byte\n", start-offset)
+			}
+			if end > start {
+				fmt.Fprintf(&b, "_ [%d]byte // bitfields: %v\n", end-start, names)
+				offset = end
+			}
+			continue
+		}
+
+		memberOffset := m.BitOffset / 8
+		if memberOffset < offset {
+			return "", fmt.Errorf("Overlapping member '%s' of '%s'", m.Name, t.Name)
+		}
+		size, err := SizeOf(m.Type)
+		if err != nil {
+			return "", fmt.Errorf("Member '%s': %v", m.Name, err)
+		}
+		if memberOffset+size > t.Size {
+			return "", fmt.Errorf("Member '%s' exceeds size of '%s'", m.Name, t.Name)
+		}
+		if size == 0 {
+			// Go pads trailing zero sized field, e.g. flexible array member
+			fmt.Fprintf(&b, "// %s: zero sized member at offset %d\n", m.Name, memberOffset)
+			continue
+		}
+		if align := goAlign(m.Type); memberOffset%align != 0 {
+			return "", fmt.Errorf("Member '%s' of '%s' at offset %d is not %d bytes aligned as Go requires",
+				m.Name, t.Name, memberOffset, align)
+		}
+		if memberOffset > offset {
+			fmt.Fprintf(&b, "_ [%d]byte\n", memberOffset-offset)
+		}
+		expr, err := g.typeExpr(m.Type)
+		if err != nil {
+			return "", fmt.Errorf("Member '%s': %v", m.Name, err)
+		}
+		name := GoName(m.Name)
+		if m.Name == "" {
+			name = fmt.Sprintf("Anon%d", idx)
+		}
+		fmt.Fprintf(&b, "%s %s\n", name, expr)
+		offset = memberOffset + size
+	}
+	if t.Size > offset {
+		fmt.Fprintf(&b, "_ [%d]byte\n", t.Size-offset)
+	}
+	// Go rounds size of struct up to its alignment
+	if align := goAlign(t); t.Size%align != 0 {
+		return "", fmt.Errorf("Size %d of '%s' is not multiple of its Go alignment %d", t.Size, t.Name, align)
+	}
+	b.WriteString("}")
+
+	return b.String(), nil
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_cbpf converts classic BPF (cBPF) filters, e.g. ones
+// produced by tcpdump / libpcap, into eBPF programs, so tools built on goebpf
+// can accept familiar filter syntax:
+//
+//	filter, err := goebpf_cbpf.CompileFilter("tcp and port 80")
+//	...
+//	prog, err := goebpf_cbpf.NewProgram("http", goebpf_cbpf.TargetXdp, filter)
+//	...
+//	err = prog.Load()
+//
+// Both socket filters (where original cBPF semantics are kept) and XDP
+// programs (non zero filter result means XDP_PASS, zero - XDP_DROP) can be produced.
+package goebpf_cbpf
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Instruction is classic BPF instruction, must be in sync with linux/filter.h:
+//
+//	struct sock_filter {
+//		__u16	code;	/* Actual filter code */
+//		__u8	jt;	/* Jump true */
+//		__u8	jf;	/* Jump false */
+//		__u32	k;	/* Generic multiuse field */
+//	};
+type Instruction struct {
+	Op uint16
+	Jt uint8
+	Jf uint8
+	K  uint32
+}
+
+// Filter is classic BPF program
+type Filter []Instruction
+
+// Maximum length of classic BPF program (BPF_MAXINSNS)
+const maxInstructions = 4096
+
+// TcpdumpPath is tcpdump binary used by CompileFilter()
+var TcpdumpPath = "tcpdump"
+
+// CompileFilter compiles pcap filter expression (e.g. "udp dst port 53") for
+// ethernet link type by running "tcpdump -ddd".
+func CompileFilter(expr string) (Filter, error) {
+	tcpdump, err := exec.LookPath(TcpdumpPath)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to find tcpdump: %v", err)
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(tcpdump, "-ddd", "-y", "EN10MB", expr)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("tcpdump failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return ParseFilter(&stdout)
+}
+
+// ParseFilter reads cBPF program in one of tcpdump's formats:
+//   - "tcpdump -ddd": number of instructions, then "code jt jf k" per line
+//   - "tcpdump -dd": C array, "{ 0x28, 0, 0, 0x0000000c }," per line
+func ParseFilter(r io.Reader) (Filter, error) {
+	var filter Filter
+	count := -1
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.FieldsFunc(scanner.Text(), func(c rune) bool {
+			return c == ' ' || c == '\t' || c == ',' || c == '{' || c == '}'
+		})
+		if len(fields) == 0 {
+			continue
+		}
+		// -ddd output starts with instructions count
+		if len(fields) == 1 && count == -1 && len(filter) == 0 {
+			n, err := strconv.ParseUint(fields[0], 0, 16)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: invalid instruction count: %v", line, err)
+			}
+			count = int(n)
+			continue
+		}
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("Line %d: expected 4 fields, got %d", line, len(fields))
+		}
+		var values [4]uint64
+		for idx, bits := range []int{16, 8, 8, 32} {
+			value, err := strconv.ParseUint(fields[idx], 0, bits)
+			if err != nil {
+				return nil, fmt.Errorf("Line %d: %v", line, err)
+			}
+			values[idx] = value
+		}
+		filter = append(filter, Instruction{
+			Op: uint16(values[0]),
+			Jt: uint8(values[1]),
+			Jf: uint8(values[2]),
+			K:  uint32(values[3]),
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if count != -1 && count != len(filter) {
+		return nil, fmt.Errorf("Expected %d instructions, got %d", count, len(filter))
+	}
+	if len(filter) == 0 {
+		return nil, fmt.Errorf("Empty filter")
+	}
+
+	return filter, nil
+}
@@ -0,0 +1,58 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_cbpf
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// "tcpdump -ddd ip"
+const tcpdumpIp = `4
+40 0 0 12
+21 0 1 2048
+6 0 0 262144
+6 0 0 0
+`
+
+// "tcpdump -dd ip"
+const tcpdumpIpC = `{ 0x28, 0, 0, 0x0000000c },
+{ 0x15, 0, 1, 0x00000800 },
+{ 0x6, 0, 0, 0x00040000 },
+{ 0x6, 0, 0, 0x00000000 },
+`
+
+var filterIp = Filter{
+	{Op: 0x28, K: 12},
+	{Op: 0x15, Jf: 1, K: 0x800},
+	{Op: 0x06, K: 0x40000},
+	{Op: 0x06, K: 0},
+}
+
+func TestParseFilter(t *testing.T) {
+	filter, err := ParseFilter(strings.NewReader(tcpdumpIp))
+	require.NoError(t, err)
+	assert.Equal(t, filterIp, filter)
+
+	filter, err = ParseFilter(strings.NewReader(tcpdumpIpC))
+	require.NoError(t, err)
+	assert.Equal(t, filterIp, filter)
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	cases := []string{
+		"",
+		"2\n6 0 0 0\n",
+		"1\n6 0 0\n",
+		"1\n6 0 0 zzz\n",
+		"1\n6 0 256 0\n",
+	}
+	for _, text := range cases {
+		_, err := ParseFilter(strings.NewReader(text))
+		assert.Error(t, err, text)
+	}
+}
@@ -0,0 +1,476 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_cbpf
+
+import (
+	"fmt"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Target is type of eBPF program produced from cBPF filter
+type Target int
+
+const (
+	// Socket filter, filter result is amount of bytes to keep, 0 - drop packet
+	TargetSocketFilter Target = iota
+	// XDP program, non zero filter result means XDP_PASS, zero - XDP_DROP
+	TargetXdp
+)
+
+func (t Target) String() string {
+	switch t {
+	case TargetSocketFilter:
+		return "SocketFilter"
+	case TargetXdp:
+		return "XDP"
+	}
+	return fmt.Sprintf("Target(%d)", int(t))
+}
+
+func (t Target) programType() goebpf.ProgramType {
+	if t == TargetXdp {
+		return goebpf.ProgramTypeXdp
+	}
+	return goebpf.ProgramTypeSocketFilter
+}
+
+// cBPF opcode fields, must be in sync with linux/filter.h
+const (
+	classLd   = 0x00
+	classLdx  = 0x01
+	classSt   = 0x02
+	classStx  = 0x03
+	classAlu  = 0x04
+	classJmp  = 0x05
+	classRet  = 0x06
+	classMisc = 0x07
+
+	sizeW = 0x00
+	sizeH = 0x08
+	sizeB = 0x10
+
+	modeImm = 0x00
+	modeAbs = 0x20
+	modeInd = 0x40
+	modeMem = 0x60
+	modeLen = 0x80
+	modeMsh = 0xa0
+
+	srcX = 0x08
+
+	retK = 0x00
+	retX = 0x08
+	retA = 0x10
+
+	miscTax = 0x00
+	miscTxa = 0x80
+
+	// Amount of scratch memory cells M[]
+	memWords = 16
+	// Largest packet offset allowed for XDP (verifier's MAX_PACKET_OFF)
+	maxPacketOffset = 0xffff
+)
+
+// Registers used by converted program, same as kernel's cBPF converter does:
+// A - accumulator, X - index register, tmp - scratch.
+// Socket filter: R6 is context (required by LD_ABS / LD_IND).
+// XDP: R6 / R9 are packet start / end, R1 is used for bounds checks.
+const (
+	regA       = goebpf.R0
+	regX       = goebpf.R7
+	regTmp     = goebpf.R8
+	regCtx     = goebpf.R6
+	regData    = goebpf.R6
+	regDataEnd = goebpf.R9
+	regBound   = goebpf.R1
+)
+
+// Label of exit path with "drop packet" result
+const labelDrop = "drop"
+
+func label(idx int) string {
+	return fmt.Sprintf("cbpf%d", idx)
+}
+
+var sizes = map[uint16]struct {
+	size  goebpf.MemSize
+	bytes int32
+}{
+	sizeW: {goebpf.SizeWord, 4},
+	sizeH: {goebpf.SizeHalf, 2},
+	sizeB: {goebpf.SizeByte, 1},
+}
+
+var jumpOps = map[uint16]goebpf.JumpOp{
+	0x00: goebpf.JumpOpAlways,
+	0x10: goebpf.JumpOpEq,
+	0x20: goebpf.JumpOpGt,
+	0x30: goebpf.JumpOpGe,
+	0x40: goebpf.JumpOpSet,
+}
+
+var aluOps = map[uint16]goebpf.AluOp{
+	0x00: goebpf.AluOpAdd,
+	0x10: goebpf.AluOpSub,
+	0x20: goebpf.AluOpMul,
+	0x30: goebpf.AluOpDiv,
+	0x40: goebpf.AluOpOr,
+	0x50: goebpf.AluOpAnd,
+	0x60: goebpf.AluOpLsh,
+	0x70: goebpf.AluOpRsh,
+	0x80: goebpf.AluOpNeg,
+	0x90: goebpf.AluOpMod,
+	0xa0: goebpf.AluOpXor,
+}
+
+// Conversion state
+type converter struct {
+	target   Target
+	filter   Filter
+	insns    goebpf.Instructions
+	needDrop bool
+}
+
+// Convert translates classic BPF filter into eBPF instructions for given target.
+// Linux specific cBPF extensions (ancillary data loads) are not supported.
+func Convert(filter Filter, target Target) (goebpf.Instructions, error) {
+	if target != TargetSocketFilter && target != TargetXdp {
+		return nil, fmt.Errorf("Unsupported target %v", target)
+	}
+	if len(filter) == 0 || len(filter) > maxInstructions {
+		return nil, fmt.Errorf("Invalid filter length %d", len(filter))
+	}
+	c := &converter{
+		target: target,
+		filter: filter,
+	}
+	c.prologue()
+	for idx := range filter {
+		start := len(c.insns)
+		if err := c.convert(idx); err != nil {
+			return nil, fmt.Errorf("Instruction %d (%+v): %v", idx, filter[idx], err)
+		}
+		c.insns[start] = c.insns[start].WithLabel(label(idx))
+	}
+	if c.needDrop {
+		c.emit(
+			goebpf.Mov64Imm(goebpf.R0, c.dropResult()).WithLabel(labelDrop),
+			goebpf.Exit(),
+		)
+	}
+
+	return c.insns, nil
+}
+
+// NewProgram converts filter and creates eBPF program of given target, ready to Load()
+func NewProgram(name string, target Target, filter Filter) (goebpf.Program, error) {
+	insns, err := Convert(filter, target)
+	if err != nil {
+		return nil, err
+	}
+
+	return goebpf.NewProgram(name, target.programType(), "GPL", insns)
+}
+
+func (c *converter) emit(insns ...goebpf.Instruction) {
+	c.insns = append(c.insns, insns...)
+}
+
+func (c *converter) dropResult() int32 {
+	if c.target == TargetXdp {
+		return int32(goebpf.XdpDrop)
+	}
+	return 0
+}
+
+// Stack offset of scratch memory cell M[k]
+func memOffset(k uint32) int16 {
+	return int16(-4 * (memWords - int(k)))
+}
+
+func (c *converter) prologue() {
+	if c.target == TargetXdp {
+		// struct xdp_md: u32 data, u32 data_end
+		c.emit(
+			goebpf.LoadMem(goebpf.SizeWord, regData, goebpf.R1, 0),
+			goebpf.LoadMem(goebpf.SizeWord, regDataEnd, goebpf.R1, 4),
+		)
+	} else {
+		c.emit(goebpf.Mov64Reg(regCtx, goebpf.R1))
+	}
+	// cBPF registers are zero on start, verifier does not allow
+	// to read uninitialized stack, so zero scratch memory as well
+	c.emit(
+		goebpf.Mov64Imm(regA, 0),
+		goebpf.Mov64Imm(regX, 0),
+	)
+	for k := uint32(0); k < memWords; k++ {
+		c.emit(goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, memOffset(k), 0))
+	}
+}
+
+func (c *converter) jumpTarget(idx int, offset uint32) (string, error) {
+	target := idx + 1 + int(offset)
+	if target >= len(c.filter) {
+		return "", fmt.Errorf("jump out of program")
+	}
+	return label(target), nil
+}
+
+func (c *converter) convert(idx int) error {
+	insn := c.filter[idx]
+	op := insn.Op
+
+	switch op & 0x07 {
+	case classLd, classLdx:
+		return c.convertLoad(insn)
+
+	case classSt, classStx:
+		if insn.K >= memWords {
+			return fmt.Errorf("invalid memory cell %d", insn.K)
+		}
+		src := regA
+		if op&0x07 == classStx {
+			src = regX
+		}
+		c.emit(goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, memOffset(insn.K), src))
+
+	case classAlu:
+		return c.convertAlu(insn)
+
+	case classJmp:
+		return c.convertJump(idx, insn)
+
+	case classRet:
+		return c.convertRet(insn)
+
+	case classMisc:
+		switch op & 0xf8 {
+		case miscTax:
+			c.emit(goebpf.Mov64Reg(regX, regA))
+		case miscTxa:
+			c.emit(goebpf.Mov64Reg(regA, regX))
+		default:
+			return fmt.Errorf("unknown misc instruction")
+		}
+	}
+
+	return nil
+}
+
+func (c *converter) convertLoad(insn Instruction) error {
+	op := insn.Op
+	dst := regA
+	if op&0x07 == classLdx {
+		dst = regX
+	}
+
+	switch op & 0xe0 {
+	case modeImm:
+		c.emit(goebpf.Alu32Imm(goebpf.AluOpMov, dst, int32(insn.K)))
+		return nil
+
+	case modeMem:
+		if insn.K >= memWords {
+			return fmt.Errorf("invalid memory cell %d", insn.K)
+		}
+		c.emit(goebpf.LoadMem(goebpf.SizeWord, dst, goebpf.R10, memOffset(insn.K)))
+		return nil
+
+	case modeLen:
+		if c.target == TargetXdp {
+			c.emit(
+				goebpf.Mov64Reg(dst, regDataEnd),
+				goebpf.Alu64Reg(goebpf.AluOpSub, dst, regData),
+			)
+		} else {
+			// __sk_buff->len
+			c.emit(goebpf.LoadMem(goebpf.SizeWord, dst, regCtx, 0))
+		}
+		return nil
+
+	case modeMsh:
+		// X = 4 * (P[k] & 0xf), LDX only
+		if dst != regX || op&0x18 != sizeB {
+			break
+		}
+		if err := c.loadPacket(insn.K, sizeB, false, true); err != nil {
+			return err
+		}
+		c.emit(
+			goebpf.Alu32Imm(goebpf.AluOpAnd, regX, 0xf),
+			goebpf.Alu32Imm(goebpf.AluOpLsh, regX, 2),
+		)
+		return nil
+
+	case modeAbs, modeInd:
+		if dst != regA {
+			break
+		}
+		return c.loadPacket(insn.K, op&0x18, op&0xe0 == modeInd, false)
+	}
+
+	return fmt.Errorf("unsupported load instruction")
+}
+
+// Emits load of packet data at offset k (+X if indirect) into A,
+// or into X in case of MSH.
+func (c *converter) loadPacket(k uint32, size uint16, indirect, msh bool) error {
+	sz, ok := sizes[size]
+	if !ok {
+		return fmt.Errorf("invalid load size")
+	}
+	if k > maxPacketOffset {
+		return fmt.Errorf("offset %#x is not supported (ancillary data?)", k)
+	}
+
+	if c.target == TargetSocketFilter {
+		if msh {
+			// LD_ABS clobbers R0 which is A
+			c.emit(goebpf.Mov64Reg(regTmp, regA))
+		}
+		if indirect {
+			c.emit(goebpf.LoadInd(sz.size, regX, int32(k)))
+		} else {
+			c.emit(goebpf.LoadAbs(sz.size, int32(k)))
+		}
+		if msh {
+			c.emit(
+				goebpf.Mov64Reg(regX, goebpf.R0),
+				goebpf.Mov64Reg(regA, regTmp),
+			)
+		}
+		return nil
+	}
+
+	// XDP: direct packet access with bounds checks
+	c.needDrop = true
+	c.emit(goebpf.Mov64Reg(regTmp, regData))
+	if indirect {
+		c.emit(
+			goebpf.JumpImm(goebpf.JumpOpGt, regX, maxPacketOffset, labelDrop),
+			goebpf.Alu64Reg(goebpf.AluOpAdd, regTmp, regX),
+		)
+	}
+	dst := regA
+	if msh {
+		dst = regX
+	}
+	c.emit(
+		goebpf.Alu64Imm(goebpf.AluOpAdd, regTmp, int32(k)),
+		goebpf.Mov64Reg(regBound, regTmp),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, regBound, sz.bytes),
+		goebpf.JumpReg(goebpf.JumpOpGt, regBound, regDataEnd, labelDrop),
+		goebpf.LoadMem(sz.size, dst, regTmp, 0),
+	)
+	if sz.bytes > 1 {
+		c.emit(goebpf.ToBigEndian(dst, sz.bytes*8))
+	}
+	return nil
+}
+
+func (c *converter) convertAlu(insn Instruction) error {
+	code := insn.Op & 0xf0
+	op, ok := aluOps[code]
+	if !ok {
+		return fmt.Errorf("unknown ALU operation")
+	}
+	if op == goebpf.AluOpNeg {
+		c.emit(goebpf.Alu32Imm(goebpf.AluOpNeg, regA, 0))
+		return nil
+	}
+
+	if insn.Op&srcX == srcX {
+		if op == goebpf.AluOpDiv || op == goebpf.AluOpMod {
+			// cBPF terminates program with 0 result on division by zero
+			c.needDrop = true
+			c.emit(goebpf.JumpImm(goebpf.JumpOpEq, regX, 0, labelDrop))
+		}
+		c.emit(goebpf.Alu32Reg(op, regA, regX))
+		return nil
+	}
+
+	if (op == goebpf.AluOpDiv || op == goebpf.AluOpMod) && insn.K == 0 {
+		return fmt.Errorf("division by zero")
+	}
+	if (op == goebpf.AluOpLsh || op == goebpf.AluOpRsh) && insn.K >= 32 {
+		return fmt.Errorf("invalid shift %d", insn.K)
+	}
+	c.emit(goebpf.Alu32Imm(op, regA, int32(insn.K)))
+	return nil
+}
+
+func (c *converter) convertJump(idx int, insn Instruction) error {
+	op, ok := jumpOps[insn.Op&0xf0]
+	if !ok {
+		return fmt.Errorf("unknown jump operation")
+	}
+	if op == goebpf.JumpOpAlways {
+		target, err := c.jumpTarget(idx, insn.K)
+		if err != nil {
+			return err
+		}
+		c.emit(goebpf.Jump(target))
+		return nil
+	}
+
+	targetTrue, err := c.jumpTarget(idx, uint32(insn.Jt))
+	if err != nil {
+		return err
+	}
+	targetFalse, err := c.jumpTarget(idx, uint32(insn.Jf))
+	if err != nil {
+		return err
+	}
+	src := regX
+	if insn.Op&srcX == 0 {
+		// cBPF comparisons are unsigned 32 bit, while eBPF sign extends
+		// immediate to 64 bits, so move constant into register first
+		src = regTmp
+		c.emit(goebpf.Alu32Imm(goebpf.AluOpMov, regTmp, int32(insn.K)))
+	}
+	c.emit(goebpf.JumpReg(op, regA, src, targetTrue))
+	if insn.Jf != 0 {
+		c.emit(goebpf.Jump(targetFalse))
+	}
+	return nil
+}
+
+func (c *converter) convertRet(insn Instruction) error {
+	var reg goebpf.Register
+	switch insn.Op & 0x18 {
+	case retK:
+		result := int32(insn.K)
+		if c.target == TargetXdp {
+			result = int32(goebpf.XdpPass)
+			if insn.K == 0 {
+				result = int32(goebpf.XdpDrop)
+			}
+		}
+		c.emit(
+			goebpf.Alu32Imm(goebpf.AluOpMov, goebpf.R0, result),
+			goebpf.Exit(),
+		)
+		return nil
+	case retA:
+		reg = regA
+	case retX:
+		reg = regX
+	default:
+		return fmt.Errorf("invalid return instruction")
+	}
+
+	if c.target == TargetXdp {
+		c.needDrop = true
+		c.emit(
+			goebpf.JumpImm(goebpf.JumpOpEq, reg, 0, labelDrop),
+			goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpPass)),
+		)
+	} else if reg != goebpf.R0 {
+		c.emit(goebpf.Mov64Reg(goebpf.R0, reg))
+	}
+	c.emit(goebpf.Exit())
+	return nil
+}
@@ -0,0 +1,310 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_cbpf
+
+import (
+	"encoding/binary"
+	"math/bits"
+	"strings"
+	"testing"
+
+	"github.com/dropbox/goebpf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Memory layout of tiny eBPF interpreter used to check converted programs
+const (
+	emuCtx    = 0x100
+	emuPacket = 0x1000
+	emuStack  = 0x20000
+)
+
+// Runs eBPF program (only instructions produced by converter) against packet
+func emulate(t *testing.T, insns goebpf.Instructions, target Target, packet []byte) uint64 {
+	bytecode, err := insns.Assemble()
+	require.NoError(t, err)
+
+	mem := make([]byte, emuStack)
+	copy(mem[emuPacket:], packet)
+	if target == TargetXdp {
+		binary.LittleEndian.PutUint32(mem[emuCtx:], emuPacket)
+		binary.LittleEndian.PutUint32(mem[emuCtx+4:], emuPacket+uint32(len(packet)))
+	} else {
+		binary.LittleEndian.PutUint32(mem[emuCtx:], uint32(len(packet)))
+	}
+	load := func(addr uint64, size uint8) uint64 {
+		switch size {
+		case 0x10:
+			return uint64(mem[addr])
+		case 0x08:
+			return uint64(binary.LittleEndian.Uint16(mem[addr:]))
+		case 0x00:
+			return uint64(binary.LittleEndian.Uint32(mem[addr:]))
+		}
+		return binary.LittleEndian.Uint64(mem[addr:])
+	}
+	store := func(addr uint64, size uint8, value uint64) {
+		switch size {
+		case 0x10:
+			mem[addr] = byte(value)
+		case 0x08:
+			binary.LittleEndian.PutUint16(mem[addr:], uint16(value))
+		case 0x00:
+			binary.LittleEndian.PutUint32(mem[addr:], uint32(value))
+		default:
+			binary.LittleEndian.PutUint64(mem[addr:], value)
+		}
+	}
+
+	var regs [11]uint64
+	regs[1] = emuCtx
+	regs[10] = emuStack
+	for pc, steps := 0, 0; steps < 10000; steps++ {
+		require.True(t, pc*8 < len(bytecode), "pc out of program")
+		raw := bytecode[pc*8:]
+		code := raw[0]
+		dst, src := raw[1]&0x0f, raw[1]>>4
+		off := int64(int16(binary.LittleEndian.Uint16(raw[2:])))
+		imm := uint64(int64(int32(binary.LittleEndian.Uint32(raw[4:]))))
+		pc++
+		operand := imm
+		if code&0x08 != 0 {
+			operand = regs[src]
+		}
+
+		switch code & 0x07 {
+		case 0x04, 0x07: // ALU, ALU64
+			a := regs[dst]
+			if code&0x07 == 0x04 {
+				a, operand = uint64(uint32(a)), uint64(uint32(operand))
+			}
+			switch code & 0xf0 {
+			case 0x00:
+				a += operand
+			case 0x10:
+				a -= operand
+			case 0x20:
+				a *= operand
+			case 0x30:
+				a /= operand
+			case 0x40:
+				a |= operand
+			case 0x50:
+				a &= operand
+			case 0x60:
+				a <<= operand
+			case 0x70:
+				a >>= operand
+			case 0x80:
+				a = -a
+			case 0x90:
+				a %= operand
+			case 0xa0:
+				a ^= operand
+			case 0xb0:
+				a = operand
+			case 0xd0:
+				switch imm {
+				case 16:
+					a = uint64(bits.ReverseBytes16(uint16(a)))
+				case 32:
+					a = uint64(bits.ReverseBytes32(uint32(a)))
+				}
+			default:
+				t.Fatalf("unexpected ALU opcode %#x", code)
+			}
+			if code&0x07 == 0x04 {
+				a = uint64(uint32(a))
+			}
+			regs[dst] = a
+		case 0x01: // LDX
+			regs[dst] = load(uint64(int64(regs[src])+off), code&0x18)
+		case 0x02: // ST
+			store(uint64(int64(regs[dst])+off), code&0x18, imm)
+		case 0x03: // STX
+			store(uint64(int64(regs[dst])+off), code&0x18, regs[src])
+		case 0x00: // LD_ABS / LD_IND
+			offset := imm
+			if code&0xe0 == 0x40 {
+				offset += regs[src]
+			}
+			size := map[uint8]uint64{0x00: 4, 0x08: 2, 0x10: 1}[code&0x18]
+			if offset+size > uint64(len(packet)) {
+				return 0
+			}
+			value := load(emuPacket+offset, code&0x18)
+			switch size {
+			case 2:
+				value = uint64(bits.ReverseBytes16(uint16(value)))
+			case 4:
+				value = uint64(bits.ReverseBytes32(uint32(value)))
+			}
+			regs[0] = value
+		case 0x05: // JMP
+			a := regs[dst]
+			var jump bool
+			switch code & 0xf0 {
+			case 0x00:
+				jump = true
+			case 0x10:
+				jump = a == operand
+			case 0x20:
+				jump = a > operand
+			case 0x30:
+				jump = a >= operand
+			case 0x40:
+				jump = a&operand != 0
+			case 0x90:
+				return regs[0]
+			default:
+				t.Fatalf("unexpected JMP opcode %#x", code)
+			}
+			if jump {
+				pc += int(off)
+			}
+		default:
+			t.Fatalf("unexpected opcode %#x", code)
+		}
+	}
+	t.Fatal("too many instructions executed")
+	return 0
+}
+
+// Runs filter converted for both targets and checks results
+func checkFilter(t *testing.T, filter Filter, packet []byte, expected uint64) {
+	insns, err := Convert(filter, TargetSocketFilter)
+	require.NoError(t, err)
+	assert.Equal(t, expected, emulate(t, insns, TargetSocketFilter, packet))
+
+	xdpExpected := uint64(goebpf.XdpPass)
+	if expected == 0 {
+		xdpExpected = uint64(goebpf.XdpDrop)
+	}
+	insns, err = Convert(filter, TargetXdp)
+	require.NoError(t, err)
+	assert.Equal(t, xdpExpected, emulate(t, insns, TargetXdp, packet))
+}
+
+// Ethernet + IPv4 (with given header length) + TCP header with destination port
+func tcpPacket(ihl int, port uint16) []byte {
+	packet := make([]byte, 14+ihl*4+20)
+	binary.BigEndian.PutUint16(packet[12:], 0x800)
+	packet[14] = 0x40 | byte(ihl)
+	packet[23] = 6
+	binary.BigEndian.PutUint16(packet[14+ihl*4+2:], port)
+	return packet
+}
+
+func TestConvertIp(t *testing.T) {
+	ipv6 := make([]byte, 64)
+	binary.BigEndian.PutUint16(ipv6[12:], 0x86dd)
+
+	checkFilter(t, filterIp, tcpPacket(5, 80), 0x40000)
+	checkFilter(t, filterIp, ipv6, 0)
+	// Packet is too short
+	checkFilter(t, filterIp, make([]byte, 10), 0)
+}
+
+func TestConvertTcpPort(t *testing.T) {
+	// "tcpdump -ddd tcp dst port 80", uses LDX MSH and indirect loads
+	filter, err := ParseFilter(strings.NewReader(`16
+40 0 0 12
+21 0 4 34525
+48 0 0 20
+21 0 11 6
+40 0 0 56
+21 8 9 80
+21 0 8 2048
+48 0 0 23
+21 0 6 6
+40 0 0 20
+69 4 0 8191
+177 0 0 14
+72 0 0 16
+21 0 1 80
+6 0 0 262144
+6 0 0 0
+`))
+	require.NoError(t, err)
+
+	checkFilter(t, filter, tcpPacket(5, 80), 262144)
+	checkFilter(t, filter, tcpPacket(6, 80), 262144)
+	checkFilter(t, filter, tcpPacket(5, 443), 0)
+	checkFilter(t, filter, tcpPacket(6, 443), 0)
+	// TCP header is truncated
+	checkFilter(t, filter, tcpPacket(5, 80)[:36], 0)
+}
+
+func TestConvertAluAndMemory(t *testing.T) {
+	filter := Filter{
+		{Op: 0x00, K: 5},  // ld #5
+		{Op: 0x02, K: 1},  // st M[1]
+		{Op: 0x01, K: 3},  // ldx #3
+		{Op: 0x60, K: 1},  // ld M[1]
+		{Op: 0x2c},        // mul x
+		{Op: 0x04, K: 1},  // add #1
+		{Op: 0x07},        // tax
+		{Op: 0x00, K: 32}, // ld #32
+		{Op: 0x3c},        // div x
+		{Op: 0x87},        // txa
+		{Op: 0x16},        // ret a
+	}
+	checkFilter(t, filter, nil, 16)
+
+	// Packet length
+	checkFilter(t, Filter{{Op: 0x80}, {Op: 0x16}}, make([]byte, 77), 77)
+
+	// Division by zero terminates filter
+	filter = Filter{
+		{Op: 0x01, K: 0}, // ldx #0
+		{Op: 0x00, K: 4}, // ld #4
+		{Op: 0x3c},       // div x
+		{Op: 0x16},       // ret a
+	}
+	checkFilter(t, filter, nil, 0)
+
+	// Comparisons are unsigned
+	filter = Filter{
+		{Op: 0x00, K: 0x80000000}, // ld #0x80000000
+		{Op: 0x25, Jf: 1, K: 1},   // jgt #1
+		{Op: 0x06, K: 1},          // ret #1
+		{Op: 0x06, K: 0},          // ret #0
+	}
+	checkFilter(t, filter, nil, 1)
+}
+
+func TestConvertErrors(t *testing.T) {
+	cases := []Filter{
+		nil,
+		// Ancillary data: ld [skb->protocol]
+		{{Op: 0x28, K: 0xfffff000}, {Op: 0x16}},
+		// Jump out of program
+		{{Op: 0x05, K: 1}, {Op: 0x06}},
+		{{Op: 0x15, Jt: 5}, {Op: 0x06}},
+		// Division by constant zero
+		{{Op: 0x34, K: 0}, {Op: 0x16}},
+		// Invalid memory cell
+		{{Op: 0x02, K: 16}, {Op: 0x06}},
+		// Invalid shift
+		{{Op: 0x64, K: 32}, {Op: 0x16}},
+	}
+	for _, filter := range cases {
+		_, err := Convert(filter, TargetXdp)
+		assert.Error(t, err, "%+v", filter)
+	}
+
+	_, err := Convert(filterIp, Target(100))
+	assert.Error(t, err)
+}
+
+func TestNewProgram(t *testing.T) {
+	prog, err := NewProgram("ip", TargetXdp, filterIp)
+	require.NoError(t, err)
+	assert.Equal(t, goebpf.ProgramTypeXdp, prog.GetType())
+
+	prog, err = NewProgram("ip", TargetSocketFilter, filterIp)
+	require.NoError(t, err)
+	assert.Equal(t, goebpf.ProgramTypeSocketFilter, prog.GetType())
+}
@@ -0,0 +1,367 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_cgnet
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/internal/maputil"
+)
+
+// Accounting collects network stats of cgroups of hierarchy
+type Accounting struct {
+	m        *goebpf.EbpfMap
+	root     string
+	programs []goebpf.Program
+	// inotify instance watching all cgroup directories
+	notify   *os.File
+	notifyFd int
+	done     chan struct{}
+
+	mu sync.RWMutex
+	// Cgroup path by ID and vice versa
+	paths map[uint64]string
+	ids   map[string]uint64
+	// Directory by inotify watch descriptor
+	dirs     map[int]string
+	onRemove func(path string, final Stats)
+}
+
+// Events of cgroup directories accounting is interested in
+const notifyMask = unix.IN_CREATE | unix.IN_DELETE | unix.IN_ONLYDIR
+
+// Programs by direction, in order of Accounting.programs
+var directions = []goebpf.CgroupSkbDirection{goebpf.CgroupSkbIngress, goebpf.CgroupSkbEgress}
+
+// New creates per-CPU map able to hold stats of maxCgroups cgroups, loads
+// programs filling it and starts tracking cgroups of hierarchy at root
+// (cgroup v2 mount point or any cgroup below it).
+// Programs are not attached yet, see Attach().
+func New(root string, maxCgroups int) (*Accounting, error) {
+	root, err := filepath.Abs(root)
+	if err != nil {
+		return nil, err
+	}
+	a := &Accounting{
+		m: &goebpf.EbpfMap{
+			Name:       MapName,
+			Type:       goebpf.MapTypePerCPUHash,
+			KeySize:    keySize,
+			ValueSize:  valueSize,
+			MaxEntries: maxCgroups,
+		},
+		root:  root,
+		done:  make(chan struct{}),
+		paths: make(map[uint64]string),
+		ids:   make(map[string]uint64),
+		dirs:  make(map[int]string),
+	}
+	if err = maputil.Create(a.m); err != nil {
+		return nil, err
+	}
+	for _, direction := range directions {
+		name := IngressProgramName
+		if direction == goebpf.CgroupSkbEgress {
+			name = EgressProgramName
+		}
+		prog, err := goebpf.NewProgram(name, goebpf.ProgramTypeCgroupSkb, "GPL", instructions(a.m, direction))
+		if err == nil {
+			err = prog.Load()
+		}
+		if err != nil {
+			a.closePrograms()
+			return nil, err
+		}
+		a.programs = append(a.programs, prog)
+	}
+
+	fd, err := unix.InotifyInit1(unix.IN_CLOEXEC | unix.IN_NONBLOCK)
+	if err != nil {
+		a.closePrograms()
+		return nil, fmt.Errorf("inotify_init1() failed: %v", err)
+	}
+	// Non blocking fd goes to runtime poller, so Close() interrupts Read().
+	// Fd() of file would switch it to blocking mode, so fd is kept aside.
+	a.notify = os.NewFile(uintptr(fd), "inotify")
+	a.notifyFd = fd
+	if err = a.addTree(root); err != nil {
+		a.notify.Close()
+		a.closePrograms()
+		return nil, err
+	}
+	go a.watch()
+
+	return a, nil
+}
+
+// Programs returns loaded ingress / egress programs
+func (a *Accounting) Programs() []goebpf.Program {
+	return a.programs
+}
+
+// Attach attaches programs to root cgroup, all or nothing
+func (a *Accounting) Attach() error {
+	for i, prog := range a.programs {
+		err := prog.Attach(goebpf.CgroupSkbAttachParams{
+			CgroupPath: a.root,
+			Direction:  directions[i],
+		})
+		if err != nil {
+			for _, attached := range a.programs[:i] {
+				attached.Detach()
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// OnRemove sets function called (from internal goroutine) with the last
+// stats of every removed cgroup
+func (a *Accounting) OnRemove(fn func(path string, final Stats)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	a.onRemove = fn
+}
+
+// Get returns stats of cgroup, path is either absolute or relative to root.
+// Cgroups without any traffic yet have zero stats.
+func (a *Accounting) Get(path string) (Stats, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(a.root, path)
+	}
+	id, err := cgroupID(path)
+	if err != nil {
+		return Stats{}, err
+	}
+	value, err := a.m.Lookup(idKey(id))
+	if err != nil {
+		return Stats{}, nil
+	}
+
+	return decodeStats(value)
+}
+
+// All returns stats of all cgroups with traffic, by path
+func (a *Accounting) All() (map[string]Stats, error) {
+	keys, err := a.keys()
+	if err != nil {
+		return nil, err
+	}
+	res := make(map[string]Stats, len(keys))
+	for _, key := range keys {
+		a.mu.RLock()
+		path, ok := a.paths[goebpf.HostByteOrder().Uint64(key)]
+		a.mu.RUnlock()
+		if !ok {
+			// Just removed, or created and not seen yet
+			continue
+		}
+		value, err := a.m.Lookup(key)
+		if err != nil {
+			continue
+		}
+		if res[path], err = decodeStats(value); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// Close detaches programs, stops tracking cgroups and frees all resources
+func (a *Accounting) Close() error {
+	a.notify.Close()
+	<-a.done
+	a.closePrograms()
+	return nil
+}
+
+func (a *Accounting) closePrograms() {
+	for _, prog := range a.programs {
+		prog.Detach()
+		prog.Close()
+	}
+	a.m.Close()
+}
+
+// ID of cgroup v2 is inode number of its directory
+func cgroupID(path string) (uint64, error) {
+	var st unix.Stat_t
+	if err := unix.Stat(path, &st); err != nil {
+		return 0, fmt.Errorf("Unable to stat '%s': %v", path, err)
+	}
+
+	return st.Ino, nil
+}
+
+func idKey(id uint64) []byte {
+	key := make([]byte, keySize)
+	goebpf.HostByteOrder().PutUint64(key, id)
+	return key
+}
+
+// Keys of map, collected first since deleting while iterating restarts enumeration
+func (a *Accounting) keys() ([][]byte, error) {
+	var keys [][]byte
+	var key interface{}
+	for {
+		next, err := a.m.GetNextKey(key)
+		if err == goebpf.ErrNoMoreKeys {
+			return keys, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		key = next
+		keys = append(keys, next)
+	}
+}
+
+// Starts tracking of cgroup dir and all cgroups below it.
+// Watch is added before listing, so no subdirectory is missed.
+func (a *Accounting) addTree(dir string) error {
+	wd, err := unix.InotifyAddWatch(a.notifyFd, dir, notifyMask)
+	if err != nil {
+		// Removed in the meantime
+		if os.IsNotExist(err) && dir != a.root {
+			return nil
+		}
+		return fmt.Errorf("Unable to watch '%s': %v", dir, err)
+	}
+	id, err := cgroupID(dir)
+	if err != nil {
+		return err
+	}
+	a.mu.Lock()
+	a.dirs[wd] = dir
+	a.paths[id] = dir
+	a.ids[dir] = id
+	a.mu.Unlock()
+
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			if err = a.addTree(filepath.Join(dir, entry.Name())); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Stops tracking of removed cgroup and drops its stats, along with stats
+// of any other cgroups not tracked anymore (sockets of removed cgroup may
+// still send / receive packets for a while)
+func (a *Accounting) remove(dir string) {
+	a.mu.Lock()
+	id, ok := a.ids[dir]
+	delete(a.ids, dir)
+	delete(a.paths, id)
+	onRemove := a.onRemove
+	a.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	var final Stats
+	if value, err := a.m.Lookup(idKey(id)); err == nil {
+		final, _ = decodeStats(value)
+	}
+	keys, _ := a.keys()
+	for _, key := range keys {
+		a.mu.RLock()
+		_, tracked := a.paths[goebpf.HostByteOrder().Uint64(key)]
+		a.mu.RUnlock()
+		if !tracked {
+			a.m.Delete(key)
+		}
+	}
+	if onRemove != nil {
+		onRemove(dir, final)
+	}
+}
+
+// Re-reads whole hierarchy after inotify queue overflow
+func (a *Accounting) rescan() {
+	a.addTree(a.root)
+	a.mu.RLock()
+	var removed []string
+	for dir := range a.ids {
+		if _, err := os.Stat(dir); os.IsNotExist(err) {
+			removed = append(removed, dir)
+		}
+	}
+	a.mu.RUnlock()
+	for _, dir := range removed {
+		a.remove(dir)
+	}
+}
+
+// Handles inotify events until inotify instance is closed
+func (a *Accounting) watch() {
+	defer close(a.done)
+
+	bo := goebpf.HostByteOrder()
+	buf := make([]byte, 64*(unix.SizeofInotifyEvent+unix.NAME_MAX+1))
+	for {
+		n, err := a.notify.Read(buf)
+		if err != nil {
+			return
+		}
+		for off := 0; off+unix.SizeofInotifyEvent <= n; {
+			// struct inotify_event followed by NULL padded name
+			wd := int(int32(bo.Uint32(buf[off:])))
+			mask := bo.Uint32(buf[off+4:])
+			nameLen := int(bo.Uint32(buf[off+12:]))
+			off += unix.SizeofInotifyEvent
+			if off+nameLen > n {
+				break
+			}
+			name := string(bytes.TrimRight(buf[off:off+nameLen], "\x00"))
+			off += nameLen
+
+			a.handleEvent(wd, mask, name)
+		}
+	}
+}
+
+func (a *Accounting) handleEvent(wd int, mask uint32, name string) {
+	if mask&unix.IN_Q_OVERFLOW != 0 {
+		a.rescan()
+		return
+	}
+	a.mu.Lock()
+	dir, ok := a.dirs[wd]
+	if mask&unix.IN_IGNORED != 0 {
+		delete(a.dirs, wd)
+	}
+	a.mu.Unlock()
+	if !ok || mask&unix.IN_ISDIR == 0 || name == "" || strings.Contains(name, "/") {
+		return
+	}
+
+	path := filepath.Join(dir, name)
+	switch {
+	case mask&unix.IN_CREATE != 0:
+		a.addTree(path)
+	case mask&unix.IN_DELETE != 0:
+		a.remove(path)
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_cgnet is per cgroup network accounting: CgroupSkb programs
+// attached to root of cgroup v2 hierarchy count received / sent bytes and
+// packets of every cgroup below it in per-CPU map, keyed by cgroup ID:
+//
+//	acc, err := goebpf_cgnet.New("/sys/fs/cgroup", goebpf_cgnet.DefaultMaxCgroups)
+//	...
+//	defer acc.Close()
+//	acc.OnRemove(func(path string, final goebpf_cgnet.Stats) {
+//		fmt.Println("removed", path, final.RxBytes, final.TxBytes)
+//	})
+//	if err = acc.Attach(); err != nil {
+//		...
+//	}
+//	...
+//	all, err := acc.All()
+//	for path, s := range all {
+//		fmt.Println(path, s.RxBytes, s.TxBytes)
+//	}
+//
+// Traffic is accounted to cgroup socket belongs to (cgroup of process
+// which created it), not to its ancestors. Cgroups created / removed
+// while accounting runs are tracked through inotify: stats of removed
+// cgroup are passed to OnRemove() handler and dropped from map.
+package goebpf_cgnet
+
+import (
+	"fmt"
+
+	"github.com/dropbox/goebpf"
+)
+
+const (
+	// DefaultMaxCgroups is reasonable capacity of map created by New()
+	DefaultMaxCgroups = 4096
+	// Names of map / programs
+	MapName            = "cgnet_stats"
+	IngressProgramName = "cgnet_ingress"
+	EgressProgramName  = "cgnet_egress"
+
+	// Key is cgroup ID, value is struct cgnet_stats:
+	//
+	//	struct cgnet_stats {
+	//		__u64 rx_bytes;
+	//		__u64 rx_packets;
+	//		__u64 tx_bytes;
+	//		__u64 tx_packets;
+	//	};
+	keySize   = 8
+	valueSize = 32
+)
+
+// Offsets of fields of struct cgnet_stats
+const (
+	valueRxBytes   = 0
+	valueRxPackets = 8
+	valueTxBytes   = 16
+	valueTxPackets = 24
+)
+
+// Stats is network traffic of single cgroup, as seen on L3 (IP) level
+type Stats struct {
+	RxBytes   uint64
+	RxPackets uint64
+	TxBytes   uint64
+	TxPackets uint64
+}
+
+// Sums values of all CPUs of per-CPU map
+func decodeStats(value []byte) (Stats, error) {
+	if len(value) == 0 || len(value)%valueSize != 0 {
+		return Stats{}, fmt.Errorf("Invalid value size %d", len(value))
+	}
+	bo := goebpf.HostByteOrder()
+	var s Stats
+	for off := 0; off < len(value); off += valueSize {
+		s.RxBytes += bo.Uint64(value[off+valueRxBytes:])
+		s.RxPackets += bo.Uint64(value[off+valueRxPackets:])
+		s.TxBytes += bo.Uint64(value[off+valueTxBytes:])
+		s.TxPackets += bo.Uint64(value[off+valueTxPackets:])
+	}
+
+	return s, nil
+}
+
+// Offset of len field of struct __sk_buff, see <linux/bpf.h>
+const skbLen = 0
+
+// BPF_NOEXIST flag of map update
+const bpfNoExist = 1
+
+// Stack layout: key, zero value for new entries
+const (
+	stackKey   = -keySize
+	stackValue = stackKey - valueSize
+)
+
+// CgroupSkb program of direction: adds packet to stats of cgroup of its socket
+func instructions(m goebpf.Map, direction goebpf.CgroupSkbDirection) goebpf.Instructions {
+	bytesOff, packetsOff := int16(valueRxBytes), int16(valueRxPackets)
+	if direction == goebpf.CgroupSkbEgress {
+		bytesOff, packetsOff = valueTxBytes, valueTxPackets
+	}
+	insns := goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R6, goebpf.R1),
+		goebpf.Call(goebpf.HelperSkbCgroupID),
+		goebpf.StoreMem(goebpf.SizeDouble, goebpf.R10, stackKey, goebpf.R0),
+
+		// R9 = stats of cgroup, created if there are none yet
+		goebpf.LoadMapFd(goebpf.R1, m),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackKey),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R0, 0, "found"),
+	}
+	for off := 0; off < valueSize; off += 8 {
+		insns = append(insns, goebpf.StoreImm(goebpf.SizeDouble, goebpf.R10, int16(stackValue+off), 0))
+	}
+	insns = append(insns,
+		goebpf.LoadMapFd(goebpf.R1, m),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackKey),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, stackValue),
+		goebpf.Mov64Imm(goebpf.R4, bpfNoExist),
+		goebpf.Call(goebpf.HelperMapUpdateElem),
+		// May be created concurrently (by other CPU), lookup again regardless of result
+		goebpf.LoadMapFd(goebpf.R1, m),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackKey),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "out"),
+
+		// Values are per CPU, so no atomic operations needed
+		goebpf.Mov64Reg(goebpf.R9, goebpf.R0).WithLabel("found"),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, skbLen),
+		goebpf.LoadMem(goebpf.SizeDouble, goebpf.R2, goebpf.R9, bytesOff),
+		goebpf.Alu64Reg(goebpf.AluOpAdd, goebpf.R2, goebpf.R1),
+		goebpf.StoreMem(goebpf.SizeDouble, goebpf.R9, bytesOff, goebpf.R2),
+		goebpf.LoadMem(goebpf.SizeDouble, goebpf.R2, goebpf.R9, packetsOff),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, 1),
+		goebpf.StoreMem(goebpf.SizeDouble, goebpf.R9, packetsOff, goebpf.R2),
+
+		// Accounting only, packet always passes
+		goebpf.Mov64Imm(goebpf.R0, 1).WithLabel("out"),
+		goebpf.Exit(),
+	)
+
+	return insns
+}
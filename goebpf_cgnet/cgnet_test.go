@@ -0,0 +1,50 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_cgnet
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_fake"
+)
+
+func TestDecodeStats(t *testing.T) {
+	bo := goebpf.HostByteOrder()
+	// Values of 2 CPUs are summed up
+	value := make([]byte, 2*valueSize)
+	for cpu := 0; cpu < 2; cpu++ {
+		off := cpu * valueSize
+		bo.PutUint64(value[off+valueRxBytes:], 1000)
+		bo.PutUint64(value[off+valueRxPackets:], 10)
+		bo.PutUint64(value[off+valueTxBytes:], uint64(500*(cpu+1)))
+		bo.PutUint64(value[off+valueTxPackets:], uint64(cpu+1))
+	}
+
+	s, err := decodeStats(value)
+	require.NoError(t, err)
+	assert.Equal(t, Stats{
+		RxBytes:   2000,
+		RxPackets: 20,
+		TxBytes:   1500,
+		TxPackets: 3,
+	}, s)
+
+	_, err = decodeStats(value[:valueSize+1])
+	assert.Error(t, err)
+	_, err = decodeStats(nil)
+	assert.Error(t, err)
+}
+
+func TestProgram(t *testing.T) {
+	m := goebpf_fake.NewFakeMap(MapName, goebpf.MapTypePerCPUHash, keySize, valueSize, 16)
+	for _, direction := range []goebpf.CgroupSkbDirection{goebpf.CgroupSkbIngress, goebpf.CgroupSkbEgress} {
+		prog, err := goebpf.NewProgram(IngressProgramName, goebpf.ProgramTypeCgroupSkb, "GPL", instructions(m, direction))
+		require.NoError(t, err, direction.String())
+		assert.Equal(t, goebpf.ProgramTypeCgroupSkb, prog.GetType())
+	}
+}
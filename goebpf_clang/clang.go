@@ -0,0 +1,131 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_clang compiles eBPF programs written in C into ELF files
+// loadable by goebpf, so there is no need to maintain Makefiles with
+// clang flags / include paths in every project:
+//
+//	err := goebpf_clang.Compile(&goebpf_clang.Options{
+//		Source: "ebpf_prog/xdp.c",
+//		Output: "ebpf_prog/xdp.elf",
+//	})
+//
+// It can be used either at run time or at build time through go:generate
+// and "goebpf compile" command.
+// Path to goebpf headers (bpf_helpers.h) is added automatically.
+package goebpf_clang
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"go/build"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Import path of main library, its directory contains bpf_helpers.h
+const goebpfPackage = "github.com/dropbox/goebpf"
+
+// Options of compilation
+type Options struct {
+	// Path to clang binary. Defaults to $CLANG or "clang"
+	Clang string
+	// C source file and output ELF file
+	Source string
+	Output string
+	// Additional include directories
+	IncludeDirs []string
+	// Preprocessor definitions, e.g. "DEBUG" or "MAX_ENTRIES=1024"
+	Defines []string
+	// Produce debug info (BTF), required for goebpf_btf
+	Debug bool
+	// Compile even if Output is newer than Source
+	Force bool
+	// Any other clang flags
+	ExtraFlags []string
+}
+
+// ErrClangNotFound returned when clang binary cannot be found
+var ErrClangNotFound = errors.New("clang not found, install clang / llvm or set CLANG environment variable")
+
+// IncludeDir returns directory of goebpf package with bpf.h / bpf_helpers.h
+func IncludeDir() (string, error) {
+	pkg, err := build.Import(goebpfPackage, "", build.FindOnly)
+	if err != nil {
+		return "", fmt.Errorf("Unable to locate %s: %v", goebpfPackage, err)
+	}
+	return pkg.Dir, nil
+}
+
+func (o *Options) clang() string {
+	if o.Clang != "" {
+		return o.Clang
+	}
+	if env := os.Getenv("CLANG"); env != "" {
+		return env
+	}
+	return "clang"
+}
+
+// Returns clang arguments
+func (o *Options) args(goebpfInclude string) []string {
+	args := []string{"-O2", "-target", "bpf", "-Wall", "-Wno-unused-function"}
+	if o.Debug {
+		args = append(args, "-g")
+	}
+	for _, dir := range o.IncludeDirs {
+		args = append(args, "-I"+dir)
+	}
+	if goebpfInclude != "" {
+		args = append(args, "-I"+goebpfInclude)
+	}
+	for _, def := range o.Defines {
+		args = append(args, "-D"+def)
+	}
+	args = append(args, o.ExtraFlags...)
+	args = append(args, "-c", o.Source, "-o", o.Output)
+
+	return args
+}
+
+// Checks if output is newer than source
+func (o *Options) upToDate() bool {
+	src, err := os.Stat(o.Source)
+	if err != nil {
+		return false
+	}
+	out, err := os.Stat(o.Output)
+	if err != nil {
+		return false
+	}
+	return out.ModTime().After(src.ModTime())
+}
+
+// Compile compiles C source into eBPF ELF file.
+// Note that only modification time of Source is checked, not included headers:
+// use Force to always recompile.
+func Compile(opts *Options) error {
+	if opts.Source == "" || opts.Output == "" {
+		return errors.New("Source and Output are required")
+	}
+	if !opts.Force && opts.upToDate() {
+		return nil
+	}
+	clang, err := exec.LookPath(opts.clang())
+	if err != nil {
+		return ErrClangNotFound
+	}
+	// Missing goebpf sources is not fatal: headers may be in IncludeDirs
+	include, _ := IncludeDir()
+
+	cmd := exec.Command(clang, opts.args(include)...)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err = cmd.Run(); err != nil {
+		return fmt.Errorf("%s failed: %v: %s", opts.clang(), err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
@@ -0,0 +1,61 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_clang
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestArgs(t *testing.T) {
+	opts := &Options{
+		Source:      "xdp.c",
+		Output:      "xdp.elf",
+		IncludeDirs: []string{"include"},
+		Defines:     []string{"DEBUG", "MAX=10"},
+		Debug:       true,
+		ExtraFlags:  []string{"-Werror"},
+	}
+	assert.Equal(t, []string{
+		"-O2", "-target", "bpf", "-Wall", "-Wno-unused-function", "-g",
+		"-Iinclude", "-I/goebpf",
+		"-DDEBUG", "-DMAX=10",
+		"-Werror",
+		"-c", "xdp.c", "-o", "xdp.elf",
+	}, opts.args("/goebpf"))
+}
+
+func TestClangBinary(t *testing.T) {
+	os.Setenv("CLANG", "clang-9")
+	defer os.Unsetenv("CLANG")
+	assert.Equal(t, "clang-9", (&Options{}).clang())
+	assert.Equal(t, "/usr/bin/clang", (&Options{Clang: "/usr/bin/clang"}).clang())
+}
+
+func TestCompile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "clang")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	src := filepath.Join(dir, "prog.c")
+	out := filepath.Join(dir, "prog.elf")
+	require.NoError(t, ioutil.WriteFile(src, []byte("int x;\n"), 0644))
+
+	// Negative
+	assert.Error(t, Compile(&Options{Source: src}))
+	err = Compile(&Options{Source: src, Output: out, Clang: "non-existing-clang"})
+	assert.Equal(t, ErrClangNotFound, err)
+
+	// Output is up to date - compiler is not even called
+	require.NoError(t, ioutil.WriteFile(out, []byte{}, 0644))
+	future := time.Now().Add(time.Hour)
+	require.NoError(t, os.Chtimes(out, future, future))
+	assert.NoError(t, Compile(&Options{Source: src, Output: out, Clang: "non-existing-clang"}))
+}
@@ -0,0 +1,322 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_conntrack reads connection tracking tables maintained by eBPF
+// programs: (LRU) hash maps keyed by flow 5-tuple (see goebpf.FlowKey) with
+// per-flow counters as value. By default value is expected to be
+//
+//	struct flow_stats {
+//		__u64 packets;
+//		__u64 bytes;
+//		__u64 first_seen;  // bpf_ktime_get_ns()
+//		__u64 last_seen;   // bpf_ktime_get_ns()
+//	};
+//
+// other layouts are supported by custom decoders, see WithValueDecoder().
+//
+//	table := goebpf_conntrack.NewTable(bpf.GetMapByName("conntrack"))
+//	flows, err := table.Flows()
+//	...
+//	for src, stats := range goebpf_conntrack.Aggregate(flows, goebpf_conntrack.BySource) {
+//		fmt.Println(src, stats.Packets, stats.Bytes)
+//	}
+//	// Forget flows idle for more than 5 minutes
+//	removed, err := table.Sweep(5 * time.Minute)
+package goebpf_conntrack
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Size of default value, struct flow_stats
+const statsValueSize = 32
+
+// Max number of keys deleted by Sweep() at once
+const sweepBatchSize = 1024
+
+// Stats is statistics of single flow, or aggregated stats of group of flows
+type Stats struct {
+	Packets   uint64
+	Bytes     uint64
+	FirstSeen time.Time
+	LastSeen  time.Time
+}
+
+// Add merges other stats into s
+func (s *Stats) Add(other Stats) {
+	s.Packets += other.Packets
+	s.Bytes += other.Bytes
+	if s.FirstSeen.IsZero() || (!other.FirstSeen.IsZero() && other.FirstSeen.Before(s.FirstSeen)) {
+		s.FirstSeen = other.FirstSeen
+	}
+	if other.LastSeen.After(s.LastSeen) {
+		s.LastSeen = other.LastSeen
+	}
+}
+
+// Flow is single entry of connection tracking table
+type Flow struct {
+	Key   goebpf.FlowKey
+	Stats Stats
+}
+
+// KeyDecoder converts raw map key into flow 5-tuple
+type KeyDecoder func(key []byte) (goebpf.FlowKey, error)
+
+// ValueDecoder converts raw map value into flow statistics
+type ValueDecoder func(value []byte) (Stats, error)
+
+// Option is optional setting of Table
+type Option func(*Table)
+
+// WithKeyDecoder sets decoder of keys with layout other than goebpf.FlowKey
+func WithKeyDecoder(d KeyDecoder) Option {
+	return func(t *Table) {
+		t.decodeKey = d
+	}
+}
+
+// WithValueDecoder sets decoder of values with layout other than struct flow_stats
+func WithValueDecoder(d ValueDecoder) Option {
+	return func(t *Table) {
+		t.decodeValue = d
+	}
+}
+
+// Table is reader of connection tracking map
+type Table struct {
+	m           goebpf.Map
+	decodeKey   KeyDecoder
+	decodeValue ValueDecoder
+	now         func() time.Time
+}
+
+// NewTable creates reader of connection tracking map m
+func NewTable(m goebpf.Map, opts ...Option) *Table {
+	t := &Table{
+		m:           m,
+		decodeKey:   DecodeFlowKey,
+		decodeValue: DecodeStats,
+		now:         time.Now,
+	}
+	for _, opt := range opts {
+		opt(t)
+	}
+
+	return t
+}
+
+// DecodeFlowKey is default key decoder, see goebpf.FlowKey
+func DecodeFlowKey(key []byte) (goebpf.FlowKey, error) {
+	var k goebpf.FlowKey
+	err := k.UnmarshalBinary(key)
+	return k, err
+}
+
+// DecodeStats is default value decoder, see struct flow_stats
+func DecodeStats(value []byte) (Stats, error) {
+	if len(value) < statsValueSize {
+		return Stats{}, fmt.Errorf("Invalid value size %d, must be at least %d", len(value), statsValueSize)
+	}
+	bo := goebpf.HostByteOrder()
+	s := Stats{
+		Packets: bo.Uint64(value),
+		Bytes:   bo.Uint64(value[8:]),
+	}
+	if ts := bo.Uint64(value[16:]); ts != 0 {
+		s.FirstSeen = goebpf.KtimeToTime(ts)
+	}
+	if ts := bo.Uint64(value[24:]); ts != 0 {
+		s.LastSeen = goebpf.KtimeToTime(ts)
+	}
+
+	return s, nil
+}
+
+// Calls fn for every flow of table. Flows removed during enumeration are skipped.
+func (t *Table) each(fn func(key []byte, flow Flow) error) error {
+	var ikey interface{}
+	for {
+		key, err := t.m.GetNextKey(ikey)
+		if err == goebpf.ErrNoMoreKeys {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		ikey = key
+		value, err := t.m.Lookup(key)
+		if err != nil {
+			// Removed (e.g. evicted) in the meantime
+			continue
+		}
+		flow := Flow{}
+		if flow.Key, err = t.decodeKey(key); err != nil {
+			return err
+		}
+		if flow.Stats, err = t.decodeValue(value); err != nil {
+			return err
+		}
+		if err = fn(key, flow); err != nil {
+			return err
+		}
+	}
+}
+
+// Flows returns all flows of table. Like any map enumeration
+// it is not atomic for maps modified concurrently.
+func (t *Table) Flows() ([]Flow, error) {
+	var res []Flow
+	err := t.each(func(key []byte, flow Flow) error {
+		res = append(res, flow)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Sweep removes flows not seen for more than idle, in batches when
+// supported by kernel. Returns number of removed flows.
+func (t *Table) Sweep(idle time.Duration) (int, error) {
+	deadline := t.now().Add(-idle)
+	var expired [][]byte
+	err := t.each(func(key []byte, flow Flow) error {
+		if !flow.Stats.LastSeen.IsZero() && flow.Stats.LastSeen.Before(deadline) {
+			expired = append(expired, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	removed := 0
+	for len(expired) > 0 {
+		batch := expired
+		if len(batch) > sweepBatchSize {
+			batch = batch[:sweepBatchSize]
+		}
+		expired = expired[len(batch):]
+		n, err := t.deleteKeys(batch)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+
+	return removed, nil
+}
+
+// Deletes raw keys, ones already gone are skipped
+func (t *Table) deleteKeys(keys [][]byte) (int, error) {
+	if m, ok := t.m.(*goebpf.EbpfMap); ok {
+		return m.DeleteBatch(keys)
+	}
+	deleted := 0
+	for _, key := range keys {
+		// Flow may be already evicted
+		if t.m.Delete(key) == nil {
+			deleted++
+		}
+	}
+
+	return deleted, nil
+}
+
+// Exported form of flow
+type jsonFlow struct {
+	Protocol  uint8     `json:"proto"`
+	Src       string    `json:"src"`
+	SrcPort   uint16    `json:"sport"`
+	Dst       string    `json:"dst"`
+	DstPort   uint16    `json:"dport"`
+	Packets   uint64    `json:"packets"`
+	Bytes     uint64    `json:"bytes"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+}
+
+// MarshalJSON implements json.Marshaler:
+//
+//	{"proto":6,"src":"10.0.0.1","sport":12345,"dst":"10.0.0.2","dport":80,
+//	 "packets":10,"bytes":1500,"first_seen":"...","last_seen":"..."}
+func (f Flow) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonFlow{
+		Protocol:  f.Key.Protocol,
+		Src:       f.Key.Src.String(),
+		SrcPort:   f.Key.SrcPort,
+		Dst:       f.Key.Dst.String(),
+		DstPort:   f.Key.DstPort,
+		Packets:   f.Stats.Packets,
+		Bytes:     f.Stats.Bytes,
+		FirstSeen: f.Stats.FirstSeen,
+		LastSeen:  f.Stats.LastSeen,
+	})
+}
+
+// Export writes flows into w as they are read from map, one JSON object
+// per line (see Flow.MarshalJSON()), without holding whole table in memory.
+// Returns number of exported flows.
+func (t *Table) Export(w io.Writer) (int, error) {
+	enc := json.NewEncoder(w)
+	count := 0
+	err := t.each(func(key []byte, flow Flow) error {
+		if err := enc.Encode(flow); err != nil {
+			return err
+		}
+		count++
+		return nil
+	})
+
+	return count, err
+}
+
+// GroupFunc returns name of group flow belongs to, see Aggregate()
+type GroupFunc func(key goebpf.FlowKey) string
+
+// Predefined groupings
+var (
+	BySource GroupFunc = func(key goebpf.FlowKey) string {
+		return key.Src.String()
+	}
+	ByDestination GroupFunc = func(key goebpf.FlowKey) string {
+		return key.Dst.String()
+	}
+	ByDestinationPort GroupFunc = func(key goebpf.FlowKey) string {
+		return fmt.Sprintf("%d/%d", key.DstPort, key.Protocol)
+	}
+	ByProtocol GroupFunc = func(key goebpf.FlowKey) string {
+		return fmt.Sprint(key.Protocol)
+	}
+)
+
+// Aggregate sums stats of flows by group returned by group
+func Aggregate(flows []Flow, group GroupFunc) map[string]Stats {
+	res := make(map[string]Stats)
+	for _, f := range flows {
+		name := group(f.Key)
+		s := res[name]
+		s.Add(f.Stats)
+		res[name] = s
+	}
+
+	return res
+}
+
+// Total returns stats of all flows together
+func Total(flows []Flow) Stats {
+	var res Stats
+	for _, f := range flows {
+		res.Add(f.Stats)
+	}
+
+	return res
+}
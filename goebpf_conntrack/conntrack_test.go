@@ -0,0 +1,148 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_conntrack
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_fake"
+)
+
+// Inverse of goebpf.KtimeToTime()
+func toKtime(t time.Time) uint64 {
+	return uint64(t.Sub(goebpf.KtimeToTime(0)))
+}
+
+func statsValue(packets, bytes uint64, first, last time.Time) []byte {
+	bo := goebpf.HostByteOrder()
+	value := make([]byte, statsValueSize)
+	bo.PutUint64(value, packets)
+	bo.PutUint64(value[8:], bytes)
+	bo.PutUint64(value[16:], toKtime(first))
+	bo.PutUint64(value[24:], toKtime(last))
+	return value
+}
+
+func flowKey(src string, sport uint16, dst string, dport uint16, proto uint8) goebpf.FlowKey {
+	return goebpf.FlowKey{
+		Src:      net.ParseIP(src),
+		Dst:      net.ParseIP(dst),
+		SrcPort:  sport,
+		DstPort:  dport,
+		Protocol: proto,
+	}
+}
+
+func TestDecodeStats(t *testing.T) {
+	now := time.Now()
+	s, err := DecodeStats(statsValue(10, 1500, now.Add(-time.Minute), now))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), s.Packets)
+	assert.Equal(t, uint64(1500), s.Bytes)
+	assert.WithinDuration(t, now.Add(-time.Minute), s.FirstSeen, time.Millisecond)
+	assert.WithinDuration(t, now, s.LastSeen, time.Millisecond)
+
+	// Zero timestamps are not set
+	s, err = DecodeStats(make([]byte, statsValueSize))
+	require.NoError(t, err)
+	assert.True(t, s.FirstSeen.IsZero())
+	assert.True(t, s.LastSeen.IsZero())
+
+	_, err = DecodeStats(make([]byte, 16))
+	assert.Error(t, err)
+}
+
+func TestTable(t *testing.T) {
+	m := goebpf_fake.NewFakeMap("conntrack", goebpf.MapTypeLRUHash, 16, statsValueSize, 16)
+	now := time.Now()
+	require.NoError(t, m.Insert(flowKey("10.0.0.1", 1000, "10.0.0.2", 80, 6),
+		statsValue(10, 1000, now.Add(-time.Hour), now)))
+	require.NoError(t, m.Insert(flowKey("10.0.0.1", 1001, "10.0.0.3", 53, 17),
+		statsValue(1, 100, now.Add(-time.Hour), now.Add(-10*time.Minute))))
+	require.NoError(t, m.Insert(flowKey("10.0.0.4", 1000, "10.0.0.2", 80, 6),
+		statsValue(5, 500, now.Add(-time.Minute), now.Add(-time.Second))))
+
+	table := NewTable(m)
+	flows, err := table.Flows()
+	require.NoError(t, err)
+	require.Len(t, flows, 3)
+
+	bySrc := Aggregate(flows, BySource)
+	require.Len(t, bySrc, 2)
+	assert.Equal(t, uint64(11), bySrc["10.0.0.1"].Packets)
+	assert.Equal(t, uint64(1100), bySrc["10.0.0.1"].Bytes)
+	assert.WithinDuration(t, now.Add(-time.Hour), bySrc["10.0.0.1"].FirstSeen, time.Millisecond)
+	assert.WithinDuration(t, now, bySrc["10.0.0.1"].LastSeen, time.Millisecond)
+	byPort := Aggregate(flows, ByDestinationPort)
+	assert.Equal(t, uint64(15), byPort["80/6"].Packets)
+	assert.Equal(t, uint64(1), byPort["53/17"].Packets)
+	assert.Equal(t, uint64(1600), Total(flows).Bytes)
+
+	// Streaming export
+	var buf bytes.Buffer
+	count, err := table.Export(&buf)
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 3)
+	var exported map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(lines[0]), &exported))
+	for _, field := range []string{"proto", "src", "sport", "dst", "dport", "packets", "bytes", "first_seen", "last_seen"} {
+		assert.Contains(t, exported, field)
+	}
+
+	// Only UDP flow is idle for more than 5 minutes
+	removed, err := table.Sweep(5 * time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+	flows, err = table.Flows()
+	require.NoError(t, err)
+	assert.Len(t, flows, 2)
+	assert.Empty(t, Aggregate(flows, ByProtocol)["17"])
+
+	// Nothing to remove
+	removed, err = table.Sweep(5 * time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+}
+
+func TestTableCustomDecoders(t *testing.T) {
+	// Key is just source IPv4 address, value is packet counter
+	m := goebpf_fake.NewFakeMap("counters", goebpf.MapTypeHash, 4, 8, 16)
+	require.NoError(t, m.Insert(goebpf.MustIPv4Key("10.0.0.1"), uint64(7)))
+
+	table := NewTable(m,
+		WithKeyDecoder(func(key []byte) (goebpf.FlowKey, error) {
+			var addr goebpf.IPv4Key
+			err := addr.UnmarshalBinary(key)
+			return goebpf.FlowKey{Src: addr.IP()}, err
+		}),
+		WithValueDecoder(func(value []byte) (Stats, error) {
+			return Stats{Packets: goebpf.HostByteOrder().Uint64(value)}, nil
+		}),
+	)
+	flows, err := table.Flows()
+	require.NoError(t, err)
+	require.Len(t, flows, 1)
+	assert.Equal(t, "10.0.0.1", flows[0].Key.Src.String())
+	assert.Equal(t, uint64(7), flows[0].Stats.Packets)
+
+	// Flows without timestamps are never swept
+	removed, err := table.Sweep(0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	// Decoding errors are reported
+	_, err = NewTable(m).Flows()
+	assert.Error(t, err)
+}
@@ -0,0 +1,183 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_container
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// QoS classes of Kubernetes pods, kubelet groups cgroups of pods by them.
+// Pods of Guaranteed class are right under root of pods.
+var podQosClasses = []string{"", "burstable", "besteffort"}
+
+// Prefixes of container scopes created by container runtimes with
+// systemd cgroup driver, e.g. "cri-containerd-<id>.scope"
+var containerScopePrefixes = []string{"cri-containerd-", "crio-", "docker-", "libpod-"}
+
+// Suffix of systemd scope / slice units
+const (
+	scopeSuffix = ".scope"
+	sliceSuffix = ".slice"
+)
+
+// Returns names of pod cgroup directory for systemd and cgroupfs cgroup
+// drivers of kubelet. Systemd driver escapes "-" of pod UID by "_":
+//
+//	kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod<uid>.slice
+//	kubepods/burstable/pod<uid>
+func podCgroupNames(podUID string) map[string]bool {
+	uid := strings.ToLower(podUID)
+	escaped := strings.Replace(uid, "-", "_", -1)
+	res := map[string]bool{"pod" + uid: true}
+	for _, qos := range podQosClasses {
+		if qos == "" {
+			res["kubepods-pod"+escaped+sliceSuffix] = true
+		} else {
+			res["kubepods-"+qos+"-pod"+escaped+sliceSuffix] = true
+		}
+	}
+	return res
+}
+
+// Checks whether cgroup directory name belongs to container id (full or
+// prefix), for both systemd ("cri-containerd-<id>.scope", "crio-<id>.scope")
+// and cgroupfs ("<id>") cgroup drivers
+func isContainerCgroup(name, id string) bool {
+	if strings.HasSuffix(name, scopeSuffix) {
+		name = strings.TrimSuffix(name, scopeSuffix)
+		found := false
+		for _, prefix := range containerScopePrefixes {
+			if strings.HasPrefix(name, prefix) {
+				name = strings.TrimPrefix(name, prefix)
+				found = true
+				break
+			}
+		}
+		// E.g. "crio-conmon-<id>.scope" is monitor of container, not container itself
+		if !found {
+			return false
+		}
+	}
+	return strings.HasPrefix(name, id)
+}
+
+// Finds shallowest directory below root which name matches, breadth first.
+// Returns path relative to root.
+func findCgroup(root string, match func(name string) bool) (string, error) {
+	level := []string{""}
+	for len(level) > 0 {
+		var next []string
+		for _, dir := range level {
+			// Cgroup may be removed meanwhile
+			entries, err := ioutil.ReadDir(filepath.Join(root, dir))
+			if err != nil {
+				continue
+			}
+			for _, entry := range entries {
+				if !entry.IsDir() {
+					continue
+				}
+				path := filepath.Join(dir, entry.Name())
+				if match(entry.Name()) {
+					return path, nil
+				}
+				next = append(next, path)
+			}
+		}
+		level = next
+	}
+
+	return "", os.ErrNotExist
+}
+
+// Path under cgroup v2 root of pod cgroup
+func findPodCgroup(root, podUID string) (string, error) {
+	if podUID == "" {
+		return "", fmt.Errorf("Invalid pod UID '%s'", podUID)
+	}
+	names := podCgroupNames(podUID)
+	path, err := findCgroup(root, func(name string) bool {
+		return names[name]
+	})
+	if err != nil {
+		return "", fmt.Errorf("Cgroup of pod '%s' not found under '%s'", podUID, root)
+	}
+
+	return filepath.Join(root, path), nil
+}
+
+// Path under cgroup v2 root of container cgroup
+func findContainerCgroup(root, containerID string) (string, error) {
+	id := normalizeID(containerID)
+	if len(id) < minContainerIDLen {
+		return "", fmt.Errorf("Invalid container ID '%s'", containerID)
+	}
+	path, err := findCgroup(root, func(name string) bool {
+		return isContainerCgroup(name, id)
+	})
+	if err != nil {
+		return "", fmt.Errorf("%v: cgroup of '%s' not found under '%s'", ErrContainerNotFound, containerID, root)
+	}
+
+	return filepath.Join(root, path), nil
+}
+
+// PodCgroupPath returns cgroup v2 directory of Kubernetes pod by its UID
+// (metadata.uid), with both systemd and cgroupfs cgroup drivers of kubelet
+// and custom cgroup root (e.g. kind / k3s nested kubepods). Program attached
+// to it sees all containers of pod.
+func PodCgroupPath(podUID string) (string, error) {
+	mount, err := Cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+
+	return findPodCgroup(mount, podUID)
+}
+
+// ContainerCgroupPath returns cgroup v2 directory of container by container
+// runtime ID (full or at least 12 characters prefix, optionally prefixed by
+// runtime as "containerd://<id>" of pod status). Containerd, CRI-O, docker
+// and podman layouts are recognized. Unlike CgroupPath(), it works for
+// containers which aren't running (have no processes) yet.
+func ContainerCgroupPath(containerID string) (string, error) {
+	mount, err := Cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+
+	return findContainerCgroup(mount, containerID)
+}
+
+// OpenCgroup opens cgroup v2 directory, e.g. one returned by PodCgroupPath(),
+// for APIs taking cgroup fd (e.g. BPF_MAP_TYPE_CGROUP_ARRAY values).
+// Cgroup v1 hierarchies can't be used for eBPF programs, so they are rejected.
+func OpenCgroup(path string) (*os.File, error) {
+	mount, err := Cgroup2Mount()
+	if err != nil {
+		return nil, err
+	}
+	if rel, err := filepath.Rel(mount, path); err != nil || strings.HasPrefix(rel, "..") {
+		return nil, fmt.Errorf("'%s' is not in cgroup v2 hierarchy mounted at '%s'", path, mount)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	if !info.IsDir() {
+		f.Close()
+		return nil, fmt.Errorf("'%s' is not cgroup directory", path)
+	}
+
+	return f, nil
+}
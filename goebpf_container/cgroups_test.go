@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_container
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPodUID = "2e1f4a5b-6c7d-4e8f-9a0b-1c2d3e4f5a6b"
+
+// Creates fake cgroup v2 hierarchy of directories
+func fakeCgroups(t *testing.T, dirs ...string) string {
+	root, err := ioutil.TempDir("", "goebpf_cgroups")
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		os.RemoveAll(root)
+	})
+	for _, dir := range dirs {
+		require.NoError(t, os.MkdirAll(filepath.Join(root, dir), 0755))
+	}
+	return root
+}
+
+func TestFindPodCgroupSystemd(t *testing.T) {
+	pod := "kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod2e1f4a5b_6c7d_4e8f_9a0b_1c2d3e4f5a6b.slice"
+	root := fakeCgroups(t,
+		"system.slice/containerd.service",
+		pod+"/cri-containerd-"+testContainerID+".scope",
+		pod+"/crio-conmon-"+testContainerID+".scope",
+	)
+
+	path, err := findPodCgroup(root, testPodUID)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, pod), path)
+
+	path, err = findContainerCgroup(root, "containerd://"+testContainerID)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, pod, "cri-containerd-"+testContainerID+".scope"), path)
+
+	_, err = findPodCgroup(root, "00000000-0000-0000-0000-000000000000")
+	assert.Error(t, err)
+	_, err = findContainerCgroup(root, "ffffffffffffffff")
+	assert.Error(t, err)
+	_, err = findContainerCgroup(root, "3f4e")
+	assert.Error(t, err)
+}
+
+func TestFindPodCgroupCgroupfs(t *testing.T) {
+	// Guaranteed pod under custom cgroup root of kubelet
+	pod := "kubelet/kubepods/pod" + testPodUID
+	root := fakeCgroups(t, pod+"/"+testContainerID, "kubelet/kubepods/besteffort")
+
+	path, err := findPodCgroup(root, testPodUID)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, pod), path)
+
+	path, err = findContainerCgroup(root, testContainerID[:12])
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, pod, testContainerID), path)
+}
+
+func TestIsContainerCgroup(t *testing.T) {
+	id := testContainerID[:12]
+	assert.True(t, isContainerCgroup(testContainerID, id))
+	assert.True(t, isContainerCgroup("crio-"+testContainerID+".scope", id))
+	assert.True(t, isContainerCgroup("docker-"+testContainerID+".scope", id))
+	assert.True(t, isContainerCgroup("libpod-"+testContainerID+".scope", id))
+	assert.False(t, isContainerCgroup("crio-conmon-"+testContainerID+".scope", id))
+	assert.False(t, isContainerCgroup("session-"+testContainerID+".scope", id))
+	assert.False(t, isContainerCgroup("system.slice", id))
+}
+
+func TestOpenCgroup(t *testing.T) {
+	fakeProc(t, nil)
+
+	_, err := OpenCgroup("/tmp")
+	assert.Error(t, err)
+	_, err = OpenCgroup("/sys/fs/cgroup/../../tmp")
+	assert.Error(t, err)
+}
@@ -0,0 +1,220 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_container resolves eBPF attach targets of containers
+// (given PID or container runtime ID) from host, as Kubernetes node agents
+// do: paths of binaries inside container mount namespace (to attach
+// uprobes) and cgroup v2 directory of container (to attach cgroup programs):
+//
+//	// Container ID as reported by Kubernetes / docker / crictl
+//	pid, err := goebpf_container.FindPid("containerd://3f4e...")
+//	...
+//	err = uprobe.Attach(goebpf.UprobeAttachParams{
+//		Pid:    pid,
+//		Path:   "/usr/bin/python3",
+//		Symbol: "PyEval_EvalCode",
+//	})
+//	...
+//	cgroup, err := goebpf_container.CgroupPath(pid)
+//	...
+//	err = cgroupSkb.Attach(goebpf.CgroupSkbAttachParams{
+//		CgroupPath: cgroup,
+//		Direction:  goebpf.CgroupSkbEgress,
+//	})
+//
+// Cgroups of pods / containers which aren't running (yet) are found by
+// PodCgroupPath() / ContainerCgroupPath(), regardless of cgroup driver
+// (systemd / cgroupfs) and container runtime naming:
+//
+//	cgroup, err := goebpf_container.PodCgroupPath(string(pod.UID))
+//
+// Agent is expected to run in host PID namespace (hostPID: true).
+package goebpf_container
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Shortest container ID prefix accepted by FindPid(), as printed by docker ps
+const minContainerIDLen = 12
+
+// Default mount point of cgroup v2 hierarchy
+const defaultCgroup2Mount = "/sys/fs/cgroup"
+
+// Root of procfs, replaced by tests
+var procRoot = "/proc"
+
+// ErrContainerNotFound returned by FindPid() when no process belongs to container
+var ErrContainerNotFound = errors.New("Container not found")
+
+// HostPath returns path at which file path of mount namespace of process
+// pid (e.g. binary of container) is accessible from host
+func HostPath(pid int, path string) string {
+	return filepath.Join(procRoot, strconv.Itoa(pid), "root", path)
+}
+
+// Normalizes container ID: runtime prefix ("containerd://", "docker://",
+// "cri-o://") used by Kubernetes pod status is stripped
+func normalizeID(id string) string {
+	if idx := strings.Index(id, "://"); idx >= 0 {
+		id = id[idx+3:]
+	}
+	return strings.ToLower(strings.TrimSpace(id))
+}
+
+// FindPid returns PID of process of container by container runtime ID
+// (full or at least 12 characters prefix), looking for it in cgroup paths
+// of processes, e.g. ".../docker-<id>.scope" or "/kubepods/.../<id>".
+// When container has many processes, the lowest PID (usually container
+// init) is returned.
+func FindPid(containerID string) (int, error) {
+	id := normalizeID(containerID)
+	if len(id) < minContainerIDLen {
+		return 0, fmt.Errorf("Invalid container ID '%s'", containerID)
+	}
+	entries, err := ioutil.ReadDir(procRoot)
+	if err != nil {
+		return 0, err
+	}
+
+	found := 0
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || (found != 0 && pid > found) {
+			continue
+		}
+		// Process may exit meanwhile
+		paths, err := readCgroups(pid)
+		if err != nil {
+			continue
+		}
+		for _, path := range paths {
+			if strings.Contains(path, id) {
+				found = pid
+				break
+			}
+		}
+	}
+	if found == 0 {
+		return 0, fmt.Errorf("%v: '%s'", ErrContainerNotFound, containerID)
+	}
+
+	return found, nil
+}
+
+// Returns cgroup paths of process by hierarchy ID ("0" for cgroup v2)
+func readCgroups(pid int) (map[string]string, error) {
+	f, err := os.Open(filepath.Join(procRoot, strconv.Itoa(pid), "cgroup"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return parseCgroups(bufio.NewScanner(f))
+}
+
+// Parses /proc/<pid>/cgroup:
+//
+//	12:memory:/kubepods/burstable/pod2e1.../3f4e...
+//	0::/kubepods.slice/kubepods-burstable.slice/cri-containerd-3f4e....scope
+func parseCgroups(scanner *bufio.Scanner) (map[string]string, error) {
+	res := make(map[string]string)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("Invalid cgroup at line %d", lineNum)
+		}
+		res[fields[0]] = fields[2]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// CgroupPath returns cgroup v2 directory of process pid (e.g. process of
+// container) under cgroup2 mount point of host, to attach cgroup programs to.
+// Path is relative to cgroup namespace of caller, so agent should run in
+// host cgroup namespace.
+func CgroupPath(pid int) (string, error) {
+	cgroups, err := readCgroups(pid)
+	if err != nil {
+		return "", err
+	}
+	path, ok := cgroups["0"]
+	if !ok {
+		return "", fmt.Errorf("Process %d is not in cgroup v2 hierarchy", pid)
+	}
+	mount, err := Cgroup2Mount()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(mount, path), nil
+}
+
+// Cgroup2Mount returns mount point of cgroup v2 hierarchy, e.g. "/sys/fs/cgroup"
+// (or "/sys/fs/cgroup/unified" on hybrid systems)
+func Cgroup2Mount() (string, error) {
+	f, err := os.Open(filepath.Join(procRoot, "self", "mountinfo"))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	mount, err := parseCgroup2Mount(bufio.NewScanner(f))
+	if err != nil {
+		return "", err
+	}
+	if mount == "" {
+		return "", fmt.Errorf("cgroup2 is not mounted (usually at %s)", defaultCgroup2Mount)
+	}
+
+	return mount, nil
+}
+
+// Finds cgroup2 in /proc/self/mountinfo, fields after "-" are filesystem type / source:
+//
+//	35 24 0:30 / /sys/fs/cgroup rw,nosuid,nodev,noexec,relatime shared:9 - cgroup2 cgroup2 rw
+func parseCgroup2Mount(scanner *bufio.Scanner) (string, error) {
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		for idx := 6; idx < len(fields)-1; idx++ {
+			if fields[idx] == "-" {
+				if fields[idx+1] == "cgroup2" {
+					return unescapeMountPath(fields[4]), nil
+				}
+				break
+			}
+		}
+	}
+
+	return "", scanner.Err()
+}
+
+// Mount paths have spaces and some other characters escaped as octal "\040"
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+	var res []byte
+	for idx := 0; idx < len(path); idx++ {
+		if path[idx] == '\\' && idx+3 < len(path) {
+			if c, err := strconv.ParseUint(path[idx+1:idx+4], 8, 8); err == nil {
+				res = append(res, byte(c))
+				idx += 3
+				continue
+			}
+		}
+		res = append(res, path[idx])
+	}
+	return string(res)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_container
+
+import (
+	"bufio"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testContainerID = "3f4e8b1c2d5a6e7f8091a2b3c4d5e6f708192a3b4c5d6e7f8091a2b3c4d5e6f7"
+
+// Creates fake procfs with cgroup files of processes
+func fakeProc(t *testing.T, cgroups map[string]string) {
+	dir, err := ioutil.TempDir("", "goebpf_container")
+	require.NoError(t, err)
+	oldRoot := procRoot
+	procRoot = dir
+	t.Cleanup(func() {
+		procRoot = oldRoot
+		os.RemoveAll(dir)
+	})
+	for pid, cgroup := range cgroups {
+		require.NoError(t, os.MkdirAll(filepath.Join(dir, pid), 0755))
+		require.NoError(t, ioutil.WriteFile(filepath.Join(dir, pid, "cgroup"), []byte(cgroup), 0644))
+	}
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "self"), 0755))
+	mountinfo := "24 1 0:22 / / rw - ext4 /dev/sda1 rw\n" +
+		"35 24 0:30 / /sys/fs/cgroup rw,nosuid shared:9 - cgroup2 cgroup2 rw\n"
+	require.NoError(t, ioutil.WriteFile(filepath.Join(dir, "self", "mountinfo"), []byte(mountinfo), 0644))
+}
+
+func TestFindPid(t *testing.T) {
+	scope := "0::/kubepods.slice/kubepods-burstable.slice/cri-containerd-" + testContainerID + ".scope\n"
+	fakeProc(t, map[string]string{
+		"1":    "0::/init.scope\n",
+		"1234": scope,
+		"987":  scope,
+		"55":   "0::/system.slice/docker-0000000000000000.scope\n",
+	})
+
+	pid, err := FindPid("containerd://" + testContainerID)
+	require.NoError(t, err)
+	assert.Equal(t, 987, pid)
+	pid, err = FindPid(strings.ToUpper(testContainerID[:12]))
+	require.NoError(t, err)
+	assert.Equal(t, 987, pid)
+
+	_, err = FindPid("3f4e8b")
+	assert.Error(t, err)
+	_, err = FindPid("ffffffffffffffff")
+	assert.Error(t, err)
+
+	path, err := CgroupPath(987)
+	require.NoError(t, err)
+	assert.Equal(t, "/sys/fs/cgroup/kubepods.slice/kubepods-burstable.slice/cri-containerd-"+testContainerID+".scope", path)
+	_, err = CgroupPath(1000)
+	assert.Error(t, err)
+
+	assert.Equal(t, filepath.Join(procRoot, "1234/root/usr/bin/python3"), HostPath(1234, "/usr/bin/python3"))
+}
+
+func TestParseCgroups(t *testing.T) {
+	input := "12:memory:/docker/abc\n0::/user.slice/user-1000.slice\n"
+	cgroups, err := parseCgroups(bufio.NewScanner(strings.NewReader(input)))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"12": "/docker/abc", "0": "/user.slice/user-1000.slice"}, cgroups)
+
+	_, err = parseCgroups(bufio.NewScanner(strings.NewReader("invalid\n")))
+	assert.Error(t, err)
+}
+
+func TestCgroup2Mount(t *testing.T) {
+	input := "26 1 0:23 / /sys/fs/cgroup ro - tmpfs tmpfs ro\n" +
+		"30 26 0:26 / /sys/fs/cgroup/unified rw,nosuid shared:4 - cgroup2 cgroup2 rw,nsdelegate\n"
+	mount, err := parseCgroup2Mount(bufio.NewScanner(strings.NewReader(input)))
+	require.NoError(t, err)
+	assert.Equal(t, "/sys/fs/cgroup/unified", mount)
+
+	mount, err = parseCgroup2Mount(bufio.NewScanner(strings.NewReader("26 1 0:23 / /sys/fs/cgroup ro - tmpfs tmpfs ro\n")))
+	require.NoError(t, err)
+	assert.Equal(t, "", mount)
+
+	assert.Equal(t, "/mnt/cgroup v2", unescapeMountPath(`/mnt/cgroup\040v2`))
+	assert.Equal(t, `/mnt/a\b`, unescapeMountPath(`/mnt/a\b`))
+}
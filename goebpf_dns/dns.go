@@ -0,0 +1,53 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_dns is DNS query telemetry: socket filter program on raw
+// socket extracts DNS queries (UDP, port 53) sent / received by interface,
+// and passes them to Go through ring buffer (linux 5.8+), where query names /
+// types are decoded:
+//
+//	mon, err := goebpf_dns.New(goebpf_dns.DefaultRingSize)
+//	...
+//	defer mon.Close()
+//	if err = mon.Attach("eth0"); err != nil {
+//		...
+//	}
+//	for {
+//		q, err := mon.Read()
+//		if err != nil {
+//			break
+//		}
+//		fmt.Println(q.Src, q.Name, q.Type)
+//	}
+//
+// Socket filter sees packets in both directions, but doesn't interfere with
+// traffic: raw socket receives nothing, everything goes through ring buffer.
+package goebpf_dns
+
+import (
+	"net"
+	"time"
+)
+
+const (
+	// DefaultRingSize (bytes) holds a few thousand queries of typical length
+	DefaultRingSize = 1 << 20
+	// Name of ring buffer map / program
+	MapName     = "dns_queries"
+	ProgramName = "dns_telemetry"
+)
+
+// Query is single DNS query seen on interface
+type Query struct {
+	// When query was seen by program
+	Time    time.Time
+	Src     net.IP
+	Dst     net.IP
+	SrcPort uint16
+	DstPort uint16
+	ID      uint16
+	// Query name without trailing dot, "." for root
+	Name  string
+	Type  QueryType
+	Class uint16
+}
@@ -0,0 +1,141 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_dns
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/internal/maputil"
+)
+
+// Monitor captures DNS queries of network interface
+type Monitor struct {
+	ring   *goebpf.EbpfMap
+	prog   goebpf.Program
+	reader *goebpf.RingBufReader
+	sock   int
+	// Number of records Read() skipped as malformed
+	malformed uint64
+}
+
+// New creates ring buffer of ringSize bytes (power of 2) and loads program
+// writing into it. Program is not attached yet, see Attach().
+func New(ringSize int) (*Monitor, error) {
+	ring := &goebpf.EbpfMap{
+		Name:       MapName,
+		Type:       goebpf.MapTypeRingBuf,
+		MaxEntries: ringSize,
+	}
+	if err := maputil.Create(ring); err != nil {
+		return nil, err
+	}
+	prog, err := goebpf.NewProgram(ProgramName, goebpf.ProgramTypeSocketFilter, "GPL", instructions(ring))
+	if err != nil {
+		ring.Close()
+		return nil, err
+	}
+	if err = prog.Load(); err != nil {
+		ring.Close()
+		return nil, err
+	}
+	reader, err := goebpf.NewRingBufReader(ring)
+	if err != nil {
+		prog.Close()
+		ring.Close()
+		return nil, err
+	}
+
+	return &Monitor{
+		ring:   ring,
+		prog:   prog,
+		reader: reader,
+		sock:   -1,
+	}, nil
+}
+
+// Program returns loaded socket filter program, e.g. to attach it to own socket
+// or to run it by goebpf.ProgramTestRun()
+func (m *Monitor) Program() goebpf.Program {
+	return m.prog
+}
+
+// Attach opens raw socket on interface ifname (all interfaces if empty)
+// and attaches program to it. Can be called once.
+func (m *Monitor) Attach(ifname string) error {
+	if m.sock != -1 {
+		return fmt.Errorf("Already attached")
+	}
+	protocol := int(htons(unix.ETH_P_ALL))
+	sock, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW|unix.SOCK_CLOEXEC, protocol)
+	if err != nil {
+		return fmt.Errorf("Unable to create raw socket: %v", err)
+	}
+	// Attach before binding, so no packets are queued to socket
+	err = m.prog.Attach(goebpf.SocketFilterAttachParams{
+		SocketFd:   sock,
+		AttachType: goebpf.SocketAttachTypeFilter,
+	})
+	if err != nil {
+		unix.Close(sock)
+		return err
+	}
+	if ifname != "" {
+		iface, err := net.InterfaceByName(ifname)
+		if err != nil {
+			unix.Close(sock)
+			return err
+		}
+		err = unix.Bind(sock, &unix.SockaddrLinklayer{Protocol: uint16(protocol), Ifindex: iface.Index})
+		if err != nil {
+			unix.Close(sock)
+			return fmt.Errorf("Unable to bind raw socket to '%s': %v", ifname, err)
+		}
+	}
+	m.sock = sock
+
+	return nil
+}
+
+// Read returns next DNS query, blocking until there is one.
+// Records which are not valid DNS queries are skipped, see Malformed().
+// Returns goebpf.ErrRingBufClosed once monitor is closed.
+func (m *Monitor) Read() (*Query, error) {
+	for {
+		record, err := m.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		q, err := ParseRecord(record)
+		if err != nil {
+			atomic.AddUint64(&m.malformed, 1)
+			continue
+		}
+		return q, nil
+	}
+}
+
+// Malformed returns number of records skipped by Read()
+func (m *Monitor) Malformed() uint64 {
+	return atomic.LoadUint64(&m.malformed)
+}
+
+// Close detaches program, interrupts pending Read() and frees all resources
+func (m *Monitor) Close() error {
+	if m.sock != -1 {
+		unix.Close(m.sock)
+		m.sock = -1
+	}
+	m.reader.Close()
+	m.prog.Close()
+	return m.ring.Close()
+}
+
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
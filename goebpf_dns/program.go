@@ -0,0 +1,152 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_dns
+
+import (
+	"github.com/dropbox/goebpf"
+)
+
+// Offsets of fields in packet / socket buffer
+const (
+	skbProtocolOff = 16 // struct __sk_buff, protocol
+	ipv4HeaderLen  = 20
+	ipv6HeaderLen  = 40
+	udpHeaderLen   = 8
+	ethTypeIPv4    = 0x0800
+	ethTypeIPv6    = 0x86dd
+	protoUDP       = 17
+	dnsPort        = 53
+	// BPF_HDR_START_NET: bpf_skb_load_bytes_relative() offsets are
+	// relative to network header, so program works with and without
+	// link layer header in socket buffer
+	hdrStartNet = 1
+)
+
+// Stack layout: record, IP header, UDP header
+const (
+	stackRecord = -recordSize
+	stackIP     = stackRecord - ipv6HeaderLen
+	stackUDP    = stackIP - udpHeaderLen
+)
+
+// Copies size bytes of packet at offset R2 (relative to network header) to stack
+func loadBytes(stackOff int16, size int32) goebpf.Instructions {
+	return goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R6),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, int32(stackOff)),
+		goebpf.Mov64Imm(goebpf.R4, size),
+		goebpf.Mov64Imm(goebpf.R5, hdrStartNet),
+		goebpf.Call(goebpf.HelperSkbLoadBytesRel),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R0, 0, "out"),
+	}
+}
+
+// Socket filter program: UDP packets to port 53 (IPv4 without options / IPv6
+// without extension headers) are copied into ring buffer as struct dns_event.
+// Socket itself never receives anything.
+func instructions(ring goebpf.Map) goebpf.Instructions {
+	// R6 = ctx, record is zeroed since it is passed to helper as a whole
+	insns := goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R6, goebpf.R1),
+	}
+	for off := 0; off < recordSize; off += 8 {
+		insns = append(insns, goebpf.StoreImm(goebpf.SizeDouble, goebpf.R10, int16(stackRecord+off), 0))
+	}
+	insns = append(insns,
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, skbProtocolOff),
+		goebpf.ToBigEndian(goebpf.R1, 16),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R1, ethTypeIPv4, "ipv4"),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R1, ethTypeIPv6, "ipv6"),
+		goebpf.Jump("out"),
+
+		// IPv4: R7 = UDP header offset, R8 = total length
+		goebpf.Mov64Imm(goebpf.R2, 0).WithLabel("ipv4"),
+	)
+	insns = append(insns, loadBytes(stackIP, ipv4HeaderLen)...)
+	insns = append(insns,
+		goebpf.LoadMem(goebpf.SizeByte, goebpf.R1, goebpf.R10, stackIP),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R1, 0x45, "out"),
+		goebpf.LoadMem(goebpf.SizeByte, goebpf.R1, goebpf.R10, stackIP+9),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R1, protoUDP, "out"),
+		// Fragments: only first one has UDP header, skip all of them
+		goebpf.LoadMem(goebpf.SizeHalf, goebpf.R1, goebpf.R10, stackIP+6),
+		goebpf.ToBigEndian(goebpf.R1, 16),
+		goebpf.Alu64Imm(goebpf.AluOpAnd, goebpf.R1, 0x3fff),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R1, 0, "out"),
+		goebpf.LoadMem(goebpf.SizeHalf, goebpf.R8, goebpf.R10, stackIP+2),
+		goebpf.ToBigEndian(goebpf.R8, 16),
+		goebpf.Mov64Imm(goebpf.R7, ipv4HeaderLen),
+		goebpf.StoreImm(goebpf.SizeByte, goebpf.R10, stackRecord+recordFamilyOff, 4),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R10, stackIP+12),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, stackRecord+recordSrcOff, goebpf.R1),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R10, stackIP+16),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, stackRecord+recordDstOff, goebpf.R1),
+		goebpf.Jump("udp"),
+
+		// IPv6
+		goebpf.Mov64Imm(goebpf.R2, 0).WithLabel("ipv6"),
+	)
+	insns = append(insns, loadBytes(stackIP, ipv6HeaderLen)...)
+	insns = append(insns,
+		goebpf.LoadMem(goebpf.SizeByte, goebpf.R1, goebpf.R10, stackIP+6),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R1, protoUDP, "out"),
+		goebpf.LoadMem(goebpf.SizeHalf, goebpf.R8, goebpf.R10, stackIP+4),
+		goebpf.ToBigEndian(goebpf.R8, 16),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R8, ipv6HeaderLen),
+		goebpf.Mov64Imm(goebpf.R7, ipv6HeaderLen),
+		goebpf.StoreImm(goebpf.SizeByte, goebpf.R10, stackRecord+recordFamilyOff, 6),
+	)
+	for off := 0; off < 16; off += 4 {
+		insns = append(insns,
+			goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R10, int16(stackIP+8+off)),
+			goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, int16(stackRecord+recordSrcOff+off), goebpf.R1),
+			goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R10, int16(stackIP+24+off)),
+			goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, int16(stackRecord+recordDstOff+off), goebpf.R1),
+		)
+	}
+
+	// UDP: destination port 53 only, ports are kept in network byte order
+	insns = append(insns, goebpf.Mov64Reg(goebpf.R2, goebpf.R7).WithLabel("udp"))
+	insns = append(insns, loadBytes(stackUDP, udpHeaderLen)...)
+	insns = append(insns,
+		goebpf.LoadMem(goebpf.SizeHalf, goebpf.R1, goebpf.R10, stackUDP+2),
+		goebpf.ToBigEndian(goebpf.R1, 16),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R1, dnsPort, "out"),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R10, stackUDP),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, stackRecord+recordSportOff, goebpf.R1),
+
+		// R9 = length of DNS message, captured up to 256 bytes
+		goebpf.Mov64Reg(goebpf.R9, goebpf.R8),
+		goebpf.Alu64Reg(goebpf.AluOpSub, goebpf.R9, goebpf.R7),
+		goebpf.Alu64Imm(goebpf.AluOpSub, goebpf.R9, udpHeaderLen),
+		goebpf.JumpImm(goebpf.JumpOpSLt, goebpf.R9, dnsHeaderLen, "out"),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, stackRecord+recordLenOff, goebpf.R9),
+		goebpf.JumpImm(goebpf.JumpOpLe, goebpf.R9, maxCaptureLen, "copy"),
+		goebpf.Mov64Imm(goebpf.R9, maxCaptureLen),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R7).WithLabel("copy"),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, udpHeaderLen),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R6),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, stackRecord+recordDNSOff),
+		goebpf.Mov64Reg(goebpf.R4, goebpf.R9),
+		goebpf.Mov64Imm(goebpf.R5, hdrStartNet),
+		goebpf.Call(goebpf.HelperSkbLoadBytesRel),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R0, 0, "out"),
+
+		goebpf.Call(goebpf.HelperKtimeGetNs),
+		goebpf.StoreMem(goebpf.SizeDouble, goebpf.R10, stackRecord+recordTimeOff, goebpf.R0),
+		goebpf.LoadMapFd(goebpf.R1, ring),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackRecord),
+		goebpf.Mov64Imm(goebpf.R3, recordSize),
+		goebpf.Mov64Imm(goebpf.R4, 0),
+		goebpf.Call(goebpf.HelperRingbufOutput),
+
+		goebpf.Mov64Imm(goebpf.R0, 0).WithLabel("out"),
+		goebpf.Exit(),
+	)
+
+	return insns
+}
@@ -0,0 +1,185 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_dns
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/dropbox/goebpf"
+)
+
+// QueryType is type of DNS query (QTYPE), see RFC 1035
+type QueryType uint16
+
+const (
+	TypeA     QueryType = 1
+	TypeNS    QueryType = 2
+	TypeCNAME QueryType = 5
+	TypeSOA   QueryType = 6
+	TypePTR   QueryType = 12
+	TypeMX    QueryType = 15
+	TypeTXT   QueryType = 16
+	TypeAAAA  QueryType = 28
+	TypeSRV   QueryType = 33
+	TypeSVCB  QueryType = 64
+	TypeHTTPS QueryType = 65
+	TypeANY   QueryType = 255
+)
+
+func (t QueryType) String() string {
+	switch t {
+	case TypeA:
+		return "A"
+	case TypeNS:
+		return "NS"
+	case TypeCNAME:
+		return "CNAME"
+	case TypeSOA:
+		return "SOA"
+	case TypePTR:
+		return "PTR"
+	case TypeMX:
+		return "MX"
+	case TypeTXT:
+		return "TXT"
+	case TypeAAAA:
+		return "AAAA"
+	case TypeSRV:
+		return "SRV"
+	case TypeSVCB:
+		return "SVCB"
+	case TypeHTTPS:
+		return "HTTPS"
+	case TypeANY:
+		return "ANY"
+	}
+
+	return fmt.Sprintf("TYPE%d", uint16(t))
+}
+
+// Record program puts into ring buffer:
+//
+//	struct dns_event {
+//		__u64 ktime;       // bpf_ktime_get_ns()
+//		__u32 dns_len;     // length of DNS message, may be more than captured
+//		__u8  family;      // 4 or 6
+//		__u8  pad[3];
+//		__u8  saddr[16];   // IPv4 address takes first 4 bytes
+//		__u8  daddr[16];
+//		__be16 sport;
+//		__be16 dport;
+//		__u8  pad2[4];
+//		__u8  dns[256];    // beginning of DNS message
+//	};
+const (
+	recordTimeOff   = 0
+	recordLenOff    = 8
+	recordFamilyOff = 12
+	recordSrcOff    = 16
+	recordDstOff    = 32
+	recordSportOff  = 48
+	recordDportOff  = 50
+	recordDNSOff    = 56
+	maxCaptureLen   = 256
+	recordSize      = recordDNSOff + maxCaptureLen
+)
+
+// DNS message limits, see RFC 1035
+const (
+	dnsHeaderLen = 12
+	maxLabelLen  = 63
+	maxNameLen   = 255
+)
+
+// ParseRecord decodes record of ring buffer into query
+func ParseRecord(record []byte) (*Query, error) {
+	if len(record) < recordSize {
+		return nil, fmt.Errorf("Invalid record size %d, must be at least %d", len(record), recordSize)
+	}
+	dnsLen := int(goebpf.HostByteOrder().Uint32(record[recordLenOff:]))
+	if dnsLen > maxCaptureLen {
+		dnsLen = maxCaptureLen
+	}
+	q, err := ParseQuery(record[recordDNSOff : recordDNSOff+dnsLen])
+	if err != nil {
+		return nil, err
+	}
+
+	addrLen := net.IPv6len
+	switch record[recordFamilyOff] {
+	case 4:
+		addrLen = net.IPv4len
+	case 6:
+	default:
+		return nil, fmt.Errorf("Invalid address family %d", record[recordFamilyOff])
+	}
+	q.Time = goebpf.KtimeToTime(goebpf.HostByteOrder().Uint64(record[recordTimeOff:]))
+	q.Src = net.IP(append([]byte(nil), record[recordSrcOff:recordSrcOff+addrLen]...))
+	q.Dst = net.IP(append([]byte(nil), record[recordDstOff:recordDstOff+addrLen]...))
+	q.SrcPort = binary.BigEndian.Uint16(record[recordSportOff:])
+	q.DstPort = binary.BigEndian.Uint16(record[recordDportOff:])
+
+	return q, nil
+}
+
+// ParseQuery decodes ID and the (first) question of DNS query message msg.
+// Message may be truncated right after the question. Responses and names
+// with compression pointers are rejected.
+func ParseQuery(msg []byte) (*Query, error) {
+	if len(msg) < dnsHeaderLen {
+		return nil, errors.New("DNS message is too short")
+	}
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x8000 != 0 {
+		return nil, errors.New("DNS message is response")
+	}
+	if binary.BigEndian.Uint16(msg[4:]) == 0 {
+		return nil, errors.New("DNS message has no questions")
+	}
+
+	var labels []string
+	nameLen := 0
+	pos := dnsHeaderLen
+	for {
+		if pos >= len(msg) {
+			return nil, errors.New("DNS question is truncated")
+		}
+		l := int(msg[pos])
+		pos++
+		if l == 0 {
+			break
+		}
+		if l > maxLabelLen {
+			// Includes compression pointers (top bits set)
+			return nil, fmt.Errorf("Invalid DNS label length %d", l)
+		}
+		if pos+l > len(msg) {
+			return nil, errors.New("DNS question is truncated")
+		}
+		nameLen += l + 1
+		if nameLen > maxNameLen {
+			return nil, errors.New("DNS name is too long")
+		}
+		labels = append(labels, string(msg[pos:pos+l]))
+		pos += l
+	}
+	if pos+4 > len(msg) {
+		return nil, errors.New("DNS question is truncated")
+	}
+
+	name := strings.Join(labels, ".")
+	if name == "" {
+		name = "."
+	}
+	return &Query{
+		ID:    binary.BigEndian.Uint16(msg),
+		Name:  name,
+		Type:  QueryType(binary.BigEndian.Uint16(msg[pos:])),
+		Class: binary.BigEndian.Uint16(msg[pos+2:]),
+	}, nil
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_dns
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Builds DNS query message with single question
+func dnsQuery(id uint16, name string, qtype QueryType) []byte {
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg, id)
+	binary.BigEndian.PutUint16(msg[2:], 0x0100) // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(strings.Trim(name, "."), ".") {
+		if label != "" {
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	return msg
+}
+
+func TestParseQuery(t *testing.T) {
+	q, err := ParseQuery(dnsQuery(0x1234, "www.example.com", TypeAAAA))
+	require.NoError(t, err)
+	assert.Equal(t, uint16(0x1234), q.ID)
+	assert.Equal(t, "www.example.com", q.Name)
+	assert.Equal(t, TypeAAAA, q.Type)
+	assert.Equal(t, "AAAA", q.Type.String())
+	assert.Equal(t, uint16(1), q.Class)
+
+	q, err = ParseQuery(dnsQuery(1, ".", TypeNS))
+	require.NoError(t, err)
+	assert.Equal(t, ".", q.Name)
+
+	// Bad messages
+	valid := dnsQuery(1, "example.com", TypeA)
+	response := append([]byte(nil), valid...)
+	response[2] |= 0x80
+	noQuestions := append([]byte(nil), valid...)
+	noQuestions[5] = 0
+	compressed := append(append([]byte(nil), valid[:dnsHeaderLen]...), 0xc0, 0x0c, 0, 1, 0, 1)
+	longName := dnsQuery(1, strings.Repeat(strings.Repeat("a", 63)+".", 4), TypeA)
+	longLabel := dnsQuery(1, strings.Repeat("a", 64), TypeA)
+	for _, msg := range [][]byte{
+		nil,
+		valid[:dnsHeaderLen],
+		valid[:len(valid)-1],
+		response,
+		noQuestions,
+		compressed,
+		longName,
+		longLabel,
+	} {
+		_, err = ParseQuery(msg)
+		assert.Error(t, err)
+	}
+}
+
+func TestQueryTypeString(t *testing.T) {
+	assert.Equal(t, "A", TypeA.String())
+	assert.Equal(t, "HTTPS", TypeHTTPS.String())
+	assert.Equal(t, "TYPE99", QueryType(99).String())
+}
+
+func TestParseRecord(t *testing.T) {
+	now := time.Now()
+	msg := dnsQuery(7, "example.com", TypeMX)
+	record := make([]byte, recordSize)
+	goebpf.HostByteOrder().PutUint64(record[recordTimeOff:], uint64(now.Sub(goebpf.KtimeToTime(0))))
+	goebpf.HostByteOrder().PutUint32(record[recordLenOff:], uint32(len(msg)))
+	record[recordFamilyOff] = 4
+	copy(record[recordSrcOff:], []byte{10, 0, 0, 1})
+	copy(record[recordDstOff:], []byte{10, 0, 0, 53})
+	binary.BigEndian.PutUint16(record[recordSportOff:], 40000)
+	binary.BigEndian.PutUint16(record[recordDportOff:], 53)
+	copy(record[recordDNSOff:], msg)
+
+	q, err := ParseRecord(record)
+	require.NoError(t, err)
+	assert.WithinDuration(t, now, q.Time, time.Millisecond)
+	assert.Equal(t, "10.0.0.1", q.Src.String())
+	assert.Equal(t, "10.0.0.53", q.Dst.String())
+	assert.Equal(t, uint16(40000), q.SrcPort)
+	assert.Equal(t, uint16(53), q.DstPort)
+	assert.Equal(t, "example.com", q.Name)
+	assert.Equal(t, TypeMX, q.Type)
+
+	// Messages longer than captured part are fine while question fits
+	goebpf.HostByteOrder().PutUint32(record[recordLenOff:], 1400)
+	_, err = ParseRecord(record)
+	assert.NoError(t, err)
+
+	record[recordFamilyOff] = 5
+	_, err = ParseRecord(record)
+	assert.Error(t, err)
+	_, err = ParseRecord(record[:recordSize-1])
+	assert.Error(t, err)
+}
@@ -0,0 +1,374 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_encap is reference lightweight tunnel programs for SRv6 /
+// GENEVE / VXLAN encapsulation decisions made in BPF, along with Go API
+// managing their policy maps:
+//
+//   - LwtXmit program encapsulates packets routed through it according to
+//     tunnel policy of their destination (longest prefix match): SRv6 segments
+//     list or GENEVE / VXLAN tunnel endpoint. Packets without policy pass as is.
+//   - LwtSeg6Local (End.BPF) program applies action (End.X / End.T / End.DT6)
+//     to SRv6 packets reaching its SID, chosen by tag of segment routing header.
+//
+// Programs are attached by routes:
+//
+//	m, err := goebpf_encap.New(goebpf_encap.DefaultMaxPolicies, goebpf_encap.DefaultMaxActions)
+//	...
+//	defer m.Close()
+//	_, dst, _ := net.ParseCIDR("192.168.0.0/16")
+//	err = m.SetTunnel(*dst, &goebpf_encap.Geneve{
+//		Source: net.ParseIP("10.0.0.1"),
+//		Remote: net.ParseIP("10.0.0.2"),
+//		VNI:    42,
+//	})
+//	err = m.XmitProgram().Attach(goebpf.LwtAttachParams{
+//		Dst:      "192.168.0.0/16",
+//		Device:   "eth0",
+//		Headroom: goebpf_encap.MaxHeaderSize,
+//	})
+//
+//	err = m.SetAction(7, goebpf_encap.Seg6Action{Action: goebpf_encap.ActionEndDT6, Table: 100})
+//	err = m.Seg6LocalProgram().Attach(goebpf.LwtAttachParams{Dst: "fc00::1/128", Device: "eth0"})
+//
+// Outer UDP headers have zero checksum: IPv6 receivers must allow it
+// (e.g. udp6zerocsumrx option of Linux GENEVE / VXLAN devices). Segmentation
+// offload (GSO) packets can be encapsulated into UDP tunnels only, so devices
+// routing TCP into SRv6 tunnels should have GSO disabled.
+package goebpf_encap
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/dropbox/goebpf"
+)
+
+const (
+	// DefaultMaxPolicies / DefaultMaxActions are reasonable capacities of maps created by New()
+	DefaultMaxPolicies = 1024
+	DefaultMaxActions  = 256
+	// MaxHeaderSize is maximum size of headers pushed by LwtXmit program
+	MaxHeaderSize = 112
+	// MaxSegments is maximum length of SRv6 segments list
+	MaxSegments = (MaxHeaderSize - ipv6HeaderSize - srhSize) / 16
+
+	// Names of maps / programs
+	PoliciesMapName      = "encap_policies"
+	ActionsMapName       = "encap_actions"
+	XmitProgramName      = "encap_xmit"
+	Seg6LocalProgramName = "encap_seg6local"
+
+	// Policies map is LPM trie of destinations: key is struct encap_key,
+	// value is struct encap_policy.
+	//
+	//	struct encap_key {
+	//		__u32 prefixlen;
+	//		__u8  addr[16];  // IPv4 addresses are IPv4-mapped IPv6 ones
+	//	};
+	//	struct encap_policy {
+	//		__u8  outer;     // version of outer IP header: 4 or 6
+	//		__u8  udp;       // outer IP header is followed by UDP one
+	//		__u16 len;       // length of headers
+	//		__u32 pad;
+	//		__u8  hdr[112];  // headers, lengths / UDP source port are filled by program
+	//	};
+	policyKeySize   = 20
+	policyValueSize = 8 + MaxHeaderSize
+
+	// Actions map is hash of SRH tags: key is __u32 tag, value is struct encap_action.
+	//
+	//	struct encap_action {
+	//		__u32 action;     // SEG6_LOCAL_ACTION_*
+	//		__u32 table;      // End.T / End.DT6
+	//		__u8  nexthop[16]; // End.X
+	//	};
+	actionKeySize   = 4
+	actionValueSize = 24
+)
+
+// Offsets of fields of struct encap_key / struct encap_policy / struct encap_action
+const (
+	keyPrefixLen = 0
+	keyAddr      = 4
+
+	policyOuter  = 0
+	policyUDP    = 1
+	policyLen    = 2
+	policyHeader = 8
+
+	actionAction  = 0
+	actionTable   = 4
+	actionNexthop = 8
+)
+
+// Well known UDP ports of tunnels
+const (
+	GenevePort = 6081
+	VXLANPort  = 4789
+)
+
+// Header sizes / fields, IPPROTO_* / ETH_P_* values
+const (
+	ipv4HeaderSize   = 20
+	ipv6HeaderSize   = 40
+	udpHeaderSize    = 8
+	srhSize          = 8
+	tunnelHeaderSize = 8
+	ethHeaderSize    = 14
+
+	protoIPIP    = 4
+	protoUDP     = 17
+	protoIPv6    = 41
+	protoRouting = 43
+	srhTypeSRv6  = 4
+
+	ethPIPv4 = 0x0800
+	ethPIPv6 = 0x86dd
+
+	defaultTTL = 64
+)
+
+// Tunnel is encapsulation of packets matching policy: *SRv6, *Geneve or *VXLAN
+type Tunnel interface {
+	// Outer headers for inner packets of given IP version, whether they end with UDP header
+	headers(innerIPv6 bool) ([]byte, bool, error)
+}
+
+// SRv6 is IPv6 encapsulation with segment routing header (T.Encaps)
+type SRv6 struct {
+	// Source address of outer IPv6 header
+	Source net.IP
+	// Segments packet visits, in order, at most MaxSegments
+	Segments []net.IP
+	// Tag of segment routing header, Seg6LocalProgram() picks action by it
+	Tag uint16
+}
+
+// Geneve is GENEVE (RFC 8926) encapsulation, inner IP packet is carried as is
+type Geneve struct {
+	// Local / remote tunnel endpoints, both IPv4 or both IPv6
+	Source net.IP
+	Remote net.IP
+	// Virtual network identifier, 24 bits
+	VNI uint32
+	// Destination UDP port, zero means GenevePort
+	Port int
+}
+
+// VXLAN is VXLAN (RFC 7348) encapsulation. VXLAN carries Ethernet frames,
+// so inner IP packet gets Ethernet header with given addresses.
+type VXLAN struct {
+	// Local / remote tunnel endpoints, both IPv4 or both IPv6
+	Source net.IP
+	Remote net.IP
+	// Virtual network identifier, 24 bits
+	VNI uint32
+	// Destination UDP port, zero means VXLANPort
+	Port int
+	// Addresses of inner Ethernet header
+	InnerSource      net.HardwareAddr
+	InnerDestination net.HardwareAddr
+}
+
+func (t *SRv6) headers(innerIPv6 bool) ([]byte, bool, error) {
+	if len(t.Segments) == 0 || len(t.Segments) > MaxSegments {
+		return nil, false, fmt.Errorf("Invalid number of segments %d, must be 1..%d", len(t.Segments), MaxSegments)
+	}
+	src := t.Source.To16()
+	if src == nil || t.Source.To4() != nil {
+		return nil, false, fmt.Errorf("Invalid SRv6 source address '%v'", t.Source)
+	}
+	next := byte(protoIPIP)
+	if innerIPv6 {
+		next = protoIPv6
+	}
+	// Segments list is in reverse order, the first segment is destination
+	srh := []byte{
+		next,
+		byte(2 * len(t.Segments)),
+		srhTypeSRv6,
+		byte(len(t.Segments) - 1),
+		byte(len(t.Segments) - 1),
+		0,
+		byte(t.Tag >> 8), byte(t.Tag),
+	}
+	for i := len(t.Segments) - 1; i >= 0; i-- {
+		segment := t.Segments[i].To16()
+		if segment == nil || t.Segments[i].To4() != nil {
+			return nil, false, fmt.Errorf("Invalid segment '%v'", t.Segments[i])
+		}
+		srh = append(srh, segment...)
+	}
+
+	return append(ipv6Header(src, t.Segments[0].To16(), protoRouting), srh...), false, nil
+}
+
+func (t *Geneve) headers(innerIPv6 bool) ([]byte, bool, error) {
+	protocol := uint16(ethPIPv4)
+	if innerIPv6 {
+		protocol = ethPIPv6
+	}
+	// Version 0, no options, not OAM / critical
+	geneve := []byte{0, 0, byte(protocol >> 8), byte(protocol), 0, 0, 0, 0}
+	hdr, err := udpTunnelHeaders(t.Source, t.Remote, t.Port, GenevePort, t.VNI, geneve)
+	return hdr, true, err
+}
+
+func (t *VXLAN) headers(innerIPv6 bool) ([]byte, bool, error) {
+	if len(t.InnerSource) != 6 || len(t.InnerDestination) != 6 {
+		return nil, false, errors.New("Inner Ethernet addresses are required")
+	}
+	protocol := uint16(ethPIPv4)
+	if innerIPv6 {
+		protocol = ethPIPv6
+	}
+	// Valid VNI flag
+	vxlan := []byte{0x08, 0, 0, 0, 0, 0, 0, 0}
+	vxlan = append(vxlan, t.InnerDestination...)
+	vxlan = append(vxlan, t.InnerSource...)
+	vxlan = append(vxlan, byte(protocol>>8), byte(protocol))
+	hdr, err := udpTunnelHeaders(t.Source, t.Remote, t.Port, VXLANPort, t.VNI, vxlan)
+	return hdr, true, err
+}
+
+// Outer IP / UDP headers followed by tunnel header, VNI goes to bytes 4..6 of it
+func udpTunnelHeaders(src, dst net.IP, port, defaultPort int, vni uint32, tunnel []byte) ([]byte, error) {
+	if vni >= 1<<24 {
+		return nil, fmt.Errorf("Invalid VNI %d, must be 24 bits", vni)
+	}
+	if port == 0 {
+		port = defaultPort
+	}
+	if port < 1 || port > 65535 {
+		return nil, fmt.Errorf("Invalid port %d", port)
+	}
+	tunnel[4], tunnel[5], tunnel[6] = byte(vni>>16), byte(vni>>8), byte(vni)
+	// Source port is set by program, from flow hash; length / checksum are zero
+	udp := []byte{0, 0, byte(port >> 8), byte(port), 0, 0, 0, 0}
+	udp = append(udp, tunnel...)
+
+	switch {
+	case src.To4() != nil && dst.To4() != nil:
+		return append(ipv4Header(src.To4(), dst.To4(), protoUDP), udp...), nil
+	case src.To4() == nil && dst.To4() == nil && src.To16() != nil && dst.To16() != nil:
+		return append(ipv6Header(src.To16(), dst.To16(), protoUDP), udp...), nil
+	}
+
+	return nil, fmt.Errorf("Invalid tunnel endpoints '%v' -> '%v'", src, dst)
+}
+
+// IPv4 header without options, total length is set by program,
+// checksum is calculated by kernel
+func ipv4Header(src, dst net.IP, protocol byte) []byte {
+	hdr := []byte{0x45, 0, 0, 0, 0, 0, 0x40, 0, defaultTTL, protocol, 0, 0}
+	hdr = append(hdr, src...)
+	return append(hdr, dst...)
+}
+
+// IPv6 header, payload length is set by program
+func ipv6Header(src, dst net.IP, next byte) []byte {
+	hdr := []byte{0x60, 0, 0, 0, 0, 0, next, defaultTTL}
+	hdr = append(hdr, src...)
+	return append(hdr, dst...)
+}
+
+// Encodes destination prefix into key of policies map
+func policyKey(dst net.IPNet) ([]byte, error) {
+	ones, bits := dst.Mask.Size()
+	switch {
+	case bits == 32 && dst.IP.To4() != nil:
+		// IPv4-mapped IPv6 address: ::ffff:a.b.c.d
+		ones += 96
+	case bits == 128 && dst.IP.To4() == nil && dst.IP.To16() != nil:
+	default:
+		return nil, fmt.Errorf("Invalid destination '%s'", dst.String())
+	}
+	key := make([]byte, policyKeySize)
+	goebpf.HostByteOrder().PutUint32(key[keyPrefixLen:], uint32(ones))
+	copy(key[keyAddr:], dst.IP.Mask(dst.Mask).To16())
+
+	return key, nil
+}
+
+// Encodes tunnel of packets to dst into value of policies map
+func policyValue(dst net.IPNet, t Tunnel) ([]byte, error) {
+	if t == nil {
+		return nil, errors.New("nil tunnel")
+	}
+	hdr, udp, err := t.headers(dst.IP.To4() == nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(hdr) > MaxHeaderSize {
+		return nil, fmt.Errorf("Headers are too long: %d bytes", len(hdr))
+	}
+	value := make([]byte, policyValueSize)
+	value[policyOuter] = hdr[0] >> 4
+	if udp {
+		value[policyUDP] = 1
+	}
+	goebpf.HostByteOrder().PutUint16(value[policyLen:], uint16(len(hdr)))
+	copy(value[policyHeader:], hdr)
+
+	return value, nil
+}
+
+// Seg6ActionType is SRv6 behavior of End.BPF program, SEG6_LOCAL_ACTION_* value
+type Seg6ActionType int
+
+// Must be in sync with SEG6_LOCAL_ACTION_* of <linux/seg6_local.h>
+const (
+	// Forward to next segment via Nexthop
+	ActionEndX Seg6ActionType = 2
+	// Lookup of next segment in Table
+	ActionEndT Seg6ActionType = 3
+	// Decapsulate, lookup of inner IPv6 packet in Table
+	ActionEndDT6 Seg6ActionType = 7
+)
+
+func (a Seg6ActionType) String() string {
+	switch a {
+	case ActionEndX:
+		return "End.X"
+	case ActionEndT:
+		return "End.T"
+	case ActionEndDT6:
+		return "End.DT6"
+	}
+
+	return "unknown"
+}
+
+// Seg6Action is what Seg6LocalProgram() does with packets of SRH tag
+type Seg6Action struct {
+	Action Seg6ActionType
+	// IPv6 next hop of End.X
+	Nexthop net.IP
+	// Routing table of End.T / End.DT6
+	Table int
+}
+
+// Encodes action into value of actions map
+func actionValue(a Seg6Action) ([]byte, error) {
+	value := make([]byte, actionValueSize)
+	bo := goebpf.HostByteOrder()
+	switch a.Action {
+	case ActionEndX:
+		if a.Nexthop.To16() == nil || a.Nexthop.To4() != nil {
+			return nil, fmt.Errorf("Invalid %v next hop '%v'", a.Action, a.Nexthop)
+		}
+		copy(value[actionNexthop:], a.Nexthop.To16())
+	case ActionEndT, ActionEndDT6:
+		if a.Table <= 0 {
+			return nil, fmt.Errorf("Invalid %v table %d", a.Action, a.Table)
+		}
+		bo.PutUint32(value[actionTable:], uint32(a.Table))
+	default:
+		return nil, fmt.Errorf("Unsupported action %d", a.Action)
+	}
+	bo.PutUint32(value[actionAction:], uint32(a.Action))
+
+	return value, nil
+}
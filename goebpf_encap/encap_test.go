@@ -0,0 +1,184 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_encap
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_fake"
+)
+
+func mustPrefix(s string) net.IPNet {
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return *prefix
+}
+
+func TestPolicyKey(t *testing.T) {
+	bo := goebpf.HostByteOrder()
+
+	key, err := policyKey(mustPrefix("192.168.1.7/24"))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(96+24), bo.Uint32(key[keyPrefixLen:]))
+	assert.Equal(t, []byte(net.ParseIP("192.168.1.0").To16()), key[keyAddr:])
+
+	key, err = policyKey(mustPrefix("2001:db8::/32"))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(32), bo.Uint32(key[keyPrefixLen:]))
+	assert.Equal(t, []byte(net.ParseIP("2001:db8::")), key[keyAddr:])
+
+	_, err = policyKey(net.IPNet{})
+	assert.Error(t, err)
+}
+
+func TestSRv6(t *testing.T) {
+	tunnel := &SRv6{
+		Source:   net.ParseIP("fc00::100"),
+		Segments: []net.IP{net.ParseIP("fc00::1"), net.ParseIP("fc00::2")},
+		Tag:      0x1234,
+	}
+	value, err := policyValue(mustPrefix("10.0.0.0/8"), tunnel)
+	require.NoError(t, err)
+	assert.Equal(t, byte(6), value[policyOuter])
+	assert.Equal(t, byte(0), value[policyUDP])
+	assert.Equal(t, uint16(ipv6HeaderSize+srhSize+32), goebpf.HostByteOrder().Uint16(value[policyLen:]))
+
+	hdr := value[policyHeader:]
+	assert.Equal(t, byte(protoRouting), hdr[6])
+	assert.Equal(t, []byte(net.ParseIP("fc00::100")), hdr[8:24])
+	// Destination is the first segment
+	assert.Equal(t, []byte(net.ParseIP("fc00::1")), hdr[24:40])
+	srh := hdr[ipv6HeaderSize:]
+	assert.Equal(t, []byte{protoIPIP, 4, srhTypeSRv6, 1, 1, 0, 0x12, 0x34}, srh[:srhSize])
+	// Segments are listed in reverse order
+	assert.Equal(t, []byte(net.ParseIP("fc00::2")), srh[8:24])
+	assert.Equal(t, []byte(net.ParseIP("fc00::1")), srh[24:40])
+
+	// Inner IPv6
+	value, err = policyValue(mustPrefix("2001:db8::/32"), tunnel)
+	require.NoError(t, err)
+	assert.Equal(t, byte(protoIPv6), value[policyHeader+ipv6HeaderSize])
+
+	invalid := []*SRv6{
+		{Source: net.ParseIP("fc00::100")},
+		{Source: net.ParseIP("10.0.0.1"), Segments: []net.IP{net.ParseIP("fc00::1")}},
+		{Source: net.ParseIP("fc00::100"), Segments: []net.IP{net.ParseIP("10.0.0.1")}},
+		{Source: net.ParseIP("fc00::100"), Segments: make([]net.IP, MaxSegments+1)},
+	}
+	for _, tunnel := range invalid {
+		_, err = policyValue(mustPrefix("10.0.0.0/8"), tunnel)
+		assert.Error(t, err)
+	}
+}
+
+func TestGeneve(t *testing.T) {
+	value, err := policyValue(mustPrefix("10.0.0.0/8"), &Geneve{
+		Source: net.ParseIP("192.0.2.1"),
+		Remote: net.ParseIP("192.0.2.2"),
+		VNI:    0x123456,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, byte(4), value[policyOuter])
+	assert.Equal(t, byte(1), value[policyUDP])
+	assert.Equal(t, uint16(ipv4HeaderSize+udpHeaderSize+tunnelHeaderSize), goebpf.HostByteOrder().Uint16(value[policyLen:]))
+
+	hdr := value[policyHeader:]
+	assert.Equal(t, []byte{0x45, 0, 0, 0, 0, 0, 0x40, 0, defaultTTL, protoUDP, 0, 0, 192, 0, 2, 1, 192, 0, 2, 2}, hdr[:ipv4HeaderSize])
+	assert.Equal(t, []byte{0, 0, 0x17, 0xc1, 0, 0, 0, 0}, hdr[20:28])
+	assert.Equal(t, []byte{0, 0, 0x08, 0x00, 0x12, 0x34, 0x56, 0}, hdr[28:36])
+
+	// IPv6 endpoints, inner IPv6, custom port
+	value, err = policyValue(mustPrefix("2001:db8::/32"), &Geneve{
+		Source: net.ParseIP("fc00::1"),
+		Remote: net.ParseIP("fc00::2"),
+		Port:   10000,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, byte(6), value[policyOuter])
+	hdr = value[policyHeader:]
+	assert.Equal(t, byte(protoUDP), hdr[6])
+	assert.Equal(t, []byte{0x27, 0x10}, hdr[42:44])
+	assert.Equal(t, []byte{0x86, 0xdd}, hdr[50:52])
+
+	invalid := []*Geneve{
+		{Source: net.ParseIP("192.0.2.1"), Remote: net.ParseIP("fc00::2")},
+		{Source: net.ParseIP("192.0.2.1"), Remote: net.ParseIP("192.0.2.2"), VNI: 1 << 24},
+		{Source: net.ParseIP("192.0.2.1"), Remote: net.ParseIP("192.0.2.2"), Port: 70000},
+	}
+	for _, tunnel := range invalid {
+		_, err = policyValue(mustPrefix("10.0.0.0/8"), tunnel)
+		assert.Error(t, err)
+	}
+}
+
+func TestVXLAN(t *testing.T) {
+	src, _ := net.ParseMAC("02:00:00:00:00:01")
+	dst, _ := net.ParseMAC("02:00:00:00:00:02")
+	value, err := policyValue(mustPrefix("10.0.0.0/8"), &VXLAN{
+		Source:           net.ParseIP("192.0.2.1"),
+		Remote:           net.ParseIP("192.0.2.2"),
+		VNI:              7,
+		InnerSource:      src,
+		InnerDestination: dst,
+	})
+	require.NoError(t, err)
+	hdr := value[policyHeader:]
+	assert.Equal(t, uint16(ipv4HeaderSize+udpHeaderSize+tunnelHeaderSize+ethHeaderSize), goebpf.HostByteOrder().Uint16(value[policyLen:]))
+	assert.Equal(t, []byte{0x12, 0xb5}, hdr[22:24])
+	assert.Equal(t, []byte{0x08, 0, 0, 0, 0, 0, 7, 0}, hdr[28:36])
+	assert.Equal(t, []byte(dst), hdr[36:42])
+	assert.Equal(t, []byte(src), hdr[42:48])
+	assert.Equal(t, []byte{0x08, 0x00}, hdr[48:50])
+
+	_, err = policyValue(mustPrefix("10.0.0.0/8"), &VXLAN{
+		Source: net.ParseIP("192.0.2.1"),
+		Remote: net.ParseIP("192.0.2.2"),
+	})
+	assert.Error(t, err)
+	_, err = policyValue(mustPrefix("10.0.0.0/8"), nil)
+	assert.Error(t, err)
+}
+
+func TestActionValue(t *testing.T) {
+	bo := goebpf.HostByteOrder()
+
+	value, err := actionValue(Seg6Action{Action: ActionEndX, Nexthop: net.ParseIP("fe80::1")})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(ActionEndX), bo.Uint32(value[actionAction:]))
+	assert.Equal(t, []byte(net.ParseIP("fe80::1")), value[actionNexthop:])
+
+	value, err = actionValue(Seg6Action{Action: ActionEndDT6, Table: 100})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(ActionEndDT6), bo.Uint32(value[actionAction:]))
+	assert.Equal(t, uint32(100), bo.Uint32(value[actionTable:]))
+
+	invalid := []Seg6Action{
+		{Action: ActionEndX, Nexthop: net.ParseIP("10.0.0.1")},
+		{Action: ActionEndT},
+		{Action: 1, Table: 100},
+	}
+	for _, a := range invalid {
+		_, err = actionValue(a)
+		assert.Error(t, err, a.Action.String())
+	}
+}
+
+func TestPrograms(t *testing.T) {
+	policies := goebpf_fake.NewFakeMap(PoliciesMapName, goebpf.MapTypeLPMTrie, policyKeySize, policyValueSize, 16)
+	prog, err := goebpf.NewProgram(XmitProgramName, goebpf.ProgramTypeLwtXmit, "GPL", xmitInstructions(policies))
+	require.NoError(t, err)
+	assert.Equal(t, goebpf.ProgramTypeLwtXmit, prog.GetType())
+
+	actions := goebpf_fake.NewFakeMap(ActionsMapName, goebpf.MapTypeHash, actionKeySize, actionValueSize, 16)
+	prog, err = goebpf.NewProgram(Seg6LocalProgramName, goebpf.ProgramTypeLwtSeg6Local, "GPL", seg6LocalInstructions(actions))
+	require.NoError(t, err)
+	assert.Equal(t, goebpf.ProgramTypeLwtSeg6Local, prog.GetType())
+}
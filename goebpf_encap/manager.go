@@ -0,0 +1,130 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_encap
+
+import (
+	"net"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/internal/maputil"
+)
+
+// Manager holds policy maps and programs using them
+type Manager struct {
+	policies  *goebpf.EbpfMap
+	actions   *goebpf.EbpfMap
+	xmit      goebpf.Program
+	seg6local goebpf.Program
+}
+
+// New creates maps able to hold maxPolicies tunnel policies / maxActions
+// SRv6 actions and loads programs using them.
+// Programs are not attached yet, see XmitProgram() / Seg6LocalProgram().
+func New(maxPolicies, maxActions int) (*Manager, error) {
+	m := &Manager{
+		policies: &goebpf.EbpfMap{
+			Name:       PoliciesMapName,
+			Type:       goebpf.MapTypeLPMTrie,
+			KeySize:    policyKeySize,
+			ValueSize:  policyValueSize,
+			MaxEntries: maxPolicies,
+		},
+		actions: &goebpf.EbpfMap{
+			Name:       ActionsMapName,
+			Type:       goebpf.MapTypeHash,
+			KeySize:    actionKeySize,
+			ValueSize:  actionValueSize,
+			MaxEntries: maxActions,
+		},
+	}
+	if err := maputil.Create(m.policies, m.actions); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if m.xmit, err = load(XmitProgramName, goebpf.ProgramTypeLwtXmit, xmitInstructions(m.policies)); err != nil {
+		m.Close()
+		return nil, err
+	}
+	if m.seg6local, err = load(Seg6LocalProgramName, goebpf.ProgramTypeLwtSeg6Local, seg6LocalInstructions(m.actions)); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+func load(name string, progType goebpf.ProgramType, insns goebpf.Instructions) (goebpf.Program, error) {
+	prog, err := goebpf.NewProgram(name, progType, "GPL", insns)
+	if err != nil {
+		return nil, err
+	}
+	if err = prog.Load(); err != nil {
+		return nil, err
+	}
+
+	return prog, nil
+}
+
+// XmitProgram returns loaded LwtXmit program encapsulating packets,
+// to be attached with goebpf.LwtAttachParams (Headroom of MaxHeaderSize recommended)
+func (m *Manager) XmitProgram() goebpf.Program {
+	return m.xmit
+}
+
+// Seg6LocalProgram returns loaded LwtSeg6Local (End.BPF) program
+// applying SRv6 actions, to be attached to SID with goebpf.LwtAttachParams
+func (m *Manager) Seg6LocalProgram() goebpf.Program {
+	return m.seg6local
+}
+
+// SetTunnel sets (or replaces) encapsulation of packets to dst prefix
+func (m *Manager) SetTunnel(dst net.IPNet, t Tunnel) error {
+	key, err := policyKey(dst)
+	if err != nil {
+		return err
+	}
+	value, err := policyValue(dst, t)
+	if err != nil {
+		return err
+	}
+
+	return m.policies.Upsert(key, value)
+}
+
+// DeleteTunnel deletes encapsulation of packets to dst prefix
+func (m *Manager) DeleteTunnel(dst net.IPNet) error {
+	key, err := policyKey(dst)
+	if err != nil {
+		return err
+	}
+
+	return m.policies.Delete(key)
+}
+
+// SetAction sets (or replaces) action of SRv6 packets with SRH tag
+func (m *Manager) SetAction(tag uint16, a Seg6Action) error {
+	value, err := actionValue(a)
+	if err != nil {
+		return err
+	}
+
+	return m.actions.Upsert(uint32(tag), value)
+}
+
+// DeleteAction deletes action of SRH tag, packets with it get End behavior
+func (m *Manager) DeleteAction(tag uint16) error {
+	return m.actions.Delete(uint32(tag))
+}
+
+// Close unloads programs and frees maps. Routes programs are attached by
+// keep them loaded until routes are deleted (programs are detached).
+func (m *Manager) Close() error {
+	for _, prog := range []goebpf.Program{m.xmit, m.seg6local} {
+		if prog != nil {
+			prog.Close()
+		}
+	}
+	return maputil.Close(m.policies, m.actions)
+}
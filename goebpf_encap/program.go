@@ -0,0 +1,204 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_encap
+
+import (
+	"github.com/dropbox/goebpf"
+)
+
+// Offsets of fields of struct __sk_buff, see <linux/bpf.h>
+const (
+	skbLen      = 0
+	skbProtocol = 16
+)
+
+// Offsets of destination address in IPv4 / IPv6 header,
+// of tag in segment routing header following IPv6 one
+const (
+	ipv4Dst = 16
+	ipv6Dst = 24
+	srhTag  = ipv6HeaderSize + 6
+)
+
+// Return codes of lightweight tunnel programs (enum bpf_ret_code)
+const (
+	bpfOK         = 0
+	bpfDrop       = 2
+	bpfRedirect   = 7
+	bpfLwtReroute = 128
+)
+
+// BPF_LWT_ENCAP_IP: push IP header (along with headers following it)
+const bpfLwtEncapIP = 2
+
+// Stack layout of xmit program: headers, policy key, UDP source port
+const (
+	stackHeader = -MaxHeaderSize
+	stackKey    = stackHeader - policyKeySize
+	stackPort   = stackKey - 4
+)
+
+// Sets UDP header fields (length, source port) at offset of headers, R1 holds length
+func fillUDP(offset int16) goebpf.Instructions {
+	return goebpf.Instructions{
+		goebpf.LoadMem(goebpf.SizeByte, goebpf.R2, goebpf.R8, policyUDP),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R2, 0, "push"),
+		goebpf.StoreMem(goebpf.SizeHalf, goebpf.R10, stackHeader+offset+4, goebpf.R1),
+		goebpf.LoadMem(goebpf.SizeHalf, goebpf.R1, goebpf.R10, stackPort),
+		goebpf.StoreMem(goebpf.SizeHalf, goebpf.R10, stackHeader+offset, goebpf.R1),
+	}
+}
+
+// LwtXmit program: pushes headers of policy of packet destination, if any
+func xmitInstructions(policies goebpf.Map) goebpf.Instructions {
+	insns := goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R6, goebpf.R1),
+		// Source port of UDP tunnels comes from flow hash, so flows are spread over paths (ECMP)
+		goebpf.Call(goebpf.HelperGetHashRecalc),
+		goebpf.Alu32Imm(goebpf.AluOpAnd, goebpf.R0, 0x3fff),
+		goebpf.Alu32Imm(goebpf.AluOpOr, goebpf.R0, 0xc000),
+		goebpf.ToBigEndian(goebpf.R0, 16),
+		goebpf.StoreMem(goebpf.SizeHalf, goebpf.R10, stackPort, goebpf.R0),
+
+		// Policy key of destination, full length
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, stackKey+keyPrefixLen, 128),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R7, goebpf.R6, skbProtocol),
+		goebpf.ToBigEndian(goebpf.R7, 16),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R7, ethPIPv6, "ipv6"),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R7, ethPIPv4, "ok"),
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, stackKey+keyAddr, 0),
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, stackKey+keyAddr+4, 0),
+		goebpf.StoreImm(goebpf.SizeHalf, goebpf.R10, stackKey+keyAddr+8, 0),
+		goebpf.StoreImm(goebpf.SizeHalf, goebpf.R10, stackKey+keyAddr+10, -1),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R6),
+		goebpf.Mov64Imm(goebpf.R2, ipv4Dst),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, stackKey+keyAddr+12),
+		goebpf.Mov64Imm(goebpf.R4, 4),
+		goebpf.Call(goebpf.HelperSkbLoadBytes),
+		goebpf.Jump("loaded"),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R6).WithLabel("ipv6"),
+		goebpf.Mov64Imm(goebpf.R2, ipv6Dst),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, stackKey+keyAddr),
+		goebpf.Mov64Imm(goebpf.R4, 16),
+		goebpf.Call(goebpf.HelperSkbLoadBytes),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R0, 0, "ok").WithLabel("loaded"),
+
+		// R8 = policy
+		goebpf.LoadMapFd(goebpf.R1, policies),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackKey),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "ok"),
+		goebpf.Mov64Reg(goebpf.R8, goebpf.R0),
+	}
+	// Policy is shared by all CPUs, so headers are completed on stack
+	for off := int16(0); off < MaxHeaderSize; off += 8 {
+		insns = append(insns,
+			goebpf.LoadMem(goebpf.SizeDouble, goebpf.R1, goebpf.R8, policyHeader+off),
+			goebpf.StoreMem(goebpf.SizeDouble, goebpf.R10, stackHeader+off, goebpf.R1),
+		)
+	}
+	insns = append(insns,
+		// R9 = length of headers, R7 = length of encapsulated packet
+		goebpf.LoadMem(goebpf.SizeHalf, goebpf.R9, goebpf.R8, policyLen),
+		goebpf.JumpImm(goebpf.JumpOpGt, goebpf.R9, MaxHeaderSize, "drop"),
+		goebpf.JumpImm(goebpf.JumpOpLt, goebpf.R9, ipv4HeaderSize, "drop"),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R7, goebpf.R6, skbLen),
+		goebpf.Alu64Reg(goebpf.AluOpAdd, goebpf.R7, goebpf.R9),
+		goebpf.LoadMem(goebpf.SizeByte, goebpf.R1, goebpf.R8, policyOuter),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R1, 6, "outer6"),
+
+		// IPv4 total length, UDP length
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R7),
+		goebpf.ToBigEndian(goebpf.R1, 16),
+		goebpf.StoreMem(goebpf.SizeHalf, goebpf.R10, stackHeader+2, goebpf.R1),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R7),
+		goebpf.Alu64Imm(goebpf.AluOpSub, goebpf.R1, ipv4HeaderSize),
+		goebpf.ToBigEndian(goebpf.R1, 16),
+	)
+	insns = append(insns, fillUDP(ipv4HeaderSize)...)
+	insns = append(insns,
+		goebpf.Jump("push"),
+
+		// IPv6 payload length, the same as UDP length
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R7).WithLabel("outer6"),
+		goebpf.Alu64Imm(goebpf.AluOpSub, goebpf.R1, ipv6HeaderSize),
+		goebpf.ToBigEndian(goebpf.R1, 16),
+		goebpf.StoreMem(goebpf.SizeHalf, goebpf.R10, stackHeader+4, goebpf.R1),
+	)
+	insns = append(insns, fillUDP(ipv6HeaderSize)...)
+	insns = append(insns,
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R6).WithLabel("push"),
+		goebpf.Mov64Imm(goebpf.R2, bpfLwtEncapIP),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, stackHeader),
+		goebpf.Mov64Reg(goebpf.R4, goebpf.R9),
+		goebpf.Call(goebpf.HelperLwtPushEncap),
+		// Packet must not leak out unencapsulated
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R0, 0, "drop"),
+		// Route of outer destination
+		goebpf.Mov64Imm(goebpf.R0, bpfLwtReroute),
+		goebpf.Exit(),
+
+		goebpf.Mov64Imm(goebpf.R0, bpfOK).WithLabel("ok"),
+		goebpf.Exit(),
+		goebpf.Mov64Imm(goebpf.R0, bpfDrop).WithLabel("drop"),
+		goebpf.Exit(),
+	)
+
+	return insns
+}
+
+// Stack layout of seg6local program: SRH tag (key of actions map)
+const stackTag = -actionKeySize
+
+// LwtSeg6Local program: applies action of SRH tag, if any. Kernel has
+// already processed SRH (advanced to next segment) when program runs,
+// without action packet is routed to next segment as usual (End behavior).
+// Segment routing header is expected to follow IPv6 header immediately.
+func seg6LocalInstructions(actions goebpf.Map) goebpf.Instructions {
+	return goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R6, goebpf.R1),
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, stackTag, 0),
+		goebpf.Mov64Imm(goebpf.R2, srhTag),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, stackTag),
+		goebpf.Mov64Imm(goebpf.R4, 2),
+		goebpf.Call(goebpf.HelperSkbLoadBytes),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R0, 0, "ok"),
+		// Tag is in network byte order
+		goebpf.LoadMem(goebpf.SizeHalf, goebpf.R1, goebpf.R10, stackTag),
+		goebpf.ToBigEndian(goebpf.R1, 16),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, stackTag, goebpf.R1),
+
+		goebpf.LoadMapFd(goebpf.R1, actions),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackTag),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "ok"),
+
+		// End.X takes next hop, End.T / End.DT6 take table
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R2, goebpf.R0, actionAction),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R0),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R2, int32(ActionEndX), "table"),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, actionNexthop),
+		goebpf.Mov64Imm(goebpf.R4, 16),
+		goebpf.Jump("action"),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, actionTable).WithLabel("table"),
+		goebpf.Mov64Imm(goebpf.R4, 4),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R6).WithLabel("action"),
+		goebpf.Call(goebpf.HelperLwtSeg6Action),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R0, 0, "drop"),
+		// Action has routed packet already
+		goebpf.Mov64Imm(goebpf.R0, bpfRedirect),
+		goebpf.Exit(),
+
+		goebpf.Mov64Imm(goebpf.R0, bpfOK).WithLabel("ok"),
+		goebpf.Exit(),
+		goebpf.Mov64Imm(goebpf.R0, bpfDrop).WithLabel("drop"),
+		goebpf.Exit(),
+	}
+}
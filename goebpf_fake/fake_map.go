@@ -0,0 +1,352 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_fake
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"syscall"
+
+	"github.com/dropbox/goebpf"
+)
+
+// FakeMap is in-memory implementation of goebpf.Map, mimicking kernel semantics:
+// arrays always have all MaxEntries elements (zeroed), hash-like maps are limited
+// by MaxEntries, errors are *goebpf.SyscallError with the same errno kernel returns.
+// Safe for concurrent use.
+type FakeMap struct {
+	Name       string
+	Type       goebpf.MapType
+	KeySize    int
+	ValueSize  int
+	MaxEntries int
+	// Per-CPU maps: number of CPUs values are stored for, 1 if not set
+	NumCPUs int
+
+	mu   sync.Mutex
+	fd   int
+	data map[string][]byte
+}
+
+// NewFakeMap creates (empty) fake map
+func NewFakeMap(name string, tp goebpf.MapType, keySize, valueSize, maxEntries int) *FakeMap {
+	m := &FakeMap{
+		Name:       name,
+		Type:       tp,
+		KeySize:    keySize,
+		ValueSize:  valueSize,
+		MaxEntries: maxEntries,
+	}
+	m.Create()
+
+	return m
+}
+
+// Fake fds are never real file descriptors
+var (
+	fdMu   sync.Mutex
+	nextFd = 1000
+)
+
+func newFakeFd() int {
+	fdMu.Lock()
+	defer fdMu.Unlock()
+
+	nextFd++
+	return nextFd
+}
+
+// Creates errors mimicking failed bpf(2)
+func newError(op string, errno syscall.Errno) error {
+	return &goebpf.SyscallError{
+		Op:    op,
+		Errno: errno,
+		Msg:   errno.Error(),
+	}
+}
+
+func (m *FakeMap) isArray() bool {
+	switch m.Type {
+	case goebpf.MapTypeArray, goebpf.MapTypePerCPUArray, goebpf.MapTypeProgArray,
+		goebpf.MapTypePerfEventArray, goebpf.MapTypeCgroupArray, goebpf.MapTypeArrayOfMaps:
+		return true
+	}
+	return false
+}
+
+func (m *FakeMap) isPerCpu() bool {
+	switch m.Type {
+	case goebpf.MapTypePerCPUArray, goebpf.MapTypePerCPUHash, goebpf.MapTypeLRUPerCPUHash,
+		goebpf.MapTypePerCpuCGroupStorage:
+		return true
+	}
+	return false
+}
+
+// Size of value returned by Lookup(): all CPUs for Per-CPU maps
+func (m *FakeMap) valueRealSize() int {
+	if m.isPerCpu() && m.NumCPUs > 1 {
+		return m.ValueSize * m.NumCPUs
+	}
+	return m.ValueSize
+}
+
+// Create "creates" map: assigns fake fd and allocates storage
+func (m *FakeMap) Create() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.KeySize < 1 || m.ValueSize < 1 {
+		return newError("ebpf_create_map()", syscall.EINVAL)
+	}
+	if m.fd != 0 {
+		return nil
+	}
+	m.fd = newFakeFd()
+	m.data = make(map[string][]byte)
+
+	return nil
+}
+
+// Close "destroys" map, all data is lost
+func (m *FakeMap) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.fd = 0
+	m.data = nil
+	return nil
+}
+
+// GetFd returns fake fd of map, zero if not created
+func (m *FakeMap) GetFd() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.fd
+}
+
+// GetName returns name of map
+func (m *FakeMap) GetName() string {
+	return m.Name
+}
+
+// CloneTemplate creates new (not created) map with the same definition
+func (m *FakeMap) CloneTemplate() goebpf.Map {
+	return &FakeMap{
+		Name:       m.Name,
+		Type:       m.Type,
+		KeySize:    m.KeySize,
+		ValueSize:  m.ValueSize,
+		MaxEntries: m.MaxEntries,
+		NumCPUs:    m.NumCPUs,
+	}
+}
+
+// Converts key, checks that element with given key can exist
+func (m *FakeMap) key(op string, ikey interface{}) (string, error) {
+	if m.fd == 0 {
+		return "", newError(op, syscall.EBADF)
+	}
+	key, err := goebpf.KeyValueToBytes(ikey, m.KeySize)
+	if err != nil {
+		return "", err
+	}
+	if m.isArray() && int(goebpf.ParseFlexibleInteger(key)) >= m.MaxEntries {
+		return "", newError(op, syscall.ENOENT)
+	}
+	return string(key), nil
+}
+
+// Lookup returns copy of value, for Per-CPU maps values of all CPUs
+func (m *FakeMap) Lookup(ikey interface{}) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key, err := m.key("ebpf_map_lookup_elem()", ikey)
+	if err != nil {
+		return nil, err
+	}
+	val, ok := m.data[key]
+	if !ok {
+		if !m.isArray() {
+			return nil, newError("ebpf_map_lookup_elem()", syscall.ENOENT)
+		}
+		val = make([]byte, m.valueRealSize())
+	}
+
+	return append([]byte(nil), val...), nil
+}
+
+// LookupInto performs lookup of raw key and copies value into dst
+func (m *FakeMap) LookupInto(key []byte, dst []byte) error {
+	if len(key) != m.KeySize {
+		return fmt.Errorf("Invalid key size %d, must be %d bytes", len(key), m.KeySize)
+	}
+	if len(dst) < m.valueRealSize() {
+		return fmt.Errorf("Buffer is too small (%d), value size is %d bytes", len(dst), m.valueRealSize())
+	}
+	val, err := m.Lookup(key)
+	if err != nil {
+		return err
+	}
+	copy(dst, val)
+
+	return nil
+}
+
+// LookupString performs lookup and returns Go string from NULL terminated C string
+func (m *FakeMap) LookupString(ikey interface{}) (string, error) {
+	val, err := m.Lookup(ikey)
+	if err != nil {
+		return "", err
+	}
+
+	return goebpf.NullTerminatedStringToString(val), nil
+}
+
+// LookupInt performs lookup and returns int
+func (m *FakeMap) LookupInt(ikey interface{}) (int, error) {
+	val, err := m.LookupUint64(ikey)
+
+	return int(val), err
+}
+
+// LookupUint64 performs lookup and returns uint64, sum of all CPUs for Per-CPU maps
+func (m *FakeMap) LookupUint64(ikey interface{}) (uint64, error) {
+	if m.ValueSize > 8 {
+		return 0, errors.New("Value is too large to fit int")
+	}
+	val, err := m.Lookup(ikey)
+	if err != nil {
+		return 0, err
+	}
+	var res uint64
+	for i := 0; i+m.ValueSize <= len(val); i += m.ValueSize {
+		res += goebpf.ParseFlexibleInteger(val[i : i+m.ValueSize])
+	}
+
+	return res, nil
+}
+
+// Actual implementation of Insert / Update / Upsert, flags are BPF_ANY / BPF_NOEXIST / BPF_EXIST
+func (m *FakeMap) update(ikey interface{}, ivalue interface{}, mustExist, mustNotExist bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	const op = "ebpf_map_update_elem()"
+	key, err := m.key(op, ikey)
+	if err != nil {
+		return err
+	}
+	// Value of Per-CPU maps is either raw values of all CPUs or single value set for every CPU
+	var val []byte
+	if raw, ok := ivalue.([]byte); ok && len(raw) == m.valueRealSize() {
+		val = append([]byte(nil), raw...)
+	} else {
+		single, err := goebpf.KeyValueToBytes(ivalue, m.ValueSize)
+		if err != nil {
+			return err
+		}
+		val = bytes.Repeat(single, m.valueRealSize()/m.ValueSize)
+	}
+
+	_, exists := m.data[key]
+	switch {
+	case m.isArray() && mustNotExist:
+		// Elements of arrays always exist
+		return newError(op, syscall.EEXIST)
+	case m.isArray():
+	case mustExist && !exists:
+		return newError(op, syscall.ENOENT)
+	case mustNotExist && exists:
+		return newError(op, syscall.EEXIST)
+	case !exists && len(m.data) >= m.MaxEntries:
+		return newError(op, syscall.E2BIG)
+	}
+	m.data[key] = val
+
+	return nil
+}
+
+// Insert inserts new element, fails if it already exists
+func (m *FakeMap) Insert(ikey interface{}, ivalue interface{}) error {
+	return m.update(ikey, ivalue, false, true)
+}
+
+// Update replaces existing element, fails if it doesn't exist
+func (m *FakeMap) Update(ikey interface{}, ivalue interface{}) error {
+	return m.update(ikey, ivalue, true, false)
+}
+
+// Upsert inserts or replaces element
+func (m *FakeMap) Upsert(ikey interface{}, ivalue interface{}) error {
+	return m.update(ikey, ivalue, false, false)
+}
+
+// Delete deletes element, not supported by arrays
+func (m *FakeMap) Delete(ikey interface{}) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	const op = "ebpf_map_delete_elem()"
+	key, err := m.key(op, ikey)
+	if err != nil {
+		return err
+	}
+	if m.isArray() {
+		return newError(op, syscall.EINVAL)
+	}
+	if _, ok := m.data[key]; !ok {
+		return newError(op, syscall.ENOENT)
+	}
+	delete(m.data, key)
+
+	return nil
+}
+
+// GetNextKey returns key following ikey (in byte order of keys), see goebpf.EbpfMap.GetNextKey()
+func (m *FakeMap) GetNextKey(ikey interface{}) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.fd == 0 {
+		return nil, newError("ebpf_map_get_next_key()", syscall.EBADF)
+	}
+	var keys []string
+	if m.isArray() {
+		for i := 0; i < m.MaxEntries; i++ {
+			key, _ := goebpf.KeyValueToBytes(uint32(i), m.KeySize)
+			keys = append(keys, string(key))
+		}
+	} else {
+		for key := range m.data {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+	}
+
+	next := 0
+	if ikey != nil {
+		key, err := goebpf.KeyValueToBytes(ikey, m.KeySize)
+		if err != nil {
+			return nil, err
+		}
+		// Like kernel: non existing key means start from the first one
+		for idx, k := range keys {
+			if bytes.Equal([]byte(k), key) {
+				next = idx + 1
+				break
+			}
+		}
+	}
+	if next >= len(keys) {
+		return nil, goebpf.ErrNoMoreKeys
+	}
+
+	return []byte(keys[next]), nil
+}
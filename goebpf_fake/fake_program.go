@@ -0,0 +1,148 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_fake
+
+import (
+	"errors"
+	"sync"
+	"syscall"
+
+	"github.com/dropbox/goebpf"
+)
+
+// FakeProgram is implementation of goebpf.Program which only records calls,
+// so control plane logic (load / attach / detach order) can be verified.
+// Safe for concurrent use.
+type FakeProgram struct {
+	Name    string
+	Type    goebpf.ProgramType
+	License string
+	Size    int
+	// Returned by Load() / Attach() when set, to test failure paths
+	LoadErr   error
+	AttachErr error
+
+	mu         sync.Mutex
+	fd         int
+	attachData interface{}
+	attached   bool
+	pinnedAt   []string
+}
+
+// NewFakeProgram creates (not loaded) fake program
+func NewFakeProgram(name string, tp goebpf.ProgramType) *FakeProgram {
+	return &FakeProgram{
+		Name:    name,
+		Type:    tp,
+		License: "GPL",
+	}
+}
+
+// Load "loads" program: assigns fake fd, unless LoadErr is set
+func (p *FakeProgram) Load() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.LoadErr != nil {
+		return p.LoadErr
+	}
+	if p.fd == 0 {
+		p.fd = newFakeFd()
+	}
+	return nil
+}
+
+// Pin records path program has been pinned at
+func (p *FakeProgram) Pin(path string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.fd == 0 {
+		return newError("ebpf_obj_pin()", syscall.EBADF)
+	}
+	p.pinnedAt = append(p.pinnedAt, path)
+	return nil
+}
+
+// Close "unloads" program
+func (p *FakeProgram) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.fd = 0
+	return nil
+}
+
+// Attach records attachment, program must be loaded
+func (p *FakeProgram) Attach(data interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.fd == 0 {
+		return errors.New("Program is not loaded")
+	}
+	if p.AttachErr != nil {
+		return p.AttachErr
+	}
+	p.attachData = data
+	p.attached = true
+	return nil
+}
+
+// Detach removes attachment
+func (p *FakeProgram) Detach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.attached {
+		return errors.New("Program is not attached")
+	}
+	p.attachData = nil
+	p.attached = false
+	return nil
+}
+
+// IsAttached reports whether program is attached and data passed to Attach()
+func (p *FakeProgram) IsAttached() (bool, interface{}) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.attached, p.attachData
+}
+
+// PinnedAt returns paths program has been pinned at
+func (p *FakeProgram) PinnedAt() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]string(nil), p.pinnedAt...)
+}
+
+// GetName returns program name
+func (p *FakeProgram) GetName() string {
+	return p.Name
+}
+
+// GetFd returns fake fd, zero if not loaded
+func (p *FakeProgram) GetFd() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.fd
+}
+
+// GetSize returns program size set by user
+func (p *FakeProgram) GetSize() int {
+	return p.Size
+}
+
+// GetLicense returns program's license
+func (p *FakeProgram) GetLicense() string {
+	return p.License
+}
+
+// GetType returns program type
+func (p *FakeProgram) GetType() goebpf.ProgramType {
+	return p.Type
+}
@@ -0,0 +1,231 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_fake
+
+import (
+	"sync"
+
+	"github.com/dropbox/goebpf"
+)
+
+// FakeSystem is in-memory implementation of goebpf.System: nothing is loaded
+// into kernel, so code built on top of goebpf can be unit tested without root /
+// bpffs. Maps / programs are either read from ELF file (definitions only) or
+// added manually:
+//
+//	bpf := goebpf_fake.NewFakeSystem()
+//	bpf.AddMap(goebpf_fake.NewFakeMap("counters", goebpf.MapTypeHash, 4, 8, 64))
+//	bpf.AddProgram(goebpf_fake.NewFakeProgram("xdp_main", goebpf.ProgramTypeXdp))
+//	runControlPlane(bpf)
+type FakeSystem struct {
+	mu       sync.Mutex
+	maps     map[string]goebpf.Map
+	programs map[string]goebpf.Program
+	logger   goebpf.Logger
+	warnings []goebpf.ElfWarning
+}
+
+// NewFakeSystem creates empty fake eBPF system
+func NewFakeSystem() *FakeSystem {
+	return &FakeSystem{
+		maps:     make(map[string]goebpf.Map),
+		programs: make(map[string]goebpf.Program),
+	}
+}
+
+// AddMap adds map to system, replacing map with the same name (if any)
+func (s *FakeSystem) AddMap(m goebpf.Map) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.maps[m.GetName()] = m
+}
+
+// AddProgram adds program to system, replacing program with the same name (if any)
+func (s *FakeSystem) AddProgram(p goebpf.Program) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.programs[p.GetName()] = p
+}
+
+// Size of single eBPF instruction, struct bpf_insn
+const instructionSize = 8
+
+// Reads definitions of maps / programs from ELF file, nothing is loaded into kernel
+func readElf(fn string) (map[string]goebpf.Map, map[string]goebpf.Program, []goebpf.ElfWarning, error) {
+	report, err := goebpf.ParseElf(fn)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	maps := make(map[string]goebpf.Map)
+	for _, em := range report.Maps {
+		m := NewFakeMap(em.Name, em.Type, em.KeySize, em.ValueSize, em.MaxEntries)
+		maps[em.Name] = m
+	}
+	programs := make(map[string]goebpf.Program)
+	for _, ep := range report.Programs {
+		p := NewFakeProgram(ep.Name, ep.Type)
+		p.License = ep.License
+		p.Size = ep.Instructions * instructionSize
+		programs[ep.Name] = p
+	}
+
+	return maps, programs, report.Warnings, nil
+}
+
+// LoadElf reads maps / programs from ELF file. Maps are "created" right away,
+// programs have to be loaded by Load(), just like goebpf.System does.
+func (s *FakeSystem) LoadElf(fn string) error {
+	maps, programs, warnings, err := readElf(fn)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.warnings = warnings
+
+	for name, m := range maps {
+		s.maps[name] = m
+	}
+	for name, p := range programs {
+		s.programs[name] = p
+	}
+	s.debugf("Loaded %d maps, %d programs from '%s'", len(maps), len(programs), fn)
+
+	return nil
+}
+
+// Reload replaces maps / programs by ones from new ELF file. Data of maps with
+// unchanged definition is kept, loaded programs are loaded, attached ones are
+// attached to the same targets.
+func (s *FakeSystem) Reload(fn string) error {
+	maps, programs, warnings, err := readElf(fn)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.warnings = warnings
+
+	for name, m := range maps {
+		old, ok := s.maps[name].(*FakeMap)
+		if ok && sameDefinition(old, m.(*FakeMap)) {
+			maps[name] = old
+		}
+	}
+	for name, p := range programs {
+		old, ok := s.programs[name].(*FakeProgram)
+		if !ok || old.GetFd() == 0 {
+			continue
+		}
+		if err := p.Load(); err != nil {
+			return err
+		}
+		if attached, data := old.IsAttached(); attached {
+			old.Detach()
+			if err := p.Attach(data); err != nil {
+				return err
+			}
+		}
+		old.Close()
+	}
+	s.maps = maps
+	s.programs = programs
+	s.debugf("Reloaded '%s'", fn)
+
+	return nil
+}
+
+func sameDefinition(a, b *FakeMap) bool {
+	return a.Type == b.Type && a.KeySize == b.KeySize &&
+		a.ValueSize == b.ValueSize && a.MaxEntries == b.MaxEntries
+}
+
+// GetMaps returns all maps
+func (s *FakeSystem) GetMaps() map[string]goebpf.Map {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make(map[string]goebpf.Map, len(s.maps))
+	for name, m := range s.maps {
+		res[name] = m
+	}
+	return res
+}
+
+// GetMapByName returns map or nil if not found
+func (s *FakeSystem) GetMapByName(name string) goebpf.Map {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if m, ok := s.maps[name]; ok {
+		return m
+	}
+	return nil
+}
+
+// GetPrograms returns all programs
+func (s *FakeSystem) GetPrograms() map[string]goebpf.Program {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make(map[string]goebpf.Program, len(s.programs))
+	for name, p := range s.programs {
+		res[name] = p
+	}
+	return res
+}
+
+// GetProgramByName returns program or nil if not found
+func (s *FakeSystem) GetProgramByName(name string) goebpf.Program {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if p, ok := s.programs[name]; ok {
+		return p
+	}
+	return nil
+}
+
+// GetElfWarnings returns parts of ELF skipped by last LoadElf() / Reload()
+func (s *FakeSystem) GetElfWarnings() []goebpf.ElfWarning {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.warnings
+}
+
+// SetLogger sets logger for debug messages
+func (s *FakeSystem) SetLogger(l goebpf.Logger) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.logger = l
+}
+
+// Close closes all programs / maps
+func (s *FakeSystem) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, p := range s.programs {
+		p.Close()
+	}
+	for _, m := range s.maps {
+		m.Close()
+	}
+	return nil
+}
+
+func (s *FakeSystem) debugf(format string, args ...interface{}) {
+	if s.logger != nil {
+		s.logger.Printf(format, args...)
+	}
+}
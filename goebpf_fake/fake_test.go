@@ -0,0 +1,169 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_fake
+
+import (
+	"syscall"
+	"testing"
+
+	"github.com/dropbox/goebpf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Fakes must be usable wherever real objects are
+var (
+	_ goebpf.System  = &FakeSystem{}
+	_ goebpf.Map     = &FakeMap{}
+	_ goebpf.Program = &FakeProgram{}
+)
+
+func requireErrno(t *testing.T, errno syscall.Errno, err error) {
+	require.Error(t, err)
+	require.IsType(t, &goebpf.SyscallError{}, err)
+	assert.Equal(t, errno, err.(*goebpf.SyscallError).Errno)
+}
+
+func TestFakeMapHash(t *testing.T) {
+	m := NewFakeMap("hash", goebpf.MapTypeHash, 4, 8, 2)
+	assert.NotZero(t, m.GetFd())
+
+	// Insert / Update / Upsert semantics
+	require.NoError(t, m.Insert(1, 100))
+	requireErrno(t, syscall.EEXIST, m.Insert(1, 100))
+	requireErrno(t, syscall.ENOENT, m.Update(2, 200))
+	require.NoError(t, m.Upsert(2, 200))
+	requireErrno(t, syscall.E2BIG, m.Upsert(3, 300))
+	require.NoError(t, m.Update(1, 111))
+
+	val, err := m.LookupInt(1)
+	require.NoError(t, err)
+	assert.Equal(t, 111, val)
+	_, err = m.Lookup(3)
+	requireErrno(t, syscall.ENOENT, err)
+
+	// Iteration
+	keys := 0
+	for key, err := m.GetNextKey(nil); err == nil; key, err = m.GetNextKey(key) {
+		keys++
+	}
+	assert.Equal(t, 2, keys)
+
+	require.NoError(t, m.Delete(1))
+	requireErrno(t, syscall.ENOENT, m.Delete(1))
+
+	// Closed map
+	require.NoError(t, m.Close())
+	_, err = m.Lookup(2)
+	requireErrno(t, syscall.EBADF, err)
+}
+
+func TestFakeMapArray(t *testing.T) {
+	m := NewFakeMap("array", goebpf.MapTypeArray, 4, 4, 4)
+
+	// All elements exist and zeroed
+	val, err := m.LookupUint64(3)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), val)
+	_, err = m.Lookup(4)
+	requireErrno(t, syscall.ENOENT, err)
+
+	require.NoError(t, m.Update(3, 33))
+	requireErrno(t, syscall.EEXIST, m.Insert(3, 33))
+	requireErrno(t, syscall.EINVAL, m.Delete(3))
+	str, err := m.LookupString(3)
+	require.NoError(t, err)
+	assert.Equal(t, "!", str)
+
+	// Iteration covers all MaxEntries elements
+	keys := 0
+	for key, err := m.GetNextKey(nil); err == nil; key, err = m.GetNextKey(key) {
+		keys++
+	}
+	assert.Equal(t, 4, keys)
+	_, err = m.GetNextKey(uint32(3))
+	assert.Equal(t, goebpf.ErrNoMoreKeys, err)
+}
+
+func TestFakeMapPerCpu(t *testing.T) {
+	m := NewFakeMap("percpu", goebpf.MapTypePerCPUArray, 4, 8, 1)
+	m.NumCPUs = 2
+
+	// Single value is set for every CPU
+	require.NoError(t, m.Update(0, 5))
+	val, err := m.LookupUint64(0)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), val)
+
+	raw := make([]byte, 8)
+	assert.Error(t, m.LookupInto([]byte{0, 0, 0, 0}, raw))
+	raw = make([]byte, 16)
+	require.NoError(t, m.LookupInto([]byte{0, 0, 0, 0}, raw))
+	assert.Equal(t, uint64(5), goebpf.ParseFlexibleInteger(raw[8:]))
+}
+
+func TestFakeMapCloneTemplate(t *testing.T) {
+	m := NewFakeMap("inner", goebpf.MapTypeHash, 4, 4, 10)
+	require.NoError(t, m.Upsert(1, 1))
+
+	clone := m.CloneTemplate()
+	assert.Zero(t, clone.GetFd())
+	require.NoError(t, clone.Create())
+	assert.NotEqual(t, m.GetFd(), clone.GetFd())
+	_, err := clone.Lookup(1)
+	requireErrno(t, syscall.ENOENT, err)
+}
+
+func TestFakeProgram(t *testing.T) {
+	p := NewFakeProgram("xdp0", goebpf.ProgramTypeXdp)
+
+	assert.Error(t, p.Attach("eth0"))
+	require.NoError(t, p.Load())
+	assert.NotZero(t, p.GetFd())
+	require.NoError(t, p.Pin("/sys/fs/bpf/xdp0"))
+	assert.Equal(t, []string{"/sys/fs/bpf/xdp0"}, p.PinnedAt())
+
+	require.NoError(t, p.Attach("eth0"))
+	attached, data := p.IsAttached()
+	assert.True(t, attached)
+	assert.Equal(t, "eth0", data)
+
+	require.NoError(t, p.Detach())
+	assert.Error(t, p.Detach())
+	require.NoError(t, p.Close())
+	assert.Zero(t, p.GetFd())
+
+	// Injected failure
+	p.LoadErr = assert.AnError
+	assert.Equal(t, assert.AnError, p.Load())
+}
+
+func TestFakeSystem(t *testing.T) {
+	bpf := NewFakeSystem()
+	bpf.AddMap(NewFakeMap("counters", goebpf.MapTypeHash, 4, 8, 64))
+	bpf.AddProgram(NewFakeProgram("xdp0", goebpf.ProgramTypeXdp))
+
+	assert.Len(t, bpf.GetMaps(), 1)
+	assert.Len(t, bpf.GetPrograms(), 1)
+	assert.Nil(t, bpf.GetMapByName("nonexisting"))
+	assert.Nil(t, bpf.GetProgramByName("nonexisting"))
+
+	m := bpf.GetMapByName("counters")
+	require.NotNil(t, m)
+	require.NoError(t, m.Upsert(1, 1))
+	p := bpf.GetProgramByName("xdp0")
+	require.NotNil(t, p)
+	require.NoError(t, p.Load())
+
+	// Works with goebpf helpers built on top of interfaces
+	group, err := goebpf.NewAttachGroup(goebpf.AttachTarget{Program: p, Data: "eth0"})
+	require.NoError(t, err)
+	require.NoError(t, group.Detach())
+
+	assert.Error(t, bpf.LoadElf("nonexisting.elf"))
+
+	require.NoError(t, bpf.Close())
+	assert.Zero(t, m.GetFd())
+	assert.Zero(t, p.GetFd())
+}
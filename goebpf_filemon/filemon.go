@@ -0,0 +1,278 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_filemon is file access monitoring: LSM programs on file_open /
+// inode_unlink hooks check whether file is (under) one of watched paths and
+// report access through ring buffer (linux 5.8+), optionally denying it:
+//
+//	mon, err := goebpf_filemon.New(goebpf_filemon.DefaultRingSize)
+//	...
+//	defer mon.Close()
+//	mon.Watch("/etc", goebpf_filemon.ActionAudit)
+//	mon.Watch("/var/lib/secrets", goebpf_filemon.ActionDeny)
+//	if err = mon.Attach(); err != nil {
+//		...
+//	}
+//	for {
+//		e, err := mon.Read()
+//		if err != nil {
+//			break
+//		}
+//		fmt.Println(e.Op, e.Path, e.Comm, e.Denied)
+//	}
+//
+// Watched paths are put into hash map by their device / inode, programs walk
+// from file up through its parent directories (up to MaxDepth levels) looking
+// for watched one, so matching is cheap and independent of how file was named
+// by process (relative path, symlinks, bind mounts). Walk stops at root of
+// file system, so watching directory doesn't cover file systems mounted below it.
+//
+// Requires kernel BTF (/sys/kernel/btf/vmlinux) and BPF LSM enabled
+// (CONFIG_BPF_LSM, "bpf" in /sys/kernel/security/lsm).
+package goebpf_filemon
+
+import (
+	"bytes"
+	"fmt"
+	"path"
+	"time"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_btf"
+)
+
+const (
+	// DefaultRingSize (bytes) fits bursts of open / unlink events, records have room for all MaxDepth path components
+	DefaultRingSize = 1 << 22
+	// DefaultMaxWatches is default capacity of watched paths map
+	DefaultMaxWatches = 1024
+	// MaxDepth is how deep below watched directory files are matched
+	MaxDepth = 16
+	// Names of maps / programs
+	WatchesMapName    = "filemon_watches"
+	EventsMapName     = "filemon_events"
+	OpenProgramName   = "filemon_open"
+	UnlinkProgramName = "filemon_unlink"
+)
+
+// Op is file operation
+type Op int
+
+const (
+	OpOpen   Op = 1
+	OpUnlink Op = 2
+)
+
+func (o Op) String() string {
+	switch o {
+	case OpOpen:
+		return "Open"
+	case OpUnlink:
+		return "Unlink"
+	}
+
+	return "Unknown"
+}
+
+// Action is what to do on access to watched path
+type Action int
+
+const (
+	// ActionAudit only reports access
+	ActionAudit Action = 0
+	// ActionDeny reports access and fails it with EPERM
+	ActionDeny Action = 1
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionAudit:
+		return "Audit"
+	case ActionDeny:
+		return "Deny"
+	}
+
+	return "Unknown"
+}
+
+// Event is single access to watched path
+type Event struct {
+	Op Op
+	// When access happened
+	Time time.Time
+	// Process (thread group) / thread ID of accessing process
+	Pid  int
+	Tid  int
+	Uid  int
+	Comm string
+	// Path of file. ParseEvent() sets it relative to watched path ("" for
+	// watched path itself), Monitor.Read() makes it absolute.
+	Path string
+	// Watched path matched file, empty if it was removed meanwhile
+	Watch   string
+	WatchID int
+	// Whether access was denied (ActionDeny)
+	Denied bool
+	// OpOpen: open(2) flags, O_RDONLY, O_WRONLY, ...
+	Flags int
+}
+
+// Key of watches map: watched file / directory
+//
+//	struct watch_key {
+//		__u64 ino;
+//		__u32 dev;    // kernel dev_t, MKDEV(major, minor)
+//		__u32 pad;
+//	};
+//	struct watch_value {
+//		__u32 id;
+//		__u32 action;
+//	};
+const (
+	watchKeySize   = 16
+	watchValueSize = 8
+)
+
+// Kernel encoding of dev_t, differs from one stat(2) returns
+func kernelDev(major, minor uint32) uint32 {
+	return major<<20 | minor
+}
+
+func watchKey(ino uint64, dev uint32) []byte {
+	key := make([]byte, watchKeySize)
+	bo := goebpf.HostByteOrder()
+	bo.PutUint64(key, ino)
+	bo.PutUint32(key[8:], dev)
+	return key
+}
+
+func watchValue(id int, action Action) []byte {
+	value := make([]byte, watchValueSize)
+	bo := goebpf.HostByteOrder()
+	bo.PutUint32(value, uint32(id))
+	bo.PutUint32(value[4:], uint32(action))
+	return value
+}
+
+// Record programs put into ring buffer:
+//
+//	struct filemon_event {
+//		__u64 ktime;          // bpf_ktime_get_ns()
+//		__u32 op;             // 1 - open, 2 - unlink
+//		__u32 pid;
+//		__u32 tid;
+//		__u32 uid;
+//		__u32 watch_id;
+//		__u32 action;         // of watch, 1 - denied
+//		__u32 depth;          // levels below watched path, number of names
+//		__u32 flags;          // open: file->f_flags
+//		char  comm[16];
+//		char  names[16][128]; // file name first, then its parents
+//	};
+const (
+	recordTimeOff    = 0
+	recordOpOff      = 8
+	recordPidOff     = 12
+	recordTidOff     = 16
+	recordUidOff     = 20
+	recordWatchIDOff = 24
+	recordActionOff  = 28
+	recordDepthOff   = 32
+	recordFlagsOff   = 36
+	recordCommOff    = 40
+	recordNamesOff   = 56
+	recordSize       = recordNamesOff + MaxDepth*maxNameLen
+	commLen          = 16
+	maxNameLen       = 128
+)
+
+// ParseEvent decodes record of ring buffer into event
+func ParseEvent(record []byte) (*Event, error) {
+	if len(record) < recordSize {
+		return nil, fmt.Errorf("Invalid record size %d, must be at least %d", len(record), recordSize)
+	}
+	bo := goebpf.HostByteOrder()
+	e := &Event{
+		Op:      Op(bo.Uint32(record[recordOpOff:])),
+		Time:    goebpf.KtimeToTime(bo.Uint64(record[recordTimeOff:])),
+		Pid:     int(bo.Uint32(record[recordPidOff:])),
+		Tid:     int(bo.Uint32(record[recordTidOff:])),
+		Uid:     int(bo.Uint32(record[recordUidOff:])),
+		Comm:    cString(record[recordCommOff : recordCommOff+commLen]),
+		WatchID: int(bo.Uint32(record[recordWatchIDOff:])),
+		Denied:  Action(bo.Uint32(record[recordActionOff:])) == ActionDeny,
+		Flags:   int(bo.Uint32(record[recordFlagsOff:])),
+	}
+	if e.Op != OpOpen && e.Op != OpUnlink {
+		return nil, fmt.Errorf("Invalid operation %d", e.Op)
+	}
+	depth := int(bo.Uint32(record[recordDepthOff:]))
+	if depth > MaxDepth {
+		return nil, fmt.Errorf("Invalid depth %d", depth)
+	}
+	// Names go from file up to watched path
+	names := make([]string, depth)
+	for i := 0; i < depth; i++ {
+		off := recordNamesOff + i*maxNameLen
+		names[depth-1-i] = cString(record[off : off+maxNameLen])
+	}
+	e.Path = path.Join(names...)
+
+	return e, nil
+}
+
+// Returns NULL terminated string
+func cString(data []byte) string {
+	if idx := bytes.IndexByte(data, 0); idx >= 0 {
+		data = data[:idx]
+	}
+	return string(data)
+}
+
+// Offsets of kernel struct fields used by programs
+type offsets struct {
+	fileDentry int // file
+	fileFlags  int
+	dParent    int // dentry
+	dInode     int
+	dName      int
+	iIno       int // inode
+	iSb        int
+	sDev       int // super_block
+}
+
+// Reads offsets of file / dentry / inode fields from kernel BTF
+func kernelOffsets() (*offsets, error) {
+	spec, err := goebpf_btf.LoadKernelSpec()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read kernel BTF: %v", err)
+	}
+	types := make(map[string]*goebpf_btf.Type)
+	for _, name := range []string{"file", "dentry", "inode", "super_block"} {
+		if types[name], err = spec.TypeByName(name, goebpf_btf.KindStruct); err != nil {
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+	}
+
+	res := &offsets{}
+	for _, f := range []struct {
+		t     string
+		field string
+		dst   *int
+	}{
+		{"file", "f_path.dentry", &res.fileDentry},
+		{"file", "f_flags", &res.fileFlags},
+		{"dentry", "d_parent", &res.dParent},
+		{"dentry", "d_inode", &res.dInode},
+		{"dentry", "d_name.name", &res.dName},
+		{"inode", "i_ino", &res.iIno},
+		{"inode", "i_sb", &res.iSb},
+		{"super_block", "s_dev", &res.sDev},
+	} {
+		if *f.dst, err = goebpf_btf.FieldOffset(types[f.t], f.field); err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
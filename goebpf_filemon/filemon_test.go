@@ -0,0 +1,84 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_filemon
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+)
+
+func TestParseEvent(t *testing.T) {
+	bo := goebpf.HostByteOrder()
+	now := time.Now()
+	record := make([]byte, recordSize)
+	bo.PutUint64(record[recordTimeOff:], uint64(now.Sub(goebpf.KtimeToTime(0))))
+	bo.PutUint32(record[recordOpOff:], uint32(OpOpen))
+	bo.PutUint32(record[recordPidOff:], 100)
+	bo.PutUint32(record[recordTidOff:], 101)
+	bo.PutUint32(record[recordUidOff:], 1000)
+	copy(record[recordWatchIDOff:], watchValue(7, ActionDeny))
+	bo.PutUint32(record[recordFlagsOff:], 2)
+	copy(record[recordCommOff:], "cat")
+	// File name first, then its parent
+	bo.PutUint32(record[recordDepthOff:], 2)
+	copy(record[recordNamesOff:], "passwd\x00")
+	copy(record[recordNamesOff+maxNameLen:], "conf\x00")
+
+	e, err := ParseEvent(record)
+	require.NoError(t, err)
+	assert.Equal(t, OpOpen, e.Op)
+	assert.Equal(t, "Open", e.Op.String())
+	assert.WithinDuration(t, now, e.Time, time.Millisecond)
+	assert.Equal(t, 100, e.Pid)
+	assert.Equal(t, 101, e.Tid)
+	assert.Equal(t, 1000, e.Uid)
+	assert.Equal(t, "cat", e.Comm)
+	assert.Equal(t, 7, e.WatchID)
+	assert.True(t, e.Denied)
+	assert.Equal(t, 2, e.Flags)
+	assert.Equal(t, "conf/passwd", e.Path)
+
+	// Watched path itself
+	bo.PutUint32(record[recordOpOff:], uint32(OpUnlink))
+	bo.PutUint32(record[recordDepthOff:], 0)
+	copy(record[recordWatchIDOff:], watchValue(7, ActionAudit))
+	e, err = ParseEvent(record)
+	require.NoError(t, err)
+	assert.Equal(t, OpUnlink, e.Op)
+	assert.False(t, e.Denied)
+	assert.Equal(t, "", e.Path)
+
+	// Malformed
+	bo.PutUint32(record[recordDepthOff:], MaxDepth+1)
+	_, err = ParseEvent(record)
+	assert.Error(t, err)
+	bo.PutUint32(record[recordDepthOff:], 0)
+	bo.PutUint32(record[recordOpOff:], 5)
+	_, err = ParseEvent(record)
+	assert.Error(t, err)
+	_, err = ParseEvent(record[:recordSize-1])
+	assert.Error(t, err)
+}
+
+func TestWatchKey(t *testing.T) {
+	bo := goebpf.HostByteOrder()
+	key := watchKey(12345, kernelDev(8, 1))
+	require.Len(t, key, watchKeySize)
+	assert.Equal(t, uint64(12345), bo.Uint64(key))
+	assert.Equal(t, uint32(8<<20|1), bo.Uint32(key[8:]))
+	assert.Equal(t, uint32(0), bo.Uint32(key[12:]))
+}
+
+func TestStrings(t *testing.T) {
+	assert.Equal(t, "Unlink", OpUnlink.String())
+	assert.Equal(t, "Unknown", Op(0).String())
+	assert.Equal(t, "Audit", ActionAudit.String())
+	assert.Equal(t, "Deny", ActionDeny.String())
+	assert.Equal(t, "Unknown", Action(5).String())
+}
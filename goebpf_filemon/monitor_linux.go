@@ -0,0 +1,235 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_filemon
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/internal/maputil"
+)
+
+// Monitor reports (and denies) access to watched paths
+type Monitor struct {
+	watches  *goebpf.EbpfMap
+	ring     *goebpf.EbpfMap
+	programs []goebpf.Program
+	reader   *goebpf.RingBufReader
+
+	mu     sync.RWMutex
+	lastID int
+	// Watched path by ID and its map key by path
+	paths map[int]string
+	keys  map[string]watchEntry
+	// Number of records Read() skipped as malformed
+	malformed uint64
+}
+
+type watchEntry struct {
+	id     int
+	key    []byte
+	action Action
+}
+
+// Programs by operation, in order of Monitor.programs
+var programs = []struct {
+	op   Op
+	name string
+	hook string
+}{
+	{OpOpen, OpenProgramName, openHook},
+	{OpUnlink, UnlinkProgramName, unlinkHook},
+}
+
+// New creates watches map (DefaultMaxWatches) / ring buffer of ringSize
+// bytes (power of 2) and loads programs. Programs are not attached yet,
+// see Attach().
+func New(ringSize int) (*Monitor, error) {
+	offsets, err := kernelOffsets()
+	if err != nil {
+		return nil, err
+	}
+	m := &Monitor{
+		watches: &goebpf.EbpfMap{
+			Name:       WatchesMapName,
+			Type:       goebpf.MapTypeHash,
+			KeySize:    watchKeySize,
+			ValueSize:  watchValueSize,
+			MaxEntries: DefaultMaxWatches,
+		},
+		ring: &goebpf.EbpfMap{
+			Name:       EventsMapName,
+			Type:       goebpf.MapTypeRingBuf,
+			MaxEntries: ringSize,
+		},
+		paths: make(map[int]string),
+		keys:  make(map[string]watchEntry),
+	}
+	if err = maputil.Create(m.watches, m.ring); err != nil {
+		return nil, err
+	}
+	for _, p := range programs {
+		prog, err := goebpf.NewLSMProgram(p.name, p.hook, "GPL", instructions(p.op, m.watches, m.ring, offsets))
+		if err == nil {
+			err = prog.Load()
+		}
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.programs = append(m.programs, prog)
+	}
+	if m.reader, err = goebpf.NewRingBufReader(m.ring); err != nil {
+		m.Close()
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Programs returns loaded open / unlink programs
+func (m *Monitor) Programs() []goebpf.Program {
+	return m.programs
+}
+
+// Attach attaches programs to their LSM hooks, all or nothing
+func (m *Monitor) Attach() error {
+	for i, prog := range m.programs {
+		if err := prog.Attach(nil); err != nil {
+			for _, attached := range m.programs[:i] {
+				attached.Detach()
+			}
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Watch starts to watch file or directory (with everything below it up
+// to MaxDepth levels), watching already watched path updates its action.
+// Path is resolved at the moment of call: if it is removed / replaced later,
+// watch has no effect on new file.
+func (m *Monitor) Watch(path string, action Action) error {
+	if action != ActionAudit && action != ActionDeny {
+		return fmt.Errorf("Invalid action %d", action)
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	var st unix.Stat_t
+	if err = unix.Stat(path, &st); err != nil {
+		return fmt.Errorf("Unable to stat '%s': %v", path, err)
+	}
+	key := watchKey(st.Ino, kernelDev(unix.Major(uint64(st.Dev)), unix.Minor(uint64(st.Dev))))
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for other, e := range m.keys {
+		if other != path && string(e.key) == string(key) {
+			return fmt.Errorf("'%s' is already watched as '%s'", path, other)
+		}
+	}
+	entry, ok := m.keys[path]
+	if !ok {
+		m.lastID++
+		entry.id = m.lastID
+	} else if string(entry.key) != string(key) {
+		// Path now refers to another file
+		if err = m.watches.Delete(entry.key); err != nil {
+			return err
+		}
+	}
+	if err = m.watches.Upsert(key, watchValue(entry.id, action)); err != nil {
+		return err
+	}
+	entry.key = key
+	entry.action = action
+	m.keys[path] = entry
+	m.paths[entry.id] = path
+
+	return nil
+}
+
+// Unwatch stops watching path
+func (m *Monitor) Unwatch(path string) error {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	entry, ok := m.keys[path]
+	if !ok {
+		return fmt.Errorf("Path '%s' is not watched", path)
+	}
+	if err = m.watches.Delete(entry.key); err != nil {
+		return err
+	}
+	delete(m.keys, path)
+	delete(m.paths, entry.id)
+
+	return nil
+}
+
+// Watches returns watched paths with their actions
+func (m *Monitor) Watches() map[string]Action {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res := make(map[string]Action, len(m.keys))
+	for path, entry := range m.keys {
+		res[path] = entry.action
+	}
+	return res
+}
+
+// Read returns next event, blocking until there is one.
+// Malformed records are skipped, see Malformed().
+// Returns goebpf.ErrRingBufClosed once monitor is closed.
+func (m *Monitor) Read() (*Event, error) {
+	for {
+		record, err := m.reader.Read()
+		if err != nil {
+			return nil, err
+		}
+		e, err := ParseEvent(record)
+		if err != nil {
+			atomic.AddUint64(&m.malformed, 1)
+			continue
+		}
+		m.mu.RLock()
+		e.Watch = m.paths[e.WatchID]
+		m.mu.RUnlock()
+		if e.Watch != "" {
+			e.Path = filepath.Join(e.Watch, e.Path)
+		}
+		return e, nil
+	}
+}
+
+// Malformed returns number of records skipped by Read()
+func (m *Monitor) Malformed() uint64 {
+	return atomic.LoadUint64(&m.malformed)
+}
+
+// Close detaches programs, interrupts pending Read() and frees all resources
+func (m *Monitor) Close() error {
+	if m.reader != nil {
+		m.reader.Close()
+	}
+	for _, prog := range m.programs {
+		prog.Close()
+	}
+	return maputil.Close(m.watches, m.ring)
+}
@@ -0,0 +1,188 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_filemon
+
+import (
+	"fmt"
+
+	"github.com/dropbox/goebpf"
+)
+
+// LSM hooks programs are attached to, see <linux/lsm_hook_defs.h>
+const (
+	openHook   = "file_open"    // (struct file *file)
+	unlinkHook = "inode_unlink" // (struct inode *dir, struct dentry *dentry)
+)
+
+// EPERM, returned by programs to deny access
+const errnoPerm = 1
+
+// Stack layout: pointers / values read from kernel
+const (
+	stackPtr    = -8
+	stackStart  = -16 // dentry of accessed file
+	stackKey    = -32 // struct watch_key
+	stackValue  = -40 // struct watch_value of matched watch
+	stackLevel  = -48 // level watch matched at
+	stackFlags  = -56 // open flags
+	stackDevOff = stackKey + 8
+)
+
+// Reads size bytes of kernel memory at R9 + offset into stack
+func readKernel(stackOff int16, size int32, offset int) goebpf.Instructions {
+	return goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R1, int32(stackOff)),
+		goebpf.Mov64Imm(goebpf.R2, size),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R9),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, int32(offset)),
+		goebpf.Call(goebpf.HelperProbeReadKernel),
+	}
+}
+
+// Walks from dentry (R8) up through parents looking for watched one.
+// Jumps to "matched" with watch value / level on stack if found,
+// to "allow" otherwise.
+func walkInstructions(watches goebpf.Map, off *offsets) goebpf.Instructions {
+	var insns goebpf.Instructions
+	for level := 0; level <= MaxDepth; level++ {
+		insns = append(insns, goebpf.Mov64Reg(goebpf.R9, goebpf.R8))
+		insns = append(insns, readKernel(stackPtr, 8, off.dInode)...)
+		insns = append(insns,
+			goebpf.LoadMem(goebpf.SizeDouble, goebpf.R9, goebpf.R10, stackPtr),
+			goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R9, 0, "allow"),
+		)
+		insns = append(insns, readKernel(stackKey, 8, off.iIno)...)
+		insns = append(insns, readKernel(stackPtr, 8, off.iSb)...)
+		insns = append(insns,
+			goebpf.LoadMem(goebpf.SizeDouble, goebpf.R9, goebpf.R10, stackPtr),
+			goebpf.StoreImm(goebpf.SizeDouble, goebpf.R10, stackDevOff, 0),
+		)
+		insns = append(insns, readKernel(stackDevOff, 4, off.sDev)...)
+
+		next := fmt.Sprintf("up_%d", level)
+		if level == MaxDepth {
+			next = "allow"
+		}
+		insns = append(insns,
+			goebpf.LoadMapFd(goebpf.R1, watches),
+			goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+			goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackKey),
+			goebpf.Call(goebpf.HelperMapLookupElem),
+			goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, next),
+			goebpf.LoadMem(goebpf.SizeDouble, goebpf.R1, goebpf.R0, 0),
+			goebpf.StoreMem(goebpf.SizeDouble, goebpf.R10, stackValue, goebpf.R1),
+			goebpf.StoreImm(goebpf.SizeDouble, goebpf.R10, stackLevel, int32(level)),
+			goebpf.Jump("matched"),
+		)
+		if level == MaxDepth {
+			break
+		}
+
+		// Root of file system is its own parent
+		insns = append(insns, goebpf.Mov64Reg(goebpf.R9, goebpf.R8).WithLabel(next))
+		insns = append(insns, readKernel(stackPtr, 8, off.dParent)...)
+		insns = append(insns,
+			goebpf.LoadMem(goebpf.SizeDouble, goebpf.R1, goebpf.R10, stackPtr),
+			goebpf.JumpReg(goebpf.JumpOpEq, goebpf.R1, goebpf.R8, "allow"),
+			goebpf.Mov64Reg(goebpf.R8, goebpf.R1),
+		)
+	}
+
+	return insns
+}
+
+// Fills record R7 reserved in ring buffer with access details and submits it
+func reportInstructions(op Op, off *offsets) goebpf.Instructions {
+	insns := goebpf.Instructions{
+		goebpf.Call(goebpf.HelperKtimeGetNs),
+		goebpf.StoreMem(goebpf.SizeDouble, goebpf.R7, recordTimeOff, goebpf.R0),
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R7, recordOpOff, int32(op)),
+		goebpf.Call(goebpf.HelperGetCurrentPidTgid),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R7, recordTidOff, goebpf.R0),
+		goebpf.Alu64Imm(goebpf.AluOpRsh, goebpf.R0, 32),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R7, recordPidOff, goebpf.R0),
+		goebpf.Call(goebpf.HelperGetCurrentUidGid),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R7, recordUidOff, goebpf.R0),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R7),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R1, recordCommOff),
+		goebpf.Mov64Imm(goebpf.R2, commLen),
+		goebpf.Call(goebpf.HelperGetCurrentComm),
+		// watch_id / action are the same as struct watch_value
+		goebpf.LoadMem(goebpf.SizeDouble, goebpf.R1, goebpf.R10, stackValue),
+		goebpf.StoreMem(goebpf.SizeDouble, goebpf.R7, recordWatchIDOff, goebpf.R1),
+		goebpf.LoadMem(goebpf.SizeDouble, goebpf.R1, goebpf.R10, stackLevel),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R7, recordDepthOff, goebpf.R1),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R10, stackFlags),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R7, recordFlagsOff, goebpf.R1),
+		goebpf.LoadMem(goebpf.SizeDouble, goebpf.R8, goebpf.R10, stackStart),
+	}
+	// Names of file and its parents below watched path
+	for level := 0; level < MaxDepth; level++ {
+		insns = append(insns,
+			goebpf.LoadMem(goebpf.SizeDouble, goebpf.R1, goebpf.R10, stackLevel),
+			goebpf.JumpImm(goebpf.JumpOpLe, goebpf.R1, int32(level), "submit"),
+			goebpf.Mov64Reg(goebpf.R9, goebpf.R8),
+		)
+		insns = append(insns, readKernel(stackPtr, 8, off.dName)...)
+		insns = append(insns,
+			goebpf.Mov64Reg(goebpf.R1, goebpf.R7),
+			goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R1, int32(recordNamesOff+level*maxNameLen)),
+			goebpf.Mov64Imm(goebpf.R2, maxNameLen),
+			goebpf.LoadMem(goebpf.SizeDouble, goebpf.R3, goebpf.R10, stackPtr),
+			goebpf.Call(goebpf.HelperProbeReadKernelStr),
+		)
+		insns = append(insns, readKernel(stackPtr, 8, off.dParent)...)
+		insns = append(insns, goebpf.LoadMem(goebpf.SizeDouble, goebpf.R8, goebpf.R10, stackPtr))
+	}
+	insns = append(insns,
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R7).WithLabel("submit"),
+		goebpf.Mov64Imm(goebpf.R2, 0),
+		goebpf.Call(goebpf.HelperRingbufSubmit),
+	)
+
+	return insns
+}
+
+// Program of LSM hook of op: takes dentry of accessed file from hook
+// arguments and denies / reports access if it is under watched path
+func instructions(op Op, watches, ring goebpf.Map, off *offsets) goebpf.Instructions {
+	insns := goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R6, goebpf.R1),
+		goebpf.StoreImm(goebpf.SizeDouble, goebpf.R10, stackFlags, 0),
+		goebpf.Mov64Reg(goebpf.R9, goebpf.R6),
+	}
+	switch op {
+	case OpOpen:
+		insns = append(insns, readKernel(stackPtr, 8, 0)...)
+		insns = append(insns, goebpf.LoadMem(goebpf.SizeDouble, goebpf.R9, goebpf.R10, stackPtr))
+		insns = append(insns, readKernel(stackFlags, 4, off.fileFlags)...)
+		insns = append(insns, readKernel(stackStart, 8, off.fileDentry)...)
+	case OpUnlink:
+		insns = append(insns, readKernel(stackStart, 8, 8)...)
+	}
+	insns = append(insns, goebpf.LoadMem(goebpf.SizeDouble, goebpf.R8, goebpf.R10, stackStart))
+	insns = append(insns, walkInstructions(watches, off)...)
+
+	// Watch matched: report it (unless ring buffer is full) and apply decision
+	insns = append(insns,
+		goebpf.LoadMapFd(goebpf.R1, ring).WithLabel("matched"),
+		goebpf.Mov64Imm(goebpf.R2, recordSize),
+		goebpf.Mov64Imm(goebpf.R3, 0),
+		goebpf.Call(goebpf.HelperRingbufReserve),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "decide"),
+		goebpf.Mov64Reg(goebpf.R7, goebpf.R0),
+	)
+	insns = append(insns, reportInstructions(op, off)...)
+	insns = append(insns,
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R10, stackValue+4).WithLabel("decide"),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R1, int32(ActionDeny), "allow"),
+		goebpf.Mov64Imm(goebpf.R0, -errnoPerm),
+		goebpf.Exit(),
+		goebpf.Mov64Imm(goebpf.R0, 0).WithLabel("allow"),
+		goebpf.Exit(),
+	)
+
+	return insns
+}
@@ -0,0 +1,303 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_ksym resolves kernel addresses into symbols and vice versa
+// using /proc/kallsyms, e.g. to symbolize kernel stack traces
+// read from BPF_MAP_TYPE_STACK_TRACE map:
+//
+//	table, err := goebpf_ksym.NewTable()
+//	...
+//	for _, frame := range table.Symbolize(stack) {
+//		fmt.Println(frame)
+//	}
+//
+// Symbols are cached in memory. Since kernel modules may be loaded / unloaded
+// at any time, table automatically re-reads kallsyms when lookup fails
+// and list of loaded modules has been changed.
+package goebpf_ksym
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	// Default locations of kernel symbols / loaded modules
+	KallsymsPath = "/proc/kallsyms"
+	ModulesPath  = "/proc/modules"
+)
+
+// ErrAddressesHidden returned when kernel hides symbol addresses
+// (all addresses are zero), typically because of kernel.kptr_restrict sysctl
+// or lack of CAP_SYSLOG.
+var ErrAddressesHidden = errors.New("Kernel symbol addresses are hidden (kptr_restrict?)")
+
+// Symbol is one entry of kallsyms
+type Symbol struct {
+	Address uint64
+	// Symbol type as reported by nm(1), e.g. 'T' for global text (code) symbol
+	Type byte
+	Name string
+	// Name of kernel module symbol belongs to, empty for core kernel symbols
+	Module string
+}
+
+// String returns symbol name with module name (if any), e.g. "xt_match [x_tables]"
+func (s *Symbol) String() string {
+	if s.Module != "" {
+		return fmt.Sprintf("%s [%s]", s.Name, s.Module)
+	}
+	return s.Name
+}
+
+// Table is cached kernel symbol table. It is safe for concurrent use.
+type Table struct {
+	kallsymsPath string
+	modulesPath  string
+
+	mutex   sync.RWMutex
+	symbols []Symbol // sorted by address
+	byName  map[string]int
+	modules string // content of /proc/modules at time of last refresh
+}
+
+// NewTable creates symbol table from /proc/kallsyms
+func NewTable() (*Table, error) {
+	return NewTableFromFile(KallsymsPath, ModulesPath)
+}
+
+// NewTableFromFile creates symbol table from given kallsyms / modules files.
+// modulesPath may be empty - in that case table will never be refreshed automatically.
+func NewTableFromFile(kallsymsPath, modulesPath string) (*Table, error) {
+	t := &Table{
+		kallsymsPath: kallsymsPath,
+		modulesPath:  modulesPath,
+	}
+	if err := t.Refresh(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Refresh unconditionally re-reads kallsyms
+func (t *Table) Refresh() error {
+	modules := t.readModules()
+
+	f, err := os.Open(t.kallsymsPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	symbols, err := parseKallsyms(f)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]int, len(symbols))
+	for idx := range symbols {
+		// Symbol names are not unique (e.g. static functions),
+		// keep first one only
+		if _, ok := byName[symbols[idx].Name]; !ok {
+			byName[symbols[idx].Name] = idx
+		}
+	}
+
+	t.mutex.Lock()
+	t.symbols = symbols
+	t.byName = byName
+	t.modules = modules
+	t.mutex.Unlock()
+
+	return nil
+}
+
+// Returns list of loaded modules, or empty string if not available
+func (t *Table) readModules() string {
+	if t.modulesPath == "" {
+		return ""
+	}
+	data, err := ioutil.ReadFile(t.modulesPath)
+	if err != nil {
+		return ""
+	}
+	// Only module names matter: the rest of line contains
+	// volatile information like reference counter
+	var names []string
+	for _, line := range strings.Split(string(data), "\n") {
+		if fields := strings.Fields(line); len(fields) > 0 {
+			names = append(names, fields[0])
+		}
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+// Re-reads symbols if set of loaded kernel modules has been changed since last refresh.
+// Returns true if table has been refreshed.
+func (t *Table) refreshIfModulesChanged() bool {
+	if t.modulesPath == "" {
+		return false
+	}
+	modules := t.readModules()
+	t.mutex.RLock()
+	changed := modules != t.modules
+	t.mutex.RUnlock()
+	if !changed {
+		return false
+	}
+	return t.Refresh() == nil
+}
+
+// Len returns amount of symbols in table
+func (t *Table) Len() int {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	return len(t.symbols)
+}
+
+// Names returns names of all symbols of table, e.g. to suggest alternatives
+// of unknown symbol
+func (t *Table) Names() []string {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	names := make([]string, 0, len(t.byName))
+	for name := range t.byName {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (t *Table) lookupAddress(addr uint64) (Symbol, uint64, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+
+	// Find first symbol with address greater than addr,
+	// previous one is what we're looking for
+	idx := sort.Search(len(t.symbols), func(i int) bool {
+		return t.symbols[i].Address > addr
+	})
+	if idx == 0 {
+		// Before first symbol
+		return Symbol{}, 0, false
+	}
+	sym := t.symbols[idx-1]
+	return sym, addr - sym.Address, true
+}
+
+// LookupAddress returns symbol which contains addr and offset of addr from
+// beginning of symbol.
+func (t *Table) LookupAddress(addr uint64) (*Symbol, uint64, bool) {
+	sym, offset, ok := t.lookupAddress(addr)
+	if !ok && t.refreshIfModulesChanged() {
+		sym, offset, ok = t.lookupAddress(addr)
+	}
+	if !ok {
+		return nil, 0, false
+	}
+	return &sym, offset, true
+}
+
+func (t *Table) lookupName(name string) (Symbol, bool) {
+	t.mutex.RLock()
+	defer t.mutex.RUnlock()
+	if idx, ok := t.byName[name]; ok {
+		return t.symbols[idx], true
+	}
+	return Symbol{}, false
+}
+
+// LookupName returns symbol by name. If there are several symbols
+// with the same name - first one (with lowest address) is returned.
+func (t *Table) LookupName(name string) (*Symbol, bool) {
+	sym, ok := t.lookupName(name)
+	if !ok && t.refreshIfModulesChanged() {
+		sym, ok = t.lookupName(name)
+	}
+	if !ok {
+		return nil, false
+	}
+	return &sym, true
+}
+
+// Exists checks that kernel has given symbol, e.g. to validate function name
+// before attaching kprobe to it
+func (t *Table) Exists(name string) bool {
+	_, ok := t.LookupName(name)
+	return ok
+}
+
+// Symbolize converts stack trace (list of instruction pointers, as stored in
+// BPF_MAP_TYPE_STACK_TRACE map) into human readable frames "name+0xoffset".
+// Stack is terminated by first zero address. Unknown addresses are printed as is.
+func (t *Table) Symbolize(stack []uint64) []string {
+	var frames []string
+	for _, addr := range stack {
+		if addr == 0 {
+			break
+		}
+		sym, offset, ok := t.LookupAddress(addr)
+		if !ok {
+			frames = append(frames, fmt.Sprintf("0x%x", addr))
+			continue
+		}
+		frames = append(frames, fmt.Sprintf("%s+0x%x", sym, offset))
+	}
+	return frames
+}
+
+// Parses kallsyms formatted lines:
+//
+//	ffffffff81000000 T _text
+//	ffffffffc0a01000 t xt_match_open	[x_tables]
+func parseKallsyms(r io.Reader) ([]Symbol, error) {
+	var symbols []Symbol
+	nonZero := false
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 3 || len(fields[1]) != 1 {
+			return nil, fmt.Errorf("Invalid kallsyms format at line %d", lineNum)
+		}
+		addr, err := strconv.ParseUint(fields[0], 16, 64)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid address at line %d: %v", lineNum, err)
+		}
+		sym := Symbol{
+			Address: addr,
+			Type:    fields[1][0],
+			Name:    fields[2],
+		}
+		if len(fields) > 3 {
+			sym.Module = strings.Trim(fields[3], "[]")
+		}
+		nonZero = nonZero || addr != 0
+		symbols = append(symbols, sym)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(symbols) > 0 && !nonZero {
+		return nil, ErrAddressesHidden
+	}
+
+	// kallsyms is mostly sorted, except module symbols
+	sort.SliceStable(symbols, func(i, j int) bool {
+		return symbols[i].Address < symbols[j].Address
+	})
+
+	return symbols, nil
+}
@@ -0,0 +1,94 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_ksym
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKallsyms = `ffffffff81000000 T _text
+ffffffff81001000 T do_one_initcall
+ffffffff81002000 t static_fn
+ffffffff81003000 t static_fn
+ffffffff81004000 T _etext
+ffffffffc0001000 t xt_match_open	[x_tables]
+`
+
+func writeFile(t *testing.T, dir, name, content string) string {
+	fn := filepath.Join(dir, name)
+	require.NoError(t, ioutil.WriteFile(fn, []byte(content), 0644))
+	return fn
+}
+
+func TestParseKallsyms(t *testing.T) {
+	symbols, err := parseKallsyms(strings.NewReader(testKallsyms))
+	require.NoError(t, err)
+	require.Len(t, symbols, 6)
+	assert.Equal(t, Symbol{
+		Address: 0xffffffffc0001000,
+		Type:    't',
+		Name:    "xt_match_open",
+		Module:  "x_tables",
+	}, symbols[5])
+	assert.Equal(t, "xt_match_open [x_tables]", symbols[5].String())
+
+	// Negative
+	_, err = parseKallsyms(strings.NewReader("0000000000000000 T _text\n0000000000000000 T _etext\n"))
+	assert.Equal(t, ErrAddressesHidden, err)
+	_, err = parseKallsyms(strings.NewReader("ffffffff81000000 T\n"))
+	assert.Error(t, err)
+	_, err = parseKallsyms(strings.NewReader("xyz T _text\n"))
+	assert.Error(t, err)
+}
+
+func TestTable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ksym")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	kallsyms := writeFile(t, dir, "kallsyms", testKallsyms)
+	modules := writeFile(t, dir, "modules", "x_tables 40960 1 - Live 0x0000000000000000\n")
+
+	table, err := NewTableFromFile(kallsyms, modules)
+	require.NoError(t, err)
+	assert.Equal(t, 6, table.Len())
+
+	// Address -> symbol
+	sym, offset, ok := table.LookupAddress(0xffffffff81001010)
+	require.True(t, ok)
+	assert.Equal(t, "do_one_initcall", sym.Name)
+	assert.Equal(t, uint64(0x10), offset)
+	_, _, ok = table.LookupAddress(0x1000)
+	assert.False(t, ok)
+
+	// Symbol -> address, duplicates resolve to first one
+	sym, ok = table.LookupName("static_fn")
+	require.True(t, ok)
+	assert.Equal(t, uint64(0xffffffff81002000), sym.Address)
+	assert.True(t, table.Exists("_text"))
+	assert.False(t, table.Exists("nf_conntrack_in"))
+	assert.Len(t, table.Names(), 5)
+	assert.Contains(t, table.Names(), "static_fn")
+
+	assert.Equal(t, []string{
+		"do_one_initcall+0x5",
+		"xt_match_open [x_tables]+0x0",
+		"0x10",
+	}, table.Symbolize([]uint64{0xffffffff81001005, 0xffffffffc0001000, 0x10, 0, 1}))
+
+	// Load new module: table must pick it up automatically
+	writeFile(t, dir, "kallsyms", testKallsyms+"ffffffffc0100000 t nf_conntrack_in\t[nf_conntrack]\n")
+	assert.False(t, table.Exists("nf_conntrack_in"))
+	writeFile(t, dir, "modules", "x_tables 40960 1 - Live 0x0000000000000000\n"+
+		"nf_conntrack 139264 1 - Live 0x0000000000000000\n")
+	assert.True(t, table.Exists("nf_conntrack_in"))
+	assert.Equal(t, 7, table.Len())
+}
@@ -0,0 +1,287 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_linkwatch keeps XDP / tc programs attached to network interfaces
+// which come and go: it subscribes to RTNETLINK link events and attaches configured
+// programs whenever matching interface appears, is renamed or is re-created
+// (bonding, VM hotplug, CNI plugins), so agents don't need own netlink loops:
+//
+//	w, err := goebpf_linkwatch.Watch(
+//		goebpf_linkwatch.Attachment{Interface: "eth*", Program: xdp, XdpMode: goebpf.XdpAttachModeSkb},
+//		goebpf_linkwatch.Attachment{Interface: "tap*", Program: cls, Direction: goebpf_tc.Ingress,
+//			Filter: goebpf_tc.Filter{Priority: 1, Handle: 1, DirectAction: true}},
+//	)
+//	defer w.Stop()
+//	for event := range w.Events() {
+//		if event.Err != nil {
+//			log.Printf("Unable to attach to %s: %v", event.Ifname, event.Err)
+//		}
+//	}
+//
+// Requires CAP_NET_ADMIN.
+package goebpf_linkwatch
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"runtime"
+	"sync"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+	"golang.org/x/sys/unix"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_tc"
+)
+
+// Attachment is program to keep attached to interfaces matching name / pattern
+type Attachment struct {
+	// Interface name or shell pattern (see path.Match()), e.g. "eth0" / "veth*"
+	Interface string
+	// XDP or tc (ProgramTypeSchedCls / ProgramTypeSchedAct) program
+	Program goebpf.Program
+	// Mode of XDP program
+	XdpMode goebpf.XdpAttachMode
+	// Hook and filter of tc program, Fd of filter is taken from Program.
+	// Priority and handle are required: filter is replaced if exists.
+	Direction goebpf_tc.Direction
+	Filter    goebpf_tc.Filter
+}
+
+func (a *Attachment) validate() error {
+	if a.Program == nil {
+		return errors.New("Program is required")
+	}
+	if _, err := path.Match(a.Interface, ""); err != nil || a.Interface == "" {
+		return fmt.Errorf("Invalid interface pattern '%s'", a.Interface)
+	}
+	switch a.Program.GetType() {
+	case goebpf.ProgramTypeXdp:
+	case goebpf.ProgramTypeSchedCls, goebpf.ProgramTypeSchedAct:
+		if a.Filter.Priority == 0 || a.Filter.Handle == 0 {
+			return fmt.Errorf("Priority and handle of filter are required for program '%s'",
+				a.Program.GetName())
+		}
+	default:
+		return fmt.Errorf("Program '%s' of type %v can't be attached to interface",
+			a.Program.GetName(), a.Program.GetType())
+	}
+
+	return nil
+}
+
+func (a *Attachment) matches(ifname string) bool {
+	ok, _ := path.Match(a.Interface, ifname)
+	return ok
+}
+
+// Event is result of attaching program to interface
+type Event struct {
+	Ifname  string
+	Ifindex int
+	Program goebpf.Program
+	// nil if program has been attached (or was attached already)
+	Err error
+}
+
+// Watcher attaches programs to interfaces as they appear, see Watch()
+type Watcher struct {
+	attachments []Attachment
+	// Program IDs, to find out if interface has program attached already
+	progIds  []int
+	ns       netns.NsHandle
+	events   chan Event
+	stop     chan struct{}
+	stopOnce sync.Once
+	err      error
+	// Names of interfaces seen by ifindex, to process only new / renamed ones
+	links map[int]string
+}
+
+// Watch starts goroutine which attaches programs to all existing interfaces
+// matching attachments and then to interfaces appearing later, reporting results
+// into Events() channel. Works in network namespace of calling thread.
+// Programs are left attached when watcher stops.
+func Watch(attachments ...Attachment) (*Watcher, error) {
+	w := &Watcher{
+		attachments: attachments,
+		events:      make(chan Event, 64),
+		stop:        make(chan struct{}),
+		links:       make(map[int]string),
+	}
+	for i := range attachments {
+		a := &attachments[i]
+		if err := a.validate(); err != nil {
+			return nil, err
+		}
+		info, err := goebpf.GetProgramInfoByFd(a.Program.GetFd())
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get info of program '%s': %v", a.Program.GetName(), err)
+		}
+		w.progIds = append(w.progIds, info.Id)
+	}
+
+	var err error
+	if w.ns, err = netns.Get(); err != nil {
+		return nil, fmt.Errorf("Unable to get current network namespace: %v", err)
+	}
+	// Subscription is made by run(), wait until it is either made or failed
+	started := make(chan error)
+	go w.run(started)
+	if err = <-started; err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// Events returns channel of attach results. Channel is closed when watcher stopped
+// either by Stop() or because of error, see Err().
+func (w *Watcher) Events() <-chan Event {
+	return w.events
+}
+
+// Err returns error caused watcher to stop. Valid after Events() channel closed.
+func (w *Watcher) Err() error {
+	return w.err
+}
+
+// Stop stops watching. Safe to call multiple times.
+func (w *Watcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+func (w *Watcher) run(started chan<- error) {
+	defer close(w.events)
+	defer w.ns.Close()
+
+	// Netlink requests are made in namespace of current thread, so goroutine
+	// stays on thread switched into watched namespace. Thread is never unlocked,
+	// therefore destroyed when goroutine exits.
+	runtime.LockOSThread()
+	if err := netns.Set(w.ns); err != nil {
+		started <- fmt.Errorf("Unable to switch network namespace: %v", err)
+		return
+	}
+
+	updates := make(chan netlink.LinkUpdate, 64)
+	done := make(chan struct{})
+	// Last error reported by subscription, the one which closed it
+	var errMu sync.Mutex
+	var subscribeErr error
+	err := netlink.LinkSubscribeWithOptions(updates, done, netlink.LinkSubscribeOptions{
+		ListExisting: true,
+		ErrorCallback: func(err error) {
+			errMu.Lock()
+			defer errMu.Unlock()
+			subscribeErr = err
+		},
+	})
+	if err != nil {
+		close(done)
+		started <- fmt.Errorf("Unable to subscribe to link updates: %v", err)
+		return
+	}
+	defer func() {
+		// Closes subscription socket, subscription goroutine closes updates
+		// then, it may be blocked on sending update until drained
+		close(done)
+		for range updates {
+		}
+	}()
+	started <- nil
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case update, ok := <-updates:
+			if !ok {
+				// Subscription is closed on receive errors only
+				errMu.Lock()
+				w.err = fmt.Errorf("Link subscription failed: %v", subscribeErr)
+				errMu.Unlock()
+				return
+			}
+			w.handleUpdate(update)
+		}
+	}
+}
+
+func (w *Watcher) handleUpdate(update netlink.LinkUpdate) {
+	attrs := update.Link.Attrs()
+	if update.Header.Type == unix.RTM_DELLINK {
+		delete(w.links, attrs.Index)
+		return
+	}
+	// Link updates are sent on every state change, programs survive them
+	// (and renames as well), so only new / renamed interfaces are processed
+	if name, ok := w.links[attrs.Index]; ok && name == attrs.Name {
+		return
+	}
+	w.links[attrs.Index] = attrs.Name
+
+	for i := range w.attachments {
+		a := &w.attachments[i]
+		if !a.matches(attrs.Name) {
+			continue
+		}
+		var err error
+		if a.Program.GetType() == goebpf.ProgramTypeXdp {
+			err = w.attachXdp(update.Link, a, w.progIds[i])
+		} else {
+			err = w.attachTc(attrs.Name, a, w.progIds[i])
+		}
+		select {
+		case w.events <- Event{Ifname: attrs.Name, Ifindex: attrs.Index, Program: a.Program, Err: err}:
+		case <-w.stop:
+			return
+		}
+	}
+}
+
+func (w *Watcher) attachXdp(link netlink.Link, a *Attachment, progId int) error {
+	attrs := link.Attrs()
+	if attrs.Xdp != nil && attrs.Xdp.Attached && int(attrs.Xdp.ProgId) == progId {
+		return nil
+	}
+	// Attached by ifindex rather than by Program.Attach(), so single
+	// program can be attached to any number of interfaces
+	err := goebpf.RetryTransient(func() error {
+		err := netlink.LinkSetXdpFdWithFlags(link, a.Program.GetFd(), int(a.XdpMode))
+		goebpf.RecordAudit(goebpf.AuditSourceNetlink, "LinkSetXdpFd", attrs.Name, err)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to attach XDP program '%s' to '%s': %v",
+			a.Program.GetName(), attrs.Name, err)
+	}
+
+	return nil
+}
+
+func (w *Watcher) attachTc(ifname string, a *Attachment, progId int) error {
+	if err := goebpf_tc.AddClsact(ifname); err != nil {
+		return err
+	}
+	filters, err := goebpf_tc.ListFilters(ifname, a.Direction)
+	if err != nil {
+		return err
+	}
+	for _, f := range filters {
+		if f.Priority == a.Filter.Priority && f.Handle == a.Filter.Handle && f.ProgramId == progId {
+			return nil
+		}
+	}
+	filter := a.Filter
+	filter.Fd = a.Program.GetFd()
+	if filter.Name == "" {
+		filter.Name = a.Program.GetName()
+	}
+
+	return goebpf_tc.ReplaceFilter(ifname, a.Direction, &filter)
+}
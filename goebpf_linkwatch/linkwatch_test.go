@@ -0,0 +1,51 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_linkwatch
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_fake"
+	"github.com/dropbox/goebpf/goebpf_tc"
+)
+
+func TestAttachmentValidate(t *testing.T) {
+	xdp := goebpf_fake.NewFakeProgram("xdp", goebpf.ProgramTypeXdp)
+	cls := goebpf_fake.NewFakeProgram("cls", goebpf.ProgramTypeSchedCls)
+	kprobe := goebpf_fake.NewFakeProgram("kprobe", goebpf.ProgramTypeKprobe)
+
+	assert.NoError(t, (&Attachment{Interface: "eth*", Program: xdp}).validate())
+	assert.NoError(t, (&Attachment{
+		Interface: "tap0",
+		Program:   cls,
+		Direction: goebpf_tc.Egress,
+		Filter:    goebpf_tc.Filter{Priority: 1, Handle: 1},
+	}).validate())
+
+	// No program / interface, malformed pattern
+	assert.Error(t, (&Attachment{Interface: "eth0"}).validate())
+	assert.Error(t, (&Attachment{Program: xdp}).validate())
+	assert.Error(t, (&Attachment{Interface: "eth[", Program: xdp}).validate())
+	// tc filter must be replaceable
+	assert.Error(t, (&Attachment{Interface: "tap0", Program: cls}).validate())
+	// Not a network program
+	assert.Error(t, (&Attachment{Interface: "eth0", Program: kprobe}).validate())
+
+	_, err := Watch(Attachment{Interface: "eth0", Program: kprobe})
+	assert.Error(t, err)
+}
+
+func TestAttachmentMatches(t *testing.T) {
+	a := &Attachment{Interface: "veth*"}
+	assert.True(t, a.matches("veth0"))
+	assert.True(t, a.matches("veth"))
+	assert.False(t, a.matches("eth0"))
+
+	a = &Attachment{Interface: "eth0"}
+	assert.True(t, a.matches("eth0"))
+	assert.False(t, a.matches("eth01"))
+}
@@ -0,0 +1,206 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_minisign verifies minisign (https://jedisct1.github.io/minisign/)
+// detached ed25519 signatures of ELF files before they are loaded, so only
+// approved eBPF artifacts run:
+//
+//	// minisign -S -m xdp.elf  (creates xdp.elf.minisig)
+//	key, err := goebpf_minisign.LoadPublicKey("/etc/bpf/minisign.pub")
+//	...
+//	verifier, err := goebpf_minisign.Verifier(key)
+//	...
+//	bpf := goebpf.NewDefaultEbpfSystem(goebpf.WithElfVerifier(verifier))
+//	err = bpf.LoadElf("xdp.elf")
+//
+// Both legacy and pre-hashed (default of recent minisign versions) signatures are supported.
+package goebpf_minisign
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+
+	"github.com/dropbox/goebpf"
+	"golang.org/x/crypto/blake2b"
+)
+
+const (
+	// SignatureSuffix is appended to name of signed file to get name of signature file
+	SignatureSuffix = ".minisig"
+
+	trustedCommentPrefix = "trusted comment: "
+)
+
+// Signature algorithms: ed25519 of file itself / of its BLAKE2b-512 digest
+var (
+	algLegacy    = [2]byte{'E', 'd'}
+	algPrehashed = [2]byte{'E', 'D'}
+)
+
+// PublicKey is minisign public key
+type PublicKey struct {
+	// Random key ID, signatures refer key they have been made by it
+	ID  [8]byte
+	Key ed25519.PublicKey
+}
+
+// String returns key ID the way minisign prints it
+func (k *PublicKey) String() string {
+	return keyIDString(k.ID)
+}
+
+func keyIDString(id [8]byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(id[:]))
+}
+
+// ParsePublicKey parses public key either as base64 string (minisign -P) or as
+// content of public key file (minisign.pub, with untrusted comment line)
+func ParsePublicKey(s string) (*PublicKey, error) {
+	lines := nonEmptyLines(s)
+	if len(lines) == 0 {
+		return nil, errors.New("Empty public key")
+	}
+	// Last line is key itself, comment precedes it
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[len(lines)-1]))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid public key: %v", err)
+	}
+	if len(raw) != 2+8+ed25519.PublicKeySize || !bytes.Equal(raw[:2], algLegacy[:]) {
+		return nil, errors.New("Invalid public key: not an ed25519 minisign key")
+	}
+
+	key := &PublicKey{Key: ed25519.PublicKey(raw[10:])}
+	copy(key.ID[:], raw[2:10])
+	return key, nil
+}
+
+// LoadPublicKey reads public key file, see ParsePublicKey()
+func LoadPublicKey(fn string) (*PublicKey, error) {
+	data, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	key, err := ParsePublicKey(string(data))
+	if err != nil {
+		return nil, fmt.Errorf("'%s': %v", fn, err)
+	}
+
+	return key, nil
+}
+
+// Signature is parsed minisign signature file
+type Signature struct {
+	Algorithm [2]byte
+	// ID of key signature has been made by
+	KeyID     [8]byte
+	Signature []byte
+	// Comment signed along with signature (e.g. timestamp / file name) and signature of both
+	TrustedComment  string
+	GlobalSignature []byte
+}
+
+// ParseSignature parses content of minisign signature file (.minisig)
+func ParseSignature(data []byte) (*Signature, error) {
+	lines := nonEmptyLines(string(data))
+	if len(lines) != 4 {
+		return nil, fmt.Errorf("Invalid signature: %d lines, expected 4", len(lines))
+	}
+
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(lines[1]))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid signature: %v", err)
+	}
+	if len(raw) != 2+8+ed25519.SignatureSize {
+		return nil, fmt.Errorf("Invalid signature: %d bytes", len(raw))
+	}
+	sig := &Signature{Signature: raw[10:]}
+	copy(sig.Algorithm[:], raw[:2])
+	copy(sig.KeyID[:], raw[2:10])
+	if sig.Algorithm != algLegacy && sig.Algorithm != algPrehashed {
+		return nil, fmt.Errorf("Invalid signature: unsupported algorithm '%s'", sig.Algorithm[:])
+	}
+
+	if !strings.HasPrefix(lines[2], trustedCommentPrefix) {
+		return nil, errors.New("Invalid signature: no trusted comment")
+	}
+	sig.TrustedComment = strings.TrimPrefix(lines[2], trustedCommentPrefix)
+	sig.GlobalSignature, err = base64.StdEncoding.DecodeString(strings.TrimSpace(lines[3]))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid signature: %v", err)
+	}
+	if len(sig.GlobalSignature) != ed25519.SignatureSize {
+		return nil, fmt.Errorf("Invalid signature: global signature is %d bytes", len(sig.GlobalSignature))
+	}
+
+	return sig, nil
+}
+
+// Verify checks that data is signed by key, along with trusted comment of signature
+func (k *PublicKey) Verify(data []byte, sig *Signature) error {
+	if sig.KeyID != k.ID {
+		return fmt.Errorf("Signed by key %s, not by %s", keyIDString(sig.KeyID), k)
+	}
+	message := data
+	if sig.Algorithm == algPrehashed {
+		digest := blake2b.Sum512(data)
+		message = digest[:]
+	}
+	if !ed25519.Verify(k.Key, message, sig.Signature) {
+		return errors.New("Signature verification failed")
+	}
+	global := append(append([]byte{}, sig.Signature...), sig.TrustedComment...)
+	if !ed25519.Verify(k.Key, global, sig.GlobalSignature) {
+		return errors.New("Trusted comment verification failed")
+	}
+
+	return nil
+}
+
+// Verifier returns ELF verifier (see goebpf.WithElfVerifier()) accepting files
+// signed by any of keys (e.g. old and new one during key rotation), with
+// signature in file next to ELF one (SignatureSuffix appended)
+func Verifier(keys ...*PublicKey) (goebpf.ElfVerifier, error) {
+	if len(keys) == 0 {
+		return nil, errors.New("No public keys to verify signatures by")
+	}
+	for idx, key := range keys {
+		if key == nil {
+			return nil, fmt.Errorf("Public key %d is nil", idx)
+		}
+	}
+
+	return func(fn string, data []byte) error {
+		sigData, err := ioutil.ReadFile(fn + SignatureSuffix)
+		if err != nil {
+			return err
+		}
+		sig, err := ParseSignature(sigData)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if key.ID == sig.KeyID {
+				return key.Verify(data, sig)
+			}
+		}
+		return fmt.Errorf("Signed by unknown key %s", keyIDString(sig.KeyID))
+	}, nil
+}
+
+// Splits text into lines, skipping empty ones
+func nonEmptyLines(s string) []string {
+	var res []string
+	for _, line := range strings.Split(s, "\n") {
+		// Trusted comment is signed as is, only line endings are stripped
+		if line = strings.TrimRight(line, "\r"); strings.TrimSpace(line) != "" {
+			res = append(res, line)
+		}
+	}
+	return res
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_minisign
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/blake2b"
+)
+
+// Test key pair in minisign format
+type testKey struct {
+	id   [8]byte
+	priv ed25519.PrivateKey
+	pub  string
+}
+
+func newTestKey(t *testing.T, id byte) *testKey {
+	pub, priv, err := ed25519.GenerateKey(nil)
+	require.NoError(t, err)
+	k := &testKey{id: [8]byte{id, 1, 2, 3, 4, 5, 6, 7}, priv: priv}
+	raw := append(append([]byte("Ed"), k.id[:]...), pub...)
+	k.pub = "untrusted comment: minisign public key\n" + base64.StdEncoding.EncodeToString(raw) + "\n"
+	return k
+}
+
+// Makes signature file, like "minisign -S [-l]"
+func (k *testKey) sign(data []byte, prehashed bool, comment string) []byte {
+	alg := "Ed"
+	message := data
+	if prehashed {
+		alg = "ED"
+		digest := blake2b.Sum512(data)
+		message = digest[:]
+	}
+	sig := ed25519.Sign(k.priv, message)
+	raw := append(append([]byte(alg), k.id[:]...), sig...)
+	global := ed25519.Sign(k.priv, append(append([]byte{}, sig...), comment...))
+	return []byte("untrusted comment: signature from minisign secret key\n" +
+		base64.StdEncoding.EncodeToString(raw) + "\n" +
+		"trusted comment: " + comment + "\n" +
+		base64.StdEncoding.EncodeToString(global) + "\n")
+}
+
+func TestParsePublicKey(t *testing.T) {
+	k := newTestKey(t, 0xab)
+	key, err := ParsePublicKey(k.pub)
+	require.NoError(t, err)
+	assert.Equal(t, k.id, key.ID)
+	assert.Equal(t, "07060504030201AB", key.String())
+	assert.Equal(t, ed25519.PublicKeySize, len(key.Key))
+
+	// Base64 only (minisign -P)
+	_, err = ParsePublicKey(nonEmptyLines(k.pub)[1])
+	assert.NoError(t, err)
+
+	for _, invalid := range []string{"", "untrusted comment: x\n", "!!!", base64.StdEncoding.EncodeToString([]byte("Ed123"))} {
+		_, err = ParsePublicKey(invalid)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	k := newTestKey(t, 1)
+	key, err := ParsePublicKey(k.pub)
+	require.NoError(t, err)
+	data := []byte("\x7fELF eBPF object")
+
+	for _, prehashed := range []bool{false, true} {
+		sig, err := ParseSignature(k.sign(data, prehashed, "timestamp:1700000000\tfile:xdp.elf"))
+		require.NoError(t, err)
+		assert.Equal(t, "timestamp:1700000000\tfile:xdp.elf", sig.TrustedComment)
+		assert.NoError(t, key.Verify(data, sig))
+
+		// Modified file / trusted comment
+		assert.EqualError(t, key.Verify([]byte("\x7fELF other object"), sig), "Signature verification failed")
+		sig.TrustedComment = "timestamp:1800000000"
+		assert.EqualError(t, key.Verify(data, sig), "Trusted comment verification failed")
+	}
+
+	// Signed by other key
+	other := newTestKey(t, 2)
+	sig, err := ParseSignature(other.sign(data, true, ""))
+	require.NoError(t, err)
+	assert.Error(t, key.Verify(data, sig))
+
+	// Malformed signature files
+	_, err = ParseSignature([]byte("untrusted comment: x\n"))
+	assert.Error(t, err)
+	valid := nonEmptyLines(string(k.sign(data, true, "c")))
+	_, err = ParseSignature([]byte(valid[0] + "\n" + valid[1] + "\ncomment\n" + valid[3]))
+	assert.Error(t, err)
+}
+
+func TestVerifier(t *testing.T) {
+	dir, err := ioutil.TempDir("", "goebpf_minisign")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	oldKey, newKey := newTestKey(t, 1), newTestKey(t, 2)
+	old, err := ParsePublicKey(oldKey.pub)
+	require.NoError(t, err)
+	cur, err := ParsePublicKey(newKey.pub)
+	require.NoError(t, err)
+	verify, err := Verifier(old, cur)
+	require.NoError(t, err)
+
+	fn := filepath.Join(dir, "xdp.elf")
+	data := []byte("\x7fELF eBPF object")
+	// No signature
+	assert.Error(t, verify(fn, data))
+
+	// Signed by any of keys
+	for _, k := range []*testKey{oldKey, newKey} {
+		require.NoError(t, ioutil.WriteFile(fn+SignatureSuffix, k.sign(data, true, ""), 0644))
+		assert.NoError(t, verify(fn, data))
+	}
+	// Content is not what has been signed
+	assert.Error(t, verify(fn, []byte("\x7fELF replaced")))
+	// Unknown key
+	require.NoError(t, ioutil.WriteFile(fn+SignatureSuffix, newTestKey(t, 3).sign(data, true, ""), 0644))
+	assert.EqualError(t, verify(fn, data), "Signed by unknown key 0706050403020103")
+
+	// Missing keys are rejected right away, not on first ELF file
+	_, err = Verifier()
+	assert.Error(t, err)
+	_, err = Verifier(old, nil)
+	assert.EqualError(t, err, "Public key 1 is nil")
+}
+
+// Fixture signed outside of this package (RFC 8032 Ed25519 over BLAKE2b-512
+// of python3 hashlib), in format of "minisign -S -m xdp.elf"
+func TestVerifierFixture(t *testing.T) {
+	key, err := LoadPublicKey("testdata/minisign.pub")
+	require.NoError(t, err)
+	assert.Equal(t, "7593F1E0A8B6C4D2", key.String())
+	data, err := ioutil.ReadFile("testdata/xdp.elf")
+	require.NoError(t, err)
+
+	verify, err := Verifier(key)
+	require.NoError(t, err)
+	assert.NoError(t, verify("testdata/xdp.elf", data))
+	data[len(data)-1] ^= 1
+	assert.Error(t, verify("testdata/xdp.elf", data))
+
+	sigData, err := ioutil.ReadFile("testdata/xdp.elf" + SignatureSuffix)
+	require.NoError(t, err)
+	sig, err := ParseSignature(sigData)
+	require.NoError(t, err)
+	assert.Equal(t, "timestamp:1700000000\tfile:xdp.elf\thashed", sig.TrustedComment)
+}
@@ -46,6 +46,25 @@ func (m *MockSystem) GetMapByName(name string) goebpf.Map {
 	return nil
 }
 
+// SetLogger does nothing, just a mock for original SetLogger
+func (m *MockSystem) SetLogger(l goebpf.Logger) {
+}
+
+// Reload does nothing, just a mock for original Reload
+func (m *MockSystem) Reload(fn string) error {
+	return nil
+}
+
+// GetElfWarnings returns nothing, just a mock for original GetElfWarnings
+func (m *MockSystem) GetElfWarnings() []goebpf.ElfWarning {
+	return nil
+}
+
+// Close does nothing, just a mock for original Close
+func (m *MockSystem) Close() error {
+	return nil
+}
+
 // GetProgramByName returns eBPF program by name or nil if not found
 func (m *MockSystem) GetProgramByName(name string) goebpf.Program {
 	if result, ok := m.Programs[name]; ok {
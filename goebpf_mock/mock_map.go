@@ -266,6 +266,43 @@ int bpf_map_lookup_elem_golang(const void *fd, const void *key, void *buf)
 	return 0;
 }
 
+// BPF get next key - implementation for GO
+// Returns 0 on success, 1 when there is no more keys, -1 on error
+int bpf_map_get_next_key_golang(const void *fd, const void *key, void *next_key)
+{
+	struct __create_map_def *map = bpf_map_find(fd);
+
+	// If map not found
+	if (!map) {
+		return -1;
+	}
+
+	// Array based maps: all items are present all times, key is just index
+	if (is_map_type_array(map->map_def)) {
+		__u32 next = key ? *((__u32*)key) + 1 : 0;
+		if (next >= map->map_def->max_entries) {
+			return 1;
+		}
+		memcpy(next_key, &next, sizeof(next));
+		return 0;
+	}
+
+	// Hash based maps: follow the list, start from first
+	// item when key is NULL or not present in map (same as kernel does)
+	struct bpf_map_data_head *head = (struct bpf_map_data_head*) &map->map_data;
+	struct bpf_map_item *item = NULL;
+	if (key) {
+		item = bpf_find_item_by_key(map, key);
+	}
+	item = item ? SLIST_NEXT(item, next) : SLIST_FIRST(head);
+	if (!item) {
+		return 1;
+	}
+	memcpy(next_key, item->key, map->map_def->key_size);
+
+	return 0;
+}
+
 // Returns map fd / fixes key / value sizes since they may be
 // omitted in definition.
 static void* fix_def_and_get_map_fd(struct __create_map_def* item)
@@ -300,6 +337,8 @@ import "C"
 
 import (
 	"errors"
+	"fmt"
+	"syscall"
 	"unsafe"
 
 	"github.com/dropbox/goebpf"
@@ -408,12 +447,34 @@ func (m *MockMap) Lookup(ikey interface{}) ([]byte, error) {
 	)
 
 	if res != 0 {
-		return nil, errors.New("bpf_map_lookup_elem_golang() failed (not found?)")
+		// Mimic kernel behavior, so callers can check for goebpf.ErrKeyNotExist
+		return nil, &goebpf.SyscallError{
+			Op:    "bpf_map_lookup_elem_golang()",
+			Errno: syscall.ENOENT,
+			Msg:   "not found",
+		}
 	}
 
 	return val, nil
 }
 
+// LookupInto performs lookup of raw key and copies value into dst
+func (m *MockMap) LookupInto(key []byte, dst []byte) error {
+	if len(key) != m.KeySize {
+		return fmt.Errorf("Invalid key size %d, must be %d bytes", len(key), m.KeySize)
+	}
+	if len(dst) < m.ValueSize {
+		return fmt.Errorf("Buffer is too small (%d), value size is %d bytes", len(dst), m.ValueSize)
+	}
+	val, err := m.Lookup(key)
+	if err != nil {
+		return err
+	}
+	copy(dst, val)
+
+	return nil
+}
+
 // LookupString perform lookup and returns GO string from NULL terminated C string
 func (m *MockMap) LookupString(ikey interface{}) (string, error) {
 	val, err := m.Lookup(ikey)
@@ -441,7 +502,7 @@ func (m *MockMap) LookupUint64(ikey interface{}) (uint64, error) {
 		return 0, err
 	}
 
-	return goebpf.ParseFlexibleIntegerLittleEndian(val), nil
+	return goebpf.ParseFlexibleInteger(val), nil
 }
 
 // Insert insert new element into mock map.
@@ -511,6 +572,36 @@ func (m *MockMap) Delete(ikey interface{}) error {
 	return nil
 }
 
+// GetNextKey returns key next to ikey, nil ikey - to get first one.
+// Returns goebpf.ErrNoMoreKeys when end of mock map reached.
+func (m *MockMap) GetNextKey(ikey interface{}) ([]byte, error) {
+	var keyPtr unsafe.Pointer
+	if ikey != nil {
+		// Convert key into bytes
+		key, err := goebpf.KeyValueToBytes(ikey, m.KeySize)
+		if err != nil {
+			return nil, err
+		}
+		keyPtr = unsafe.Pointer(&key[0])
+	}
+
+	// Buffer where C part will copy next key into
+	var nextKey = make([]byte, m.KeySize)
+	res := C.bpf_map_get_next_key_golang(m.fd,
+		keyPtr,
+		unsafe.Pointer(&nextKey[0]),
+	)
+
+	switch res {
+	case 0:
+		return nextKey, nil
+	case 1:
+		return nil, goebpf.ErrNoMoreKeys
+	}
+
+	return nil, errors.New("bpf_map_get_next_key_golang() failed")
+}
+
 // GetFd returns mock file descriptor of map
 func (m *MockMap) GetFd() int {
 	return int(uintptr(m.fd))
@@ -4,6 +4,7 @@
 package goebpf_mock
 
 import (
+	"encoding/binary"
 	"testing"
 	"unsafe"
 
@@ -167,6 +168,52 @@ func TestMockMapHash(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestMockMapGetNextKey(t *testing.T) {
+	// Hash: iterate over all inserted items
+	m := &MockMap{
+		Type:       goebpf.MapTypeHash,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 10,
+	}
+	err := m.Create()
+	require.NoError(t, err)
+
+	// Empty map
+	_, err = m.GetNextKey(nil)
+	assert.Equal(t, goebpf.ErrNoMoreKeys, err)
+
+	expected := map[uint32]bool{1: true, 2: true, 3: true}
+	for k := range expected {
+		err = m.Insert(k, 100)
+		assert.NoError(t, err)
+	}
+	found := map[uint32]bool{}
+	key, err := m.GetNextKey(nil)
+	for ; err == nil; key, err = m.GetNextKey(key) {
+		found[binary.LittleEndian.Uint32(key)] = true
+	}
+	assert.Equal(t, goebpf.ErrNoMoreKeys, err)
+	assert.Equal(t, expected, found)
+
+	// Array: all indexes are present
+	a := &MockMap{
+		Type:       goebpf.MapTypeArray,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 3,
+	}
+	err = a.Create()
+	require.NoError(t, err)
+	var indexes []uint32
+	key, err = a.GetNextKey(nil)
+	for ; err == nil; key, err = a.GetNextKey(key) {
+		indexes = append(indexes, binary.LittleEndian.Uint32(key))
+	}
+	assert.Equal(t, goebpf.ErrNoMoreKeys, err)
+	assert.Equal(t, []uint32{0, 1, 2}, indexes)
+}
+
 func TestArrayOfMaps(t *testing.T) {
 	// Inner map
 	template := MockMap{
@@ -0,0 +1,104 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_packet
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Ones' complement sum of 16 bit words of data in byte order bo, odd byte is
+// padded with zero. Inverted words are subtracted, i.e. removed from sum.
+func onesSum(bo binary.ByteOrder, data []byte, invert bool) uint64 {
+	var sum uint64
+	for i := 0; i < len(data); i += 2 {
+		var w uint16
+		if i+1 < len(data) {
+			w = bo.Uint16(data[i:])
+		} else {
+			w = bo.Uint16([]byte{data[i], 0})
+		}
+		if invert {
+			w = ^w
+		}
+		sum += uint64(w)
+	}
+
+	return sum
+}
+
+func fold(sum uint64) uint16 {
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+
+	return uint16(sum)
+}
+
+// Checksum returns Internet checksum (RFC 1071) of data, e.g. of IPv4 header
+// with checksum field zeroed, as value of checksum field (big endian)
+func Checksum(data []byte) uint16 {
+	return ^fold(onesSum(binary.BigEndian, data, false))
+}
+
+// CsumReplace returns checksum csum (big endian) updated for bytes from
+// replaced with bytes to (RFC 1624), the way bpf_l3_csum_replace() /
+// bpf_l4_csum_replace() with size 2 / 4 do. Bytes must be 2 byte aligned
+// within checksummed data. UDP checksum of zero must be sent as 0xffff
+// (what BPF_F_MARK_MANGLED_0 does).
+func CsumReplace(csum uint16, from, to []byte) uint16 {
+	sum := uint64(^csum) + onesSum(binary.BigEndian, from, true) + onesSum(binary.BigEndian, to, false)
+
+	return ^fold(sum)
+}
+
+// CsumDiff returns checksum difference of replacing bytes from with bytes
+// to, like bpf_csum_diff() does. It is in host byte order, ready to be put
+// into map values: programs pass it to bpf_l3_csum_replace() /
+// bpf_l4_csum_replace() as "to" argument, with "from" and size of zero.
+func CsumDiff(from, to []byte) uint32 {
+	bo := goebpf.HostByteOrder()
+
+	return uint32(fold(onesSum(bo, from, true) + onesSum(bo, to, false)))
+}
+
+// CsumReplaceByDiff returns checksum csum (big endian) updated by diff
+// returned by CsumDiff(), the way bpf_l3_csum_replace() with size of zero does
+func CsumReplaceByDiff(csum uint16, diff uint32) uint16 {
+	bo := goebpf.HostByteOrder()
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], csum)
+	sum := uint64(^bo.Uint16(b[:])) + uint64(diff)
+	bo.PutUint16(b[:], ^fold(sum))
+
+	return binary.BigEndian.Uint16(b[:])
+}
+
+// RewriteDiff returns checksum differences (see CsumDiff) of NAT rewriting
+// address / port of packet: l3 for IPv4 header checksum (zero for IPv6 which
+// has no header checksum), l4 for TCP / UDP checksum covering pseudo header.
+func RewriteDiff(fromIP, toIP net.IP, fromPort, toPort uint16) (l3, l4 uint32, err error) {
+	from, to := fromIP.To4(), toIP.To4()
+	if from == nil || to == nil {
+		if from != nil || to != nil {
+			return 0, 0, fmt.Errorf("Address families of %v and %v differ", fromIP, toIP)
+		}
+		from, to = fromIP.To16(), toIP.To16()
+		if from == nil || to == nil {
+			return 0, 0, fmt.Errorf("Invalid IP addresses %v, %v", fromIP, toIP)
+		}
+	} else {
+		l3 = CsumDiff(from, to)
+	}
+
+	var fromPortBytes, toPortBytes [2]byte
+	binary.BigEndian.PutUint16(fromPortBytes[:], fromPort)
+	binary.BigEndian.PutUint16(toPortBytes[:], toPort)
+	l4 = CsumDiff(append(append([]byte{}, from...), fromPortBytes[:]...), append(append([]byte{}, to...), toPortBytes[:]...))
+
+	return l3, l4, nil
+}
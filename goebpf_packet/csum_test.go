@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_packet
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// IPv4 header with zero checksum, 192.168.0.1 -> 192.168.0.199
+var csumHeader = []byte{
+	0x45, 0x00, 0x00, 0x73, 0x00, 0x00, 0x40, 0x00, 0x40, 0x11, 0x00, 0x00,
+	0xc0, 0xa8, 0x00, 0x01, 0xc0, 0xa8, 0x00, 0xc7,
+}
+
+func TestChecksum(t *testing.T) {
+	assert.Equal(t, uint16(0xb861), Checksum(csumHeader))
+	// Odd length is padded with zero
+	assert.Equal(t, Checksum([]byte{1, 2, 3, 0}), Checksum([]byte{1, 2, 3}))
+}
+
+func TestCsumReplace(t *testing.T) {
+	hdr := append([]byte{}, csumHeader...)
+	csum := Checksum(hdr)
+	from := append([]byte{}, hdr[16:20]...)
+	to := net.ParseIP("10.1.2.3").To4()
+	copy(hdr[16:20], to)
+	expected := Checksum(hdr)
+
+	assert.Equal(t, expected, CsumReplace(csum, from, to))
+	diff := CsumDiff(from, to)
+	assert.Equal(t, expected, CsumReplaceByDiff(csum, diff))
+	// Reverse change
+	assert.Equal(t, csum, CsumReplaceByDiff(expected, CsumDiff(to, from)))
+	assert.Equal(t, csum, CsumReplaceByDiff(csum, CsumDiff(from, from)))
+}
+
+// UDP checksum over IPv4 / IPv6 pseudo header
+func udpChecksum(src, dst net.IP, udp []byte) uint16 {
+	pseudo := append(append([]byte{}, src...), dst...)
+	pseudo = append(pseudo, 0, 0, byte(len(udp)>>8), byte(len(udp)), 0, 0, 0, ProtoUDP)
+	return Checksum(append(pseudo, udp...))
+}
+
+func TestRewriteDiff(t *testing.T) {
+	cases := []struct {
+		from, to string
+	}{
+		{"192.168.0.1", "10.0.0.7"},
+		{"fc00::1", "2001:db8::42"},
+	}
+	for _, c := range cases {
+		from, to := net.ParseIP(c.from), net.ParseIP(c.to)
+		if from.To4() != nil {
+			from, to = from.To4(), to.To4()
+		}
+		pkt := append(udp(5000, 53), []byte("query")...)
+		binary.BigEndian.PutUint16(pkt[4:], uint16(len(pkt)))
+		dst := net.ParseIP("192.168.0.199").To4()
+		if from.To4() == nil {
+			dst = net.ParseIP("fc00::ff")
+		}
+		csum := udpChecksum(from, dst, pkt)
+
+		l3, l4, err := RewriteDiff(from, to, 5000, 6000)
+		require.NoError(t, err)
+		binary.BigEndian.PutUint16(pkt[0:], 6000)
+		assert.Equal(t, udpChecksum(to, dst, pkt), CsumReplaceByDiff(csum, l4), c.from)
+		if from.To4() == nil {
+			assert.Equal(t, uint32(0), l3)
+		} else {
+			hdr := append([]byte{}, csumHeader...)
+			copy(hdr[12:16], to)
+			assert.Equal(t, Checksum(hdr), CsumReplaceByDiff(Checksum(csumHeader), l3))
+		}
+	}
+
+	_, _, err := RewriteDiff(net.ParseIP("10.0.0.1"), net.ParseIP("fc00::1"), 1, 2)
+	assert.Error(t, err)
+	_, _, err = RewriteDiff(nil, nil, 1, 2)
+	assert.Error(t, err)
+}
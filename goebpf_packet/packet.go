@@ -0,0 +1,156 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_packet decodes packets (or their beginnings) delivered to Go
+// by programs through perf event / ring buffer samples, following the same
+// logic BPF parsers commonly use, so userspace sees what program has matched:
+//
+//   - Ethernet, up to MaxVLANs 802.1Q / 802.1ad tags
+//   - IPv4 (options skipped), IPv6 (up to MaxExtHeaders extension headers skipped)
+//   - TCP / UDP ports, TCP flags, ICMP / ICMPv6 type and code; non-first
+//     fragments have no L4 header
+//   - GTP-U, VXLAN and GENEVE tunnels (by well known UDP destination port),
+//     single level: inner packet is decoded, tunnels inside of it are not
+//   - QUIC long header (UDP port 443): version, connection IDs
+//
+// Samples are often truncated by program, so headers must be complete,
+// while payload may be shorter than headers claim:
+//
+//	pkt, err := goebpf_packet.Parse(sample)
+//	if err != nil {
+//		...
+//	}
+//	if pkt.Inner != nil {
+//		fmt.Println(pkt.Tunnel, pkt.TunnelID, pkt.Inner.Src, pkt.Inner.Dst)
+//	}
+//
+// Checksum helpers follow semantics of bpf_csum_diff() / bpf_l3_csum_replace() /
+// bpf_l4_csum_replace(), so checksum deltas of rewrites (e.g. NAT entries) can
+// be computed in Go and stored in maps for programs to apply:
+//
+//	l3, l4, err := goebpf_packet.RewriteDiff(origIP, natIP, origPort, natPort)
+package goebpf_packet
+
+import (
+	"fmt"
+	"net"
+)
+
+const (
+	// MaxVLANs is how many VLAN tags are skipped
+	MaxVLANs = 2
+	// MaxExtHeaders is how many IPv6 extension headers are skipped
+	MaxExtHeaders = 4
+
+	// Well known UDP ports of tunnels / QUIC
+	GTPUPort   = 2152
+	VXLANPort  = 4789
+	GenevePort = 6081
+	QUICPort   = 443
+)
+
+// EtherType values, IP protocol numbers
+const (
+	EthPIPv4   = 0x0800
+	EthPIPv6   = 0x86dd
+	EthP8021Q  = 0x8100
+	EthP8021AD = 0x88a8
+	// Transparent Ethernet bridging, protocol type of GENEVE carrying Ethernet
+	EthPTEB = 0x6558
+
+	ProtoICMP   = 1
+	ProtoTCP    = 6
+	ProtoUDP    = 17
+	ProtoICMPv6 = 58
+)
+
+// TCP flags
+const (
+	TCPFlagFIN = 0x01
+	TCPFlagSYN = 0x02
+	TCPFlagRST = 0x04
+	TCPFlagPSH = 0x08
+	TCPFlagACK = 0x10
+	TCPFlagURG = 0x20
+	TCPFlagECE = 0x40
+	TCPFlagCWR = 0x80
+)
+
+// TunnelType is encapsulation packet carries inner packet with
+type TunnelType int
+
+const (
+	TunnelNone TunnelType = iota
+	TunnelGTPU
+	TunnelVXLAN
+	TunnelGeneve
+)
+
+func (t TunnelType) String() string {
+	switch t {
+	case TunnelNone:
+		return "none"
+	case TunnelGTPU:
+		return "GTP-U"
+	case TunnelVXLAN:
+		return "VXLAN"
+	case TunnelGeneve:
+		return "GENEVE"
+	}
+
+	return fmt.Sprintf("TunnelType(%d)", int(t))
+}
+
+// Packet is decoded headers of packet. Slices point into parsed data.
+type Packet struct {
+	// Ethernet addresses, nil when parsing started from IP header
+	SrcMAC net.HardwareAddr
+	DstMAC net.HardwareAddr
+	// VLAN IDs, outermost first
+	VLANs []uint16
+	// EtherType of L3 header (after VLAN tags)
+	EtherType uint16
+
+	// IP version: 4 / 6, or 0 for non IP packets
+	Version int
+	Src     net.IP
+	Dst     net.IP
+	// L4 protocol, after IPv6 extension headers
+	Protocol uint8
+	// TTL / hop limit
+	TTL uint8
+	// Fragment is set for non-first fragments, they have no L4 header
+	Fragment bool
+
+	// TCP / UDP ports
+	SrcPort uint16
+	DstPort uint16
+	// Flags of TCP header
+	TCPFlags uint8
+	// Type / code of ICMP / ICMPv6 header
+	ICMPType uint8
+	ICMPCode uint8
+
+	// Payload following the last decoded header
+	Payload []byte
+
+	// Tunnel encapsulation: GTP-U TEID / VXLAN, GENEVE VNI and inner packet.
+	// Inner is nil for GTP-U messages other than G-PDU.
+	Tunnel   TunnelType
+	TunnelID uint32
+	Inner    *Packet
+
+	// QUIC long header of UDP packet, if any
+	QUIC *QUIC
+}
+
+// QUIC is long header of QUIC packet (Initial / 0-RTT / Handshake / Retry),
+// short header packets can't be reliably told apart from other UDP traffic.
+type QUIC struct {
+	// Version, 0 for version negotiation packets
+	Version uint32
+	// Long packet type, meaning depends on version (QUIC v1: 0 - Initial ... 3 - Retry)
+	Type uint8
+	DCID []byte
+	SCID []byte
+}
@@ -0,0 +1,215 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_packet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func concat(parts ...[]byte) []byte {
+	var res []byte
+	for _, part := range parts {
+		res = append(res, part...)
+	}
+	return res
+}
+
+func eth(etherType ...byte) []byte {
+	return concat(
+		[]byte{2, 0, 0, 0, 0, 2},
+		[]byte{2, 0, 0, 0, 0, 1},
+		etherType,
+	)
+}
+
+// Total length / checksum are not used by parser
+func ipv4(proto byte, src, dst string) []byte {
+	return concat(
+		[]byte{0x45, 0, 0, 0, 0, 0, 0, 0, 64, proto, 0, 0},
+		net.ParseIP(src).To4(),
+		net.ParseIP(dst).To4(),
+	)
+}
+
+func ipv6(next byte, src, dst string) []byte {
+	return concat(
+		[]byte{0x60, 0, 0, 0, 0, 0, next, 32},
+		net.ParseIP(src),
+		net.ParseIP(dst),
+	)
+}
+
+func udp(sport, dport uint16) []byte {
+	return []byte{byte(sport >> 8), byte(sport), byte(dport >> 8), byte(dport), 0, 0, 0, 0}
+}
+
+func TestParseTCP(t *testing.T) {
+	tcp := []byte{0x30, 0x39, 0, 80, 0, 0, 0, 1, 0, 0, 0, 0, 0x60, TCPFlagSYN | TCPFlagACK, 0, 0, 0, 0, 0, 0, 2, 4, 5, 0xb4}
+	// VLAN 100 inside of 802.1ad VLAN 200, Ethernet padding
+	data := concat(eth(0x88, 0xa8), []byte{0, 200, 0x81, 0x00, 0x20, 100, 0x08, 0x00}, ipv4(ProtoTCP, "10.0.0.1", "10.0.0.2"), tcp, []byte("GET"))
+	data[ethHeaderSize+8+3] = byte(ipv4HeaderSize + len(tcp) + 3)
+	data = append(data, 0, 0, 0)
+
+	p, err := Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, "02:00:00:00:00:01", p.SrcMAC.String())
+	assert.Equal(t, "02:00:00:00:00:02", p.DstMAC.String())
+	assert.Equal(t, []uint16{200, 100}, p.VLANs)
+	assert.Equal(t, uint16(EthPIPv4), p.EtherType)
+	assert.Equal(t, 4, p.Version)
+	assert.Equal(t, "10.0.0.1", p.Src.String())
+	assert.Equal(t, "10.0.0.2", p.Dst.String())
+	assert.Equal(t, uint8(ProtoTCP), p.Protocol)
+	assert.Equal(t, uint8(64), p.TTL)
+	assert.Equal(t, uint16(12345), p.SrcPort)
+	assert.Equal(t, uint16(80), p.DstPort)
+	assert.Equal(t, uint8(TCPFlagSYN|TCPFlagACK), p.TCPFlags)
+	assert.Equal(t, "GET", string(p.Payload))
+	assert.Equal(t, TunnelNone, p.Tunnel)
+
+	// TCP header is truncated
+	_, err = Parse(data[:ethHeaderSize+8+ipv4HeaderSize+20])
+	assert.Error(t, err)
+}
+
+func TestParseIPv6(t *testing.T) {
+	// Hop-by-hop options, then first fragment
+	data := concat(
+		ipv6(protoHopByHop, "fc00::1", "fc00::2"),
+		[]byte{protoFragment, 0, 1, 4, 0, 0, 0, 0},
+		[]byte{ProtoICMPv6, 0, 0, 0, 0, 0, 0, 1},
+		[]byte{128, 0, 0, 0, 0, 1, 0, 1},
+	)
+	p, err := ParseIP(data)
+	require.NoError(t, err)
+	assert.Nil(t, p.SrcMAC)
+	assert.Equal(t, uint16(EthPIPv6), p.EtherType)
+	assert.Equal(t, 6, p.Version)
+	assert.Equal(t, "fc00::1", p.Src.String())
+	assert.Equal(t, uint8(32), p.TTL)
+	assert.Equal(t, uint8(ProtoICMPv6), p.Protocol)
+	assert.False(t, p.Fragment)
+	assert.Equal(t, uint8(128), p.ICMPType)
+
+	// Non-first fragment has no L4 header
+	data[ipv6HeaderSize+8+3] = 0x08
+	p, err = ParseIP(data)
+	require.NoError(t, err)
+	assert.True(t, p.Fragment)
+	assert.Equal(t, uint8(0), p.ICMPType)
+	assert.Len(t, p.Payload, 8)
+
+	_, err = ParseIP(data[:ipv6HeaderSize+4])
+	assert.Error(t, err)
+	_, err = ParseIP([]byte{0x50})
+	assert.Error(t, err)
+	_, err = Parse(data[:10])
+	assert.Error(t, err)
+}
+
+func TestParseGTPU(t *testing.T) {
+	inner := concat(ipv4(ProtoUDP, "10.45.0.2", "8.8.8.8"), udp(1000, 53), []byte("dns"))
+	// Extension header (PDU session container), then inner packet
+	data := concat(
+		eth(0x86, 0xdd),
+		ipv6(ProtoUDP, "fc00::1", "fc00::2"),
+		udp(2152, GTPUPort),
+		[]byte{0x34, gtpuTypeGPDU, 0, 0, 0, 0, 0x12, 0x34, 0, 0, 0, 0x85},
+		[]byte{1, 0x10, 9, 0},
+		inner,
+	)
+	p, err := Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, TunnelGTPU, p.Tunnel)
+	assert.Equal(t, uint32(0x1234), p.TunnelID)
+	require.NotNil(t, p.Inner)
+	assert.Equal(t, "10.45.0.2", p.Inner.Src.String())
+	assert.Equal(t, "8.8.8.8", p.Inner.Dst.String())
+	assert.Equal(t, uint16(53), p.Inner.DstPort)
+	assert.Equal(t, "dns", string(p.Inner.Payload))
+
+	// Echo request carries no packet
+	data[ethHeaderSize+ipv6HeaderSize+udpHeaderSize+1] = 1
+	p, err = Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, TunnelGTPU, p.Tunnel)
+	assert.Nil(t, p.Inner)
+
+	// Extension header of zero length
+	data[ethHeaderSize+ipv6HeaderSize+udpHeaderSize+12] = 0
+	_, err = Parse(data)
+	assert.Error(t, err)
+}
+
+func TestParseVXLAN(t *testing.T) {
+	inner := concat(eth(0x86, 0xdd), ipv6(ProtoTCP, "fd00::1", "fd00::2"), make([]byte, 20))
+	inner[len(inner)-20+12] = 0x50
+	// Tunnel inside of tunnel is not decoded
+	innerUDP := concat(eth(0x08, 0x00), ipv4(ProtoUDP, "10.1.0.1", "10.1.0.2"), udp(1, VXLANPort), []byte{0x08, 0, 0, 0, 0, 0, 1, 0})
+
+	for _, pkt := range [][]byte{inner, innerUDP} {
+		data := concat(eth(0x08, 0x00), ipv4(ProtoUDP, "192.0.2.1", "192.0.2.2"), udp(50000, VXLANPort), []byte{0x08, 0, 0, 0, 0, 0, 42, 0}, pkt)
+		p, err := Parse(data)
+		require.NoError(t, err)
+		assert.Equal(t, TunnelVXLAN, p.Tunnel)
+		assert.Equal(t, uint32(42), p.TunnelID)
+		require.NotNil(t, p.Inner)
+		assert.Equal(t, TunnelNone, p.Inner.Tunnel)
+		assert.Nil(t, p.Inner.Inner)
+	}
+
+	data := concat(eth(0x08, 0x00), ipv4(ProtoUDP, "192.0.2.1", "192.0.2.2"), udp(50000, VXLANPort), []byte{0, 0, 0, 0, 0, 0, 42, 0}, inner)
+	_, err := Parse(data)
+	assert.Error(t, err)
+}
+
+func TestParseGeneve(t *testing.T) {
+	// Option of 4 bytes, inner IPv4
+	data := concat(
+		eth(0x08, 0x00),
+		ipv4(ProtoUDP, "192.0.2.1", "192.0.2.2"),
+		udp(50000, GenevePort),
+		[]byte{0x01, 0, 0x08, 0x00, 0x12, 0x34, 0x56, 0, 0, 0, 0, 0},
+		ipv4(ProtoICMP, "10.0.0.1", "10.0.0.2"),
+		[]byte{8, 0, 0, 0, 0, 0, 0, 0},
+	)
+	p, err := Parse(data)
+	require.NoError(t, err)
+	assert.Equal(t, TunnelGeneve, p.Tunnel)
+	assert.Equal(t, uint32(0x123456), p.TunnelID)
+	require.NotNil(t, p.Inner)
+	assert.Equal(t, uint8(ProtoICMP), p.Inner.Protocol)
+	assert.Equal(t, uint8(8), p.Inner.ICMPType)
+	assert.Equal(t, "TunnelType(7)", TunnelType(7).String())
+	assert.Equal(t, "GENEVE", p.Tunnel.String())
+}
+
+func TestParseQUIC(t *testing.T) {
+	// QUIC v1 Initial
+	initial := []byte{0xc3, 0, 0, 0, 1, 4, 1, 2, 3, 4, 2, 5, 6, 0, 0x41}
+	data := concat(ipv6(ProtoUDP, "fc00::1", "fc00::2"), udp(50000, QUICPort), initial)
+	p, err := ParseIP(data)
+	require.NoError(t, err)
+	require.NotNil(t, p.QUIC)
+	assert.Equal(t, uint32(1), p.QUIC.Version)
+	assert.Equal(t, uint8(0), p.QUIC.Type)
+	assert.Equal(t, []byte{1, 2, 3, 4}, p.QUIC.DCID)
+	assert.Equal(t, []byte{5, 6}, p.QUIC.SCID)
+
+	// Short header / truncated / other ports
+	invalid := [][]byte{
+		concat(ipv6(ProtoUDP, "fc00::1", "fc00::2"), udp(QUICPort, 50000), []byte{0x40, 1, 2, 3, 4, 5, 6}),
+		concat(ipv6(ProtoUDP, "fc00::1", "fc00::2"), udp(50000, QUICPort), initial[:8]),
+		concat(ipv6(ProtoUDP, "fc00::1", "fc00::2"), udp(50000, 8443), initial),
+	}
+	for _, data := range invalid {
+		p, err = ParseIP(data)
+		require.NoError(t, err)
+		assert.Nil(t, p.QUIC)
+	}
+}
@@ -0,0 +1,371 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_packet
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	ethHeaderSize    = 14
+	vlanHeaderSize   = 4
+	ipv4HeaderSize   = 20
+	ipv6HeaderSize   = 40
+	tcpHeaderSize    = 20
+	udpHeaderSize    = 8
+	icmpHeaderSize   = 8
+	tunnelHeaderSize = 8
+	// GTP-U header with sequence number / N-PDU number / next extension type
+	gtpuOptHeaderSize = 12
+	gtpuTypeGPDU      = 0xff
+)
+
+// IPv6 extension headers
+const (
+	protoHopByHop = 0
+	protoRouting  = 43
+	protoFragment = 44
+	protoAH       = 51
+	protoDstOpts  = 60
+)
+
+func errTruncated(header string) error {
+	return fmt.Errorf("%s header is truncated", header)
+}
+
+// Parse decodes packet starting with Ethernet header
+func Parse(data []byte) (*Packet, error) {
+	p := &Packet{}
+	if err := p.parseEthernet(data, true); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// ParseIP decodes packet starting with IPv4 / IPv6 header, as seen by
+// programs working with L3 packets (e.g. cgroup skb, lightweight tunnels)
+func ParseIP(data []byte) (*Packet, error) {
+	p := &Packet{}
+	if err := p.parseIP(data, true); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+func (p *Packet) parseEthernet(data []byte, tunnels bool) error {
+	if len(data) < ethHeaderSize {
+		return errTruncated("Ethernet")
+	}
+	p.DstMAC = net.HardwareAddr(data[0:6])
+	p.SrcMAC = net.HardwareAddr(data[6:12])
+	p.EtherType = binary.BigEndian.Uint16(data[12:])
+	off := ethHeaderSize
+	for i := 0; i < MaxVLANs && (p.EtherType == EthP8021Q || p.EtherType == EthP8021AD); i++ {
+		if len(data) < off+vlanHeaderSize {
+			return errTruncated("VLAN")
+		}
+		p.VLANs = append(p.VLANs, binary.BigEndian.Uint16(data[off:])&0x0fff)
+		p.EtherType = binary.BigEndian.Uint16(data[off+2:])
+		off += vlanHeaderSize
+	}
+
+	switch p.EtherType {
+	case EthPIPv4:
+		return p.parseIPv4(data[off:], tunnels)
+	case EthPIPv6:
+		return p.parseIPv6(data[off:], tunnels)
+	}
+	p.Payload = data[off:]
+
+	return nil
+}
+
+func (p *Packet) parseIP(data []byte, tunnels bool) error {
+	if len(data) == 0 {
+		return errTruncated("IP")
+	}
+	switch data[0] >> 4 {
+	case 4:
+		p.EtherType = EthPIPv4
+		return p.parseIPv4(data, tunnels)
+	case 6:
+		p.EtherType = EthPIPv6
+		return p.parseIPv6(data, tunnels)
+	}
+
+	return fmt.Errorf("Invalid IP version %d", data[0]>>4)
+}
+
+func (p *Packet) parseIPv4(data []byte, tunnels bool) error {
+	if len(data) < ipv4HeaderSize {
+		return errTruncated("IPv4")
+	}
+	if data[0]>>4 != 4 {
+		return fmt.Errorf("Invalid IPv4 header version %d", data[0]>>4)
+	}
+	hdrLen := int(data[0]&0x0f) * 4
+	if hdrLen < ipv4HeaderSize {
+		return fmt.Errorf("Invalid IPv4 header length %d", hdrLen)
+	}
+	if len(data) < hdrLen {
+		return errTruncated("IPv4")
+	}
+	p.Version = 4
+	p.TTL = data[8]
+	p.Protocol = data[9]
+	p.Src = net.IP(data[12:16])
+	p.Dst = net.IP(data[16:20])
+	p.Fragment = binary.BigEndian.Uint16(data[6:])&0x1fff != 0
+
+	// Ethernet padding of short packets is not payload
+	if total := int(binary.BigEndian.Uint16(data[2:])); total >= hdrLen && total < len(data) {
+		data = data[:total]
+	}
+	if p.Fragment {
+		p.Payload = data[hdrLen:]
+		return nil
+	}
+
+	return p.parseL4(data[hdrLen:], tunnels)
+}
+
+func (p *Packet) parseIPv6(data []byte, tunnels bool) error {
+	if len(data) < ipv6HeaderSize {
+		return errTruncated("IPv6")
+	}
+	if data[0]>>4 != 6 {
+		return fmt.Errorf("Invalid IPv6 header version %d", data[0]>>4)
+	}
+	p.Version = 6
+	p.TTL = data[7]
+	p.Src = net.IP(data[8:24])
+	p.Dst = net.IP(data[24:40])
+
+	// Zero payload length is jumbogram, length is in hop-by-hop option then
+	if plen := int(binary.BigEndian.Uint16(data[4:])); plen > 0 && ipv6HeaderSize+plen < len(data) {
+		data = data[:ipv6HeaderSize+plen]
+	}
+	next := data[6]
+	data = data[ipv6HeaderSize:]
+	for i := 0; i < MaxExtHeaders; i++ {
+		var hdrLen int
+		switch next {
+		case protoHopByHop, protoRouting, protoDstOpts:
+			if len(data) < 2 {
+				return errTruncated("IPv6 extension")
+			}
+			hdrLen = (int(data[1]) + 1) * 8
+		case protoAH:
+			if len(data) < 2 {
+				return errTruncated("IPv6 extension")
+			}
+			hdrLen = (int(data[1]) + 2) * 4
+		case protoFragment:
+			hdrLen = 8
+			if len(data) >= 4 && binary.BigEndian.Uint16(data[2:])&0xfff8 != 0 {
+				p.Fragment = true
+			}
+		}
+		if hdrLen == 0 {
+			break
+		}
+		if len(data) < hdrLen {
+			return errTruncated("IPv6 extension")
+		}
+		next = data[0]
+		data = data[hdrLen:]
+	}
+	p.Protocol = next
+	if p.Fragment {
+		p.Payload = data
+		return nil
+	}
+
+	return p.parseL4(data, tunnels)
+}
+
+func (p *Packet) parseL4(data []byte, tunnels bool) error {
+	switch p.Protocol {
+	case ProtoTCP:
+		if len(data) < tcpHeaderSize {
+			return errTruncated("TCP")
+		}
+		hdrLen := int(data[12]>>4) * 4
+		if hdrLen < tcpHeaderSize {
+			return fmt.Errorf("Invalid TCP header length %d", hdrLen)
+		}
+		if len(data) < hdrLen {
+			return errTruncated("TCP")
+		}
+		p.SrcPort = binary.BigEndian.Uint16(data[0:])
+		p.DstPort = binary.BigEndian.Uint16(data[2:])
+		p.TCPFlags = data[13]
+		p.Payload = data[hdrLen:]
+
+	case ProtoUDP:
+		if len(data) < udpHeaderSize {
+			return errTruncated("UDP")
+		}
+		p.SrcPort = binary.BigEndian.Uint16(data[0:])
+		p.DstPort = binary.BigEndian.Uint16(data[2:])
+		if l := int(binary.BigEndian.Uint16(data[4:])); l >= udpHeaderSize && l < len(data) {
+			data = data[:l]
+		}
+		p.Payload = data[udpHeaderSize:]
+		return p.parseUDPPayload(tunnels)
+
+	case ProtoICMP, ProtoICMPv6:
+		if len(data) < icmpHeaderSize {
+			return errTruncated("ICMP")
+		}
+		p.ICMPType = data[0]
+		p.ICMPCode = data[1]
+		p.Payload = data[icmpHeaderSize:]
+
+	default:
+		p.Payload = data
+	}
+
+	return nil
+}
+
+// Tunnels are decoded at the first level only, QUIC at any
+func (p *Packet) parseUDPPayload(tunnels bool) error {
+	switch {
+	case tunnels && p.DstPort == GTPUPort:
+		return p.parseGTPU()
+	case tunnels && p.DstPort == VXLANPort:
+		return p.parseVXLAN()
+	case tunnels && p.DstPort == GenevePort:
+		return p.parseGeneve()
+	case p.DstPort == QUICPort || p.SrcPort == QUICPort:
+		p.parseQUIC()
+	}
+
+	return nil
+}
+
+func (p *Packet) parseGTPU() error {
+	data := p.Payload
+	if len(data) < tunnelHeaderSize {
+		return errTruncated("GTP-U")
+	}
+	if data[0]>>5 != 1 {
+		return fmt.Errorf("Invalid GTP-U version %d", data[0]>>5)
+	}
+	p.Tunnel = TunnelGTPU
+	p.TunnelID = binary.BigEndian.Uint32(data[4:])
+	off := tunnelHeaderSize
+	// Any of E / S / PN flags adds optional fields, E - extension headers chain
+	if data[0]&0x07 != 0 {
+		if len(data) < gtpuOptHeaderSize {
+			return errTruncated("GTP-U")
+		}
+		off = gtpuOptHeaderSize
+		for next := data[off-1]; data[0]&0x04 != 0 && next != 0; {
+			if len(data) <= off {
+				return errTruncated("GTP-U extension")
+			}
+			l := int(data[off]) * 4
+			if l == 0 {
+				return errors.New("Invalid GTP-U extension header length 0")
+			}
+			if len(data) < off+l {
+				return errTruncated("GTP-U extension")
+			}
+			next = data[off+l-1]
+			off += l
+		}
+	}
+	p.Payload = data[off:]
+	if data[1] != gtpuTypeGPDU {
+		return nil
+	}
+
+	p.Inner = &Packet{}
+	return p.Inner.parseIP(p.Payload, false)
+}
+
+func (p *Packet) parseVXLAN() error {
+	data := p.Payload
+	if len(data) < tunnelHeaderSize {
+		return errTruncated("VXLAN")
+	}
+	if data[0]&0x08 == 0 {
+		return errors.New("VXLAN header has no VNI")
+	}
+	p.Tunnel = TunnelVXLAN
+	p.TunnelID = binary.BigEndian.Uint32(data[4:]) >> 8
+	p.Payload = data[tunnelHeaderSize:]
+
+	p.Inner = &Packet{}
+	return p.Inner.parseEthernet(p.Payload, false)
+}
+
+func (p *Packet) parseGeneve() error {
+	data := p.Payload
+	if len(data) < tunnelHeaderSize {
+		return errTruncated("GENEVE")
+	}
+	if data[0]>>6 != 0 {
+		return fmt.Errorf("Invalid GENEVE version %d", data[0]>>6)
+	}
+	// Options length is in 4 byte units
+	hdrLen := tunnelHeaderSize + int(data[0]&0x3f)*4
+	if len(data) < hdrLen {
+		return errTruncated("GENEVE")
+	}
+	p.Tunnel = TunnelGeneve
+	p.TunnelID = binary.BigEndian.Uint32(data[4:]) >> 8
+	p.Payload = data[hdrLen:]
+
+	switch binary.BigEndian.Uint16(data[2:]) {
+	case EthPTEB:
+		p.Inner = &Packet{}
+		return p.Inner.parseEthernet(p.Payload, false)
+	case EthPIPv4, EthPIPv6:
+		p.Inner = &Packet{}
+		return p.Inner.parseIP(p.Payload, false)
+	}
+
+	return nil
+}
+
+// QUIC is guessed by port, so payload not looking like long header is not an error
+func (p *Packet) parseQUIC() {
+	data := p.Payload
+	if len(data) < 6 || data[0]&0x80 == 0 {
+		return
+	}
+	version := binary.BigEndian.Uint32(data[1:])
+	// Fixed bit is set, except of version negotiation packets
+	if version != 0 && data[0]&0x40 == 0 {
+		return
+	}
+	off := 5
+	dcidLen := int(data[off])
+	off++
+	if len(data) < off+dcidLen+1 {
+		return
+	}
+	dcid := data[off : off+dcidLen]
+	off += dcidLen
+	scidLen := int(data[off])
+	off++
+	if len(data) < off+scidLen {
+		return
+	}
+
+	p.QUIC = &QUIC{
+		Version: version,
+		Type:    (data[0] >> 4) & 0x03,
+		DCID:    dcid,
+		SCID:    data[off : off+scidLen],
+	}
+}
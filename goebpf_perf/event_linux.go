@@ -0,0 +1,152 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_perf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Converts attributes into struct perf_event_attr
+func (a *Attr) unixAttr() *unix.PerfEventAttr {
+	attr := &unix.PerfEventAttr{
+		Type:        a.Type,
+		Size:        uint32(unsafe.Sizeof(unix.PerfEventAttr{})),
+		Config:      a.Config,
+		Sample:      a.SamplePeriod,
+		Sample_type: a.SampleType,
+		Read_format: a.ReadFormat,
+		Wakeup:      a.WakeupEvents,
+		Bp_type:     a.BpType,
+		Ext1:        a.Config1,
+		Ext2:        a.Config2,
+	}
+	if a.SampleFrequency != 0 {
+		attr.Sample = a.SampleFrequency
+		attr.Bits |= unix.PerfBitFreq
+	}
+	flags := []struct {
+		set bool
+		bit uint64
+	}{
+		{a.Disabled, unix.PerfBitDisabled},
+		{a.Inherit, unix.PerfBitInherit},
+		{a.ExcludeKernel, unix.PerfBitExcludeKernel},
+		{a.ExcludeUser, unix.PerfBitExcludeUser},
+		{a.ExcludeHv, unix.PerfBitExcludeHv},
+	}
+	for _, f := range flags {
+		if f.set {
+			attr.Bits |= f.bit
+		}
+	}
+
+	return attr
+}
+
+// Open opens event for process pid (0 - calling process, -1 - all) on cpu
+// (-1 - any), see perf_event_open(2). Events of group are scheduled
+// together with group leader. Returns raw errno on failure.
+func Open(attr *Attr, pid, cpu int, group *Event) (*Event, error) {
+	if attr.SamplePeriod != 0 && attr.SampleFrequency != 0 {
+		return nil, errors.New("Either SamplePeriod or SampleFrequency may be set")
+	}
+	groupFd := -1
+	if group != nil {
+		groupFd = group.fd
+	}
+	fd, err := unix.PerfEventOpen(attr.unixAttr(), pid, cpu, groupFd, unix.PERF_FLAG_FD_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Event{fd: fd, readFormat: attr.ReadFormat}, nil
+}
+
+// Enable starts counting / sampling
+func (e *Event) Enable() error {
+	return unix.IoctlSetInt(e.fd, unix.PERF_EVENT_IOC_ENABLE, 0)
+}
+
+// Disable stops counting / sampling
+func (e *Event) Disable() error {
+	return unix.IoctlSetInt(e.fd, unix.PERF_EVENT_IOC_DISABLE, 0)
+}
+
+// Reset zeroes counter of event
+func (e *Event) Reset() error {
+	return unix.IoctlSetInt(e.fd, unix.PERF_EVENT_IOC_RESET, 0)
+}
+
+// SetBpf attaches eBPF program (by fd) to event, program is run on every sample
+// (kprobe / tracepoint / perf event programs). Program stays attached until
+// event is closed.
+func (e *Event) SetBpf(progFd int) error {
+	return unix.IoctlSetInt(e.fd, unix.PERF_EVENT_IOC_SET_BPF, progFd)
+}
+
+// ReadCount returns current value of counter
+func (e *Event) ReadCount() (uint64, error) {
+	v, err := e.ReadValue()
+	return v.Counter, err
+}
+
+// ReadValue returns current value of counter, with enabled / running times
+// if event was opened with corresponding ReadFormat* flags
+func (e *Event) ReadValue() (Value, error) {
+	var v Value
+	// value, time_enabled, time_running, id
+	var buf [32]byte
+	n, err := unix.Read(e.fd, buf[:])
+	if err != nil {
+		return v, err
+	}
+	fields := []*uint64{&v.Counter}
+	if e.readFormat&ReadFormatTotalTimeEnabled != 0 {
+		fields = append(fields, &v.Enabled)
+	}
+	if e.readFormat&ReadFormatTotalTimeRunning != 0 {
+		fields = append(fields, &v.Running)
+	}
+	if n < len(fields)*8 {
+		return v, fmt.Errorf("Short read of counter: %d bytes", n)
+	}
+	for i, f := range fields {
+		*f = hostByteOrder.Uint64(buf[i*8:])
+	}
+
+	return v, nil
+}
+
+// Mmap maps ring of pages data pages (must be power of 2) to receive samples
+func (e *Event) Mmap(pages int) (*Ring, error) {
+	if e.ring != nil {
+		return nil, errors.New("Ring is already mapped")
+	}
+	if pages <= 0 || pages&(pages-1) != 0 {
+		return nil, fmt.Errorf("Number of pages %d is not power of 2", pages)
+	}
+	pageSize := os.Getpagesize()
+	mem, err := unix.Mmap(e.fd, 0, (pages+1)*pageSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	e.ring = newRing(mem, pageSize)
+
+	return e.ring, nil
+}
+
+// Close unmaps ring and closes event, detaching program set by SetBpf()
+func (e *Event) Close() error {
+	if e.ring != nil {
+		unix.Munmap(e.ring.mem)
+		e.ring = nil
+	}
+
+	return unix.Close(e.fd)
+}
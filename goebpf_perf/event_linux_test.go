@@ -0,0 +1,43 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_perf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sys/unix"
+)
+
+func TestUnixAttr(t *testing.T) {
+	attr := (&Attr{
+		Type:            TypeSoftware,
+		Config:          CountSwCPUClock,
+		SampleFrequency: 99,
+		SampleType:      SampleIP | SampleTID,
+		Disabled:        true,
+		ExcludeUser:     true,
+	}).unixAttr()
+	assert.Equal(t, uint32(TypeSoftware), attr.Type)
+	assert.Equal(t, uint64(99), attr.Sample)
+	assert.Equal(t, uint64(SampleIP|SampleTID), attr.Sample_type)
+	assert.Equal(t, unix.PerfBitFreq|unix.PerfBitDisabled|unix.PerfBitExcludeUser, attr.Bits)
+	assert.NotZero(t, attr.Size)
+
+	attr = Breakpoint(0x1000, 8, BreakpointW).unixAttr()
+	assert.Equal(t, uint32(TypeBreakpoint), attr.Type)
+	assert.Equal(t, uint32(BreakpointW), attr.Bp_type)
+	assert.Equal(t, uint64(0x1000), attr.Ext1)
+	assert.Equal(t, uint64(8), attr.Ext2)
+	assert.Equal(t, uint64(1), attr.Sample)
+	assert.Zero(t, attr.Bits)
+}
+
+func TestOpenNegative(t *testing.T) {
+	_, err := Open(&Attr{SamplePeriod: 1, SampleFrequency: 1}, 0, -1, nil)
+	assert.Error(t, err)
+	ev := &Event{fd: -1}
+	_, err = ev.Mmap(3)
+	assert.Error(t, err)
+}
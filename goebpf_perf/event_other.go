@@ -0,0 +1,52 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package goebpf_perf
+
+// Open opens event, see perf_event_open(2)
+func Open(attr *Attr, pid, cpu int, group *Event) (*Event, error) {
+	return nil, ErrNotSupported
+}
+
+// Enable starts counting / sampling
+func (e *Event) Enable() error {
+	return ErrNotSupported
+}
+
+// Disable stops counting / sampling
+func (e *Event) Disable() error {
+	return ErrNotSupported
+}
+
+// Reset zeroes counter of event
+func (e *Event) Reset() error {
+	return ErrNotSupported
+}
+
+// SetBpf attaches eBPF program (by fd) to event
+func (e *Event) SetBpf(progFd int) error {
+	return ErrNotSupported
+}
+
+// ReadCount returns current value of counter
+func (e *Event) ReadCount() (uint64, error) {
+	return 0, ErrNotSupported
+}
+
+// ReadValue returns current value of counter with enabled / running times
+func (e *Event) ReadValue() (Value, error) {
+	return Value{}, ErrNotSupported
+}
+
+// Mmap maps ring of pages data pages to receive samples
+func (e *Event) Mmap(pages int) (*Ring, error) {
+	return nil, ErrNotSupported
+}
+
+// Close closes event
+func (e *Event) Close() error {
+	return ErrNotSupported
+}
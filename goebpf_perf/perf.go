@@ -0,0 +1,158 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_perf is minimal perf_event_open(2) wrapper: opening events,
+// enabling / disabling them, attaching eBPF programs (PERF_EVENT_IOC_SET_BPF)
+// and reading samples from mmap-ed ring. It is used by perf event / tracepoint
+// programs of goebpf, and may be used directly for custom events, e.g.
+// hardware counters:
+//
+//	ev, err := goebpf_perf.Open(&goebpf_perf.Attr{
+//		Type:     goebpf_perf.TypeHardware,
+//		Config:   goebpf_perf.CountHwInstructions,
+//		Disabled: true,
+//	}, 0, -1, nil)
+//	...
+//	defer ev.Close()
+//	ev.Enable()
+//	work()
+//	ev.Disable()
+//	count, err := ev.ReadCount()
+//
+// or watchpoints, reported as samples through ring:
+//
+//	ev, err := goebpf_perf.Open(goebpf_perf.Breakpoint(addr, 8, goebpf_perf.BreakpointW), pid, -1, nil)
+//	...
+//	ring, err := ev.Mmap(8)
+//	for _, rec := range ring.Read() {
+//		...
+//	}
+package goebpf_perf
+
+import (
+	"errors"
+)
+
+// Event types, PERF_TYPE_* from <linux/perf_event.h>
+const (
+	TypeHardware   = 0
+	TypeSoftware   = 1
+	TypeTracepoint = 2
+	TypeHwCache    = 3
+	TypeRaw        = 4
+	TypeBreakpoint = 5
+)
+
+// Commonly used configs of hardware / software events (PERF_COUNT_HW_* / PERF_COUNT_SW_*)
+const (
+	CountHwCPUCycles    = 0
+	CountHwInstructions = 1
+	CountHwCacheMisses  = 3
+	CountHwBranchMisses = 5
+	CountSwCPUClock     = 0
+	CountSwTaskClock    = 1
+	CountSwPageFaults   = 2
+	CountSwBpfOutput    = 10
+)
+
+// Fields of samples written to ring, PERF_SAMPLE_*
+const (
+	SampleIP        = 1 << 0
+	SampleTID       = 1 << 1
+	SampleTime      = 1 << 2
+	SampleAddr      = 1 << 3
+	SampleCallchain = 1 << 5
+	SampleCPU       = 1 << 7
+	SamplePeriod    = 1 << 8
+	SampleRaw       = 1 << 10
+)
+
+// Extra values returned by read(2) of event / Event.ReadValue(), PERF_FORMAT_*
+const (
+	ReadFormatTotalTimeEnabled = 1 << 0
+	ReadFormatTotalTimeRunning = 1 << 1
+)
+
+// Breakpoint types, HW_BREAKPOINT_*
+const (
+	BreakpointR  = 1
+	BreakpointW  = 2
+	BreakpointRW = BreakpointR | BreakpointW
+	BreakpointX  = 4
+)
+
+// ErrNotSupported returned on platforms without perf events
+var ErrNotSupported = errors.New("Perf events are not supported on this platform")
+
+// Attr describes event to open, subset of struct perf_event_attr
+type Attr struct {
+	// Event type / config, e.g. TypeSoftware / CountSwCPUClock
+	Type   uint32
+	Config uint64
+	// Sample every SamplePeriod events or SampleFrequency times per second,
+	// sampling is off when both are zero (counting only)
+	SamplePeriod    uint64
+	SampleFrequency uint64
+	// Sample* flags: which fields samples have
+	SampleType uint64
+	// ReadFormat* flags: values read(2) of event returns along with counter
+	ReadFormat uint64
+	// Ring reader is woken up every WakeupEvents samples
+	WakeupEvents uint32
+	// Event is opened disabled, see Event.Enable()
+	Disabled      bool
+	Inherit       bool
+	ExcludeKernel bool
+	ExcludeUser   bool
+	ExcludeHv     bool
+	// Type of breakpoint (Breakpoint*) for TypeBreakpoint
+	BpType uint32
+	// Config extensions: breakpoint address / length, or kprobe / uprobe
+	// function / path and offset of dynamic PMUs
+	Config1 uint64
+	Config2 uint64
+}
+
+// Breakpoint returns attributes of hardware breakpoint (watchpoint) on size
+// bytes at addr, which samples every hit
+func Breakpoint(addr uint64, size uint64, bpType uint32) *Attr {
+	return &Attr{
+		Type:         TypeBreakpoint,
+		BpType:       bpType,
+		Config1:      addr,
+		Config2:      size,
+		SamplePeriod: 1,
+		SampleType:   SampleIP | SampleTID | SampleAddr,
+		WakeupEvents: 1,
+	}
+}
+
+// Value is counter along with time it was enabled / actually counting, in
+// nanoseconds. Layout matches struct bpf_perf_event_value, filled by
+// bpf_perf_event_read_value().
+type Value struct {
+	Counter uint64
+	Enabled uint64
+	Running uint64
+}
+
+// Scaled returns counter extrapolated to the whole time event was enabled:
+// when there are more events than hardware counters, kernel multiplexes them.
+func (v Value) Scaled() uint64 {
+	if v.Running == 0 || v.Running >= v.Enabled {
+		return v.Counter
+	}
+	return uint64(float64(v.Counter) * float64(v.Enabled) / float64(v.Running))
+}
+
+// Event is opened perf event
+type Event struct {
+	fd         int
+	readFormat uint64
+	ring       *Ring
+}
+
+// Fd returns file descriptor of event, e.g. to poll for ring data
+func (e *Event) Fd() int {
+	return e.fd
+}
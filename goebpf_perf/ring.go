@@ -0,0 +1,139 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_perf
+
+import (
+	"encoding/binary"
+	"sync/atomic"
+	"unsafe"
+)
+
+// Record types, PERF_RECORD_*
+const (
+	RecordLost   = 2
+	RecordSample = 9
+)
+
+// Offsets of fields of struct perf_event_mmap_page
+const (
+	mmapDataHead   = 1024
+	mmapDataTail   = 1032
+	mmapDataOffset = 1040
+	mmapDataSize   = 1048
+)
+
+// Size of struct perf_event_header
+const recordHeaderSize = 8
+
+// Perf records use byte order of host
+var hostByteOrder = detectHostByteOrder()
+
+func detectHostByteOrder() binary.ByteOrder {
+	var x uint16 = 0x0102
+	if *(*byte)(unsafe.Pointer(&x)) == 0x01 {
+		return binary.BigEndian
+	}
+	return binary.LittleEndian
+}
+
+// Record is single record of ring
+type Record struct {
+	Type uint32
+	Misc uint16
+	// Record after header, e.g. fields of sample in order of Sample* bits
+	Data []byte
+}
+
+// Samples read from / lost by all rings of process, see Stats()
+var samplesRead, samplesLost uint64
+
+// Stats returns total number of samples read from rings of process and
+// number of samples kernel lost because ring was full
+func Stats() (read, lost uint64) {
+	return atomic.LoadUint64(&samplesRead), atomic.LoadUint64(&samplesLost)
+}
+
+// Ring is memory mapped ring buffer of event, see Event.Mmap()
+type Ring struct {
+	// Metadata page followed by data pages
+	mem  []byte
+	data []byte
+}
+
+func newRing(mem []byte, pageSize int) *Ring {
+	offset := hostByteOrder.Uint64(mem[mmapDataOffset:])
+	size := hostByteOrder.Uint64(mem[mmapDataSize:])
+	// Kernels before 4.1 don't report layout
+	if size == 0 {
+		offset = uint64(pageSize)
+		size = uint64(len(mem) - pageSize)
+	}
+
+	return &Ring{
+		mem:  mem,
+		data: mem[offset : offset+size],
+	}
+}
+
+func (r *Ring) counter(offset int) *uint64 {
+	return (*uint64)(unsafe.Pointer(&r.mem[offset]))
+}
+
+// Read returns all records available in ring, doesn't block: wait for
+// event fd to become readable (e.g. by poll) to wait for records.
+// Returned records are copies, space of ring is released.
+func (r *Ring) Read() []Record {
+	// Paired with smp_store_release() of kernel
+	head := atomic.LoadUint64(r.counter(mmapDataHead))
+	tail := atomic.LoadUint64(r.counter(mmapDataTail))
+
+	var res []Record
+	var read, lost uint64
+	for tail+recordHeaderSize <= head {
+		hdr := r.copy(tail, recordHeaderSize)
+		size := uint64(hostByteOrder.Uint16(hdr[6:]))
+		if size < recordHeaderSize || tail+size > head {
+			// Malformed record, drop everything
+			tail = head
+			break
+		}
+		rec := Record{
+			Type: hostByteOrder.Uint32(hdr),
+			Misc: hostByteOrder.Uint16(hdr[4:]),
+			Data: r.copy(tail+recordHeaderSize, size-recordHeaderSize),
+		}
+		switch rec.Type {
+		case RecordSample:
+			read++
+		case RecordLost:
+			lost += rec.Lost()
+		}
+		res = append(res, rec)
+		tail += size
+	}
+	atomic.StoreUint64(r.counter(mmapDataTail), tail)
+	atomic.AddUint64(&samplesRead, read)
+	atomic.AddUint64(&samplesLost, lost)
+
+	return res
+}
+
+// Copies n bytes of ring at position pos, which may wrap around end of ring
+func (r *Ring) copy(pos, n uint64) []byte {
+	buf := make([]byte, n)
+	start := pos % uint64(len(r.data))
+	copied := copy(buf, r.data[start:])
+	copy(buf[copied:], r.data)
+
+	return buf
+}
+
+// Lost returns number of samples lost because ring was full (RecordLost)
+func (rec Record) Lost() uint64 {
+	// struct { u64 id; u64 lost; }
+	if rec.Type != RecordLost || len(rec.Data) < 16 {
+		return 0
+	}
+	return hostByteOrder.Uint64(rec.Data[8:])
+}
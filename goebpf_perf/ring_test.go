@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_perf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testPageSize = 4096
+
+// Ring of one metadata and one data page
+func newTestRing() *Ring {
+	mem := make([]byte, 2*testPageSize)
+	return newRing(mem, testPageSize)
+}
+
+// Writes record at position pos of ring, returns position after it
+func (r *Ring) write(pos uint64, recType uint32, data []byte) uint64 {
+	rec := make([]byte, recordHeaderSize+len(data))
+	hostByteOrder.PutUint32(rec, recType)
+	hostByteOrder.PutUint16(rec[6:], uint16(len(rec)))
+	copy(rec[recordHeaderSize:], data)
+	for i, b := range rec {
+		r.data[(pos+uint64(i))%uint64(len(r.data))] = b
+	}
+	pos += uint64(len(rec))
+	hostByteOrder.PutUint64(r.mem[mmapDataHead:], pos)
+	return pos
+}
+
+func TestRingRead(t *testing.T) {
+	r := newTestRing()
+	require.Len(t, r.data, testPageSize)
+	assert.Empty(t, r.Read())
+	read, lost := Stats()
+
+	pos := r.write(0, RecordSample, []byte{1, 2, 3, 4, 5, 6, 7, 8})
+	lostRec := make([]byte, 16)
+	hostByteOrder.PutUint64(lostRec[8:], 42)
+	pos = r.write(pos, RecordLost, lostRec)
+	recs := r.Read()
+	require.Len(t, recs, 2)
+	assert.Equal(t, Record{Type: RecordSample, Data: []byte{1, 2, 3, 4, 5, 6, 7, 8}}, recs[0])
+	assert.Equal(t, uint64(0), recs[0].Lost())
+	assert.Equal(t, uint64(42), recs[1].Lost())
+	assert.Equal(t, pos, hostByteOrder.Uint64(r.mem[mmapDataTail:]))
+	assert.Empty(t, r.Read())
+	newRead, newLost := Stats()
+	assert.Equal(t, read+1, newRead)
+	assert.Equal(t, lost+42, newLost)
+
+	// Record wrapping around end of ring
+	pos = uint64(testPageSize - 12)
+	hostByteOrder.PutUint64(r.mem[mmapDataTail:], pos)
+	r.write(pos, RecordSample, []byte("wrapped data"))
+	recs = r.Read()
+	require.Len(t, recs, 1)
+	assert.Equal(t, "wrapped data", string(recs[0].Data))
+}
+
+func TestRingReadMalformed(t *testing.T) {
+	r := newTestRing()
+	r.write(0, RecordSample, nil)
+	// Header claims record is larger than available data
+	hostByteOrder.PutUint16(r.data[6:], 100)
+	assert.Empty(t, r.Read())
+	assert.Equal(t, uint64(recordHeaderSize), hostByteOrder.Uint64(r.mem[mmapDataTail:]))
+}
+
+func TestRingLayout(t *testing.T) {
+	mem := make([]byte, 4*testPageSize)
+	hostByteOrder.PutUint64(mem[mmapDataOffset:], 2*testPageSize)
+	hostByteOrder.PutUint64(mem[mmapDataSize:], 2*testPageSize)
+	r := newRing(mem, testPageSize)
+	assert.Len(t, r.data, 2*testPageSize)
+	assert.Equal(t, &mem[2*testPageSize], &r.data[0])
+}
+
+func TestValueScaled(t *testing.T) {
+	assert.Equal(t, uint64(100), Value{Counter: 100}.Scaled())
+	assert.Equal(t, uint64(100), Value{Counter: 100, Enabled: 10, Running: 10}.Scaled())
+	assert.Equal(t, uint64(400), Value{Counter: 100, Enabled: 20, Running: 5}.Scaled())
+}
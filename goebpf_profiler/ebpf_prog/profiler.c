@@ -0,0 +1,63 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Whole-system sampling profiler: on every perf event (timer tick)
+// captures kernel / user stacks of current task and counts them.
+
+#include "bpf_helpers.h"
+
+// Must be in sync with goebpf_profiler
+#define MAX_STACK_DEPTH 127
+#define MAX_STACKS 16384
+#define TASK_COMM_LEN 16
+
+// Flags of bpf_get_stackid()
+#define BPF_F_USER_STACK (1ULL << 8)
+
+struct stack_key {
+  __u32 pid;
+  __s32 user_stack_id;
+  __s32 kernel_stack_id;
+  char comm[TASK_COMM_LEN];
+};
+
+// Stack traces (instruction pointers) referenced by stack_key
+BPF_MAP_DEF(stack_traces) = {
+    .map_type = BPF_MAP_TYPE_STACK_TRACE,
+    .key_size = sizeof(__u32),
+    .value_size = MAX_STACK_DEPTH * sizeof(__u64),
+    .max_entries = MAX_STACKS,
+};
+BPF_MAP_ADD(stack_traces);
+
+// Amount of samples per unique (process, user stack, kernel stack)
+BPF_MAP_DEF(stack_counts) = {
+    .map_type = BPF_MAP_TYPE_HASH,
+    .key_size = sizeof(struct stack_key),
+    .value_size = sizeof(__u64),
+    .max_entries = MAX_STACKS,
+};
+BPF_MAP_ADD(stack_counts);
+
+SEC("perf_event")
+int profile_cpu(void *ctx) {
+  struct stack_key key = {};
+
+  key.pid = bpf_get_current_pid_tgid() >> 32;
+  bpf_get_current_comm(&key.comm, sizeof(key.comm));
+  // Negative stack id means no stack (e.g. kernel thread has no user stack)
+  key.user_stack_id = bpf_get_stackid(ctx, &stack_traces, BPF_F_USER_STACK);
+  key.kernel_stack_id = bpf_get_stackid(ctx, &stack_traces, 0);
+
+  __u64 *count = bpf_map_lookup_elem(&stack_counts, &key);
+  if (count) {
+    __sync_fetch_and_add(count, 1);
+  } else {
+    __u64 one = 1;
+    bpf_map_update_elem(&stack_counts, &key, &one, BPF_NOEXIST);
+  }
+
+  return 0;
+}
+
+char _license[] SEC("license") = "GPL";
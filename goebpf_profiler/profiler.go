@@ -0,0 +1,310 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_profiler is whole-system continuous CPU profiler built on goebpf.
+//
+// Bundled eBPF program (ebpf_prog/profiler.c, build it by "make") is attached
+// to CPU clock perf event on every CPU, captures kernel / user stacks
+// of currently running task and counts them in eBPF maps.
+// Collected samples are written in pprof format, consumable by "go tool pprof":
+//
+//	p, err := goebpf_profiler.New(goebpf_profiler.Options{
+//		ElfFile: "ebpf_prog/profiler.elf",
+//	})
+//	...
+//	p.Start()
+//	time.Sleep(30 * time.Second)
+//	p.Stop()
+//	f, _ := os.Create("cpu.pprof")
+//	p.WriteProfile(f)
+//
+// Kernel frames are symbolized by using /proc/kallsyms, user space frames
+// are reported as raw addresses. User stacks are captured by frame pointers,
+// for binaries compiled without them see goebpf_unwind.
+package goebpf_profiler
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_ksym"
+	"github.com/google/pprof/profile"
+	"golang.org/x/sys/unix"
+)
+
+// Must be in sync with ebpf_prog/profiler.c
+const (
+	programName      = "profile_cpu"
+	stackTracesMap   = "stack_traces"
+	stackCountsMap   = "stack_counts"
+	maxStackDepth    = 127
+	taskCommLen      = 16
+	stackKeySize     = 4 + 4 + 4 + taskCommLen
+	defaultFrequency = 49
+)
+
+// ErrNotStarted is returned when profile requested before Start()
+var ErrNotStarted = errors.New("Profiler is not started")
+
+// Options of profiler
+type Options struct {
+	// Compiled bundled eBPF program (ebpf_prog/profiler.elf)
+	ElfFile string
+	// Sampling frequency per CPU, Hz. Defaults to 49
+	Frequency int
+	// Process to profile, zero means all processes
+	Pid int
+	// Symbol table to resolve kernel frames. Created from /proc/kallsyms if not set
+	Ksyms *goebpf_ksym.Table
+}
+
+// Profiler collects stack samples of all CPUs
+type Profiler struct {
+	opts   Options
+	bpf    goebpf.System
+	prog   goebpf.Program
+	counts goebpf.Map
+	stacks goebpf.Map
+	start  time.Time
+	stop   time.Time
+}
+
+// One unique stack with amount of times it has been seen
+type stackSample struct {
+	pid         int
+	comm        string
+	count       uint64
+	userStack   []uint64
+	kernelStack []uint64
+}
+
+// New loads bundled eBPF program into kernel, but does not start profiling yet
+func New(opts Options) (*Profiler, error) {
+	if opts.Frequency == 0 {
+		opts.Frequency = defaultFrequency
+	}
+	if opts.Ksyms == nil {
+		var err error
+		if opts.Ksyms, err = goebpf_ksym.NewTable(); err != nil {
+			return nil, err
+		}
+	}
+
+	p := &Profiler{
+		opts: opts,
+		bpf:  goebpf.NewDefaultEbpfSystem(),
+	}
+	if err := p.bpf.LoadElf(opts.ElfFile); err != nil {
+		return nil, err
+	}
+	p.prog = p.bpf.GetProgramByName(programName)
+	p.counts = p.bpf.GetMapByName(stackCountsMap)
+	p.stacks = p.bpf.GetMapByName(stackTracesMap)
+	if p.prog == nil || p.counts == nil || p.stacks == nil {
+		return nil, fmt.Errorf("'%s' is not profiler eBPF program", opts.ElfFile)
+	}
+	if err := p.prog.Load(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Start starts sampling
+func (p *Profiler) Start() error {
+	pid := -1
+	if p.opts.Pid != 0 {
+		pid = p.opts.Pid
+	}
+	err := p.prog.Attach(&goebpf.PerfEventAttachParams{
+		Type:            unix.PERF_TYPE_SOFTWARE,
+		Config:          unix.PERF_COUNT_SW_CPU_CLOCK,
+		SampleFrequency: uint64(p.opts.Frequency),
+		Pid:             pid,
+	})
+	if err != nil {
+		return err
+	}
+	p.start = time.Now()
+
+	return nil
+}
+
+// Stop stops sampling, collected samples remain available for WriteProfile()
+func (p *Profiler) Stop() error {
+	p.stop = time.Now()
+	return p.prog.Detach()
+}
+
+// WriteProfile writes gzipped pprof profile of all samples collected so far
+func (p *Profiler) WriteProfile(w io.Writer) error {
+	if p.start.IsZero() {
+		return ErrNotStarted
+	}
+	samples, err := p.readSamples()
+	if err != nil {
+		return err
+	}
+	stop := p.stop
+	if stop.Before(p.start) {
+		// Still running
+		stop = time.Now()
+	}
+	prof := buildProfile(samples, p.opts.Ksyms, p.opts.Frequency, p.start, stop.Sub(p.start))
+	return prof.Write(w)
+}
+
+// Reads all unique stacks from eBPF maps
+func (p *Profiler) readSamples() ([]stackSample, error) {
+	var samples []stackSample
+
+	key, err := p.counts.GetNextKey(nil)
+	for ; err == nil; key, err = p.counts.GetNextKey(key) {
+		count, err := p.counts.LookupUint64(key)
+		if err != nil {
+			// Element may be deleted in between
+			continue
+		}
+		if len(key) != stackKeySize {
+			return nil, fmt.Errorf("Unexpected key size %d of '%s' map", len(key), stackCountsMap)
+		}
+		sample := stackSample{
+			pid:   int(goebpf.HostByteOrder().Uint32(key[0:])),
+			comm:  goebpf.NullTerminatedStringToString(key[12:]),
+			count: count,
+		}
+		userId := int32(goebpf.HostByteOrder().Uint32(key[4:]))
+		kernelId := int32(goebpf.HostByteOrder().Uint32(key[8:]))
+		if sample.userStack, err = p.readStack(userId); err != nil {
+			return nil, err
+		}
+		if sample.kernelStack, err = p.readStack(kernelId); err != nil {
+			return nil, err
+		}
+		samples = append(samples, sample)
+	}
+	if err != goebpf.ErrNoMoreKeys {
+		return nil, err
+	}
+
+	return samples, nil
+}
+
+// Reads stack by id, negative id means that stack was not captured
+func (p *Profiler) readStack(id int32) ([]uint64, error) {
+	if id < 0 {
+		return nil, nil
+	}
+	val, err := p.stacks.Lookup(int(id))
+	if err != nil {
+		// Stack may be evicted because of hash collision
+		return nil, nil
+	}
+	stack := make([]uint64, maxStackDepth)
+	if err = binary.Read(bytes.NewReader(val), goebpf.HostByteOrder(), stack); err != nil {
+		return nil, err
+	}
+	for idx, addr := range stack {
+		if addr == 0 {
+			return stack[:idx], nil
+		}
+	}
+	return stack, nil
+}
+
+// Converts raw stack samples into pprof profile
+func buildProfile(samples []stackSample, ksyms *goebpf_ksym.Table, freq int,
+	start time.Time, duration time.Duration) *profile.Profile {
+	period := int64(time.Second) / int64(freq)
+	prof := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "cpu", Unit: "nanoseconds"},
+		},
+		PeriodType:    &profile.ValueType{Type: "cpu", Unit: "nanoseconds"},
+		Period:        period,
+		TimeNanos:     start.UnixNano(),
+		DurationNanos: int64(duration),
+	}
+	kernelMapping := &profile.Mapping{
+		ID:    1,
+		File:  "[kernel]",
+		Limit: ^uint64(0),
+	}
+	prof.Mapping = []*profile.Mapping{kernelMapping}
+
+	functions := make(map[string]*profile.Function)
+	kernelLocations := make(map[uint64]*profile.Location)
+	userLocations := make(map[uint64]*profile.Location)
+
+	kernelLocation := func(addr uint64) *profile.Location {
+		if loc, ok := kernelLocations[addr]; ok {
+			return loc
+		}
+		loc := &profile.Location{
+			ID:      uint64(len(prof.Location) + 1),
+			Address: addr,
+			Mapping: kernelMapping,
+		}
+		if sym, _, ok := ksyms.LookupAddress(addr); ok {
+			name := sym.String()
+			fn, ok := functions[name]
+			if !ok {
+				fn = &profile.Function{
+					ID:         uint64(len(prof.Function) + 1),
+					Name:       name,
+					SystemName: sym.Name,
+				}
+				functions[name] = fn
+				prof.Function = append(prof.Function, fn)
+			}
+			loc.Line = []profile.Line{{Function: fn}}
+		}
+		kernelLocations[addr] = loc
+		prof.Location = append(prof.Location, loc)
+		return loc
+	}
+	userLocation := func(addr uint64) *profile.Location {
+		if loc, ok := userLocations[addr]; ok {
+			return loc
+		}
+		loc := &profile.Location{
+			ID:      uint64(len(prof.Location) + 1),
+			Address: addr,
+		}
+		userLocations[addr] = loc
+		prof.Location = append(prof.Location, loc)
+		return loc
+	}
+
+	for _, s := range samples {
+		sample := &profile.Sample{
+			Value: []int64{int64(s.count), int64(s.count) * period},
+			Label: map[string][]string{
+				"comm": {s.comm},
+			},
+			NumLabel: map[string][]int64{
+				"pid": {int64(s.pid)},
+			},
+		}
+		// Leaf frame goes first: kernel stack is on top of user stack
+		for _, addr := range s.kernelStack {
+			sample.Location = append(sample.Location, kernelLocation(addr))
+		}
+		for _, addr := range s.userStack {
+			sample.Location = append(sample.Location, userLocation(addr))
+		}
+		if len(sample.Location) == 0 {
+			// Neither stack captured: still account sample with pseudo frame
+			sample.Location = append(sample.Location, userLocation(0))
+		}
+		prof.Sample = append(prof.Sample, sample)
+	}
+
+	return prof
+}
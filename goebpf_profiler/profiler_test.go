@@ -0,0 +1,82 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_profiler
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf/goebpf_ksym"
+)
+
+const testKallsyms = `ffffffff81000000 T _text
+ffffffff81001000 T do_syscall_64
+ffffffff81002000 T ksys_read
+ffffffff81003000 T _etext
+`
+
+func TestBuildProfile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "profiler")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	fn := filepath.Join(dir, "kallsyms")
+	require.NoError(t, ioutil.WriteFile(fn, []byte(testKallsyms), 0644))
+	ksyms, err := goebpf_ksym.NewTableFromFile(fn, "")
+	require.NoError(t, err)
+
+	samples := []stackSample{
+		{
+			pid:         100,
+			comm:        "cat",
+			count:       10,
+			kernelStack: []uint64{0xffffffff81002010, 0xffffffff81001020},
+			userStack:   []uint64{0x401000, 0x402000},
+		},
+		{
+			pid:         1,
+			comm:        "kthread",
+			count:       2,
+			kernelStack: []uint64{0xffffffff81001030},
+		},
+		{
+			pid:   200,
+			comm:  "lost",
+			count: 1,
+		},
+	}
+
+	prof := buildProfile(samples, ksyms, 100, time.Unix(1000, 0), time.Second)
+	require.NoError(t, prof.CheckValid())
+	assert.Equal(t, int64(10000000), prof.Period)
+	require.Len(t, prof.Sample, 3)
+	// 2 same kernel functions, 2 user addresses, 1 pseudo frame
+	assert.Len(t, prof.Location, 6)
+	assert.Len(t, prof.Function, 2)
+
+	first := prof.Sample[0]
+	assert.Equal(t, []int64{10, 100000000}, first.Value)
+	assert.Equal(t, []string{"cat"}, first.Label["comm"])
+	assert.Equal(t, []int64{100}, first.NumLabel["pid"])
+	require.Len(t, first.Location, 4)
+	assert.Equal(t, "ksys_read", first.Location[0].Line[0].Function.Name)
+	assert.Equal(t, "do_syscall_64", first.Location[1].Line[0].Function.Name)
+	assert.Equal(t, uint64(0x401000), first.Location[2].Address)
+	assert.Equal(t, first.Location[1].Line[0].Function,
+		prof.Sample[1].Location[0].Line[0].Function)
+
+	// Ensure that profile can be serialized / read back by pprof
+	buf := &bytes.Buffer{}
+	require.NoError(t, prof.Write(buf))
+	parsed, err := profile.Parse(buf)
+	require.NoError(t, err)
+	assert.Len(t, parsed.Sample, 3)
+}
@@ -0,0 +1,140 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_prometheus exposes content of eBPF maps as Prometheus metrics.
+//
+// Every map entry becomes one sample: map value is sample value,
+// map key is converted into label values by KeyDecoder:
+//
+//	drops := bpf.GetMapByName("drops")
+//	collector := goebpf_prometheus.NewMapCollector(drops, goebpf_prometheus.MapCollectorOpts{
+//		Name:      "xdp_drops_total",
+//		Help:      "Packets dropped by XDP program, by protocol",
+//		ValueType: prometheus.CounterValue,
+//		Labels:    []string{"proto"},
+//	})
+//	prometheus.MustRegister(collector)
+package goebpf_prometheus
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/dropbox/goebpf"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// KeyDecoder converts raw map key into label values.
+// Amount of returned values must match amount of labels.
+type KeyDecoder func(key []byte) ([]string, error)
+
+// ValueDecoder reads value for given key from map and converts it to sample value.
+type ValueDecoder func(m goebpf.Map, key []byte) (float64, error)
+
+// MapCollectorOpts defines how map content will be exposed
+type MapCollectorOpts struct {
+	// Fully qualified metric name is Namespace_Subsystem_Name
+	Namespace string
+	Subsystem string
+	Name      string
+	Help      string
+	// CounterValue or GaugeValue, defaults to GaugeValue
+	ValueType prometheus.ValueType
+	// Label names, values of these labels are produced by KeyDecoder.
+	// Defaults to single "key" label
+	Labels      []string
+	ConstLabels prometheus.Labels
+	// Defaults to IntKeyDecoder
+	KeyDecoder KeyDecoder
+	// Defaults to IntValueDecoder
+	ValueDecoder ValueDecoder
+}
+
+// MapCollector implements prometheus.Collector for single eBPF map
+type MapCollector struct {
+	m            goebpf.Map
+	desc         *prometheus.Desc
+	valueType    prometheus.ValueType
+	keyDecoder   KeyDecoder
+	valueDecoder ValueDecoder
+}
+
+// IntKeyDecoder converts little endian integer key into decimal string label,
+// e.g. index of array map
+func IntKeyDecoder(key []byte) ([]string, error) {
+	return []string{
+		strconv.FormatUint(goebpf.ParseFlexibleInteger(key), 10),
+	}, nil
+}
+
+// IntValueDecoder reads integer value from map.
+// For Per-CPU maps values from all CPUs are summed up.
+func IntValueDecoder(m goebpf.Map, key []byte) (float64, error) {
+	val, err := m.LookupUint64(key)
+	if err != nil {
+		return 0, err
+	}
+	return float64(val), nil
+}
+
+// NewMapCollector creates Prometheus collector for eBPF map m
+func NewMapCollector(m goebpf.Map, opts MapCollectorOpts) *MapCollector {
+	c := &MapCollector{
+		m:            m,
+		valueType:    opts.ValueType,
+		keyDecoder:   opts.KeyDecoder,
+		valueDecoder: opts.ValueDecoder,
+	}
+	labels := opts.Labels
+	if labels == nil {
+		labels = []string{"key"}
+	}
+	if c.valueType == 0 {
+		c.valueType = prometheus.GaugeValue
+	}
+	if c.keyDecoder == nil {
+		c.keyDecoder = IntKeyDecoder
+	}
+	if c.valueDecoder == nil {
+		c.valueDecoder = IntValueDecoder
+	}
+	c.desc = prometheus.NewDesc(
+		prometheus.BuildFQName(opts.Namespace, opts.Subsystem, opts.Name),
+		opts.Help,
+		labels,
+		opts.ConstLabels,
+	)
+
+	return c
+}
+
+// Describe implements prometheus.Collector
+func (c *MapCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector: iterates over all map elements
+// and sends one sample per element.
+func (c *MapCollector) Collect(ch chan<- prometheus.Metric) {
+	key, err := c.m.GetNextKey(nil)
+	for ; err == nil; key, err = c.m.GetNextKey(key) {
+		labels, err := c.keyDecoder(key)
+		if err != nil {
+			ch <- prometheus.NewInvalidMetric(c.desc, fmt.Errorf("map '%s': %v", c.m.GetName(), err))
+			continue
+		}
+		value, err := c.valueDecoder(c.m, key)
+		if err != nil {
+			// Element may be deleted in between, skip it
+			continue
+		}
+		metric, err := prometheus.NewConstMetric(c.desc, c.valueType, value, labels...)
+		if err != nil {
+			metric = prometheus.NewInvalidMetric(c.desc, err)
+		}
+		ch <- metric
+	}
+	if err != goebpf.ErrNoMoreKeys {
+		ch <- prometheus.NewInvalidMetric(c.desc, fmt.Errorf("map '%s': %v", c.m.GetName(), err))
+	}
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_prometheus
+
+import (
+	"encoding/binary"
+	"errors"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/dropbox/goebpf"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// Simple in-memory map with uint32 keys / uint64 values
+type testMap struct {
+	goebpf.Map
+	items map[uint32]uint64
+}
+
+func (m *testMap) GetName() string {
+	return "test"
+}
+
+func (m *testMap) keys() []uint32 {
+	var keys []uint32
+	for k := range m.items {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+	return keys
+}
+
+func (m *testMap) GetNextKey(ikey interface{}) ([]byte, error) {
+	keys := m.keys()
+	idx := 0
+	if ikey != nil {
+		current := binary.LittleEndian.Uint32(ikey.([]byte))
+		for idx < len(keys) && keys[idx] <= current {
+			idx++
+		}
+	}
+	if idx == len(keys) {
+		return nil, goebpf.ErrNoMoreKeys
+	}
+	return goebpf.KeyValueToBytes(keys[idx], 4)
+}
+
+func (m *testMap) LookupUint64(ikey interface{}) (uint64, error) {
+	val, ok := m.items[binary.LittleEndian.Uint32(ikey.([]byte))]
+	if !ok {
+		return 0, errors.New("not found")
+	}
+	return val, nil
+}
+
+func TestMapCollector(t *testing.T) {
+	m := &testMap{
+		items: map[uint32]uint64{
+			6:  100,
+			17: 20,
+		},
+	}
+	c := NewMapCollector(m, MapCollectorOpts{
+		Namespace: "xdp",
+		Name:      "packets_total",
+		Help:      "Packets by protocol",
+		ValueType: prometheus.CounterValue,
+		Labels:    []string{"proto"},
+	})
+
+	expected := `
+# HELP xdp_packets_total Packets by protocol
+# TYPE xdp_packets_total counter
+xdp_packets_total{proto="17"} 20
+xdp_packets_total{proto="6"} 100
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected))
+	assert.NoError(t, err)
+}
+
+func TestMapCollectorKeyDecoder(t *testing.T) {
+	m := &testMap{
+		items: map[uint32]uint64{
+			1: 5,
+		},
+	}
+	c := NewMapCollector(m, MapCollectorOpts{
+		Name:   "requests",
+		Help:   "Requests",
+		Labels: []string{"method"},
+		KeyDecoder: func(key []byte) ([]string, error) {
+			if key[0] == 1 {
+				return []string{"GET"}, nil
+			}
+			return nil, errors.New("unknown method")
+		},
+	})
+
+	expected := `
+# HELP requests Requests
+# TYPE requests gauge
+requests{method="GET"} 5
+`
+	err := testutil.CollectAndCompare(c, strings.NewReader(expected))
+	assert.NoError(t, err)
+
+	// Key decoder error must be reported
+	m.items[2] = 1
+	err = testutil.CollectAndCompare(c, strings.NewReader(expected))
+	assert.Error(t, err)
+}
@@ -0,0 +1,428 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_ratelimit is per source address packet rate limiter:
+// rates are configured from Go and enforced by XDP program, rates can be
+// changed at any time without reloading program:
+//
+//	rl, err := goebpf_ratelimit.New(goebpf_ratelimit.DefaultMaxEntries)
+//	...
+//	defer rl.Close()
+//	// 100 packets per second with bursts up to 10 packets for everyone...
+//	err = rl.SetDefaultRate(goebpf_ratelimit.Rate{PacketsPerSecond: 100, Burst: 10})
+//	// ...but single host
+//	err = rl.SetRate("10.0.0.1", goebpf_ratelimit.Rate{PacketsPerSecond: 1000, Burst: 100})
+//
+//	prog, err := rl.Program()
+//	...
+//	err = prog.Load()
+//	err = prog.Attach("eth0")
+//
+// Token bucket is implemented as GCRA (generic cell rate algorithm), so program
+// needs just "theoretical arrival time" of next packet per address. State is
+// updated without locks, so under heavy load from single address spread across
+// CPUs slightly more packets than configured may pass.
+package goebpf_ratelimit
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/internal/maputil"
+	"github.com/dropbox/goebpf/internal/xdpsrc"
+)
+
+const (
+	// Names of maps used by FromSystem()
+	MapNameConfig = "ratelimit_conf"
+	MapNameState  = "ratelimit_state"
+	// DefaultMaxEntries is reasonable size of maps created by New()
+	DefaultMaxEntries = 16384
+	// Name of program returned by Program()
+	ProgramName = "xdp_ratelimit"
+
+	// Key is IPv6 address (IPv4 one is IPv4-mapped), all zeros for default rate
+	keySize = net.IPv6len
+	// Config value is struct { __u64 interval_ns; __u64 tolerance_ns; __u64 pps; __u64 burst; },
+	// program uses the first two fields only
+	configValueSize = 32
+	// State value is __u64 theoretical arrival time of next packet (bpf_ktime_get_ns())
+	stateValueSize = 8
+)
+
+// Rate is limit of packets from single address
+type Rate struct {
+	PacketsPerSecond uint64
+	// Number of packets allowed to arrive at once, 0 is the same as 1
+	Burst uint64
+}
+
+func (r Rate) String() string {
+	return fmt.Sprintf("%d pps, burst %d", r.PacketsPerSecond, r.Burst)
+}
+
+// RateLimiter manages configuration / state maps of rate limiting program
+type RateLimiter struct {
+	config, state goebpf.Map
+	// Maps were created by New() and closed by Close()
+	ownMaps bool
+}
+
+// Key of default rate
+var defaultKey goebpf.IPv6Key
+
+// New creates rate limiter along with its maps, able to hold rates of
+// maxEntries addresses. Maximum number of tracked addresses is maxEntries
+// as well, least recently seen ones are evicted.
+func New(maxEntries int) (*RateLimiter, error) {
+	config := &goebpf.EbpfMap{
+		Name:       MapNameConfig,
+		Type:       goebpf.MapTypeHash,
+		KeySize:    keySize,
+		ValueSize:  configValueSize,
+		MaxEntries: maxEntries,
+	}
+	state := &goebpf.EbpfMap{
+		Name:       MapNameState,
+		Type:       goebpf.MapTypeLRUHash,
+		KeySize:    keySize,
+		ValueSize:  stateValueSize,
+		MaxEntries: maxEntries,
+	}
+	if err := maputil.Create(config, state); err != nil {
+		return nil, err
+	}
+
+	rl, _ := NewFromMaps(config, state)
+	rl.ownMaps = true
+	return rl, nil
+}
+
+// NewFromMaps creates rate limiter on top of existing maps, e.g. defined by
+// own eBPF program. Both are hashes (state is usually LRU one) keyed by
+// struct in6_addr (IPv4 addresses are IPv4-mapped, zero one is default rate):
+//
+//	struct ratelimit_config {
+//		__u64 interval_ns;   // NSEC_PER_SEC / pps
+//		__u64 tolerance_ns;  // interval_ns * (burst - 1)
+//		__u64 pps;
+//		__u64 burst;
+//	};
+//	// state: __u64 theoretical arrival time of next packet
+func NewFromMaps(config, state goebpf.Map) (*RateLimiter, error) {
+	if config == nil || state == nil {
+		return nil, errors.New("Both config and state maps are required")
+	}
+
+	return &RateLimiter{
+		config: config,
+		state:  state,
+	}, nil
+}
+
+// FromSystem creates rate limiter on top of maps "ratelimit_conf" / "ratelimit_state"
+// of loaded ELF file
+func FromSystem(bpf goebpf.System) (*RateLimiter, error) {
+	maps, err := maputil.Find(bpf, MapNameConfig, MapNameState)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFromMaps(maps[0], maps[1])
+}
+
+// SetRate sets / changes rate of packets from address addr, overriding default
+// rate. Bucket of address is refilled.
+func (r *RateLimiter) SetRate(addr string, rate Rate) error {
+	key, err := parseKey(addr)
+	if err != nil {
+		return err
+	}
+	if err = r.setRate(key, rate); err != nil {
+		return err
+	}
+
+	return r.resetState(key)
+}
+
+// GetRate returns rate of address addr set by SetRate()
+func (r *RateLimiter) GetRate(addr string) (Rate, error) {
+	key, err := parseKey(addr)
+	if err != nil {
+		return Rate{}, err
+	}
+	value, err := r.config.Lookup(key)
+	if err != nil {
+		return Rate{}, err
+	}
+
+	return decodeRate(value)
+}
+
+// RemoveRate removes rate of address addr, so default one (if any) is applied
+func (r *RateLimiter) RemoveRate(addr string) error {
+	key, err := parseKey(addr)
+	if err != nil {
+		return err
+	}
+	if err = r.config.Delete(key); err != nil {
+		return err
+	}
+
+	return r.resetState(key)
+}
+
+// SetDefaultRate sets / changes rate of addresses without own one.
+// Buckets of all addresses are refilled.
+func (r *RateLimiter) SetDefaultRate(rate Rate) error {
+	if err := r.setRate(defaultKey, rate); err != nil {
+		return err
+	}
+
+	return r.ResetState()
+}
+
+// DefaultRate returns rate set by SetDefaultRate(), nil if there is none
+func (r *RateLimiter) DefaultRate() (*Rate, error) {
+	value, err := r.config.Lookup(defaultKey)
+	if errors.Is(err, goebpf.ErrKeyNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	rate, err := decodeRate(value)
+	if err != nil {
+		return nil, err
+	}
+
+	return &rate, nil
+}
+
+// RemoveDefaultRate removes default rate, so only addresses with own rates are limited
+func (r *RateLimiter) RemoveDefaultRate() error {
+	return r.config.Delete(defaultKey)
+}
+
+// Rates returns rates of all addresses set by SetRate(), by address
+func (r *RateLimiter) Rates() (map[string]Rate, error) {
+	res := map[string]Rate{}
+	var key interface{}
+	for {
+		next, err := r.config.GetNextKey(key)
+		if err == goebpf.ErrNoMoreKeys {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		key = next
+		var addr goebpf.IPv6Key
+		if err = addr.UnmarshalBinary(next); err != nil {
+			return nil, err
+		}
+		if addr == defaultKey {
+			continue
+		}
+		value, err := r.config.Lookup(next)
+		if err != nil {
+			// Removed in the meantime
+			continue
+		}
+		rate, err := decodeRate(value)
+		if err != nil {
+			return nil, err
+		}
+		res[addr.String()] = rate
+	}
+
+	return res, nil
+}
+
+// ResetState refills buckets of all addresses
+func (r *RateLimiter) ResetState() error {
+	// Deleting while iterating restarts enumeration, so collect keys first
+	var keys [][]byte
+	var key interface{}
+	for {
+		next, err := r.state.GetNextKey(key)
+		if err == goebpf.ErrNoMoreKeys {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		key = next
+		keys = append(keys, next)
+	}
+	for _, k := range keys {
+		// May be already evicted
+		r.state.Delete(k)
+	}
+
+	return nil
+}
+
+// Close closes maps created by New()
+func (r *RateLimiter) Close() error {
+	if !r.ownMaps {
+		return nil
+	}
+	return maputil.Close(r.config, r.state)
+}
+
+func (r *RateLimiter) setRate(key goebpf.IPv6Key, rate Rate) error {
+	value, err := encodeRate(rate)
+	if err != nil {
+		return err
+	}
+
+	return r.config.Upsert(key, value)
+}
+
+// Refills bucket of single address, which may be not tracked yet
+func (r *RateLimiter) resetState(key goebpf.IPv6Key) error {
+	err := r.state.Delete(key)
+	if errors.Is(err, goebpf.ErrKeyNotExist) {
+		return nil
+	}
+
+	return err
+}
+
+// Program returns XDP program dropping IPv4 / IPv6 packets exceeding rate of
+// their source address (VLAN tagged frames are passed as is).
+// Program is not loaded yet, see goebpf.Program.
+func (r *RateLimiter) Program() (goebpf.Program, error) {
+	return goebpf.NewProgram(ProgramName, goebpf.ProgramTypeXdp, "GPL", r.instructions())
+}
+
+// Stack layout: source address key, default key, new state value
+const (
+	stackKey        = -keySize
+	stackDefaultKey = 2 * -keySize
+	stackState      = 2*-keySize - stateValueSize
+)
+
+func (r *RateLimiter) instructions() goebpf.Instructions {
+	insns := xdpsrc.Dispatch()
+	// IPv4: key is ::ffff:saddr
+	insns = append(insns, xdpsrc.IPv4Src(stackKey+12)...)
+	insns = append(insns,
+		goebpf.StoreImm(goebpf.SizeDouble, goebpf.R10, stackKey, 0),
+		goebpf.Mov64Imm(goebpf.R5, 0xffff),
+		goebpf.ToBigEndian(goebpf.R5, 32),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, stackKey+8, goebpf.R5),
+		goebpf.Jump("lookup"),
+	)
+	// IPv6: key is saddr
+	insns = append(insns, xdpsrc.IPv6Src(stackKey)...)
+	insns = append(insns,
+		// Own rate of address, otherwise default one
+		goebpf.LoadMapFd(goebpf.R1, r.config).WithLabel("lookup"),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackKey),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R0, 0, "limit"),
+		goebpf.StoreImm(goebpf.SizeDouble, goebpf.R10, stackDefaultKey, 0),
+		goebpf.StoreImm(goebpf.SizeDouble, goebpf.R10, stackDefaultKey+8, 0),
+		goebpf.LoadMapFd(goebpf.R1, r.config),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackDefaultKey),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "pass"),
+
+		// R7 = interval, R8 = tolerance, R9 = now
+		goebpf.LoadMem(goebpf.SizeDouble, goebpf.R7, goebpf.R0, 0).WithLabel("limit"),
+		goebpf.LoadMem(goebpf.SizeDouble, goebpf.R8, goebpf.R0, 8),
+		goebpf.Call(goebpf.HelperKtimeGetNs),
+		goebpf.Mov64Reg(goebpf.R9, goebpf.R0),
+		goebpf.LoadMapFd(goebpf.R1, r.state),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackKey),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "new"),
+
+		// tat = max(tat, now); drop if tat - now > tolerance, otherwise tat += interval
+		goebpf.Mov64Reg(goebpf.R6, goebpf.R0),
+		goebpf.LoadMem(goebpf.SizeDouble, goebpf.R1, goebpf.R6, 0),
+		goebpf.JumpReg(goebpf.JumpOpGe, goebpf.R1, goebpf.R9, "check"),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R9),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R1).WithLabel("check"),
+		goebpf.Alu64Reg(goebpf.AluOpSub, goebpf.R2, goebpf.R9),
+		goebpf.JumpReg(goebpf.JumpOpGt, goebpf.R2, goebpf.R8, "drop"),
+		goebpf.Alu64Reg(goebpf.AluOpAdd, goebpf.R1, goebpf.R7),
+		goebpf.StoreMem(goebpf.SizeDouble, goebpf.R6, 0, goebpf.R1),
+		goebpf.Jump("pass"),
+
+		// First packet from address: tat = now + interval
+		goebpf.Alu64Reg(goebpf.AluOpAdd, goebpf.R9, goebpf.R7).WithLabel("new"),
+		goebpf.StoreMem(goebpf.SizeDouble, goebpf.R10, stackState, goebpf.R9),
+		goebpf.LoadMapFd(goebpf.R1, r.state),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackKey),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, stackState),
+		goebpf.Mov64Imm(goebpf.R4, 0),
+		goebpf.Call(goebpf.HelperMapUpdateElem),
+		goebpf.Jump("pass"),
+
+		goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpDrop)).WithLabel("drop"),
+		goebpf.Exit(),
+
+		goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpPass)).WithLabel("pass"),
+		goebpf.Exit(),
+	)
+
+	return insns
+}
+
+// Parses address into map key
+func parseKey(addr string) (goebpf.IPv6Key, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return goebpf.IPv6Key{}, fmt.Errorf("Invalid address '%s'", addr)
+	}
+	if ip.IsUnspecified() {
+		return goebpf.IPv6Key{}, fmt.Errorf("Address '%s' is reserved for default rate", addr)
+	}
+
+	return goebpf.NewIPv6Key(ip)
+}
+
+// Converts rate into config map value
+func encodeRate(rate Rate) ([]byte, error) {
+	if rate.PacketsPerSecond == 0 || rate.PacketsPerSecond > uint64(time.Second) {
+		return nil, fmt.Errorf("Invalid rate %d pps, must be 1..%d", rate.PacketsPerSecond, uint64(time.Second))
+	}
+	burst := rate.Burst
+	if burst == 0 {
+		burst = 1
+	}
+	interval := uint64(time.Second) / rate.PacketsPerSecond
+
+	bo := goebpf.HostByteOrder()
+	value := make([]byte, configValueSize)
+	bo.PutUint64(value, interval)
+	bo.PutUint64(value[8:], interval*(burst-1))
+	bo.PutUint64(value[16:], rate.PacketsPerSecond)
+	bo.PutUint64(value[24:], rate.Burst)
+
+	return value, nil
+}
+
+// Converts config map value into rate
+func decodeRate(value []byte) (Rate, error) {
+	if len(value) < configValueSize {
+		return Rate{}, fmt.Errorf("Invalid value size %d", len(value))
+	}
+	bo := goebpf.HostByteOrder()
+
+	return Rate{
+		PacketsPerSecond: bo.Uint64(value[16:]),
+		Burst:            bo.Uint64(value[24:]),
+	}, nil
+}
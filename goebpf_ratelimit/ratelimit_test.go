@@ -0,0 +1,92 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_ratelimit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_fake"
+)
+
+func TestEncodeRate(t *testing.T) {
+	bo := goebpf.HostByteOrder()
+
+	value, err := encodeRate(Rate{PacketsPerSecond: 100, Burst: 5})
+	require.NoError(t, err)
+	require.Len(t, value, configValueSize)
+	// interval / tolerance used by program
+	assert.Equal(t, uint64(10000000), bo.Uint64(value))
+	assert.Equal(t, uint64(40000000), bo.Uint64(value[8:]))
+
+	rate, err := decodeRate(value)
+	require.NoError(t, err)
+	assert.Equal(t, Rate{PacketsPerSecond: 100, Burst: 5}, rate)
+
+	// Zero burst means no bursts at all
+	value, err = encodeRate(Rate{PacketsPerSecond: 3})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(333333333), bo.Uint64(value))
+	assert.Equal(t, uint64(0), bo.Uint64(value[8:]))
+	rate, err = decodeRate(value)
+	require.NoError(t, err)
+	assert.Equal(t, Rate{PacketsPerSecond: 3}, rate)
+
+	_, err = encodeRate(Rate{})
+	assert.Error(t, err)
+	_, err = encodeRate(Rate{PacketsPerSecond: 2000000000})
+	assert.Error(t, err)
+	_, err = decodeRate(value[:8])
+	assert.Error(t, err)
+}
+
+func TestParseKey(t *testing.T) {
+	key, err := parseKey("10.0.0.1")
+	require.NoError(t, err)
+	// IPv4-mapped
+	assert.Equal(t, goebpf.MustIPv6Key("::ffff:10.0.0.1"), key)
+
+	key, err = parseKey("fc00::1")
+	require.NoError(t, err)
+	assert.Equal(t, goebpf.MustIPv6Key("fc00::1"), key)
+
+	for _, addr := range []string{"", "host", "10.0.0.0/8", "::", "0.0.0.0"} {
+		_, err = parseKey(addr)
+		assert.Error(t, err, addr)
+	}
+}
+
+func TestNewFromMaps(t *testing.T) {
+	_, err := NewFromMaps(nil, &goebpf.EbpfMap{})
+	assert.Error(t, err)
+	_, err = NewFromMaps(&goebpf.EbpfMap{}, nil)
+	assert.Error(t, err)
+}
+
+func TestDefaultRate(t *testing.T) {
+	config := goebpf_fake.NewFakeMap(MapNameConfig, goebpf.MapTypeHash, keySize, configValueSize, 10)
+	state := goebpf_fake.NewFakeMap(MapNameState, goebpf.MapTypeLRUHash, keySize, stateValueSize, 10)
+	require.NoError(t, config.Create())
+	require.NoError(t, state.Create())
+	rl, err := NewFromMaps(config, state)
+	require.NoError(t, err)
+
+	rate, err := rl.DefaultRate()
+	require.NoError(t, err)
+	assert.Nil(t, rate)
+
+	require.NoError(t, rl.SetDefaultRate(Rate{PacketsPerSecond: 10, Burst: 2}))
+	require.NoError(t, rl.SetRate("10.0.0.1", Rate{PacketsPerSecond: 20}))
+	rate, err = rl.DefaultRate()
+	require.NoError(t, err)
+	assert.Equal(t, &Rate{PacketsPerSecond: 10, Burst: 2}, rate)
+
+	// Failed lookup is not "no default rate"
+	config.Close()
+	_, err = rl.DefaultRate()
+	assert.Error(t, err)
+}
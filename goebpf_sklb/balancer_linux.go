@@ -0,0 +1,231 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_sklb
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/internal/maputil"
+)
+
+// Balancer steers traffic of services to their backend sockets
+type Balancer struct {
+	services    *goebpf.EbpfMap
+	sockets     *goebpf.EbpfMap
+	program     goebpf.Program
+	maxBackends int
+
+	mu sync.Mutex
+	// State of services by key
+	states map[string]*serviceState
+	// Unused slots of sockets map
+	free []int
+}
+
+// Every service owns slot of sockets map made of two banks of maxBackends
+// sockets each: new set of backends is written into inactive bank, then
+// service is switched over to it by single services map update.
+type serviceState struct {
+	service Service
+	slot    int
+	bank    int
+	count   int
+}
+
+// New creates maps able to hold maxServices services with up to
+// maxBackends backends each and loads program steering traffic to them.
+// Program is not attached yet, see Attach().
+func New(maxServices, maxBackends int) (*Balancer, error) {
+	if maxServices < 1 || maxBackends < 1 {
+		return nil, fmt.Errorf("Invalid capacity: %d services, %d backends", maxServices, maxBackends)
+	}
+	b := &Balancer{
+		services: &goebpf.EbpfMap{
+			Name:       ServicesMapName,
+			Type:       goebpf.MapTypeLPMTrie,
+			KeySize:    keySize,
+			ValueSize:  valueSize,
+			MaxEntries: maxServices,
+		},
+		sockets: &goebpf.EbpfMap{
+			Name:       SocketsMapName,
+			Type:       goebpf.MapTypeSockMap,
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 2 * maxServices * maxBackends,
+		},
+		maxBackends: maxBackends,
+		states:      make(map[string]*serviceState),
+	}
+	for slot := maxServices - 1; slot >= 0; slot-- {
+		b.free = append(b.free, slot)
+	}
+	if err := maputil.Create(b.services, b.sockets); err != nil {
+		return nil, err
+	}
+	prog, err := goebpf.NewProgram(ProgramName, goebpf.ProgramTypeSkLookup, "GPL",
+		instructions(b.services, b.sockets))
+	if err == nil {
+		err = prog.Load()
+	}
+	if err != nil {
+		b.closeMaps()
+		return nil, err
+	}
+	b.program = prog
+
+	return b, nil
+}
+
+// Program returns loaded SkLookup program
+func (b *Balancer) Program() goebpf.Program {
+	return b.program
+}
+
+// Attach attaches program to network namespace, empty path means
+// network namespace of current process
+func (b *Balancer) Attach(netnsPath string) error {
+	if netnsPath == "" {
+		return b.program.Attach(nil)
+	}
+	return b.program.Attach(netnsPath)
+}
+
+// SetBackends atomically replaces backends of service (adding service if
+// there is no such one yet). Backends are listening TCP sockets (e.g.
+// *net.TCPListener) for TCP services and unconnected UDP sockets (e.g.
+// *net.UDPConn) for UDP ones. Service without backends is kept, but its
+// traffic goes through regular socket lookup.
+func (b *Balancer) SetBackends(service Service, backends []syscall.Conn) error {
+	key, err := serviceKey(service)
+	if err != nil {
+		return err
+	}
+	if len(backends) > b.maxBackends {
+		return fmt.Errorf("Too many backends: %d, at most %d supported", len(backends), b.maxBackends)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, existing := b.states[string(key)]
+	if !existing {
+		if len(b.free) == 0 {
+			return fmt.Errorf("Unable to add service '%s': too many services", service)
+		}
+		// Empty bank 1 is "current" one, so bank 0 is filled first
+		state = &serviceState{
+			service: service,
+			slot:    b.free[len(b.free)-1],
+			bank:    1,
+		}
+	}
+
+	bank := 1 - state.bank
+	base := b.bankBase(state.slot, bank)
+	for i, conn := range backends {
+		if err = b.putSocket(base+i, conn); err != nil {
+			b.deleteSockets(base, i)
+			return fmt.Errorf("Unable to add backend #%d of service '%s': %v", i, service, err)
+		}
+	}
+	if err = b.services.Upsert(key, backendsValue(base, len(backends))); err != nil {
+		b.deleteSockets(base, len(backends))
+		return err
+	}
+	// No lookup uses old bank anymore
+	b.deleteSockets(b.bankBase(state.slot, state.bank), state.count)
+	state.bank = bank
+	state.count = len(backends)
+	if !existing {
+		b.free = b.free[:len(b.free)-1]
+		b.states[string(key)] = state
+	}
+
+	return nil
+}
+
+// RemoveService stops steering traffic of service
+func (b *Balancer) RemoveService(service Service) error {
+	key, err := serviceKey(service)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	state, ok := b.states[string(key)]
+	if !ok {
+		return fmt.Errorf("No such service '%s'", service)
+	}
+	if err = b.services.Delete(key); err != nil {
+		return err
+	}
+	b.deleteSockets(b.bankBase(state.slot, state.bank), state.count)
+	delete(b.states, string(key))
+	b.free = append(b.free, state.slot)
+
+	return nil
+}
+
+// Services returns all services, with or without backends
+func (b *Balancer) Services() []Service {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	res := make([]Service, 0, len(b.states))
+	for _, state := range b.states {
+		res = append(res, state.service)
+	}
+
+	return res
+}
+
+// Close detaches program and frees all resources.
+// Backend sockets are not closed.
+func (b *Balancer) Close() error {
+	err := b.program.Close()
+	b.closeMaps()
+	return err
+}
+
+func (b *Balancer) closeMaps() {
+	maputil.Close(b.services, b.sockets)
+}
+
+// First key of sockets map of bank of slot
+func (b *Balancer) bankBase(slot, bank int) int {
+	return (2*slot + bank) * b.maxBackends
+}
+
+// Adds socket to sockets map, map keeps its own reference to socket
+func (b *Balancer) putSocket(index int, conn syscall.Conn) error {
+	if conn == nil {
+		return errors.New("nil socket")
+	}
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var updateErr error
+	err = raw.Control(func(fd uintptr) {
+		updateErr = b.sockets.Upsert(uint32(index), uint32(fd))
+	})
+	if err != nil {
+		return err
+	}
+
+	return updateErr
+}
+
+func (b *Balancer) deleteSockets(base, count int) {
+	for i := 0; i < count; i++ {
+		b.sockets.Delete(uint32(base + i))
+	}
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_sklb is building block of socket level load balancer:
+// SkLookup program steers TCP connection requests / UDP packets destined
+// to service (protocol, local address prefix, port) to one of listening
+// sockets registered from Go, regardless of addresses / ports they are
+// bound to ("bind anywhere"):
+//
+//	lb, err := goebpf_sklb.New(goebpf_sklb.DefaultMaxServices, goebpf_sklb.DefaultMaxBackends)
+//	...
+//	defer lb.Close()
+//	if err = lb.Attach(""); err != nil {
+//		...
+//	}
+//	ln, err := net.Listen("tcp", "127.0.0.1:0")
+//	...
+//	_, prefix, _ := net.ParseCIDR("192.0.2.0/24")
+//	err = lb.SetBackends(goebpf_sklb.Service{Network: "tcp", Prefix: *prefix, Port: 80},
+//		[]syscall.Conn{ln.(*net.TCPListener)})
+//
+// Backend is picked by hash of remote address / port, so all packets of
+// UDP flow go to the same socket. Set of backends of service is replaced
+// atomically: every lookup sees either old set or new one, never mix of them.
+// Lookups not matching any service (or matching one without backends)
+// continue with regular socket lookup.
+package goebpf_sklb
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/dropbox/goebpf"
+)
+
+const (
+	// DefaultMaxServices / DefaultMaxBackends are reasonable capacities of maps created by New()
+	DefaultMaxServices = 256
+	DefaultMaxBackends = 64
+	// Names of maps / program
+	ServicesMapName = "sklb_services"
+	SocketsMapName  = "sklb_sockets"
+	ProgramName     = "sklb_dispatch"
+
+	// Key of LPM trie of services is struct sklb_service_key, value is
+	// struct sklb_backends: range of sockets map keys holding backends.
+	//
+	//	struct sklb_service_key {
+	//		__u32 prefixlen;
+	//		__u8  protocol;
+	//		__u8  pad;
+	//		__u16 port;      // host byte order
+	//		__u8  addr[16];  // IPv4 addresses are IPv4-mapped IPv6 ones
+	//	};
+	//	struct sklb_backends {
+	//		__u32 base;
+	//		__u32 count;
+	//	};
+	keySize   = 24
+	valueSize = 8
+	// Protocol, pad and port are always matched entirely
+	keyFixedBits = 32
+)
+
+// Offsets of fields of struct sklb_service_key / struct sklb_backends
+const (
+	keyPrefixLen = 0
+	keyProtocol  = 4
+	keyPort      = 6
+	keyAddr      = 8
+
+	valueBase  = 0
+	valueCount = 4
+)
+
+// Service is set of local endpoints traffic of which is steered to backends
+type Service struct {
+	// "tcp" or "udp"
+	Network string
+	// Local addresses, either IPv4 or IPv6 ones
+	Prefix net.IPNet
+	Port   int
+}
+
+func (s Service) String() string {
+	return fmt.Sprintf("%s %s port %d", s.Network, s.Prefix.String(), s.Port)
+}
+
+// IPPROTO_TCP / IPPROTO_UDP
+const (
+	protoTCP = 6
+	protoUDP = 17
+)
+
+// Encodes service into key of services map
+func serviceKey(s Service) ([]byte, error) {
+	key := make([]byte, keySize)
+	switch s.Network {
+	case "tcp":
+		key[keyProtocol] = protoTCP
+	case "udp":
+		key[keyProtocol] = protoUDP
+	default:
+		return nil, fmt.Errorf("Unsupported network '%s', must be 'tcp' or 'udp'", s.Network)
+	}
+	if s.Port < 1 || s.Port > 65535 {
+		return nil, fmt.Errorf("Invalid port %d", s.Port)
+	}
+	goebpf.HostByteOrder().PutUint16(key[keyPort:], uint16(s.Port))
+
+	ones, bits := s.Prefix.Mask.Size()
+	switch {
+	case bits == 32 && s.Prefix.IP.To4() != nil:
+		// IPv4-mapped IPv6 address: ::ffff:a.b.c.d
+		ones += 96
+	case bits == 128 && s.Prefix.IP.To4() == nil && s.Prefix.IP.To16() != nil:
+	default:
+		return nil, fmt.Errorf("Invalid prefix '%s'", s.Prefix.String())
+	}
+	copy(key[keyAddr:], s.Prefix.IP.Mask(s.Prefix.Mask).To16())
+	goebpf.HostByteOrder().PutUint32(key[keyPrefixLen:], uint32(keyFixedBits+ones))
+
+	return key, nil
+}
+
+func backendsValue(base, count int) []byte {
+	value := make([]byte, valueSize)
+	goebpf.HostByteOrder().PutUint32(value[valueBase:], uint32(base))
+	goebpf.HostByteOrder().PutUint32(value[valueCount:], uint32(count))
+	return value
+}
+
+// Offsets of fields of struct bpf_sk_lookup, see <linux/bpf.h>
+const (
+	ctxFamily     = 8
+	ctxProtocol   = 12
+	ctxRemoteIP4  = 16
+	ctxRemoteIP6  = 20
+	ctxRemotePort = 36
+	ctxLocalIP4   = 40
+	ctxLocalIP6   = 44
+	ctxLocalPort  = 60
+)
+
+const (
+	afInet6 = 10
+	// SK_PASS: continue with socket picked by program, or regular lookup if none
+	skPass = 1
+	// 0x9e3779b1 (golden ratio) as signed immediate
+	hashMultiplier = -0x61c8864f
+)
+
+// Stack layout: service key, sockets map key
+const (
+	stackKey    = -keySize
+	stackSocket = stackKey - 4
+)
+
+// SkLookup program: looks up service of local endpoint, assigns one of its
+// backends picked by hash of remote endpoint
+func instructions(services, sockets goebpf.Map) goebpf.Instructions {
+	insns := goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R6, goebpf.R1),
+
+		// Service key of local endpoint, full length
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, stackKey+keyPrefixLen, keyFixedBits+128),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, ctxProtocol),
+		goebpf.StoreMem(goebpf.SizeByte, goebpf.R10, stackKey+keyProtocol, goebpf.R1),
+		goebpf.StoreImm(goebpf.SizeByte, goebpf.R10, stackKey+keyProtocol+1, 0),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, ctxLocalPort),
+		goebpf.StoreMem(goebpf.SizeHalf, goebpf.R10, stackKey+keyPort, goebpf.R1),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, ctxFamily),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R1, afInet6, "ipv4"),
+	}
+	for off := int16(0); off < 16; off += 4 {
+		insns = append(insns,
+			goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, ctxLocalIP6+off),
+			goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, stackKey+keyAddr+off, goebpf.R1),
+		)
+	}
+	insns = append(insns,
+		goebpf.Jump("lookup"),
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, stackKey+keyAddr, 0).WithLabel("ipv4"),
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, stackKey+keyAddr+4, 0),
+		goebpf.StoreImm(goebpf.SizeHalf, goebpf.R10, stackKey+keyAddr+8, 0),
+		goebpf.StoreImm(goebpf.SizeHalf, goebpf.R10, stackKey+keyAddr+10, -1),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, ctxLocalIP4),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, stackKey+keyAddr+12, goebpf.R1),
+
+		// R7 = first backend, R8 = count of backends
+		goebpf.LoadMapFd(goebpf.R1, services).WithLabel("lookup"),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackKey),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "pass"),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R7, goebpf.R0, valueBase),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R8, goebpf.R0, valueCount),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R8, 0, "pass"),
+
+		// Hash of remote endpoint (one of IPv4 / IPv6 addresses is zero)
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, ctxRemoteIP4),
+	)
+	for off := int16(0); off < 16; off += 4 {
+		insns = append(insns,
+			goebpf.LoadMem(goebpf.SizeWord, goebpf.R2, goebpf.R6, ctxRemoteIP6+off),
+			goebpf.Alu32Reg(goebpf.AluOpXor, goebpf.R1, goebpf.R2),
+		)
+	}
+	insns = append(insns,
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R2, goebpf.R6, ctxRemotePort),
+		goebpf.Alu32Reg(goebpf.AluOpXor, goebpf.R1, goebpf.R2),
+		goebpf.Alu32Imm(goebpf.AluOpMul, goebpf.R1, hashMultiplier),
+		goebpf.Alu32Imm(goebpf.AluOpRsh, goebpf.R1, 16),
+		goebpf.Alu32Reg(goebpf.AluOpMod, goebpf.R1, goebpf.R8),
+		goebpf.Alu32Reg(goebpf.AluOpAdd, goebpf.R1, goebpf.R7),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, stackSocket, goebpf.R1),
+
+		// Socket reference taken by lookup must be released
+		goebpf.LoadMapFd(goebpf.R1, sockets),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackSocket),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "pass"),
+		goebpf.Mov64Reg(goebpf.R7, goebpf.R0),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R6),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R7),
+		goebpf.Mov64Imm(goebpf.R3, 0),
+		goebpf.Call(goebpf.HelperSkAssign),
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R7),
+		goebpf.Call(goebpf.HelperSkRelease),
+
+		// Socket failed to be assigned (e.g. of wrong protocol) is skipped as well
+		goebpf.Mov64Imm(goebpf.R0, skPass).WithLabel("pass"),
+		goebpf.Exit(),
+	)
+
+	return insns
+}
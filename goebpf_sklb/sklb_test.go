@@ -0,0 +1,66 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_sklb
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_fake"
+)
+
+func mustPrefix(s string) net.IPNet {
+	_, prefix, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return *prefix
+}
+
+func TestServiceKey(t *testing.T) {
+	bo := goebpf.HostByteOrder()
+
+	key, err := serviceKey(Service{Network: "tcp", Prefix: mustPrefix("192.0.2.7/24"), Port: 80})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(32+96+24), bo.Uint32(key[keyPrefixLen:]))
+	assert.Equal(t, byte(protoTCP), key[keyProtocol])
+	assert.Equal(t, uint16(80), bo.Uint16(key[keyPort:]))
+	assert.Equal(t, []byte(net.ParseIP("192.0.2.0").To16()), key[keyAddr:])
+
+	key, err = serviceKey(Service{Network: "udp", Prefix: mustPrefix("2001:db8::1/128"), Port: 53})
+	require.NoError(t, err)
+	assert.Equal(t, uint32(32+128), bo.Uint32(key[keyPrefixLen:]))
+	assert.Equal(t, byte(protoUDP), key[keyProtocol])
+	assert.Equal(t, []byte(net.ParseIP("2001:db8::1")), key[keyAddr:])
+
+	invalid := []Service{
+		{Network: "sctp", Prefix: mustPrefix("10.0.0.0/8"), Port: 80},
+		{Network: "tcp", Prefix: mustPrefix("10.0.0.0/8"), Port: 0},
+		{Network: "tcp", Prefix: mustPrefix("10.0.0.0/8"), Port: 65536},
+		{Network: "tcp", Port: 80},
+	}
+	for _, s := range invalid {
+		_, err = serviceKey(s)
+		assert.Error(t, err, s.String())
+	}
+}
+
+func TestBackendsValue(t *testing.T) {
+	value := backendsValue(128, 3)
+	assert.Len(t, value, valueSize)
+	assert.Equal(t, uint32(128), goebpf.HostByteOrder().Uint32(value[valueBase:]))
+	assert.Equal(t, uint32(3), goebpf.HostByteOrder().Uint32(value[valueCount:]))
+}
+
+func TestProgram(t *testing.T) {
+	services := goebpf_fake.NewFakeMap(ServicesMapName, goebpf.MapTypeLPMTrie, keySize, valueSize, 16)
+	sockets := goebpf_fake.NewFakeMap(SocketsMapName, goebpf.MapTypeSockMap, 4, 4, 64)
+	prog, err := goebpf.NewProgram(ProgramName, goebpf.ProgramTypeSkLookup, "GPL", instructions(services, sockets))
+	require.NoError(t, err)
+	assert.Equal(t, goebpf.ProgramTypeSkLookup, prog.GetType())
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_systemd keeps eBPF objects (links, maps, programs) of daemon
+// alive across its restarts in systemd file descriptor store, instead of
+// pinning them to bpffs. Objects are passed to systemd by sd_notify("FDSTORE=1")
+// and handed back to new instance of daemon by socket activation protocol
+// (LISTEN_FDS / LISTEN_FDNAMES), so attached programs keep running in between.
+//
+// Unit of daemon must allow fd store:
+//
+//	[Service]
+//	Type=notify
+//	FileDescriptorStoreMax=16
+//	# Keep fd store on "systemctl stop" too (systemd 254+)
+//	FileDescriptorStorePreserve=yes
+//
+// Go side:
+//
+//	store, err := goebpf_systemd.Open()
+//	link, err := store.Link("xdp_eth0")
+//	if err != nil {
+//		// First start: attach program, hand link over to systemd
+//		link, err = ...
+//		err = store.PutLink("xdp_eth0", link)
+//	}
+//	...
+//	err = store.Close()
+//
+// Objects stay in store till removed by Delete() or service is stopped.
+package goebpf_systemd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Fds passed by systemd start from 3 (SD_LISTEN_FDS_START)
+const listenFdsStart = 3
+
+// Max length of FDNAME, see fdname_is_valid() of systemd
+const maxFdNameLen = 255
+
+// Name systemd gives to fds stored without name
+const unnamedFd = "unknown"
+
+// FdStore is systemd file descriptor store of service, see Open()
+type FdStore struct {
+	mu     sync.Mutex
+	socket string
+	// Fds handed over by systemd on start, not taken yet
+	fds map[string][]int
+}
+
+// Open takes fds passed by systemd on start of service and prepares
+// storing new ones. Fds are taken once per process: LISTEN_* environment
+// variables are unset, so children don't inherit them.
+// Without systemd (NOTIFY_SOCKET is not set) store is empty and Put*()
+// fail with error matching goebpf.ErrNotSupported.
+func Open() (*FdStore, error) {
+	fds, err := listenFds(os.Getenv("LISTEN_PID"), os.Getenv("LISTEN_FDS"), os.Getenv("LISTEN_FDNAMES"), os.Getpid())
+	if err != nil {
+		return nil, err
+	}
+	for _, nameFds := range fds {
+		for _, fd := range nameFds {
+			syscall.CloseOnExec(fd)
+		}
+	}
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	return &FdStore{
+		socket: os.Getenv("NOTIFY_SOCKET"),
+		fds:    fds,
+	}, nil
+}
+
+// Parses LISTEN_* variables into fds by names
+func listenFds(pid, count, names string, ownPid int) (map[string][]int, error) {
+	res := make(map[string][]int)
+	if pid == "" {
+		return res, nil
+	}
+	listenPid, err := strconv.Atoi(pid)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid LISTEN_PID '%s': %v", pid, err)
+	}
+	if listenPid != ownPid {
+		// Fds are meant for other process (e.g. parent)
+		return res, nil
+	}
+	n, err := strconv.Atoi(count)
+	if err != nil || n < 0 {
+		return nil, fmt.Errorf("Invalid LISTEN_FDS '%s'", count)
+	}
+	var fdNames []string
+	if names != "" {
+		fdNames = strings.Split(names, ":")
+	}
+	for i := 0; i < n; i++ {
+		name := unnamedFd
+		if i < len(fdNames) && fdNames[i] != "" {
+			name = fdNames[i]
+		}
+		res[name] = append(res[name], listenFdsStart+i)
+	}
+
+	return res, nil
+}
+
+// Checks name the way systemd does: printable ASCII without ':'
+func validateFdName(name string) error {
+	if name == "" || len(name) > maxFdNameLen {
+		return fmt.Errorf("Invalid fd name '%s': must be 1..%d characters long", name, maxFdNameLen)
+	}
+	for _, c := range name {
+		if c < ' ' || c > '~' || c == ':' {
+			return fmt.Errorf("Invalid fd name '%s': must be printable ASCII without ':'", name)
+		}
+	}
+	return nil
+}
+
+// Names returns sorted names of fds handed over by systemd and not taken yet
+func (s *FdStore) Names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]string, 0, len(s.fds))
+	for name := range s.fds {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// Take returns fd handed over by systemd under name, false if there is none.
+// Caller owns fd, it is not returned again. Extra fds of the same name
+// (e.g. stored by older version of daemon) are closed.
+func (s *FdStore) Take(name string) (int, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fds, ok := s.fds[name]
+	if !ok {
+		return 0, false
+	}
+	for _, fd := range fds[1:] {
+		syscall.Close(fd)
+	}
+	delete(s.fds, name)
+
+	return fds[0], true
+}
+
+// Link returns BPF link stored under name by previous instance of daemon
+func (s *FdStore) Link(name string) (*goebpf.Link, error) {
+	fd, ok := s.Take(name)
+	if !ok {
+		return nil, fmt.Errorf("Link '%s' is not in fd store", name)
+	}
+	return goebpf.NewLinkFromFd(fd)
+}
+
+// Map returns map stored under name by previous instance of daemon
+func (s *FdStore) Map(name string) (*goebpf.EbpfMap, error) {
+	fd, ok := s.Take(name)
+	if !ok {
+		return nil, fmt.Errorf("Map '%s' is not in fd store", name)
+	}
+	m, err := goebpf.NewMapFromExistingMapByFd(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return m, nil
+}
+
+// Program returns fd of program stored under name by previous instance of
+// daemon along with its information, e.g. to check its tag before re-use
+func (s *FdStore) Program(name string) (int, *goebpf.ProgramInfo, error) {
+	fd, ok := s.Take(name)
+	if !ok {
+		return 0, nil, fmt.Errorf("Program '%s' is not in fd store", name)
+	}
+	info, err := goebpf.GetProgramInfoByFd(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return 0, nil, err
+	}
+	return fd, info, nil
+}
+
+// Put passes duplicate of fd to systemd to keep under name,
+// replacing fds previously stored under the same name
+func (s *FdStore) Put(name string, fd int) error {
+	if err := validateFdName(name); err != nil {
+		return err
+	}
+	if fd <= 0 {
+		return errors.New("Object is not created / loaded")
+	}
+	if err := s.notify("FDSTOREREMOVE=1\nFDNAME="+name, nil); err != nil {
+		return err
+	}
+	// Object fds never signal POLLHUP, no need for systemd to poll them
+	return s.notify("FDSTORE=1\nFDPOLL=0\nFDNAME="+name, []int{fd})
+}
+
+// PutLink stores BPF link, so program stays attached while daemon restarts
+func (s *FdStore) PutLink(name string, l *goebpf.Link) error {
+	return s.Put(name, l.GetFd())
+}
+
+// PutMap stores map, so its content survives restarts of daemon
+func (s *FdStore) PutMap(name string, m *goebpf.EbpfMap) error {
+	return s.Put(name, m.GetFd())
+}
+
+// PutProgram stores loaded program
+func (s *FdStore) PutProgram(name string, prog goebpf.Program) error {
+	return s.Put(name, prog.GetFd())
+}
+
+// Delete removes fds stored under name from systemd, objects are
+// destroyed once nobody else holds them
+func (s *FdStore) Delete(name string) error {
+	if err := validateFdName(name); err != nil {
+		return err
+	}
+	return s.notify("FDSTOREREMOVE=1\nFDNAME="+name, nil)
+}
+
+// Close closes fds handed over by systemd and not taken, they stay in fd store
+func (s *FdStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for name, fds := range s.fds {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		delete(s.fds, name)
+	}
+	return nil
+}
+
+// Sends sd_notify() message along with fds
+func (s *FdStore) notify(msg string, fds []int) error {
+	if s.socket == "" {
+		return &goebpf.NotSupportedError{Feature: "systemd fd store without NOTIFY_SOCKET"}
+	}
+	fd, err := syscall.Socket(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		return fmt.Errorf("socket() failed: %v", err)
+	}
+	defer syscall.Close(fd)
+
+	var oob []byte
+	if len(fds) > 0 {
+		oob = syscall.UnixRights(fds...)
+	}
+	// Abstract sockets start with "@", SockaddrUnix handles it
+	err = syscall.Sendmsg(fd, []byte(msg), oob, &syscall.SockaddrUnix{Name: s.socket}, 0)
+	if err != nil {
+		return fmt.Errorf("sd_notify() failed: %v", err)
+	}
+	return nil
+}
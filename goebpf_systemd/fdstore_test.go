@@ -0,0 +1,132 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+)
+
+func TestListenFds(t *testing.T) {
+	fds, err := listenFds("", "", "", 100)
+	require.NoError(t, err)
+	assert.Empty(t, fds)
+
+	// Meant for other process
+	fds, err = listenFds("99", "2", "a:b", 100)
+	require.NoError(t, err)
+	assert.Empty(t, fds)
+
+	fds, err = listenFds("100", "4", "xdp_eth0:counters::counters", 100)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]int{
+		"xdp_eth0": {3},
+		"counters": {4, 6},
+		"unknown":  {5},
+	}, fds)
+
+	fds, err = listenFds("100", "2", "", 100)
+	require.NoError(t, err)
+	assert.Equal(t, map[string][]int{"unknown": {3, 4}}, fds)
+
+	_, err = listenFds("abc", "1", "", 100)
+	assert.Error(t, err)
+	_, err = listenFds("100", "-1", "", 100)
+	assert.Error(t, err)
+}
+
+func TestValidateFdName(t *testing.T) {
+	assert.NoError(t, validateFdName("xdp_eth0"))
+	assert.Error(t, validateFdName(""))
+	assert.Error(t, validateFdName("a:b"))
+	assert.Error(t, validateFdName("a\nFDSTORE=1"))
+	assert.Error(t, validateFdName(string(make([]byte, 256))))
+}
+
+func TestFdStoreTake(t *testing.T) {
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	// Extra fd of the same name is closed by Take()
+	extra, err := syscall.Dup(int(w.Fd()))
+	require.NoError(t, err)
+	w.Close()
+
+	s := &FdStore{fds: map[string][]int{"pipe": {int(r.Fd()), extra}}}
+	assert.Equal(t, []string{"pipe"}, s.Names())
+	fd, ok := s.Take("pipe")
+	assert.True(t, ok)
+	assert.Equal(t, int(r.Fd()), fd)
+	assert.Empty(t, s.Names())
+	assert.Equal(t, syscall.EBADF, syscall.Close(extra))
+
+	_, ok = s.Take("pipe")
+	assert.False(t, ok)
+	_, err = s.Link("pipe")
+	assert.Error(t, err)
+	_, err = s.Map("pipe")
+	assert.Error(t, err)
+	_, _, err = s.Program("pipe")
+	assert.Error(t, err)
+}
+
+func TestFdStorePut(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	require.NoError(t, err)
+	defer conn.Close()
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	defer w.Close()
+
+	s := &FdStore{socket: path}
+	require.NoError(t, s.Put("pipe", int(r.Fd())))
+
+	buf := make([]byte, 256)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	require.NoError(t, err)
+	assert.Equal(t, "FDSTOREREMOVE=1\nFDNAME=pipe", string(buf[:n]))
+	assert.Equal(t, 0, oobn)
+
+	n, oobn, _, _, err = conn.ReadMsgUnix(buf, oob)
+	require.NoError(t, err)
+	assert.Equal(t, "FDSTORE=1\nFDPOLL=0\nFDNAME=pipe", string(buf[:n]))
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	require.NoError(t, err)
+	require.Len(t, msgs, 1)
+	fds, err := syscall.ParseUnixRights(&msgs[0])
+	require.NoError(t, err)
+	require.Len(t, fds, 1)
+	syscall.Close(fds[0])
+
+	require.NoError(t, s.Delete("pipe"))
+	n, _, _, _, err = conn.ReadMsgUnix(buf, oob)
+	require.NoError(t, err)
+	assert.Equal(t, "FDSTOREREMOVE=1\nFDNAME=pipe", string(buf[:n]))
+
+	assert.Error(t, s.Put("a:b", int(r.Fd())))
+	assert.Error(t, s.Put("pipe", 0))
+	assert.Error(t, s.PutMap("counters", &goebpf.EbpfMap{Name: "counters"}))
+}
+
+func TestFdStoreWithoutSystemd(t *testing.T) {
+	s := &FdStore{fds: map[string][]int{}}
+	err := s.Put("pipe", 1)
+	assert.True(t, errors.Is(err, goebpf.ErrNotSupported))
+	err = s.Delete("pipe")
+	assert.True(t, errors.Is(err, goebpf.ErrNotSupported))
+	assert.NoError(t, s.Close())
+}
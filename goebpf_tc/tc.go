@@ -0,0 +1,274 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_tc manages tc (traffic control) objects eBPF classifiers
+// are attached by: clsact qdisc and bpf filters on its ingress / egress hooks.
+// It is thin layer over the same netlink library goebpf uses for XDP, so custom
+// tc setups can be composed without another netlink dependency:
+//
+//	if err := goebpf_tc.AddClsact("eth0"); err != nil {
+//		...
+//	}
+//	err := goebpf_tc.AddFilter("eth0", goebpf_tc.Ingress, &goebpf_tc.Filter{
+//		Fd:           prog.GetFd(),
+//		Name:         "my_classifier",
+//		Priority:     1,
+//		Handle:       1,
+//		DirectAction: true,
+//	})
+package goebpf_tc
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Direction is hook of clsact qdisc filter is attached to
+type Direction int
+
+const (
+	Ingress Direction = iota
+	Egress
+)
+
+func (d Direction) String() string {
+	switch d {
+	case Ingress:
+		return "ingress"
+	case Egress:
+		return "egress"
+	}
+	return fmt.Sprintf("Direction(%d)", int(d))
+}
+
+// Parent handle of filters for given direction
+func (d Direction) parent() (uint32, error) {
+	switch d {
+	case Ingress:
+		return netlink.HANDLE_MIN_INGRESS, nil
+	case Egress:
+		return netlink.HANDLE_MIN_EGRESS, nil
+	}
+	return 0, fmt.Errorf("Invalid direction %v", d)
+}
+
+// Filter is bpf filter (classifier) of clsact qdisc
+type Filter struct {
+	// Filters run in order of priority (lower first), zero means "assign automatically"
+	Priority uint16
+	// Identifies filter within priority, zero means "assign automatically"
+	Handle uint32
+	// Name of program as shown by "tc filter show"
+	Name string
+	// Return code of program is tc action (TC_ACT_*), instead of classid
+	DirectAction bool
+	// Program to attach, used only by AddFilter() / ReplaceFilter()
+	Fd int
+	// ID of attached program, reported by ListFilters()
+	ProgramId int
+}
+
+func linkByName(ifname string) (netlink.Link, error) {
+	link, err := netlink.LinkByName(ifname)
+	audit("LinkByName", ifname, err)
+	if err != nil {
+		return nil, fmt.Errorf("LinkByName(%s) failed: %v", ifname, err)
+	}
+	return link, nil
+}
+
+// Reports netlink request to audit sink of library, see goebpf.SetAuditSink()
+func audit(op, ifname string, err error) {
+	goebpf.RecordAudit(goebpf.AuditSourceNetlink, op, ifname, err)
+}
+
+// Makes netlink request changing interface, retrying transient failures
+// (see goebpf.SetRetryPolicy()) and reporting every attempt to audit sink
+func request(op, ifname string, fn func() error) error {
+	return goebpf.RetryTransient(func() error {
+		err := fn()
+		audit(op, ifname, err)
+		return err
+	})
+}
+
+func clsact(link netlink.Link) *netlink.Clsact {
+	return &netlink.Clsact{
+		QdiscAttrs: netlink.QdiscAttrs{
+			LinkIndex: link.Attrs().Index,
+			Handle:    netlink.MakeHandle(0xffff, 0),
+			Parent:    netlink.HANDLE_CLSACT,
+		},
+	}
+}
+
+// HasClsact checks if interface has clsact qdisc
+func HasClsact(ifname string) (bool, error) {
+	link, err := linkByName(ifname)
+	if err != nil {
+		return false, err
+	}
+	qdiscs, err := netlink.QdiscList(link)
+	audit("QdiscList", ifname, err)
+	if err != nil {
+		return false, fmt.Errorf("Unable to list qdiscs of '%s': %v", ifname, err)
+	}
+	for _, qdisc := range qdiscs {
+		if qdisc.Type() == "clsact" {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
+// AddClsact adds clsact qdisc to interface, does nothing if it already has one
+func AddClsact(ifname string) error {
+	link, err := linkByName(ifname)
+	if err != nil {
+		return err
+	}
+	err = request("QdiscAdd", ifname, func() error {
+		return netlink.QdiscAdd(clsact(link))
+	})
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("Unable to add clsact qdisc to '%s': %v", ifname, err)
+	}
+
+	return nil
+}
+
+// DeleteClsact removes clsact qdisc from interface, along with all its filters
+func DeleteClsact(ifname string) error {
+	link, err := linkByName(ifname)
+	if err != nil {
+		return err
+	}
+	err = request("QdiscDel", ifname, func() error {
+		return netlink.QdiscDel(clsact(link))
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to delete clsact qdisc of '%s': %v", ifname, err)
+	}
+
+	return nil
+}
+
+func bpfFilter(ifname string, dir Direction, f *Filter) (*netlink.BpfFilter, error) {
+	link, err := linkByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := dir.parent()
+	if err != nil {
+		return nil, err
+	}
+
+	return &netlink.BpfFilter{
+		FilterAttrs: netlink.FilterAttrs{
+			LinkIndex: link.Attrs().Index,
+			Parent:    parent,
+			Priority:  f.Priority,
+			Handle:    f.Handle,
+			Protocol:  unix.ETH_P_ALL,
+		},
+		Fd:           f.Fd,
+		Name:         f.Name,
+		DirectAction: f.DirectAction,
+	}, nil
+}
+
+// AddFilter attaches program f.Fd to ingress / egress of interface.
+// Interface must have clsact qdisc, see AddClsact().
+func AddFilter(ifname string, dir Direction, f *Filter) error {
+	filter, err := bpfFilter(ifname, dir, f)
+	if err != nil {
+		return err
+	}
+	err = request("FilterAdd", ifname, func() error {
+		return netlink.FilterAdd(filter)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to add %v filter to '%s': %v", dir, ifname, err)
+	}
+
+	return nil
+}
+
+// ReplaceFilter atomically replaces program of filter with given priority / handle,
+// or adds filter if there is no such one yet
+func ReplaceFilter(ifname string, dir Direction, f *Filter) error {
+	if f.Priority == 0 || f.Handle == 0 {
+		return errors.New("Priority and handle are required to replace filter")
+	}
+	filter, err := bpfFilter(ifname, dir, f)
+	if err != nil {
+		return err
+	}
+	err = request("FilterReplace", ifname, func() error {
+		return netlink.FilterReplace(filter)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to replace %v filter of '%s': %v", dir, ifname, err)
+	}
+
+	return nil
+}
+
+// DeleteFilter removes filter with given priority / handle
+func DeleteFilter(ifname string, dir Direction, priority uint16, handle uint32) error {
+	filter, err := bpfFilter(ifname, dir, &Filter{
+		Priority: priority,
+		Handle:   handle,
+	})
+	if err != nil {
+		return err
+	}
+	err = request("FilterDel", ifname, func() error {
+		return netlink.FilterDel(filter)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to delete %v filter of '%s': %v", dir, ifname, err)
+	}
+
+	return nil
+}
+
+// ListFilters returns bpf filters attached to ingress / egress of interface
+func ListFilters(ifname string, dir Direction) ([]Filter, error) {
+	link, err := linkByName(ifname)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := dir.parent()
+	if err != nil {
+		return nil, err
+	}
+	filters, err := netlink.FilterList(link, parent)
+	audit("FilterList", ifname, err)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list %v filters of '%s': %v", dir, ifname, err)
+	}
+
+	var res []Filter
+	for _, filter := range filters {
+		bpf, ok := filter.(*netlink.BpfFilter)
+		if !ok {
+			continue
+		}
+		res = append(res, Filter{
+			Priority:     bpf.Priority,
+			Handle:       bpf.Handle,
+			Name:         bpf.Name,
+			DirectAction: bpf.DirectAction,
+			ProgramId:    bpf.Id,
+		})
+	}
+
+	return res, nil
+}
@@ -0,0 +1,33 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_tc
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/vishvananda/netlink"
+)
+
+func TestDirection(t *testing.T) {
+	assert.Equal(t, "ingress", Ingress.String())
+	assert.Equal(t, "egress", Egress.String())
+	assert.Equal(t, "Direction(5)", Direction(5).String())
+
+	parent, err := Ingress.parent()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(netlink.HANDLE_MIN_INGRESS), parent)
+	parent, err = Egress.parent()
+	assert.NoError(t, err)
+	assert.Equal(t, uint32(netlink.HANDLE_MIN_EGRESS), parent)
+	_, err = Direction(5).parent()
+	assert.Error(t, err)
+}
+
+func TestReplaceFilterRequiresHandle(t *testing.T) {
+	err := ReplaceFilter("lo", Ingress, &Filter{Priority: 1})
+	assert.Error(t, err)
+	err = ReplaceFilter("lo", Ingress, &Filter{Handle: 1})
+	assert.Error(t, err)
+}
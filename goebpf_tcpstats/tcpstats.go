@@ -0,0 +1,372 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_tcpstats collects TCP latency / health metrics per remote
+// address without packet capture: sockops program attached to cgroup v2
+// gets RTT updates, retransmissions and retransmission timeouts of TCP
+// connections from kernel (linux 5.3+) and accumulates them in map:
+//
+//	ts, err := goebpf_tcpstats.New(goebpf_tcpstats.DefaultMaxEntries)
+//	...
+//	defer ts.Close()
+//	prog, err := ts.Program()
+//	...
+//	err = prog.Load()
+//	err = prog.Attach("/sys/fs/cgroup")
+//	defer prog.Detach()
+//	...
+//	all, err := ts.All()
+//	for addr, s := range all {
+//		fmt.Println(addr, s.AvgRTT, s.MinRTT, s.Retransmits)
+//	}
+//
+// Only connections established after program is attached are tracked.
+package goebpf_tcpstats
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/internal/maputil"
+)
+
+const (
+	// MapName is name of map used by FromSystem()
+	MapName = "tcp_stats"
+	// DefaultMaxEntries is reasonable size of map created by New()
+	DefaultMaxEntries = 65536
+	// Name of program returned by Program()
+	ProgramName = "sockops_tcp"
+
+	// Key is remote IPv6 address (IPv4 one is IPv4-mapped)
+	keySize = net.IPv6len
+	// Value is struct tcp_stats, see NewFromMap()
+	valueSize = 40
+)
+
+// Stats is TCP statistics of connections to / from single remote address
+type Stats struct {
+	// Number of RTT updates
+	Samples uint64
+	// Average of smoothed RTT over all updates
+	AvgRTT time.Duration
+	// Smoothed RTT of the last update
+	SmoothedRTT time.Duration
+	// Minimal RTT seen by the last updated connection
+	MinRTT time.Duration
+	// Number of retransmitted segments
+	Retransmits uint64
+	// Number of retransmission timeouts
+	Timeouts uint64
+}
+
+// Monitor reads TCP statistics map
+type Monitor struct {
+	m goebpf.Map
+	// Map was created by New() and closed by Close()
+	ownMap bool
+}
+
+// New creates monitor along with its map, able to hold stats of maxEntries
+// remote addresses, least recently updated ones are evicted.
+func New(maxEntries int) (*Monitor, error) {
+	m := &goebpf.EbpfMap{
+		Name:       MapName,
+		Type:       goebpf.MapTypeLRUHash,
+		KeySize:    keySize,
+		ValueSize:  valueSize,
+		MaxEntries: maxEntries,
+	}
+	if err := maputil.Create(m); err != nil {
+		return nil, err
+	}
+
+	mon, _ := NewFromMap(m)
+	mon.ownMap = true
+	return mon, nil
+}
+
+// NewFromMap creates monitor on top of existing map, e.g. filled by own
+// eBPF program. Map is (LRU) hash keyed by struct in6_addr of remote address
+// (IPv4 addresses are IPv4-mapped):
+//
+//	struct tcp_stats {
+//		__u64 rtt_samples;
+//		__u64 rtt_sum_us;     // sum of srtt_us >> 3 of every RTT update
+//		__u64 retransmits;    // segments
+//		__u64 timeouts;
+//		__u32 srtt_us;        // the last smoothed RTT, not scaled
+//		__u32 min_rtt_us;
+//	};
+func NewFromMap(m goebpf.Map) (*Monitor, error) {
+	if m == nil {
+		return nil, errors.New("Map is required")
+	}
+
+	return &Monitor{m: m}, nil
+}
+
+// FromSystem creates monitor on top of map "tcp_stats" of loaded ELF file
+func FromSystem(bpf goebpf.System) (*Monitor, error) {
+	maps, err := maputil.Find(bpf, MapName)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewFromMap(maps[0])
+}
+
+// Get returns stats of remote address addr
+func (mon *Monitor) Get(addr string) (Stats, error) {
+	key, err := parseKey(addr)
+	if err != nil {
+		return Stats{}, err
+	}
+	value, err := mon.m.Lookup(key)
+	if err != nil {
+		return Stats{}, err
+	}
+
+	return decodeStats(value)
+}
+
+// All returns stats of all remote addresses, by address
+func (mon *Monitor) All() (map[string]Stats, error) {
+	res := map[string]Stats{}
+	var key interface{}
+	for {
+		next, err := mon.m.GetNextKey(key)
+		if err == goebpf.ErrNoMoreKeys {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		key = next
+		var addr goebpf.IPv6Key
+		if err = addr.UnmarshalBinary(next); err != nil {
+			return nil, err
+		}
+		value, err := mon.m.Lookup(next)
+		if err != nil {
+			// Evicted in the meantime
+			continue
+		}
+		s, err := decodeStats(value)
+		if err != nil {
+			return nil, err
+		}
+		res[addr.String()] = s
+	}
+
+	return res, nil
+}
+
+// Reset forgets stats of all addresses
+func (mon *Monitor) Reset() error {
+	// Deleting while iterating restarts enumeration, so collect keys first
+	var keys [][]byte
+	var key interface{}
+	for {
+		next, err := mon.m.GetNextKey(key)
+		if err == goebpf.ErrNoMoreKeys {
+			break
+		}
+		if err != nil {
+			return err
+		}
+		key = next
+		keys = append(keys, next)
+	}
+	for _, k := range keys {
+		// May be already evicted
+		mon.m.Delete(k)
+	}
+
+	return nil
+}
+
+// Close closes map created by New()
+func (mon *Monitor) Close() error {
+	if !mon.ownMap {
+		return nil
+	}
+
+	return mon.m.Close()
+}
+
+// Program returns sockops program filling map of monitor.
+// Program is not loaded yet, see goebpf.Program.
+func (mon *Monitor) Program() (goebpf.Program, error) {
+	return goebpf.NewProgram(ProgramName, goebpf.ProgramTypeSockOps, "GPL", mon.instructions())
+}
+
+// Fields of struct bpf_sock_ops, see <linux/bpf.h>
+const (
+	sockOpsOp        = 0
+	sockOpsArg1      = 8 // args[1]
+	sockOpsFamily    = 20
+	sockOpsRemoteIP4 = 24
+	sockOpsRemoteIP6 = 32
+	sockOpsSrttUs    = 80
+	sockOpsRttMin    = 92
+)
+
+// Operations / callback flags of sockops program, see enum in <linux/bpf.h>
+const (
+	opActiveEstablished  = 4
+	opPassiveEstablished = 5
+	opRTO                = 8
+	opRetrans            = 9
+	opRTT                = 12
+	cbFlagRTO            = 1 << 0
+	cbFlagRetrans        = 1 << 1
+	cbFlagRTT            = 1 << 3
+	afInet               = 2
+	afInet6              = 10
+	bpfNoExist           = 1
+)
+
+// Offsets of fields of struct tcp_stats
+const (
+	valueSamples     = 0
+	valueRttSum      = 8
+	valueRetransmits = 16
+	valueTimeouts    = 24
+	valueSrtt        = 32
+	valueMinRtt      = 36
+)
+
+// Stack layout: key, zero value for new entries
+const (
+	stackKey   = -keySize
+	stackValue = stackKey - valueSize
+)
+
+func (mon *Monitor) instructions() goebpf.Instructions {
+	// R6 = ctx, R8 = op
+	insns := goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R6, goebpf.R1),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R8, goebpf.R6, sockOpsOp),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R8, opActiveEstablished, "established"),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R8, opPassiveEstablished, "established"),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R8, opRTT, "key"),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R8, opRetrans, "key"),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R8, opRTO, "key"),
+		goebpf.Jump("out"),
+
+		// Subscribe connection to callbacks, fails on kernels without RTT ones
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R6).WithLabel("established"),
+		goebpf.Mov64Imm(goebpf.R2, cbFlagRTO|cbFlagRetrans|cbFlagRTT),
+		goebpf.Call(goebpf.HelperSockOpsCbFlagsSet),
+		goebpf.Jump("out"),
+
+		// Key is remote address
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, sockOpsFamily).WithLabel("key"),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R1, afInet6, "ipv6"),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R1, afInet, "out"),
+		goebpf.StoreImm(goebpf.SizeDouble, goebpf.R10, stackKey, 0),
+		goebpf.Mov64Imm(goebpf.R1, 0xffff),
+		goebpf.ToBigEndian(goebpf.R1, 32),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, stackKey+8, goebpf.R1),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, sockOpsRemoteIP4),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, stackKey+12, goebpf.R1),
+		goebpf.Jump("lookup"),
+	}
+	for off := 0; off < net.IPv6len; off += 4 {
+		insn := goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, int16(sockOpsRemoteIP6+off))
+		if off == 0 {
+			insn = insn.WithLabel("ipv6")
+		}
+		insns = append(insns,
+			insn,
+			goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, int16(stackKey+off), goebpf.R1),
+		)
+	}
+	insns = append(insns,
+		// R9 = stats of address, created if there are none yet
+		goebpf.LoadMapFd(goebpf.R1, mon.m).WithLabel("lookup"),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackKey),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R0, 0, "found"),
+	)
+	for off := 0; off < valueSize; off += 8 {
+		insns = append(insns, goebpf.StoreImm(goebpf.SizeDouble, goebpf.R10, int16(stackValue+off), 0))
+	}
+	insns = append(insns,
+		goebpf.LoadMapFd(goebpf.R1, mon.m),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackKey),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, stackValue),
+		goebpf.Mov64Imm(goebpf.R4, bpfNoExist),
+		goebpf.Call(goebpf.HelperMapUpdateElem),
+		// May be created concurrently, lookup again regardless of result
+		goebpf.LoadMapFd(goebpf.R1, mon.m),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, stackKey),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "out"),
+		goebpf.Mov64Reg(goebpf.R9, goebpf.R0).WithLabel("found"),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R8, opRTT, "rtt"),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R8, opRetrans, "retrans"),
+
+		// Retransmission timeout
+		goebpf.Mov64Imm(goebpf.R1, 1),
+		goebpf.AtomicAdd(goebpf.SizeDouble, goebpf.R9, valueTimeouts, goebpf.R1),
+		goebpf.Jump("out"),
+
+		// RTT update: srtt_us of socket is scaled by 8
+		goebpf.Mov64Imm(goebpf.R1, 1).WithLabel("rtt"),
+		goebpf.AtomicAdd(goebpf.SizeDouble, goebpf.R9, valueSamples, goebpf.R1),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, sockOpsSrttUs),
+		goebpf.Alu64Imm(goebpf.AluOpRsh, goebpf.R1, 3),
+		goebpf.AtomicAdd(goebpf.SizeDouble, goebpf.R9, valueRttSum, goebpf.R1),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R9, valueSrtt, goebpf.R1),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, sockOpsRttMin),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R9, valueMinRtt, goebpf.R1),
+		goebpf.Jump("out"),
+
+		// Retransmission: args[1] is number of segments
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R1, goebpf.R6, sockOpsArg1).WithLabel("retrans"),
+		goebpf.AtomicAdd(goebpf.SizeDouble, goebpf.R9, valueRetransmits, goebpf.R1),
+
+		goebpf.Mov64Imm(goebpf.R0, 1).WithLabel("out"),
+		goebpf.Exit(),
+	)
+
+	return insns
+}
+
+func parseKey(addr string) (goebpf.IPv6Key, error) {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return goebpf.IPv6Key{}, fmt.Errorf("Invalid address '%s'", addr)
+	}
+
+	return goebpf.NewIPv6Key(ip)
+}
+
+// Converts map value into stats
+func decodeStats(value []byte) (Stats, error) {
+	if len(value) < valueSize {
+		return Stats{}, fmt.Errorf("Invalid value size %d", len(value))
+	}
+	bo := goebpf.HostByteOrder()
+	s := Stats{
+		Samples:     bo.Uint64(value[valueSamples:]),
+		SmoothedRTT: time.Duration(bo.Uint32(value[valueSrtt:])) * time.Microsecond,
+		MinRTT:      time.Duration(bo.Uint32(value[valueMinRtt:])) * time.Microsecond,
+		Retransmits: bo.Uint64(value[valueRetransmits:]),
+		Timeouts:    bo.Uint64(value[valueTimeouts:]),
+	}
+	if s.Samples > 0 {
+		s.AvgRTT = time.Duration(bo.Uint64(value[valueRttSum:])/s.Samples) * time.Microsecond
+	}
+
+	return s, nil
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_tcpstats
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_fake"
+)
+
+func statsValue(samples, rttSum, retransmits, timeouts uint64, srtt, minRtt uint32) []byte {
+	bo := goebpf.HostByteOrder()
+	value := make([]byte, valueSize)
+	bo.PutUint64(value[valueSamples:], samples)
+	bo.PutUint64(value[valueRttSum:], rttSum)
+	bo.PutUint64(value[valueRetransmits:], retransmits)
+	bo.PutUint64(value[valueTimeouts:], timeouts)
+	bo.PutUint32(value[valueSrtt:], srtt)
+	bo.PutUint32(value[valueMinRtt:], minRtt)
+	return value
+}
+
+func TestMonitor(t *testing.T) {
+	m := goebpf_fake.NewFakeMap(MapName, goebpf.MapTypeLRUHash, keySize, valueSize, 16)
+	mon, err := NewFromMap(m)
+	require.NoError(t, err)
+	defer mon.Close()
+
+	require.NoError(t, m.Insert(goebpf.MustIPv6Key("10.0.0.1"), statsValue(4, 4000, 3, 1, 900, 500)))
+	require.NoError(t, m.Insert(goebpf.MustIPv6Key("fc00::1"), statsValue(0, 0, 0, 0, 0, 0)))
+
+	s, err := mon.Get("10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, Stats{
+		Samples:     4,
+		AvgRTT:      time.Millisecond,
+		SmoothedRTT: 900 * time.Microsecond,
+		MinRTT:      500 * time.Microsecond,
+		Retransmits: 3,
+		Timeouts:    1,
+	}, s)
+	_, err = mon.Get("10.0.0.2")
+	assert.Error(t, err)
+	_, err = mon.Get("bad")
+	assert.Error(t, err)
+
+	all, err := mon.All()
+	require.NoError(t, err)
+	assert.Len(t, all, 2)
+	assert.Equal(t, uint64(3), all["10.0.0.1"].Retransmits)
+	// No RTT samples yet
+	assert.Equal(t, time.Duration(0), all["fc00::1"].AvgRTT)
+
+	require.NoError(t, mon.Reset())
+	all, err = mon.All()
+	require.NoError(t, err)
+	assert.Empty(t, all)
+}
+
+func TestMonitorProgram(t *testing.T) {
+	mon, err := NewFromMap(goebpf_fake.NewFakeMap(MapName, goebpf.MapTypeLRUHash, keySize, valueSize, 16))
+	require.NoError(t, err)
+
+	prog, err := mon.Program()
+	require.NoError(t, err)
+	assert.Equal(t, goebpf.ProgramTypeSockOps, prog.GetType())
+	assert.Equal(t, ProgramName, prog.GetName())
+
+	_, err = NewFromMap(nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,234 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_tenant partitions state of eBPF program per tenant (customer,
+// VRF, container, etc) by map-in-map: outer hash of maps is keyed by tenant ID,
+// every tenant has own inner map of layout defined by inner map template, so
+// tenants can't see / exhaust entries of each other:
+//
+//	struct bpf_map_def SEC("maps") rules_template = {
+//		.map_type = BPF_MAP_TYPE_HASH,
+//		.key_size = sizeof(struct rule_key),
+//		.value_size = sizeof(__u32),
+//		.max_entries = 4096,
+//	};
+//	struct bpf_map_def SEC("maps") tenant_rules = {
+//		.map_type = BPF_MAP_TYPE_HASH_OF_MAPS,
+//		.key_size = sizeof(__u32),
+//		.max_entries = 256,
+//		.inner_map_def = &rules_template,
+//	};
+//
+//	void *rules = bpf_map_lookup_elem(&tenant_rules, &tenant_id);
+//	if (!rules)
+//		return XDP_DROP;
+//	__u32 *action = bpf_map_lookup_elem(rules, &key);
+//
+// Go side:
+//
+//	mgr, err := goebpf_tenant.NewManager(bpf.GetMapByName("tenant_rules").(*goebpf.EbpfMap),
+//		goebpf_tenant.Options{PinDir: "/sys/fs/bpf/tenant_rules"})
+//	t, err := mgr.Add(42)
+//	err = t.Put(key, uint32(actionDrop))
+//	usage, err := mgr.Usage(ctx)
+//	err = mgr.Remove(42)
+//
+// With PinDir set inner maps are pinned, so Add() of the same tenant after
+// restart picks up its existing state.
+package goebpf_tenant
+
+import (
+	"context"
+	"encoding"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Options are optional settings of Manager
+type Options struct {
+	// Directory in bpffs inner maps are pinned at, not pinned if empty
+	PinDir string
+	// Inner maps are named "<NamePrefix>_<tenant ID>", name of outer map if empty
+	NamePrefix string
+}
+
+// Manager allocates / destroys per-tenant inner maps of outer map, see NewManager()
+type Manager struct {
+	mu      sync.Mutex
+	outer   *goebpf.EbpfMap
+	set     *goebpf.InnerMapSet
+	prefix  string
+	tenants map[uint32]*Tenant
+}
+
+// NewManager creates manager of tenants of outer hash / array of maps with
+// __u32 keys (tenant IDs). Outer map must have inner map template, i.e. be
+// loaded from ELF with inner_map_def or have one set by SetInnerTemplate().
+func NewManager(outer *goebpf.EbpfMap, opts Options) (*Manager, error) {
+	if outer.KeySize != 4 {
+		return nil, fmt.Errorf("Map '%s' key size is %d, tenant ID is __u32", outer.Name, outer.KeySize)
+	}
+	set, err := goebpf.NewInnerMapSet(outer, opts.PinDir)
+	if err != nil {
+		return nil, err
+	}
+	prefix := opts.NamePrefix
+	if prefix == "" {
+		prefix = outer.Name
+	}
+
+	return &Manager{
+		outer:   outer,
+		set:     set,
+		prefix:  prefix,
+		tenants: make(map[uint32]*Tenant),
+	}, nil
+}
+
+// Name of inner map of tenant
+func (m *Manager) innerName(id uint32) string {
+	return fmt.Sprintf("%s_%d", m.prefix, id)
+}
+
+// Add allocates inner map of tenant and makes it visible to programs.
+// Fails with goebpf.ErrMapFull when outer map has no room for more tenants.
+func (m *Manager) Add(id uint32) (*Tenant, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tenants[id]; ok {
+		return nil, fmt.Errorf("Tenant %d already exists", id)
+	}
+	inner, err := m.set.CreateInner(m.innerName(id), id)
+	if err != nil {
+		return nil, err
+	}
+	t := &Tenant{ID: id, m: inner}
+	m.tenants[id] = t
+
+	return t, nil
+}
+
+// Get returns tenant added by Add(), nil if there is no such tenant
+func (m *Manager) Get(id uint32) *Tenant {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.tenants[id]
+}
+
+// Remove removes tenant from outer map (programs stop seeing it right away)
+// and destroys its inner map along with all its entries.
+func (m *Manager) Remove(id uint32) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if _, ok := m.tenants[id]; !ok {
+		return fmt.Errorf("Tenant %d does not exist", id)
+	}
+	if err := m.set.DeleteInner(m.innerName(id)); err != nil {
+		return err
+	}
+	delete(m.tenants, id)
+
+	return nil
+}
+
+// Tenants returns sorted IDs of tenants
+func (m *Manager) Tenants() []uint32 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	res := make([]uint32, 0, len(m.tenants))
+	for id := range m.tenants {
+		res = append(res, id)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i] < res[j]
+	})
+	return res
+}
+
+// Usage returns occupancy / churn of inner maps of all tenants,
+// e.g. to find tenants close to their limit (see goebpf.EbpfMap.Stats())
+func (m *Manager) Usage(ctx context.Context) (map[uint32]goebpf.MapStats, error) {
+	m.mu.Lock()
+	tenants := make([]*Tenant, 0, len(m.tenants))
+	for _, t := range m.tenants {
+		tenants = append(tenants, t)
+	}
+	m.mu.Unlock()
+
+	res := make(map[uint32]goebpf.MapStats, len(tenants))
+	for _, t := range tenants {
+		stats, err := t.Usage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to get usage of tenant %d: %v", t.ID, err)
+		}
+		res[t.ID] = stats
+	}
+
+	return res, nil
+}
+
+// Close releases inner maps of all tenants. Tenants stay in outer map
+// (and pinned), so programs keep using them.
+func (m *Manager) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.tenants = make(map[uint32]*Tenant)
+	return m.set.Close()
+}
+
+// Tenant is state of single tenant: its inner map
+type Tenant struct {
+	ID uint32
+	m  *goebpf.EbpfMap
+}
+
+// Map returns inner map of tenant
+func (t *Tenant) Map() *goebpf.EbpfMap {
+	return t.m
+}
+
+// Put inserts / replaces entry of tenant. Key / value are of types
+// goebpf.EbpfMap.Upsert() accepts, sizes must match inner map template.
+func (t *Tenant) Put(key, value interface{}) error {
+	return t.m.Upsert(key, value)
+}
+
+// Get decodes entry of tenant into value, e.g. goebpf.Be32 or own type
+// implementing encoding.BinaryUnmarshaler
+func (t *Tenant) Get(key interface{}, value encoding.BinaryUnmarshaler) error {
+	return t.m.LookupValue(key, value)
+}
+
+// GetUint32 returns __u32 entry of tenant
+func (t *Tenant) GetUint32(key interface{}) (uint32, error) {
+	return t.m.LookupUint32(key)
+}
+
+// GetUint64 returns integer entry (up to 8 bytes) of tenant
+func (t *Tenant) GetUint64(key interface{}) (uint64, error) {
+	return t.m.LookupUint64(key)
+}
+
+// Delete removes entry of tenant
+func (t *Tenant) Delete(key interface{}) error {
+	return t.m.Delete(key)
+}
+
+// ForEach calls fn for every entry of tenant, see goebpf.ForEachMapEntry()
+func (t *Tenant) ForEach(ctx context.Context, fn func(key, value []byte) error) error {
+	return goebpf.ForEachMapEntry(ctx, t.m, fn)
+}
+
+// Usage returns number of entries of tenant along with number of changes
+// made through this Tenant
+func (t *Tenant) Usage(ctx context.Context) (goebpf.MapStats, error) {
+	return t.m.Stats(ctx)
+}
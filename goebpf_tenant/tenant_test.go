@@ -0,0 +1,46 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_tenant
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+)
+
+func TestNewManagerNegative(t *testing.T) {
+	template := &goebpf.EbpfMap{Name: "template", Type: goebpf.MapTypeHash, KeySize: 4, ValueSize: 4, MaxEntries: 16}
+
+	_, err := NewManager(template, Options{})
+	assert.EqualError(t, err, "Map 'template' (Hash) is not array / hash of maps")
+
+	outer := &goebpf.EbpfMap{Name: "tenants", Type: goebpf.MapTypeHashOfMaps, KeySize: 8, MaxEntries: 16}
+	_, err = NewManager(outer, Options{})
+	assert.EqualError(t, err, "Map 'tenants' key size is 8, tenant ID is __u32")
+
+	outer.KeySize = 4
+	_, err = NewManager(outer, Options{})
+	assert.EqualError(t, err, "Map 'tenants' has no inner map template")
+}
+
+func TestManagerNames(t *testing.T) {
+	template := &goebpf.EbpfMap{Name: "template", Type: goebpf.MapTypeHash, KeySize: 4, ValueSize: 4, MaxEntries: 16}
+	outer := &goebpf.EbpfMap{Name: "tenants", Type: goebpf.MapTypeHashOfMaps, KeySize: 4, MaxEntries: 16}
+	require.NoError(t, outer.SetInnerTemplate(template))
+
+	m, err := NewManager(outer, Options{})
+	require.NoError(t, err)
+	assert.Equal(t, "tenants_42", m.innerName(42))
+	assert.Empty(t, m.Tenants())
+	assert.Nil(t, m.Get(42))
+	assert.EqualError(t, m.Remove(42), "Tenant 42 does not exist")
+
+	m, err = NewManager(outer, Options{NamePrefix: "acl"})
+	require.NoError(t, err)
+	assert.Equal(t, "acl_7", m.innerName(7))
+	assert.NoError(t, m.Close())
+}
@@ -0,0 +1,92 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_testnet
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+)
+
+const (
+	ethHeaderLen  = 14
+	ipv4HeaderLen = 20
+	ethTypeIPv4   = 0x0800
+)
+
+// IPv4Packet is Ethernet frame with IPv4 packet (without options), to build
+// test input for forwarding programs / check their output
+type IPv4Packet struct {
+	SrcMac   net.HardwareAddr
+	DstMac   net.HardwareAddr
+	Src      net.IP
+	Dst      net.IP
+	TTL      uint8
+	Protocol uint8
+	// L4 header along with payload
+	Payload []byte
+}
+
+// Bytes encodes packet, IPv4 header checksum is calculated
+func (p *IPv4Packet) Bytes() []byte {
+	res := make([]byte, ethHeaderLen+ipv4HeaderLen+len(p.Payload))
+
+	copy(res[0:], p.DstMac)
+	copy(res[6:], p.SrcMac)
+	binary.BigEndian.PutUint16(res[12:], ethTypeIPv4)
+
+	ip := res[ethHeaderLen:]
+	ip[0] = 0x45 // version 4, 5 words header
+	binary.BigEndian.PutUint16(ip[2:], uint16(ipv4HeaderLen+len(p.Payload)))
+	ip[8] = p.TTL
+	ip[9] = p.Protocol
+	copy(ip[12:], p.Src.To4())
+	copy(ip[16:], p.Dst.To4())
+	binary.BigEndian.PutUint16(ip[10:], ipv4Checksum(ip[:ipv4HeaderLen]))
+	copy(ip[ipv4HeaderLen:], p.Payload)
+
+	return res
+}
+
+// ParseIPv4Packet decodes Ethernet frame with IPv4 packet, e.g. output of
+// program test run. Fails if packet is not IPv4 or header checksum is invalid.
+func ParseIPv4Packet(data []byte) (*IPv4Packet, error) {
+	if len(data) < ethHeaderLen+ipv4HeaderLen {
+		return nil, errors.New("Packet is too short")
+	}
+	if binary.BigEndian.Uint16(data[12:]) != ethTypeIPv4 {
+		return nil, errors.New("Not IPv4 packet")
+	}
+	ip := data[ethHeaderLen:]
+	headerLen := int(ip[0]&0xf) * 4
+	totalLen := int(binary.BigEndian.Uint16(ip[2:]))
+	if ip[0]>>4 != 4 || headerLen < ipv4HeaderLen || totalLen < headerLen || totalLen > len(ip) {
+		return nil, errors.New("Invalid IPv4 header")
+	}
+	if ipv4Checksum(ip[:headerLen]) != 0 {
+		return nil, errors.New("Invalid IPv4 header checksum")
+	}
+
+	return &IPv4Packet{
+		DstMac:   net.HardwareAddr(append([]byte(nil), data[0:6]...)),
+		SrcMac:   net.HardwareAddr(append([]byte(nil), data[6:12]...)),
+		TTL:      ip[8],
+		Protocol: ip[9],
+		Src:      net.IP(append([]byte(nil), ip[12:16]...)),
+		Dst:      net.IP(append([]byte(nil), ip[16:20]...)),
+		Payload:  append([]byte(nil), ip[headerLen:totalLen]...),
+	}, nil
+}
+
+// Internet checksum (RFC 1071) of header, zero for header with valid checksum
+func ipv4Checksum(header []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(header); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(header[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
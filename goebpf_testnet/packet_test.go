@@ -0,0 +1,46 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_testnet
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPv4Packet(t *testing.T) {
+	pkt := &IPv4Packet{
+		SrcMac:   net.HardwareAddr{0, 1, 2, 3, 4, 5},
+		DstMac:   net.HardwareAddr{6, 7, 8, 9, 10, 11},
+		Src:      net.IPv4(10, 0, 0, 1),
+		Dst:      net.IPv4(192, 168, 1, 1),
+		TTL:      64,
+		Protocol: 17,
+		Payload:  []byte{1, 2, 3, 4, 5, 6, 7, 8},
+	}
+	data := pkt.Bytes()
+	require.Len(t, data, 14+20+8)
+	// Precalculated checksum of this header
+	assert.Equal(t, []byte{0xaf, 0x27}, data[24:26])
+
+	parsed, err := ParseIPv4Packet(data)
+	require.NoError(t, err)
+	assert.Equal(t, pkt.SrcMac, parsed.SrcMac)
+	assert.Equal(t, pkt.DstMac, parsed.DstMac)
+	assert.True(t, pkt.Src.Equal(parsed.Src))
+	assert.True(t, pkt.Dst.Equal(parsed.Dst))
+	assert.Equal(t, pkt.TTL, parsed.TTL)
+	assert.Equal(t, pkt.Protocol, parsed.Protocol)
+	assert.Equal(t, pkt.Payload, parsed.Payload)
+
+	// TTL changed without checksum update
+	data[22]--
+	_, err = ParseIPv4Packet(data)
+	assert.Error(t, err)
+
+	_, err = ParseIPv4Packet(data[:20])
+	assert.Error(t, err)
+}
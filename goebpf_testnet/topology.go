@@ -0,0 +1,285 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_testnet builds throwaway network topologies (veth pairs,
+// addresses, routes, neighbors) in dedicated network namespace, so programs
+// which depend on routing state (e.g. XDP forwarders using bpf_fib_lookup())
+// can be integration tested reproducibly by BPF_PROG_TEST_RUN, without
+// touching host network configuration:
+//
+//	topo, err := goebpf_testnet.NewTopology()
+//	defer topo.Close()
+//	topo.AddVethPair("in0", "10.0.0.1/24", "in1")
+//	topo.AddVethPair("out0", "10.1.0.1/24", "out1")
+//	topo.AddNeighbor("10.1.0.2", "out0")
+//	topo.AddRoute("192.168.0.0/16", "10.1.0.2")
+//
+//	in0, _ := topo.Interface("in0")
+//	res, err := topo.TestRun(prog, goebpf.TestRunParams{
+//		Data:           packet,
+//		IngressIfindex: in0.Index,
+//	})
+//
+// Requires root (CAP_NET_ADMIN / CAP_SYS_ADMIN).
+package goebpf_testnet
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"runtime"
+
+	"github.com/dropbox/goebpf"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netns"
+)
+
+// Sysctls enabling forwarding, without them bpf_fib_lookup() returns BPF_FIB_LKUP_RET_FWD_DISABLED
+var forwardingSysctls = []string{
+	"/proc/sys/net/ipv4/conf/all/forwarding",
+	"/proc/sys/net/ipv6/conf/all/forwarding",
+}
+
+// Topology is network namespace along with links / routes created in it.
+// All links are destroyed along with namespace by Close().
+type Topology struct {
+	ns     netns.NsHandle
+	handle *netlink.Handle
+	// Other end of veth links
+	peers map[string]string
+}
+
+// NewTopology creates new network namespace with loopback interface up
+// and IPv4 / IPv6 forwarding enabled
+func NewTopology() (*Topology, error) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get current network namespace: %v", err)
+	}
+	defer orig.Close()
+
+	// netns.New() switches current thread into new namespace
+	ns, err := netns.New()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create network namespace: %v", err)
+	}
+	if err = netns.Set(orig); err != nil {
+		ns.Close()
+		return nil, fmt.Errorf("Unable to return to original network namespace: %v", err)
+	}
+
+	t := &Topology{
+		ns:    ns,
+		peers: make(map[string]string),
+	}
+	if t.handle, err = netlink.NewHandleAt(ns); err != nil {
+		ns.Close()
+		return nil, fmt.Errorf("Unable to open netlink socket: %v", err)
+	}
+	if err = t.setup(); err != nil {
+		t.Close()
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func (t *Topology) setup() error {
+	lo, err := t.handle.LinkByName("lo")
+	if err != nil {
+		return err
+	}
+	if err = t.handle.LinkSetUp(lo); err != nil {
+		return fmt.Errorf("Unable to set loopback up: %v", err)
+	}
+
+	return t.Do(func() error {
+		for _, sysctl := range forwardingSysctls {
+			if err := ioutil.WriteFile(sysctl, []byte("1"), 0644); err != nil {
+				return fmt.Errorf("Unable to enable forwarding: %v", err)
+			}
+		}
+		return nil
+	})
+}
+
+// Do runs f with current goroutine switched into topology's network namespace,
+// e.g. to run program by goebpf.ProgramTestRun() or open socket there
+func (t *Topology) Do(f func() error) error {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	orig, err := netns.Get()
+	if err != nil {
+		return fmt.Errorf("Unable to get current network namespace: %v", err)
+	}
+	defer orig.Close()
+
+	if err = netns.Set(t.ns); err != nil {
+		return fmt.Errorf("Unable to switch network namespace: %v", err)
+	}
+	res := f()
+	if err = netns.Set(orig); err != nil {
+		// Thread is left in wrong namespace, it must not be reused
+		panic(fmt.Sprintf("Unable to return to original network namespace: %v", err))
+	}
+
+	return res
+}
+
+// TestRun runs program on packet within topology's network namespace,
+// so routing lookups by program see topology's routes / neighbors
+func (t *Topology) TestRun(prog goebpf.Program, params goebpf.TestRunParams) (*goebpf.TestRunResult, error) {
+	var res *goebpf.TestRunResult
+	err := t.Do(func() error {
+		var err error
+		res, err = goebpf.ProgramTestRun(prog, params)
+		return err
+	})
+
+	return res, err
+}
+
+// Adds address in CIDR notation (e.g. "10.0.0.1/24") to link and sets it up
+func (t *Topology) setupLink(link netlink.Link, cidr string) error {
+	if cidr != "" {
+		addr, err := netlink.ParseAddr(cidr)
+		if err != nil {
+			return err
+		}
+		if err = t.handle.AddrAdd(link, addr); err != nil {
+			return fmt.Errorf("Unable to add address %s to '%s': %v", cidr, link.Attrs().Name, err)
+		}
+	}
+	if err := t.handle.LinkSetUp(link); err != nil {
+		return fmt.Errorf("Unable to set '%s' up: %v", link.Attrs().Name, err)
+	}
+
+	return nil
+}
+
+// AddVethPair creates veth pair name <-> peer and sets both ends up. Address in CIDR
+// notation (empty means none) is assigned to name, while peer stands for the rest of
+// network behind the link, e.g. its MAC address is used by AddNeighbor().
+func (t *Topology) AddVethPair(name, addr, peer string) error {
+	veth := &netlink.Veth{
+		LinkAttrs: netlink.LinkAttrs{Name: name},
+		PeerName:  peer,
+	}
+	if err := t.handle.LinkAdd(veth); err != nil {
+		return fmt.Errorf("Unable to create veth pair '%s' <-> '%s': %v", name, peer, err)
+	}
+	t.peers[name] = peer
+	t.peers[peer] = name
+
+	for _, end := range []struct{ name, addr string }{{name, addr}, {peer, ""}} {
+		link, err := t.handle.LinkByName(end.name)
+		if err != nil {
+			return err
+		}
+		if err = t.setupLink(link, end.addr); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// AddRoute adds route to dst (CIDR notation) via gateway gw
+func (t *Topology) AddRoute(dst, gw string) error {
+	_, dstNet, err := net.ParseCIDR(dst)
+	if err != nil {
+		return err
+	}
+	gwIP := net.ParseIP(gw)
+	if gwIP == nil {
+		return fmt.Errorf("Invalid gateway address '%s'", gw)
+	}
+	route := &netlink.Route{
+		Dst: dstNet,
+		Gw:  gwIP,
+	}
+	if err = t.handle.RouteAdd(route); err != nil {
+		return fmt.Errorf("Unable to add route %s via %s: %v", dst, gw, err)
+	}
+
+	return nil
+}
+
+// AddNeighbor adds permanent neighbor (ARP / NDP) entry resolving ip to MAC address
+// of the other end of veth link dev, so bpf_fib_lookup() is able to fill destination
+// MAC (otherwise it returns BPF_FIB_LKUP_RET_NO_NEIGH)
+func (t *Topology) AddNeighbor(ip, dev string) error {
+	name, ok := t.peers[dev]
+	if !ok {
+		return fmt.Errorf("'%s' is not veth created by AddVethPair()", dev)
+	}
+	peer, err := t.handle.LinkByName(name)
+	if err != nil {
+		return err
+	}
+
+	return t.AddStaticNeighbor(ip, peer.Attrs().HardwareAddr.String(), dev)
+}
+
+// AddStaticNeighbor adds permanent neighbor entry resolving ip to given MAC address on dev
+func (t *Topology) AddStaticNeighbor(ip, mac, dev string) error {
+	link, err := t.handle.LinkByName(dev)
+	if err != nil {
+		return err
+	}
+	neighIP := net.ParseIP(ip)
+	if neighIP == nil {
+		return fmt.Errorf("Invalid neighbor address '%s'", ip)
+	}
+	hwAddr, err := net.ParseMAC(mac)
+	if err != nil {
+		return err
+	}
+	family := netlink.FAMILY_V6
+	if neighIP.To4() != nil {
+		family = netlink.FAMILY_V4
+	}
+	neigh := &netlink.Neigh{
+		LinkIndex:    link.Attrs().Index,
+		Family:       family,
+		State:        netlink.NUD_PERMANENT,
+		IP:           neighIP,
+		HardwareAddr: hwAddr,
+	}
+	if err = t.handle.NeighAdd(neigh); err != nil {
+		return fmt.Errorf("Unable to add neighbor %s on '%s': %v", ip, dev, err)
+	}
+
+	return nil
+}
+
+// Interface returns ifindex / MAC address / etc of link in topology
+func (t *Topology) Interface(name string) (*net.Interface, error) {
+	link, err := t.handle.LinkByName(name)
+	if err != nil {
+		return nil, err
+	}
+	attrs := link.Attrs()
+
+	return &net.Interface{
+		Index:        attrs.Index,
+		MTU:          attrs.MTU,
+		Name:         attrs.Name,
+		HardwareAddr: attrs.HardwareAddr,
+		Flags:        attrs.Flags,
+	}, nil
+}
+
+// Close destroys network namespace along with all links / routes created in it
+func (t *Topology) Close() error {
+	if t.handle != nil {
+		t.handle.Delete()
+		t.handle = nil
+	}
+
+	return t.ns.Close()
+}
@@ -0,0 +1,609 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_unwind
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/dropbox/goebpf/internal/procmaps"
+)
+
+// Pointer encodings of .eh_frame, DW_EH_PE_*
+const (
+	pePtr     = 0x00
+	peUleb128 = 0x01
+	peUdata2  = 0x02
+	peUdata4  = 0x03
+	peUdata8  = 0x04
+	peSleb128 = 0x09
+	peSdata2  = 0x0a
+	peSdata4  = 0x0b
+	peSdata8  = 0x0c
+	pePcrel   = 0x10
+	peOmit    = 0xff
+)
+
+// Call frame instructions, DW_CFA_*
+const (
+	cfaAdvanceLoc        = 0x40
+	cfaOffset            = 0x80
+	cfaRestore           = 0xc0
+	cfaNop               = 0x00
+	cfaSetLoc            = 0x01
+	cfaAdvanceLoc1       = 0x02
+	cfaAdvanceLoc2       = 0x03
+	cfaAdvanceLoc4       = 0x04
+	cfaOffsetExtended    = 0x05
+	cfaRestoreExtended   = 0x06
+	cfaUndefined         = 0x07
+	cfaSameValue         = 0x08
+	cfaRegister          = 0x09
+	cfaRememberState     = 0x0a
+	cfaRestoreState      = 0x0b
+	cfaDefCfa            = 0x0c
+	cfaDefCfaRegister    = 0x0d
+	cfaDefCfaOffset      = 0x0e
+	cfaDefCfaExpression  = 0x0f
+	cfaExpression        = 0x10
+	cfaOffsetExtendedSf  = 0x11
+	cfaDefCfaSf          = 0x12
+	cfaDefCfaOffsetSf    = 0x13
+	cfaValOffset         = 0x14
+	cfaValOffsetSf       = 0x15
+	cfaValExpression     = 0x16
+	cfaGnuArgsSize       = 0x2e
+	cfaGnuNegOffsetExtSf = 0x2f
+)
+
+// ErrNoFrameInfo returned when there is no call frame information for address
+var ErrNoFrameInfo = errors.New("No call frame information for address")
+
+// RuleKind tells how register of caller is restored
+type RuleKind int
+
+const (
+	// RuleSameValue - register is not changed by callee
+	RuleSameValue RuleKind = iota
+	// RuleUndefined - register can't be restored (e.g. end of stack for RA)
+	RuleUndefined
+	// RuleOffset - register is saved at CFA + Offset
+	RuleOffset
+	// RuleValOffset - register value is CFA + Offset
+	RuleValOffset
+	// RuleRegister - register is saved in other register (Reg)
+	RuleRegister
+	// RuleExpression - DWARF expression, not supported by unwinder
+	RuleExpression
+)
+
+// Rule describes how to restore one register of caller
+type Rule struct {
+	Kind   RuleKind
+	Offset int64
+	Reg    uint64
+}
+
+// Row is call frame information at particular address: canonical frame
+// address (CFA, value of SP before call) is CfaReg + CfaOffset, saved
+// registers of caller are described by Regs (DWARF register numbers)
+type Row struct {
+	CfaReg    uint64
+	CfaOffset int64
+	// CFA is computed by DWARF expression (e.g. PLT entries), not supported
+	CfaExpression bool
+	Regs          map[uint64]Rule
+	// Register holding return address
+	RAReg uint64
+}
+
+func (r *Row) clone() *Row {
+	c := *r
+	c.Regs = make(map[uint64]Rule, len(r.Regs))
+	for reg, rule := range r.Regs {
+		c.Regs[reg] = rule
+	}
+	return &c
+}
+
+// Rule returns rule of register, registers without explicit rule keep value
+func (r *Row) Rule(reg uint64) Rule {
+	if rule, ok := r.Regs[reg]; ok {
+		return rule
+	}
+	return Rule{Kind: RuleSameValue}
+}
+
+type cie struct {
+	bo          binary.ByteOrder
+	codeAlign   uint64
+	dataAlign   int64
+	raReg       uint64
+	fdeEncoding byte
+	// Augmentation 'z': FDEs have augmentation data
+	hasAugData   bool
+	instructions []byte
+}
+
+type fde struct {
+	cie          *cie
+	start        uint64
+	end          uint64
+	instructions []byte
+}
+
+// Table is call frame information (.eh_frame) of one ELF binary,
+// addresses are virtual addresses of binary (before relocation)
+type Table struct {
+	fdes []*fde // sorted by start
+	// PT_LOAD segments, to convert file offsets into virtual addresses
+	loads procmaps.Loads
+}
+
+// LoadTable reads .eh_frame of ELF binary / shared library
+func LoadTable(path string) (*Table, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	sec := f.Section(".eh_frame")
+	if sec == nil {
+		return nil, fmt.Errorf("'%s' has no .eh_frame section", path)
+	}
+	data, err := sec.Data()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read .eh_frame of '%s': %v", path, err)
+	}
+	t, err := ParseEhFrame(data, sec.Addr, f.ByteOrder)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid .eh_frame of '%s': %v", path, err)
+	}
+	t.loads = procmaps.ReadLoads(f)
+
+	return t, nil
+}
+
+// ParseEhFrame parses raw .eh_frame section loaded at virtual address addr
+func ParseEhFrame(data []byte, addr uint64, bo binary.ByteOrder) (*Table, error) {
+	t := &Table{}
+	cies := make(map[uint64]*cie)
+
+	for off := uint64(0); off+4 <= uint64(len(data)); {
+		start := off
+		length := uint64(bo.Uint32(data[off:]))
+		off += 4
+		if length == 0xffffffff {
+			if off+8 > uint64(len(data)) {
+				return nil, fmt.Errorf("Truncated entry at offset %d", start)
+			}
+			length = bo.Uint64(data[off:])
+			off += 8
+		}
+		if length == 0 {
+			// Terminator
+			break
+		}
+		if off+length > uint64(len(data)) || length < 4 {
+			return nil, fmt.Errorf("Invalid length of entry at offset %d", start)
+		}
+		entry := data[off : off+length]
+		idOff := off
+		off += length
+
+		id := uint64(bo.Uint32(entry))
+		if id == 0 {
+			c, err := parseCIE(entry[4:], bo)
+			if err != nil {
+				return nil, fmt.Errorf("CIE at offset %d: %v", start, err)
+			}
+			cies[start] = c
+			continue
+		}
+		// FDE: id is offset of CIE back from id field
+		if id > idOff {
+			return nil, fmt.Errorf("FDE at offset %d: invalid CIE pointer", start)
+		}
+		c, ok := cies[idOff-id]
+		if !ok {
+			return nil, fmt.Errorf("FDE at offset %d: unknown CIE", start)
+		}
+		f, err := parseFDE(entry[4:], c, addr+idOff+4)
+		if err != nil {
+			return nil, fmt.Errorf("FDE at offset %d: %v", start, err)
+		}
+		if f.end > f.start {
+			t.fdes = append(t.fdes, f)
+		}
+	}
+	sort.Slice(t.fdes, func(i, j int) bool {
+		return t.fdes[i].start < t.fdes[j].start
+	})
+
+	return t, nil
+}
+
+func parseCIE(data []byte, bo binary.ByteOrder) (*cie, error) {
+	r := &reader{data: data, bo: bo}
+	version := r.u8()
+	if version != 1 && version != 3 {
+		return nil, fmt.Errorf("Unsupported version %d", version)
+	}
+	aug := r.cstring()
+	c := &cie{bo: bo, fdeEncoding: pePtr}
+	c.codeAlign = r.uleb()
+	c.dataAlign = r.sleb()
+	if version == 1 {
+		c.raReg = uint64(r.u8())
+	} else {
+		c.raReg = r.uleb()
+	}
+	if len(aug) > 0 && aug[0] == 'z' {
+		c.hasAugData = true
+		augLen := r.uleb()
+		augData := &reader{data: r.bytes(augLen), bo: bo}
+		for _, ch := range aug[1:] {
+			switch ch {
+			case 'R':
+				c.fdeEncoding = augData.u8()
+			case 'P':
+				// Personality routine is not needed, just skipped
+				// (usually indirect, DW_EH_PE_indirect)
+				enc := augData.u8() &^ 0x80
+				if _, err := augData.pointer(enc, 0); err != nil {
+					return nil, err
+				}
+			case 'L':
+				augData.u8()
+			case 'S', 'B':
+			default:
+				return nil, fmt.Errorf("Unsupported augmentation '%s'", aug)
+			}
+		}
+	} else if aug != "" {
+		return nil, fmt.Errorf("Unsupported augmentation '%s'", aug)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	c.instructions = r.rest()
+
+	return c, nil
+}
+
+// addr is virtual address of data
+func parseFDE(data []byte, c *cie, addr uint64) (*fde, error) {
+	r := &reader{data: data, bo: c.bo}
+	start, err := r.pointer(c.fdeEncoding, addr)
+	if err != nil {
+		return nil, err
+	}
+	// Range has the same format, but is never relative
+	size, err := r.pointer(c.fdeEncoding&0x0f, 0)
+	if err != nil {
+		return nil, err
+	}
+	if c.hasAugData {
+		r.bytes(r.uleb())
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return &fde{
+		cie:          c,
+		start:        start,
+		end:          start + size,
+		instructions: r.rest(),
+	}, nil
+}
+
+// Len returns amount of functions (FDEs) having call frame information
+func (t *Table) Len() int {
+	return len(t.fdes)
+}
+
+// Vaddr converts offset in ELF file into virtual address, e.g. to find
+// address of instruction in binary by offset in its memory mapping
+func (t *Table) Vaddr(fileOffset uint64) (uint64, bool) {
+	return t.loads.Vaddr(fileOffset)
+}
+
+// Row returns call frame information at virtual address pc of binary
+func (t *Table) Row(pc uint64) (*Row, error) {
+	idx := sort.Search(len(t.fdes), func(i int) bool {
+		return t.fdes[i].start > pc
+	})
+	if idx == 0 || pc >= t.fdes[idx-1].end {
+		return nil, ErrNoFrameInfo
+	}
+	f := t.fdes[idx-1]
+
+	row := &Row{Regs: make(map[uint64]Rule), RAReg: f.cie.raReg}
+	if err := execute(f.cie, f.cie.instructions, row, nil, f.start, ^uint64(0)); err != nil {
+		return nil, err
+	}
+	initial := row.clone()
+	if err := execute(f.cie, f.instructions, row, initial, f.start, pc); err != nil {
+		return nil, err
+	}
+
+	return row, nil
+}
+
+// Executes call frame instructions while location is not beyond pc
+func execute(c *cie, insns []byte, row, initial *Row, loc, pc uint64) error {
+	r := &reader{data: insns, bo: c.bo}
+	var stack []*Row
+
+	for r.err == nil && len(r.data) > 0 {
+		op := r.u8()
+		switch op & 0xc0 {
+		case cfaAdvanceLoc:
+			loc += uint64(op&0x3f) * c.codeAlign
+			if loc > pc {
+				return nil
+			}
+			continue
+		case cfaOffset:
+			row.Regs[uint64(op&0x3f)] = Rule{Kind: RuleOffset, Offset: int64(r.uleb()) * c.dataAlign}
+			continue
+		case cfaRestore:
+			restore(row, initial, uint64(op&0x3f))
+			continue
+		}
+
+		switch op {
+		case cfaNop:
+		case cfaSetLoc:
+			// Absolute addresses are not used by .eh_frame of position independent code
+			loc = r.u64()
+		case cfaAdvanceLoc1, cfaAdvanceLoc2, cfaAdvanceLoc4:
+			var delta uint64
+			switch op {
+			case cfaAdvanceLoc1:
+				delta = uint64(r.u8())
+			case cfaAdvanceLoc2:
+				delta = uint64(r.u16())
+			default:
+				delta = uint64(r.u32())
+			}
+			loc += delta * c.codeAlign
+		case cfaOffsetExtended:
+			reg := r.uleb()
+			row.Regs[reg] = Rule{Kind: RuleOffset, Offset: int64(r.uleb()) * c.dataAlign}
+		case cfaOffsetExtendedSf:
+			reg := r.uleb()
+			row.Regs[reg] = Rule{Kind: RuleOffset, Offset: r.sleb() * c.dataAlign}
+		case cfaGnuNegOffsetExtSf:
+			reg := r.uleb()
+			row.Regs[reg] = Rule{Kind: RuleOffset, Offset: -int64(r.uleb()) * c.dataAlign}
+		case cfaValOffset:
+			reg := r.uleb()
+			row.Regs[reg] = Rule{Kind: RuleValOffset, Offset: int64(r.uleb()) * c.dataAlign}
+		case cfaValOffsetSf:
+			reg := r.uleb()
+			row.Regs[reg] = Rule{Kind: RuleValOffset, Offset: r.sleb() * c.dataAlign}
+		case cfaRestoreExtended:
+			restore(row, initial, r.uleb())
+		case cfaUndefined:
+			row.Regs[r.uleb()] = Rule{Kind: RuleUndefined}
+		case cfaSameValue:
+			row.Regs[r.uleb()] = Rule{Kind: RuleSameValue}
+		case cfaRegister:
+			reg := r.uleb()
+			row.Regs[reg] = Rule{Kind: RuleRegister, Reg: r.uleb()}
+		case cfaRememberState:
+			stack = append(stack, row.clone())
+		case cfaRestoreState:
+			if len(stack) == 0 {
+				return errors.New("DW_CFA_restore_state without remember_state")
+			}
+			saved := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			// CFA is not part of remembered state
+			saved.CfaReg, saved.CfaOffset, saved.CfaExpression = row.CfaReg, row.CfaOffset, row.CfaExpression
+			*row = *saved
+		case cfaDefCfa:
+			row.CfaReg = r.uleb()
+			row.CfaOffset = int64(r.uleb())
+			row.CfaExpression = false
+		case cfaDefCfaSf:
+			row.CfaReg = r.uleb()
+			row.CfaOffset = r.sleb() * c.dataAlign
+			row.CfaExpression = false
+		case cfaDefCfaRegister:
+			row.CfaReg = r.uleb()
+			row.CfaExpression = false
+		case cfaDefCfaOffset:
+			row.CfaOffset = int64(r.uleb())
+		case cfaDefCfaOffsetSf:
+			row.CfaOffset = r.sleb() * c.dataAlign
+		case cfaDefCfaExpression:
+			r.bytes(r.uleb())
+			row.CfaExpression = true
+		case cfaExpression, cfaValExpression:
+			reg := r.uleb()
+			r.bytes(r.uleb())
+			row.Regs[reg] = Rule{Kind: RuleExpression}
+		case cfaGnuArgsSize:
+			r.uleb()
+		default:
+			return fmt.Errorf("Unsupported call frame instruction 0x%x", op)
+		}
+		if loc > pc {
+			return nil
+		}
+	}
+
+	return r.err
+}
+
+func restore(row, initial *Row, reg uint64) {
+	if initial == nil {
+		delete(row.Regs, reg)
+		return
+	}
+	if rule, ok := initial.Regs[reg]; ok {
+		row.Regs[reg] = rule
+	} else {
+		delete(row.Regs, reg)
+	}
+}
+
+// Little helper to read DWARF encoded values, remembers first error
+type reader struct {
+	data []byte
+	bo   binary.ByteOrder
+	err  error
+}
+
+var errTruncated = errors.New("Truncated call frame information")
+
+func (r *reader) bytes(n uint64) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > uint64(len(r.data)) {
+		r.err = errTruncated
+		r.data = nil
+		return nil
+	}
+	res := r.data[:n]
+	r.data = r.data[n:]
+	return res
+}
+
+func (r *reader) rest() []byte {
+	res := r.data
+	r.data = nil
+	return res
+}
+
+func (r *reader) u8() byte {
+	if b := r.bytes(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *reader) u16() uint16 {
+	if b := r.bytes(2); b != nil {
+		return r.bo.Uint16(b)
+	}
+	return 0
+}
+
+func (r *reader) u32() uint32 {
+	if b := r.bytes(4); b != nil {
+		return r.bo.Uint32(b)
+	}
+	return 0
+}
+
+func (r *reader) u64() uint64 {
+	if b := r.bytes(8); b != nil {
+		return r.bo.Uint64(b)
+	}
+	return 0
+}
+
+func (r *reader) uleb() uint64 {
+	var res uint64
+	for shift := uint(0); ; shift += 7 {
+		b := r.u8()
+		if r.err != nil {
+			return 0
+		}
+		if shift < 64 {
+			res |= uint64(b&0x7f) << shift
+		}
+		if b&0x80 == 0 {
+			return res
+		}
+	}
+}
+
+func (r *reader) sleb() int64 {
+	var res int64
+	shift := uint(0)
+	for {
+		b := r.u8()
+		if r.err != nil {
+			return 0
+		}
+		if shift < 64 {
+			res |= int64(b&0x7f) << shift
+		}
+		shift += 7
+		if b&0x80 == 0 {
+			if shift < 64 && b&0x40 != 0 {
+				res |= -1 << shift
+			}
+			return res
+		}
+	}
+}
+
+func (r *reader) cstring() string {
+	idx := bytes.IndexByte(r.data, 0)
+	if idx < 0 {
+		r.err = errTruncated
+		return ""
+	}
+	s := string(r.data[:idx])
+	r.data = r.data[idx+1:]
+	return s
+}
+
+// Reads pointer of given DW_EH_PE_* encoding, addr is address of pointer itself
+// for pc relative pointers
+func (r *reader) pointer(enc byte, addr uint64) (uint64, error) {
+	if enc == peOmit {
+		return 0, nil
+	}
+	var val uint64
+	switch enc & 0x0f {
+	case pePtr, peUdata8, peSdata8:
+		if b := r.bytes(8); b != nil {
+			val = r.bo.Uint64(b)
+		}
+	case peUleb128:
+		val = r.uleb()
+	case peSleb128:
+		val = uint64(r.sleb())
+	case peUdata2:
+		if b := r.bytes(2); b != nil {
+			val = uint64(r.bo.Uint16(b))
+		}
+	case peSdata2:
+		if b := r.bytes(2); b != nil {
+			val = uint64(int64(int16(r.bo.Uint16(b))))
+		}
+	case peUdata4:
+		if b := r.bytes(4); b != nil {
+			val = uint64(r.bo.Uint32(b))
+		}
+	case peSdata4:
+		if b := r.bytes(4); b != nil {
+			val = uint64(int64(int32(r.bo.Uint32(b))))
+		}
+	default:
+		return 0, fmt.Errorf("Unsupported pointer encoding 0x%x", enc)
+	}
+	switch enc & 0x70 {
+	case 0:
+	case pePcrel:
+		val += addr
+	default:
+		return 0, fmt.Errorf("Unsupported pointer encoding 0x%x", enc)
+	}
+
+	return val, r.err
+}
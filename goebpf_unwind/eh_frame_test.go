@@ -0,0 +1,170 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_unwind
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testEhFrameAddr = 0x2000
+
+// Appends entry (length + body) to .eh_frame data
+func appendEntry(data []byte, body ...byte) []byte {
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(body)))
+	return append(append(data, length[:]...), body...)
+}
+
+// .eh_frame as emitted by gcc for x86-64 function at 0x1000 of 0x20 bytes:
+//
+//	push %rbp; mov %rsp,%rbp; ...; pop %rbp; ret
+func buildTestEhFrame() []byte {
+	cie := []byte{
+		0, 0, 0, 0, // CIE id
+		1,           // version
+		'z', 'R', 0, // augmentation
+		1,       // code align
+		0x78,    // data align -8
+		16,      // RA register
+		1, 0x1b, // augmentation data: pcrel | sdata4
+		cfaDefCfa, 7, 8, // CFA = rsp + 8
+		cfaOffset | 16, 1, // RA at CFA - 8
+		cfaNop, cfaNop,
+	}
+	data := appendEntry(nil, cie...)
+
+	fdeOff := len(data)
+	fde := make([]byte, 12)
+	// CIE pointer: offset back from this field to CIE
+	binary.LittleEndian.PutUint32(fde[0:], uint32(fdeOff+4))
+	// pc_begin relative to its own address
+	pcBeginAddr := testEhFrameAddr + fdeOff + 8
+	binary.LittleEndian.PutUint32(fde[4:], uint32(int32(0x1000-pcBeginAddr)))
+	binary.LittleEndian.PutUint32(fde[8:], 0x20)
+	fde = append(fde,
+		0,                   // augmentation data length
+		cfaAdvanceLoc|1,     // after push %rbp
+		cfaDefCfaOffset, 16, // CFA = rsp + 16
+		cfaOffset|6, 2, // rbp at CFA - 16
+		cfaAdvanceLoc|3,      // after mov %rsp,%rbp
+		cfaDefCfaRegister, 6, // CFA = rbp + 16
+		cfaAdvanceLoc1, 0x10, // after pop %rbp
+		cfaDefCfa, 7, 8, // CFA = rsp + 8
+		cfaNop,
+	)
+	data = appendEntry(data, fde...)
+
+	// Terminator
+	return append(data, 0, 0, 0, 0)
+}
+
+func TestParseEhFrame(t *testing.T) {
+	table, err := ParseEhFrame(buildTestEhFrame(), testEhFrameAddr, binary.LittleEndian)
+	require.NoError(t, err)
+	assert.Equal(t, 1, table.Len())
+
+	cases := []struct {
+		pc        uint64
+		cfaReg    uint64
+		cfaOffset int64
+		rbpSaved  bool
+	}{
+		{0x1000, 7, 8, false},
+		{0x1001, 7, 16, true},
+		{0x1003, 7, 16, true},
+		{0x1004, 6, 16, true},
+		{0x1013, 6, 16, true},
+		{0x1014, 7, 8, true},
+		{0x101f, 7, 8, true},
+	}
+	for _, c := range cases {
+		row, err := table.Row(c.pc)
+		require.NoError(t, err, "pc 0x%x", c.pc)
+		assert.Equal(t, c.cfaReg, row.CfaReg, "pc 0x%x", c.pc)
+		assert.Equal(t, c.cfaOffset, row.CfaOffset, "pc 0x%x", c.pc)
+		assert.Equal(t, Rule{Kind: RuleOffset, Offset: -8}, row.Rule(16))
+		if c.rbpSaved {
+			assert.Equal(t, Rule{Kind: RuleOffset, Offset: -16}, row.Rule(6), "pc 0x%x", c.pc)
+		} else {
+			assert.Equal(t, RuleSameValue, row.Rule(6).Kind, "pc 0x%x", c.pc)
+		}
+	}
+
+	_, err = table.Row(0xfff)
+	assert.Equal(t, ErrNoFrameInfo, err)
+	_, err = table.Row(0x1020)
+	assert.Equal(t, ErrNoFrameInfo, err)
+
+	// Truncated
+	data := buildTestEhFrame()
+	_, err = ParseEhFrame(data[:len(data)-10], testEhFrameAddr, binary.LittleEndian)
+	assert.Error(t, err)
+}
+
+func TestRememberState(t *testing.T) {
+	c := &cie{bo: binary.LittleEndian, codeAlign: 1, dataAlign: -8, raReg: 16}
+	insns := []byte{
+		cfaDefCfa, 7, 16,
+		cfaOffset | 6, 2,
+		cfaRememberState,
+		cfaAdvanceLoc | 1,
+		cfaRestore | 6,
+		cfaDefCfaOffset, 8,
+		cfaAdvanceLoc | 1,
+		cfaRestoreState,
+	}
+	row := &Row{Regs: make(map[uint64]Rule)}
+	require.NoError(t, execute(c, insns, row, nil, 0, 1))
+	assert.Equal(t, int64(8), row.CfaOffset)
+	assert.Equal(t, RuleSameValue, row.Rule(6).Kind)
+
+	row = &Row{Regs: make(map[uint64]Rule)}
+	require.NoError(t, execute(c, insns, row, nil, 0, 2))
+	// CFA is not restored, registers are
+	assert.Equal(t, int64(8), row.CfaOffset)
+	assert.Equal(t, Rule{Kind: RuleOffset, Offset: -16}, row.Rule(6))
+
+	row = &Row{Regs: make(map[uint64]Rule)}
+	assert.Error(t, execute(c, []byte{cfaRestoreState}, row, nil, 0, 0))
+	assert.Error(t, execute(c, []byte{0x3f}, row, nil, 0, 0))
+}
+
+func TestLeb128(t *testing.T) {
+	r := &reader{data: []byte{0xe5, 0x8e, 0x26, 0x7f, 0x80, 0x7f, 0x02}, bo: binary.LittleEndian}
+	assert.Equal(t, uint64(624485), r.uleb())
+	assert.Equal(t, int64(-1), r.sleb())
+	assert.Equal(t, int64(-128), r.sleb())
+	assert.Equal(t, int64(2), r.sleb())
+	assert.NoError(t, r.err)
+	r.uleb()
+	assert.Error(t, r.err)
+}
+
+func TestLoadTable(t *testing.T) {
+	const path = "/bin/ls"
+	f, err := elf.Open(path)
+	if err != nil || f.Section(".eh_frame") == nil {
+		t.Skipf("No ELF binary with .eh_frame at %s", path)
+	}
+	f.Close()
+
+	table, err := LoadTable(path)
+	require.NoError(t, err)
+	assert.True(t, table.Len() > 10)
+	// Every function has CFI at its entry
+	for _, fde := range table.fdes[:10] {
+		row, err := table.Row(fde.start)
+		require.NoError(t, err)
+		assert.Equal(t, fde.cie.raReg, row.RAReg)
+	}
+
+	_, err = LoadTable(os.DevNull)
+	assert.Error(t, err)
+}
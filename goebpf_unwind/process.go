@@ -0,0 +1,88 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_unwind
+
+import (
+	"sync"
+
+	"github.com/dropbox/goebpf/internal/procmaps"
+)
+
+// Process unwinds stacks of one process by call frame information of its
+// executable / shared libraries. Tables are loaded on first use and cached.
+// It is safe for concurrent use.
+type Process struct {
+	pid int
+
+	mu       sync.Mutex
+	mappings []procmaps.Mapping // sorted by start
+	// Tables by path binary is opened by, nil if binary has no (valid) .eh_frame
+	tables map[string]*Table
+}
+
+// NewProcess reads memory mappings of process pid from /proc
+func NewProcess(pid int) (*Process, error) {
+	p := &Process{
+		pid:    pid,
+		tables: make(map[string]*Table),
+	}
+	if err := p.Refresh(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Refresh re-reads memory mappings of process, e.g. after it loaded shared library
+func (p *Process) Refresh() error {
+	mappings, err := procmaps.Read(p.pid)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.mappings = mappings
+	p.mu.Unlock()
+
+	return nil
+}
+
+// Finds CFI row of address of process memory
+func (p *Process) row(pc uint64) (*Row, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	m, ok := procmaps.Find(p.mappings, pc)
+	if !ok {
+		return nil, false
+	}
+	// Binaries are opened through root of process, which may be in other
+	// mount namespace, deleted ones through map_files
+	path := m.BinaryPath(p.pid)
+	t, ok := p.tables[path]
+	if !ok {
+		t, _ = LoadTable(path)
+		p.tables[path] = t
+	}
+	if t == nil {
+		return nil, false
+	}
+	vaddr, ok := t.Vaddr(m.FileOffset(pc))
+	if !ok {
+		return nil, false
+	}
+	row, err := t.Row(vaddr)
+	if err != nil {
+		return nil, false
+	}
+
+	return row, true
+}
+
+// Unwind returns addresses of up to maxDepth frames of stack snapshot,
+// innermost first. Unwinding stops at first frame which can't be unwound
+// (e.g. stack snapshot is too short).
+func (p *Process) Unwind(s Snapshot, maxDepth int) []uint64 {
+	return unwind(&s, hostArchRegs(), p.row, maxDepth)
+}
@@ -0,0 +1,209 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_unwind unwinds user space stacks of binaries compiled without
+// frame pointers (most distro binaries / libraries) by using call frame
+// information of their .eh_frame sections. bpf_get_stackid() relies on frame
+// pointers, so for such binaries it returns only one or two frames.
+//
+// Instead eBPF program (e.g. of uprobe / perf event) copies registers and
+// top of user stack into sample:
+//
+//	struct sample {
+//		__u64 pc, sp, fp;
+//		__u8 stack[8192];
+//	};
+//	...
+//	s->pc = PT_REGS_IP(ctx);
+//	s->sp = PT_REGS_SP(ctx);
+//	s->fp = PT_REGS_FP(ctx);
+//	bpf_probe_read_user(s->stack, sizeof(s->stack), (void *)s->sp);
+//
+// and unwinding is done in user space:
+//
+//	proc, err := goebpf_unwind.NewProcess(pid)
+//	...
+//	pcs := proc.Unwind(goebpf_unwind.Snapshot{
+//		Regs:  goebpf_unwind.Regs{PC: s.pc, SP: s.sp, FP: s.fp},
+//		Stack: s.stack[:],
+//	}, 64)
+//
+// Frames without call frame information (e.g. JIT compiled code) are
+// unwound by frame pointer. Supported architectures are x86-64 and arm64.
+package goebpf_unwind
+
+import (
+	"encoding/binary"
+	"runtime"
+)
+
+// DWARF numbers of registers needed for unwinding
+type archRegs struct {
+	sp uint64
+	fp uint64
+	// Link register (return address) of arm64, 0 on x86-64
+	lr uint64
+}
+
+var (
+	regsAmd64 = archRegs{sp: 7, fp: 6}
+	regsArm64 = archRegs{sp: 31, fp: 29, lr: 30}
+)
+
+func hostArchRegs() archRegs {
+	if runtime.GOARCH == "arm64" {
+		return regsArm64
+	}
+	return regsAmd64
+}
+
+// Regs are registers of thread at the moment stack snapshot was taken
+type Regs struct {
+	PC uint64
+	SP uint64
+	FP uint64 // rbp / x29
+	LR uint64 // x30, arm64 only
+}
+
+// Snapshot is copy of top of user stack (starting at Regs.SP) with registers
+type Snapshot struct {
+	Regs  Regs
+	Stack []byte
+}
+
+// Reads 8 bytes of stack snapshot at addr
+func (s *Snapshot) read(addr uint64) (uint64, bool) {
+	if addr < s.Regs.SP {
+		return 0, false
+	}
+	off := addr - s.Regs.SP
+	if off > uint64(len(s.Stack)) || uint64(len(s.Stack))-off < 8 {
+		return 0, false
+	}
+	return binary.LittleEndian.Uint64(s.Stack[off:]), true
+}
+
+// Register state of frame being unwound, only registers tracked by
+// unwinder: values of unknown ones are absent
+type frameRegs map[uint64]uint64
+
+// Finds call frame information row of pc, returns false if there is none
+type rowFinder func(pc uint64) (*Row, bool)
+
+// Unwinds stack snapshot by rows found by find, returns addresses of
+// frames starting with s.Regs.PC
+func unwind(s *Snapshot, arch archRegs, find rowFinder, maxDepth int) []uint64 {
+	regs := frameRegs{arch.sp: s.Regs.SP, arch.fp: s.Regs.FP}
+	if arch.lr != 0 {
+		regs[arch.lr] = s.Regs.LR
+	}
+	pc := s.Regs.PC
+	var res []uint64
+
+	for len(res) < maxDepth && pc != 0 {
+		res = append(res, pc)
+		lookup := pc
+		if len(res) > 1 {
+			// Return address points after call, which may be the end of function
+			lookup--
+		}
+
+		var ra uint64
+		var ok bool
+		if row, found := find(lookup); found {
+			ra, ok = unwindRow(s, arch, row, regs)
+		} else {
+			ra, ok = unwindFramePointer(s, arch, regs)
+		}
+		if !ok {
+			break
+		}
+		pc = ra
+	}
+
+	return res
+}
+
+// Restores registers of caller by CFI row, returns return address
+func unwindRow(s *Snapshot, arch archRegs, row *Row, regs frameRegs) (uint64, bool) {
+	if row.CfaExpression {
+		return 0, false
+	}
+	base, ok := regs[row.CfaReg]
+	if !ok {
+		return 0, false
+	}
+	cfa := uint64(int64(base) + row.CfaOffset)
+	// Stack grows down, so frames of callers are above
+	if cfa < regs[arch.sp] {
+		return 0, false
+	}
+
+	restore := func(reg uint64) (uint64, bool) {
+		rule := row.Rule(reg)
+		switch rule.Kind {
+		case RuleSameValue:
+			val, ok := regs[reg]
+			return val, ok
+		case RuleOffset:
+			return s.read(uint64(int64(cfa) + rule.Offset))
+		case RuleValOffset:
+			return uint64(int64(cfa) + rule.Offset), true
+		case RuleRegister:
+			val, ok := regs[rule.Reg]
+			return val, ok
+		}
+		return 0, false
+	}
+
+	ra, ok := restore(row.RAReg)
+	if !ok {
+		return 0, false
+	}
+	caller := frameRegs{arch.sp: cfa}
+	tracked := []uint64{arch.fp}
+	if arch.lr != 0 {
+		tracked = append(tracked, arch.lr)
+	}
+	for _, reg := range tracked {
+		if val, ok := restore(reg); ok {
+			caller[reg] = val
+		}
+	}
+	for reg := range regs {
+		delete(regs, reg)
+	}
+	for reg, val := range caller {
+		regs[reg] = val
+	}
+
+	return ra, true
+}
+
+// Restores registers of caller by frame pointer: saved frame pointer
+// and return address are on top of frame, both on x86-64 and arm64
+func unwindFramePointer(s *Snapshot, arch archRegs, regs frameRegs) (uint64, bool) {
+	fp, ok := regs[arch.fp]
+	if !ok || fp == 0 {
+		return 0, false
+	}
+	savedFp, ok := s.read(fp)
+	if !ok {
+		return 0, false
+	}
+	ra, ok := s.read(fp + 8)
+	if !ok {
+		return 0, false
+	}
+	// Stack grows down, so frames of callers are above
+	if savedFp != 0 && savedFp <= fp {
+		return 0, false
+	}
+	for reg := range regs {
+		delete(regs, reg)
+	}
+	regs[arch.sp] = fp + 16
+	regs[arch.fp] = savedFp
+
+	return ra, true
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_unwind
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Builds stack snapshot at sp of 64-bit words
+func snapshot(pc, sp, fp uint64, words ...uint64) *Snapshot {
+	s := &Snapshot{Regs: Regs{PC: pc, SP: sp, FP: fp}}
+	for _, w := range words {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], w)
+		s.Stack = append(s.Stack, b[:]...)
+	}
+	return s
+}
+
+func TestUnwind(t *testing.T) {
+	table, err := ParseEhFrame(buildTestEhFrame(), testEhFrameAddr, binary.LittleEndian)
+	require.NoError(t, err)
+	find := func(pc uint64) (*Row, bool) {
+		row, err := table.Row(pc)
+		return row, err == nil
+	}
+
+	// Function at 0x1000 (in its body: CFA = rbp + 16) called recursively
+	// from itself (0x1010), called from 0x5000 without CFI, which uses
+	// frame pointer, called from 0x6000
+	s := snapshot(0x1008, 0x7f00, 0x7f00,
+		0x7f10, // 7f00: saved rbp
+		0x1010, // 7f08: return address
+		0x7f30, // 7f10: saved rbp
+		0x5005, // 7f18: return address
+		0, 0,   // 7f20: locals of 0x5000
+		0,      // 7f30: saved rbp, end of frame chain
+		0x6000, // 7f38: return address
+	)
+	pcs := unwind(s, regsAmd64, find, 10)
+	assert.Equal(t, []uint64{0x1008, 0x1010, 0x5005, 0x6000}, pcs)
+
+	// Depth limit
+	assert.Equal(t, []uint64{0x1008, 0x1010}, unwind(s, regsAmd64, find, 2))
+
+	// Snapshot is too short
+	short := *s
+	short.Stack = s.Stack[:8]
+	assert.Equal(t, []uint64{0x1008}, unwind(&short, regsAmd64, find, 10))
+
+	// Function entry: CFA = rsp + 8, return address on top of stack
+	entry := snapshot(0x1000, 0x7000, 0, 0x6000)
+	assert.Equal(t, []uint64{0x1000, 0x6000}, unwind(entry, regsAmd64, find, 10))
+}
+
+func TestUnwindArm64(t *testing.T) {
+	// Leaf function: return address is kept in link register
+	row := &Row{CfaReg: 31, Regs: map[uint64]Rule{}, RAReg: 30}
+	find := func(pc uint64) (*Row, bool) {
+		return row, pc == 0x1000
+	}
+	s := snapshot(0x1000, 0x7000, 0, 0)
+	s.Regs.LR = 0x2000
+	assert.Equal(t, []uint64{0x1000, 0x2000}, unwind(s, regsArm64, find, 10))
+}
+
+func TestProcess(t *testing.T) {
+	p, err := NewProcess(os.Getpid())
+	if err != nil {
+		t.Skipf("No /proc: %v", err)
+	}
+	// Test binary itself is mapped
+	assert.NotEmpty(t, p.mappings)
+	_, ok := p.row(0)
+	assert.False(t, ok)
+	assert.Equal(t, []uint64{0x10}, p.Unwind(Snapshot{Regs: Regs{PC: 0x10}}, 10))
+}
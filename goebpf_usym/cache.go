@@ -0,0 +1,111 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_usym
+
+import (
+	"debug/elf"
+	"os"
+	"sync"
+	"time"
+)
+
+// Identity of file on disk: binary replaced / updated in place gets
+// other size / modification time, so its build-id is read again
+type statKey struct {
+	path    string
+	size    int64
+	modTime time.Time
+}
+
+// Cache is symbol tables of binaries shared by uprobe attach (SymbolOffset)
+// and stack symbolization (Process) of any amount of processes.
+// Tables are keyed by build-id: the same binary seen by different paths
+// (e.g. in different containers) is read once.
+// It is safe for concurrent use.
+type Cache struct {
+	mu     sync.Mutex
+	byID   map[string]*File
+	byStat map[statKey]*File
+}
+
+// NewCache creates empty symbol cache
+func NewCache() *Cache {
+	return &Cache{
+		byID:   make(map[string]*File),
+		byStat: make(map[statKey]*File),
+	}
+}
+
+// Open returns symbol table of binary, reading it only if binary with
+// the same build-id hasn't been read yet. Binaries without build-id
+// are cached by path.
+func (c *Cache) Open(path string) (*File, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	key := statKey{path: path, size: info.Size(), modTime: info.ModTime()}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if file, ok := c.byStat[key]; ok {
+		return file, nil
+	}
+
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	id, err := buildID(f)
+	if err != nil {
+		return nil, err
+	}
+	file, ok := c.byID[id]
+	if id == "" || !ok {
+		if file, err = newFile(f, path); err != nil {
+			return nil, err
+		}
+		if id != "" {
+			c.byID[id] = file
+		}
+	}
+	c.byStat[key] = file
+
+	return file, nil
+}
+
+// SymbolOffset returns offset of function in binary to attach uprobe to
+func (c *Cache) SymbolOffset(path, name string) (uint64, error) {
+	file, err := c.Open(path)
+	if err != nil {
+		return 0, err
+	}
+
+	return file.SymbolOffset(name)
+}
+
+// Len returns amount of distinct binaries in cache
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	seen := make(map[*File]bool)
+	for _, file := range c.byStat {
+		seen[file] = true
+	}
+	return len(seen)
+}
+
+// Purge drops all cached symbol tables, e.g. after many short living
+// processes have been symbolized
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.byID = make(map[string]*File)
+	c.byStat = make(map[statKey]*File)
+}
@@ -0,0 +1,108 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_usym
+
+import (
+	"fmt"
+	"path/filepath"
+	"sync"
+
+	"github.com/dropbox/goebpf/internal/procmaps"
+)
+
+// Process symbolizes addresses of one process by symbol tables of its
+// executable / shared libraries taken from Cache.
+// It is safe for concurrent use.
+type Process struct {
+	pid   int
+	cache *Cache
+
+	mu       sync.Mutex
+	mappings []procmaps.Mapping // sorted by start
+	// Symbol tables by mapping start, nil if binary can't be read
+	files map[uint64]*File
+}
+
+// Process reads memory mappings of process pid from /proc
+func (c *Cache) Process(pid int) (*Process, error) {
+	p := &Process{
+		pid:   pid,
+		cache: c,
+	}
+	if err := p.Refresh(); err != nil {
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// Refresh re-reads memory mappings of process, e.g. after it loaded shared library
+func (p *Process) Refresh() error {
+	mappings, err := procmaps.Read(p.pid)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	p.mappings = mappings
+	p.files = make(map[uint64]*File)
+	p.mu.Unlock()
+
+	return nil
+}
+
+// LookupAddress returns symbol containing address of process memory, offset
+// of address from beginning of symbol and path of binary (as seen by process)
+func (p *Process) LookupAddress(addr uint64) (*Symbol, uint64, string, bool) {
+	p.mu.Lock()
+	found, ok := procmaps.Find(p.mappings, addr)
+	if !ok {
+		p.mu.Unlock()
+		return nil, 0, "", false
+	}
+	m := *found
+	file, ok := p.files[m.Start]
+	p.mu.Unlock()
+
+	if !ok {
+		// Cache reads binary, don't block lookups in other binaries meanwhile
+		file, _ = p.cache.Open(m.BinaryPath(p.pid))
+		p.mu.Lock()
+		p.files[m.Start] = file
+		p.mu.Unlock()
+	}
+	if file == nil {
+		return nil, 0, m.Path, false
+	}
+	vaddr, ok := file.Vaddr(m.FileOffset(addr))
+	if !ok {
+		return nil, 0, m.Path, false
+	}
+	sym, offset, ok := file.LookupAddress(vaddr)
+
+	return sym, offset, m.Path, ok
+}
+
+// Symbolize converts user stack trace (list of instruction pointers, as stored
+// in BPF_MAP_TYPE_STACK_TRACE map) into human readable frames
+// "name+0xoffset [binary]". Stack is terminated by first zero address.
+// Unknown addresses are printed as is, with binary name if known.
+func (p *Process) Symbolize(stack []uint64) []string {
+	var frames []string
+	for _, addr := range stack {
+		if addr == 0 {
+			break
+		}
+		sym, offset, path, ok := p.LookupAddress(addr)
+		switch {
+		case ok:
+			frames = append(frames, fmt.Sprintf("%s+0x%x [%s]", sym.Name, offset, filepath.Base(path)))
+		case path != "":
+			frames = append(frames, fmt.Sprintf("0x%x [%s]", addr, filepath.Base(path)))
+		default:
+			frames = append(frames, fmt.Sprintf("0x%x", addr))
+		}
+	}
+	return frames
+}
@@ -0,0 +1,207 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_usym resolves user space addresses into function names and
+// function names into file offsets (to attach uprobes) using ELF symbol
+// tables (.symtab / .dynsym):
+//
+//	cache := goebpf_usym.NewCache()
+//	...
+//	proc, err := cache.Process(pid)
+//	for _, frame := range proc.Symbolize(stack) {
+//		fmt.Println(frame)
+//	}
+//	...
+//	offset, err := cache.SymbolOffset("/usr/lib/x86_64-linux-gnu/libc.so.6", "malloc")
+//
+// Symbol tables are cached by ELF build-id, so binaries shared by many
+// processes / containers are read once, while binary updated in place
+// (same path, other build-id) is read again. Binaries of processes are
+// opened through /proc/<pid>/root (binaries of containers), deleted ones
+// (e.g. upgraded while process is running) through /proc/<pid>/map_files.
+package goebpf_usym
+
+import (
+	"debug/elf"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/dropbox/goebpf/internal/procmaps"
+)
+
+// NT_GNU_BUILD_ID
+const noteGnuBuildID = 3
+
+// ErrSymbolNotFound returned when binary has no requested symbol
+var ErrSymbolNotFound = errors.New("Symbol not found")
+
+// Symbol is function of ELF binary
+type Symbol struct {
+	Name string
+	// Virtual address of symbol in binary (before relocation) and size
+	Address uint64
+	Size    uint64
+}
+
+// File is symbol table of one ELF binary / shared library
+type File struct {
+	// Hex encoded GNU build-id, empty if binary has none
+	BuildID string
+	// Path binary has been read from for the first time
+	Path string
+
+	symbols []Symbol // sorted by address
+	byName  map[string]int
+	// PT_LOAD segments, to convert file offsets into virtual addresses
+	loads procmaps.Loads
+}
+
+// ReadBuildID returns hex encoded GNU build-id of ELF binary,
+// empty if binary has no build-id
+func ReadBuildID(path string) (string, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	return buildID(f)
+}
+
+func buildID(f *elf.File) (string, error) {
+	for _, sec := range f.Sections {
+		if sec.Type != elf.SHT_NOTE {
+			continue
+		}
+		data, err := sec.Data()
+		if err != nil {
+			return "", err
+		}
+		// Notes: namesz, descsz, type, name and desc aligned to 4 bytes
+		for len(data) >= 12 {
+			nameSize := int(f.ByteOrder.Uint32(data))
+			descSize := int(f.ByteOrder.Uint32(data[4:]))
+			noteType := f.ByteOrder.Uint32(data[8:])
+			nameEnd := 12 + align4(nameSize)
+			descEnd := nameEnd + align4(descSize)
+			if nameSize < 0 || descSize < 0 || descEnd > len(data) {
+				break
+			}
+			if noteType == noteGnuBuildID && string(data[12:12+nameSize]) == "GNU\x00" {
+				return hex.EncodeToString(data[nameEnd : nameEnd+descSize]), nil
+			}
+			data = data[descEnd:]
+		}
+	}
+
+	return "", nil
+}
+
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
+
+// OpenFile reads symbol table of ELF binary, without caching, see Cache
+func OpenFile(path string) (*File, error) {
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return newFile(f, path)
+}
+
+func newFile(f *elf.File, path string) (*File, error) {
+	id, err := buildID(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read build-id of '%s': %v", path, err)
+	}
+	res := &File{
+		BuildID: id,
+		Path:    path,
+		byName:  make(map[string]int),
+		loads:   procmaps.ReadLoads(f),
+	}
+
+	// Stripped binaries have dynamic symbols only
+	symbols, err := f.Symbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, fmt.Errorf("Unable to read symbols of '%s': %v", path, err)
+	}
+	dynamic, err := f.DynamicSymbols()
+	if err != nil && err != elf.ErrNoSymbols {
+		return nil, fmt.Errorf("Unable to read dynamic symbols of '%s': %v", path, err)
+	}
+	seen := make(map[uint64]bool)
+	for _, sym := range append(symbols, dynamic...) {
+		if elf.ST_TYPE(sym.Info) != elf.STT_FUNC || sym.Value == 0 || sym.Name == "" || seen[sym.Value] {
+			continue
+		}
+		seen[sym.Value] = true
+		res.symbols = append(res.symbols, Symbol{Name: sym.Name, Address: sym.Value, Size: sym.Size})
+	}
+	sort.Slice(res.symbols, func(i, j int) bool {
+		return res.symbols[i].Address < res.symbols[j].Address
+	})
+	for idx := range res.symbols {
+		// Aliases: keep first one only
+		if _, ok := res.byName[res.symbols[idx].Name]; !ok {
+			res.byName[res.symbols[idx].Name] = idx
+		}
+	}
+
+	return res, nil
+}
+
+// Len returns amount of function symbols of binary
+func (f *File) Len() int {
+	return len(f.symbols)
+}
+
+// LookupAddress returns symbol containing virtual address of binary,
+// and offset of address from beginning of symbol
+func (f *File) LookupAddress(addr uint64) (*Symbol, uint64, bool) {
+	idx := sort.Search(len(f.symbols), func(i int) bool {
+		return f.symbols[i].Address > addr
+	})
+	if idx == 0 {
+		return nil, 0, false
+	}
+	sym := f.symbols[idx-1]
+	// Symbols of unknown size (e.g. hand written assembly) cover everything up to next one
+	if sym.Size != 0 && addr >= sym.Address+sym.Size {
+		return nil, 0, false
+	}
+	return &sym, addr - sym.Address, true
+}
+
+// LookupName returns symbol by name
+func (f *File) LookupName(name string) (*Symbol, bool) {
+	idx, ok := f.byName[name]
+	if !ok {
+		return nil, false
+	}
+	sym := f.symbols[idx]
+	return &sym, true
+}
+
+// Vaddr converts offset in ELF file into virtual address
+func (f *File) Vaddr(fileOffset uint64) (uint64, bool) {
+	return f.loads.Vaddr(fileOffset)
+}
+
+// SymbolOffset returns offset of symbol in ELF file, as expected by uprobes
+func (f *File) SymbolOffset(name string) (uint64, error) {
+	sym, ok := f.LookupName(name)
+	if !ok {
+		return 0, fmt.Errorf("%v: '%s' in '%s'", ErrSymbolNotFound, name, f.Path)
+	}
+	if offset, ok := f.loads.FileOffset(sym.Address); ok {
+		return offset, nil
+	}
+
+	return 0, fmt.Errorf("Symbol '%s' of '%s' is not in any loadable segment", name, f.Path)
+}
@@ -0,0 +1,87 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_usym
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testLibc = "/usr/lib/x86_64-linux-gnu/libc.so.6"
+
+func TestCache(t *testing.T) {
+	if _, err := os.Stat(testLibc); err != nil {
+		t.Skip("No libc: ", err)
+	}
+	id, err := ReadBuildID(testLibc)
+	require.NoError(t, err)
+	assert.NotEmpty(t, id)
+
+	cache := NewCache()
+	file, err := cache.Open(testLibc)
+	require.NoError(t, err)
+	assert.Equal(t, id, file.BuildID)
+	assert.True(t, file.Len() > 0)
+
+	// The same binary by other path is shared
+	other, err := cache.Open("/proc/self/root" + testLibc)
+	require.NoError(t, err)
+	assert.True(t, file == other)
+	assert.Equal(t, 1, cache.Len())
+
+	offset, err := cache.SymbolOffset(testLibc, "malloc")
+	require.NoError(t, err)
+	sym, ok := file.LookupName("malloc")
+	require.True(t, ok)
+	vaddr, ok := file.Vaddr(offset)
+	require.True(t, ok)
+	assert.Equal(t, sym.Address, vaddr)
+
+	_, err = file.SymbolOffset("no_such_function")
+	assert.Error(t, err)
+
+	cache.Purge()
+	assert.Equal(t, 0, cache.Len())
+}
+
+func TestProcess(t *testing.T) {
+	if _, err := os.Stat(testLibc); err != nil {
+		t.Skip("No libc: ", err)
+	}
+	cache := NewCache()
+	proc, err := cache.Process(os.Getpid())
+	require.NoError(t, err)
+
+	// Binaries built by "go test" are stripped, so look up libc function
+	// at address it is mapped at in this process
+	offset, err := cache.SymbolOffset(testLibc, "malloc")
+	require.NoError(t, err)
+	var addr uint64
+	for _, m := range proc.mappings {
+		if m.Path == testLibc && offset >= m.Offset && offset < m.Offset+m.End-m.Start {
+			addr = m.Start + offset - m.Offset
+		}
+	}
+	if addr == 0 {
+		t.Skip("libc is not mapped")
+	}
+
+	file, err := cache.Open(testLibc)
+	require.NoError(t, err)
+	malloc, ok := file.LookupName("malloc")
+	require.True(t, ok)
+
+	// Aliases of malloc (e.g. __libc_malloc) are reported by first name
+	sym, symOffset, path, ok := proc.LookupAddress(addr + 4)
+	require.True(t, ok)
+	assert.Equal(t, malloc.Address, sym.Address)
+	assert.Equal(t, uint64(4), symOffset)
+	assert.Equal(t, testLibc, path)
+
+	frames := proc.Symbolize([]uint64{addr + 4, 0x10, 0, addr})
+	assert.Equal(t, []string{sym.Name + "+0x4 [libc.so.6]", "0x10"}, frames)
+}
@@ -0,0 +1,155 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package goebpf_xdptest runs XDP programs over packets by BPF_PROG_TEST_RUN
+// and checks action / packet after program run, so filters can be covered
+// by table driven tests in plain "go test", with packets either built in
+// test or taken from pcap corpus:
+//
+//	goebpf_xdptest.Run(t, prog, []goebpf_xdptest.Case{
+//		{Name: "blocked", Packet: blocked, Expect: goebpf_xdptest.Expect{Action: goebpf.XdpDrop}},
+//		{Name: "nat", Packet: original, Expect: goebpf_xdptest.Expect{Action: goebpf.XdpTx, Output: rewritten}},
+//	})
+//
+//	// Every packet of corpus but DNS ones must pass untouched
+//	cases, err := goebpf_xdptest.PcapCases("testdata/corpus.pcap", func(index int, packet []byte) goebpf_xdptest.Expect {
+//		if isDNS(packet) {
+//			return goebpf_xdptest.Expect{Action: goebpf.XdpDrop}
+//		}
+//		return goebpf_xdptest.Expect{Action: goebpf.XdpPass}
+//	})
+//	goebpf_xdptest.Run(t, prog, cases)
+//
+// Requires root (CAP_BPF / CAP_SYS_ADMIN) to load program.
+package goebpf_xdptest
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Expect is expected outcome of program run on packet
+type Expect struct {
+	// Return code of program
+	Action goebpf.XdpResult
+	// Packet after program run (e.g. rewritten / encapsulated one),
+	// nil means that program must not modify packet
+	Output []byte
+	// Don't check packet after program run, only action
+	AnyOutput bool
+}
+
+// Case is packet along with expected outcome of program run on it
+type Case struct {
+	Name   string
+	Packet []byte
+	Expect
+	// Optional input of program, e.g. receiving interface (see goebpf.TestRunParams)
+	IngressIfindex int
+	RxQueueIndex   int
+}
+
+// Check runs program on packet of case, returns description of mismatch
+// of outcome with expected one
+func Check(prog goebpf.Program, c Case) error {
+	if prog.GetType() != goebpf.ProgramTypeXdp {
+		return fmt.Errorf("Program '%s' is %v, not XDP", prog.GetName(), prog.GetType())
+	}
+	res, err := goebpf.ProgramTestRun(prog, goebpf.TestRunParams{
+		Data:           c.Packet,
+		IngressIfindex: c.IngressIfindex,
+		RxQueueIndex:   c.RxQueueIndex,
+	})
+	if err != nil {
+		return err
+	}
+
+	return compare(c, res)
+}
+
+// Compares result of program run with expected one
+func compare(c Case, res *goebpf.TestRunResult) error {
+	action := goebpf.XdpResult(res.ReturnValue)
+	if action != c.Action {
+		return fmt.Errorf("Action %v, expected %v", action, c.Action)
+	}
+	if c.AnyOutput {
+		return nil
+	}
+	expected := c.Output
+	if expected == nil {
+		expected = c.Packet
+	}
+	if bytes.Equal(res.Data, expected) {
+		return nil
+	}
+	what := "differs"
+	if c.Output == nil {
+		what = "modified"
+	}
+	return fmt.Errorf("Packet %s at offset %d\ngot (%d bytes):\n%sexpected (%d bytes):\n%s",
+		what, diffOffset(res.Data, expected), len(res.Data), hex.Dump(res.Data), len(expected), hex.Dump(expected))
+}
+
+// Returns offset of the first different byte
+func diffOffset(a, b []byte) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if a[i] != b[i] {
+			return i
+		}
+	}
+	if len(a) < len(b) {
+		return len(a)
+	}
+	return len(b)
+}
+
+// Run runs program on packet of every case as subtest of t
+// (named by Case.Name, or by index when empty)
+func Run(t *testing.T, prog goebpf.Program, cases []Case) {
+	t.Helper()
+	for i, c := range cases {
+		name := c.Name
+		if name == "" {
+			name = fmt.Sprintf("packet_%d", i)
+		}
+		c := c
+		t.Run(name, func(t *testing.T) {
+			if err := Check(prog, c); err != nil {
+				t.Error(err)
+			}
+		})
+	}
+}
+
+// PcapCases makes case of every packet of pcap file (see ReadPcapFile()),
+// with outcome given by expect. Cases are named by index of packet in file.
+// Packets truncated by capture snap length are rejected, program would see
+// them differently than on the wire.
+func PcapCases(path string, expect func(index int, packet []byte) Expect) ([]Case, error) {
+	packets, err := ReadPcapFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(packets) == 0 {
+		return nil, fmt.Errorf("No packets in '%s'", path)
+	}
+
+	res := make([]Case, 0, len(packets))
+	for i, pkt := range packets {
+		if pkt.OrigLen > len(pkt.Data) {
+			return nil, fmt.Errorf("Packet %d of '%s' is truncated to %d of %d bytes", i, path, len(pkt.Data), pkt.OrigLen)
+		}
+		res = append(res, Case{
+			Name:   fmt.Sprintf("packet_%d", i),
+			Packet: pkt.Data,
+			Expect: expect(i, pkt.Data),
+		})
+	}
+
+	return res, nil
+}
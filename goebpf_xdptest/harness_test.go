@@ -0,0 +1,77 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_xdptest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+)
+
+func TestCompare(t *testing.T) {
+	packet := []byte{1, 2, 3, 4}
+	result := func(action goebpf.XdpResult, data []byte) *goebpf.TestRunResult {
+		return &goebpf.TestRunResult{ReturnValue: int(action), Data: data}
+	}
+
+	// Unmodified packet
+	c := Case{Packet: packet, Expect: Expect{Action: goebpf.XdpPass}}
+	assert.NoError(t, compare(c, result(goebpf.XdpPass, []byte{1, 2, 3, 4})))
+	assert.Error(t, compare(c, result(goebpf.XdpDrop, []byte{1, 2, 3, 4})))
+	err := compare(c, result(goebpf.XdpPass, []byte{1, 2, 9, 4}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "modified at offset 2")
+
+	// Rewritten packet
+	c.Expect = Expect{Action: goebpf.XdpTx, Output: []byte{4, 3, 2, 1, 0}}
+	assert.NoError(t, compare(c, result(goebpf.XdpTx, []byte{4, 3, 2, 1, 0})))
+	err = compare(c, result(goebpf.XdpTx, []byte{4, 3, 2, 1}))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "differs at offset 4")
+
+	c.Expect = Expect{Action: goebpf.XdpTx, AnyOutput: true}
+	assert.NoError(t, compare(c, result(goebpf.XdpTx, []byte{9})))
+}
+
+func TestPcapCases(t *testing.T) {
+	dir, err := ioutil.TempDir("", "xdptest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "corpus.pcap")
+
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, WritePcap(f, []Packet{{Data: []byte{1}}, {Data: []byte{2}}}))
+	require.NoError(t, f.Close())
+
+	cases, err := PcapCases(path, func(index int, packet []byte) Expect {
+		if packet[0] == 2 {
+			return Expect{Action: goebpf.XdpDrop}
+		}
+		return Expect{Action: goebpf.XdpPass}
+	})
+	require.NoError(t, err)
+	require.Len(t, cases, 2)
+	assert.Equal(t, "packet_1", cases[1].Name)
+	assert.Equal(t, []byte{2}, cases[1].Packet)
+	assert.Equal(t, goebpf.XdpDrop, cases[1].Action)
+	assert.Equal(t, goebpf.XdpPass, cases[0].Action)
+
+	// Truncated by snap length
+	f, err = os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, WritePcap(f, []Packet{{Data: []byte{1}, OrigLen: 60}}))
+	require.NoError(t, f.Close())
+	_, err = PcapCases(path, func(int, []byte) Expect { return Expect{} })
+	assert.Error(t, err)
+
+	_, err = PcapCases(filepath.Join(dir, "missing.pcap"), func(int, []byte) Expect { return Expect{} })
+	assert.Error(t, err)
+}
@@ -0,0 +1,175 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_xdptest
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Magic numbers of classic pcap files with micro / nanosecond timestamps,
+// byte order of file is detected by them
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+	// Section header block of pcapng
+	pcapngMagic = 0x0a0d0d0a
+)
+
+const (
+	pcapVersionMajor = 2
+	pcapVersionMinor = 4
+	// LINKTYPE_ETHERNET, XDP programs see Ethernet frames
+	pcapLinkTypeEthernet = 1
+	pcapMaxSnapLen       = 262144
+)
+
+// Packet is packet read from / written into pcap file
+type Packet struct {
+	Timestamp time.Time
+	Data      []byte
+	// Length of packet on the wire, more than len(Data) if it has been
+	// truncated by capture snap length
+	OrigLen int
+}
+
+type pcapHeader struct {
+	Magic        uint32
+	VersionMajor uint16
+	VersionMinor uint16
+	ThisZone     int32
+	SigFigs      uint32
+	SnapLen      uint32
+	LinkType     uint32
+}
+
+type pcapRecordHeader struct {
+	TsSec   uint32
+	TsFrac  uint32
+	InclLen uint32
+	OrigLen uint32
+}
+
+// ReadPcap reads Ethernet packets of classic pcap (not pcapng) stream,
+// e.g. written by "tcpdump -w"
+func ReadPcap(r io.Reader) ([]Packet, error) {
+	br := bufio.NewReader(r)
+	var hdr pcapHeader
+	if err := binary.Read(br, binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("Unable to read pcap header: %v", err)
+	}
+	var bo binary.ByteOrder = binary.LittleEndian
+	nano := false
+	switch hdr.Magic {
+	case pcapMagicMicro:
+	case pcapMagicNano:
+		nano = true
+	default:
+		// pcapng magic is palindrome, so it is recognized in any byte order
+		switch swapped32(hdr.Magic) {
+		case pcapMagicMicro:
+		case pcapMagicNano:
+			nano = true
+		case pcapngMagic:
+			return nil, errors.New("pcapng files are not supported, convert by 'editcap -F pcap'")
+		default:
+			return nil, fmt.Errorf("Invalid pcap magic 0x%08x", hdr.Magic)
+		}
+		bo = binary.BigEndian
+		hdr.LinkType = swapped32(hdr.LinkType)
+	}
+	if hdr.LinkType != pcapLinkTypeEthernet {
+		return nil, fmt.Errorf("Unsupported pcap link type %d, Ethernet expected", hdr.LinkType)
+	}
+
+	var res []Packet
+	for {
+		var rec pcapRecordHeader
+		err := binary.Read(br, bo, &rec)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Unable to read header of packet %d: %v", len(res), err)
+		}
+		if rec.InclLen > pcapMaxSnapLen {
+			return nil, fmt.Errorf("Invalid length %d of packet %d", rec.InclLen, len(res))
+		}
+		data := make([]byte, rec.InclLen)
+		if _, err := io.ReadFull(br, data); err != nil {
+			return nil, fmt.Errorf("Unable to read packet %d: %v", len(res), err)
+		}
+		frac := int64(rec.TsFrac)
+		if !nano {
+			frac *= int64(time.Microsecond)
+		}
+		res = append(res, Packet{
+			Timestamp: time.Unix(int64(rec.TsSec), frac),
+			Data:      data,
+			OrigLen:   int(rec.OrigLen),
+		})
+	}
+
+	return res, nil
+}
+
+// Reverses byte order of v
+func swapped32(v uint32) uint32 {
+	return v>>24 | v>>8&0xff00 | v<<8&0xff0000 | v<<24
+}
+
+// ReadPcapFile reads Ethernet packets of classic pcap file, see ReadPcap()
+func ReadPcapFile(path string) ([]Packet, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return ReadPcap(f)
+}
+
+// WritePcap writes packets as classic pcap stream of Ethernet frames
+// (microsecond timestamps, little endian), e.g. to record corpus of test packets
+func WritePcap(w io.Writer, packets []Packet) error {
+	bw := bufio.NewWriter(w)
+	hdr := pcapHeader{
+		Magic:        pcapMagicMicro,
+		VersionMajor: pcapVersionMajor,
+		VersionMinor: pcapVersionMinor,
+		SnapLen:      pcapMaxSnapLen,
+		LinkType:     pcapLinkTypeEthernet,
+	}
+	if err := binary.Write(bw, binary.LittleEndian, &hdr); err != nil {
+		return err
+	}
+	for _, pkt := range packets {
+		origLen := pkt.OrigLen
+		if origLen < len(pkt.Data) {
+			origLen = len(pkt.Data)
+		}
+		rec := pcapRecordHeader{
+			TsSec:   uint32(pkt.Timestamp.Unix()),
+			TsFrac:  uint32(pkt.Timestamp.Nanosecond() / int(time.Microsecond)),
+			InclLen: uint32(len(pkt.Data)),
+			OrigLen: uint32(origLen),
+		}
+		if pkt.Timestamp.IsZero() {
+			rec.TsSec, rec.TsFrac = 0, 0
+		}
+		if err := binary.Write(bw, binary.LittleEndian, &rec); err != nil {
+			return err
+		}
+		if _, err := bw.Write(pkt.Data); err != nil {
+			return err
+		}
+	}
+
+	return bw.Flush()
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf_xdptest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPcapRoundTrip(t *testing.T) {
+	packets := []Packet{
+		{Timestamp: time.Unix(1600000000, 123456000), Data: []byte{1, 2, 3, 4}, OrigLen: 4},
+		{Timestamp: time.Unix(1600000001, 0), Data: []byte{5, 6}, OrigLen: 100},
+	}
+	var buf bytes.Buffer
+	require.NoError(t, WritePcap(&buf, packets))
+
+	res, err := ReadPcap(&buf)
+	require.NoError(t, err)
+	require.Len(t, res, 2)
+	for i := range packets {
+		assert.True(t, packets[i].Timestamp.Equal(res[i].Timestamp))
+		assert.Equal(t, packets[i].Data, res[i].Data)
+		assert.Equal(t, packets[i].OrigLen, res[i].OrigLen)
+	}
+}
+
+// Big endian file with nanosecond timestamps
+func TestReadPcapBigEndianNano(t *testing.T) {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.BigEndian, &pcapHeader{
+		Magic:        pcapMagicNano,
+		VersionMajor: 2,
+		VersionMinor: 4,
+		SnapLen:      65535,
+		LinkType:     pcapLinkTypeEthernet,
+	})
+	binary.Write(&buf, binary.BigEndian, &pcapRecordHeader{TsSec: 10, TsFrac: 5, InclLen: 3, OrigLen: 3})
+	buf.Write([]byte{7, 8, 9})
+
+	res, err := ReadPcap(&buf)
+	require.NoError(t, err)
+	require.Len(t, res, 1)
+	assert.Equal(t, time.Unix(10, 5), res[0].Timestamp)
+	assert.Equal(t, []byte{7, 8, 9}, res[0].Data)
+}
+
+func TestReadPcapNegative(t *testing.T) {
+	header := func(magic, linkType uint32) *bytes.Buffer {
+		var buf bytes.Buffer
+		binary.Write(&buf, binary.LittleEndian, &pcapHeader{Magic: magic, LinkType: linkType})
+		return &buf
+	}
+
+	_, err := ReadPcap(header(pcapngMagic, pcapLinkTypeEthernet))
+	assert.Error(t, err)
+	_, err = ReadPcap(header(0x12345678, pcapLinkTypeEthernet))
+	assert.Error(t, err)
+	// Raw IP
+	_, err = ReadPcap(header(pcapMagicMicro, 101))
+	assert.Error(t, err)
+	_, err = ReadPcap(bytes.NewReader([]byte{1, 2, 3}))
+	assert.Error(t, err)
+
+	// Truncated packet
+	buf := header(pcapMagicMicro, pcapLinkTypeEthernet)
+	binary.Write(buf, binary.LittleEndian, &pcapRecordHeader{InclLen: 10, OrigLen: 10})
+	buf.Write([]byte{1, 2})
+	_, err = ReadPcap(buf)
+	assert.Error(t, err)
+
+	// Empty capture is fine
+	res, err := ReadPcap(header(pcapMagicMicro, pcapLinkTypeEthernet))
+	assert.NoError(t, err)
+	assert.Empty(t, res)
+}
@@ -0,0 +1,53 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package maputil is map scaffolding shared by ready to use goebpf_* packages:
+// creating own maps in New(), finding maps of loaded ELF file in FromSystem()
+// and closing own maps in Close().
+package maputil
+
+import (
+	"fmt"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Create creates maps in given order, on error already created ones are closed
+func Create(maps ...*goebpf.EbpfMap) error {
+	for i, m := range maps {
+		if err := m.Create(); err != nil {
+			for _, created := range maps[:i] {
+				created.Close()
+			}
+			return fmt.Errorf("Unable to create map '%s': %v", m.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// Find returns maps of loaded ELF file by names, in the same order
+func Find(bpf goebpf.System, names ...string) ([]goebpf.Map, error) {
+	res := make([]goebpf.Map, 0, len(names))
+	for _, name := range names {
+		m := bpf.GetMapByName(name)
+		if m == nil {
+			return nil, fmt.Errorf("Map '%s' not found", name)
+		}
+		res = append(res, m)
+	}
+
+	return res, nil
+}
+
+// Close closes all maps, returns the first error
+func Close(maps ...goebpf.Map) error {
+	var res error
+	for _, m := range maps {
+		if err := m.Close(); err != nil && res == nil {
+			res = err
+		}
+	}
+
+	return res
+}
@@ -0,0 +1,49 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package maputil
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_fake"
+)
+
+func TestFind(t *testing.T) {
+	s := goebpf_fake.NewFakeSystem()
+	a := goebpf_fake.NewFakeMap("a", goebpf.MapTypeHash, 4, 4, 10)
+	b := goebpf_fake.NewFakeMap("b", goebpf.MapTypeHash, 4, 4, 10)
+	s.AddMap(a)
+	s.AddMap(b)
+
+	maps, err := Find(s, "b", "a")
+	require.NoError(t, err)
+	assert.Equal(t, []goebpf.Map{b, a}, maps)
+
+	_, err = Find(s, "a", "c")
+	assert.EqualError(t, err, "Map 'c' not found")
+}
+
+func TestClose(t *testing.T) {
+	a := goebpf_fake.NewFakeMap("a", goebpf.MapTypeHash, 4, 4, 10)
+	b := goebpf_fake.NewFakeMap("b", goebpf.MapTypeHash, 4, 4, 10)
+	require.NoError(t, a.Create())
+	require.NoError(t, b.Create())
+
+	assert.NoError(t, Close(a, b))
+	assert.Equal(t, 0, a.GetFd())
+	assert.Equal(t, 0, b.GetFd())
+}
+
+func TestCreateFailed(t *testing.T) {
+	// Zero sizes are rejected by kernel / emulation, nothing is left open
+	bad := &goebpf.EbpfMap{Name: "bad", Type: goebpf.MapTypeHash}
+	err := Create(bad)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "Unable to create map 'bad'")
+	assert.Equal(t, 0, bad.GetFd())
+}
@@ -0,0 +1,159 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package procmaps reads executable file mappings of process from
+// /proc/<pid>/maps and converts addresses of process memory into virtual
+// addresses of mapped ELF binaries.
+package procmaps
+
+import (
+	"bufio"
+	"debug/elf"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Suffix of /proc/<pid>/maps path of binary deleted / replaced after it has been mapped
+const deletedSuffix = " (deleted)"
+
+// Mapping is executable memory mapping of file
+type Mapping struct {
+	Start  uint64
+	End    uint64
+	Offset uint64
+	Path   string
+	// Binary has been deleted, it is accessible through map_files only
+	Deleted bool
+}
+
+// Read reads executable file mappings of process pid, sorted by start address
+func Read(pid int) ([]Mapping, error) {
+	f, err := os.Open(procPath(pid, "maps"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	mappings, err := Parse(f)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read memory mappings of process %d: %v", pid, err)
+	}
+
+	return mappings, nil
+}
+
+// Parse parses executable file mappings in /proc/<pid>/maps format:
+//
+//	7f0e5c028000-7f0e5c1bd000 r-xp 00028000 08:01 1837 /usr/lib/x86_64-linux-gnu/libc.so.6
+func Parse(r io.Reader) ([]Mapping, error) {
+	var res []Mapping
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") {
+			// Anonymous / special ([stack], [vdso]) mappings
+			continue
+		}
+		if len(fields[1]) < 3 || fields[1][2] != 'x' {
+			continue
+		}
+		addrs := strings.SplitN(fields[0], "-", 2)
+		if len(addrs) != 2 {
+			return nil, fmt.Errorf("Invalid mapping at line %d", lineNum)
+		}
+		start, err1 := strconv.ParseUint(addrs[0], 16, 64)
+		end, err2 := strconv.ParseUint(addrs[1], 16, 64)
+		offset, err3 := strconv.ParseUint(fields[2], 16, 64)
+		if err1 != nil || err2 != nil || err3 != nil {
+			return nil, fmt.Errorf("Invalid mapping at line %d", lineNum)
+		}
+		// Path may contain spaces
+		path := strings.Join(fields[5:], " ")
+		deleted := strings.HasSuffix(path, deletedSuffix)
+		res = append(res, Mapping{
+			Start:   start,
+			End:     end,
+			Offset:  offset,
+			Path:    strings.TrimSuffix(path, deletedSuffix),
+			Deleted: deleted,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Start < res[j].Start
+	})
+
+	return res, nil
+}
+
+// Find returns mapping containing address, mappings must be sorted by start
+func Find(mappings []Mapping, addr uint64) (*Mapping, bool) {
+	idx := sort.Search(len(mappings), func(i int) bool {
+		return mappings[i].End > addr
+	})
+	if idx == len(mappings) || addr < mappings[idx].Start {
+		return nil, false
+	}
+	return &mappings[idx], true
+}
+
+// FileOffset returns offset in mapped file of address in mapping
+func (m *Mapping) FileOffset(addr uint64) uint64 {
+	return addr - m.Start + m.Offset
+}
+
+// BinaryPath returns path binary of mapping of process pid can be opened by:
+// binaries are opened through root of process, which may be in other mount
+// namespace (container), deleted ones through map_files (requires CAP_SYS_ADMIN)
+func (m *Mapping) BinaryPath(pid int) string {
+	if m.Deleted {
+		return procPath(pid, "map_files", fmt.Sprintf("%x-%x", m.Start, m.End))
+	}
+	return procPath(pid, "root", m.Path)
+}
+
+func procPath(pid int, elem ...string) string {
+	return filepath.Join(append([]string{"/proc", strconv.Itoa(pid)}, elem...)...)
+}
+
+// Loads are PT_LOAD segments of ELF binary, to convert file offsets
+// into virtual addresses and back
+type Loads []elf.ProgHeader
+
+// ReadLoads returns PT_LOAD segments of ELF file
+func ReadLoads(f *elf.File) Loads {
+	var res Loads
+	for _, prog := range f.Progs {
+		if prog.Type == elf.PT_LOAD {
+			res = append(res, prog.ProgHeader)
+		}
+	}
+	return res
+}
+
+// Vaddr converts offset in ELF file into virtual address
+func (l Loads) Vaddr(fileOffset uint64) (uint64, bool) {
+	for _, prog := range l {
+		if fileOffset >= prog.Off && fileOffset < prog.Off+prog.Filesz {
+			return fileOffset - prog.Off + prog.Vaddr, true
+		}
+	}
+	return 0, false
+}
+
+// FileOffset converts virtual address into offset in ELF file
+func (l Loads) FileOffset(vaddr uint64) (uint64, bool) {
+	for _, prog := range l {
+		if vaddr >= prog.Vaddr && vaddr < prog.Vaddr+prog.Filesz {
+			return vaddr - prog.Vaddr + prog.Off, true
+		}
+	}
+	return 0, false
+}
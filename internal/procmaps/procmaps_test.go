@@ -0,0 +1,79 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package procmaps
+
+import (
+	"debug/elf"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	const maps = `55d0c1a00000-55d0c1a04000 r--p 00000000 08:01 100 /usr/bin/cat
+55d0c1a04000-55d0c1a09000 r-xp 00004000 08:01 100 /usr/bin/cat
+7f0e5c400000-7f0e5c401000 r-xp 00000000 08:01 1838 /tmp/with space.so
+7f0e5c028000-7f0e5c1bd000 r-xp 00028000 08:01 1837 /opt/app/bin/server (deleted)
+7ffd1b5fe000-7ffd1b600000 r-xp 00000000 00:00 0 [vdso]
+7ffd1b500000-7ffd1b520000 rw-p 00000000 00:00 0 [stack]
+`
+	mappings, err := Parse(strings.NewReader(maps))
+	require.NoError(t, err)
+	assert.Equal(t, []Mapping{
+		{Start: 0x55d0c1a04000, End: 0x55d0c1a09000, Offset: 0x4000, Path: "/usr/bin/cat"},
+		{Start: 0x7f0e5c028000, End: 0x7f0e5c1bd000, Offset: 0x28000, Path: "/opt/app/bin/server", Deleted: true},
+		{Start: 0x7f0e5c400000, End: 0x7f0e5c401000, Path: "/tmp/with space.so"},
+	}, mappings)
+
+	assert.Equal(t, "/proc/42/root/usr/bin/cat", mappings[0].BinaryPath(42))
+	assert.Equal(t, "/proc/42/map_files/7f0e5c028000-7f0e5c1bd000", mappings[1].BinaryPath(42))
+
+	m, ok := Find(mappings, 0x7f0e5c028010)
+	require.True(t, ok)
+	assert.Equal(t, "/opt/app/bin/server", m.Path)
+	assert.Equal(t, uint64(0x28010), m.FileOffset(0x7f0e5c028010))
+	_, ok = Find(mappings, 0x7f0e5c1bd000)
+	assert.False(t, ok)
+	_, ok = Find(mappings, 0x1000)
+	assert.False(t, ok)
+
+	_, err = Parse(strings.NewReader("xyz r-xp 0 0 0 /bin/x\n"))
+	assert.Error(t, err)
+}
+
+func TestLoads(t *testing.T) {
+	l := Loads{
+		{Type: elf.PT_LOAD, Off: 0, Vaddr: 0, Filesz: 0x1000},
+		{Type: elf.PT_LOAD, Off: 0x1000, Vaddr: 0x401000, Filesz: 0x2000},
+	}
+	vaddr, ok := l.Vaddr(0x1010)
+	require.True(t, ok)
+	assert.Equal(t, uint64(0x401010), vaddr)
+	offset, ok := l.FileOffset(vaddr)
+	require.True(t, ok)
+	assert.Equal(t, uint64(0x1010), offset)
+
+	_, ok = l.Vaddr(0x3000)
+	assert.False(t, ok)
+	_, ok = l.FileOffset(0x1000)
+	assert.False(t, ok)
+}
+
+func TestRead(t *testing.T) {
+	mappings, err := Read(os.Getpid())
+	if err != nil {
+		t.Skipf("No /proc: %v", err)
+	}
+	exe, err := os.Executable()
+	require.NoError(t, err)
+	// Test binary itself is mapped
+	found := false
+	for _, m := range mappings {
+		found = found || m.Path == exe
+	}
+	assert.True(t, found)
+}
@@ -0,0 +1,83 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+// Package xdpsrc builds common parts of XDP programs matching IPv4 / IPv6
+// packets by source address. Instructions jump to labels "ipv4", "ipv6"
+// and "pass", which must be defined by program:
+//
+//	insns := xdpsrc.Dispatch()
+//	insns = append(insns, xdpsrc.IPv4Src(-4)...)
+//	// lookup of IPv4 source address at fp-4
+//	insns = append(insns, xdpsrc.IPv6Src(-16)...)
+//	// lookup of IPv6 source address at fp-16
+//	insns = append(insns,
+//		goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpPass)).WithLabel("pass"),
+//		goebpf.Exit(),
+//	)
+package xdpsrc
+
+import (
+	"net"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Offsets of fields in packet: Ethernet header, source address of IPv4 / IPv6 header
+const (
+	ethHeaderLen  = 14
+	ethProtoOff   = 12
+	ipv4HeaderLen = 20
+	ipv4SrcOff    = ethHeaderLen + 12
+	ipv6HeaderLen = 40
+	ipv6SrcOff    = ethHeaderLen + 8
+	ethTypeIPv4   = 0x0800
+	ethTypeIPv6   = 0x86dd
+)
+
+// Dispatch returns program prologue: R2 = data, R3 = data_end, then jump
+// to "ipv4" / "ipv6" by EtherType, to "pass" for other (e.g. VLAN tagged)
+// or truncated frames. R1 must be XDP context.
+func Dispatch() goebpf.Instructions {
+	return goebpf.Instructions{
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R2, goebpf.R1, 0),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R3, goebpf.R1, 4),
+		goebpf.Mov64Reg(goebpf.R4, goebpf.R2),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R4, ethHeaderLen),
+		goebpf.JumpReg(goebpf.JumpOpGt, goebpf.R4, goebpf.R3, "pass"),
+		goebpf.LoadMem(goebpf.SizeHalf, goebpf.R5, goebpf.R2, ethProtoOff),
+		goebpf.ToBigEndian(goebpf.R5, 16),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R5, ethTypeIPv4, "ipv4"),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R5, ethTypeIPv6, "ipv6"),
+		goebpf.Jump("pass"),
+	}
+}
+
+// IPv4Src returns instructions labelled "ipv4" copying source address of
+// IPv4 header to stack at fp+off, truncated packets jump to "pass".
+// R2 / R3 are set up by Dispatch(), R4 / R5 are clobbered.
+func IPv4Src(off int16) goebpf.Instructions {
+	return goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R4, goebpf.R2).WithLabel("ipv4"),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R4, ethHeaderLen+ipv4HeaderLen),
+		goebpf.JumpReg(goebpf.JumpOpGt, goebpf.R4, goebpf.R3, "pass"),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R5, goebpf.R2, ipv4SrcOff),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, off, goebpf.R5),
+	}
+}
+
+// IPv6Src is IPv4Src() for IPv6 header, labelled "ipv6"
+func IPv6Src(off int16) goebpf.Instructions {
+	insns := goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R4, goebpf.R2).WithLabel("ipv6"),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R4, ethHeaderLen+ipv6HeaderLen),
+		goebpf.JumpReg(goebpf.JumpOpGt, goebpf.R4, goebpf.R3, "pass"),
+	}
+	for i := 0; i < net.IPv6len; i += 4 {
+		insns = append(insns,
+			goebpf.LoadMem(goebpf.SizeWord, goebpf.R5, goebpf.R2, int16(ipv6SrcOff+i)),
+			goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, off+int16(i), goebpf.R5),
+		)
+	}
+
+	return insns
+}
@@ -0,0 +1,69 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf/goebpf_audit"
+)
+
+func TestAuditor(t *testing.T) {
+	a, err := goebpf_audit.New(1 << 20)
+	require.NoError(t, err)
+	defer a.Close()
+	require.NoError(t, a.Attach())
+
+	cmd := exec.Command("/bin/sh", "-c", "exit 3")
+	assert.Error(t, cmd.Run())
+	pid := cmd.Process.Pid
+
+	// Other processes of system may run meanwhile, look for own ones
+	events := make(chan *goebpf_audit.Event)
+	go func() {
+		for {
+			e, err := a.Read()
+			if err != nil {
+				close(events)
+				return
+			}
+			if e.Pid == pid {
+				events <- e
+			}
+		}
+	}()
+	var execEvent, exitEvent *goebpf_audit.Event
+	timeout := time.After(5 * time.Second)
+	for execEvent == nil || exitEvent == nil {
+		select {
+		case e := <-events:
+			switch e.Type {
+			case goebpf_audit.EventExec:
+				execEvent = e
+			case goebpf_audit.EventExit:
+				exitEvent = e
+			}
+		case <-timeout:
+			t.Fatal("No exec / exit events received")
+		}
+	}
+
+	assert.Equal(t, "/bin/sh", execEvent.Filename)
+	assert.Equal(t, []string{"/bin/sh", "-c", "exit 3"}, execEvent.Argv)
+	assert.Equal(t, os.Getpid(), execEvent.Ppid)
+	assert.Equal(t, os.Getuid(), execEvent.Uid)
+	assert.Equal(t, pid, execEvent.Tid)
+	assert.WithinDuration(t, time.Now(), execEvent.Time, 5*time.Second)
+
+	assert.Equal(t, 3, exitEvent.ExitCode)
+	assert.Equal(t, 0, exitEvent.Signal)
+	assert.Equal(t, os.Getpid(), exitEvent.Ppid)
+	assert.False(t, exitEvent.Time.Before(execEvent.Time))
+}
@@ -0,0 +1,52 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/dropbox/goebpf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditTrail(t *testing.T) {
+	var mu sync.Mutex
+	var records []goebpf.AuditRecord
+	goebpf.SetAuditSink(func(rec goebpf.AuditRecord) {
+		mu.Lock()
+		records = append(records, rec)
+		mu.Unlock()
+	})
+	defer goebpf.SetAuditSink(nil)
+
+	m := &goebpf.EbpfMap{
+		Name:       "audit_trail",
+		Type:       goebpf.MapTypeHash,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 4,
+	}
+	require.NoError(t, m.Create())
+	require.NoError(t, m.Upsert(1, 1))
+	_, err := m.LookupInt(2)
+	assert.Error(t, err)
+	require.NoError(t, m.Close())
+
+	mu.Lock()
+	defer mu.Unlock()
+	ops := map[string]goebpf.AuditRecord{}
+	for _, rec := range records {
+		if rec.Object == "audit_trail" {
+			ops[rec.Op] = rec
+		}
+	}
+	require.Contains(t, ops, "BPF_MAP_CREATE")
+	assert.NoError(t, ops["BPF_MAP_CREATE"].Err)
+	require.Contains(t, ops, "BPF_MAP_UPDATE_ELEM")
+	assert.NoError(t, ops["BPF_MAP_UPDATE_ELEM"].Err)
+	require.Contains(t, ops, "BPF_MAP_LOOKUP_ELEM")
+	assert.Error(t, ops["BPF_MAP_LOOKUP_ELEM"].Err)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_blocklist"
+	"github.com/dropbox/goebpf/goebpf_testnet"
+)
+
+// Ethernet frame with IPv6 header from src (payload is not needed by program)
+func ipv6Frame(src string) []byte {
+	frame := make([]byte, 14+40)
+	frame[12], frame[13] = 0x86, 0xdd
+	frame[14] = 0x60
+	copy(frame[14+8:], net.ParseIP(src).To16())
+	copy(frame[14+24:], net.ParseIP("fc00::1").To16())
+	return frame
+}
+
+func TestBlocklist(t *testing.T) {
+	bl, err := goebpf_blocklist.New(16)
+	require.NoError(t, err)
+	defer bl.Close()
+
+	require.NoError(t, bl.Add("10.0.0.0/8", 0))
+	require.NoError(t, bl.Add("192.168.1.1", time.Millisecond))
+	require.NoError(t, bl.Add("2001:db8::/32", time.Hour))
+	assert.Error(t, bl.Add("not-a-network", 0))
+
+	prog, err := bl.Program()
+	require.NoError(t, err)
+	require.NoError(t, prog.Load())
+	defer prog.Close()
+
+	runs := []struct {
+		data   []byte
+		result goebpf.XdpResult
+	}{
+		{(&goebpf_testnet.IPv4Packet{Src: net.ParseIP("10.1.2.3"), Dst: net.ParseIP("1.1.1.1"), TTL: 64}).Bytes(), goebpf.XdpDrop},
+		{(&goebpf_testnet.IPv4Packet{Src: net.ParseIP("11.1.2.3"), Dst: net.ParseIP("1.1.1.1"), TTL: 64}).Bytes(), goebpf.XdpPass},
+		{(&goebpf_testnet.IPv4Packet{Src: net.ParseIP("192.168.1.1"), Dst: net.ParseIP("1.1.1.1"), TTL: 64}).Bytes(), goebpf.XdpDrop},
+		{ipv6Frame("2001:db8::5"), goebpf.XdpDrop},
+		{ipv6Frame("2001:db9::5"), goebpf.XdpPass},
+		// Truncated IPv4 header
+		{(&goebpf_testnet.IPv4Packet{Src: net.ParseIP("10.1.2.3"), Dst: net.ParseIP("1.1.1.1"), TTL: 64}).Bytes()[:20], goebpf.XdpPass},
+	}
+	for idx, r := range runs {
+		res, err := goebpf.ProgramTestRun(prog, goebpf.TestRunParams{Data: r.data, Repeat: 1})
+		require.NoError(t, err)
+		assert.Equal(t, int(r.result), res.ReturnValue, "run %d", idx)
+	}
+
+	entries, err := bl.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 3)
+	packets := map[string]uint64{}
+	for _, e := range entries {
+		packets[e.Network.String()] = e.Packets
+	}
+	assert.Equal(t, map[string]uint64{
+		"10.0.0.0/8":     1,
+		"192.168.1.1/32": 1,
+		"2001:db8::/32":  1,
+	}, packets)
+
+	// Re-adding keeps counter
+	require.NoError(t, bl.Add("10.0.0.0/8", time.Hour))
+	entries, err = bl.List()
+	require.NoError(t, err)
+	for _, e := range entries {
+		if e.Network.String() == "10.0.0.0/8" {
+			assert.Equal(t, uint64(1), e.Packets)
+			assert.False(t, e.Expires.IsZero())
+		}
+	}
+	// Nested network is separate entry: counter of enclosing one is not copied
+	require.NoError(t, bl.Add("10.1.0.0/16", 0))
+	entries, err = bl.List()
+	require.NoError(t, err)
+	packets = map[string]uint64{}
+	for _, e := range entries {
+		packets[e.Network.String()] = e.Packets
+	}
+	assert.Equal(t, uint64(1), packets["10.0.0.0/8"])
+	assert.Equal(t, uint64(0), packets["10.1.0.0/16"])
+	require.NoError(t, bl.Remove("10.1.0.0/16"))
+
+	time.Sleep(10 * time.Millisecond)
+	removed, err := bl.Expire()
+	require.NoError(t, err)
+	assert.Equal(t, 1, removed)
+
+	require.NoError(t, bl.Remove("2001:db8::/32"))
+	assert.Error(t, bl.Remove("2001:db8::/32"))
+	entries, err = bl.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, "10.0.0.0/8", entries[0].Network.String())
+
+	// Background expiry
+	require.NoError(t, bl.Add("172.16.0.0/12", time.Millisecond))
+	bl.StartExpiry(5 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	entries, err = bl.List()
+	require.NoError(t, err)
+	assert.Len(t, entries, 1)
+	assert.NoError(t, bl.Err())
+}
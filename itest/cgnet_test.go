@@ -0,0 +1,116 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf/goebpf_cgnet"
+)
+
+// Moves test process into cgroup
+func enterCgroup(t *testing.T, path string) {
+	pid := []byte(strconv.Itoa(os.Getpid()))
+	require.NoError(t, ioutil.WriteFile(filepath.Join(path, "cgroup.procs"), pid, 0644))
+}
+
+// Sends count UDP packets of size over loopback, from sockets created by
+// process in its current cgroup
+func sendUDP(t *testing.T, count, size int) {
+	srv, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer srv.Close()
+	conn, err := net.DialUDP("udp4", nil, srv.LocalAddr().(*net.UDPAddr))
+	require.NoError(t, err)
+	defer conn.Close()
+
+	buf := make([]byte, size)
+	for i := 0; i < count; i++ {
+		_, err = conn.Write(buf)
+		require.NoError(t, err)
+		srv.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = srv.Read(buf)
+		require.NoError(t, err)
+	}
+}
+
+func TestCgroupNetAccounting(t *testing.T) {
+	existing := filepath.Join(cgroupV2Path, "goebpf_cgnet1")
+	created := filepath.Join(cgroupV2Path, "goebpf_cgnet2")
+	os.Remove(existing)
+	os.Remove(created)
+	require.NoError(t, os.Mkdir(existing, 0755))
+	defer os.Remove(existing)
+
+	acc, err := goebpf_cgnet.New(cgroupV2Path, 64)
+	require.NoError(t, err)
+	defer acc.Close()
+	removed := make(chan goebpf_cgnet.Stats, 1)
+	acc.OnRemove(func(path string, final goebpf_cgnet.Stats) {
+		if path == created {
+			removed <- final
+		}
+	})
+	require.NoError(t, acc.Attach())
+	defer enterCgroup(t, cgroupV2Path)
+
+	// 10 packets of 100 bytes payload, IP + UDP headers are 28 bytes
+	enterCgroup(t, existing)
+	sendUDP(t, 10, 100)
+	s, err := acc.Get("goebpf_cgnet1")
+	require.NoError(t, err)
+	assert.Equal(t, goebpf_cgnet.Stats{
+		RxBytes:   10 * 128,
+		RxPackets: 10,
+		TxBytes:   10 * 128,
+		TxPackets: 10,
+	}, s)
+
+	// Cgroup created after accounting started is tracked as well
+	require.NoError(t, os.Mkdir(created, 0755))
+	enterCgroup(t, created)
+	sendUDP(t, 5, 72)
+	enterCgroup(t, cgroupV2Path)
+	s, err = acc.Get(created)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), s.TxPackets)
+	assert.Equal(t, uint64(5*100), s.RxBytes)
+
+	var all map[string]goebpf_cgnet.Stats
+	for i := 0; i < 100; i++ {
+		all, err = acc.All()
+		require.NoError(t, err)
+		if _, ok := all[created]; ok {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.Equal(t, uint64(10), all[existing].RxPackets)
+	assert.Equal(t, uint64(5), all[created].RxPackets)
+
+	// Stats of removed cgroup are reported and dropped
+	require.NoError(t, os.Remove(created))
+	select {
+	case final := <-removed:
+		assert.Equal(t, uint64(5), final.TxPackets)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Removal of cgroup not reported")
+	}
+	all, err = acc.All()
+	require.NoError(t, err)
+	assert.NotContains(t, all, created)
+	assert.Contains(t, all, existing)
+
+	_, err = acc.Get("goebpf_cgnet_nonexisting")
+	assert.Error(t, err)
+}
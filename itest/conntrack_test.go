@@ -0,0 +1,58 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_conntrack"
+)
+
+func TestConntrackSweep(t *testing.T) {
+	m := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypeLRUHash,
+		KeySize:    16,
+		ValueSize:  32,
+		MaxEntries: 8192,
+	}
+	require.NoError(t, m.Create())
+	defer m.Close()
+
+	// Half of flows were last seen hour ago, half - just now
+	boot := goebpf.KtimeToTime(0)
+	now := time.Now()
+	for i := 0; i < 2000; i++ {
+		key := goebpf.FlowKey{
+			Src:      net.IPv4(10, 0, byte(i>>8), byte(i)),
+			Dst:      net.ParseIP("10.1.0.1"),
+			SrcPort:  uint16(1024 + i),
+			DstPort:  443,
+			Protocol: 6,
+		}
+		lastSeen := now
+		if i%2 == 0 {
+			lastSeen = now.Add(-time.Hour)
+		}
+		value := make([]byte, 32)
+		goebpf.HostByteOrder().PutUint64(value, 1)
+		goebpf.HostByteOrder().PutUint64(value[24:], uint64(lastSeen.Sub(boot)))
+		require.NoError(t, m.Insert(key, value))
+	}
+
+	table := goebpf_conntrack.NewTable(m)
+	removed, err := table.Sweep(time.Minute)
+	require.NoError(t, err)
+	assert.Equal(t, 1000, removed)
+
+	flows, err := table.Flows()
+	require.NoError(t, err)
+	assert.Len(t, flows, 1000)
+	assert.Equal(t, uint64(1000), goebpf_conntrack.Total(flows).Packets)
+}
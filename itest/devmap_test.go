@@ -0,0 +1,73 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_testnet"
+)
+
+func TestDevMapBroadcast(t *testing.T) {
+	topo, err := goebpf_testnet.NewTopology()
+	require.NoError(t, err)
+	defer topo.Close()
+	require.NoError(t, topo.AddVethPair("dm0", "", "dm1"))
+	require.NoError(t, topo.AddVethPair("dm2", "", "dm3"))
+
+	err = topo.Do(func() error {
+		m := &goebpf.EbpfMap{
+			Name:       "group",
+			Type:       goebpf.MapTypeDevMapHash,
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 8,
+		}
+		require.NoError(t, m.Create())
+		defer m.Close()
+		group, err := goebpf.NewDevMap(m)
+		require.NoError(t, err)
+
+		dm0, err := net.InterfaceByName("dm0")
+		require.NoError(t, err)
+		dm2, err := net.InterfaceByName("dm2")
+		require.NoError(t, err)
+
+		require.NoError(t, group.Join("dm0"))
+		require.NoError(t, group.Join("dm2"))
+		members, err := group.Members()
+		require.NoError(t, err)
+		assert.ElementsMatch(t, []int{dm0.Index, dm2.Index}, members)
+
+		require.NoError(t, group.Leave("dm2"))
+		require.NoError(t, group.Leave("dm2"))
+		ifaces, err := group.Interfaces()
+		require.NoError(t, err)
+		assert.Equal(t, map[uint32]int{uint32(dm0.Index): dm0.Index}, ifaces)
+
+		// Kernel accepts broadcast flags: packet is redirected, not aborted
+		flags := goebpf.XdpRedirectBroadcast | goebpf.XdpRedirectExcludeIngress
+		prog, err := goebpf.NewProgram("flood", goebpf.ProgramTypeXdp, "GPL", goebpf.Instructions{
+			goebpf.LoadMapFd(goebpf.R1, m),
+			goebpf.Mov64Imm(goebpf.R2, 0),
+			goebpf.Mov64Imm(goebpf.R3, int32(flags)),
+			goebpf.Call(goebpf.HelperRedirectMap),
+			goebpf.Exit(),
+		})
+		require.NoError(t, err)
+		require.NoError(t, prog.Load())
+		defer prog.Close()
+
+		res, err := goebpf.ProgramTestRun(prog, goebpf.TestRunParams{Data: ethFrame(0xff, 2, 0x0800)})
+		require.NoError(t, err)
+		assert.Equal(t, int(goebpf.XdpRedirect), res.ReturnValue)
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,125 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_dns"
+	"github.com/dropbox/goebpf/goebpf_testnet"
+)
+
+// UDP datagram (without checksum) carrying DNS query for name
+func dnsDatagram(sport, dport uint16, name string, qtype goebpf_dns.QueryType) []byte {
+	msg := []byte{0xab, 0xcd, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range []string{name[:len(name)-4], name[len(name)-3:]} {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+
+	udp := make([]byte, 8, 8+len(msg))
+	binary.BigEndian.PutUint16(udp, sport)
+	binary.BigEndian.PutUint16(udp[2:], dport)
+	binary.BigEndian.PutUint16(udp[4:], uint16(8+len(msg)))
+	return append(udp, msg...)
+}
+
+func TestDNSMonitor(t *testing.T) {
+	mon, err := goebpf_dns.New(1 << 16)
+	require.NoError(t, err)
+
+	ipv4 := func(payload []byte) []byte {
+		return (&goebpf_testnet.IPv4Packet{
+			Src:      net.ParseIP("10.0.0.1"),
+			Dst:      net.ParseIP("10.0.0.53"),
+			TTL:      64,
+			Protocol: 17,
+			Payload:  payload,
+		}).Bytes()
+	}
+	ipv6 := ipv6Frame("fc00::5")
+	udp := dnsDatagram(40001, 53, "example.com", goebpf_dns.TypeAAAA)
+	binary.BigEndian.PutUint16(ipv6[14+4:], uint16(len(udp)))
+	ipv6[14+6] = 17
+	ipv6 = append(ipv6, udp...)
+
+	for _, data := range [][]byte{
+		ipv4(dnsDatagram(40000, 53, "example.com", goebpf_dns.TypeA)),
+		// Not DNS queries: other port, TCP, truncated DNS header
+		ipv4(dnsDatagram(53, 5353, "example.com", goebpf_dns.TypeA)),
+		(&goebpf_testnet.IPv4Packet{Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("10.0.0.53"), Protocol: 6,
+			Payload: dnsDatagram(40000, 53, "example.com", goebpf_dns.TypeA)}).Bytes(),
+		ipv4(dnsDatagram(40000, 53, "example.com", goebpf_dns.TypeA)[:16]),
+		ipv6,
+	} {
+		res, err := goebpf.ProgramTestRun(mon.Program(), goebpf.TestRunParams{Data: data})
+		require.NoError(t, err)
+		// Socket itself never gets packets
+		assert.Equal(t, 0, res.ReturnValue)
+	}
+
+	q, err := mon.Read()
+	require.NoError(t, err)
+	assert.Equal(t, "10.0.0.1", q.Src.String())
+	assert.Equal(t, "10.0.0.53", q.Dst.String())
+	assert.Equal(t, uint16(40000), q.SrcPort)
+	assert.Equal(t, uint16(53), q.DstPort)
+	assert.Equal(t, uint16(0xabcd), q.ID)
+	assert.Equal(t, "example.com", q.Name)
+	assert.Equal(t, goebpf_dns.TypeA, q.Type)
+	assert.WithinDuration(t, time.Now(), q.Time, time.Second)
+
+	q, err = mon.Read()
+	require.NoError(t, err)
+	assert.Equal(t, "fc00::5", q.Src.String())
+	assert.Equal(t, "fc00::1", q.Dst.String())
+	assert.Equal(t, uint16(40001), q.SrcPort)
+	assert.Equal(t, goebpf_dns.TypeAAAA, q.Type)
+	assert.Equal(t, uint64(0), mon.Malformed())
+
+	// Close interrupts pending Read()
+	done := make(chan error)
+	go func() {
+		_, err := mon.Read()
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, mon.Close())
+	select {
+	case err = <-done:
+		assert.Equal(t, goebpf.ErrRingBufClosed, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read() has not been interrupted by Close()")
+	}
+}
+
+func TestDNSMonitorAttach(t *testing.T) {
+	mon, err := goebpf_dns.New(1 << 16)
+	require.NoError(t, err)
+	defer mon.Close()
+
+	require.NoError(t, mon.Attach("lo"))
+	assert.Error(t, mon.Attach("lo"))
+
+	// Send query to local port, nobody has to answer it
+	conn, err := net.Dial("udp", "127.0.0.1:53")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(dnsDatagram(0, 0, "example.org", goebpf_dns.TypeTXT)[8:])
+	require.NoError(t, err)
+
+	q, err := mon.Read()
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", q.Src.String())
+	assert.Equal(t, "example.org", q.Name)
+	assert.Equal(t, goebpf_dns.TypeTXT, q.Type)
+}
@@ -0,0 +1,165 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_encap"
+	"github.com/dropbox/goebpf/goebpf_testnet"
+)
+
+// Sends payload over UDP to addr, returns what listener received
+func udpRoundTrip(t *testing.T, ln *net.UDPConn, network, addr, payload string) []byte {
+	conn, err := net.Dial(network, addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte(payload))
+	require.NoError(t, err)
+
+	buf := make([]byte, 1500)
+	ln.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := ln.Read(buf)
+	require.NoError(t, err)
+
+	return buf[:n]
+}
+
+// Opens socket receiving IPv6 packets of interface
+func newIPv6Capture(t *testing.T, ifname string) int {
+	link, err := netlink.LinkByName(ifname)
+	require.NoError(t, err)
+	protocol := int(goebpf.HostByteOrder().Uint16([]byte{0x86, 0xdd}))
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, protocol)
+	require.NoError(t, err)
+	require.NoError(t, unix.Bind(fd, &unix.SockaddrLinklayer{
+		Protocol: uint16(protocol),
+		Ifindex:  link.Attrs().Index,
+	}))
+
+	return fd
+}
+
+// Returns captured IPv6 packet carrying UDP payload, nil on timeout
+func captureUDP(fd int, payload string, timeout time.Duration) []byte {
+	tv := unix.NsecToTimeval(int64(timeout))
+	unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv)
+	buf := make([]byte, 1500)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil
+		}
+		if n == 48+len(payload) && buf[6] == unix.IPPROTO_UDP && string(buf[48:n]) == payload {
+			return buf[:n]
+		}
+	}
+}
+
+func TestEncap(t *testing.T) {
+	topo, err := goebpf_testnet.NewTopology()
+	require.NoError(t, err)
+	defer topo.Close()
+	// Addresses are usable right away
+	require.NoError(t, topo.Do(func() error {
+		return ioutil.WriteFile("/proc/sys/net/ipv6/conf/default/accept_dad", []byte("0"), 0644)
+	}))
+	require.NoError(t, topo.AddVethPair("srv0", "fd00::1/64", "srv1"))
+	require.NoError(t, topo.AddNeighbor("fc00::1", "srv0"))
+	require.NoError(t, topo.AddVethPair("out0", "fd01::1/64", "out1"))
+	require.NoError(t, topo.AddNeighbor("fd01::2", "out0"))
+
+	err = topo.Do(func() error {
+		m, err := goebpf_encap.New(16, 16)
+		require.NoError(t, err)
+		defer m.Close()
+
+		// GENEVE: tunnel endpoint is local, so encapsulated packets are received by UDP socket
+		_, dst, _ := net.ParseCIDR("192.168.1.0/24")
+		require.NoError(t, m.SetTunnel(*dst, &goebpf_encap.Geneve{
+			Source: net.ParseIP("127.0.0.1"),
+			Remote: net.ParseIP("127.0.0.1"),
+			VNI:    42,
+		}))
+		route := goebpf.LwtAttachParams{
+			Dst:      "192.168.1.0/24",
+			Device:   "lo",
+			Headroom: goebpf_encap.MaxHeaderSize,
+		}
+		require.NoError(t, m.XmitProgram().Attach(route))
+		endpoint, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1), Port: goebpf_encap.GenevePort})
+		require.NoError(t, err)
+		defer endpoint.Close()
+
+		pkt := udpRoundTrip(t, endpoint, "udp4", "192.168.1.5:9999", "hello")
+		require.True(t, len(pkt) > 8+20+8)
+		// GENEVE header: inner IPv4, VNI 42
+		assert.Equal(t, []byte{0, 0, 0x08, 0x00, 0, 0, 42, 0}, pkt[:8])
+		inner := pkt[8:]
+		assert.Equal(t, net.IPv4(192, 168, 1, 5).To4(), net.IP(inner[16:20]))
+		assert.Equal(t, "hello", string(inner[28:]))
+		require.NoError(t, m.XmitProgram().Detach())
+
+		// SRv6: packets to 2001:db8:1::/64 visit End.BPF SID fc00::1 (reached
+		// through srv0 -> srv1), which decapsulates them into table 100 (tag 7)
+		// routing them out of out0. Decapsulated packets are captured on out1.
+		_, dst, _ = net.ParseCIDR("2001:db8:1::/64")
+		require.NoError(t, m.SetTunnel(*dst, &goebpf_encap.SRv6{
+			Source:   net.ParseIP("fd00::1"),
+			Segments: []net.IP{net.ParseIP("fc00::1"), net.ParseIP("fc00::2")},
+			Tag:      7,
+		}))
+		require.NoError(t, m.XmitProgram().Attach(goebpf.LwtAttachParams{
+			Dst:      "2001:db8:1::/64",
+			Device:   "srv0",
+			Headroom: goebpf_encap.MaxHeaderSize,
+		}))
+		defer m.XmitProgram().Detach()
+		require.NoError(t, m.Seg6LocalProgram().Attach(goebpf.LwtAttachParams{
+			Dst:    "fc00::1/128",
+			Device: "srv0",
+		}))
+		defer m.Seg6LocalProgram().Detach()
+		out0, err := netlink.LinkByName("out0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.RouteAdd(&netlink.Route{
+			Dst:       dst,
+			Gw:        net.ParseIP("fd01::2"),
+			LinkIndex: out0.Attrs().Index,
+			Table:     100,
+		}))
+		require.NoError(t, m.SetAction(7, goebpf_encap.Seg6Action{Action: goebpf_encap.ActionEndDT6, Table: 100}))
+		capture := newIPv6Capture(t, "out1")
+		defer unix.Close(capture)
+
+		conn, err := net.Dial("udp6", "[2001:db8:1::5]:9999")
+		require.NoError(t, err)
+		defer conn.Close()
+		_, err = conn.Write([]byte("hello6"))
+		require.NoError(t, err)
+		pkt = captureUDP(capture, "hello6", time.Second)
+		require.NotNil(t, pkt)
+		// Inner packet only, UDP right after IPv6 header
+		assert.Equal(t, net.ParseIP("fd00::1"), net.IP(pkt[8:24]))
+		assert.Equal(t, net.ParseIP("2001:db8:1::5"), net.IP(pkt[24:40]))
+
+		// Without action packet goes to the next segment, which is unreachable
+		require.NoError(t, m.DeleteAction(7))
+		_, err = conn.Write([]byte("lost"))
+		require.NoError(t, err)
+		assert.Nil(t, captureUDP(capture, "lost", 200*time.Millisecond))
+
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_testnet"
+)
+
+// Return codes of bpf_fib_lookup()
+const (
+	fibLookupSuccess  = 0
+	fibLookupNotFwded = 4
+	fibLookupNoNeigh  = 7
+)
+
+// XDP program doing bpf_fib_lookup() for destination of IPv4 packet,
+// returns result of lookup (or XDP_ABORTED for short packets)
+func newFibLookupProgram() (goebpf.Program, error) {
+	const (
+		params    = -64 // struct bpf_fib_lookup on stack
+		ethIpDst  = 14 + 16
+		fibIfidx  = 8
+		fibIpv4Da = 32
+	)
+	insns := goebpf.Instructions{
+		goebpf.Mov64Reg(goebpf.R6, goebpf.R1),
+		// Bounds check of packet
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R2, goebpf.R6, 0),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R3, goebpf.R6, 4),
+		goebpf.Mov64Reg(goebpf.R4, goebpf.R2),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R4, ethIpDst+4),
+		goebpf.JumpReg(goebpf.JumpOpGt, goebpf.R4, goebpf.R3, "aborted"),
+	}
+	for off := int16(params); off < 0; off += 8 {
+		insns = append(insns, goebpf.StoreImm(goebpf.SizeDouble, goebpf.R10, off, 0))
+	}
+	insns = append(insns,
+		// family = AF_INET, ifindex = ctx->ingress_ifindex, ipv4_dst = iph->daddr
+		goebpf.StoreImm(goebpf.SizeByte, goebpf.R10, params, 2),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R3, goebpf.R6, 12),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, params+fibIfidx, goebpf.R3),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R3, goebpf.R2, ethIpDst),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R10, params+fibIpv4Da, goebpf.R3),
+		// bpf_fib_lookup(ctx, &params, sizeof(params), 0)
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R6),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, params),
+		goebpf.Mov64Imm(goebpf.R3, -params),
+		goebpf.Mov64Imm(goebpf.R4, 0),
+		goebpf.Call(goebpf.HelperFibLookup),
+		goebpf.Exit(),
+		goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpAborted)).WithLabel("aborted"),
+		goebpf.Exit(),
+	)
+
+	prog, err := goebpf.NewProgram("fib_lookup", goebpf.ProgramTypeXdp, "GPL", insns)
+	if err != nil {
+		return nil, err
+	}
+	return prog, prog.Load()
+}
+
+func TestFibLookup(t *testing.T) {
+	prog, err := newFibLookupProgram()
+	require.NoError(t, err)
+	defer prog.Close()
+
+	topo, err := goebpf_testnet.NewTopology()
+	require.NoError(t, err)
+	defer topo.Close()
+
+	require.NoError(t, topo.AddVethPair("in0", "10.0.0.1/24", "in1"))
+	require.NoError(t, topo.AddVethPair("out0", "10.1.0.1/24", "out1"))
+	require.NoError(t, topo.AddRoute("192.168.0.0/16", "10.1.0.2"))
+	require.NoError(t, topo.AddRoute("172.16.0.0/12", "10.1.0.3"))
+	require.NoError(t, topo.AddNeighbor("10.1.0.2", "out0"))
+	in0, err := topo.Interface("in0")
+	require.NoError(t, err)
+
+	run := func(dst net.IP) int {
+		pkt := &goebpf_testnet.IPv4Packet{
+			SrcMac:   net.HardwareAddr{2, 0, 0, 0, 0, 1},
+			DstMac:   in0.HardwareAddr,
+			Src:      net.IPv4(10, 0, 0, 2),
+			Dst:      dst,
+			TTL:      64,
+			Protocol: 17,
+			Payload:  make([]byte, 8),
+		}
+		res, err := topo.TestRun(prog, goebpf.TestRunParams{
+			Data:           pkt.Bytes(),
+			IngressIfindex: in0.Index,
+		})
+		require.NoError(t, err)
+		return res.ReturnValue
+	}
+
+	// Route with resolved next hop
+	assert.Equal(t, fibLookupSuccess, run(net.IPv4(192, 168, 1, 1)))
+	// Route without neighbor
+	assert.Equal(t, fibLookupNoNeigh, run(net.IPv4(172, 16, 1, 1)))
+	// No route at all
+	assert.Equal(t, fibLookupNotFwded, run(net.IPv4(8, 8, 8, 8)))
+
+	// Routes of topology are not visible outside of it
+	res, err := goebpf.ProgramTestRun(prog, goebpf.TestRunParams{Data: make([]byte, 64)})
+	require.NoError(t, err)
+	assert.NotEqual(t, fibLookupSuccess, res.ReturnValue)
+}
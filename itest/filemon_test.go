@@ -0,0 +1,98 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf/goebpf_filemon"
+)
+
+func TestFileMonitor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filemon")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	audited := filepath.Join(dir, "a", "b", "audited")
+	protected := filepath.Join(dir, "protected", "secret")
+	require.NoError(t, os.MkdirAll(filepath.Dir(audited), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Dir(protected), 0755))
+	require.NoError(t, ioutil.WriteFile(audited, []byte("1"), 0644))
+	require.NoError(t, ioutil.WriteFile(protected, []byte("2"), 0644))
+
+	m, err := goebpf_filemon.New(1 << 20)
+	require.NoError(t, err)
+	defer m.Close()
+	require.NoError(t, m.Watch(dir, goebpf_filemon.ActionAudit))
+	require.NoError(t, m.Watch(filepath.Dir(protected), goebpf_filemon.ActionDeny))
+	assert.Equal(t, map[string]goebpf_filemon.Action{
+		dir:                     goebpf_filemon.ActionAudit,
+		filepath.Dir(protected): goebpf_filemon.ActionDeny,
+	}, m.Watches())
+	require.NoError(t, m.Attach())
+
+	// Other processes of system may access watched files as well
+	events := make(chan *goebpf_filemon.Event, 16)
+	go func() {
+		for {
+			e, err := m.Read()
+			if err != nil {
+				close(events)
+				return
+			}
+			if e.Pid == os.Getpid() {
+				events <- e
+			}
+		}
+	}()
+	nextEvent := func() *goebpf_filemon.Event {
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("No event received")
+		}
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(audited)
+	require.NoError(t, err)
+	assert.Equal(t, "1", string(data))
+	e := nextEvent()
+	assert.Equal(t, goebpf_filemon.OpOpen, e.Op)
+	assert.Equal(t, audited, e.Path)
+	assert.Equal(t, dir, e.Watch)
+	assert.False(t, e.Denied)
+	assert.Equal(t, os.O_RDONLY, e.Flags&(os.O_RDONLY|os.O_WRONLY|os.O_RDWR))
+
+	// Nearest watched directory decides
+	_, err = ioutil.ReadFile(protected)
+	assert.True(t, os.IsPermission(err))
+	e = nextEvent()
+	assert.Equal(t, protected, e.Path)
+	assert.Equal(t, filepath.Dir(protected), e.Watch)
+	assert.True(t, e.Denied)
+	assert.True(t, os.IsPermission(os.Remove(protected)))
+	e = nextEvent()
+	assert.Equal(t, goebpf_filemon.OpUnlink, e.Op)
+	assert.Equal(t, protected, e.Path)
+	assert.True(t, e.Denied)
+
+	require.NoError(t, m.Unwatch(filepath.Dir(protected)))
+	require.NoError(t, os.Remove(protected))
+	e = nextEvent()
+	assert.Equal(t, goebpf_filemon.OpUnlink, e.Op)
+	assert.Equal(t, protected, e.Path)
+	assert.Equal(t, dir, e.Watch)
+	assert.False(t, e.Denied)
+
+	assert.Error(t, m.Unwatch(filepath.Dir(protected)))
+	assert.Equal(t, uint64(0), m.Malformed())
+}
@@ -0,0 +1,105 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_sklb"
+)
+
+func TestLinkInfo(t *testing.T) {
+	lb, err := goebpf_sklb.New(4, 4)
+	require.NoError(t, err)
+	defer lb.Close()
+	require.NoError(t, lb.Attach(""))
+
+	// Find netns link of sk_lookup program
+	var found *goebpf.LinkInfo
+	id, err := goebpf.GetNextLinkId(0)
+	for ; err == nil; id, err = goebpf.GetNextLinkId(id) {
+		info, err := goebpf.GetLinkInfoById(id)
+		require.NoError(t, err)
+		if info.Type != goebpf.LinkTypeNetns {
+			continue
+		}
+		prog, err := goebpf.GetProgramInfoById(info.ProgramId)
+		require.NoError(t, err)
+		if prog.Type == goebpf.ProgramTypeSkLookup {
+			found = info
+		}
+	}
+	require.Equal(t, goebpf.ErrNoMoreIds, err)
+	require.NotNil(t, found)
+	assert.NotZero(t, found.NetnsIno)
+	assert.Contains(t, found.Target(), "netns ")
+}
+
+func TestBtfInfo(t *testing.T) {
+	var vmlinux *goebpf.BtfInfo
+	id, err := goebpf.GetNextBtfId(0)
+	for ; err == nil; id, err = goebpf.GetNextBtfId(id) {
+		info, err := goebpf.GetBtfInfoById(id)
+		require.NoError(t, err)
+		assert.Equal(t, id, info.Id)
+		if info.Name == "vmlinux" {
+			vmlinux = info
+		}
+	}
+	require.Equal(t, goebpf.ErrNoMoreIds, err)
+	require.NotNil(t, vmlinux)
+	assert.True(t, vmlinux.Kernel)
+	assert.True(t, vmlinux.Size > 1024)
+}
+
+func TestAdoptLink(t *testing.T) {
+	lb, err := goebpf_sklb.New(4, 4)
+	require.NoError(t, err)
+	defer lb.Close()
+	require.NoError(t, lb.Attach(""))
+
+	links, err := goebpf.ListLinks(goebpf.LinkFilter{Type: goebpf.LinkTypeNetns})
+	require.NoError(t, err)
+	require.NotEmpty(t, links)
+	info := links[len(links)-1]
+	assert.Zero(t, info.Fd)
+	other, err := goebpf.ListLinks(goebpf.LinkFilter{Type: goebpf.LinkTypeNetns, ProgramId: info.ProgramId + 1000000})
+	require.NoError(t, err)
+	assert.Empty(t, other)
+
+	// Detach as if link was left by previous instance
+	link, err := goebpf.OpenLink(info.Id)
+	require.NoError(t, err)
+	defer link.Close()
+	assert.Equal(t, info.Id, link.Info().Id)
+	assert.Equal(t, info.ProgramId, link.Info().ProgramId)
+	require.NoError(t, link.Detach())
+
+	detached, err := goebpf.GetLinkInfoByFd(link.GetFd())
+	require.NoError(t, err)
+	assert.Zero(t, detached.NetnsIno)
+
+	_, err = goebpf.OpenLink(1 << 30)
+	assert.Error(t, err)
+}
+
+func TestProgramInfoLongName(t *testing.T) {
+	prog, err := goebpf.NewProgram("xdp_program_with_long_name", goebpf.ProgramTypeXdp, "GPL", goebpf.Instructions{
+		goebpf.Mov64Imm(goebpf.R0, 2),
+		goebpf.Exit(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, prog.Load())
+	defer prog.Close()
+
+	info, err := goebpf.GetProgramInfoByFd(prog.GetFd())
+	require.NoError(t, err)
+	assert.Equal(t, "xdp_program_with_long_name", info.Name)
+	assert.Equal(t, goebpf.KernelObjectName(info.Name), info.KernelName)
+	assert.Len(t, info.KernelName, 15)
+}
@@ -0,0 +1,121 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_linkwatch"
+	"github.com/dropbox/goebpf/goebpf_testnet"
+)
+
+func nextLinkEvent(t *testing.T, w *goebpf_linkwatch.Watcher) goebpf_linkwatch.Event {
+	select {
+	case event, ok := <-w.Events():
+		require.True(t, ok, "watcher stopped: %v", w.Err())
+		return event
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no link event")
+	}
+	return goebpf_linkwatch.Event{}
+}
+
+func TestLinkWatch(t *testing.T) {
+	topo, err := goebpf_testnet.NewTopology()
+	require.NoError(t, err)
+	defer topo.Close()
+
+	prog, err := newMacSwapProgram()
+	require.NoError(t, err)
+	defer prog.Close()
+	info, err := goebpf.GetProgramInfoByFd(prog.GetFd())
+	require.NoError(t, err)
+
+	attachedId := func(ifname string) int {
+		var id int
+		err := topo.Do(func() error {
+			link, err := netlink.LinkByName(ifname)
+			if err != nil {
+				return err
+			}
+			if link.Attrs().Xdp != nil {
+				id = int(link.Attrs().Xdp.ProgId)
+			}
+			return nil
+		})
+		require.NoError(t, err)
+		return id
+	}
+	addLink := func(ifname, peer string) {
+		require.NoError(t, topo.AddVethPair(ifname, "", peer))
+	}
+
+	// Existing interface
+	addLink("lw0", "peer0")
+	var w *goebpf_linkwatch.Watcher
+	err = topo.Do(func() error {
+		var err error
+		w, err = goebpf_linkwatch.Watch(goebpf_linkwatch.Attachment{
+			Interface: "lw*",
+			Program:   prog,
+			XdpMode:   goebpf.XdpAttachModeSkb,
+		})
+		return err
+	})
+	require.NoError(t, err)
+	defer w.Stop()
+
+	event := nextLinkEvent(t, w)
+	assert.Equal(t, "lw0", event.Ifname)
+	assert.NoError(t, event.Err)
+	assert.Equal(t, info.Id, attachedId("lw0"))
+
+	// New and re-created interfaces
+	addLink("lw1", "peer1")
+	event = nextLinkEvent(t, w)
+	assert.Equal(t, "lw1", event.Ifname)
+	assert.NoError(t, event.Err)
+	assert.Equal(t, info.Id, attachedId("lw1"))
+
+	require.NoError(t, topo.Do(func() error {
+		link, err := netlink.LinkByName("lw1")
+		if err != nil {
+			return err
+		}
+		return netlink.LinkDel(link)
+	}))
+	addLink("lw1", "peer1")
+	event = nextLinkEvent(t, w)
+	assert.Equal(t, "lw1", event.Ifname)
+	assert.NoError(t, event.Err)
+	assert.Equal(t, info.Id, attachedId("lw1"))
+
+	// Interface renamed to matching name
+	addLink("other0", "peer2")
+	require.NoError(t, topo.Do(func() error {
+		link, err := netlink.LinkByName("other0")
+		if err != nil {
+			return err
+		}
+		if err = netlink.LinkSetDown(link); err != nil {
+			return err
+		}
+		return netlink.LinkSetName(link, "lw2")
+	}))
+	event = nextLinkEvent(t, w)
+	assert.Equal(t, "lw2", event.Ifname)
+	assert.NoError(t, event.Err)
+	assert.Equal(t, info.Id, attachedId("lw2"))
+
+	w.Stop()
+	for range w.Events() {
+	}
+	assert.NoError(t, w.Err())
+}
@@ -0,0 +1,116 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"testing"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Benchmarks of hot map paths, run as root:
+//	./itest_test -test.run=^$ -test.bench=. -test.benchmem
+
+func newBenchMap(b *testing.B, mapType goebpf.MapType) *goebpf.EbpfMap {
+	m := &goebpf.EbpfMap{
+		Type:       mapType,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 16,
+	}
+	if err := m.Create(); err != nil {
+		b.Skipf("Unable to create map: %v", err)
+	}
+	if err := m.Upsert(uint32(1), uint64(100)); err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	return m
+}
+
+func BenchmarkMapLookup(b *testing.B) {
+	m := newBenchMap(b, goebpf.MapTypeArray)
+	defer m.Close()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := m.Lookup(uint32(1)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMapLookupInto(b *testing.B) {
+	m := newBenchMap(b, goebpf.MapTypeArray)
+	defer m.Close()
+
+	key := make([]byte, 4)
+	goebpf.HostByteOrder().PutUint32(key, 1)
+	val := make([]byte, 8)
+	for i := 0; i < b.N; i++ {
+		if err := m.LookupInto(key, val); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMapLookupUint64(b *testing.B) {
+	m := newBenchMap(b, goebpf.MapTypeArray)
+	defer m.Close()
+
+	key := make([]byte, 4)
+	goebpf.HostByteOrder().PutUint32(key, 1)
+	for i := 0; i < b.N; i++ {
+		if _, err := m.LookupUint64(key); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMapLookupPerCPU(b *testing.B) {
+	m := newBenchMap(b, goebpf.MapTypePerCPUArray)
+	defer m.Close()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := m.LookupUint64(uint32(1)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMapUpsert(b *testing.B) {
+	m := newBenchMap(b, goebpf.MapTypeHash)
+	defer m.Close()
+
+	for i := 0; i < b.N; i++ {
+		if err := m.Upsert(uint32(i&15), uint64(i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkReadPerCPUCounters(b *testing.B) {
+	m := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypePerCPUArray,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 4096,
+	}
+	if err := m.Create(); err != nil {
+		b.Skipf("Unable to create map: %v", err)
+	}
+	defer m.Close()
+	r, err := goebpf.NewPerCPUCounterReader(m)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		if _, err := r.Read(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -4,11 +4,21 @@
 package itest
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/dropbox/goebpf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
+	"golang.org/x/sys/unix"
 )
 
 type mapTestSuite struct {
@@ -277,13 +287,13 @@ func (ts *mapTestSuite) TestMapLPMTrieIPv6() {
 
 func (ts *mapTestSuite) TestArrayOfMaps() {
 	// Inner map template
-	templ := goebpf.EbpfMap{
+	templ := &goebpf.EbpfMap{
 		Type:       goebpf.MapTypeArray,
 		KeySize:    4,
 		ValueSize:  4,
 		MaxEntries: 10,
 	}
-	m := templ
+	m := templ.CloneTemplate()
 	err := m.Create()
 	ts.NoError(err)
 
@@ -298,7 +308,7 @@ func (ts *mapTestSuite) TestArrayOfMaps() {
 
 	// Create few inner maps - and insert them into array of maps (m)
 	for i := 0; i < 5; i++ {
-		m1 := templ
+		m1 := templ.CloneTemplate()
 		err = m1.Create()
 		ts.NoError(err)
 		// Insert it into outer map (main map)
@@ -307,6 +317,72 @@ func (ts *mapTestSuite) TestArrayOfMaps() {
 	}
 }
 
+func (ts *mapTestSuite) TestInnerMapSet() {
+	template := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypeHash,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 16,
+	}
+	placeholder := template.CloneTemplate()
+	ts.Require().NoError(placeholder.Create())
+	defer placeholder.Close()
+	outer := &goebpf.EbpfMap{
+		Name:       "tenants",
+		Type:       goebpf.MapTypeHashOfMaps,
+		KeySize:    4,
+		MaxEntries: 16,
+		InnerMapFd: placeholder.GetFd(),
+	}
+	ts.Require().NoError(outer.Create())
+	defer outer.Close()
+	ts.Require().NoError(outer.SetInnerTemplate(template))
+
+	pinDir := bpfPath + "/test_tenants"
+	defer os.RemoveAll(pinDir)
+	set, err := goebpf.NewInnerMapSet(outer, pinDir)
+	ts.Require().NoError(err)
+	for i, name := range []string{"tenant_1", "tenant_2"} {
+		m, err := set.CreateInner(name, uint32(i+1))
+		ts.Require().NoError(err)
+		ts.Equal(name, m.Name)
+		ts.FileExists(pinDir + "/" + name)
+		ts.NoError(m.Upsert(uint32(1), uint64(i+1)))
+
+		// Outer map element is id of inner map
+		id, err := outer.LookupUint32(uint32(i + 1))
+		ts.Require().NoError(err)
+		inner, err := goebpf.NewMapFromExistingMapById(int(id))
+		ts.Require().NoError(err)
+		value, err := inner.LookupUint64(uint32(1))
+		ts.NoError(err)
+		ts.Equal(uint64(i+1), value)
+		inner.Close()
+	}
+	ts.Equal([]string{"tenant_1", "tenant_2"}, set.Names())
+	_, err = set.CreateInner("tenant_1", uint32(3))
+	ts.Error(err)
+
+	// Pinned inner maps survive restart
+	ts.NoError(set.Close())
+	ts.Nil(set.Get("tenant_1"))
+	set, err = goebpf.NewInnerMapSet(outer, pinDir)
+	ts.Require().NoError(err)
+	m, err := set.CreateInner("tenant_1", uint32(1))
+	ts.Require().NoError(err)
+	value, err := m.LookupUint64(uint32(1))
+	ts.NoError(err)
+	ts.Equal(uint64(1), value)
+	ts.Equal(m, set.Get("tenant_1"))
+
+	ts.NoError(set.DeleteInner("tenant_1"))
+	ts.NoFileExists(pinDir + "/tenant_1")
+	_, err = outer.Lookup(uint32(1))
+	ts.True(errors.Is(err, goebpf.ErrKeyNotExist))
+	ts.Nil(set.Get("tenant_1"))
+	ts.NoError(set.Close())
+}
+
 func (ts *mapTestSuite) TestHashOfMaps() {
 	// Inner map template
 	templ := &goebpf.EbpfMap{
@@ -400,16 +476,98 @@ func (ts *mapTestSuite) TestMapPersistent() {
 	ts.NoError(err)
 }
 
-// Double close negative test
+// Access to pinned map restricted by kernel
+func (ts *mapTestSuite) TestOpenPinnedMap() {
+	path := bpfPath + "/test_access"
+	m := &goebpf.EbpfMap{
+		Type:           goebpf.MapTypeHash,
+		KeySize:        4,
+		ValueSize:      4,
+		MaxEntries:     4,
+		PersistentPath: path,
+	}
+	ts.Require().NoError(m.Create())
+	defer os.Remove(path)
+	defer m.Close()
+	ts.NoError(m.Upsert(1, 10))
+
+	ro, err := goebpf.OpenPinnedMap(path, goebpf.MapAccessReadOnly)
+	ts.Require().NoError(err)
+	defer ro.Close()
+	ts.Equal(m.Type, ro.Type)
+	value, err := ro.LookupInt(1)
+	ts.NoError(err)
+	ts.Equal(10, value)
+	ts.True(errors.Is(ro.Upsert(2, 20), goebpf.ErrPermission))
+	ts.True(errors.Is(ro.Delete(1), goebpf.ErrPermission))
+
+	wo, err := goebpf.OpenPinnedMap(path, goebpf.MapAccessWriteOnly)
+	ts.Require().NoError(err)
+	defer wo.Close()
+	ts.NoError(wo.Upsert(2, 20))
+	_, err = wo.LookupInt(2)
+	ts.True(errors.Is(err, goebpf.ErrPermission))
+	value, err = m.LookupInt(2)
+	ts.NoError(err)
+	ts.Equal(20, value)
+
+	_, err = goebpf.OpenPinnedMap(path, goebpf.MapAccess(42))
+	ts.Error(err)
+	_, err = goebpf.OpenPinnedMap(bpfPath+"/test_access_missing", goebpf.MapAccessReadOnly)
+	ts.Error(err)
+}
+
+// Pin policies for already pinned maps
+func (ts *mapTestSuite) TestMapPinPolicy() {
+	path := bpfPath + "/test_policy"
+	m1 := &goebpf.EbpfMap{
+		Type:           goebpf.MapTypeArray,
+		ValueSize:      4,
+		MaxEntries:     5,
+		PersistentPath: path,
+	}
+	err := m1.Create()
+	ts.Require().NoError(err)
+	defer os.Remove(path)
+	defer m1.Close()
+	err = m1.Update(1, 42)
+	ts.NoError(err)
+
+	// Reuse: incompatible definition
+	m2 := m1.CloneTemplate().(*goebpf.EbpfMap)
+	m2.MaxEntries = 10
+	err = m2.Create()
+	ts.Error(err)
+	ts.Equal(0, m2.GetFd())
+
+	// Exclusive: anything pinned is an error
+	m3 := m1.CloneTemplate().(*goebpf.EbpfMap)
+	m3.PinPolicy = goebpf.MapPinExclusive
+	err = m3.Create()
+	ts.Error(err)
+
+	// Replace: new, empty map pinned instead of old one
+	m4 := m1.CloneTemplate().(*goebpf.EbpfMap)
+	m4.PinPolicy = goebpf.MapPinReplace
+	err = m4.Create()
+	ts.Require().NoError(err)
+	defer m4.Close()
+	val, err := m4.LookupInt(1)
+	ts.NoError(err)
+	ts.Equal(0, val)
+	ts.FileExists(path)
+}
+
+// Close must be idempotent
 func (ts *mapTestSuite) TestMapDoubleClose() {
 	m := &goebpf.EbpfMap{
 		Type:       goebpf.MapTypeArray,
 		ValueSize:  4,
 		MaxEntries: 4,
 	}
-	// Try to close non-created map
+	// Close non-created map
 	err := m.Close()
-	ts.Error(err)
+	ts.NoError(err)
 
 	err = m.Create()
 	ts.NoError(err)
@@ -418,7 +576,8 @@ func (ts *mapTestSuite) TestMapDoubleClose() {
 	err = m.Close()
 	ts.NoError(err)
 	err = m.Close()
-	ts.Error(err)
+	ts.NoError(err)
+	ts.Equal(0, m.GetFd())
 }
 
 func (ts *mapTestSuite) TestMapFromExistingByFd() {
@@ -443,7 +602,744 @@ func (ts *mapTestSuite) TestMapFromExistingByFd() {
 	ts.Equal(m1, m2)
 }
 
+// Names longer than kernel allows are truncated, full name is kept
+func (ts *mapTestSuite) TestMapLongName() {
+	m := &goebpf.EbpfMap{
+		Name:       "map_with_very_long_name",
+		Type:       goebpf.MapTypeArray,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1,
+	}
+	ts.Require().NoError(m.Create())
+	defer m.Close()
+	ts.Equal(goebpf.KernelObjectName(m.Name), m.KernelName())
+	ts.Len(m.KernelName(), 15)
+
+	m2, err := goebpf.NewMapFromExistingMapByFd(m.GetFd())
+	ts.Require().NoError(err)
+	ts.Equal(m.Name, m2.Name)
+	ts.Equal(m.KernelName(), m2.KernelName())
+}
+
+func (ts *mapTestSuite) TestMapLookupInto() {
+	m := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypeHash,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 10,
+	}
+	err := m.Create()
+	ts.Require().NoError(err)
+	defer m.Close()
+
+	ts.NoError(m.Insert(uint32(1), uint64(12345)))
+
+	key := make([]byte, 4)
+	goebpf.HostByteOrder().PutUint32(key, 1)
+	val := make([]byte, 8)
+	ts.NoError(m.LookupInto(key, val))
+	ts.Equal(uint64(12345), goebpf.HostByteOrder().Uint64(val))
+
+	// Raw key path of LookupUint64
+	res, err := m.LookupUint64(key)
+	ts.NoError(err)
+	ts.Equal(uint64(12345), res)
+
+	// Non existing key
+	goebpf.HostByteOrder().PutUint32(key, 2)
+	ts.Error(m.LookupInto(key, val))
+}
+
+func (ts *mapTestSuite) TestMapLookupIntoPerCPU() {
+	m := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypePerCPUArray,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1,
+	}
+	ts.Require().NoError(m.Create())
+	defer m.Close()
+	numCpus, err := goebpf.GetNumOfPossibleCpus()
+	ts.Require().NoError(err)
+
+	// Kernel aligns value of every CPU to 8 bytes
+	key := make([]byte, 4)
+	err = m.LookupInto(key, make([]byte, 4*numCpus))
+	ts.True(errors.Is(err, goebpf.ErrInvalidSize))
+	ts.NoError(m.LookupInto(key, make([]byte, 8*numCpus)))
+
+	val, err := m.Lookup(uint32(0))
+	ts.NoError(err)
+	ts.Len(val, 8*numCpus)
+	sum, err := m.LookupUint64(uint32(0))
+	ts.NoError(err)
+	ts.Zero(sum)
+}
+
+func (ts *mapTestSuite) TestMapUpsertPerCPU() {
+	m := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypePerCPUArray,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1,
+	}
+	ts.Require().NoError(m.Create())
+	defer m.Close()
+	numCpus, err := goebpf.GetNumOfPossibleCpus()
+	ts.Require().NoError(err)
+
+	// Value of single CPU would make kernel read beyond buffer
+	err = m.Upsert(uint32(0), uint32(1))
+	ts.True(errors.Is(err, goebpf.ErrInvalidSize))
+
+	value := make([]byte, 8*numCpus)
+	for cpu := 0; cpu < numCpus; cpu++ {
+		value[cpu*8] = 1
+	}
+	ts.NoError(m.Upsert(uint32(0), value))
+	sum, err := m.LookupUint64(uint32(0))
+	ts.NoError(err)
+	ts.Equal(uint64(numCpus), sum)
+}
+
+func (ts *mapTestSuite) TestMapDumpPerCPU() {
+	m := &goebpf.EbpfMap{
+		Name:       "dump_percpu",
+		Type:       goebpf.MapTypePerCPUArray,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1,
+	}
+	ts.Require().NoError(m.Create())
+	defer m.Close()
+	numCpus, err := goebpf.GetNumOfPossibleCpus()
+	ts.Require().NoError(err)
+
+	var buf bytes.Buffer
+	ts.Require().NoError(m.Dump(&buf, goebpf.DumpFormatJSON))
+	var dump struct {
+		ValueSize int `json:"value_size"`
+		Entries   []struct {
+			Value string `json:"value"`
+		} `json:"entries"`
+	}
+	ts.Require().NoError(json.Unmarshal(buf.Bytes(), &dump))
+	// Value of every CPU is aligned to 8 bytes
+	ts.Equal(8*numCpus, dump.ValueSize)
+	ts.Require().Len(dump.Entries, 1)
+	ts.Len(dump.Entries[0].Value, 2*8*numCpus)
+}
+
+func (ts *mapTestSuite) TestReadPerCPUCounters() {
+	// Array: all elements exist, zeroed
+	m := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypePerCPUArray,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 4,
+	}
+	ts.Require().NoError(m.Create())
+	defer m.Close()
+
+	r, err := goebpf.NewPerCPUCounterReader(m)
+	ts.Require().NoError(err)
+	// Buffers are re-used, results must be the same
+	for i := 0; i < 2; i++ {
+		counters, err := r.Read()
+		ts.Require().NoError(err)
+		ts.Equal(4, len(counters))
+		for idx, c := range counters {
+			ts.Equal(uint32(idx), goebpf.HostByteOrder().Uint32(c.Key))
+			ts.Equal(uint64(0), c.Value)
+		}
+	}
+
+	// Empty hash
+	h := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypePerCPUHash,
+		KeySize:    8,
+		ValueSize:  8,
+		MaxEntries: 16,
+	}
+	ts.Require().NoError(h.Create())
+	defer h.Close()
+
+	counters, err := goebpf.ReadPerCPUCounters(h)
+	ts.NoError(err)
+	ts.Equal(0, len(counters))
+}
+
+func (ts *mapTestSuite) TestMapDeleteBatch() {
+	for _, mapType := range []goebpf.MapType{goebpf.MapTypeHash, goebpf.MapTypeLRUHash} {
+		m := &goebpf.EbpfMap{
+			Type:       mapType,
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 16,
+		}
+		ts.Require().NoError(m.Create())
+		defer m.Close()
+
+		var keys [][]byte
+		for i := 0; i < 10; i++ {
+			ts.Require().NoError(m.Insert(uint32(i), uint32(i)))
+			key := make([]byte, 4)
+			goebpf.HostByteOrder().PutUint32(key, uint32(i))
+			keys = append(keys, key)
+		}
+		ts.NoError(m.Delete(uint32(3)))
+
+		// Missing key is skipped
+		deleted, err := m.DeleteBatch(keys[:6])
+		ts.NoError(err)
+		ts.Equal(5, deleted)
+		_, err = m.GetNextKey(nil)
+		ts.NoError(err)
+		deleted, err = m.DeleteBatch(keys)
+		ts.NoError(err)
+		ts.Equal(4, deleted)
+		_, err = m.GetNextKey(nil)
+		ts.Equal(goebpf.ErrNoMoreKeys, err)
+
+		_, err = m.DeleteBatch([][]byte{{1}})
+		ts.Error(err)
+	}
+}
+
+func (ts *mapTestSuite) TestSweepExpired() {
+	m := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypeHash,
+		KeySize:    4,
+		ValueSize:  16,
+		MaxEntries: 2048,
+	}
+	ts.Require().NoError(m.Create())
+	defer m.Close()
+
+	// Timestamp of last use at offset 8, odd entries are used recently,
+	// even ones right after boot
+	var now unix.Timespec
+	ts.Require().NoError(unix.ClockGettime(unix.CLOCK_MONOTONIC, &now))
+	for i := 0; i < 2000; i++ {
+		value := make([]byte, 16)
+		last := uint64(1)
+		if i%2 == 1 {
+			last = uint64(now.Nano())
+		}
+		goebpf.HostByteOrder().PutUint64(value[8:], last)
+		ts.Require().NoError(m.Insert(uint32(i), value))
+	}
+
+	e := goebpf.MapExpiry{TimestampOffset: 8, TTL: time.Second}
+	removed, err := goebpf.SweepExpired(m, e)
+	ts.NoError(err)
+	ts.Equal(1000, removed)
+	_, err = m.Lookup(uint32(2))
+	ts.Error(err)
+	_, err = m.Lookup(uint32(3))
+	ts.NoError(err)
+
+	// Background sweeper: the rest expires with short TTL
+	e.TTL = time.Nanosecond
+	e.Interval = 10 * time.Millisecond
+	s, err := m.Expire(e)
+	ts.Require().NoError(err)
+	for i := 0; i < 100 && s.Removed() < 1000; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	s.Stop()
+	<-s.Done()
+	ts.NoError(s.Err())
+	ts.Equal(uint64(1000), s.Removed())
+	_, err = m.GetNextKey(nil)
+	ts.Equal(goebpf.ErrNoMoreKeys, err)
+
+	// Array entries can't be removed
+	a := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypeArray,
+		KeySize:    4,
+		ValueSize:  16,
+		MaxEntries: 1,
+	}
+	_, err = goebpf.SweepExpired(a, e)
+	ts.Error(err)
+}
+
+func (ts *mapTestSuite) TestMapContext() {
+	for _, mapType := range []goebpf.MapType{goebpf.MapTypeHash, goebpf.MapTypeLRUHash} {
+		m := &goebpf.EbpfMap{
+			Type:       mapType,
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 4096,
+		}
+		ts.Require().NoError(m.Create())
+		defer m.Close()
+
+		var keys [][]byte
+		for i := 0; i < 3000; i++ {
+			ts.Require().NoError(m.Insert(uint32(i), uint32(i)))
+			key := make([]byte, 4)
+			goebpf.HostByteOrder().PutUint32(key, uint32(i))
+			keys = append(keys, key)
+		}
+
+		count := 0
+		err := goebpf.ForEachMapEntry(context.Background(), m, func(key, value []byte) error {
+			ts.Equal(key, value)
+			count++
+			return nil
+		})
+		ts.NoError(err)
+		ts.Equal(3000, count)
+
+		// Cancelled walk stops at batch boundary at most
+		ctx, cancel := context.WithCancel(context.Background())
+		count = 0
+		err = goebpf.ForEachMapEntry(ctx, m, func(key, value []byte) error {
+			count++
+			cancel()
+			return nil
+		})
+		ts.Equal(context.Canceled, err)
+		ts.True(count < 3000)
+
+		// Nothing is deleted after deadline
+		ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+		defer cancel()
+		deleted, err := m.DeleteBatchContext(ctx, keys)
+		ts.True(errors.Is(err, context.DeadlineExceeded))
+		ts.Equal(0, deleted)
+		deleted, err = m.DeleteBatchContext(context.Background(), keys)
+		ts.NoError(err)
+		ts.Equal(3000, deleted)
+	}
+
+	// Per-CPU maps are walked element by element, values of all CPUs
+	numCpus, err := goebpf.GetNumOfPossibleCpus()
+	ts.Require().NoError(err)
+	a := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypePerCPUArray,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 4,
+	}
+	ts.Require().NoError(a.Create())
+	defer a.Close()
+	count := 0
+	err = goebpf.ForEachMapEntry(context.Background(), a, func(key, value []byte) error {
+		ts.Len(value, 8*numCpus)
+		count++
+		return nil
+	})
+	ts.NoError(err)
+	ts.Equal(4, count)
+
+	// Per-CPU counters
+	p := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypePerCPUArray,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 4,
+	}
+	ts.Require().NoError(p.Create())
+	defer p.Close()
+	r, err := goebpf.NewPerCPUCounterReader(p)
+	ts.Require().NoError(err)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = r.ReadContext(ctx)
+	ts.Equal(context.Canceled, err)
+	counters, err := r.ReadContext(context.Background())
+	ts.NoError(err)
+	ts.Equal(4, len(counters))
+}
+
+func (ts *mapTestSuite) TestMapTypedValues() {
+	m := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypeHash,
+		KeySize:    2,
+		ValueSize:  4,
+		MaxEntries: 4,
+	}
+	ts.Require().NoError(m.Create())
+	defer m.Close()
+
+	// Port in network byte order, address value
+	ts.Require().NoError(m.Insert(goebpf.PortKey(80), goebpf.MustIPv4Key("10.0.0.1")))
+	ts.Require().NoError(m.Insert(goebpf.PortKey(443), goebpf.Be32(0x0a000002)))
+	raw, err := m.GetNextKey(nil)
+	ts.Require().NoError(err)
+	var port goebpf.PortKey
+	ts.NoError(port.UnmarshalBinary(raw))
+	ts.Contains([]goebpf.PortKey{80, 443}, port)
+
+	var ip goebpf.IPv4Key
+	ts.NoError(m.LookupValue(goebpf.PortKey(80), &ip))
+	ts.Equal("10.0.0.1", ip.String())
+	var v goebpf.Be32
+	ts.NoError(m.LookupValue(goebpf.PortKey(443), &v))
+	ts.Equal(goebpf.Be32(0x0a000002), v)
+	val, err := m.LookupUint32(goebpf.PortKey(443))
+	ts.NoError(err)
+	// Same bytes read as host order integer
+	ts.Equal(goebpf.HostByteOrder().Uint32([]byte{10, 0, 0, 2}), val)
+	var v16 goebpf.Be16
+	ts.Error(m.LookupValue(goebpf.PortKey(443), &v16))
+	ts.Error(m.LookupValue(goebpf.PortKey(22), &v))
+}
+
+func (ts *mapTestSuite) TestMapStats() {
+	for _, mapType := range []goebpf.MapType{goebpf.MapTypeHash, goebpf.MapTypeLPMTrie} {
+		m := &goebpf.EbpfMap{
+			Type:       mapType,
+			KeySize:    8,
+			ValueSize:  4,
+			MaxEntries: 100,
+			Flags:      1, // BPF_F_NO_PREALLOC
+		}
+		if mapType == goebpf.MapTypeHash {
+			m.Flags = 0
+		}
+		ts.Require().NoError(m.Create())
+		defer m.Close()
+
+		for i := 0; i < 95; i++ {
+			ts.Require().NoError(m.Insert(goebpf.CreateLPMtrieKey(fmt.Sprintf("10.0.%d.0/24", i)), uint32(i)))
+		}
+		ts.Require().NoError(m.Upsert(goebpf.CreateLPMtrieKey("10.0.0.0/24"), uint32(1)))
+		ts.Require().NoError(m.Delete(goebpf.CreateLPMtrieKey("10.0.1.0/24")))
+
+		stats, err := m.Stats(context.Background())
+		ts.Require().NoError(err)
+		ts.Equal(goebpf.MapStats{Entries: 94, MaxEntries: 100, Updates: 96, Deletes: 1}, stats)
+
+		// Early warning: map is filled above 90%
+		highFill := make(chan goebpf.MapStats, 1)
+		s := goebpf.SampleMaps(goebpf.MapSamplerParams{
+			Interval: time.Hour,
+			OnHighFill: func(hm *goebpf.EbpfMap, stats goebpf.MapStats) {
+				highFill <- stats
+			},
+		}, m)
+		ts.Equal(stats, <-highFill)
+		s.Stop()
+		<-s.Done()
+	}
+}
+
+func (ts *mapTestSuite) TestDoubleBuffer() {
+	index := &goebpf.EbpfMap{
+		Name:       "index",
+		Type:       goebpf.MapTypeArray,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1,
+	}
+	ts.Require().NoError(index.Create())
+	defer index.Close()
+	// Hash / array inner maps
+	var maps []goebpf.DoubleBufferedMap
+	for _, mapType := range []goebpf.MapType{goebpf.MapTypeHash, goebpf.MapTypeArray} {
+		inner := &goebpf.EbpfMap{
+			Type:       mapType,
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 16,
+		}
+		ts.Require().NoError(inner.Create())
+		defer inner.Close()
+		outer := &goebpf.EbpfMap{
+			Name:       "outer_" + strings.ToLower(mapType.String()),
+			Type:       goebpf.MapTypeArrayOfMaps,
+			MaxEntries: 2,
+			InnerMapFd: inner.GetFd(),
+		}
+		ts.Require().NoError(outer.Create())
+		defer outer.Close()
+		maps = append(maps, goebpf.DoubleBufferedMap{Outer: outer, Inner: inner})
+	}
+
+	db, err := goebpf.NewDoubleBuffer(index, maps...)
+	ts.Require().NoError(err)
+	defer db.Close()
+	ts.Equal(0, db.Active())
+
+	txn := db.Begin()
+	ts.NoError(txn.Upsert("outer_hash", uint32(1), uint32(10)))
+	ts.NoError(txn.Upsert("outer_hash", uint32(2), uint32(20)))
+	ts.NoError(txn.Upsert("outer_array", uint32(1), uint32(100)))
+	// Nothing applied before commit
+	_, err = db.Map("outer_hash").Lookup(uint32(1))
+	ts.Error(err)
+	ts.NoError(txn.Commit())
+	ts.Equal(1, db.Active())
+	bank, err := index.LookupInt(uint32(0))
+	ts.NoError(err)
+	ts.Equal(1, bank)
+
+	// Second transaction sees result of the first one
+	txn = db.Begin()
+	ts.NoError(txn.Delete("outer_hash", uint32(1)))
+	ts.NoError(txn.Upsert("outer_hash", uint32(3), uint32(30)))
+	ts.NoError(txn.Upsert("outer_array", uint32(2), uint32(200)))
+	ts.NoError(txn.Commit())
+	ts.Equal(0, db.Active())
+	hash, array := db.Map("outer_hash"), db.Map("outer_array")
+	_, err = hash.Lookup(uint32(1))
+	ts.Error(err)
+	for key, expected := range map[uint32]int{2: 20, 3: 30} {
+		value, err := hash.LookupInt(key)
+		ts.NoError(err)
+		ts.Equal(expected, value)
+	}
+	for key, expected := range map[uint32]int{1: 100, 2: 200} {
+		value, err := array.LookupInt(key)
+		ts.NoError(err)
+		ts.Equal(expected, value)
+	}
+
+	// Empty transaction flips banks, which are identical
+	ts.NoError(db.Begin().Commit())
+	value, err := db.Map("outer_hash").LookupInt(uint32(3))
+	ts.NoError(err)
+	ts.Equal(30, value)
+	_, err = db.Map("outer_hash").Lookup(uint32(1))
+	ts.Error(err)
+}
+
+func (ts *mapTestSuite) TestConfigFlipper() {
+	for _, mapType := range []goebpf.MapType{goebpf.MapTypeHash, goebpf.MapTypeArray} {
+		inner := &goebpf.EbpfMap{
+			Type:       mapType,
+			KeySize:    4,
+			ValueSize:  4,
+			MaxEntries: 8,
+		}
+		ts.Require().NoError(inner.Create())
+		defer inner.Close()
+		outer := &goebpf.EbpfMap{
+			Type:       goebpf.MapTypeArrayOfMaps,
+			MaxEntries: 1,
+			InnerMapFd: inner.GetFd(),
+		}
+		ts.Require().NoError(outer.Create())
+		defer outer.Close()
+
+		f, err := goebpf.NewConfigFlipper(outer, inner, uint32(0))
+		ts.Require().NoError(err)
+		defer f.Close()
+		// Slot holds ID of inner map
+		initial, err := outer.Lookup(uint32(0))
+		ts.Require().NoError(err)
+
+		ts.NoError(f.Publish([]goebpf.ConfigEntry{{Key: uint32(1), Value: uint32(10)}, {Key: uint32(2), Value: uint32(20)}}))
+		current, err := outer.Lookup(uint32(0))
+		ts.NoError(err)
+		ts.NotEqual(initial, current)
+		value, err := f.Active().LookupInt(uint32(2))
+		ts.NoError(err)
+		ts.Equal(20, value)
+
+		// Previous config is fully replaced
+		ts.NoError(f.Publish([]goebpf.ConfigEntry{{Key: uint32(3), Value: uint32(30)}}))
+		current, err = outer.Lookup(uint32(0))
+		ts.NoError(err)
+		ts.Equal(initial, current)
+		value, err = f.Active().LookupInt(uint32(3))
+		ts.NoError(err)
+		ts.Equal(30, value)
+		value, err = f.Active().LookupInt(uint32(1))
+		if mapType == goebpf.MapTypeArray {
+			ts.NoError(err)
+			ts.Equal(0, value)
+		} else {
+			ts.Error(err)
+		}
+
+		// Invalid entry doesn't change active config
+		ts.Error(f.Publish([]goebpf.ConfigEntry{{Key: uint32(4), Value: uint64(40)}}))
+		value, err = f.Active().LookupInt(uint32(3))
+		ts.NoError(err)
+		ts.Equal(30, value)
+	}
+}
+
+func (ts *mapTestSuite) TestGenerationConfig() {
+	generation := &goebpf.EbpfMap{
+		Name:       "config_gen",
+		Type:       goebpf.MapTypeArray,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 1,
+	}
+	ts.Require().NoError(generation.Create())
+	defer generation.Close()
+	rules := &goebpf.EbpfMap{
+		Name:       "rules",
+		Type:       goebpf.MapTypeHash,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 2,
+	}
+	ts.Require().NoError(rules.Create())
+	defer rules.Close()
+	routes := &goebpf.EbpfMap{
+		Name:       "routes",
+		Type:       goebpf.MapTypeArray,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 4,
+	}
+	ts.Require().NoError(routes.Create())
+	defer routes.Close()
+
+	g, err := goebpf.NewGenerationConfig(generation, rules, routes)
+	ts.Require().NoError(err)
+	ts.Equal(uint64(0), g.Generation())
+
+	txn := g.Begin()
+	ts.NoError(txn.Upsert("rules", uint32(1), uint32(10)))
+	ts.NoError(txn.Upsert("routes", uint32(1), uint32(100)))
+	// Nothing written before publish
+	_, err = rules.Lookup(uint32(1))
+	ts.Error(err)
+	ts.NoError(txn.Publish())
+	ts.Equal(uint64(2), g.Generation())
+	current, err := generation.LookupUint64(uint32(0))
+	ts.NoError(err)
+	ts.Equal(uint64(2), current)
+	value, err := rules.LookupInt(uint32(1))
+	ts.NoError(err)
+	ts.Equal(10, value)
+	value, err = routes.LookupInt(uint32(1))
+	ts.NoError(err)
+	ts.Equal(100, value)
+
+	// Failed write (hash is full) leaves generation odd
+	txn = g.Begin()
+	ts.NoError(txn.Delete("rules", uint32(5)))
+	ts.NoError(txn.Upsert("rules", uint32(2), uint32(20)))
+	ts.NoError(txn.Upsert("rules", uint32(3), uint32(30)))
+	ts.Error(txn.Publish())
+	ts.Equal(uint64(3), g.Generation())
+	current, err = generation.LookupUint64(uint32(0))
+	ts.NoError(err)
+	ts.Equal(uint64(3), current)
+
+	// Generation is resumed from map, next publish makes it even again
+	g, err = goebpf.NewGenerationConfig(generation, rules, routes)
+	ts.Require().NoError(err)
+	ts.Equal(uint64(3), g.Generation())
+	txn = g.Begin()
+	ts.NoError(txn.Delete("rules", uint32(2)))
+	ts.NoError(txn.Upsert("rules", uint32(3), uint32(30)))
+	ts.NoError(txn.Publish())
+	ts.Equal(uint64(4), g.Generation())
+	value, err = rules.LookupInt(uint32(3))
+	ts.NoError(err)
+	ts.Equal(30, value)
+}
+
 // Run suite
 func TestMapSuite(t *testing.T) {
 	suite.Run(t, new(mapTestSuite))
 }
+
+func TestMapMigration(t *testing.T) {
+	path := bpfPath + "/test_migration"
+	os.Remove(path)
+	m1 := &goebpf.EbpfMap{
+		Type:           goebpf.MapTypeHash,
+		KeySize:        4,
+		ValueSize:      8,
+		MaxEntries:     10,
+		PersistentPath: path,
+	}
+	require.NoError(t, m1.Create())
+	defer os.Remove(path)
+	defer m1.Close()
+	require.NoError(t, m1.Upsert(1, uint64(10)))
+	require.NoError(t, m1.Upsert(2, uint64(20)))
+
+	// Value grown, no way to convert entries
+	m2 := m1.CloneTemplate().(*goebpf.EbpfMap)
+	m2.ValueSize = 16
+	m2.PinPolicy = goebpf.MapPinMigrate
+	assert.Error(t, m2.Create())
+
+	// Field appended, entry 2 dropped
+	m2.Migrate = func(from *goebpf.MapMigration, key, value []byte) ([]byte, []byte, error) {
+		assert.Equal(t, 8, from.Old.ValueSize)
+		if key[0] == 2 {
+			return nil, nil, nil
+		}
+		return key, append(value, make([]byte, 8)...), nil
+	}
+	require.NoError(t, m2.Create())
+	defer m2.Close()
+	value, err := m2.Lookup(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), goebpf.HostByteOrder().Uint64(value))
+	_, err = m2.Lookup(2)
+	assert.Error(t, err)
+	// Old map is not changed
+	val, err := m1.LookupUint64(2)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(20), val)
+
+	// Migrated map is pinned, it is re-used as is
+	m3 := m2.CloneTemplate().(*goebpf.EbpfMap)
+	require.NoError(t, m3.Create())
+	defer m3.Close()
+	value, err = m3.Lookup(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), goebpf.HostByteOrder().Uint64(value))
+
+	// Sizes kept: entries are copied as is
+	m4 := m2.CloneTemplate().(*goebpf.EbpfMap)
+	m4.MaxEntries = 20
+	m4.Migrate = nil
+	require.NoError(t, m4.Create())
+	defer m4.Close()
+	value, err = m4.Lookup(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(10), goebpf.HostByteOrder().Uint64(value))
+}
+
+func TestMapMigrationPerCPU(t *testing.T) {
+	path := bpfPath + "/test_migration_percpu"
+	os.Remove(path)
+	numCpus, err := goebpf.GetNumOfPossibleCpus()
+	require.NoError(t, err)
+	m1 := &goebpf.EbpfMap{
+		Type:           goebpf.MapTypePerCPUHash,
+		KeySize:        4,
+		ValueSize:      4,
+		MaxEntries:     10,
+		PersistentPath: path,
+	}
+	require.NoError(t, m1.Create())
+	defer os.Remove(path)
+	defer m1.Close()
+	value := make([]byte, 8*numCpus)
+	for cpu := 0; cpu < numCpus; cpu++ {
+		value[cpu*8] = 1
+	}
+	require.NoError(t, m1.Upsert(1, value))
+
+	// __u32 grown to __u64: value of every CPU is aligned to 8 bytes anyway
+	m2 := m1.CloneTemplate().(*goebpf.EbpfMap)
+	m2.ValueSize = 8
+	m2.PinPolicy = goebpf.MapPinMigrate
+	m2.Migrate = func(from *goebpf.MapMigration, key, value []byte) ([]byte, []byte, error) {
+		assert.Len(t, value, 8*numCpus)
+		return key, value, nil
+	}
+	require.NoError(t, m2.Create())
+	defer m2.Close()
+	sum, err := m2.LookupUint64(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(numCpus), sum)
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_testnet"
+)
+
+// Errors of netlink requests carry message of kernel (extended ACK)
+func TestXdpAttachErrorMessage(t *testing.T) {
+	topo, err := goebpf_testnet.NewTopology()
+	require.NoError(t, err)
+	defer topo.Close()
+
+	prog, err := newMacSwapProgram()
+	require.NoError(t, err)
+	defer prog.Close()
+
+	// Loopback driver has no native XDP support
+	err = topo.Do(func() error {
+		return prog.Attach(&goebpf.XdpAttachParams{Interface: "lo", Mode: goebpf.XdpAttachModeDrv})
+	})
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "does not support XDP")
+	assert.True(t, errors.Is(err, goebpf.ErrNotSupported))
+}
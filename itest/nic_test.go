@@ -0,0 +1,41 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_testnet"
+)
+
+func TestNicChannels(t *testing.T) {
+	topo, err := goebpf_testnet.NewTopology()
+	require.NoError(t, err)
+	defer topo.Close()
+	require.NoError(t, topo.AddVethPair("nq0", "", "nq1"))
+
+	err = topo.Do(func() error {
+		// veth has single RX / TX queue by default
+		channels, err := goebpf.GetNicChannels("nq0")
+		require.NoError(t, err)
+		assert.Equal(t, 1, channels.RxQueues())
+		assert.Equal(t, 1, channels.TxQueues())
+
+		// Loopback reports no channels, veth has no RSS
+		_, err = goebpf.GetNicChannels("lo")
+		assert.True(t, errors.Is(err, goebpf.ErrNotSupported))
+		_, err = goebpf.GetNicRss("nq0")
+		assert.True(t, errors.Is(err, goebpf.ErrNotSupported))
+
+		_, err = goebpf.GetNicChannels("nonexisting0")
+		assert.Error(t, err)
+		return nil
+	})
+	require.NoError(t, err)
+}
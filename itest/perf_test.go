@@ -0,0 +1,225 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_perf"
+)
+
+// Burns CPU for d
+func spin(d time.Duration) {
+	for deadline := time.Now().Add(d); time.Now().Before(deadline); {
+	}
+}
+
+func TestPerfCounter(t *testing.T) {
+	ev, err := goebpf_perf.Open(&goebpf_perf.Attr{
+		Type:     goebpf_perf.TypeSoftware,
+		Config:   goebpf_perf.CountSwTaskClock,
+		Disabled: true,
+		Inherit:  true,
+	}, 0, -1, nil)
+	require.NoError(t, err)
+	defer ev.Close()
+
+	count, err := ev.ReadCount()
+	require.NoError(t, err)
+	assert.Zero(t, count)
+
+	require.NoError(t, ev.Enable())
+	spin(20 * time.Millisecond)
+	require.NoError(t, ev.Disable())
+	count, err = ev.ReadCount()
+	require.NoError(t, err)
+	assert.True(t, count >= uint64(10*time.Millisecond), "task clock %d", count)
+
+	require.NoError(t, ev.Reset())
+	count, err = ev.ReadCount()
+	require.NoError(t, err)
+	assert.Zero(t, count)
+}
+
+func TestPerfRing(t *testing.T) {
+	// Samples of this thread only
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	ev, err := goebpf_perf.Open(&goebpf_perf.Attr{
+		Type:         goebpf_perf.TypeSoftware,
+		Config:       goebpf_perf.CountSwTaskClock,
+		SamplePeriod: uint64(time.Millisecond),
+		SampleType:   goebpf_perf.SampleIP | goebpf_perf.SampleTID,
+	}, 0, -1, nil)
+	require.NoError(t, err)
+	defer ev.Close()
+	ring, err := ev.Mmap(8)
+	require.NoError(t, err)
+	_, err = ev.Mmap(8)
+	assert.Error(t, err)
+
+	spin(20 * time.Millisecond)
+	samples := 0
+	for _, rec := range ring.Read() {
+		if rec.Type == goebpf_perf.RecordSample {
+			// u64 ip, u32 pid, u32 tid
+			require.Len(t, rec.Data, 16)
+			samples++
+		}
+	}
+	assert.True(t, samples > 5, "%d samples", samples)
+}
+
+func TestPerfCounters(t *testing.T) {
+	m := &goebpf.EbpfMap{Name: "counters", Type: goebpf.MapTypePerfEventArray, KeySize: 4, ValueSize: 4}
+	require.NoError(t, m.Create())
+	defer m.Close()
+
+	c, err := goebpf.NewPerfCounters(m, goebpf_perf.Attr{
+		Type:   goebpf_perf.TypeSoftware,
+		Config: goebpf_perf.CountSwCPUClock,
+	})
+	require.NoError(t, err)
+	cpus, err := goebpf.OnlineCPUs()
+	require.NoError(t, err)
+	assert.Equal(t, cpus, c.CPUs())
+
+	spin(10 * time.Millisecond)
+	sum, err := c.Sum()
+	require.NoError(t, err)
+	assert.True(t, sum >= uint64(10*time.Millisecond), "cpu clock %d", sum)
+	v, err := c.Read(cpus[0])
+	require.NoError(t, err)
+	assert.NotZero(t, v.Enabled)
+	assert.NotZero(t, v.Running)
+	_, err = c.Read(1 << 20)
+	assert.Error(t, err)
+
+	require.NoError(t, c.Close())
+	assert.Empty(t, c.CPUs())
+}
+
+func TestPerfBreakpoint(t *testing.T) {
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+
+	hits := &goebpf.EbpfMap{Name: "hits", Type: goebpf.MapTypeArray, KeySize: 4, ValueSize: 8, MaxEntries: 1}
+	require.NoError(t, hits.Create())
+	defer hits.Close()
+	// hits[0]++
+	prog, err := goebpf.NewProgram("watch", goebpf.ProgramTypePerfEvent, "GPL", goebpf.Instructions{
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, -4, 0),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, -4),
+		goebpf.LoadMapFd(goebpf.R1, hits),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "out"),
+		goebpf.Mov64Imm(goebpf.R1, 1),
+		goebpf.AtomicAdd(goebpf.SizeDouble, goebpf.R0, 0, goebpf.R1),
+		goebpf.Mov64Imm(goebpf.R0, 0).WithLabel("out"),
+		goebpf.Exit(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, prog.Load())
+	defer prog.Close()
+
+	watched := new(uint64)
+	err = prog.Attach(goebpf.PerfEventAttachParams{
+		Type:           goebpf_perf.TypeBreakpoint,
+		BreakpointType: goebpf_perf.BreakpointW,
+		BreakpointAddr: uint64(uintptr(unsafe.Pointer(watched))),
+		BreakpointLen:  8,
+		Pid:            unix.Gettid(),
+	})
+	if err != nil && strings.Contains(err.Error(), "perf_event_open()") {
+		t.Skipf("Hardware breakpoints are not supported: %v", err)
+	}
+	require.NoError(t, err)
+	defer prog.Detach()
+
+	for i := 0; i < 5; i++ {
+		atomic.AddUint64(watched, 1)
+	}
+	value, err := hits.LookupUint64(uint32(0))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5), value)
+}
+
+// Program storing bpf_get_attach_cookie() into cookies[0]
+func cookieProgram(t *testing.T, progType goebpf.ProgramType, cookies goebpf.Map) goebpf.Program {
+	prog, err := goebpf.NewProgram("cookie", progType, "GPL", goebpf.Instructions{
+		goebpf.Call(goebpf.HelperGetAttachCookie),
+		goebpf.StoreMem(goebpf.SizeDouble, goebpf.R10, -16, goebpf.R0),
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, -4, 0),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, -4),
+		goebpf.Mov64Reg(goebpf.R3, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R3, -16),
+		goebpf.Mov64Imm(goebpf.R4, 0),
+		goebpf.LoadMapFd(goebpf.R1, cookies),
+		goebpf.Call(goebpf.HelperMapUpdateElem),
+		goebpf.Mov64Imm(goebpf.R0, 0),
+		goebpf.Exit(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, prog.Load())
+
+	return prog
+}
+
+func TestPerfCookie(t *testing.T) {
+	cookies := &goebpf.EbpfMap{Name: "cookies", Type: goebpf.MapTypeArray, KeySize: 4, ValueSize: 8, MaxEntries: 1}
+	require.NoError(t, cookies.Create())
+	defer cookies.Close()
+	prog := cookieProgram(t, goebpf.ProgramTypePerfEvent, cookies)
+	defer prog.Close()
+
+	err := prog.Attach(goebpf.PerfEventAttachParams{
+		Type:         goebpf_perf.TypeSoftware,
+		Config:       goebpf_perf.CountSwTaskClock,
+		SamplePeriod: uint64(time.Millisecond),
+		Pid:          os.Getpid(),
+		Cookie:       0x1234567890,
+	})
+	require.NoError(t, err)
+	defer prog.Detach()
+
+	spin(20 * time.Millisecond)
+	value, err := cookies.LookupUint64(uint32(0))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0x1234567890), value)
+}
+
+func TestTracepointCookie(t *testing.T) {
+	cookies := &goebpf.EbpfMap{Name: "cookies", Type: goebpf.MapTypeArray, KeySize: 4, ValueSize: 8, MaxEntries: 1}
+	require.NoError(t, cookies.Create())
+	defer cookies.Close()
+	prog := cookieProgram(t, goebpf.ProgramTypeTracepoint, cookies)
+	defer prog.Close()
+
+	err := prog.Attach(goebpf.TracepointAttachParams{
+		Category: "syscalls",
+		Name:     "sys_enter_getppid",
+		Cookie:   42,
+	})
+	require.NoError(t, err)
+	defer prog.Detach()
+
+	unix.Getppid()
+	value, err := cookies.LookupUint64(uint32(0))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), value)
+}
@@ -0,0 +1,82 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_ratelimit"
+	"github.com/dropbox/goebpf/goebpf_testnet"
+)
+
+func TestRateLimiter(t *testing.T) {
+	rl, err := goebpf_ratelimit.New(16)
+	require.NoError(t, err)
+	defer rl.Close()
+
+	prog, err := rl.Program()
+	require.NoError(t, err)
+	require.NoError(t, prog.Load())
+	defer prog.Close()
+
+	// Returns results of sending count packets in a row
+	send := func(data []byte, count int) []int {
+		var res []int
+		for i := 0; i < count; i++ {
+			r, err := goebpf.ProgramTestRun(prog, goebpf.TestRunParams{Data: data})
+			require.NoError(t, err)
+			res = append(res, r.ReturnValue)
+		}
+		return res
+	}
+	pass, drop := int(goebpf.XdpPass), int(goebpf.XdpDrop)
+	host1 := (&goebpf_testnet.IPv4Packet{Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("1.1.1.1"), TTL: 64}).Bytes()
+	host2 := (&goebpf_testnet.IPv4Packet{Src: net.ParseIP("10.0.0.2"), Dst: net.ParseIP("1.1.1.1"), TTL: 64}).Bytes()
+	host6 := ipv6Frame("fc00::5")
+
+	// No rates - no limits
+	assert.Equal(t, []int{pass, pass, pass}, send(host1, 3))
+
+	require.NoError(t, rl.SetRate("10.0.0.1", goebpf_ratelimit.Rate{PacketsPerSecond: 1, Burst: 3}))
+	assert.Equal(t, []int{pass, pass, pass, drop, drop}, send(host1, 5))
+	assert.Equal(t, []int{pass, pass, pass}, send(host2, 3))
+
+	rate, err := rl.GetRate("10.0.0.1")
+	require.NoError(t, err)
+	assert.Equal(t, goebpf_ratelimit.Rate{PacketsPerSecond: 1, Burst: 3}, rate)
+
+	// Changing rate at runtime refills bucket
+	require.NoError(t, rl.SetRate("10.0.0.1", goebpf_ratelimit.Rate{PacketsPerSecond: 1}))
+	assert.Equal(t, []int{pass, drop}, send(host1, 2))
+
+	// Default rate applies to everyone else
+	require.NoError(t, rl.SetDefaultRate(goebpf_ratelimit.Rate{PacketsPerSecond: 1, Burst: 2}))
+	assert.Equal(t, []int{pass, pass, drop}, send(host2, 3))
+	assert.Equal(t, []int{pass, pass, drop}, send(host6, 3))
+	def, err := rl.DefaultRate()
+	require.NoError(t, err)
+	require.NotNil(t, def)
+	assert.Equal(t, uint64(2), def.Burst)
+
+	rates, err := rl.Rates()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]goebpf_ratelimit.Rate{
+		"10.0.0.1": {PacketsPerSecond: 1},
+	}, rates)
+
+	// Back to default rate
+	require.NoError(t, rl.RemoveRate("10.0.0.1"))
+	assert.Equal(t, []int{pass, pass, drop}, send(host1, 3))
+
+	require.NoError(t, rl.RemoveDefaultRate())
+	def, err = rl.DefaultRate()
+	require.NoError(t, err)
+	assert.Nil(t, def)
+	assert.Equal(t, []int{pass, pass, pass}, send(host2, 3))
+}
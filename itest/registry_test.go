@@ -0,0 +1,105 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+)
+
+// Offset of owner PID in registry value
+const registryPidOffset = 32 + 32 + 64 + 256
+
+func TestRegistry(t *testing.T) {
+	path := bpfPath + "/test_registry"
+	os.Remove(path)
+	defer os.Remove(path)
+	reg, err := goebpf.OpenRegistry(path, goebpf.Owner{Name: "itest", Version: "1.0"})
+	require.NoError(t, err)
+	defer reg.Close()
+
+	own := &goebpf.EbpfMap{
+		Name:           "registry_own_map",
+		Type:           goebpf.MapTypeArray,
+		KeySize:        4,
+		ValueSize:      4,
+		MaxEntries:     1,
+		PersistentPath: bpfPath + "/test_registry_own",
+	}
+	require.NoError(t, own.Create())
+	defer os.Remove(own.PersistentPath)
+	defer own.Close()
+	dead := own.CloneTemplate().(*goebpf.EbpfMap)
+	dead.Name = "dead"
+	dead.PersistentPath = bpfPath + "/test_registry_dead"
+	require.NoError(t, dead.Create())
+	defer os.Remove(dead.PersistentPath)
+	defer dead.Close()
+	require.NoError(t, reg.RegisterMap(own))
+	require.NoError(t, reg.RegisterMap(dead))
+	// Registering again keeps creation time
+	entries, err := reg.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.NoError(t, reg.RegisterMap(own))
+
+	entries, err = reg.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	for _, entry := range entries {
+		assert.Equal(t, goebpf.ObjectMap, entry.Kind)
+		assert.Equal(t, goebpf.Owner{Name: "itest", Version: "1.0"}, entry.Owner)
+		assert.Equal(t, os.Getpid(), entry.Pid)
+		assert.True(t, entry.Alive)
+		if entry.Name == own.Name {
+			assert.Equal(t, own.PersistentPath, entry.PinPath)
+			assert.True(t, entry.Updated.After(entry.Created))
+		}
+	}
+	// Nothing to collect
+	removed, err := reg.CollectGarbage()
+	require.NoError(t, err)
+	assert.Empty(t, removed)
+
+	// Make owner of the second map a process which is gone
+	cmd := exec.Command("/bin/true")
+	require.NoError(t, cmd.Run())
+	raw, err := goebpf.OpenPinnedMap(path, goebpf.MapAccessReadWrite)
+	require.NoError(t, err)
+	defer raw.Close()
+	key, err := raw.GetNextKey(nil)
+	for ; err == nil; key, err = raw.GetNextKey(key) {
+		value, err := raw.Lookup(key)
+		require.NoError(t, err)
+		if goebpf.NullTerminatedStringToString(value[64:128]) == "dead" {
+			goebpf.HostByteOrder().PutUint32(value[registryPidOffset:], uint32(cmd.Process.Pid))
+			require.NoError(t, raw.Upsert(key, value))
+		}
+	}
+
+	removed, err = reg.CollectGarbage()
+	require.NoError(t, err)
+	require.Len(t, removed, 1)
+	assert.Equal(t, "dead", removed[0].Name)
+	assert.False(t, removed[0].Alive)
+	assert.NoFileExists(t, dead.PersistentPath)
+	assert.FileExists(t, own.PersistentPath)
+	entries, err = reg.List()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, own.Name, entries[0].Name)
+
+	// Unregister of missing object is fine
+	require.NoError(t, reg.Unregister(goebpf.ObjectMap, entries[0].Id))
+	require.NoError(t, reg.Unregister(goebpf.ObjectMap, entries[0].Id))
+	entries, err = reg.List()
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
@@ -0,0 +1,93 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf/goebpf_sklb"
+)
+
+// Connects to addr, returns which of listeners accepted connection
+func acceptedBy(t *testing.T, addr string, listeners ...*net.TCPListener) int {
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	for i, ln := range listeners {
+		ln.SetDeadline(time.Now().Add(50 * time.Millisecond))
+		if accepted, err := ln.Accept(); err == nil {
+			accepted.Close()
+			return i
+		}
+	}
+
+	return -1
+}
+
+func TestSocketLoadBalancer(t *testing.T) {
+	lb, err := goebpf_sklb.New(4, 4)
+	require.NoError(t, err)
+	defer lb.Close()
+	require.NoError(t, lb.Attach(""))
+
+	var listeners []*net.TCPListener
+	for i := 0; i < 2; i++ {
+		ln, err := net.ListenTCP("tcp4", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		require.NoError(t, err)
+		defer ln.Close()
+		listeners = append(listeners, ln)
+	}
+	udp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer udp.Close()
+
+	// Nothing listens on 127.0.0.2:4242, service makes it reachable
+	_, prefix, _ := net.ParseCIDR("127.0.0.2/32")
+	tcpService := goebpf_sklb.Service{Network: "tcp", Prefix: *prefix, Port: 4242}
+	require.NoError(t, lb.SetBackends(tcpService, []syscall.Conn{listeners[0]}))
+	assert.Equal(t, 0, acceptedBy(t, "127.0.0.2:4242", listeners...))
+
+	// Backends are swapped
+	require.NoError(t, lb.SetBackends(tcpService, []syscall.Conn{listeners[1]}))
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, 1, acceptedBy(t, "127.0.0.2:4242", listeners...))
+	}
+
+	// UDP service
+	udpService := goebpf_sklb.Service{Network: "udp", Prefix: *prefix, Port: 4243}
+	require.NoError(t, lb.SetBackends(udpService, []syscall.Conn{udp}))
+	assert.Len(t, lb.Services(), 2)
+	conn, err := net.Dial("udp4", "127.0.0.2:4243")
+	require.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 16)
+	udp.SetReadDeadline(time.Now().Add(time.Second))
+	n, err := udp.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+
+	// Service without backends / removed one falls back to regular lookup
+	require.NoError(t, lb.SetBackends(tcpService, nil))
+	_, err = net.DialTimeout("tcp", "127.0.0.2:4242", time.Second)
+	assert.Error(t, err)
+	require.NoError(t, lb.SetBackends(tcpService, []syscall.Conn{listeners[0]}))
+	assert.Equal(t, 0, acceptedBy(t, "127.0.0.2:4242", listeners...))
+	require.NoError(t, lb.RemoveService(tcpService))
+	_, err = net.DialTimeout("tcp", "127.0.0.2:4242", time.Second)
+	assert.Error(t, err)
+	assert.Error(t, lb.RemoveService(tcpService))
+	assert.Len(t, lb.Services(), 1)
+
+	// Too many backends
+	assert.Error(t, lb.SetBackends(udpService, []syscall.Conn{udp, udp, udp, udp, udp}))
+}
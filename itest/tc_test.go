@@ -0,0 +1,51 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf/goebpf_tc"
+	"github.com/dropbox/goebpf/goebpf_testnet"
+)
+
+func TestClsact(t *testing.T) {
+	topo, err := goebpf_testnet.NewTopology()
+	require.NoError(t, err)
+	defer topo.Close()
+	require.NoError(t, topo.AddVethPair("tc0", "", "tc1"))
+
+	err = topo.Do(func() error {
+		has, err := goebpf_tc.HasClsact("tc0")
+		require.NoError(t, err)
+		assert.False(t, has)
+
+		// Adding is idempotent
+		require.NoError(t, goebpf_tc.AddClsact("tc0"))
+		require.NoError(t, goebpf_tc.AddClsact("tc0"))
+		has, err = goebpf_tc.HasClsact("tc0")
+		require.NoError(t, err)
+		assert.True(t, has)
+
+		for _, dir := range []goebpf_tc.Direction{goebpf_tc.Ingress, goebpf_tc.Egress} {
+			filters, err := goebpf_tc.ListFilters("tc0", dir)
+			require.NoError(t, err)
+			assert.Empty(t, filters)
+		}
+		assert.Error(t, goebpf_tc.DeleteFilter("tc0", goebpf_tc.Ingress, 1, 1))
+
+		require.NoError(t, goebpf_tc.DeleteClsact("tc0"))
+		has, err = goebpf_tc.HasClsact("tc0")
+		require.NoError(t, err)
+		assert.False(t, has)
+		return nil
+	})
+	require.NoError(t, err)
+
+	_, err = goebpf_tc.HasClsact("nonexisting0")
+	assert.Error(t, err)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf/goebpf_tcpstats"
+)
+
+// Mount point of cgroup v2 hierarchy of test environment
+const cgroupV2Path = "/sys/fs/cgroup/unified"
+
+func TestTCPStats(t *testing.T) {
+	mon, err := goebpf_tcpstats.New(16)
+	require.NoError(t, err)
+	defer mon.Close()
+
+	prog, err := mon.Program()
+	require.NoError(t, err)
+	require.NoError(t, prog.Load())
+	defer prog.Close()
+	assert.Error(t, prog.Attach(42))
+	require.NoError(t, prog.Attach(cgroupV2Path))
+	defer prog.Detach()
+	assert.Error(t, prog.Attach(cgroupV2Path))
+
+	// Echo server, connection established after attach is tracked
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		io.Copy(conn, conn)
+	}()
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	buf := make([]byte, 1024)
+	for i := 0; i < 10; i++ {
+		_, err = conn.Write(buf)
+		require.NoError(t, err)
+		_, err = io.ReadFull(conn, buf)
+		require.NoError(t, err)
+	}
+	conn.Close()
+
+	s, err := mon.Get("127.0.0.1")
+	require.NoError(t, err)
+	assert.NotZero(t, s.Samples)
+	assert.NotZero(t, s.AvgRTT)
+	all, err := mon.All()
+	require.NoError(t, err)
+	assert.Contains(t, all, "127.0.0.1")
+
+	// Nothing is tracked after detach
+	require.NoError(t, prog.Detach())
+	require.NoError(t, mon.Reset())
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+	all, err = mon.All()
+	require.NoError(t, err)
+	assert.Empty(t, all)
+
+	// Closed program is detached as well
+	require.NoError(t, prog.Attach(cgroupV2Path))
+	require.NoError(t, prog.Close())
+	conn, err = net.Dial("tcp", ln.Addr().String())
+	require.NoError(t, err)
+	conn.Close()
+	all, err = mon.All()
+	require.NoError(t, err)
+	assert.Empty(t, all)
+}
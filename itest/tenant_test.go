@@ -0,0 +1,103 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"context"
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_tenant"
+)
+
+func TestTenantManager(t *testing.T) {
+	template := &goebpf.EbpfMap{
+		Type:       goebpf.MapTypeHash,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 8,
+	}
+	placeholder := template.CloneTemplate()
+	require.NoError(t, placeholder.Create())
+	defer placeholder.Close()
+	outer := &goebpf.EbpfMap{
+		Name:       "tenant_rules",
+		Type:       goebpf.MapTypeHashOfMaps,
+		KeySize:    4,
+		MaxEntries: 2,
+		InnerMapFd: placeholder.GetFd(),
+	}
+	require.NoError(t, outer.Create())
+	defer outer.Close()
+	require.NoError(t, outer.SetInnerTemplate(template))
+
+	pinDir := bpfPath + "/test_tenant_rules"
+	defer os.RemoveAll(pinDir)
+	mgr, err := goebpf_tenant.NewManager(outer, goebpf_tenant.Options{PinDir: pinDir})
+	require.NoError(t, err)
+	defer mgr.Close()
+
+	t1, err := mgr.Add(1)
+	require.NoError(t, err)
+	t2, err := mgr.Add(2)
+	require.NoError(t, err)
+	_, err = mgr.Add(1)
+	assert.Error(t, err)
+	assert.Equal(t, []uint32{1, 2}, mgr.Tenants())
+	assert.Equal(t, t1, mgr.Get(1))
+	assert.FileExists(t, pinDir+"/tenant_rules_1")
+
+	// Outer map has room for 2 tenants only
+	_, err = mgr.Add(3)
+	assert.True(t, errors.Is(err, goebpf.ErrMapFull))
+
+	// Tenants are isolated
+	require.NoError(t, t1.Put(uint32(10), goebpf.Be32(0x01020304)))
+	require.NoError(t, t1.Put(uint32(11), uint32(5)))
+	require.NoError(t, t2.Put(uint32(10), uint32(7)))
+	var be goebpf.Be32
+	require.NoError(t, t1.Get(uint32(10), &be))
+	assert.Equal(t, goebpf.Be32(0x01020304), be)
+	value, err := t2.GetUint32(uint32(10))
+	require.NoError(t, err)
+	assert.Equal(t, uint32(7), value)
+	_, err = t2.GetUint64(uint32(11))
+	assert.True(t, errors.Is(err, goebpf.ErrKeyNotExist))
+	require.NoError(t, t1.Delete(uint32(11)))
+	count := 0
+	require.NoError(t, t1.ForEach(context.Background(), func(key, value []byte) error {
+		count++
+		return nil
+	}))
+	assert.Equal(t, 1, count)
+
+	usage, err := mgr.Usage(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[uint32]goebpf.MapStats{
+		1: {Entries: 1, MaxEntries: 8, Updates: 2, Deletes: 1},
+		2: {Entries: 1, MaxEntries: 8, Updates: 1},
+	}, usage)
+
+	// Removed tenant disappears from outer map, room for new one
+	require.NoError(t, mgr.Remove(2))
+	_, err = outer.Lookup(uint32(2))
+	assert.True(t, errors.Is(err, goebpf.ErrKeyNotExist))
+	assert.NoFileExists(t, pinDir+"/tenant_rules_2")
+	_, err = mgr.Add(3)
+	assert.NoError(t, err)
+
+	// State of pinned tenant survives restart
+	require.NoError(t, mgr.Close())
+	mgr, err = goebpf_tenant.NewManager(outer, goebpf_tenant.Options{PinDir: pinDir})
+	require.NoError(t, err)
+	t1, err = mgr.Add(1)
+	require.NoError(t, err)
+	require.NoError(t, t1.Get(uint32(10), &be))
+	assert.Equal(t, goebpf.Be32(0x01020304), be)
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+)
+
+func TestTracePipe(t *testing.T) {
+	// bpf_printk("gtp:hi!")
+	prog, err := goebpf.NewProgram("printk", goebpf.ProgramTypeXdp, "GPL", goebpf.Instructions{
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, -8, 0x3a707467), // "gtp:"
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, -4, 0x00216968), // "hi!\0"
+		goebpf.Mov64Reg(goebpf.R1, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R1, -8),
+		goebpf.Mov64Imm(goebpf.R2, 8),
+		goebpf.Call(goebpf.HelperTracePrintk),
+		goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpPass)),
+		goebpf.Exit(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, prog.Load())
+	defer prog.Close()
+
+	r, err := goebpf.ReadTracePipe(goebpf.TraceFilter{Prefixes: []string{"gtp:"}, PrintkOnly: true})
+	require.NoError(t, err)
+	defer r.Stop()
+
+	// Nothing is printed yet
+	select {
+	case ev := <-r.Events():
+		require.FailNow(t, "unexpected event", "%+v", ev)
+	default:
+	}
+
+	_, err = goebpf.ProgramTestRun(prog, goebpf.TestRunParams{Data: make([]byte, 64)})
+	require.NoError(t, err)
+	select {
+	case ev := <-r.Events():
+		assert.Equal(t, "bpf_trace_printk", ev.Function)
+		assert.Equal(t, "gtp:hi!", ev.Message)
+		assert.NotZero(t, ev.Timestamp)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "no trace event")
+	}
+
+	// Blocked read of pipe is interrupted
+	r.Stop()
+	select {
+	case _, ok := <-r.Events():
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		require.FailNow(t, "reader not stopped")
+	}
+	assert.NoError(t, r.Err())
+}
@@ -0,0 +1,127 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_btf"
+)
+
+// hits[0]++, wrapped into kernel function calls (if any)
+func countingProgram(hits goebpf.Map, wrap ...string) goebpf.Instructions {
+	var insns goebpf.Instructions
+	if len(wrap) > 0 {
+		insns = append(insns, goebpf.CallKernelFunc(wrap[0]))
+	}
+	insns = append(insns,
+		goebpf.StoreImm(goebpf.SizeWord, goebpf.R10, -4, 0),
+		goebpf.Mov64Reg(goebpf.R2, goebpf.R10),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R2, -4),
+		goebpf.LoadMapFd(goebpf.R1, hits),
+		goebpf.Call(goebpf.HelperMapLookupElem),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R0, 0, "out"),
+		goebpf.Mov64Imm(goebpf.R1, 1),
+		goebpf.AtomicAdd(goebpf.SizeDouble, goebpf.R0, 0, goebpf.R1),
+	)
+	if len(wrap) > 1 {
+		insns = append(insns, goebpf.CallKernelFunc(wrap[1]).WithLabel("out"))
+		insns = append(insns, goebpf.Mov64Imm(goebpf.R0, 0))
+	} else {
+		insns = append(insns, goebpf.Mov64Imm(goebpf.R0, 0).WithLabel("out"))
+	}
+
+	return append(insns, goebpf.Exit())
+}
+
+func testTracing(t *testing.T, kind goebpf.TracingKind, function string, wrap ...string) {
+	hits := &goebpf.EbpfMap{Name: "hits", Type: goebpf.MapTypeArray, KeySize: 4, ValueSize: 8, MaxEntries: 1}
+	require.NoError(t, hits.Create())
+	defer hits.Close()
+	prog, err := goebpf.NewTracingProgram("open", kind, function, "GPL", countingProgram(hits, wrap...))
+	require.NoError(t, err)
+	require.NoError(t, prog.Load())
+	defer prog.Close()
+	assert.Equal(t, goebpf.ProgramTypeTracing, prog.GetType())
+
+	require.NoError(t, prog.Attach(nil))
+	assert.Error(t, prog.Attach(nil))
+	f, err := os.Open("/proc/self/stat")
+	require.NoError(t, err)
+	f.Close()
+	value, err := hits.LookupUint64(uint32(0))
+	require.NoError(t, err)
+	assert.True(t, value > 0)
+
+	require.NoError(t, prog.Detach())
+	assert.Error(t, prog.Detach())
+}
+
+func TestTracingFentry(t *testing.T) {
+	testTracing(t, goebpf.TracingFentry, "do_sys_openat2")
+}
+
+func TestTracingFexit(t *testing.T) {
+	testTracing(t, goebpf.TracingFexit, "vmlinux:do_sys_openat2")
+}
+
+func TestTracingKernelFunc(t *testing.T) {
+	testTracing(t, goebpf.TracingFentry, "do_sys_openat2", "bpf_rcu_read_lock", "bpf_rcu_read_unlock")
+}
+
+func TestTracingUnknownFunction(t *testing.T) {
+	prog, err := goebpf.NewTracingProgram("none", goebpf.TracingFentry, "no_such_function", "GPL",
+		goebpf.Instructions{goebpf.Mov64Imm(goebpf.R0, 0), goebpf.Exit()})
+	require.NoError(t, err)
+	assert.True(t, errors.Is(prog.Load(), goebpf.ErrSymbolNotFound))
+	_, err = goebpf.Instructions{goebpf.CallKernelFunc("no_such_function"), goebpf.Exit()}.Assemble()
+	assert.Error(t, err)
+
+	// Typo: similar functions are suggested
+	prog, err = goebpf.NewTracingProgram("typo", goebpf.TracingFentry, "do_sys_openat3", "GPL",
+		goebpf.Instructions{goebpf.Mov64Imm(goebpf.R0, 0), goebpf.Exit()})
+	require.NoError(t, err)
+	err = prog.Load()
+	var serr *goebpf.SymbolNotFoundError
+	require.True(t, errors.As(err, &serr))
+	assert.Equal(t, "do_sys_openat3", serr.Symbol)
+	assert.Contains(t, serr.Suggestions, "do_sys_openat2")
+}
+
+func TestCheckKernelSymbol(t *testing.T) {
+	assert.NoError(t, goebpf.CheckKernelSymbol("do_sys_openat2"))
+
+	err := goebpf.CheckKernelSymbol("do_sys_openat3")
+	assert.True(t, errors.Is(err, goebpf.ErrSymbolNotFound))
+	var serr *goebpf.SymbolNotFoundError
+	require.True(t, errors.As(err, &serr))
+	assert.Contains(t, serr.Suggestions, "do_sys_openat2")
+}
+
+func TestTracingKernelModule(t *testing.T) {
+	modules, err := goebpf_btf.KernelModules()
+	require.NoError(t, err)
+	if len(modules) == 0 {
+		t.Skip("No kernel modules with BTF loaded")
+	}
+	base, err := goebpf_btf.LoadKernelSpec()
+	require.NoError(t, err)
+	spec, err := goebpf_btf.LoadKernelModuleSpec(modules[0], base)
+	require.NoError(t, err)
+	assert.True(t, spec.Len() > base.Len())
+
+	// Function is looked up in given module only
+	prog, err := goebpf.NewTracingProgram("none", goebpf.TracingFentry, modules[0]+":no_such_function", "GPL",
+		goebpf.Instructions{goebpf.Mov64Imm(goebpf.R0, 0), goebpf.Exit()})
+	require.NoError(t, err)
+	err = prog.Load()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), modules[0])
+}
@@ -0,0 +1,77 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_container"
+)
+
+const libcPath = "/usr/lib/x86_64-linux-gnu/libc.so.6"
+
+func TestUprobe(t *testing.T) {
+	if _, err := os.Stat(libcPath); err != nil {
+		t.Skip("No libc: ", err)
+	}
+	cookies := &goebpf.EbpfMap{Name: "cookies", Type: goebpf.MapTypeArray, KeySize: 4, ValueSize: 8, MaxEntries: 1}
+	require.NoError(t, cookies.Create())
+	defer cookies.Close()
+	prog := cookieProgram(t, goebpf.ProgramTypeKprobe, cookies)
+	defer prog.Close()
+
+	// Every dynamically linked binary starts by libc
+	err := prog.Attach(goebpf.UprobeAttachParams{
+		Path:   libcPath,
+		Symbol: "__libc_start_main",
+		Cookie: 42,
+	})
+	require.NoError(t, err)
+	require.NoError(t, exec.Command("/bin/true").Run())
+	require.NoError(t, prog.Detach())
+
+	value, err := cookies.LookupUint64(uint32(0))
+	require.NoError(t, err)
+	assert.Equal(t, uint64(42), value)
+}
+
+func TestUprobeContainerPath(t *testing.T) {
+	if _, err := os.Stat(libcPath); err != nil {
+		t.Skip("No libc: ", err)
+	}
+	cookies := &goebpf.EbpfMap{Name: "cookies", Type: goebpf.MapTypeArray, KeySize: 4, ValueSize: 8, MaxEntries: 1}
+	require.NoError(t, cookies.Create())
+	defer cookies.Close()
+	prog := cookieProgram(t, goebpf.ProgramTypeKprobe, cookies)
+	defer prog.Close()
+
+	// Path is resolved in mount namespace of process, own one here
+	err := prog.Attach(goebpf.UprobeAttachParams{
+		Path:     libcPath,
+		Symbol:   "malloc",
+		Retprobe: true,
+		Pid:      os.Getpid(),
+	})
+	require.NoError(t, err)
+	require.NoError(t, prog.Detach())
+
+	err = prog.Attach(goebpf.UprobeAttachParams{Path: libcPath, Symbol: "no_such_function"})
+	assert.Error(t, err)
+}
+
+func TestContainerCgroupPath(t *testing.T) {
+	path, err := goebpf_container.CgroupPath(os.Getpid())
+	if err != nil {
+		t.Skip("No cgroup v2: ", err)
+	}
+	f, err := goebpf_container.OpenCgroup(path)
+	require.NoError(t, err)
+	f.Close()
+}
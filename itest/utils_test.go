@@ -16,3 +16,38 @@ func TestGetNumOfPossibleCpus(t *testing.T) {
 	assert.NoError(t, err)
 	assert.True(t, cpus > 0)
 }
+
+func TestPossibleOnlineCPUs(t *testing.T) {
+	possible, err := goebpf.PossibleCPUs()
+	assert.NoError(t, err)
+	num, err := goebpf.GetNumOfPossibleCpus()
+	assert.NoError(t, err)
+	assert.Len(t, possible, num)
+
+	online, err := goebpf.OnlineCPUs()
+	assert.NoError(t, err)
+	assert.NotEmpty(t, online)
+	assert.Subset(t, possible, online)
+}
+
+func TestDetectCompatMatrix(t *testing.T) {
+	compat, err := goebpf.DetectCompatMatrix()
+	assert.NoError(t, err)
+	version, err := goebpf.GetKernelVersion()
+	assert.NoError(t, err)
+	assert.Equal(t, version, compat.Version)
+	// Tests run on kernels with ring buffer
+	f, err := compat.Resolve(goebpf.FeatureRingBuf)
+	assert.NoError(t, err)
+	assert.Equal(t, goebpf.FeatureRingBuf, f)
+
+	// Probed features don't depend on version, others do
+	compat.Version, err = goebpf.ParseKernelRelease("4.0.0")
+	assert.NoError(t, err)
+	for _, f := range []goebpf.KernelFeature{goebpf.FeatureRingBuf, goebpf.FeatureTcx,
+		goebpf.FeatureMapBatch, goebpf.FeatureDevMapHash, goebpf.FeatureKprobe} {
+		assert.True(t, compat.Supported(f), f.String())
+	}
+	assert.False(t, compat.Supported(goebpf.FeatureTimer))
+	assert.False(t, goebpf.NewCompatMatrix(compat.Version).Supported(goebpf.FeatureRingBuf))
+}
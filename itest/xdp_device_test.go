@@ -0,0 +1,84 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_testnet"
+)
+
+func TestXdpDeviceInfo(t *testing.T) {
+	topo, err := goebpf_testnet.NewTopology()
+	require.NoError(t, err)
+	defer topo.Close()
+	require.NoError(t, topo.AddVethPair("xd0", "", "xd1"))
+
+	prog, err := newMacSwapProgram()
+	require.NoError(t, err)
+	defer prog.Close()
+
+	err = topo.Do(func() error {
+		info, err := goebpf.GetXdpDeviceInfo("xd0")
+		require.NoError(t, err)
+		assert.Equal(t, "veth", info.Driver)
+		assert.Equal(t, 1500, info.MTU)
+		assert.True(t, info.MaxMTU >= info.MTU)
+		assert.True(t, info.MaxXdpMTU > info.MTU)
+		assert.NoError(t, info.CheckNative())
+		if info.FeaturesKnown {
+			assert.NotZero(t, info.Features&goebpf.XdpFeatureBasic)
+		}
+
+		// Jumbo frames don't fit page, native attach is refused upfront
+		link, err := netlink.LinkByName("xd0")
+		require.NoError(t, err)
+		require.NoError(t, netlink.LinkSetMTU(link, 9000))
+		err = prog.Attach(&goebpf.XdpAttachParams{Interface: "xd0", Mode: goebpf.XdpAttachModeDrv})
+		require.Error(t, err)
+		var deviceErr *goebpf.XdpDeviceError
+		assert.True(t, errors.As(err, &deviceErr))
+		assert.True(t, errors.Is(err, goebpf.ErrNotSupported))
+		assert.Contains(t, err.Error(), "MTU 9000")
+
+		// ... unless falling back to generic mode is fine
+		err = prog.Attach(&goebpf.XdpAttachParams{
+			Interface:         "xd0",
+			Mode:              goebpf.XdpAttachModeDrv,
+			FallbackToGeneric: true,
+		})
+		require.NoError(t, err)
+		link, err = netlink.LinkByName("xd0")
+		require.NoError(t, err)
+		require.NotNil(t, link.Attrs().Xdp)
+		assert.Equal(t, uint32(nl.XDP_ATTACHED_SKB), link.Attrs().Xdp.AttachMode)
+
+		info, err = goebpf.GetXdpDeviceInfo("xd0")
+		require.NoError(t, err)
+		progInfo, err := goebpf.GetProgramInfoByFd(prog.GetFd())
+		require.NoError(t, err)
+		assert.Equal(t, progInfo.Id, info.AttachedProgramId)
+
+		return prog.Detach()
+	})
+	require.NoError(t, err)
+
+	// Loopback has no native XDP support at all
+	err = topo.Do(func() error {
+		info, err := goebpf.GetXdpDeviceInfo("lo")
+		require.NoError(t, err)
+		if info.FeaturesKnown {
+			assert.Error(t, info.CheckNative())
+		}
+		return nil
+	})
+	require.NoError(t, err)
+}
@@ -130,13 +130,83 @@ func (ts *xdpTestSuite) TestElfLoad() {
 		ts.NoError(err)
 	}
 
-	// Negative: close already closed program
+	// Close of already closed program does nothing
 	err = progs[0].Close()
-	ts.Error(err)
+	ts.NoError(err)
 
 	// Negative: attach to non existing interface
 	err = progs[0].Attach("dummyiface")
 	ts.Error(err)
+	// Release everything created by LoadElf()
+	err = eb.Close()
+	ts.NoError(err)
+	ts.Empty(eb.GetMaps())
+}
+
+// Reload must keep map data and move attachments to new programs
+func (ts *xdpTestSuite) TestReload() {
+	eb := goebpf.NewDefaultEbpfSystem()
+	err := eb.LoadElf(testProgramFilename)
+	ts.Require().NoError(err)
+	defer eb.Close()
+
+	for _, prog := range eb.GetPrograms() {
+		ts.Require().NoError(prog.Load())
+	}
+	rxcnt := eb.GetMapByName("rxcnt")
+	err = rxcnt.Upsert("key1", 100)
+	ts.NoError(err)
+	old := eb.GetProgramByName("xdp0")
+	err = old.Attach("lo")
+	ts.Require().NoError(err)
+
+	err = eb.Reload(testProgramFilename)
+	ts.Require().NoError(err)
+
+	// Map has been reused with data
+	ts.True(rxcnt == eb.GetMapByName("rxcnt"))
+	val, err := rxcnt.LookupInt("key1")
+	ts.NoError(err)
+	ts.Equal(100, val)
+
+	// Old program replaced by new one
+	ts.Equal(0, old.GetFd())
+	prog := eb.GetProgramByName("xdp0")
+	ts.NotEqual(0, prog.GetFd())
+	ts.Error(old.Detach())
+	ts.NoError(prog.Detach())
+
+	// Failed reload keeps everything in place
+	err = eb.Reload("non_existing.elf")
+	ts.Error(err)
+	ts.True(prog == eb.GetProgramByName("xdp0"))
+}
+
+// ParseElf must read everything LoadElf does without creating kernel objects
+func (ts *xdpTestSuite) TestParseElf() {
+	report, err := goebpf.ParseElf(testProgramFilename,
+		goebpf.WithMapMaxEntries("rxcnt", 500),
+		goebpf.WithBpffsRoot("/run/bpffs"),
+	)
+	ts.Require().NoError(err)
+
+	ts.Equal("GPLv2", report.License)
+	ts.Equal(goebpf.HostByteOrder(), report.ByteOrder)
+	ts.Equal(6, len(report.Maps))
+	ts.Equal(programsAmount, len(report.Programs))
+	for _, m := range report.Maps {
+		switch m.Name {
+		case "rxcnt":
+			ts.Equal(500, m.MaxEntries)
+		case "txcnt":
+			ts.Equal("/run/bpffs/txcnt", m.PersistentPath)
+		}
+	}
+	ts.True(report.MinKernelVersion() >= 0x040f00)
+
+	// Nothing has been created in kernel
+	_, err = os.Stat("/run/bpffs/txcnt")
+	ts.True(os.IsNotExist(err))
 }
 
 func (ts *xdpTestSuite) TestProgramInfo() {
@@ -185,6 +255,111 @@ func (ts *xdpTestSuite) TestProgramInfo() {
 	ts.Equal(123, val)
 }
 
+func (ts *xdpTestSuite) TestVerifierLog() {
+	eb := goebpf.NewDefaultEbpfSystem(goebpf.WithVerifierLogLevel(goebpf.VerifierLogStats, "xdp0"))
+	ts.Require().NoError(eb.LoadElf(testProgramFilename))
+	prog := eb.GetProgramByName("xdp0")
+	ts.Require().NoError(prog.Load())
+	defer prog.Close()
+
+	// Stats of successful load are kept
+	log := prog.(interface{ VerifierLog() string }).VerifierLog()
+	ts.Contains(log, "processed")
+
+	// Default level: no log unless load failed
+	other := eb.GetProgramByName("xdp1")
+	ts.Require().NotNil(other)
+	ts.Require().NoError(other.Load())
+	defer other.Close()
+	ts.Empty(other.(interface{ VerifierLog() string }).VerifierLog())
+}
+
+func (ts *xdpTestSuite) TestSelectiveLoad() {
+	// Only maps used by selected programs are read
+	report, err := goebpf.ParseElf(testProgramFilename, goebpf.WithPrograms("xdp1"))
+	ts.Require().NoError(err)
+	ts.Require().Equal(1, len(report.Programs))
+	ts.Equal("xdp1", report.Programs[0].Name)
+	ts.Require().Equal(1, len(report.Maps))
+	ts.Equal("rxcnt", report.Maps[0].Name)
+
+	// Explicitly selected maps come with their inner maps
+	report, err = goebpf.ParseElf(testProgramFilename,
+		goebpf.WithPrograms("xdp1"),
+		goebpf.WithMaps("match_maps_tx"),
+	)
+	ts.Require().NoError(err)
+	var names []string
+	for _, m := range report.Maps {
+		names = append(names, m.Name)
+	}
+	ts.Equal([]string{"match_maps_tx", "rxcnt", "txcnt"}, names)
+
+	// Real load: maps of other programs are not created
+	eb := goebpf.NewDefaultEbpfSystem(goebpf.WithPrograms("xdp0"))
+	ts.Require().NoError(eb.LoadElf(testProgramFilename))
+	defer eb.Close()
+	ts.Equal(1, len(eb.GetPrograms()))
+	ts.NotNil(eb.GetMapByName("array_map"))
+	ts.Nil(eb.GetMapByName("programs"))
+	ts.NoError(eb.GetProgramByName("xdp0").Load())
+}
+
+func (ts *xdpTestSuite) TestAutoload() {
+	eb := goebpf.NewDefaultEbpfSystem(goebpf.WithAutoload())
+	ts.Require().NoError(eb.LoadElf(testProgramFilename))
+	defer eb.Close()
+	for name, prog := range eb.GetPrograms() {
+		ts.NotEqual(0, prog.GetFd(), name)
+	}
+	usage, err := goebpf.GetMemoryUsage(eb)
+	ts.Require().NoError(err)
+	ts.Equal(6, len(usage.Maps))
+	ts.Equal(len(eb.GetPrograms()), len(usage.Programs))
+	for _, prog := range usage.Programs {
+		ts.True(prog.XlatedSize > 0, prog.Name)
+		ts.True(prog.Bytes > 0, prog.Name)
+	}
+
+	// Only programs matched by filter are loaded
+	eb2 := goebpf.NewDefaultEbpfSystem(goebpf.WithAutoloadFilter(func(name string) bool {
+		return name == "xdp1"
+	}))
+	ts.Require().NoError(eb2.LoadElf(testProgramFilename))
+	defer eb2.Close()
+	ts.NotEqual(0, eb2.GetProgramByName("xdp1").GetFd())
+	ts.Equal(0, eb2.GetProgramByName("xdp0").GetFd())
+}
+
+func (ts *xdpTestSuite) TestProgArrayState() {
+	eb := goebpf.NewDefaultEbpfSystem(goebpf.WithAutoload())
+	ts.Require().NoError(eb.LoadElf(testProgramFilename))
+	defer eb.Close()
+	progArray := eb.GetMapByName("programs").(*goebpf.EbpfMap)
+	xdp0 := eb.GetProgramByName("xdp0")
+	xdp1 := eb.GetProgramByName("xdp1")
+
+	path := bpfPath + "/programs_state_test"
+	defer os.Remove(path)
+	state, err := goebpf.NewProgArrayState(progArray, path)
+	ts.Require().NoError(err)
+	ts.NoError(state.Reconcile(map[int]goebpf.Program{0: xdp0, 1: xdp1}))
+	ts.NoError(state.Close())
+
+	// "Restart": state survives, obsolete entries are removed
+	state, err = goebpf.NewProgArrayState(progArray, path)
+	ts.Require().NoError(err)
+	defer state.Close()
+	installed, err := state.Installed()
+	ts.NoError(err)
+	ts.Equal(map[int]string{0: "xdp0", 1: "xdp1"}, installed)
+
+	ts.NoError(state.Reconcile(map[int]goebpf.Program{1: xdp0}))
+	installed, err = state.Installed()
+	ts.NoError(err)
+	ts.Equal(map[int]string{1: "xdp0"}, installed)
+}
+
 // Run suite
 func TestXdpSuite(t *testing.T) {
 	suite.Run(t, new(xdpTestSuite))
@@ -0,0 +1,98 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_xdptest"
+)
+
+// Drops ARP, swaps MAC addresses of IPv4 packets and sends them back, passes the rest
+func newMacSwapProgram() (goebpf.Program, error) {
+	prog, err := goebpf.NewProgram("mac_swap", goebpf.ProgramTypeXdp, "GPL", goebpf.Instructions{
+		goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpPass)),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R2, goebpf.R1, 0),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R3, goebpf.R1, 4),
+		goebpf.Mov64Reg(goebpf.R4, goebpf.R2),
+		goebpf.Alu64Imm(goebpf.AluOpAdd, goebpf.R4, 14),
+		goebpf.JumpReg(goebpf.JumpOpGt, goebpf.R4, goebpf.R3, "out"),
+		goebpf.LoadMem(goebpf.SizeHalf, goebpf.R5, goebpf.R2, 12),
+		goebpf.ToBigEndian(goebpf.R5, 16),
+		goebpf.JumpImm(goebpf.JumpOpEq, goebpf.R5, 0x0806, "drop"),
+		goebpf.JumpImm(goebpf.JumpOpNe, goebpf.R5, 0x0800, "out"),
+		// 6 bytes of MAC as 4 + 2
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R6, goebpf.R2, 0),
+		goebpf.LoadMem(goebpf.SizeHalf, goebpf.R7, goebpf.R2, 4),
+		goebpf.LoadMem(goebpf.SizeWord, goebpf.R8, goebpf.R2, 6),
+		goebpf.LoadMem(goebpf.SizeHalf, goebpf.R9, goebpf.R2, 10),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R2, 0, goebpf.R8),
+		goebpf.StoreMem(goebpf.SizeHalf, goebpf.R2, 4, goebpf.R9),
+		goebpf.StoreMem(goebpf.SizeWord, goebpf.R2, 6, goebpf.R6),
+		goebpf.StoreMem(goebpf.SizeHalf, goebpf.R2, 10, goebpf.R7),
+		goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpTx)),
+		goebpf.Exit().WithLabel("out"),
+		goebpf.Mov64Imm(goebpf.R0, int32(goebpf.XdpDrop)).WithLabel("drop"),
+		goebpf.Exit(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return prog, prog.Load()
+}
+
+func ethFrame(dst, src byte, etherType uint16) []byte {
+	frame := make([]byte, 60)
+	for i := 0; i < 6; i++ {
+		frame[i], frame[6+i] = dst, src
+	}
+	frame[12], frame[13] = byte(etherType>>8), byte(etherType)
+	return frame
+}
+
+func TestXdpHarness(t *testing.T) {
+	prog, err := newMacSwapProgram()
+	require.NoError(t, err)
+	defer prog.Close()
+
+	ipv4 := ethFrame(0xaa, 0xbb, 0x0800)
+	goebpf_xdptest.Run(t, prog, []goebpf_xdptest.Case{
+		{Name: "arp", Packet: ethFrame(0xaa, 0xbb, 0x0806), Expect: goebpf_xdptest.Expect{Action: goebpf.XdpDrop}},
+		{Name: "ipv6", Packet: ethFrame(0xaa, 0xbb, 0x86dd), Expect: goebpf_xdptest.Expect{Action: goebpf.XdpPass}},
+		{Name: "ipv4", Packet: ipv4, Expect: goebpf_xdptest.Expect{Action: goebpf.XdpTx, Output: ethFrame(0xbb, 0xaa, 0x0800)}},
+	})
+	// Mismatches are reported
+	require.Error(t, goebpf_xdptest.Check(prog, goebpf_xdptest.Case{
+		Packet: ipv4,
+		Expect: goebpf_xdptest.Expect{Action: goebpf.XdpTx},
+	}))
+
+	// Corpus from pcap
+	dir, err := ioutil.TempDir("", "xdptest")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "corpus.pcap")
+	f, err := os.Create(path)
+	require.NoError(t, err)
+	require.NoError(t, goebpf_xdptest.WritePcap(f, []goebpf_xdptest.Packet{
+		{Data: ethFrame(1, 2, 0x0806)},
+		{Data: ethFrame(3, 4, 0x86dd)},
+		{Data: ethFrame(5, 6, 0x0806)},
+	}))
+	require.NoError(t, f.Close())
+	cases, err := goebpf_xdptest.PcapCases(path, func(index int, packet []byte) goebpf_xdptest.Expect {
+		if index%2 == 0 {
+			return goebpf_xdptest.Expect{Action: goebpf.XdpDrop}
+		}
+		return goebpf_xdptest.Expect{Action: goebpf.XdpPass}
+	})
+	require.NoError(t, err)
+	goebpf_xdptest.Run(t, prog, cases)
+}
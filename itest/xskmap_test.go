@@ -0,0 +1,53 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package itest
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/dropbox/goebpf"
+	"github.com/dropbox/goebpf/goebpf_testnet"
+)
+
+func TestXskMap(t *testing.T) {
+	topo, err := goebpf_testnet.NewTopology()
+	require.NoError(t, err)
+	defer topo.Close()
+	require.NoError(t, topo.AddVethPair("xq0", "", "xq1"))
+
+	err = topo.Do(func() error {
+		// veth has single RX queue by default
+		queues, err := goebpf.NicRxQueues("xq0")
+		require.NoError(t, err)
+		assert.Equal(t, 1, queues)
+		assert.NoError(t, goebpf.ValidateNicQueue("xq0", 0))
+		assert.Error(t, goebpf.ValidateNicQueue("xq0", 1))
+		assert.Error(t, goebpf.ValidateNicQueue("nonexisting0", 0))
+
+		xsks, err := goebpf.CreateXskMap("xsks", "xq0")
+		require.NoError(t, err)
+		defer xsks.Close()
+		assert.Equal(t, 1, xsks.Map().MaxEntries)
+		assert.Equal(t, 1, xsks.Queues())
+
+		// Only AF_XDP sockets can be put into map
+		assert.Error(t, xsks.Set(0, xsks.Map().GetFd()))
+		assert.Error(t, xsks.Set(1, xsks.Map().GetFd()))
+		assert.NoError(t, xsks.Remove(0))
+		assert.NoError(t, xsks.Populate(nil))
+
+		// Existing map must fit all queues
+		small := &goebpf.EbpfMap{Name: "xsks", Type: goebpf.MapTypeXSKMap, KeySize: 4, ValueSize: 4, MaxEntries: 1}
+		_, err = goebpf.NewXskMap(small, "xq0")
+		assert.NoError(t, err)
+		small.MaxEntries = 0
+		_, err = goebpf.NewXskMap(small, "xq0")
+		assert.Error(t, err)
+		return nil
+	})
+	require.NoError(t, err)
+}
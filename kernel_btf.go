@@ -0,0 +1,206 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/dropbox/goebpf/goebpf_btf"
+)
+
+// Kernel BTF is large, so it is read only once for all programs
+// (LSM / tracing programs, kernel function calls) per path, see WithBtfPath().
+// BTF of kernel modules is read on demand and cached by base path / module name.
+var (
+	kernelSpecMu      sync.Mutex
+	kernelSpecs       = make(map[string]*goebpf_btf.Spec)
+	kernelModuleSpecs = make(map[kernelModuleKey]*goebpf_btf.Spec)
+)
+
+type kernelModuleKey struct {
+	basePath string
+	module   string
+}
+
+// Kernel function resolved in BTF of vmlinux or kernel module
+type kernelFunc struct {
+	name   string
+	module string // Empty for vmlinux
+	btfID  int
+}
+
+// Reads kernel BTF from path, DefaultBtfPath if empty.
+// Must be called with kernelSpecMu held
+func loadKernelSpecLocked(path string) (*goebpf_btf.Spec, error) {
+	if path == "" {
+		path = DefaultBtfPath
+	}
+	if spec, ok := kernelSpecs[path]; ok {
+		return spec, nil
+	}
+	spec, err := goebpf_btf.LoadSpecFromFile(path)
+	if os.IsNotExist(err) {
+		// Kernel built without CONFIG_DEBUG_INFO_BTF (or before 5.4)
+		return nil, &NotSupportedError{
+			Feature: fmt.Sprintf("Kernel BTF (%s is missing)", path),
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read kernel BTF: %v", err)
+	}
+	kernelSpecs[path] = spec
+
+	return spec, nil
+}
+
+// Must be called with kernelSpecMu held
+func loadKernelModuleSpecLocked(basePath, module string) (*goebpf_btf.Spec, error) {
+	key := kernelModuleKey{basePath: basePath, module: module}
+	if spec, ok := kernelModuleSpecs[key]; ok {
+		return spec, nil
+	}
+	base, err := loadKernelSpecLocked(basePath)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := goebpf_btf.LoadKernelModuleSpec(module, base)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read BTF of kernel module '%s': %v", module, err)
+	}
+	kernelModuleSpecs[key] = spec
+
+	return spec, nil
+}
+
+// Returns BTF ID of function of vmlinux, BTF is read from btfPath
+func kernelFuncBtfID(btfPath, name string) (int, error) {
+	kernelSpecMu.Lock()
+	defer kernelSpecMu.Unlock()
+
+	spec, err := loadKernelSpecLocked(btfPath)
+	if err != nil {
+		return 0, err
+	}
+	t, err := spec.TypeByName(name, goebpf_btf.KindFunc)
+	if err != nil {
+		return 0, err
+	}
+
+	return t.ID, nil
+}
+
+// findKernelFunc looks function up in BTF of vmlinux (read from btfPath),
+// then of loaded kernel modules (/sys/kernel/btf/<module>). Name may be prefixed
+// by module to look only in it, e.g. "nf_conntrack:nf_confirm". Missing function
+// is reported as *SymbolNotFoundError.
+func findKernelFunc(btfPath, name string) (*kernelFunc, error) {
+	module := ""
+	if idx := strings.IndexByte(name, ':'); idx >= 0 {
+		module, name = name[:idx], name[idx+1:]
+	}
+	if name == "" {
+		return nil, fmt.Errorf("Invalid kernel function '%s:%s'", module, name)
+	}
+
+	kernelSpecMu.Lock()
+	defer kernelSpecMu.Unlock()
+
+	if module != "" && module != "vmlinux" {
+		spec, err := loadKernelModuleSpecLocked(btfPath, module)
+		if err != nil {
+			return nil, err
+		}
+		t, err := spec.OwnTypeByName(name, goebpf_btf.KindFunc)
+		if err != nil {
+			return nil, &SymbolNotFoundError{
+				Symbol:      name,
+				Module:      module,
+				Suggestions: similarSymbols(name, spec.OwnNames(goebpf_btf.KindFunc)),
+			}
+		}
+		return &kernelFunc{name: name, module: module, btfID: t.ID}, nil
+	}
+
+	spec, err := loadKernelSpecLocked(btfPath)
+	if err != nil {
+		return nil, err
+	}
+	if t, err := spec.TypeByName(name, goebpf_btf.KindFunc); err == nil {
+		return &kernelFunc{name: name, btfID: t.ID}, nil
+	}
+	names := spec.OwnNames(goebpf_btf.KindFunc)
+
+	if module != "vmlinux" {
+		// Modules may be loaded at any time, so list is never cached
+		modules, err := goebpf_btf.KernelModules()
+		if err != nil {
+			return nil, fmt.Errorf("Unable to list BTF of kernel modules: %v", err)
+		}
+		for _, module := range modules {
+			spec, err := loadKernelModuleSpecLocked(btfPath, module)
+			if err != nil {
+				// Module may be unloaded in between
+				continue
+			}
+			if t, err := spec.OwnTypeByName(name, goebpf_btf.KindFunc); err == nil {
+				return &kernelFunc{name: name, module: module, btfID: t.ID}, nil
+			}
+			names = append(names, spec.OwnNames(goebpf_btf.KindFunc)...)
+		}
+	}
+
+	return nil, &SymbolNotFoundError{
+		Symbol:      name,
+		Suggestions: similarSymbols(name, names),
+	}
+}
+
+// Opens kernel BTF object of loaded module (linux 5.11+), to refer
+// module types when loading programs
+func kernelModuleBtfFd(module string) (int, error) {
+	id, err := GetNextBtfId(0)
+	for ; err == nil; id, err = GetNextBtfId(id) {
+		info, err := GetBtfInfoById(id)
+		if err != nil {
+			// BTF may be gone in between
+			continue
+		}
+		if info.Kernel && info.Name == module {
+			return info.Fd, nil
+		}
+		closeFd(info.Fd)
+	}
+	if err != ErrNoMoreIds {
+		return 0, err
+	}
+
+	return 0, fmt.Errorf("BTF object of kernel module '%s' not found", module)
+}
+
+// Opens BTF objects of modules to be passed as fd_array of program load:
+// module of index i is referred as i+1, 0 is vmlinux
+func kernelModulesBtfFds(modules []string) ([]int32, error) {
+	fds := make([]int32, len(modules)+1)
+	for i, module := range modules {
+		fd, err := kernelModuleBtfFd(module)
+		if err != nil {
+			closeBtfFds(fds)
+			return nil, err
+		}
+		fds[i+1] = int32(fd)
+	}
+
+	return fds, nil
+}
+
+func closeBtfFds(fds []int32) {
+	for _, fd := range fds {
+		if fd != 0 {
+			closeFd(int(fd))
+		}
+	}
+}
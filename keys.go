@@ -0,0 +1,352 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+)
+
+// Typed keys / values of common networking maps. Unlike plain integers (which
+// are in host byte order), addresses, ports and VLAN IDs are stored in network
+// byte order, exactly as eBPF program reads them from packet (iph->saddr,
+// tcph->dest, etc), so keys built in Go match ones built by program.
+// All of them implement encoding.BinaryMarshaler, so they can be passed to map
+// methods directly, and encoding.BinaryUnmarshaler to decode raw keys / values:
+//
+//	m.Insert(goebpf.MustIPv4Key("10.0.0.1"), 1)
+//
+//	var key goebpf.FlowKey
+//	err := key.UnmarshalBinary(rawKey)
+
+// IPv4Key is IPv4 address, __be32 in eBPF program
+type IPv4Key [4]byte
+
+// NewIPv4Key creates key from IPv4 address
+func NewIPv4Key(ip net.IP) (IPv4Key, error) {
+	var k IPv4Key
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return k, fmt.Errorf("'%v' is not IPv4 address", ip)
+	}
+	copy(k[:], ip4)
+	return k, nil
+}
+
+// MustIPv4Key creates key from string representation of IPv4 address, panics if it is invalid
+func MustIPv4Key(s string) IPv4Key {
+	k, err := NewIPv4Key(net.ParseIP(s))
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// IP returns address of key
+func (k IPv4Key) IP() net.IP {
+	return net.IPv4(k[0], k[1], k[2], k[3])
+}
+
+func (k IPv4Key) String() string {
+	return k.IP().String()
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (k IPv4Key) MarshalBinary() ([]byte, error) {
+	return k[:], nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (k *IPv4Key) UnmarshalBinary(data []byte) error {
+	return unmarshalFixed(k[:], data, "IPv4 address")
+}
+
+// IPv6Key is IPv6 address, struct in6_addr in eBPF program
+type IPv6Key [16]byte
+
+// NewIPv6Key creates key from IPv6 address. IPv4 addresses are IPv4-mapped (::ffff:a.b.c.d).
+func NewIPv6Key(ip net.IP) (IPv6Key, error) {
+	var k IPv6Key
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return k, fmt.Errorf("'%v' is not IP address", ip)
+	}
+	copy(k[:], ip16)
+	return k, nil
+}
+
+// MustIPv6Key creates key from string representation of IPv6 address, panics if it is invalid
+func MustIPv6Key(s string) IPv6Key {
+	k, err := NewIPv6Key(net.ParseIP(s))
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// IP returns address of key
+func (k IPv6Key) IP() net.IP {
+	return net.IP(append([]byte(nil), k[:]...))
+}
+
+func (k IPv6Key) String() string {
+	return k.IP().String()
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (k IPv6Key) MarshalBinary() ([]byte, error) {
+	return k[:], nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (k *IPv6Key) UnmarshalBinary(data []byte) error {
+	return unmarshalFixed(k[:], data, "IPv6 address")
+}
+
+// MacKey is MAC address, unsigned char[ETH_ALEN] in eBPF program
+// (e.g. h_source of struct ethhdr)
+type MacKey [6]byte
+
+// NewMacKey creates key from 48 bit MAC address
+func NewMacKey(mac net.HardwareAddr) (MacKey, error) {
+	var k MacKey
+	if len(mac) != len(k) {
+		return k, fmt.Errorf("'%v' is not 48 bit MAC address", mac)
+	}
+	copy(k[:], mac)
+	return k, nil
+}
+
+// MustMacKey creates key from string representation of MAC address, panics if it is invalid
+func MustMacKey(s string) MacKey {
+	mac, err := net.ParseMAC(s)
+	if err != nil {
+		panic(err)
+	}
+	k, err := NewMacKey(mac)
+	if err != nil {
+		panic(err)
+	}
+	return k
+}
+
+// HardwareAddr returns MAC address of key
+func (k MacKey) HardwareAddr() net.HardwareAddr {
+	return net.HardwareAddr(append([]byte(nil), k[:]...))
+}
+
+func (k MacKey) String() string {
+	return k.HardwareAddr().String()
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (k MacKey) MarshalBinary() ([]byte, error) {
+	return k[:], nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (k *MacKey) UnmarshalBinary(data []byte) error {
+	return unmarshalFixed(k[:], data, "MAC address")
+}
+
+// VlanKey is 802.1Q VLAN ID, __be16 in eBPF program:
+//
+//	__be16 vlan = vhdr->h_vlan_TCI & bpf_htons(VLAN_VID_MASK);
+type VlanKey uint16
+
+// Max VLAN ID, VLAN_VID_MASK
+const vlanVidMask = 0x0fff
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (k VlanKey) MarshalBinary() ([]byte, error) {
+	if k > vlanVidMask {
+		return nil, fmt.Errorf("Invalid VLAN ID %d", k)
+	}
+	res := make([]byte, 2)
+	binary.BigEndian.PutUint16(res, uint16(k))
+	return res, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (k *VlanKey) UnmarshalBinary(data []byte) error {
+	var raw [2]byte
+	if err := unmarshalFixed(raw[:], data, "VLAN ID"); err != nil {
+		return err
+	}
+	*k = VlanKey(binary.BigEndian.Uint16(raw[:]) & vlanVidMask)
+	return nil
+}
+
+// PortKey is TCP / UDP port, __be16 in eBPF program (e.g. tcph->dest)
+type PortKey uint16
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (k PortKey) MarshalBinary() ([]byte, error) {
+	return Be16(k).MarshalBinary()
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (k *PortKey) UnmarshalBinary(data []byte) error {
+	return (*Be16)(k).UnmarshalBinary(data)
+}
+
+// Be16, Be32 and Be64 are integers in network (big endian) byte order,
+// __be16 / __be32 / __be64 in eBPF program. Plain Go integers are always
+// encoded in host byte order, so values program compares with bpf_htons() /
+// bpf_htonl() results must be wrapped:
+//
+//	m.Upsert(goebpf.Be32(0x0a000001), uint32(1))
+type Be16 uint16
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (v Be16) MarshalBinary() ([]byte, error) {
+	res := make([]byte, 2)
+	binary.BigEndian.PutUint16(res, uint16(v))
+	return res, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (v *Be16) UnmarshalBinary(data []byte) error {
+	var raw [2]byte
+	if err := unmarshalFixed(raw[:], data, "__be16"); err != nil {
+		return err
+	}
+	*v = Be16(binary.BigEndian.Uint16(raw[:]))
+	return nil
+}
+
+// Be32 is __be32, see Be16
+type Be32 uint32
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (v Be32) MarshalBinary() ([]byte, error) {
+	res := make([]byte, 4)
+	binary.BigEndian.PutUint32(res, uint32(v))
+	return res, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (v *Be32) UnmarshalBinary(data []byte) error {
+	var raw [4]byte
+	if err := unmarshalFixed(raw[:], data, "__be32"); err != nil {
+		return err
+	}
+	*v = Be32(binary.BigEndian.Uint32(raw[:]))
+	return nil
+}
+
+// Be64 is __be64, see Be16
+type Be64 uint64
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (v Be64) MarshalBinary() ([]byte, error) {
+	res := make([]byte, 8)
+	binary.BigEndian.PutUint64(res, uint64(v))
+	return res, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (v *Be64) UnmarshalBinary(data []byte) error {
+	var raw [8]byte
+	if err := unmarshalFixed(raw[:], data, "__be64"); err != nil {
+		return err
+	}
+	*v = Be64(binary.BigEndian.Uint64(raw[:]))
+	return nil
+}
+
+// FlowKey is 5-tuple of TCP / UDP flow. Binary representation depends on
+// address family, IPv4 one is 16 bytes:
+//
+//	struct flow_key {
+//		__be32 saddr;
+//		__be32 daddr;
+//		__be16 sport;
+//		__be16 dport;
+//		__u8 proto;
+//		__u8 pad[3];
+//	};
+//
+// IPv6 one is the same, but with struct in6_addr addresses (40 bytes).
+type FlowKey struct {
+	Src      net.IP
+	Dst      net.IP
+	SrcPort  uint16
+	DstPort  uint16
+	Protocol uint8
+}
+
+// Sizes of binary representation of FlowKey
+const (
+	flowKeyIPv4Size = 16
+	flowKeyIPv6Size = 40
+)
+
+func (k FlowKey) String() string {
+	return fmt.Sprintf("%d %s -> %s",
+		k.Protocol,
+		net.JoinHostPort(k.Src.String(), fmt.Sprint(k.SrcPort)),
+		net.JoinHostPort(k.Dst.String(), fmt.Sprint(k.DstPort)))
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler.
+// Both addresses must be of the same family.
+func (k FlowKey) MarshalBinary() ([]byte, error) {
+	src4, dst4 := k.Src.To4(), k.Dst.To4()
+	src16, dst16 := k.Src.To16(), k.Dst.To16()
+
+	var res []byte
+	var addrLen int
+	switch {
+	case src4 != nil && dst4 != nil:
+		res = make([]byte, flowKeyIPv4Size)
+		addrLen = net.IPv4len
+		copy(res, src4)
+		copy(res[addrLen:], dst4)
+	case src4 == nil && dst4 == nil && src16 != nil && dst16 != nil:
+		res = make([]byte, flowKeyIPv6Size)
+		addrLen = net.IPv6len
+		copy(res, src16)
+		copy(res[addrLen:], dst16)
+	default:
+		return nil, fmt.Errorf("Addresses of flow %v are not of the same family", k)
+	}
+	binary.BigEndian.PutUint16(res[2*addrLen:], k.SrcPort)
+	binary.BigEndian.PutUint16(res[2*addrLen+2:], k.DstPort)
+	res[2*addrLen+4] = k.Protocol
+
+	return res, nil
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler,
+// address family is detected by size of data
+func (k *FlowKey) UnmarshalBinary(data []byte) error {
+	var addrLen int
+	switch len(data) {
+	case flowKeyIPv4Size:
+		addrLen = net.IPv4len
+	case flowKeyIPv6Size:
+		addrLen = net.IPv6len
+	default:
+		return fmt.Errorf("Invalid flow key size %d, must be %d or %d bytes",
+			len(data), flowKeyIPv4Size, flowKeyIPv6Size)
+	}
+	k.Src = net.IP(append([]byte(nil), data[:addrLen]...))
+	k.Dst = net.IP(append([]byte(nil), data[addrLen:2*addrLen]...))
+	k.SrcPort = binary.BigEndian.Uint16(data[2*addrLen:])
+	k.DstPort = binary.BigEndian.Uint16(data[2*addrLen+2:])
+	k.Protocol = data[2*addrLen+4]
+
+	return nil
+}
+
+// Copies data of exactly len(dst) bytes into dst
+func unmarshalFixed(dst, data []byte, what string) error {
+	if len(data) != len(dst) {
+		return fmt.Errorf("Invalid %s size %d, must be %d bytes", what, len(data), len(dst))
+	}
+	copy(dst, data)
+	return nil
+}
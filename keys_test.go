@@ -0,0 +1,160 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPv4Key(t *testing.T) {
+	k := MustIPv4Key("10.1.2.3")
+	data, err := KeyValueToBytes(k, 4)
+	require.NoError(t, err)
+	// Network byte order regardless of host one
+	assert.Equal(t, []byte{10, 1, 2, 3}, data)
+	assert.Equal(t, "10.1.2.3", k.String())
+	assert.True(t, net.ParseIP("10.1.2.3").Equal(k.IP()))
+
+	var k2 IPv4Key
+	require.NoError(t, k2.UnmarshalBinary(data))
+	assert.Equal(t, k, k2)
+	assert.Error(t, k2.UnmarshalBinary(data[:3]))
+
+	_, err = NewIPv4Key(net.ParseIP("::1"))
+	assert.Error(t, err)
+	// Doesn't fit
+	_, err = KeyValueToBytes(k, 3)
+	assert.Error(t, err)
+}
+
+func TestIPv6Key(t *testing.T) {
+	k := MustIPv6Key("fc00::1")
+	data, err := KeyValueToBytes(k, 16)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0xfc, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1}, data)
+	assert.Equal(t, "fc00::1", k.String())
+
+	var k2 IPv6Key
+	require.NoError(t, k2.UnmarshalBinary(data))
+	assert.Equal(t, k, k2)
+
+	// IPv4-mapped
+	k4 := MustIPv6Key("1.2.3.4")
+	assert.Equal(t, []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff, 1, 2, 3, 4}, k4[:])
+}
+
+func TestMacKey(t *testing.T) {
+	k := MustMacKey("00:11:22:aa:bb:cc")
+	data, err := KeyValueToBytes(k, 6)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 0x11, 0x22, 0xaa, 0xbb, 0xcc}, data)
+	assert.Equal(t, "00:11:22:aa:bb:cc", k.String())
+
+	var k2 MacKey
+	require.NoError(t, k2.UnmarshalBinary(data))
+	assert.Equal(t, k, k2)
+
+	// EUI-64
+	_, err = NewMacKey(net.HardwareAddr{1, 2, 3, 4, 5, 6, 7, 8})
+	assert.Error(t, err)
+}
+
+func TestVlanKey(t *testing.T) {
+	data, err := KeyValueToBytes(VlanKey(0x123), 2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x01, 0x23}, data)
+
+	var k VlanKey
+	// PCP / DEI bits are masked out
+	require.NoError(t, k.UnmarshalBinary([]byte{0xf1, 0x23}))
+	assert.Equal(t, VlanKey(0x123), k)
+
+	_, err = KeyValueToBytes(VlanKey(4096), 2)
+	assert.Error(t, err)
+}
+
+func TestNetworkOrderIntegers(t *testing.T) {
+	data, err := KeyValueToBytes(PortKey(443), 2)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0x01, 0xbb}, data)
+	var port PortKey
+	require.NoError(t, port.UnmarshalBinary(data))
+	assert.Equal(t, PortKey(443), port)
+
+	data, err = KeyValueToBytes(Be32(0x0a000001), 4)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{10, 0, 0, 1}, data)
+	var v32 Be32
+	require.NoError(t, v32.UnmarshalBinary(data))
+	assert.Equal(t, Be32(0x0a000001), v32)
+
+	data, err = KeyValueToBytes(Be64(0x0102030405060708), 8)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, data)
+	var v64 Be64
+	require.NoError(t, v64.UnmarshalBinary(data))
+	assert.Equal(t, Be64(0x0102030405060708), v64)
+
+	// Size must match exactly
+	var v16 Be16
+	assert.EqualError(t, v16.UnmarshalBinary([]byte{1, 2, 3, 4}), "Invalid __be16 size 4, must be 2 bytes")
+	assert.Error(t, v32.UnmarshalBinary([]byte{1, 2}))
+	_, err = KeyValueToBytes(Be32(1), 2)
+	assert.Error(t, err)
+}
+
+func TestFlowKey(t *testing.T) {
+	k := FlowKey{
+		Src:      net.ParseIP("10.0.0.1"),
+		Dst:      net.ParseIP("10.0.0.2"),
+		SrcPort:  12345,
+		DstPort:  80,
+		Protocol: 6,
+	}
+	data, err := KeyValueToBytes(k, flowKeyIPv4Size)
+	require.NoError(t, err)
+	assert.Equal(t, []byte{
+		10, 0, 0, 1, // saddr
+		10, 0, 0, 2, // daddr
+		0x30, 0x39, // sport
+		0, 80, // dport
+		6,       // proto
+		0, 0, 0, // pad
+	}, data)
+	assert.Equal(t, "6 10.0.0.1:12345 -> 10.0.0.2:80", k.String())
+
+	var k2 FlowKey
+	require.NoError(t, k2.UnmarshalBinary(data))
+	assert.True(t, k.Src.Equal(k2.Src))
+	assert.True(t, k.Dst.Equal(k2.Dst))
+	assert.Equal(t, k.SrcPort, k2.SrcPort)
+	assert.Equal(t, k.DstPort, k2.DstPort)
+	assert.Equal(t, k.Protocol, k2.Protocol)
+
+	// IPv6
+	k6 := FlowKey{
+		Src:      net.ParseIP("fc00::1"),
+		Dst:      net.ParseIP("fc00::2"),
+		SrcPort:  53,
+		DstPort:  1024,
+		Protocol: 17,
+	}
+	data, err = k6.MarshalBinary()
+	require.NoError(t, err)
+	require.Len(t, data, flowKeyIPv6Size)
+	assert.Equal(t, []byte{0, 53, 4, 0, 17, 0, 0, 0}, data[32:])
+	require.NoError(t, k2.UnmarshalBinary(data))
+	assert.Equal(t, "17 [fc00::1]:53 -> [fc00::2]:1024", k2.String())
+
+	// Mixed address families / missing address
+	_, err = FlowKey{Src: net.ParseIP("10.0.0.1"), Dst: net.ParseIP("fc00::1")}.MarshalBinary()
+	assert.Error(t, err)
+	_, err = FlowKey{Src: net.ParseIP("10.0.0.1")}.MarshalBinary()
+	assert.Error(t, err)
+	assert.Error(t, k2.UnmarshalBinary(make([]byte, 20)))
+}
@@ -0,0 +1,163 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// LinkFilter selects links returned by ListLinks(), zero fields match any link
+type LinkFilter struct {
+	Type      LinkType
+	ProgramId int
+	// Network interface of XDP / TCX / Netkit link
+	Ifindex int
+}
+
+func (f LinkFilter) match(info *LinkInfo) bool {
+	if f.Type != LinkTypeUnspec && f.Type != info.Type {
+		return false
+	}
+	if f.ProgramId != 0 && f.ProgramId != info.ProgramId {
+		return false
+	}
+	if f.Ifindex != 0 && f.Ifindex != info.Ifindex {
+		return false
+	}
+
+	return true
+}
+
+// ListLinks returns information about all BPF links of the system matching
+// filter, e.g. links left by crashed previous instance. Links are not kept
+// open (Fd of returned infos is 0), use OpenLink() to detach / update them.
+func ListLinks(filter LinkFilter) ([]*LinkInfo, error) {
+	var res []*LinkInfo
+
+	id, err := GetNextLinkId(0)
+	for ; err == nil; id, err = GetNextLinkId(id) {
+		fd, err := ebpfGetFdById(bpfCmdLinkGetFdById, "ebpf_link_get_fd_by_id()", id)
+		if err != nil {
+			// Link may be gone in between
+			continue
+		}
+		info, err := GetLinkInfoByFd(fd)
+		closeFd(fd)
+		if err != nil {
+			return nil, err
+		}
+		info.Fd = 0
+		if filter.match(info) {
+			res = append(res, info)
+		}
+	}
+	if err != ErrNoMoreIds {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Link is BPF link not created by this process (e.g. by previous instance),
+// opened by ID or pin path. Closing link does not detach program as long as
+// link is pinned or held by someone else, Detach() does.
+type Link struct {
+	fd   int
+	info *LinkInfo
+}
+
+// OpenLink opens BPF link by ID, see ListLinks()
+func OpenLink(id int) (*Link, error) {
+	fd, err := ebpfGetFdById(bpfCmdLinkGetFdById, "ebpf_link_get_fd_by_id()", id)
+	if err != nil {
+		return nil, err
+	}
+
+	return newLink(fd)
+}
+
+// OpenPinnedLink opens BPF link pinned to bpffs
+func OpenPinnedLink(path string) (*Link, error) {
+	fd, err := ebpfObjGet(path, 0)
+	if err != nil {
+		return nil, newSyscallError(fmt.Sprintf("ebpf_obj_get('%s')", path), err, nil)
+	}
+
+	return newLink(fd)
+}
+
+// NewLinkFromFd creates Link of link fd received from elsewhere, e.g. passed
+// by parent process / systemd. Link takes ownership of fd.
+func NewLinkFromFd(fd int) (*Link, error) {
+	return newLink(fd)
+}
+
+func newLink(fd int) (*Link, error) {
+	info, err := GetLinkInfoByFd(fd)
+	if err != nil {
+		closeFd(fd)
+		return nil, err
+	}
+
+	return &Link{fd: fd, info: info}, nil
+}
+
+// GetFd returns file descriptor of link
+func (l *Link) GetFd() int {
+	return l.fd
+}
+
+// Info returns information about link at the moment it was opened
+func (l *Link) Info() *LinkInfo {
+	return l.info
+}
+
+// Pin saves link into given location of bpffs, so it outlives process
+func (l *Link) Pin(path string) error {
+	return ebpfObjPin(l.fd, path)
+}
+
+// Update atomically replaces program of link with prog (linux 5.7+).
+// If old is not nil, replace is done only if old is still attached.
+func (l *Link) Update(prog Program, old Program) error {
+	if prog.GetFd() == 0 {
+		return errors.New("Program is not loaded")
+	}
+	attr := bpfLinkUpdateAttr{
+		linkFd:    uint32(l.fd),
+		newProgFd: uint32(prog.GetFd()),
+	}
+	if old != nil {
+		attr.flags = bpfFReplace
+		attr.oldProgFd = uint32(old.GetFd())
+	}
+	_, err := bpfSyscall(bpfCmdLinkUpdate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return newSyscallError("ebpf_link_update()", err, nil)
+	}
+
+	return nil
+}
+
+// Detach detaches program of link from its target (linux 5.9+), even if
+// link is pinned / held by other processes. Link stays open, see Close().
+func (l *Link) Detach() error {
+	attr := bpfLinkUpdateAttr{
+		linkFd: uint32(l.fd),
+	}
+	_, err := bpfSyscall(bpfCmdLinkDetach, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	countOperation(MetricDetaches, MetricDetachFailures, err)
+	if err != nil {
+		return newSyscallError("ebpf_link_detach()", err, nil)
+	}
+
+	return nil
+}
+
+// Close closes link fd
+func (l *Link) Close() error {
+	return closeFd(l.fd)
+}
@@ -10,9 +10,11 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"path/filepath"
+	"sort"
 	"strings"
 
-	"golang.org/x/sys/unix"
+	"github.com/vishvananda/netlink"
 )
 
 const (
@@ -27,25 +29,73 @@ const (
 	// Other BPF constants that are not present in "golang.org/x/sys/unix"
 	bpfDw          = 0x18 // ld/ldx double word
 	bpfPseudoMapFd = 1    // pseudo map fd (to be replaced with actual fd)
+
+	// Call of kernel function (kfunc) by BTF ID instead of helper number
+	bpfPseudoKfuncCall = 2
 )
 
 // Supported ELF section names and function how to create program of it type
 type programCreator func(name, license string, bytecode []byte) Program
 
+// All programs embed BaseProgram, so loader can set common fields regardless of program type
+type baseProgramAccessor interface {
+	base() *BaseProgram
+}
+
 var sectionNameToProgramType = map[string]programCreator{
 	"xdp":           newXdpProgram,
 	"socket_filter": newSocketFilterProgram,
+	"perf_event":    newPerfEventProgram,
+	"sockops":       newSockOpsProgram,
+	"tracepoint":    newTracepointProgram,
+	"uprobe":        newUprobeProgram(false),
+	"uretprobe":     newUprobeProgram(true),
+	"cgroup_skb":    newCgroupSkbProgram,
+	"sk_lookup":     newSkLookupProgram,
+	"lwt_in":        newLwtProgram(ProgramTypeLwtIn),
+	"lwt_out":       newLwtProgram(ProgramTypeLwtOut),
+	"lwt_xmit":      newLwtProgram(ProgramTypeLwtXmit),
+	"lwt_seg6local": newLwtProgram(ProgramTypeLwtSeg6Local),
+	// Direction is given on attach, libbpf style names are accepted for convenience
+	"cgroup_skb/ingress": newCgroupSkbProgram,
+	"cgroup_skb/egress":  newCgroupSkbProgram,
+}
+
+// Prefix of section name marking programs as load on demand (never autoloaded),
+// the same convention as libbpf uses, e.g. SEC("?xdp")
+const onDemandSectionPrefix = "?"
+
+// Returns program creator for ELF section and whether programs of section are load on demand
+func programSectionType(sectionName string) (programCreator, bool, bool) {
+	name := strings.ToLower(sectionName)
+	onDemand := strings.HasPrefix(name, onDemandSectionPrefix)
+	name = strings.TrimPrefix(name, onDemandSectionPrefix)
+	// LSM programs are bound to hook given by section name, SEC("lsm/file_open")
+	if strings.HasPrefix(name, lsmSectionPrefix) {
+		return newLSMProgram(strings.TrimPrefix(name, lsmSectionPrefix)), onDemand, true
+	}
+	// Tracing programs are bound to kernel function, SEC("fentry/tcp_connect"),
+	// which name is case sensitive
+	if strings.HasPrefix(name, fentrySectionPrefix) {
+		return newTracingProgram(TracingFentry, sectionName[len(sectionName)-len(name)+len(fentrySectionPrefix):]), onDemand, true
+	}
+	if strings.HasPrefix(name, fexitSectionPrefix) {
+		return newTracingProgram(TracingFexit, sectionName[len(sectionName)-len(name)+len(fexitSectionPrefix):]), onDemand, true
+	}
+	create, ok := sectionNameToProgramType[name]
+	return create, onDemand, ok
 }
 
 // BPF instruction //
 // Must be in sync with linux/bpf.h:
-// 	struct bpf_insn {
-// 		__u8	code;		/* opcode */
-// 		__u8	dst_reg:4;	/* dest register */
-// 		__u8	src_reg:4;	/* source register */
-// 		__s16	off;		/* signed offset */
-// 		__s32	imm;		/* signed immediate constant */
-// 	};
+//
+//	struct bpf_insn {
+//		__u8	code;		/* opcode */
+//		__u8	dst_reg:4;	/* dest register */
+//		__u8	src_reg:4;	/* source register */
+//		__s16	off;		/* signed offset */
+//		__s32	imm;		/* signed immediate constant */
+//	};
 type bpfInstruction struct {
 	code   uint8  // Opcode
 	dstReg uint8  // 4 bits: destination register, r0-r10
@@ -54,28 +104,38 @@ type bpfInstruction struct {
 	imm    uint32 // Immediate constant
 }
 
-// Loads BPF instruction from binary slice
-func (b *bpfInstruction) load(data []byte) error {
+// Loads BPF instruction from binary slice.
+// Register nibbles are swapped for big endian, like C bit fields of struct bpf_insn.
+func (b *bpfInstruction) load(data []byte, bo binary.ByteOrder) error {
 	if len(data) < bpfInstructionLen {
 		return errors.New("Invalid BPF bytecode")
 	}
 
 	b.code = data[0]
-	b.dstReg = data[1] & 0xf
-	b.srcReg = data[1] >> 4
-	b.offset = binary.LittleEndian.Uint16(data[2:])
-	b.imm = binary.LittleEndian.Uint32(data[4:])
+	if bo == binary.BigEndian {
+		b.dstReg = data[1] >> 4
+		b.srcReg = data[1] & 0xf
+	} else {
+		b.dstReg = data[1] & 0xf
+		b.srcReg = data[1] >> 4
+	}
+	b.offset = bo.Uint16(data[2:])
+	b.imm = bo.Uint32(data[4:])
 
 	return nil
 }
 
 // Converts BPF instruction into bytes
-func (b *bpfInstruction) save() []byte {
+func (b *bpfInstruction) save(bo binary.ByteOrder) []byte {
 	res := make([]byte, bpfInstructionLen)
 	res[0] = b.code
-	res[1] = (b.srcReg << 4) | (b.dstReg & 0x0f)
-	binary.LittleEndian.PutUint16(res[2:], b.offset)
-	binary.LittleEndian.PutUint32(res[4:], b.imm)
+	if bo == binary.BigEndian {
+		res[1] = (b.dstReg << 4) | (b.srcReg & 0x0f)
+	} else {
+		res[1] = (b.srcReg << 4) | (b.dstReg & 0x0f)
+	}
+	bo.PutUint16(res[2:], b.offset)
+	bo.PutUint32(res[4:], b.imm)
 
 	return res
 }
@@ -133,10 +193,13 @@ func readRelocations(elfFile *elf.File, section *elf.Section) ([]relocationItem,
 			return nil, err
 		}
 		// Ensure that symbol exists
-		if symbolIndex >= len(symbols) {
+		if symbolIndex < 0 || symbolIndex >= len(symbols) {
 			return nil, fmt.Errorf("Invalid RELO '%v': symbol index %v does not exist",
 				section, symbolIndex)
 		}
+		if offset < 0 {
+			return nil, fmt.Errorf("Invalid RELO '%v': offset %d", section, offset)
+		}
 		result = append(result, relocationItem{
 			offset: offset,
 			symbol: symbols[symbolIndex],
@@ -144,7 +207,97 @@ func readRelocations(elfFile *elf.File, section *elf.Section) ([]relocationItem,
 	}
 }
 
-func loadAndCreateMaps(elfFile *elf.File) (map[string]Map, error) {
+// Program defined in ELF section: symbol name and location of its bytecode
+type elfProgramSymbol struct {
+	name   string
+	offset int
+	size   int
+}
+
+// Returns all programs (GLOBAL symbols) of section, ordered by offset
+func sectionPrograms(symbols []elf.Symbol, sectionIndex int, sectionSize int) []elfProgramSymbol {
+	var result []elfProgramSymbol
+	for _, symbol := range symbols {
+		if int(symbol.Section) != sectionIndex || elf.ST_BIND(symbol.Info) != elf.STB_GLOBAL {
+			continue
+		}
+		result = append(result, elfProgramSymbol{name: symbol.Name, offset: int(symbol.Value)})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].offset < result[j].offset
+	})
+	// Program lasts till beginning of next one
+	for idx := range result {
+		end := sectionSize
+		if idx+1 < len(result) {
+			end = result[idx+1].offset
+		}
+		result[idx].size = end - result[idx].offset
+	}
+	return result
+}
+
+// Returns program which contains given offset of section, or nil
+func programAtOffset(programs []elfProgramSymbol, offset int) *elfProgramSymbol {
+	for idx := range programs {
+		if offset >= programs[idx].offset && offset < programs[idx].offset+programs[idx].size {
+			return &programs[idx]
+		}
+	}
+	return nil
+}
+
+// Checks if program should be loaded by LoadElf(), see WithAutoload()
+func (s *ebpfSystem) autoloadSelected(prog Program) bool {
+	if s.autoloadFilter != nil {
+		return s.autoloadFilter(prog.GetName())
+	}
+	return s.autoload && !prog.(baseProgramAccessor).base().onDemand
+}
+
+// Checks if program should be read from ELF, see WithProgramFilter()
+func (s *ebpfSystem) programSelected(name string) bool {
+	return s.programFilter == nil || s.programFilter(name)
+}
+
+// Returns names of maps used by selected programs
+func (s *ebpfSystem) referencedMaps(elfFile *elf.File) (map[string]bool, error) {
+	symbols, err := elfFile.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("elf.Symbols() failed: %v", err)
+	}
+
+	result := map[string]bool{}
+	for sectionIndex, section := range elfFile.Sections {
+		if section.Type != elf.SHT_PROGBITS {
+			continue
+		}
+		if _, _, ok := programSectionType(section.Name); !ok {
+			continue
+		}
+		programs := sectionPrograms(symbols, sectionIndex, int(section.Size))
+		for _, reloSection := range elfFile.Sections {
+			if reloSection.Type != elf.SHT_REL || int(reloSection.Info) != sectionIndex {
+				continue
+			}
+			relocations, err := readRelocations(elfFile, reloSection)
+			if err != nil {
+				return nil, fmt.Errorf("readRelocations() failed: %v", err)
+			}
+			for _, relo := range relocations {
+				if prog := programAtOffset(programs, relo.offset); prog != nil && s.programSelected(prog.name) {
+					result[relo.symbol.Name] = true
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// Reads all maps from ELF file and creates them in kernel.
+// Maps from reuse with the same definition are used instead of creating new ones (reload case).
+// If needed is not nil, only maps from needed (and their inner maps) are created.
+func (s *ebpfSystem) loadAndCreateMaps(elfFile *elf.File, ifindex int, reuse map[string]Map, needed map[string]bool) (map[string]Map, error) {
 	// Read ELF symbols
 	symbols, err := elfFile.Symbols()
 	if err != nil {
@@ -162,17 +315,19 @@ func loadAndCreateMaps(elfFile *elf.File) (map[string]Map, error) {
 	}
 	if mapSection == nil {
 		// eBPF programs may live without maps - not an error
+		s.logger.Printf("goebpf: no '%s' section found", MapSectionName)
 		return map[string]Map{}, nil
 	}
 
 	// Read and parse map definitions from designated ELF section
 	mapsByIndex := []*EbpfMap{}
+	unknownMaps := map[string]bool{}
 	data, err := mapSection.Data()
 	if err != nil {
 		return nil, fmt.Errorf("Failed to read '%s' section data: %v", mapSection.Name, err)
 	}
 	for offset := 0; offset < len(data); offset += mapDefinitionSize {
-		m, err := newMapFromElfSection(data[offset:])
+		m, err := newMapFromElfSection(data[offset:], elfFile.ByteOrder)
 		if err != nil {
 			return nil, err
 		}
@@ -188,6 +343,16 @@ func loadAndCreateMaps(elfFile *elf.File) (map[string]Map, error) {
 		if m.Name == "" {
 			return nil, fmt.Errorf("Unable to get map name (section offset=%d)", offset)
 		}
+		s.logger.Printf("goebpf: found map '%s' (%v) at offset %d of '%s' section",
+			m.Name, m.Type, offset, mapSection.Name)
+		// Map types unknown to library are passed to kernel as is by default
+		if m.Type.String() == "Unknown" && s.elfCompat != ElfCompatDefault {
+			err = s.unsupported(true, mapSection.Name, "Map '%s' has unknown type %d", m.Name, int(m.Type))
+			if err != nil {
+				return nil, err
+			}
+			unknownMaps[m.Name] = true
+		}
 		mapsByIndex = append(mapsByIndex, m)
 	}
 
@@ -227,21 +392,84 @@ func loadAndCreateMaps(elfFile *elf.File) (map[string]Map, error) {
 				// 	  void *inner_map_def;
 				// Symbol name is actually variable name ("inner_map_def" for given example)
 				mapsByIndex[mapIndex].InnerMapName = relo.symbol.Name
+				s.logger.Printf("goebpf: map '%s' uses '%s' as inner map",
+					mapsByIndex[mapIndex].Name, relo.symbol.Name)
 			} else if mapOffset == mapDefinitionPersistentOffset {
 				// RELO for
 				//    const char  *persistent_path;
 				// Since it points to string - reading it value from section
 				// where this REL points to
+				if int(relo.symbol.Section) >= len(elfFile.Sections) {
+					return nil, fmt.Errorf("Invalid RELO: symbol '%s' section %d does not exist",
+						relo.symbol.Name, relo.symbol.Section)
+				}
 				sec := elfFile.Sections[relo.symbol.Section]
 				sdata, err := sec.Data()
 				if err != nil {
 					return nil, fmt.Errorf("Unable to read '%s' section data: %v", sec.Name, err)
 				}
+				if relo.symbol.Value >= uint64(len(sdata)) {
+					return nil, fmt.Errorf("Invalid RELO: symbol '%s' offset %d is out of '%s' section",
+						relo.symbol.Name, relo.symbol.Value, sec.Name)
+				}
 				// Section data contains null terminated string and
 				// symbol.Value holds offset in this data
 				mapsByIndex[mapIndex].PersistentPath = NullTerminatedStringToString(sdata[relo.symbol.Value:])
-			} else {
-				return nil, fmt.Errorf("Unknown map RELO offset %d", mapOffset)
+				s.logger.Printf("goebpf: map '%s' persistent path is '%s'",
+					mapsByIndex[mapIndex].Name, mapsByIndex[mapIndex].PersistentPath)
+			} else if err := s.unsupported(false, reloSection.Name, "Unknown map RELO offset %d", mapOffset); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	// Maps with special fields in values (bpf_timer, bpf_spin_lock) need BTF,
+	// as well as maps to be migrated
+	for _, item := range mapsByIndex {
+		if migrate, ok := s.mapMigrations[item.Name]; ok {
+			item.Migrate = migrate
+		}
+	}
+	btfData, err := s.readMapsBtf(elfFile, mapsByIndex)
+	if err != nil {
+		return nil, err
+	}
+	if btfData != nil && !s.parseOnly {
+		btfFd, err := s.loadMapsBtf(btfData, mapsByIndex)
+		if err != nil {
+			return nil, err
+		}
+		if btfFd != 0 {
+			for _, item := range mapsByIndex {
+				if item.btfValueTypeId != 0 {
+					item.btfFd = btfFd
+				}
+			}
+			// Maps keep reference to BTF, so it is not needed once they are created
+			defer func() {
+				closeFd(btfFd)
+				for _, item := range mapsByIndex {
+					item.btfFd = 0
+				}
+			}()
+		}
+	}
+
+	// Selective loading: maps selected explicitly and inner map templates
+	// of needed maps are needed as well
+	if needed != nil {
+		for _, item := range mapsByIndex {
+			if s.mapFilter != nil && s.mapFilter(item.Name) {
+				needed[item.Name] = true
+			}
+		}
+		for changed := true; changed; {
+			changed = false
+			for _, item := range mapsByIndex {
+				if needed[item.Name] && item.InnerMapName != "" && !needed[item.InnerMapName] {
+					needed[item.InnerMapName] = true
+					changed = true
+				}
 			}
 		}
 	}
@@ -249,25 +477,82 @@ func loadAndCreateMaps(elfFile *elf.File) (map[string]Map, error) {
 	// Create maps / add to result map
 	result := map[string]Map{}
 	for _, item := range mapsByIndex {
+		if unknownMaps[item.Name] {
+			continue
+		}
+		if needed != nil && !needed[item.Name] {
+			s.logger.Printf("goebpf: map '%s' is not used by selected programs, skipped", item.Name)
+			continue
+		}
 		// Map of maps use case
 		if item.InnerMapName != "" {
 			if innerMap, ok := result[item.InnerMapName]; ok {
 				item.InnerMapFd = innerMap.GetFd()
+				item.innerTemplate, _ = innerMap.(*EbpfMap)
 			} else {
+				closeMaps(result, reuse)
 				return nil, fmt.Errorf("Inner map '%s' does not exist", item.InnerMapName)
 			}
 		}
+		// Apply runtime configuration of system
+		item.Ifindex = ifindex
+		item.TokenFd = s.tokenFd
+		item.PersistentPath = s.resolvePersistentPath(
+			s.templatePersistentPath(item.Name, item.PersistentPath))
+		item.PinPolicy = s.mapPinPolicy
+		if policy, ok := s.mapPinPolicies[item.Name]; ok {
+			item.PinPolicy = policy
+		}
+		if maxEntries, ok := s.mapMaxEntries[item.Name]; ok {
+			s.logger.Printf("goebpf: map '%s' max entries overridden: %d -> %d",
+				item.Name, item.MaxEntries, maxEntries)
+			item.MaxEntries = maxEntries
+		}
+		// Validate definition before creating map
+		if err := item.prepare(); err != nil {
+			closeMaps(result, reuse)
+			return nil, err
+		}
+		if s.elfPolicy != nil {
+			if err := s.elfPolicy.checkMap(item); err != nil {
+				closeMaps(result, reuse)
+				return nil, err
+			}
+		}
+		if s.parseOnly {
+			result[item.Name] = item
+			continue
+		}
+		// Reload case: keep existing map (and its data) if definition is the same
+		if old, ok := reuse[item.Name].(*EbpfMap); ok {
+			if old.checkCompatible(item) == nil {
+				s.logger.Printf("goebpf: map '%s' reused, fd %d", item.Name, old.GetFd())
+				result[item.Name] = old
+				continue
+			}
+			s.logger.Printf("goebpf: map '%s' definition changed, creating new one", item.Name)
+		}
+		// Per instance directory of persistent maps may not exist yet
+		if s.pinPathTemplate != "" && item.PersistentPath != "" {
+			if err := makePinDir(filepath.Dir(item.PersistentPath)); err != nil {
+				closeMaps(result, reuse)
+				return nil, fmt.Errorf("Unable to create directory for map '%s': %v", item.Name, err)
+			}
+		}
 		// Create map in kernel / add to results
 		err := item.Create()
 		if err != nil {
-			return nil, fmt.Errorf("map.Create() failed: %v", err)
+			// Do not leak maps created so far
+			closeMaps(result, reuse)
+			return nil, &LoadError{Context: "map.Create() failed", Err: err}
 		}
+		s.logger.Printf("goebpf: map '%s' created, fd %d", item.Name, item.GetFd())
 		result[item.Name] = item
 	}
 	return result, nil
 }
 
-func loadPrograms(elfFile *elf.File, maps map[string]Map) (map[string]Program, error) {
+func (s *ebpfSystem) loadPrograms(elfFile *elf.File, maps map[string]Map, ifindex int) (map[string]Program, error) {
 	// Read ELF symbols
 	symbols, err := elfFile.Symbols()
 	if err != nil {
@@ -287,6 +572,12 @@ func loadPrograms(elfFile *elf.File, maps map[string]Map) (map[string]Program, e
 		}
 	}
 
+	// bpf_metadata_* variables, bound to every program
+	metadata, err := s.readProgramMetadata(elfFile, symbols)
+	if err != nil {
+		return nil, err
+	}
+
 	// Iterate over all ELF section in order to find known sections with eBPF programs
 	result := make(map[string]Program)
 	for sectionIndex, section := range elfFile.Sections {
@@ -295,8 +586,14 @@ func loadPrograms(elfFile *elf.File, maps map[string]Map) (map[string]Program, e
 			continue
 		}
 		// Ensure that this section is known
-		createProgram, ok := sectionNameToProgramType[strings.ToLower(section.Name)]
+		createProgram, onDemand, ok := programSectionType(section.Name)
 		if !ok {
+			// Not empty code section is likely program of type not supported yet
+			if section.Flags&elf.SHF_EXECINSTR != 0 && section.Size > 0 {
+				if err := s.unsupported(true, section.Name, "Unknown program section"); err != nil {
+					return nil, err
+				}
+			}
 			continue
 		}
 
@@ -305,6 +602,24 @@ func loadPrograms(elfFile *elf.File, maps map[string]Map) (map[string]Program, e
 		if err != nil {
 			return nil, fmt.Errorf("Failed to read data for section %s: %v", section.Name, err)
 		}
+		// One section may contain multiple programs
+		programs := sectionPrograms(symbols, sectionIndex, len(bytecode))
+		// Programs with unsupported relocations, skipped in permissive mode
+		skipped := map[string]bool{}
+		// Kernel modules of kernel functions called by programs
+		kfuncModules := map[string][]string{}
+		skipProgram := func(prog *elfProgramSymbol, format string, args ...interface{}) error {
+			if prog != nil {
+				format = fmt.Sprintf("Program '%s': %s", prog.name, format)
+			}
+			if err := s.unsupported(false, section.Name, format, args...); err != nil {
+				return err
+			}
+			if prog != nil {
+				skipped[prog.name] = true
+			}
+			return nil
+		}
 
 		// Apply all relocations
 		for _, reloSection := range elfFile.Sections {
@@ -322,74 +637,251 @@ func loadPrograms(elfFile *elf.File, maps map[string]Map) (map[string]Program, e
 				if relocation.offset >= len(bytecode) {
 					return nil, fmt.Errorf("Invalid RELO offset %d", relocation.offset)
 				}
+				// Programs not selected are not loaded, so maps they use may not exist
+				prog := programAtOffset(programs, relocation.offset)
+				if prog != nil && (!s.programSelected(prog.name) || skipped[prog.name]) {
+					continue
+				}
 				// Load BPF instruction that needs to be modified ("relocated")
 				instruction := &bpfInstruction{}
-				err = instruction.load(bytecode[relocation.offset:])
+				err = instruction.load(bytecode[relocation.offset:], elfFile.ByteOrder)
 				if err != nil {
 					return nil, err
 				}
+				// Call of extern kernel function, declared with __ksym
+				if instruction.code == classJmp|jumpCall && relocation.symbol.Section == elf.SHN_UNDEF {
+					var modules []string
+					if prog != nil {
+						modules = kfuncModules[prog.name]
+					}
+					name := relocation.symbol.Name
+					err = s.relocateKernelFunc(instruction, name, &modules)
+					switch {
+					case err == nil:
+						s.logger.Printf("goebpf: section '%s' offset %d: relocated kernel function '%s' (BTF ID %d)",
+							section.Name, relocation.offset, name, instruction.imm)
+					case s.parseOnly:
+						s.logger.Printf("goebpf: section '%s' offset %d: kernel function '%s' not resolved: %v",
+							section.Name, relocation.offset, name, err)
+					default:
+						if err = skipProgram(prog, "kernel function '%s': %v", name, err); err != nil {
+							return nil, err
+						}
+						continue
+					}
+					if prog != nil {
+						kfuncModules[prog.name] = modules
+					}
+					copy(bytecode[relocation.offset:], instruction.save(elfFile.ByteOrder))
+					continue
+				}
 				// Ensure that instruction is valid
-				if instruction.code != (unix.BPF_LD | unix.BPF_IMM | bpfDw) {
-					return nil, fmt.Errorf("Invalid BPF instruction (at %d): %v",
-						relocation.offset, instruction)
+				if instruction.code != (classLd | modeImm | bpfDw) {
+					err = skipProgram(prog, "Invalid BPF instruction (at %d): %v", relocation.offset, instruction)
+					if err != nil {
+						return nil, err
+					}
+					continue
 				}
 				// Patch instruction to use proper map fd
 				mapName := relocation.symbol.Name
 				if bpfMap, ok := maps[mapName]; ok {
 					instruction.srcReg = bpfPseudoMapFd
 					instruction.imm = uint32(bpfMap.GetFd())
-					copy(bytecode[relocation.offset:], instruction.save())
-				} else {
-					return nil, fmt.Errorf("map '%s' doesn't exist", mapName)
+					copy(bytecode[relocation.offset:], instruction.save(elfFile.ByteOrder))
+					s.logger.Printf("goebpf: section '%s' offset %d: relocated map '%s' (fd %d)",
+						section.Name, relocation.offset, mapName, bpfMap.GetFd())
+				} else if err := skipProgram(prog, "map '%s' doesn't exist", mapName); err != nil {
+					return nil, err
 				}
 			}
 		}
 
-		// One section may contain multiple programs
 		// Cut section's bytecode into programs based on symbols information
-		lastOffset := len(bytecode)
-		for i := len(symbols) - 1; i >= 0; i-- {
-			// Skip symbols which are either:
-			// 1. non GLOBAL binded
-			// 2. Don't belong to current section
-			symbol := &symbols[i]
-			if int(symbol.Section) != sectionIndex || elf.ST_BIND(symbol.Info) != elf.STB_GLOBAL {
+		for _, symbol := range programs {
+			if !s.programSelected(symbol.name) {
+				s.logger.Printf("goebpf: program '%s' is not selected, skipped", symbol.name)
+				continue
+			}
+			if skipped[symbol.name] {
 				continue
 			}
-			offset := int(symbol.Value)
-			size := lastOffset - offset
+			offset := symbol.offset
+			size := symbol.size
+			if offset < 0 || size < 0 || offset+size > len(bytecode) {
+				return nil, fmt.Errorf("eBPF program '%s' is out of section '%s'", symbol.name, section.Name)
+			}
 			if size/bpfInstructionLen > bpfMaxInstructions {
-				return nil, fmt.Errorf("eBPF program '%s' too big", symbol.Name)
+				return nil, fmt.Errorf("eBPF program '%s' too big", symbol.name)
 			}
 			// Create program with type based on section name
-			result[symbol.Name] = createProgram(symbol.Name, license, bytecode[offset:offset+size])
-			lastOffset = offset
+			program := createProgram(symbol.name, license, bytecode[offset:offset+size])
+			base := program.(baseProgramAccessor).base()
+			base.ifindex = ifindex
+			base.kernelVersion = s.features.Version
+			base.logger = s.logger
+			base.onDemand = onDemand
+			base.tokenFd = s.tokenFd
+			base.btfPath = s.btfPath
+			base.kfuncModules = kfuncModules[symbol.name]
+			base.metadata = metadata
+			base.logLevel = s.verifierLogLevel
+			if level, ok := s.verifierLogLevels[symbol.name]; ok {
+				base.logLevel = level
+			}
+			if err := checkTimerMaps(symbol.name, base.bytecode, elfFile.ByteOrder, maps); err != nil {
+				return nil, err
+			}
+			if s.elfPolicy != nil {
+				err := s.elfPolicy.checkProgram(symbol.name, program.GetType(), base.bytecode, elfFile.ByteOrder)
+				if err != nil {
+					return nil, err
+				}
+			}
+			if s.parseOnly {
+				if err := base.validate(); err != nil {
+					return nil, err
+				}
+			}
+			s.logger.Printf("goebpf: found program '%s' (%v) in section '%s', %d instructions",
+				symbol.name, program.GetType(), section.Name, size/bpfInstructionLen)
+			result[symbol.name] = program
 		}
 	}
 
 	return result, nil
 }
 
+// Patches call of extern kernel function to call it by BTF ID, like libbpf does.
+// Functions of kernel modules refer module BTF by index in fd_array, so module
+// is added to modules of program. Call is marked as kernel function call even
+// if function is not found (ELF files read by WithParseOnly()).
+func (s *ebpfSystem) relocateKernelFunc(insn *bpfInstruction, name string, modules *[]string) error {
+	insn.srcReg = bpfPseudoKfuncCall
+	fn, err := findKernelFunc(s.btfPath, name)
+	if err != nil {
+		return err
+	}
+	insn.imm = uint32(fn.btfID)
+	insn.offset = 0
+	if fn.module != "" {
+		insn.offset = uint16(moduleIndex(modules, fn.module) + 1)
+	}
+
+	return nil
+}
+
 // Reads ELF file compiled by clang + llvm for target bpf
 func (s *ebpfSystem) LoadElf(fn string) error {
-	// Open/read ELF headers
-	elfFile, err := elf.Open(fn)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	maps, programs, err := s.readElf(fn, nil)
 	if err != nil {
 		return err
 	}
-	defer elfFile.Close()
+	s.Maps = maps
+	s.Programs = programs
+
+	return nil
+}
+
+// Adds context to error of reading ELF, policy violations are returned
+// as is, so callers can tell them by errors.As()
+func wrapLoadError(msg string, err error) error {
+	if _, ok := err.(*ElfPolicyError); ok {
+		return err
+	}
+	return &LoadError{Context: msg, Err: err}
+}
+
+// Reads ELF file, creates all maps (except compatible ones from reuse) and
+// programs (not loaded yet). Nothing is leaked in case of error.
+func (s *ebpfSystem) readElf(fn string, reuse map[string]Map) (map[string]Map, map[string]Program, error) {
+	// Read / verify ELF file, then its headers
+	data, err := s.readElfData(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	elfFile, err := elf.NewFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, nil, err
+	}
+	s.logger.Printf("goebpf: reading ELF file '%s', %d sections", fn, len(elfFile.Sections))
+
+	return s.readElfFile(elfFile, reuse)
+}
+
+// Same as readElf(), for ELF file already opened / read into memory
+func (s *ebpfSystem) readElfFile(elfFile *elf.File, reuse map[string]Map) (map[string]Map, map[string]Program, error) {
+	var err error
+	s.elfWarnings = nil
+
+	if err := checkElfMachine(elfFile); err != nil {
+		return nil, nil, err
+	}
+	// Parse only mode is able to validate ELF files built for other architectures
+	if !s.parseOnly {
+		if err := checkElfByteOrder(elfFile); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	// Hardware offload case: resolve interface index of target NIC
+	var ifindex int
+	if s.offloadIfname != "" {
+		iface, err := netlink.LinkByName(s.offloadIfname)
+		RecordAudit(AuditSourceNetlink, "LinkByName", s.offloadIfname, err)
+		if err != nil {
+			return nil, nil, fmt.Errorf("LinkByName() failed: %v", err)
+		}
+		ifindex = iface.Attrs().Index
+	}
+
+	// Kernel version is needed for kprobe programs only, so failure is not fatal
+	if s.features.Version == 0 && !s.parseOnly {
+		if s.features.Version, err = GetKernelVersion(); err != nil {
+			s.logger.Printf("goebpf: unable to detect kernel version: %v", err)
+		}
+	}
+
+	// Selective loading: create only maps used by selected programs (or selected explicitly)
+	var needed map[string]bool
+	if s.programFilter != nil || s.mapFilter != nil {
+		if needed, err = s.referencedMaps(elfFile); err != nil {
+			return nil, nil, err
+		}
+	}
 
 	// Load eBPF maps
-	s.Maps, err = loadAndCreateMaps(elfFile)
+	maps, err := s.loadAndCreateMaps(elfFile, ifindex, reuse, needed)
 	if err != nil {
-		return fmt.Errorf("loadAndCreateMaps() failed: %v", err)
+		return nil, nil, wrapLoadError("loadAndCreateMaps() failed", err)
 	}
 
 	// Load eBPF programs
-	s.Programs, err = loadPrograms(elfFile, s.Maps)
+	programs, err := s.loadPrograms(elfFile, maps, ifindex)
 	if err != nil {
-		return fmt.Errorf("loadPrograms() failed: %v", err)
+		closeMaps(maps, reuse)
+		return nil, nil, wrapLoadError("loadPrograms() failed", err)
 	}
 
-	return nil
+	// Load programs marked for autoload into kernel right away
+	if !s.parseOnly && reuse == nil {
+		autoload := map[string]Program{}
+		for name, prog := range programs {
+			if s.autoloadSelected(prog) {
+				autoload[name] = prog
+			}
+		}
+		if _, err := LoadPrograms(autoload, s.loadParallelism); err != nil {
+			for _, prog := range autoload {
+				prog.Close()
+			}
+			closeMaps(maps, reuse)
+			return nil, nil, &LoadError{Context: "Autoload failed", Err: err}
+		}
+	}
+
+	return maps, programs, nil
 }
@@ -4,9 +4,17 @@
 package goebpf
 
 import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestBpfInstruction(t *testing.T) {
@@ -15,20 +23,192 @@ func TestBpfInstruction(t *testing.T) {
 
 	// Test save()
 	b := &bpfInstruction{}
-	assert.Equal(t, exp1, b.save())
+	assert.Equal(t, exp1, b.save(binary.LittleEndian))
 	b.code = 1
 	b.srcReg = 0xa
 	b.dstReg = 0xb
 	b.offset = 0xccdd
 	b.imm = 0x01020304
-	assert.Equal(t, exp2, b.save())
+	assert.Equal(t, exp2, b.save(binary.LittleEndian))
 
 	// Test load()
 	b = &bpfInstruction{}
-	b.load(exp2)
+	b.load(exp2, binary.LittleEndian)
 	assert.Equal(t, uint8(1), b.code)
 	assert.Equal(t, uint8(0xa), b.srcReg)
 	assert.Equal(t, uint8(0xb), b.dstReg)
 	assert.Equal(t, uint16(0xccdd), b.offset)
 	assert.Equal(t, uint32(0x01020304), b.imm)
+
+	// Big endian: registers are swapped as well
+	exp3 := []byte{0x1, 0xba, 0xcc, 0xdd, 0x01, 0x02, 0x03, 0x04}
+	assert.Equal(t, exp3, b.save(binary.BigEndian))
+	b = &bpfInstruction{}
+	b.load(exp3, binary.BigEndian)
+	assert.Equal(t, uint8(0xa), b.srcReg)
+	assert.Equal(t, uint8(0xb), b.dstReg)
+	assert.Equal(t, uint16(0xccdd), b.offset)
+	assert.Equal(t, uint32(0x01020304), b.imm)
+}
+
+func TestSectionPrograms(t *testing.T) {
+	global := elf.ST_INFO(elf.STB_GLOBAL, elf.STT_FUNC)
+	symbols := []elf.Symbol{
+		{Name: "prog2", Section: 3, Value: 64, Info: global},
+		{Name: "local", Section: 3, Value: 16, Info: elf.ST_INFO(elf.STB_LOCAL, elf.STT_NOTYPE)},
+		{Name: "prog1", Section: 3, Value: 0, Info: global},
+		{Name: "other", Section: 4, Value: 0, Info: global},
+	}
+	programs := sectionPrograms(symbols, 3, 128)
+	assert.Equal(t, []elfProgramSymbol{
+		{name: "prog1", offset: 0, size: 64},
+		{name: "prog2", offset: 64, size: 64},
+	}, programs)
+
+	assert.Equal(t, "prog1", programAtOffset(programs, 8).name)
+	assert.Equal(t, "prog2", programAtOffset(programs, 64).name)
+	assert.Nil(t, programAtOffset(programs, 128))
+}
+
+func TestProgramSectionType(t *testing.T) {
+	_, onDemand, ok := programSectionType("xdp")
+	assert.True(t, ok)
+	assert.False(t, onDemand)
+
+	_, onDemand, ok = programSectionType("?XDP")
+	assert.True(t, ok)
+	assert.True(t, onDemand)
+
+	_, _, ok = programSectionType("?maps")
+	assert.False(t, ok)
+	_, _, ok = programSectionType("?")
+	assert.False(t, ok)
+
+	create, onDemand, ok := programSectionType("?lsm/file_open")
+	assert.True(t, ok)
+	assert.True(t, onDemand)
+	prog := create("prog", "GPL", nil).(*lsmProgram)
+	assert.Equal(t, "file_open", prog.hook)
+	assert.Equal(t, ProgramTypeLSM, prog.GetType())
+
+	create, _, ok = programSectionType("fexit/Some_Func")
+	assert.True(t, ok)
+	tracing := create("prog", "GPL", nil).(*tracingProgram)
+	assert.Equal(t, "Some_Func", tracing.function)
+	assert.Equal(t, TracingFexit, tracing.kind)
+	assert.Equal(t, ProgramTypeTracing, tracing.GetType())
+	assert.Equal(t, bpfAttachTypeTraceFexit, tracing.expectedAttachType)
+
+	create, onDemand, ok = programSectionType("?fentry/nf_conntrack:nf_confirm")
+	assert.True(t, ok)
+	assert.True(t, onDemand)
+	tracing = create("prog", "GPL", nil).(*tracingProgram)
+	assert.Equal(t, "nf_conntrack:nf_confirm", tracing.function)
+	assert.Equal(t, TracingFentry, tracing.kind)
+
+	create, _, ok = programSectionType("uretprobe")
+	assert.True(t, ok)
+	uprobe := create("prog", "GPL", nil).(*uprobeProgram)
+	assert.True(t, uprobe.retprobe)
+	assert.Equal(t, ProgramTypeKprobe, uprobe.GetType())
+}
+
+// Builds ELF file like clang does for:
+//
+//	extern void bpf_test_kfunc(void) __ksym;
+//
+//	SEC("xdp")
+//	int xdp_prog(struct xdp_md *ctx) {
+//		bpf_test_kfunc();
+//		return XDP_PASS;
+//	}
+func buildTestKfuncElf(kfunc string) []byte {
+	bo := binary.LittleEndian
+	strtab := []byte("\x00.strtab\x00.symtab\x00xdp\x00.relxdp\x00license\x00xdp_prog\x00" + kfunc + "\x00")
+	var symtab []byte
+	symtab = append(symtab, make([]byte, 24)...)
+	symtab = append(symtab, testElfSymbol(testElfName(strtab, "xdp_prog"), elf.STB_GLOBAL, elf.STT_FUNC, 3)...)
+	// Extern function is undefined symbol
+	symtab = append(symtab, testElfSymbol(testElfName(strtab, kfunc), elf.STB_GLOBAL, elf.STT_NOTYPE, uint16(elf.SHN_UNDEF))...)
+
+	// call -1 (BPF_PSEUDO_CALL); r0 = XDP_PASS; exit
+	code := []byte{
+		0x85, 0x10, 0, 0, 0xff, 0xff, 0xff, 0xff,
+		0xb7, 0x00, 0, 0, 2, 0, 0, 0,
+		0x95, 0, 0, 0, 0, 0, 0, 0,
+	}
+	rel := make([]byte, 16)
+	bo.PutUint64(rel[8:], elf.R_INFO(2, 10)) // R_BPF_64_32
+
+	return writeTestElf(strtab, []testElfSection{
+		{},
+		{name: ".strtab", typ: elf.SHT_STRTAB, data: strtab},
+		{name: ".symtab", typ: elf.SHT_SYMTAB, data: symtab, link: 1, info: 1, entrySize: 24},
+		{name: "xdp", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR, data: code},
+		{name: ".relxdp", typ: elf.SHT_REL, data: rel, link: 2, info: 3, entrySize: 16},
+		{name: "license", typ: elf.SHT_PROGBITS, flags: elf.SHF_ALLOC | elf.SHF_WRITE, data: []byte("GPL\x00")},
+	})
+}
+
+// Builds kernel BTF with single function: [1] void (void), [2] bpf_test_kfunc
+func buildTestKfuncBtf() []byte {
+	var types bytes.Buffer
+	strs := "\x00bpf_test_kfunc\x00"
+	binary.Write(&types, binary.LittleEndian, []uint32{0, 13 << 24, 0, 1, 12<<24 | 1, 1})
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, []uint32{0x0001eb9f, 24, 0, uint32(types.Len()),
+		uint32(types.Len()), uint32(len(strs))})
+	buf.Write(types.Bytes())
+	buf.WriteString(strs)
+	return buf.Bytes()
+}
+
+func TestRelocateKernelFunc(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "vmlinux")
+	require.NoError(t, os.WriteFile(path, buildTestKfuncBtf(), 0644))
+
+	s := NewDefaultEbpfSystem(WithBtfPath(path), WithParseOnly()).(*ebpfSystem)
+	_, err := s.parseElfData(buildTestKfuncElf("bpf_test_kfunc"))
+	require.NoError(t, err)
+	require.Len(t, s.Programs, 1)
+	base := s.Programs["xdp_prog"].(baseProgramAccessor).base()
+	// call bpf_test_kfunc by BTF ID
+	var insn bpfInstruction
+	require.NoError(t, insn.load(base.bytecode, binary.LittleEndian))
+	assert.Equal(t, bpfInstruction{code: classJmp | jumpCall, srcReg: bpfPseudoKfuncCall, imm: 2}, insn)
+	assert.Empty(t, base.kfuncModules)
+
+	// Missing function is not resolved when ELF is just parsed...
+	s = NewDefaultEbpfSystem(WithBtfPath(path), WithParseOnly()).(*ebpfSystem)
+	_, err = s.parseElfData(buildTestKfuncElf("bpf_no_such_kfunc"))
+	require.NoError(t, err)
+	base = s.Programs["xdp_prog"].(baseProgramAccessor).base()
+	require.NoError(t, insn.load(base.bytecode, binary.LittleEndian))
+	assert.Equal(t, uint8(bpfPseudoKfuncCall), insn.srcReg)
+
+	// ...and fails loading otherwise
+	s = NewDefaultEbpfSystem(WithBtfPath(path)).(*ebpfSystem)
+	_, err = s.parseElfData(buildTestKfuncElf("bpf_no_such_kfunc"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "bpf_no_such_kfunc")
+}
+
+func TestLoadElfTypedError(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "prog.elf")
+	require.NoError(t, os.WriteFile(path, buildTestElf(), 0644))
+
+	// Hash map of 2^30 entries is rejected by kernel (E2BIG), as well as
+	// any map without privileges (EPERM)
+	err := NewDefaultEbpfSystem(WithMapMaxEntries("test_map", 1<<30)).LoadElf(path)
+	require.Error(t, err)
+	assert.True(t, strings.HasPrefix(err.Error(), "loadAndCreateMaps() failed: map.Create() failed: "), err.Error())
+	// Context is added, typed error is kept
+	var sysErr *SyscallError
+	require.True(t, errors.As(err, &sysErr), err.Error())
+	assert.True(t, errors.Is(err, sysErr.Errno))
+	assert.True(t, errors.Is(err, ErrMapFull) || errors.Is(err, ErrPermission), err.Error())
+	loadErr, ok := err.(*LoadError)
+	require.True(t, ok)
+	assert.Equal(t, sysErr.Cause(), loadErr.Cause())
 }
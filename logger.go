@@ -0,0 +1,16 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+// Logger is used by library to print debug / trace messages, like
+// ELF sections parsed, relocations applied, maps created, programs attached, etc.
+// Standard *log.Logger satisfies this interface.
+type Logger interface {
+	Printf(format string, v ...interface{})
+}
+
+// Default logger - discards everything
+type nopLogger struct{}
+
+func (nopLogger) Printf(format string, v ...interface{}) {}
@@ -3,162 +3,58 @@
 
 package goebpf
 
-/*
-#include <string.h>
-#include <unistd.h>
-#include <errno.h>
-#include <stdlib.h>
-
-#include "bpf.h"
-#include "bpf_helpers.h"
-
-// Since eBPF mock package is optional and have definition of "__maps_head" symbol
-// it may cause link error, so defining weak symbol here as well
-struct __create_map_def maps_head;
-__attribute__((weak)) struct __maps_head_def *__maps_head = (struct __maps_head_def*) &maps_head;
-
-static int ebpf_map_create(const char *name, __u32 map_type, __u32 key_size, __u32 value_size,
-		__u32 max_entries, __u32 flags, __u32 inner_fd, void *log_buf, size_t log_size)
-{
-	union bpf_attr attr = {};
-
-	attr.map_type = map_type;
-	attr.key_size = key_size;
-	attr.value_size = value_size;
-	attr.max_entries = max_entries;
-	attr.map_flags = flags;
-	attr.inner_map_fd = inner_fd;
-	strncpy((char*)&attr.map_name, name, BPF_OBJ_NAME_LEN - 1);
-
-	int res = syscall(__NR_bpf, BPF_MAP_CREATE, &attr, sizeof(attr));
-	strncpy(log_buf, strerror(errno), log_size);
-	return res;
-}
-
-static int ebpf_map_update_elem(__u32 fd, const void *key, const void *value,
-		__u64 flags, void *log_buf, size_t log_size)
-{
-	union bpf_attr attr = {};
-
-	attr.map_fd = fd;
-	attr.key = ptr_to_u64(key);
-	attr.value = ptr_to_u64(value);
-	attr.flags = flags;
-
-	int res = syscall(__NR_bpf, BPF_MAP_UPDATE_ELEM, &attr, sizeof(attr));
-	strncpy(log_buf, strerror(errno), log_size);
-	return res;
-}
-
-static int ebpf_map_lookup_elem(__u32 fd, const void *key, void *value,
-		void *log_buf, size_t log_size)
-{
-	union bpf_attr attr = {};
-
-	attr.map_fd = fd;
-	attr.key = ptr_to_u64(key);
-	attr.value = ptr_to_u64(value);
-
-	int res = syscall(__NR_bpf, BPF_MAP_LOOKUP_ELEM, &attr, sizeof(attr));
-	strncpy(log_buf, strerror(errno), log_size);
-	return res;
-}
-
-static int ebpf_map_delete_elem(__u32 fd, const void *key,
-		void *log_buf, size_t log_size)
-{
-	union bpf_attr attr = {};
-
-	attr.map_fd = fd;
-	attr.key = ptr_to_u64(key);
-
-	int res = syscall(__NR_bpf, BPF_MAP_DELETE_ELEM, &attr, sizeof(attr));
-	strncpy(log_buf, strerror(errno), log_size);
-	return res;
-}
-
-static int ebpf_obj_get(const char *pathname,
-		void *log_buf, size_t log_size)
-{
-	union bpf_attr attr = {};
-
-	attr.pathname = ptr_to_u64(pathname);
-
-	int res = syscall(__NR_bpf, BPF_OBJ_GET, &attr, sizeof(attr));
-	strncpy(log_buf, strerror(errno), log_size);
-	return res;
-}
-
-static int ebpf_map_get_fd_by_id(__u32 id,
-		void *log_buf, size_t log_size)
-{
-	union bpf_attr attr = {};
-	attr.map_id = id;
-
-	int fd = syscall(__NR_bpf, BPF_MAP_GET_FD_BY_ID, &attr, sizeof(attr));
-	strncpy(log_buf, strerror(errno), log_size);
-
-	return fd;
-}
-
-static int ebpf_obj_get_info_by_fd(__u32 fd, void *info, __u32 info_len,
-		void *log_buf, size_t log_size)
-{
-	union bpf_attr attr = {};
-
-	attr.info.bpf_fd = fd;
-	attr.info.info = ptr_to_u64(info);
-	attr.info.info_len = info_len;
-
-	int res = syscall(__NR_bpf, BPF_OBJ_GET_INFO_BY_FD, &attr, sizeof(attr));
-	strncpy(log_buf, strerror(errno), log_size);
-
-	return res;
-}
-
-
-*/
-import "C"
-
 import (
 	"bytes"
+	"context"
+	"encoding"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"net"
+	"os"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"unsafe"
+
+	"github.com/dropbox/goebpf/goebpf_btf"
 )
 
+// ErrNoMoreKeys is returned by GetNextKey() when end of map reached
+var ErrNoMoreKeys = errors.New("No more keys")
+
 // MapType is eBPF map type enum
 type MapType int
 
-// Supported eBPF map types.
+// Supported eBPF map types, must be in sync with enum bpf_map_type from <linux/bpf.h>
 const (
-	MapTypeHash                MapType = C.BPF_MAP_TYPE_HASH
-	MapTypeArray               MapType = C.BPF_MAP_TYPE_ARRAY
-	MapTypeProgArray           MapType = C.BPF_MAP_TYPE_PROG_ARRAY
-	MapTypePerfEventArray      MapType = C.BPF_MAP_TYPE_PERF_EVENT_ARRAY
-	MapTypePerCPUHash          MapType = C.BPF_MAP_TYPE_PERCPU_HASH
-	MapTypePerCPUArray         MapType = C.BPF_MAP_TYPE_PERCPU_ARRAY
-	MapTypeStackTrace          MapType = C.BPF_MAP_TYPE_STACK_TRACE
-	MapTypeCgroupArray         MapType = C.BPF_MAP_TYPE_CGROUP_ARRAY
-	MapTypeLRUHash             MapType = C.BPF_MAP_TYPE_LRU_HASH
-	MapTypeLRUPerCPUHash       MapType = C.BPF_MAP_TYPE_LRU_PERCPU_HASH
-	MapTypeLPMTrie             MapType = C.BPF_MAP_TYPE_LPM_TRIE
-	MapTypeArrayOfMaps         MapType = C.BPF_MAP_TYPE_ARRAY_OF_MAPS
-	MapTypeHashOfMaps          MapType = C.BPF_MAP_TYPE_HASH_OF_MAPS
-	MapTypeDevMap              MapType = C.BPF_MAP_TYPE_DEVMAP
-	MapTypeSockMap             MapType = C.BPF_MAP_TYPE_SOCKMAP
-	MapTypeCPUMap              MapType = C.BPF_MAP_TYPE_CPUMAP
-	MapTypeXSKMap              MapType = C.BPF_MAP_TYPE_XSKMAP
-	MapTypeSockHash            MapType = C.BPF_MAP_TYPE_SOCKHASH
-	MapTypeCGroupStorage       MapType = C.BPF_MAP_TYPE_CGROUP_STORAGE
-	MapTypeReusePortSockArray  MapType = C.BPF_MAP_TYPE_REUSEPORT_SOCKARRAY
-	MapTypePerCpuCGroupStorage MapType = C.BPF_MAP_TYPE_PERCPU_CGROUP_STORAGE
-	MapTypeQueue               MapType = C.BPF_MAP_TYPE_QUEUE
-	MapTypeStack               MapType = C.BPF_MAP_TYPE_STACK
-	MapTypeSKStorage           MapType = C.BPF_MAP_TYPE_SK_STORAGE
+	MapTypeHash                MapType = 1
+	MapTypeArray               MapType = 2
+	MapTypeProgArray           MapType = 3
+	MapTypePerfEventArray      MapType = 4
+	MapTypePerCPUHash          MapType = 5
+	MapTypePerCPUArray         MapType = 6
+	MapTypeStackTrace          MapType = 7
+	MapTypeCgroupArray         MapType = 8
+	MapTypeLRUHash             MapType = 9
+	MapTypeLRUPerCPUHash       MapType = 10
+	MapTypeLPMTrie             MapType = 11
+	MapTypeArrayOfMaps         MapType = 12
+	MapTypeHashOfMaps          MapType = 13
+	MapTypeDevMap              MapType = 14
+	MapTypeSockMap             MapType = 15
+	MapTypeCPUMap              MapType = 16
+	MapTypeXSKMap              MapType = 17
+	MapTypeSockHash            MapType = 18
+	MapTypeCGroupStorage       MapType = 19
+	MapTypeReusePortSockArray  MapType = 20
+	MapTypePerCpuCGroupStorage MapType = 21
+	MapTypeQueue               MapType = 22
+	MapTypeStack               MapType = 23
+	MapTypeSKStorage           MapType = 24
+	MapTypeDevMapHash          MapType = 25
+	MapTypeRingBuf             MapType = 27
 )
 
 // Optional flags for ebpf_map_create()
@@ -176,10 +72,10 @@ const (
 
 // Optional flags for ebpf_map_update_elem()
 const (
-	bpfAny     = C.BPF_ANY     // create new element or update existing
-	bpfNoexist = C.BPF_NOEXIST // create new element if it didn't exist
-	bpfExist   = C.BPF_EXIST   // update existing element
-	bpfFLock   = C.BPF_F_LOCK  // spin_lock-ed map_lookup/map_update
+	bpfAny     = 0 // create new element or update existing
+	bpfNoexist = 1 // create new element if it didn't exist
+	bpfExist   = 2 // update existing element
+	bpfFLock   = 4 // spin_lock-ed map_lookup/map_update
 )
 
 // Returns user friendly name for MapType
@@ -233,13 +129,85 @@ func (t MapType) String() string {
 		return "Stack"
 	case MapTypeSKStorage:
 		return "Socket storage"
+	case MapTypeDevMapHash:
+		return "DevMap hash"
+	case MapTypeRingBuf:
+		return "Ring buffer"
+	}
+
+	return "Unknown"
+}
+
+// MapPinPolicy defines what Create() does when map with PersistentPath
+// is already pinned by someone else (e.g. previous instance of application)
+type MapPinPolicy int
+
+const (
+	// MapPinReuse re-uses already pinned map (so data survives restarts) if its
+	// definition matches, fails otherwise. Map is created / pinned if nothing is pinned yet.
+	MapPinReuse MapPinPolicy = iota
+	// MapPinReplace always creates new map, replacing existing pin
+	MapPinReplace
+	// MapPinExclusive fails if something is already pinned at PersistentPath
+	MapPinExclusive
+	// MapPinMigrate re-uses already pinned map if its definition and value
+	// layout (BTF) match, otherwise creates new map, copies entries of pinned
+	// one into it (converted by EbpfMap.Migrate) and replaces pin, see map_migrate.go
+	MapPinMigrate
+)
+
+func (p MapPinPolicy) String() string {
+	switch p {
+	case MapPinReuse:
+		return "Reuse"
+	case MapPinReplace:
+		return "Replace"
+	case MapPinExclusive:
+		return "Exclusive"
+	case MapPinMigrate:
+		return "Migrate"
+	}
+
+	return "Unknown"
+}
+
+// MapAccess is access mode of map fd opened by OpenPinnedMap(),
+// enforced by kernel
+type MapAccess int
+
+// Access modes of map fd, BPF_F_RDONLY / BPF_F_WRONLY of BPF_OBJ_GET
+const (
+	MapAccessReadWrite MapAccess = 0
+	MapAccessReadOnly  MapAccess = bpfReadOnly
+	MapAccessWriteOnly MapAccess = bpfWriteOnly
+)
+
+func (a MapAccess) String() string {
+	switch a {
+	case MapAccessReadWrite:
+		return "ReadWrite"
+	case MapAccessReadOnly:
+		return "ReadOnly"
+	case MapAccessWriteOnly:
+		return "WriteOnly"
 	}
 
 	return "Unknown"
 }
 
-// EbpfMap is structure to define eBPF map
+// EbpfMap is structure to define eBPF map.
+// All methods are safe for concurrent use, e.g. map can be queried from
+// multiple goroutines while another one closes it. Exported fields are
+// map definition and must not be modified once map has been created.
+// EbpfMap must not be copied, use CloneTemplate() instead.
 type EbpfMap struct {
+	// Elements updated / deleted through this map, see Stats().
+	// First for 64-bit alignment of atomic access on 32-bit platforms
+	updates uint64
+	deletes uint64
+	// Guards fd: element operations hold read lock for duration of syscall,
+	// so Create() / Close() can't swap descriptor from under them
+	mu sync.RWMutex
 	fd int
 	// Map name, picked up automatically by loader from ELF section
 	Name       string
@@ -254,15 +222,48 @@ type EbpfMap struct {
 	// Persistent eBPF map use case: contains path to special file in filesystem.
 	// WARNING: filesystem must be mounted as BPF
 	PersistentPath string
+	// What to do if map is already pinned at PersistentPath
+	PinPolicy MapPinPolicy
+	// Converts entries of map pinned by previous version of application
+	// with other layout, MapPinMigrate only. Nil copies entries as is.
+	Migrate MapMigrateFunc
+	// Hardware offload use case: index of network interface (SmartNIC)
+	// to create map on. Zero means regular, host map.
+	Ifindex int
+	// BPF token to create map with (unprivileged containers), see NewToken().
+	// Zero means none.
+	TokenFd int
 
 	// In case of Per-CPU maps bpf_lookup call expects buffer equal to valueSize * nCPUs
 	// which will be populated with data from all possible CPUs
 	valueRealSize int
+	// Value contains struct bpf_spin_lock (per BTF) at spinLockOffset,
+	// so elements are read / written with BPF_F_LOCK, see map_spinlock.go
+	spinLock       bool
+	spinLockOffset int
+	// ID full name of created map is remembered by, see registerObjectName()
+	nameId uint32
+	// Value contains struct bpf_timer, only timers of maps with BTF work
+	timer bool
+	// Key / value types in BTF loaded into kernel (btfFd), set by loader for
+	// maps with special fields (spin lock / timer) only, see map_btf.go
+	btfFd          int
+	btfKeyTypeId   int
+	btfValueTypeId int
+	// Key / value types from ELF's BTF (BPF_ANNOTATE_KV_PAIR), to detect
+	// layout changes of pinned maps
+	btfKeyType   *goebpf_btf.Type
+	btfValueType *goebpf_btf.Type
+	// Pinned map to copy entries from on Create(), see MapPinMigrate
+	migrateFrom *MapMigration
+	// Definition of inner maps (array / hash of maps), see InnerTemplate()
+	innerTemplate *EbpfMap
 }
 
 // CreateLPMtrieKey converts string representation of CIDR into net.IPNet
 // in order to support special eBPF map type: LPMtrie ("Longest Prefix Match Trie")
 // Can be used to match single IPv4/6 address with multiple CIDRs, like
+//
 //	m.Insert(CreateLPMtrieKey("192.168.0.0/16"), "value16")
 //	m.Insert(CreateLPMtrieKey("192.168.0.0/24"), "value24")
 //
@@ -291,83 +292,123 @@ func CreateLPMtrieKey(s string) *net.IPNet {
 // in ELF section, defined in BPF program itself.
 // Refer to bpf_helpers.h, struct bpf_map_def
 const (
-	mapDefinitionSize             = C.BPF_MAP_DEF_SIZE
-	mapDefinitionPersistentOffset = C.BPF_MAP_OFFSET_PERSISTENT
-	mapDefinitionInnerMapOffset   = C.BPF_MAP_OFFSET_INNER_MAP
+	mapDefinitionSize             = 40 // BPF_MAP_DEF_SIZE
+	mapDefinitionPersistentOffset = 32 // BPF_MAP_OFFSET_PERSISTENT
+	mapDefinitionInnerMapOffset   = 24 // BPF_MAP_OFFSET_INNER_MAP
 )
 
-// Create EbpfMap binary data stored in ELF section
-func newMapFromElfSection(data []byte) (*EbpfMap, error) {
+// Create EbpfMap binary data stored in ELF section, bo is byte order of ELF file
+func newMapFromElfSection(data []byte, bo binary.ByteOrder) (*EbpfMap, error) {
 	if len(data) < mapDefinitionSize {
 		return nil, errors.New("Invalid binary representation of BPF map")
 	}
 
 	return &EbpfMap{
-		Type:       MapType(binary.LittleEndian.Uint32(data[:4])),
-		KeySize:    int(binary.LittleEndian.Uint32(data[4:])),
-		ValueSize:  int(binary.LittleEndian.Uint32(data[8:])),
-		MaxEntries: int(binary.LittleEndian.Uint32(data[12:])),
-		Flags:      int(binary.LittleEndian.Uint32(data[16:])),
+		Type:       MapType(bo.Uint32(data[:4])),
+		KeySize:    int(bo.Uint32(data[4:])),
+		ValueSize:  int(bo.Uint32(data[8:])),
+		MaxEntries: int(bo.Uint32(data[12:])),
+		Flags:      int(bo.Uint32(data[16:])),
 	}, nil
 }
 
+// Beginning of struct bpf_map_info
+type bpfMapInfo struct {
+	Type       uint32
+	Id         uint32
+	KeySize    uint32
+	ValueSize  uint32
+	MaxEntries uint32
+	Flags      uint32
+	Name       [bpfObjNameLen]byte
+	Ifindex    uint32
+	// Fields below are zero on kernels without BTF support
+	BtfVmlinuxValueTypeId uint32
+	NetnsDev              uint64
+	NetnsIno              uint64
+	BtfId                 uint32
+	BtfKeyTypeId          uint32
+	BtfValueTypeId        uint32
+}
+
+// Reads information about map by its fd
+func ebpfMapGetInfo(fd int) (*bpfMapInfo, error) {
+	var infoBuf [1024]byte
+
+	if err := ebpfObjGetInfoByFd(fd, infoBuf[:]); err != nil {
+		return nil, err
+	}
+	var rawInfo bpfMapInfo
+	reader := bytes.NewReader(infoBuf[:])
+	if err := binary.Read(reader, hostByteOrder, &rawInfo); err != nil {
+		return nil, err
+	}
+
+	return &rawInfo, nil
+}
+
 // NewMapFromExistingMapByFd creates eBPF map from already existing map by fd
 // available to current process (i.e. created by it).
 // In other words it will work only on maps created by current process.
 func NewMapFromExistingMapByFd(fd int) (*EbpfMap, error) {
-	var logBuf [errCodeBufferSize]byte
-	var infoBuf [1024]byte
-
 	// Get map information
-	res := C.ebpf_obj_get_info_by_fd(C.__u32(fd),
-		unsafe.Pointer(&infoBuf[0]), C.__u32(len(infoBuf)),
-		unsafe.Pointer(&logBuf[0]), C.size_t(unsafe.Sizeof(logBuf)))
-	if res == -1 {
-		return nil, fmt.Errorf("ebpf_obj_get_info_by_fd() failed: %v",
-			NullTerminatedStringToString(logBuf[:]))
-	}
-
-	// Read definition
-	var rawInfo struct {
-		Type       uint32
-		Id         uint32
-		KeySize    uint32
-		ValueSize  uint32
-		MaxEntries uint32
-		Flags      uint32
-		Name       [C.BPF_OBJ_NAME_LEN]byte
-	}
-	reader := bytes.NewReader(infoBuf[:])
-	if err := binary.Read(reader, binary.LittleEndian, &rawInfo); err != nil {
+	rawInfo, err := ebpfMapGetInfo(fd)
+	if err != nil {
 		return nil, err
 	}
 
-	return &EbpfMap{
+	m := &EbpfMap{
 		fd:         fd,
-		Name:       NullTerminatedStringToString(rawInfo.Name[:]),
+		Name:       fullObjectName(objectNames.maps, rawInfo.Id, NullTerminatedStringToString(rawInfo.Name[:])),
 		Type:       MapType(rawInfo.Type),
 		KeySize:    int(rawInfo.KeySize),
 		ValueSize:  int(rawInfo.ValueSize),
 		MaxEntries: int(rawInfo.MaxEntries),
 		Flags:      int(rawInfo.Flags),
-	}, nil
+	}
+	if rawInfo.BtfId != 0 && rawInfo.BtfValueTypeId != 0 {
+		m.spinLockOffset, m.spinLock = findSpinLock(int(rawInfo.BtfId), int(rawInfo.BtfValueTypeId))
+	}
+
+	return m, nil
 }
 
 // NewMapFromExistingMapById creates eBPF map from BPF object ID.
 // BPF object ID is a kernel mechanism to let non owner process to use BPF objects.
 // Common use case - tooling for troubleshoot / inspect existing BPF objects in the kernel.
 func NewMapFromExistingMapById(id int) (*EbpfMap, error) {
-	var logBuf [errCodeBufferSize]byte
-
 	// Resolve object FD from ID
-	fd := C.ebpf_map_get_fd_by_id(C.__u32(id),
-		unsafe.Pointer(&logBuf[0]), C.size_t(unsafe.Sizeof(logBuf)))
-	if fd == -1 {
-		return nil, fmt.Errorf("ebpf_map_get_fd_by_id() failed: %v",
-			NullTerminatedStringToString(logBuf[:]))
+	fd, err := ebpfGetFdById(bpfCmdMapGetFdById, "ebpf_map_get_fd_by_id()", id)
+	if err != nil {
+		return nil, err
 	}
 
-	return NewMapFromExistingMapByFd(int(fd))
+	return NewMapFromExistingMapByFd(fd)
+}
+
+// OpenPinnedMap opens map pinned to bpffs (e.g. by another application) with
+// given access mode. Access is enforced by kernel: operations not allowed by
+// mode fail with ErrPermission, so monitoring components can be given
+// read-only view of maps without being able to modify them by mistake.
+func OpenPinnedMap(path string, access MapAccess) (*EbpfMap, error) {
+	if access.String() == "Unknown" {
+		return nil, fmt.Errorf("Invalid map access mode %d", access)
+	}
+	fd, err := ebpfObjGet(path, int(access))
+	if err != nil {
+		return nil, newSyscallError(fmt.Sprintf("ebpf_obj_get('%s')", path), err, nil)
+	}
+	m, err := NewMapFromExistingMapByFd(fd)
+	if err == nil {
+		// Doesn't create map, just makes it ready for use
+		err = m.Create()
+	}
+	if err != nil {
+		closeFd(fd)
+		return nil, err
+	}
+
+	return m, nil
 }
 
 // If map type is Per-CPU based
@@ -378,12 +419,25 @@ func (m *EbpfMap) isPerCpu() bool {
 		m.Type == MapTypePerCpuCGroupStorage
 }
 
-// Map elements part: lookup, update / delete / etc
+// Size of value of single CPU in buffers of Per-CPU maps:
+// kernel aligns value of every CPU to 8 bytes
+func perCpuValueSize(valueSize int) int {
+	return (valueSize + 7) &^ 7
+}
 
-// Create creates map in kernel
-func (m *EbpfMap) Create() error {
-	var logBuf [errCodeBufferSize]byte
+// Map types which have one element per CPU, when defined with zero max entries
+func (m *EbpfMap) isSizedByCpus() bool {
+	return m.Type == MapTypePerfEventArray ||
+		m.Type == MapTypePerCPUArray ||
+		m.Type == MapTypePerCPUHash ||
+		m.Type == MapTypeLRUPerCPUHash
+}
 
+// Map elements part: lookup, update / delete / etc
+
+// Normalizes map definition and performs sanity checks,
+// doesn't interact with kernel
+func (m *EbpfMap) prepare() error {
 	// These special map types always have 4 byte value
 	if m.Type == MapTypeArrayOfMaps || m.Type == MapTypeHashOfMaps ||
 		m.Type == MapTypeProgArray {
@@ -409,9 +463,25 @@ func (m *EbpfMap) Create() error {
 		m.Flags |= bpfNoPrealloc
 	}
 
+	// Perf event arrays / per-CPU maps with zero max entries are sized to number
+	// of possible CPUs (same as libbpf does), so programs don't hardcode it.
+	// Per-CPU cgroup storage is exception: it must have zero max entries.
+	if m.MaxEntries == 0 && m.isSizedByCpus() {
+		numCpus, err := GetNumOfPossibleCpus()
+		if err != nil {
+			return err
+		}
+		m.MaxEntries = numCpus
+	}
+
 	// Perform few sanity checks
-	if len(m.Name) >= C.BPF_OBJ_NAME_LEN {
-		return fmt.Errorf("Map name '%s' is too long", m.Name)
+	// Ring buffer has no keys / values, max entries is its size in bytes
+	if m.Type == MapTypeRingBuf {
+		if m.MaxEntries < os.Getpagesize() || m.MaxEntries&(m.MaxEntries-1) != 0 {
+			return fmt.Errorf("Invalid ring buffer '%s' size(%d), must be power of 2 and at least page size",
+				m.Name, m.MaxEntries)
+		}
+		return nil
 	}
 	if m.KeySize < 1 {
 		return fmt.Errorf("Invalid map '%s' key size(%d)", m.Name, m.KeySize)
@@ -420,13 +490,25 @@ func (m *EbpfMap) Create() error {
 		return fmt.Errorf("Invalid map '%s' value size(%d)", m.Name, m.ValueSize)
 	}
 
+	return nil
+}
+
+// Create creates map in kernel
+func (m *EbpfMap) Create() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err := m.prepare(); err != nil {
+		return err
+	}
+
 	// Per-CPU maps require extra space to store values from ALL possible CPUs
 	if m.isPerCpu() {
 		numCpus, err := GetNumOfPossibleCpus()
 		if err != nil {
 			return err
 		}
-		m.valueRealSize = m.ValueSize * numCpus
+		m.valueRealSize = perCpuValueSize(m.ValueSize) * numCpus
 	} else {
 		m.valueRealSize = m.ValueSize
 	}
@@ -436,53 +518,64 @@ func (m *EbpfMap) Create() error {
 		return nil
 	}
 
-	// Make C string from map name
-	name := C.CString(m.Name)
-	defer C.free(unsafe.Pointer(name))
 	// Map can be defined as either process only or system wide ("object pinning")
 	// If PersistentPath is set - it indicates that eBPF program wants to
 	// make this map system wide accessible via PersistentPath (it is just filename)
-	persistentPathStr := C.CString(m.PersistentPath)
-	defer C.free(unsafe.Pointer(persistentPathStr))
 	if m.PersistentPath != "" {
 		// Try to locate map in the system on
 		// given path (i.e. map has been already created before)
-		objFd := int(C.ebpf_obj_get(
-			persistentPathStr,
-			unsafe.Pointer(&logBuf[0]),
-			C.size_t(unsafe.Sizeof(logBuf)),
-		))
-		if objFd != -1 {
-			// Successful, retrieved map fd from given location
-			m.fd = objFd
-			return nil
+		objFd, err := ebpfObjGet(m.PersistentPath, 0)
+		if err == nil {
+			// Successful, retrieved map fd from given location.
+			// handlePinned() takes fd over unless it fails.
+			if err := m.handlePinned(objFd); err != nil {
+				closeFd(objFd)
+				return err
+			}
+			if m.fd != 0 {
+				return nil
+			}
+			defer m.closeMigrateFrom()
 		}
-		// No map at given location present yet, create it!
-	}
-	newFd := int(C.ebpf_map_create(
-		name,
-		C.__u32(m.Type),
-		C.__u32(m.KeySize),
-		C.__u32(m.ValueSize),
-		C.__u32(m.MaxEntries),
-		C.__u32(m.Flags),
-		C.__u32(m.InnerMapFd),
-		unsafe.Pointer(&logBuf[0]),
-		C.size_t(unsafe.Sizeof(logBuf)),
-	))
-
-	if newFd == -1 {
-		return fmt.Errorf("ebpf_create_map() failed: %s",
-			NullTerminatedStringToString(logBuf[:]))
-	}
-	m.fd = newFd
+		// No map at given location present yet (or replaced / to be migrated), create it!
+	}
+	attr := bpfMapCreateAttr{
+		mapType:    uint32(m.Type),
+		keySize:    uint32(m.KeySize),
+		valueSize:  uint32(m.ValueSize),
+		maxEntries: uint32(m.MaxEntries),
+		mapFlags:   uint32(m.Flags),
+		innerMapFd: uint32(m.InnerMapFd),
+		mapName:    objName(KernelObjectName(m.Name)),
+		mapIfindex: uint32(m.Ifindex),
+		// Maps with special fields in value
+		btfFd:          uint32(m.btfFd),
+		btfKeyTypeId:   uint32(m.btfKeyTypeId),
+		btfValueTypeId: uint32(m.btfValueTypeId),
+	}
+	if m.TokenFd != 0 {
+		attr.mapFlags |= bpfFTokenFd
+		attr.mapTokenFd = int32(m.TokenFd)
+	}
+	res, err := bpfSyscall(bpfCmdMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return newSyscallError("ebpf_create_map()", err, nil)
+	}
+	m.fd = res
+	m.nameId = registerObjectName(objectNames.maps, m.fd, m.Name)
+	metrics.Add(MetricMapsCreated, 1)
 
 	// If eBPF program decides to make this map system wide - pin it to given location
 	if m.PersistentPath != "" {
-		err := ebpfObjPin(m.fd, m.PersistentPath)
+		var err error
+		if m.migrateFrom != nil {
+			err = m.migrateLocked()
+		} else {
+			err = ebpfObjPin(m.fd, m.PersistentPath)
+		}
 		if err != nil {
 			// Destroy just created map
-			cerr := m.Close()
+			cerr := m.closeLocked()
 			if cerr != nil {
 				return fmt.Errorf("%v, also close() failed: %v", err, cerr)
 			}
@@ -493,17 +586,91 @@ func (m *EbpfMap) Create() error {
 	return nil
 }
 
-// Close destroy eBPF map (removes it from kernel)
+// Pin saves map into given location of bpffs, so it outlives current process
+// and can be shared with others (e.g. opened by PersistentPath)
+func (m *EbpfMap) Pin(path string) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return ebpfObjPin(m.fd, path)
+}
+
+// Close destroy eBPF map (removes it from kernel).
+// Closing already closed / not created map does nothing.
 func (m *EbpfMap) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.closeLocked()
+}
+
+// Actual implementation of Close(), caller must hold write lock
+func (m *EbpfMap) closeLocked() error {
 	if m.fd == 0 {
-		return errors.New("Already closed / not created")
+		return nil
 	}
 	err := closeFd(m.fd)
 	if err != nil {
 		return err
 	}
 
+	unregisterObjectName(objectNames.maps, m.nameId)
 	m.fd = 0
+	m.nameId = 0
+	return nil
+}
+
+// Applies PinPolicy to map already pinned at PersistentPath (fd).
+// On success either fd becomes m.fd (map re-used) / source of migration
+// or pin is removed and fd is closed. On error fd is left to caller to close.
+func (m *EbpfMap) handlePinned(fd int) error {
+	switch m.PinPolicy {
+	case MapPinReplace:
+		if err := unpinObject(m.PersistentPath); err != nil {
+			return fmt.Errorf("Unable to replace pinned map '%s': %v", m.Name, err)
+		}
+		closeFd(fd)
+		return nil
+	case MapPinExclusive:
+		return fmt.Errorf("Map '%s': '%s' is already pinned", m.Name, m.PersistentPath)
+	}
+
+	pinned, err := NewMapFromExistingMapByFd(fd)
+	if err != nil {
+		return err
+	}
+	// Offload device is not reported by kernel
+	pinned.Ifindex = m.Ifindex
+	if m.PinPolicy == MapPinMigrate {
+		return m.checkMigration(pinned)
+	}
+	if err := m.checkCompatible(pinned); err != nil {
+		return fmt.Errorf("Map '%s' pinned at '%s' can't be reused: %v", m.Name, m.PersistentPath, err)
+	}
+	m.fd = fd
+	m.spinLock = pinned.spinLock
+	m.spinLockOffset = pinned.spinLockOffset
+
+	return nil
+}
+
+// Checks if other map definition is the same, i.e. map can be used instead of other
+func (m *EbpfMap) checkCompatible(other *EbpfMap) error {
+	switch {
+	case m.Type != other.Type:
+		return fmt.Errorf("type %v, expected %v", other.Type, m.Type)
+	case m.KeySize != other.KeySize:
+		return fmt.Errorf("key size %d, expected %d", other.KeySize, m.KeySize)
+	case m.ValueSize != other.ValueSize:
+		return fmt.Errorf("value size %d, expected %d", other.ValueSize, m.ValueSize)
+	case m.MaxEntries != other.MaxEntries:
+		return fmt.Errorf("max entries %d, expected %d", other.MaxEntries, m.MaxEntries)
+	case m.Flags != other.Flags:
+		return fmt.Errorf("flags %#x, expected %#x", other.Flags, m.Flags)
+	case m.Ifindex != other.Ifindex:
+		return fmt.Errorf("ifindex %d, expected %d", other.Ifindex, m.Ifindex)
+	}
+
 	return nil
 }
 
@@ -516,45 +683,151 @@ func (m *EbpfMap) Close() error {
 //	// Insert item into array of maps
 //	superMap.Insert(1, newItem)
 func (m *EbpfMap) CloneTemplate() Map {
-	res := *m
-	res.fd = 0
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	return &res
+	// Copy field by field: lock must not be copied
+	return &EbpfMap{
+		Name:           m.Name,
+		Type:           m.Type,
+		KeySize:        m.KeySize,
+		ValueSize:      m.ValueSize,
+		MaxEntries:     m.MaxEntries,
+		Flags:          m.Flags,
+		InnerMapName:   m.InnerMapName,
+		InnerMapFd:     m.InnerMapFd,
+		PersistentPath: m.PersistentPath,
+		PinPolicy:      m.PinPolicy,
+		Migrate:        m.Migrate,
+		Ifindex:        m.Ifindex,
+		TokenFd:        m.TokenFd,
+		valueRealSize:  m.valueRealSize,
+		innerTemplate:  m.innerTemplate,
+	}
 }
 
 // Lookup performs lookup and returns array of bytes
 // WARNING: For Per-CPU array/hash map return value will contain
-// data from all CPUs, i.e. length = valueSize * nCPU
+// data from all CPUs, each aligned to 8 bytes, i.e. length = round_up(valueSize, 8) * nCPU
 func (m *EbpfMap) Lookup(ikey interface{}) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	// Convert key into bytes
-	key, err := KeyValueToBytes(ikey, int(m.KeySize))
+	key, err := m.lookupKey(ikey)
 	if err != nil {
 		return nil, err
 	}
 
 	var val = make([]byte, m.valueRealSize)
-	var logBuf [errCodeBufferSize]byte
+	if err = m.lookupLocked(key, val); err != nil {
+		return nil, err
+	}
+
+	return val, nil
+}
 
-	res := int(C.ebpf_map_lookup_elem(
-		C.__u32(m.fd),
-		unsafe.Pointer(&key[0]),
-		unsafe.Pointer(&val[0]),
-		unsafe.Pointer(&logBuf[0]),
-		C.size_t(unsafe.Sizeof(logBuf))))
+// LookupInto performs lookup of raw key (exactly KeySize bytes) and copies value into dst,
+// so hot paths can re-use buffers and avoid allocations / interface conversions.
+// dst must be able to hold whole value, for Per-CPU maps it is round_up(valueSize, 8) * nCPU,
+// see Lookup(). Too small dst is reported as *MapSizeError.
+func (m *EbpfMap) LookupInto(key []byte, dst []byte) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 
-	if res == -1 {
-		return nil, fmt.Errorf("ebpf_map_lookup_elem() failed: %s",
-			NullTerminatedStringToString(logBuf[:]))
+	if len(key) != m.KeySize {
+		return &MapSizeError{Map: m.Name, Kind: "key", Expected: m.KeySize, Got: len(key)}
+	}
+	// Map may be not created yet, i.e. valueRealSize is unknown
+	if size := m.valueRealSize; len(dst) < size || len(dst) < m.ValueSize {
+		if size < m.ValueSize {
+			size = m.ValueSize
+		}
+		return &MapSizeError{Map: m.Name, Kind: "value", Expected: size, Got: len(dst)}
 	}
 
-	return val, nil
+	return m.lookupLocked(key, dst)
+}
+
+// Converts key for read only operations: raw keys of proper size are used as is
+func (m *EbpfMap) lookupKey(ikey interface{}) ([]byte, error) {
+	if key, ok := ikey.([]byte); ok && len(key) == m.KeySize {
+		return key, nil
+	}
+	return m.keyBytes(ikey)
+}
+
+// Converts key into bytes, see toBytes()
+func (m *EbpfMap) keyBytes(ikey interface{}) ([]byte, error) {
+	return m.toBytes(ikey, "key", m.KeySize)
+}
+
+// Converts value into bytes, see toBytes(). Value of Per-CPU map holds
+// values of all CPUs (like one returned by Lookup()), kernel reads that much.
+func (m *EbpfMap) valueBytes(ivalue interface{}) ([]byte, error) {
+	if m.isPerCpu() && m.valueRealSize > 0 {
+		return m.toBytes(ivalue, "value", m.valueRealSize)
+	}
+	return m.toBytes(ivalue, "value", m.ValueSize)
+}
+
+// Converts key / value into bytes (see KeyValueToBytes()), ones of fixed size
+// (sized integers, []byte, typed keys) must be of exactly map's key / value size.
+// Strings are zero padded (C strings), as well as deprecated flexible int.
+func (m *EbpfMap) toBytes(ival interface{}, kind string, size int) ([]byte, error) {
+	if marshaler, ok := ival.(encoding.BinaryMarshaler); ok {
+		data, err := marshaler.MarshalBinary()
+		if err != nil {
+			return nil, fmt.Errorf("Map '%s': invalid %s: %v", m.Name, kind, err)
+		}
+		ival = data
+	}
+	got := size
+	switch val := ival.(type) {
+	case []byte:
+		got = len(val)
+	case string:
+		if len(val) > size {
+			got = len(val)
+		}
+	case uint8:
+		got = 1
+	case uint16:
+		got = 2
+	case uint32, int32:
+		got = 4
+	case uint64:
+		got = 8
+	case *net.IPNet:
+		_, bits := val.Mask.Size()
+		got = bits/8 + 4
+	}
+	if got != size {
+		return nil, &MapSizeError{Map: m.Name, Kind: kind, Expected: size, Got: got}
+	}
+	res, err := KeyValueToBytes(ival, size)
+	if err != nil {
+		return nil, fmt.Errorf("Map '%s': invalid %s: %v", m.Name, kind, err)
+	}
+	return res, nil
+}
+
+// Actual lookup, caller must hold read lock
+func (m *EbpfMap) lookupLocked(key []byte, dst []byte) error {
+	err := ebpfMapElemOp(bpfCmdMapLookupElem, m.fd,
+		unsafe.Pointer(&key[0]), unsafe.Pointer(&dst[0]), m.elemFlags(0))
+	if err != nil {
+		return newSyscallError("ebpf_map_lookup_elem()", err, nil)
+	}
+	m.clearSpinLock(dst)
+	return nil
 }
 
 // LookupString perform lookup and returns GO string from NULL terminated C string
 // WARNING: Does NOT work for Per-CPU maps (not an real use case?).
 func (m *EbpfMap) LookupString(ikey interface{}) (string, error) {
 	if m.isPerCpu() {
-		return "", fmt.Errorf("LookupString is not supported for %v", m.Type)
+		return "", &NotSupportedError{Feature: fmt.Sprintf("LookupString for %v", m.Type)}
 	}
 	val, err := m.Lookup(ikey)
 	if err != nil {
@@ -567,36 +840,74 @@ func (m *EbpfMap) LookupString(ikey interface{}) (string, error) {
 // with support for per-cpu maps (multiple values joined into one buffer)
 func (m *EbpfMap) parseFlexibleMultiInteger(rawVal []byte) uint64 {
 	// Per-CPU map types have slightly different behavior:
-	// lookup returns all values in single call, e.g. assuming for uint32 and 2 CPUs:
-	// {0x01, 0x00, 0x00, 0x00, 0x0ff, 0x00, 0x00, 0x00}
-	//   ^^^^ CPU0 value ^^^^    ^^^^ CPU1 value^^^^^
+	// lookup returns all values in single call, each aligned to 8 bytes,
+	// e.g. assuming for uint32 and 2 CPUs:
+	// {0x01, 0x00, 0x00, 0x00, 0, 0, 0, 0, 0x0ff, 0x00, 0x00, 0x00, 0, 0, 0, 0}
+	//   ^^^^ CPU0 value ^^^^                ^^^^ CPU1 value^^^^^
 	//  = 0x01 + 0xff = 256
-	//
-	// First value (for all map types)
-	val := ParseFlexibleIntegerLittleEndian(rawVal[:m.ValueSize])
 	if m.isPerCpu() {
-		// Sum up values from all CPUs in case of Per-CPU maps,
-		// starting from second item
-		for i := m.ValueSize; i < m.valueRealSize; i += m.ValueSize {
-			val += ParseFlexibleIntegerLittleEndian(rawVal[i : i+m.ValueSize])
-		}
+		stride := perCpuValueSize(m.ValueSize)
+		return sumPerCPUValues(rawVal, m.ValueSize, stride, m.valueRealSize/stride)
 	}
-	return val
+	return ParseFlexibleInteger(rawVal[:m.ValueSize])
 }
 
 // LookupInt performs lookup and returns integer
 // WARNING: For Per-CPU array/hash returns sum of values from all CPUs
+//
+// Deprecated: value of any size up to 8 bytes is silently accepted and
+// truncated to int, use LookupUint32() / LookupUint64() / LookupValue() instead.
 func (m *EbpfMap) LookupInt(ikey interface{}) (int, error) {
 	val, err := m.LookupUint64(ikey)
 	return int(val), err
 }
 
+// LookupUint32 performs lookup of __u32 value (host byte order),
+// map value size must be exactly 4 bytes.
+// WARNING: For Per-CPU array/hash returns sum of values from all CPUs
+func (m *EbpfMap) LookupUint32(ikey interface{}) (uint32, error) {
+	if m.ValueSize != 4 {
+		return 0, fmt.Errorf("Map '%s' value size is %d bytes, not 4 (__u32)", m.Name, m.ValueSize)
+	}
+	val, err := m.LookupUint64(ikey)
+	return uint32(val), err
+}
+
+// LookupValue performs lookup and decodes value into typed one,
+// e.g. Be32 for __be32 values or IPv4Key for addresses. Value size
+// must match type exactly. Per-CPU maps are not supported.
+func (m *EbpfMap) LookupValue(ikey interface{}, value encoding.BinaryUnmarshaler) error {
+	if m.isPerCpu() {
+		return &NotSupportedError{Feature: fmt.Sprintf("LookupValue for %v", m.Type)}
+	}
+	val, err := m.Lookup(ikey)
+	if err != nil {
+		return err
+	}
+	return value.UnmarshalBinary(val[:m.ValueSize])
+}
+
 // LookupUint64 performs lookup and returns uint64
 // WARNING: For Per-CPU array/hash returns sum of values from all CPUs
 func (m *EbpfMap) LookupUint64(ikey interface{}) (uint64, error) {
 	if m.ValueSize > 8 {
 		return 0, errors.New("Value is too large to fit int")
 	}
+	// Regular maps: value fits into buffer on stack, so no allocations needed
+	if !m.isPerCpu() {
+		m.mu.RLock()
+		defer m.mu.RUnlock()
+
+		key, err := m.lookupKey(ikey)
+		if err != nil {
+			return 0, err
+		}
+		var buf [8]byte
+		if err = m.lookupLocked(key, buf[:m.ValueSize]); err != nil {
+			return 0, err
+		}
+		return ParseFlexibleInteger(buf[:m.ValueSize]), nil
+	}
 	rawVal, err := m.Lookup(ikey)
 	if err != nil {
 		return 0, err
@@ -606,48 +917,45 @@ func (m *EbpfMap) LookupUint64(ikey interface{}) (uint64, error) {
 
 // Actual implementation for Insert / Update methods
 func (m *EbpfMap) updateImpl(ikey interface{}, ivalue interface{}, op int) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	// ArrayOfMaps/ProgArray requires BPF_ANY in order to update item for some reason... :(
 	if m.Type == MapTypeArrayOfMaps || m.Type == MapTypeProgArray {
 		op = bpfAny
 	}
 	// Convert key/value into bytes
-	key, err := KeyValueToBytes(ikey, int(m.KeySize))
+	key, err := m.keyBytes(ikey)
 	if err != nil {
 		return err
 	}
 
-	val, err := KeyValueToBytes(ivalue, int(m.ValueSize))
+	val, err := m.valueBytes(ivalue)
 	if err != nil {
 		return err
 	}
 
-	var logBuf [errCodeBufferSize]byte
-
-	res := int(C.ebpf_map_update_elem(
-		C.__u32(m.fd),
-		unsafe.Pointer(&key[0]),
-		unsafe.Pointer(&val[0]),
-		C.__u64(op),
-		unsafe.Pointer(&logBuf[0]),
-		C.size_t(unsafe.Sizeof(logBuf))))
-
-	if res == -1 {
-		return fmt.Errorf("ebpf_map_update_elem() failed: %s",
-			NullTerminatedStringToString(logBuf[:]))
+	err = ebpfMapElemOp(bpfCmdMapUpdateElem, m.fd,
+		unsafe.Pointer(&key[0]), unsafe.Pointer(&val[0]), m.elemFlags(op))
+	if err != nil {
+		return newSyscallError("ebpf_map_update_elem()", err, nil)
 	}
+	atomic.AddUint64(&m.updates, 1)
 
 	return nil
 
 }
 
 // Insert inserts value into eBPF map at given ikey.
-// Supported key/value types are: int, uint8, uint16, uint32, int32, uint64, string, []byte, net.IPNet
+// Supported key/value types are listed in KeyValueToBytes(),
+// value of Per-CPU map holds values of all CPUs like for Lookup()
 func (m *EbpfMap) Insert(ikey interface{}, ivalue interface{}) error {
 	return m.updateImpl(ikey, ivalue, bpfNoexist)
 }
 
 // Update updates (replaces) element at given ikey.
-// Supported ivalue types are: int, uint8, uint16, uint32, int32, uint64, string, []byte, net.IPNet
+// Supported key/value types are listed in KeyValueToBytes(),
+// value of Per-CPU map holds values of all CPUs like for Lookup()
 //
 // Element must be inserted before for non array types (map, hash)
 func (m *EbpfMap) Update(ikey interface{}, ivalue interface{}) error {
@@ -655,8 +963,8 @@ func (m *EbpfMap) Update(ikey interface{}, ivalue interface{}) error {
 }
 
 // Upsert updates (replaces) or inserts element at given ikey.
-// Supported ivalue types are: int, uint8, uint16, uint32, int32, uint64, string, []byte, net.IPNet
-//
+// Supported key/value types are listed in KeyValueToBytes(),
+// value of Per-CPU map holds values of all CPUs like for Lookup()
 func (m *EbpfMap) Upsert(ikey interface{}, ivalue interface{}) error {
 	return m.updateImpl(ikey, ivalue, bpfAny)
 }
@@ -664,30 +972,157 @@ func (m *EbpfMap) Upsert(ikey interface{}, ivalue interface{}) error {
 // Delete deletes element by given ikey.
 // Array based types are not supported.
 func (m *EbpfMap) Delete(ikey interface{}) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	// Convert key into bytes
-	key, err := KeyValueToBytes(ikey, int(m.KeySize))
+	key, err := m.keyBytes(ikey)
 	if err != nil {
 		return err
 	}
 
-	var logBuf [errCodeBufferSize]byte
+	err = ebpfMapElemOp(bpfCmdMapDeleteElem, m.fd, unsafe.Pointer(&key[0]), nil, 0)
+	if err != nil {
+		return newSyscallError("ebpf_map_delete_elem()", err, nil)
+	}
+	atomic.AddUint64(&m.deletes, 1)
+
+	return nil
+}
+
+// DeleteBatch deletes raw keys from map using as few syscalls as possible
+// (BPF_MAP_DELETE_BATCH, linux 5.6+, element by element on older kernels).
+// Keys which are not in map (e.g. already evicted from LRU map) are skipped.
+// Returns number of deleted elements.
+func (m *EbpfMap) DeleteBatch(keys [][]byte) (int, error) {
+	return m.DeleteBatchContext(context.Background(), keys)
+}
 
-	res := int(C.ebpf_map_delete_elem(
-		C.__u32(m.fd),
-		unsafe.Pointer(&key[0]),
-		unsafe.Pointer(&logBuf[0]),
-		C.size_t(unsafe.Sizeof(logBuf))))
+// DeleteBatchContext is DeleteBatch() which stops once ctx is done (checked
+// between syscalls), returning number of elements deleted so far along with ctx.Err()
+func (m *EbpfMap) DeleteBatchContext(ctx context.Context, keys [][]byte) (int, error) {
+	deleted, err := m.deleteBatch(ctx, keys)
+	atomic.AddUint64(&m.deletes, uint64(deleted))
+	return deleted, err
+}
 
-	if res == -1 {
-		return fmt.Errorf("ebpf_map_delete_elem() failed: %s",
-			NullTerminatedStringToString(logBuf[:]))
+func (m *EbpfMap) deleteBatch(ctx context.Context, keys [][]byte) (int, error) {
+	if len(keys) == 0 {
+		return 0, nil
+	}
+	buf := make([]byte, 0, len(keys)*m.KeySize)
+	for _, key := range keys {
+		if len(key) != m.KeySize {
+			return 0, &MapSizeError{Map: m.Name, Kind: "key", Expected: m.KeySize, Got: len(key)}
+		}
+		buf = append(buf, key...)
 	}
 
-	return nil
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	deleted := 0
+	for offset := 0; offset < len(keys); {
+		if err := ctx.Err(); err != nil {
+			return deleted, err
+		}
+		count := len(keys) - offset
+		if count > mapBatchSize {
+			count = mapBatchSize
+		}
+		attr := bpfMapBatchAttr{
+			keys:  newBpfPointer(unsafe.Pointer(&buf[offset*m.KeySize])),
+			count: uint32(count),
+			mapFd: uint32(m.fd),
+		}
+		_, err := bpfSyscall(bpfCmdMapDeleteBatch, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		if offset == 0 && (err == syscall.EINVAL || err == errnoENOTSUPP) {
+			// Old kernel / map type without batch support, count is not updated
+			return m.deleteByKeys(ctx, keys)
+		}
+		// On error count is number of elements deleted before failed one
+		deleted += int(attr.count)
+		offset += int(attr.count)
+		switch {
+		case err == nil:
+		case err == syscall.ENOENT:
+			// Skip missing key
+			offset++
+		default:
+			return deleted, newSyscallError("ebpf_map_delete_batch()", err, nil)
+		}
+	}
+
+	return deleted, nil
+}
+
+// Deletes raw keys element by element, skipping missing ones
+func (m *EbpfMap) deleteByKeys(ctx context.Context, keys [][]byte) (int, error) {
+	deleted := 0
+	for i, key := range keys {
+		if i%mapBatchSize == 0 {
+			if err := ctx.Err(); err != nil {
+				return deleted, err
+			}
+		}
+		err := ebpfMapElemOp(bpfCmdMapDeleteElem, m.fd, unsafe.Pointer(&key[0]), nil, 0)
+		if err == syscall.ENOENT {
+			continue
+		}
+		if err != nil {
+			return deleted, newSyscallError("ebpf_map_delete_elem()", err, nil)
+		}
+		deleted++
+	}
+
+	return deleted, nil
+}
+
+// GetNextKey returns key which follows ikey in map, can be used to iterate
+// over all map elements:
+//
+//	key, err := m.GetNextKey(nil)
+//	for ; err == nil; key, err = m.GetNextKey(key) {
+//		// do something with key
+//	}
+//	if err != goebpf.ErrNoMoreKeys {
+//		// handle error
+//	}
+//
+// If ikey is nil (or does not exist in map) first key of map returned.
+// ErrNoMoreKeys returned when ikey is the last element of map.
+func (m *EbpfMap) GetNextKey(ikey interface{}) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var keyPtr unsafe.Pointer
+	if ikey != nil {
+		// Convert key into bytes
+		key, err := m.keyBytes(ikey)
+		if err != nil {
+			return nil, err
+		}
+		keyPtr = unsafe.Pointer(&key[0])
+	}
+
+	var nextKey = make([]byte, m.KeySize)
+
+	err := ebpfMapElemOp(bpfCmdMapGetNextKey, m.fd, keyPtr, unsafe.Pointer(&nextKey[0]), 0)
+	if err != nil {
+		if err == syscall.ENOENT {
+			return nil, ErrNoMoreKeys
+		}
+		return nil, newSyscallError("ebpf_map_get_next_key()", err, nil)
+	}
+
+	return nextKey, nil
 }
 
 // GetFd returns fd (file descriptor) of eBPF map
 func (m *EbpfMap) GetFd() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
 	return m.fd
 }
 
@@ -695,3 +1130,8 @@ func (m *EbpfMap) GetFd() int {
 func (m *EbpfMap) GetName() string {
 	return m.Name
 }
+
+// KernelName returns name of map as kept by kernel, see KernelObjectName()
+func (m *EbpfMap) KernelName() string {
+	return KernelObjectName(m.Name)
+}
@@ -0,0 +1,252 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/dropbox/goebpf/goebpf_btf"
+)
+
+// Maps are defined by struct bpf_map_def, so kernel knows nothing about their key / value
+// types. However values with special fields (struct bpf_spin_lock, struct bpf_timer) are
+// accepted by kernel only for maps created with BTF. Types of such maps are taken from
+// ELF's BTF (clang -g), where they are described by BPF_ANNOTATE_KV_PAIR():
+//
+//	struct elem {
+//		struct bpf_timer t;
+//		__u64 counter;
+//	};
+//	BPF_MAP_DEF(timers) = {
+//		.map_type = BPF_MAP_TYPE_HASH,
+//		.key_size = sizeof(__u32),
+//		.value_size = sizeof(struct elem),
+//		.max_entries = 1024,
+//	};
+//	BPF_MAP_ADD(timers);
+//	BPF_ANNOTATE_KV_PAIR(timers, __u32, struct elem);
+//
+// Maps without special fields are created without BTF as before, so older kernels keep working.
+// The only exception is maps with migration function, see map_migrate.go: they are created
+// without BTF as well if kernel rejects it (before 4.18 / BTF of newer clang).
+
+// Name prefix of struct generated by BPF_ANNOTATE_KV_PAIR()
+const btfMapTypePrefix = "____btf_map_"
+
+// Helpers working with struct bpf_timer, linux 5.15+
+const (
+	bpfFuncTimerInit        = 169
+	bpfFuncTimerSetCallback = 170
+	bpfFuncTimerStart       = 171
+	bpfFuncTimerCancel      = 172
+)
+
+// Map types which can hold struct bpf_timer / struct bpf_spin_lock in values
+var (
+	timerMapTypes = map[MapType]bool{
+		MapTypeHash:    true,
+		MapTypeArray:   true,
+		MapTypeLRUHash: true,
+	}
+	spinLockMapTypes = map[MapType]bool{
+		MapTypeHash:          true,
+		MapTypeArray:         true,
+		MapTypeCGroupStorage: true,
+		MapTypeSKStorage:     true,
+	}
+)
+
+// Reads key / value types of maps with special fields from ELF's BTF.
+// Returns BTF ready to be loaded into kernel or nil if no map needs BTF.
+// BTF which can't be parsed is skipped as unsupported part of ELF, maps
+// are created without it then.
+func (s *ebpfSystem) readMapsBtf(elfFile *elf.File, maps []*EbpfMap) ([]byte, error) {
+	section := elfFile.Section(goebpf_btf.ElfSectionName)
+	if section == nil {
+		return nil, nil
+	}
+	data, err := section.Data()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read '%s' section data: %v", section.Name, err)
+	}
+	spec, err := goebpf_btf.ParseSpec(data, elfFile.ByteOrder)
+	if err != nil {
+		return nil, s.unsupported(true, section.Name, "Unable to parse BTF: %v", err)
+	}
+
+	needed := false
+	for _, m := range maps {
+		kv, err := spec.TypeByName(btfMapTypePrefix+m.Name, goebpf_btf.KindStruct)
+		if err != nil || len(kv.Members) != 2 {
+			continue
+		}
+		key, value := kv.Members[0].Type, kv.Members[1].Type
+		m.btfKeyType, m.btfValueType = key, value
+		_, m.timer = goebpf_btf.TimerOffset(value)
+		m.spinLockOffset, m.spinLock = goebpf_btf.SpinLockOffset(value)
+		// Maps to be migrated are created with BTF as well, so next versions
+		// of application can detect layout changes of pinned map
+		if !m.timer && !m.spinLock && m.Migrate == nil {
+			continue
+		}
+		if err := checkMapBtf(m, key, value); err != nil {
+			return nil, err
+		}
+		m.btfKeyTypeId = key.ID
+		m.btfValueTypeId = value.ID
+		needed = true
+	}
+	if !needed {
+		return nil, nil
+	}
+
+	return fixupElfBtf(elfFile, data)
+}
+
+// Returns copy of ELF's BTF data with sizes of data sections / offsets of
+// variables filled, so it can be loaded into kernel
+func fixupElfBtf(elfFile *elf.File, data []byte) ([]byte, error) {
+	// Data of section is cached by debug/elf, so patch a copy
+	data = append([]byte(nil), data...)
+	symbols, err := elfFile.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("elf.Symbols() failed: %v", err)
+	}
+	err = goebpf_btf.FixupDataSections(data, elfFile.ByteOrder,
+		func(name string) (uint32, bool) {
+			if s := elfFile.Section(name); s != nil {
+				return uint32(s.Size), true
+			}
+			return 0, false
+		},
+		func(sectionName, name string) (uint32, bool) {
+			for _, sym := range symbols {
+				if sym.Name == name && int(sym.Section) < len(elfFile.Sections) &&
+					elfFile.Sections[sym.Section].Name == sectionName {
+					return uint32(sym.Value), true
+				}
+			}
+			return 0, false
+		})
+	if err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
+
+// Validates BTF types of map with special fields against map definition
+func checkMapBtf(m *EbpfMap, key, value *goebpf_btf.Type) error {
+	if m.timer && !timerMapTypes[m.Type] {
+		return fmt.Errorf("Map '%s': bpf_timer is not supported by %v maps", m.Name, m.Type)
+	}
+	if m.spinLock && !spinLockMapTypes[m.Type] {
+		return fmt.Errorf("Map '%s': bpf_spin_lock is not supported by %v maps", m.Name, m.Type)
+	}
+	keySize, err := goebpf_btf.SizeOf(key)
+	if err != nil {
+		return fmt.Errorf("Map '%s': %v", m.Name, err)
+	}
+	valueSize, err := goebpf_btf.SizeOf(value)
+	if err != nil {
+		return fmt.Errorf("Map '%s': %v", m.Name, err)
+	}
+	if keySize != m.KeySize || valueSize != m.ValueSize {
+		return fmt.Errorf("Map '%s': BTF key / value sizes (%d / %d) do not match definition (%d / %d)",
+			m.Name, keySize, valueSize, m.KeySize, m.ValueSize)
+	}
+
+	return nil
+}
+
+// Checks that programs calling bpf_timer helpers have map with timer to work with,
+// otherwise verifier rejects them with quite confusing message
+func checkTimerMaps(name string, bytecode []byte, bo binary.ByteOrder, maps map[string]Map) error {
+	usesTimer := false
+	for offset := 0; offset+bpfInstructionLen <= len(bytecode); offset += bpfInstructionLen {
+		var insn bpfInstruction
+		if err := insn.load(bytecode[offset:], bo); err != nil {
+			return err
+		}
+		// Helper call: src_reg is zero, imm is helper ID
+		if insn.code == classJmp|jumpCall && insn.srcReg == 0 &&
+			insn.imm >= bpfFuncTimerInit && insn.imm <= bpfFuncTimerCancel {
+			usesTimer = true
+			break
+		}
+	}
+	if !usesTimer {
+		return nil
+	}
+	for _, m := range maps {
+		if em, ok := m.(*EbpfMap); ok && em.timer {
+			return nil
+		}
+	}
+	return fmt.Errorf("Program '%s' uses bpf_timer, but there are no maps with timer: "+
+		"describe map by BPF_ANNOTATE_KV_PAIR() and compile with -g", name)
+}
+
+// Loads BTF of maps into kernel, returns fd or 0 if BTF is rejected by kernel
+// (EINVAL / E2BIG of kernel without BTF support or not knowing some BTF kinds)
+// and no map really needs it: maps to be migrated are created without BTF then
+// (layout changes are not detected for them). Other errors (e.g. EPERM) are returned.
+func (s *ebpfSystem) loadMapsBtf(data []byte, maps []*EbpfMap) (int, error) {
+	fd, err := ebpfBtfLoad(data, s.tokenFd)
+	if err == nil {
+		return fd, nil
+	}
+	return 0, s.dropMapsBtf(maps, err)
+}
+
+// Makes maps to be created without BTF kernel rejected by err
+func (s *ebpfSystem) dropMapsBtf(maps []*EbpfMap, err error) error {
+	if !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.E2BIG) {
+		return err
+	}
+	for _, m := range maps {
+		if m.spinLock || m.timer {
+			return &NotSupportedError{
+				Feature: fmt.Sprintf("Map '%s' with bpf_spin_lock / bpf_timer on kernel rejecting BTF (%v)", m.Name, err),
+			}
+		}
+	}
+	s.logger.Printf("goebpf: unable to load BTF of maps, creating maps without BTF: %v", err)
+	for _, m := range maps {
+		m.btfKeyTypeId, m.btfValueTypeId = 0, 0
+	}
+
+	return nil
+}
+
+// Loads BTF into kernel (using BPF token if tokenFd is set), returns fd
+func ebpfBtfLoad(data []byte, tokenFd int) (int, error) {
+	attr := bpfBtfLoadAttr{
+		btf:     newBpfPointer(unsafe.Pointer(&data[0])),
+		btfSize: uint32(len(data)),
+	}
+	if tokenFd != 0 {
+		attr.btfFlags = bpfFTokenFd
+		attr.btfTokenFd = int32(tokenFd)
+	}
+	fd, err := bpfSyscall(bpfCmdBtfLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		// Try again with log to get reason
+		var logBuf [logBufferSize]byte
+		attr.btfLogBuf = newBpfPointer(unsafe.Pointer(&logBuf[0]))
+		attr.btfLogSize = uint32(len(logBuf))
+		attr.btfLogLevel = bpfLogLevelVerifierInfo
+		fd, err = bpfSyscall(bpfCmdBtfLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		if err != nil {
+			return 0, newSyscallError("ebpf_btf_load()", err, logBuf[:])
+		}
+	}
+
+	return fd, nil
+}
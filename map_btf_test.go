@@ -0,0 +1,100 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"encoding/binary"
+	"errors"
+	"syscall"
+	"testing"
+
+	"github.com/dropbox/goebpf/goebpf_btf"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckMapBtf(t *testing.T) {
+	u32 := &goebpf_btf.Type{Kind: goebpf_btf.KindInt, Name: "__u32", Size: 4}
+	timer := &goebpf_btf.Type{Kind: goebpf_btf.KindStruct, Name: "bpf_timer", Size: 16}
+	elem := &goebpf_btf.Type{Kind: goebpf_btf.KindStruct, Name: "elem", Size: 24, Members: []goebpf_btf.Member{
+		{Name: "t", Type: timer},
+	}}
+
+	m := &EbpfMap{Name: "timers", Type: MapTypeHash, KeySize: 4, ValueSize: 24, timer: true}
+	assert.NoError(t, checkMapBtf(m, u32, elem))
+
+	// Sizes must match definition
+	m.ValueSize = 16
+	assert.Error(t, checkMapBtf(m, u32, elem))
+
+	// Timers are not supported by per-CPU maps
+	m = &EbpfMap{Name: "timers", Type: MapTypePerCPUHash, KeySize: 4, ValueSize: 24, timer: true}
+	assert.Error(t, checkMapBtf(m, u32, elem))
+
+	m = &EbpfMap{Name: "locks", Type: MapTypeLRUHash, KeySize: 4, ValueSize: 24, spinLock: true}
+	assert.Error(t, checkMapBtf(m, u32, elem))
+}
+
+func TestCheckTimerMaps(t *testing.T) {
+	// call bpf_timer_start; exit
+	start := bpfInstruction{code: 0x85, imm: bpfFuncTimerStart}
+	exit := bpfInstruction{code: 0x95}
+	bytecode := append(start.save(binary.LittleEndian), exit.save(binary.LittleEndian)...)
+
+	noTimers := map[string]Map{
+		"counters": &EbpfMap{Name: "counters", Type: MapTypeHash},
+	}
+	assert.Error(t, checkTimerMaps("prog", bytecode, binary.LittleEndian, noTimers))
+
+	withTimers := map[string]Map{
+		"timers": &EbpfMap{Name: "timers", Type: MapTypeHash, timer: true},
+	}
+	assert.NoError(t, checkTimerMaps("prog", bytecode, binary.LittleEndian, withTimers))
+
+	// Programs without timer helpers don't need such maps
+	assert.NoError(t, checkTimerMaps("prog", exit.save(binary.LittleEndian), binary.LittleEndian, noTimers))
+}
+
+func TestReadMapsBtfInvalid(t *testing.T) {
+	// BTF of newer clang / corrupted one is skipped, maps are defined by bpf_map_def anyway
+	data := buildTestElfWithBtf([]byte("not a BTF"))
+	report, err := ParseElfData(data)
+	require.NoError(t, err)
+	assert.Len(t, report.Maps, 1)
+	require.Len(t, report.Warnings, 1)
+	assert.Equal(t, ".BTF", report.Warnings[0].Section)
+
+	_, err = ParseElfData(data, WithElfCompatibility(ElfCompatStrict))
+	assert.Error(t, err)
+}
+
+func TestDropMapsBtf(t *testing.T) {
+	s := NewDefaultEbpfSystem().(*ebpfSystem)
+	newMap := func() *EbpfMap {
+		return &EbpfMap{Name: "sessions", Type: MapTypeHash, KeySize: 4, ValueSize: 8, MaxEntries: 16,
+			btfKeyTypeId: 1, btfValueTypeId: 2}
+	}
+
+	// BTF rejected by kernel: maps to be migrated are created without it
+	for _, rejected := range []error{syscall.EINVAL, newSyscallError("ebpf_btf_load()", syscall.E2BIG, nil)} {
+		migrated := newMap()
+		assert.NoError(t, s.dropMapsBtf([]*EbpfMap{migrated}, rejected))
+		assert.Equal(t, 0, migrated.btfKeyTypeId)
+		assert.Equal(t, 0, migrated.btfValueTypeId)
+	}
+
+	// Other errors are not hidden
+	migrated := newMap()
+	err := s.dropMapsBtf([]*EbpfMap{migrated}, newSyscallError("ebpf_btf_load()", syscall.EPERM, nil))
+	assert.True(t, errors.Is(err, syscall.EPERM))
+	assert.Equal(t, 1, migrated.btfKeyTypeId)
+
+	// Maps with bpf_spin_lock / bpf_timer can't work without BTF
+	locked := newMap()
+	locked.Name = "locked"
+	locked.spinLock = true
+	err = s.dropMapsBtf([]*EbpfMap{migrated, locked}, syscall.EINVAL)
+	assert.True(t, errors.Is(err, ErrNotSupported))
+	assert.Contains(t, err.Error(), "Map 'locked' with bpf_spin_lock / bpf_timer")
+}
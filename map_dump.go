@@ -0,0 +1,172 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// DumpFormat is serialization format of map content used by Dump / Restore
+type DumpFormat int
+
+const (
+	// JSON object with map definition and list of entries:
+	//	{"name":"counters","type":"Hash","key_size":4,"value_size":8,
+	//	 "entries":[{"key":"0a000001","value":"0100000000000000"}]}
+	DumpFormatJSON DumpFormat = iota
+	// CSV with "key,value" header, one entry per line
+	DumpFormatCSV
+)
+
+func (f DumpFormat) String() string {
+	switch f {
+	case DumpFormatJSON:
+		return "JSON"
+	case DumpFormatCSV:
+		return "CSV"
+	}
+
+	return "Unknown"
+}
+
+// Serialized form of map, keys / values are hex encoded raw bytes
+type mapDump struct {
+	Name      string         `json:"name"`
+	Type      string         `json:"type"`
+	KeySize   int            `json:"key_size"`
+	ValueSize int            `json:"value_size"`
+	Entries   []mapDumpEntry `json:"entries"`
+}
+
+type mapDumpEntry struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+var csvDumpHeader = []string{"key", "value"}
+
+// Dump writes all entries of map into w.
+// For Per-CPU maps value contains data from all CPUs, like for Lookup(),
+// so value_size is round_up(ValueSize, 8) * nCPU.
+func (m *EbpfMap) Dump(w io.Writer, format DumpFormat) error {
+	return dumpMap(m, &mapDump{
+		Name:      m.Name,
+		Type:      m.Type.String(),
+		KeySize:   m.KeySize,
+		ValueSize: m.valueRealSize,
+	}, w, format)
+}
+
+// Restore reads entries previously saved by Dump() from r and puts them
+// into map. Existing entries with the same keys are overwritten,
+// the rest of map remains untouched.
+// Per-CPU maps and maps holding file descriptors (like ProgArray) are not supported.
+func (m *EbpfMap) Restore(r io.Reader, format DumpFormat) error {
+	if m.isPerCpu() {
+		return &NotSupportedError{Feature: fmt.Sprintf("Restore of %v map", m.Type)}
+	}
+	switch m.Type {
+	case MapTypeProgArray, MapTypePerfEventArray, MapTypeArrayOfMaps, MapTypeHashOfMaps,
+		MapTypeCgroupArray, MapTypeDevMap, MapTypeDevMapHash, MapTypeSockMap, MapTypeSockHash,
+		MapTypeXSKMap, MapTypeReusePortSockArray:
+		// Values are file descriptors / indexes valid only for process created them
+		return &NotSupportedError{Feature: fmt.Sprintf("Restore of %v map", m.Type)}
+	}
+	return restoreMap(m, m.KeySize, m.ValueSize, r, format)
+}
+
+// Reads all map entries and writes them in given format
+func dumpMap(m Map, dump *mapDump, w io.Writer, format DumpFormat) error {
+	key, err := m.GetNextKey(nil)
+	for ; err == nil; key, err = m.GetNextKey(key) {
+		value, err := m.Lookup(key)
+		if err != nil {
+			// Element may be deleted in between
+			continue
+		}
+		dump.Entries = append(dump.Entries, mapDumpEntry{
+			Key:   hex.EncodeToString(key),
+			Value: hex.EncodeToString(value),
+		})
+	}
+	if err != ErrNoMoreKeys {
+		return err
+	}
+
+	switch format {
+	case DumpFormatJSON:
+		return json.NewEncoder(w).Encode(dump)
+	case DumpFormatCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(csvDumpHeader)
+		for _, entry := range dump.Entries {
+			cw.Write([]string{entry.Key, entry.Value})
+		}
+		cw.Flush()
+		return cw.Error()
+	}
+
+	return fmt.Errorf("Unknown dump format %v", format)
+}
+
+// Parses dump and upserts all entries into map
+func restoreMap(m Map, keySize, valueSize int, r io.Reader, format DumpFormat) error {
+	var entries []mapDumpEntry
+
+	switch format {
+	case DumpFormatJSON:
+		var dump mapDump
+		if err := json.NewDecoder(r).Decode(&dump); err != nil {
+			return fmt.Errorf("Invalid JSON dump: %v", err)
+		}
+		if dump.KeySize != keySize || dump.ValueSize != valueSize {
+			return fmt.Errorf("Dump of map '%s' (key size %d, value size %d) does not match map '%s' (key size %d, value size %d)",
+				dump.Name, dump.KeySize, dump.ValueSize, m.GetName(), keySize, valueSize)
+		}
+		entries = dump.Entries
+	case DumpFormatCSV:
+		records, err := csv.NewReader(r).ReadAll()
+		if err != nil {
+			return fmt.Errorf("Invalid CSV dump: %v", err)
+		}
+		for idx, record := range records {
+			if len(record) != 2 {
+				return fmt.Errorf("Invalid CSV dump: line %d: 2 fields expected", idx+1)
+			}
+			if idx == 0 && record[0] == csvDumpHeader[0] && record[1] == csvDumpHeader[1] {
+				continue
+			}
+			entries = append(entries, mapDumpEntry{Key: record[0], Value: record[1]})
+		}
+	default:
+		return fmt.Errorf("Unknown dump format %v", format)
+	}
+
+	// Decode everything first to not leave map half restored because of malformed dump
+	keys := make([][]byte, len(entries))
+	values := make([][]byte, len(entries))
+	for idx, entry := range entries {
+		var err error
+		keys[idx], err = hex.DecodeString(entry.Key)
+		if err != nil || len(keys[idx]) != keySize {
+			return fmt.Errorf("Invalid key '%s' of entry %d", entry.Key, idx)
+		}
+		values[idx], err = hex.DecodeString(entry.Value)
+		if err != nil || len(values[idx]) != valueSize {
+			return fmt.Errorf("Invalid value '%s' of entry %d", entry.Value, idx)
+		}
+	}
+
+	for idx := range keys {
+		if err := m.Upsert(keys[idx], values[idx]); err != nil {
+			return fmt.Errorf("Unable to restore entry %d of map '%s': %v", idx, m.GetName(), err)
+		}
+	}
+
+	return nil
+}
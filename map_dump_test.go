@@ -0,0 +1,121 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"bytes"
+	"sort"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Simple in-memory map, implements only methods used by dump / restore
+type dumpTestMap struct {
+	Map
+	items map[string][]byte
+}
+
+func (m *dumpTestMap) GetName() string {
+	return "test"
+}
+
+func (m *dumpTestMap) Lookup(ikey interface{}) ([]byte, error) {
+	if val, ok := m.items[string(ikey.([]byte))]; ok {
+		return val, nil
+	}
+	return nil, ErrKeyNotExist
+}
+
+func (m *dumpTestMap) Upsert(ikey, ivalue interface{}) error {
+	m.items[string(ikey.([]byte))] = ivalue.([]byte)
+	return nil
+}
+
+func (m *dumpTestMap) GetNextKey(ikey interface{}) ([]byte, error) {
+	var keys []string
+	for key := range m.items {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	idx := 0
+	if ikey != nil {
+		idx = sort.SearchStrings(keys, string(ikey.([]byte))) + 1
+	}
+	if idx >= len(keys) {
+		return nil, ErrNoMoreKeys
+	}
+	return []byte(keys[idx]), nil
+}
+
+func newDumpTestMap() *dumpTestMap {
+	return &dumpTestMap{
+		items: map[string][]byte{
+			"\x01\x00": {1, 0, 0, 0},
+			"\x02\x00": {2, 0, 0, 0},
+		},
+	}
+}
+
+func TestDumpRestore(t *testing.T) {
+	header := func() *mapDump {
+		return &mapDump{Name: "test", Type: "Hash", KeySize: 2, ValueSize: 4}
+	}
+
+	for _, format := range []DumpFormat{DumpFormatJSON, DumpFormatCSV} {
+		src := newDumpTestMap()
+		buf := &bytes.Buffer{}
+		require.NoError(t, dumpMap(src, header(), buf, format), format.String())
+
+		dst := &dumpTestMap{items: map[string][]byte{"\x03\x00": {3, 0, 0, 0}}}
+		require.NoError(t, restoreMap(dst, 2, 4, buf, format), format.String())
+		assert.Len(t, dst.items, 3)
+		assert.Equal(t, []byte{2, 0, 0, 0}, dst.items["\x02\x00"])
+	}
+
+	// Check formats itself
+	buf := &bytes.Buffer{}
+	require.NoError(t, dumpMap(newDumpTestMap(), header(), buf, DumpFormatCSV))
+	assert.Equal(t, "key,value\n0100,01000000\n0200,02000000\n", buf.String())
+	buf.Reset()
+	require.NoError(t, dumpMap(newDumpTestMap(), header(), buf, DumpFormatJSON))
+	assert.Equal(t, `{"name":"test","type":"Hash","key_size":2,"value_size":4,`+
+		`"entries":[{"key":"0100","value":"01000000"},{"key":"0200","value":"02000000"}]}`+"\n",
+		buf.String())
+}
+
+func TestRestoreNegative(t *testing.T) {
+	runs := map[DumpFormat][]string{
+		DumpFormatJSON: {
+			"",
+			"{}",
+			`{"key_size":2,"value_size":8,"entries":[]}`,
+			`{"key_size":2,"value_size":4,"entries":[{"key":"01","value":"01000000"}]}`,
+			`{"key_size":2,"value_size":4,"entries":[{"key":"0100","value":"zz000000"}]}`,
+		},
+		DumpFormatCSV: {
+			"key,value\n0100\n",
+			"key,value\n0100,010000\n",
+			"0100,01000000,1\n",
+		},
+	}
+
+	for format, dumps := range runs {
+		for _, dump := range dumps {
+			m := &dumpTestMap{items: map[string][]byte{}}
+			err := restoreMap(m, 2, 4, bytes.NewBufferString(dump), format)
+			assert.Error(t, err, dump)
+			// Nothing must be restored from malformed dump
+			assert.Len(t, m.items, 0)
+		}
+	}
+
+	// Per-CPU / fd maps
+	for _, mapType := range []MapType{MapTypePerCPUHash, MapTypeProgArray} {
+		m := &EbpfMap{Type: mapType}
+		err := m.Restore(bytes.NewBufferString(""), DumpFormatCSV)
+		assert.IsType(t, &NotSupportedError{}, err)
+	}
+}
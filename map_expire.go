@@ -0,0 +1,221 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ClockSource is clock timestamps of map values are taken from
+type ClockSource int
+
+const (
+	// CLOCK_MONOTONIC: bpf_ktime_get_ns() / bpf_ktime_get_coarse_ns()
+	ClockMonotonic ClockSource = iota
+	// CLOCK_BOOTTIME: bpf_ktime_get_boot_ns(), includes time system was suspended
+	ClockBoottime
+	// CLOCK_REALTIME: nanoseconds since epoch, e.g. written by userspace
+	ClockRealtime
+)
+
+func (c ClockSource) String() string {
+	switch c {
+	case ClockMonotonic:
+		return "Monotonic"
+	case ClockBoottime:
+		return "Boottime"
+	case ClockRealtime:
+		return "Realtime"
+	}
+
+	return "Unknown"
+}
+
+// MapExpiry describes how entries of hash / LRU hash map expire: value holds
+// timestamp of last use (__u64 nanoseconds of Clock, host byte order) at
+// TimestampOffset. Entries with zero timestamp never expire.
+type MapExpiry struct {
+	TimestampOffset int
+	Clock           ClockSource
+	// Entries not used for more than TTL are removed
+	TTL time.Duration
+	// How often map is swept by ExpireMap(), TTL / 2 when zero
+	Interval time.Duration
+}
+
+func (e MapExpiry) validate(m Map) error {
+	if e.TTL <= 0 {
+		return fmt.Errorf("Invalid TTL %v", e.TTL)
+	}
+	if e.Interval < 0 {
+		return fmt.Errorf("Invalid sweep interval %v", e.Interval)
+	}
+	if e.TimestampOffset < 0 {
+		return fmt.Errorf("Invalid timestamp offset %d", e.TimestampOffset)
+	}
+	if e.Clock.String() == "Unknown" {
+		return fmt.Errorf("Invalid clock source %d", int(e.Clock))
+	}
+	em, ok := m.(*EbpfMap)
+	if !ok {
+		return nil
+	}
+	switch em.Type {
+	case MapTypeHash, MapTypeLRUHash:
+	default:
+		return fmt.Errorf("Map '%s' (%v) entries can't expire, must be hash / LRU hash", em.Name, em.Type)
+	}
+	if e.TimestampOffset+8 > em.ValueSize {
+		return fmt.Errorf("Timestamp offset %d is out of map '%s' value (%d bytes)", e.TimestampOffset, em.Name, em.ValueSize)
+	}
+
+	return nil
+}
+
+// SweepExpired removes expired entries of map m in one pass, using batch
+// operations when supported by kernel (linux 5.6+). Returns number of removed
+// entries. Like any map enumeration it is not atomic: entry used between
+// lookup and delete is removed as well, programs are expected to re-create it.
+func SweepExpired(m Map, e MapExpiry) (int, error) {
+	if err := e.validate(m); err != nil {
+		return 0, err
+	}
+	return sweepExpired(context.Background(), m, e, getClockTime(e.Clock))
+}
+
+// SweepExpiredContext is SweepExpired() which stops once ctx is done,
+// returning number of entries removed so far along with ctx.Err()
+func SweepExpiredContext(ctx context.Context, m Map, e MapExpiry) (int, error) {
+	if err := e.validate(m); err != nil {
+		return 0, err
+	}
+	return sweepExpired(ctx, m, e, getClockTime(e.Clock))
+}
+
+func sweepExpired(ctx context.Context, m Map, e MapExpiry, now uint64) (int, error) {
+	if uint64(e.TTL) > now {
+		// Clock started less than TTL ago, nothing can be expired yet
+		return 0, nil
+	}
+	deadline := now - uint64(e.TTL)
+	var expired [][]byte
+	err := forEachMapEntry(ctx, m, func(key, value []byte) error {
+		if len(value) < e.TimestampOffset+8 {
+			return fmt.Errorf("Timestamp offset %d is out of map '%s' value (%d bytes)", e.TimestampOffset, m.GetName(), len(value))
+		}
+		ts := HostByteOrder().Uint64(value[e.TimestampOffset:])
+		if ts != 0 && ts < deadline {
+			expired = append(expired, append([]byte{}, key...))
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if em, ok := m.(*EbpfMap); ok {
+		return em.DeleteBatchContext(ctx, expired)
+	}
+	removed := 0
+	for _, key := range expired {
+		if err := ctx.Err(); err != nil {
+			return removed, err
+		}
+		// Entry may be already evicted
+		if m.Delete(key) == nil {
+			removed++
+		}
+	}
+
+	return removed, nil
+}
+
+// MapSweeper periodically removes expired entries of map, see ExpireMap()
+type MapSweeper struct {
+	// First for 64-bit alignment of atomic access on 32-bit platforms
+	removed  uint64
+	m        Map
+	expiry   MapExpiry
+	now      func() uint64
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+	err      error
+}
+
+// Expire starts removing expired entries of map, see ExpireMap()
+func (m *EbpfMap) Expire(e MapExpiry) (*MapSweeper, error) {
+	return ExpireMap(m, e)
+}
+
+// ExpireMap starts goroutine which sweeps map m every e.Interval, removing
+// entries not used for more than e.TTL (see SweepExpired()).
+func ExpireMap(m Map, e MapExpiry) (*MapSweeper, error) {
+	if err := e.validate(m); err != nil {
+		return nil, err
+	}
+	if e.Interval == 0 {
+		e.Interval = e.TTL / 2
+	}
+	s := &MapSweeper{
+		m:      m,
+		expiry: e,
+		now: func() uint64 {
+			return getClockTime(e.Clock)
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run()
+
+	return s, nil
+}
+
+// Removed returns number of entries removed so far
+func (s *MapSweeper) Removed() uint64 {
+	return atomic.LoadUint64(&s.removed)
+}
+
+// Done returns channel closed when sweeper stopped either by Stop() or
+// because of error, see Err()
+func (s *MapSweeper) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns error caused sweeper to stop. Valid after Done() channel closed.
+func (s *MapSweeper) Err() error {
+	return s.err
+}
+
+// Stop stops sweeping. Safe to call multiple times.
+func (s *MapSweeper) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+func (s *MapSweeper) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.expiry.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+		removed, err := sweepExpired(context.Background(), s.m, s.expiry, s.now())
+		atomic.AddUint64(&s.removed, uint64(removed))
+		if err != nil {
+			s.err = err
+			return
+		}
+	}
+}
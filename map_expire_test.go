@@ -0,0 +1,106 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// In-memory map supporting deletes
+type expireTestMap struct {
+	*dumpTestMap
+}
+
+func (m *expireTestMap) Delete(ikey interface{}) error {
+	key := string(ikey.([]byte))
+	if _, ok := m.items[key]; !ok {
+		return ErrKeyNotExist
+	}
+	delete(m.items, key)
+	return nil
+}
+
+// Map of 10 entries, timestamp of entry i is i seconds, it is at offset 4
+func newExpireTestMap() *expireTestMap {
+	m := &expireTestMap{&dumpTestMap{items: make(map[string][]byte)}}
+	for i := 0; i < 10; i++ {
+		value := make([]byte, 12)
+		HostByteOrder().PutUint64(value[4:], uint64(i)*uint64(time.Second))
+		m.items[string([]byte{byte(i)})] = value
+	}
+	return m
+}
+
+func TestSweepExpired(t *testing.T) {
+	m := newExpireTestMap()
+	e := MapExpiry{TimestampOffset: 4, TTL: 5 * time.Second}
+	require.NoError(t, e.validate(m))
+
+	// Entries 1..4 are older than 5s, 0 has no timestamp
+	removed, err := sweepExpired(context.Background(), m, e, uint64(10*time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 4, removed)
+	assert.Len(t, m.items, 6)
+	assert.Contains(t, m.items, "\x00")
+	assert.Contains(t, m.items, "\x05")
+
+	// Clock is less than TTL
+	removed, err = sweepExpired(context.Background(), m, e, uint64(time.Second))
+	require.NoError(t, err)
+	assert.Equal(t, 0, removed)
+
+	// Value too short for timestamp
+	_, err = sweepExpired(context.Background(), m, MapExpiry{TimestampOffset: 6, TTL: time.Second}, uint64(10*time.Second))
+	assert.Error(t, err)
+}
+
+func TestMapExpiryValidate(t *testing.T) {
+	m := newExpireTestMap()
+	invalid := []MapExpiry{
+		{},
+		{TTL: time.Second, Interval: -1},
+		{TTL: time.Second, TimestampOffset: -1},
+		{TTL: time.Second, Clock: ClockSource(10)},
+	}
+	for _, e := range invalid {
+		assert.Error(t, e.validate(m))
+	}
+
+	em := &EbpfMap{Name: "test", Type: MapTypeArray, KeySize: 4, ValueSize: 16, MaxEntries: 1}
+	assert.Error(t, MapExpiry{TTL: time.Second}.validate(em))
+	em.Type = MapTypeLRUHash
+	assert.NoError(t, MapExpiry{TTL: time.Second, TimestampOffset: 8}.validate(em))
+	assert.Error(t, MapExpiry{TTL: time.Second, TimestampOffset: 9}.validate(em))
+	_, err := ExpireMap(em, MapExpiry{})
+	assert.Error(t, err)
+}
+
+func TestMapSweeper(t *testing.T) {
+	m := newExpireTestMap()
+	s := &MapSweeper{
+		m:      m,
+		expiry: MapExpiry{TimestampOffset: 4, TTL: 5 * time.Second, Interval: time.Millisecond},
+		now: func() uint64 {
+			return uint64(20 * time.Second)
+		},
+		stop: make(chan struct{}),
+		done: make(chan struct{}),
+	}
+	go s.run()
+
+	// Only entry without timestamp stays
+	for s.Removed() < 9 {
+		time.Sleep(time.Millisecond)
+	}
+	s.Stop()
+	s.Stop()
+	<-s.Done()
+	assert.NoError(t, s.Err())
+	assert.Equal(t, uint64(9), s.Removed())
+}
@@ -0,0 +1,143 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// ConfigEntry is key / value of config map, of types EbpfMap.Upsert() accepts
+type ConfigEntry struct {
+	Key   interface{}
+	Value interface{}
+}
+
+// ConfigFlipper publishes whole configurations kept in single map: it owns
+// two inner maps, new configuration is written into standby one, which then
+// atomically replaces active one in slot of array (hash) of maps. Programs
+// always see either old or new configuration, never a mix of them:
+//
+//	__u32 zero = 0;
+//	void *config = bpf_map_lookup_elem(&config_outer, &zero);
+//	if (!config)
+//		return XDP_PASS;
+//	struct rule *rule = bpf_map_lookup_elem(config, &key);
+//
+// Go side:
+//
+//	f, err := goebpf.NewConfigFlipper(configOuter, configTemplate, uint32(0))
+//	err = f.Publish([]goebpf.ConfigEntry{{Key: key1, Value: rule1}, {Key: key2, Value: rule2}})
+//
+// For consistent updates of several maps at once see DoubleBuffer.
+type ConfigFlipper struct {
+	mu     sync.Mutex
+	outer  *EbpfMap
+	slot   interface{}
+	maps   [2]*EbpfMap
+	active int
+}
+
+// NewConfigFlipper creates two inner maps from template inner and puts
+// the first one (empty config) into slot of outer map
+func NewConfigFlipper(outer *EbpfMap, inner *EbpfMap, slot interface{}) (*ConfigFlipper, error) {
+	if outer.Type != MapTypeArrayOfMaps && outer.Type != MapTypeHashOfMaps {
+		return nil, fmt.Errorf("Map '%s' (%v) is not array / hash of maps", outer.Name, outer.Type)
+	}
+	if inner == nil {
+		return nil, errors.New("Inner map template must be set")
+	}
+	f := &ConfigFlipper{
+		outer: outer,
+		slot:  slot,
+	}
+	for i := range f.maps {
+		m := inner.CloneTemplate().(*EbpfMap)
+		m.PersistentPath = ""
+		if err := m.Create(); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("Unable to create inner map of '%s': %v", outer.Name, err)
+		}
+		f.maps[i] = m
+	}
+	if err := outer.Upsert(slot, uint32(f.maps[0].GetFd())); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("Unable to insert inner map into '%s': %v", outer.Name, err)
+	}
+
+	return f, nil
+}
+
+// Active returns map holding active configuration, e.g. to read it.
+// Map must not be modified directly.
+func (f *ConfigFlipper) Active() Map {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.maps[f.active]
+}
+
+// Publish makes config new content of map: standby map is filled with it,
+// then swapped with active one. On error active configuration is not changed.
+func (f *ConfigFlipper) Publish(config []ConfigEntry) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	standby := f.maps[1-f.active]
+	if err := f.clear(standby); err != nil {
+		return err
+	}
+	for _, entry := range config {
+		if err := standby.Upsert(entry.Key, entry.Value); err != nil {
+			return fmt.Errorf("Unable to update config of '%s': %v", f.outer.Name, err)
+		}
+	}
+	if err := f.outer.Upsert(f.slot, uint32(standby.GetFd())); err != nil {
+		return fmt.Errorf("Unable to swap config of '%s': %v", f.outer.Name, err)
+	}
+	f.active = 1 - f.active
+
+	return nil
+}
+
+// Removes previous configuration, array elements are zeroed
+func (f *ConfigFlipper) clear(m *EbpfMap) error {
+	if m.Type == MapTypeArray {
+		zero := make([]byte, m.ValueSize)
+		for i := 0; i < m.MaxEntries; i++ {
+			if err := m.Upsert(uint32(i), zero); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var keys [][]byte
+	key, err := m.GetNextKey(nil)
+	for ; err == nil; key, err = m.GetNextKey(key) {
+		keys = append(keys, key)
+	}
+	if err != ErrNoMoreKeys {
+		return err
+	}
+	_, err = m.DeleteBatch(keys)
+
+	return err
+}
+
+// Close frees inner maps. Map in slot of outer map is kept by kernel as
+// long as outer map references it.
+func (f *ConfigFlipper) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for _, m := range f.maps {
+		if m != nil {
+			m.Close()
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,19 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewConfigFlipperNegative(t *testing.T) {
+	inner := &EbpfMap{Name: "inner", Type: MapTypeHash, KeySize: 4, ValueSize: 8, MaxEntries: 16}
+
+	_, err := NewConfigFlipper(&EbpfMap{Name: "outer", Type: MapTypeArray, KeySize: 4, ValueSize: 4, MaxEntries: 1}, inner, uint32(0))
+	assert.Error(t, err)
+	_, err = NewConfigFlipper(&EbpfMap{Name: "outer", Type: MapTypeArrayOfMaps, KeySize: 4, ValueSize: 4, MaxEntries: 1}, nil, uint32(0))
+	assert.Error(t, err)
+}
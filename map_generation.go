@@ -0,0 +1,199 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// GenerationConfig updates configuration spread over several maps in place,
+// stamping every update by generation counter kept in well-known array map
+// (single __u64 value). Like seqlock, generation is odd while update is in
+// progress and bumped to the next even number only after all writes are done,
+// so programs can detect torn reads of configuration and retry / fall back:
+//
+//	__u32 zero = 0;
+//	__u64 *gen = bpf_map_lookup_elem(&config_gen, &zero);
+//	if (!gen)
+//		return XDP_PASS;
+//	__u64 before = READ_ONCE(*gen);
+//	if (before & 1)
+//		return XDP_PASS; // being updated
+//	struct rule *rule = bpf_map_lookup_elem(&rules, &key);
+//	struct route *route = bpf_map_lookup_elem(&routes, &rule->route);
+//	...
+//	if (READ_ONCE(*gen) != before)
+//		return XDP_PASS; // torn read
+//
+// Go side:
+//
+//	g, err := goebpf.NewGenerationConfig(configGen, rules, routes)
+//	txn := g.Begin()
+//	txn.Upsert("rules", key, value)
+//	txn.Delete("routes", otherKey)
+//	err = txn.Publish()
+//
+// Unlike DoubleBuffer it needs no extra memory, but programs have to check
+// generation. For configurations never read torn see DoubleBuffer.
+type GenerationConfig struct {
+	mu         sync.Mutex
+	generation *EbpfMap
+	maps       map[string]*EbpfMap
+	current    uint64
+}
+
+type generationOp struct {
+	m      *EbpfMap
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// NewGenerationConfig creates publisher of updates of maps, identified by
+// name in transactions. Generation is resumed from generation map, e.g.
+// pinned one written by previous instance of application.
+func NewGenerationConfig(generation *EbpfMap, maps ...*EbpfMap) (*GenerationConfig, error) {
+	if generation.Type != MapTypeArray || generation.ValueSize != 8 {
+		return nil, fmt.Errorf("Generation map '%s' must be array of __u64", generation.Name)
+	}
+	if len(maps) == 0 {
+		return nil, errors.New("No config maps")
+	}
+	g := &GenerationConfig{
+		generation: generation,
+		maps:       make(map[string]*EbpfMap),
+	}
+	for _, m := range maps {
+		if m == nil {
+			return nil, errors.New("Config map must be set")
+		}
+		if m == generation {
+			return nil, fmt.Errorf("Map '%s' is generation map", m.Name)
+		}
+		if _, ok := g.maps[m.Name]; ok {
+			return nil, fmt.Errorf("Map '%s' is listed twice", m.Name)
+		}
+		g.maps[m.Name] = m
+	}
+	current, err := generation.LookupUint64(uint32(0))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read generation map '%s': %v", generation.Name, err)
+	}
+	g.current = current
+
+	return g, nil
+}
+
+// Generation returns the last generation written to generation map,
+// odd if the last Publish() failed
+func (g *GenerationConfig) Generation() uint64 {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	return g.current
+}
+
+// Begin starts transaction. Nothing is written to maps until Publish().
+func (g *GenerationConfig) Begin() *GenerationTxn {
+	return &GenerationTxn{g: g}
+}
+
+// Writes generation into generation map
+func (g *GenerationConfig) setGeneration(generation uint64) error {
+	if err := g.generation.Upsert(uint32(0), generation); err != nil {
+		return fmt.Errorf("Unable to update generation map '%s': %v", g.generation.Name, err)
+	}
+	g.current = generation
+
+	return nil
+}
+
+// GenerationTxn is set of updates of maps of GenerationConfig,
+// published at once by Publish()
+type GenerationTxn struct {
+	g   *GenerationConfig
+	ops []generationOp
+}
+
+func (t *GenerationTxn) configMap(name string) (*EbpfMap, error) {
+	m, ok := t.g.maps[name]
+	if !ok {
+		return nil, fmt.Errorf("Map '%s' is not config map", name)
+	}
+	return m, nil
+}
+
+// Upsert records update of config map.
+// Supported key / value types are the same as of EbpfMap.Upsert().
+func (t *GenerationTxn) Upsert(name string, ikey, ivalue interface{}) error {
+	m, err := t.configMap(name)
+	if err != nil {
+		return err
+	}
+	key, err := m.keyBytes(ikey)
+	if err != nil {
+		return err
+	}
+	value, err := m.valueBytes(ivalue)
+	if err != nil {
+		return err
+	}
+	t.ops = append(t.ops, generationOp{m: m, key: key, value: value})
+
+	return nil
+}
+
+// Delete records removal of key from config map.
+// Removal of missing key is not an error.
+func (t *GenerationTxn) Delete(name string, ikey interface{}) error {
+	m, err := t.configMap(name)
+	if err != nil {
+		return err
+	}
+	if m.Type == MapTypeArray {
+		return fmt.Errorf("Map '%s' elements can't be deleted", name)
+	}
+	key, err := m.keyBytes(ikey)
+	if err != nil {
+		return err
+	}
+	t.ops = append(t.ops, generationOp{m: m, key: key, delete: true})
+
+	return nil
+}
+
+// Publish makes generation odd, writes updates into config maps and bumps
+// generation to the next even number. On error generation is left odd:
+// configuration is partially updated, so programs keep treating it as torn
+// until the next successful Publish().
+func (t *GenerationTxn) Publish() error {
+	g := t.g
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Odd generation stays as is after failed / interrupted Publish()
+	writing := g.current | 1
+	if err := g.setGeneration(writing); err != nil {
+		return err
+	}
+	for _, op := range t.ops {
+		if op.delete {
+			if err := op.m.Delete(op.key); err != nil && !errors.Is(err, ErrKeyNotExist) {
+				return err
+			}
+			continue
+		}
+		if err := op.m.Upsert(op.key, op.value); err != nil {
+			return err
+		}
+	}
+	if err := g.setGeneration(writing + 1); err != nil {
+		return err
+	}
+	t.ops = nil
+
+	return nil
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewGenerationConfigNegative(t *testing.T) {
+	generation := &EbpfMap{Name: "gen", Type: MapTypeArray, KeySize: 4, ValueSize: 8, MaxEntries: 1}
+	hash := &EbpfMap{Name: "hash", Type: MapTypeHash, KeySize: 4, ValueSize: 8, MaxEntries: 16}
+
+	_, err := NewGenerationConfig(&EbpfMap{Name: "gen", Type: MapTypeArray, KeySize: 4, ValueSize: 4, MaxEntries: 1}, hash)
+	assert.Error(t, err)
+	_, err = NewGenerationConfig(&EbpfMap{Name: "gen", Type: MapTypeHash, KeySize: 4, ValueSize: 8, MaxEntries: 1}, hash)
+	assert.Error(t, err)
+	_, err = NewGenerationConfig(generation)
+	assert.Error(t, err)
+	_, err = NewGenerationConfig(generation, hash, hash)
+	assert.Error(t, err)
+	_, err = NewGenerationConfig(generation, generation)
+	assert.Error(t, err)
+	_, err = NewGenerationConfig(generation, nil)
+	assert.Error(t, err)
+}
+
+func TestGenerationTxnOps(t *testing.T) {
+	hash := &EbpfMap{Name: "hash", Type: MapTypeHash, KeySize: 4, ValueSize: 8}
+	array := &EbpfMap{Name: "array", Type: MapTypeArray, KeySize: 4, ValueSize: 2}
+	g := &GenerationConfig{maps: map[string]*EbpfMap{"hash": hash, "array": array}}
+
+	txn := g.Begin()
+	require.NoError(t, txn.Upsert("hash", uint32(1), uint64(2)))
+	require.NoError(t, txn.Delete("hash", uint32(3)))
+	require.NoError(t, txn.Upsert("array", uint32(0), uint16(5)))
+	require.Len(t, txn.ops, 3)
+	assert.Equal(t, hash, txn.ops[0].m)
+	assert.Equal(t, uint32(1), HostByteOrder().Uint32(txn.ops[0].key))
+	assert.Equal(t, uint64(2), HostByteOrder().Uint64(txn.ops[0].value))
+	assert.True(t, txn.ops[1].delete)
+	assert.Len(t, txn.ops[2].value, 2)
+
+	// Unknown map, key / value sizes, delete from array
+	assert.Error(t, txn.Upsert("other", uint32(1), uint64(2)))
+	assert.Error(t, txn.Upsert("hash", uint64(1), uint64(2)))
+	assert.Error(t, txn.Upsert("array", uint32(1), uint64(2)))
+	assert.Error(t, txn.Delete("array", uint32(1)))
+	assert.Error(t, txn.Delete("other", uint32(1)))
+	assert.Len(t, txn.ops, 3)
+}
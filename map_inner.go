@@ -0,0 +1,190 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// InnerTemplate returns definition of inner maps of array / hash of maps:
+// map referenced by inner_map_def of ELF map definition, or one set by
+// SetInnerTemplate(). Nil if there is none.
+func (m *EbpfMap) InnerTemplate() *EbpfMap {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.innerTemplate
+}
+
+// SetInnerTemplate registers definition of inner maps for array / hash of maps
+// created by hand (not loaded from ELF), see InnerMapSet.
+// Template is used as definition only, it doesn't have to be created.
+func (m *EbpfMap) SetInnerTemplate(template *EbpfMap) error {
+	if m.Type != MapTypeArrayOfMaps && m.Type != MapTypeHashOfMaps {
+		return fmt.Errorf("Map '%s' (%v) is not array / hash of maps", m.Name, m.Type)
+	}
+	if template == nil {
+		return errors.New("Inner map template must be set")
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.innerTemplate = template
+	return nil
+}
+
+// InnerMapSet manages inner maps of array / hash of maps created at runtime,
+// e.g. one map per tenant, all of them of outer map's inner map template:
+//
+//	struct bpf_map_def SEC("maps") tenant_template = { ... };
+//	struct bpf_map_def SEC("maps") tenants = {
+//		.type = BPF_MAP_TYPE_HASH_OF_MAPS,
+//		.key_size = sizeof(__u32),
+//		.max_entries = 1024,
+//		.inner_map_def = &tenant_template,
+//	};
+//
+// Go side:
+//
+//	set, err := goebpf.NewInnerMapSet(bpf.GetMapByName("tenants").(*goebpf.EbpfMap), "/sys/fs/bpf/tenants")
+//	m, err := set.CreateInner("tenant_42", uint32(42))
+//	err = m.Upsert(key, value)
+//	...
+//	err = set.DeleteInner("tenant_42")
+//
+// Pinned inner maps outlive process: CreateInner() of the same name re-uses
+// pinned map (according to template's PinPolicy), so state survives restarts.
+type InnerMapSet struct {
+	mu     sync.Mutex
+	outer  *EbpfMap
+	pinDir string
+	inner  map[string]*innerMapEntry
+}
+
+type innerMapEntry struct {
+	m       *EbpfMap
+	key     interface{}
+	pinPath string
+}
+
+// NewInnerMapSet creates manager of inner maps of outer map, which must have
+// inner map template (see InnerTemplate()). If pinDir is not empty, inner maps
+// are pinned there (bpffs) by their names.
+func NewInnerMapSet(outer *EbpfMap, pinDir string) (*InnerMapSet, error) {
+	if outer.Type != MapTypeArrayOfMaps && outer.Type != MapTypeHashOfMaps {
+		return nil, fmt.Errorf("Map '%s' (%v) is not array / hash of maps", outer.Name, outer.Type)
+	}
+	if outer.InnerTemplate() == nil {
+		return nil, fmt.Errorf("Map '%s' has no inner map template", outer.Name)
+	}
+
+	return &InnerMapSet{
+		outer:  outer,
+		pinDir: pinDir,
+		inner:  make(map[string]*innerMapEntry),
+	}, nil
+}
+
+// CreateInner creates inner map of given name from template (pinning it
+// if set has pin directory) and puts it into outer map at key.
+// Element of outer map at key is replaced, if any. Fails with ErrMapFull
+// if there is no room for new element in outer map.
+func (s *InnerMapSet) CreateInner(name string, key interface{}) (*EbpfMap, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.inner[name]; ok {
+		return nil, fmt.Errorf("Inner map '%s' of '%s' already exists", name, s.outer.Name)
+	}
+	m := s.outer.InnerTemplate().CloneTemplate().(*EbpfMap)
+	m.Name = name
+	m.PersistentPath = ""
+	if s.pinDir != "" {
+		if err := makePinDir(s.pinDir); err != nil {
+			return nil, err
+		}
+		m.PersistentPath = filepath.Join(s.pinDir, name)
+	}
+	if err := m.Create(); err != nil {
+		return nil, fmt.Errorf("Unable to create inner map '%s' of '%s': %v", name, s.outer.Name, err)
+	}
+	if err := s.outer.Upsert(key, uint32(m.GetFd())); err != nil {
+		m.Close()
+		// Returned as is, so ErrMapFull (no room in outer map) can be checked
+		return nil, err
+	}
+	s.inner[name] = &innerMapEntry{m: m, key: key, pinPath: m.PersistentPath}
+
+	return m, nil
+}
+
+// Get returns inner map created by CreateInner(), nil if there is no such map
+func (s *InnerMapSet) Get(name string) *EbpfMap {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if entry, ok := s.inner[name]; ok {
+		return entry.m
+	}
+	return nil
+}
+
+// Names returns sorted names of inner maps created by CreateInner()
+func (s *InnerMapSet) Names() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res []string
+	for name := range s.inner {
+		res = append(res, name)
+	}
+	sort.Strings(res)
+	return res
+}
+
+// DeleteInner removes inner map from outer one, unpins and closes it.
+// Programs in the middle of using map keep working with it till they finish.
+func (s *InnerMapSet) DeleteInner(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry, ok := s.inner[name]
+	if !ok {
+		return fmt.Errorf("Inner map '%s' of '%s' does not exist", name, s.outer.Name)
+	}
+	err := s.outer.Delete(entry.key)
+	if err != nil && !errors.Is(err, ErrKeyNotExist) {
+		return fmt.Errorf("Unable to remove inner map '%s' from '%s': %v", name, s.outer.Name, err)
+	}
+	if entry.pinPath != "" {
+		if err := unpinObject(entry.pinPath); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	delete(s.inner, name)
+
+	return entry.m.Close()
+}
+
+// Close closes all inner maps created by set. Maps stay in outer map
+// (and pinned), so programs keep using them.
+func (s *InnerMapSet) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var res error
+	for name, entry := range s.inner {
+		if err := entry.m.Close(); err != nil && res == nil {
+			res = err
+		}
+		delete(s.inner, name)
+	}
+	return res
+}
@@ -0,0 +1,38 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInnerMapSetNegative(t *testing.T) {
+	template := &EbpfMap{Name: "template", Type: MapTypeHash, KeySize: 4, ValueSize: 8, MaxEntries: 16}
+
+	// Not a map of maps
+	_, err := NewInnerMapSet(template, "")
+	assert.EqualError(t, err, "Map 'template' (Hash) is not array / hash of maps")
+	assert.Error(t, template.SetInnerTemplate(template))
+
+	// No template
+	outer := &EbpfMap{Name: "outer", Type: MapTypeHashOfMaps, KeySize: 4, MaxEntries: 16}
+	assert.Nil(t, outer.InnerTemplate())
+	_, err = NewInnerMapSet(outer, "")
+	assert.EqualError(t, err, "Map 'outer' has no inner map template")
+	assert.Error(t, outer.SetInnerTemplate(nil))
+
+	// Template is kept by clones
+	require.NoError(t, outer.SetInnerTemplate(template))
+	assert.Equal(t, template, outer.InnerTemplate())
+	assert.Equal(t, template, outer.CloneTemplate().(*EbpfMap).InnerTemplate())
+	set, err := NewInnerMapSet(outer, "")
+	require.NoError(t, err)
+	assert.Nil(t, set.Get("tenant"))
+	assert.Empty(t, set.Names())
+	assert.EqualError(t, set.DeleteInner("tenant"), "Inner map 'tenant' of 'outer' does not exist")
+	assert.NoError(t, set.Close())
+}
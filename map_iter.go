@@ -0,0 +1,120 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"context"
+	"syscall"
+	"unsafe"
+)
+
+// Max number of elements processed by single batch syscall
+const mapBatchSize = 1024
+
+// ForEachMapEntry calls fn for every entry of map m, key / value are valid
+// during call only. Hash / array maps are read by BPF_MAP_LOOKUP_BATCH (linux 5.6+),
+// others element by element. Iteration is stopped on first error returned by fn.
+//
+// Context is checked between syscalls: once it is cancelled / its deadline
+// passed, iteration stops and ctx.Err() is returned, so walking huge map
+// under contention never stalls caller beyond deadline (plus one syscall).
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+//	defer cancel()
+//	err := goebpf.ForEachMapEntry(ctx, m, func(key, value []byte) error {
+//		// do something with copy of key / value
+//		return nil
+//	})
+func ForEachMapEntry(ctx context.Context, m Map, fn func(key, value []byte) error) error {
+	return forEachMapEntry(ctx, m, fn)
+}
+
+// Calls fn for every map entry, key / value are valid during call only
+func forEachMapEntry(ctx context.Context, m Map, fn func(key, value []byte) error) error {
+	if em, ok := m.(*EbpfMap); ok {
+		err := em.forEachBatch(ctx, fn)
+		if err != errBatchNotSupported {
+			return err
+		}
+	}
+
+	key, err := m.GetNextKey(nil)
+	for ; err == nil; key, err = m.GetNextKey(key) {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		value, err := m.Lookup(key)
+		if err != nil {
+			// Element may be deleted in between
+			continue
+		}
+		if err = fn(key, value); err != nil {
+			return err
+		}
+	}
+	if err != ErrNoMoreKeys {
+		return err
+	}
+
+	return nil
+}
+
+// Reads map by BPF_MAP_LOOKUP_BATCH (kernel 5.6+), errBatchNotSupported
+// is returned before any call of fn
+func (m *EbpfMap) forEachBatch(ctx context.Context, fn func(key, value []byte) error) error {
+	if m.isPerCpu() {
+		// Values of all CPUs are returned, see Lookup()
+		return errBatchNotSupported
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	batchSize := m.MaxEntries
+	if batchSize > mapBatchSize || batchSize < 1 {
+		batchSize = mapBatchSize
+	}
+	// Batch token is bucket (u32) of hash maps
+	tokenSize := m.KeySize
+	if tokenSize < 4 {
+		tokenSize = 4
+	}
+	keys := make([]byte, batchSize*m.KeySize)
+	values := make([]byte, batchSize*m.ValueSize)
+	batchIn := make([]byte, tokenSize)
+	batchOut := make([]byte, tokenSize)
+	inBatch := unsafe.Pointer(nil)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		attr := bpfMapBatchAttr{
+			inBatch:  newBpfPointer(inBatch),
+			outBatch: newBpfPointer(unsafe.Pointer(&batchOut[0])),
+			keys:     newBpfPointer(unsafe.Pointer(&keys[0])),
+			values:   newBpfPointer(unsafe.Pointer(&values[0])),
+			count:    uint32(batchSize),
+			mapFd:    uint32(m.fd),
+		}
+		_, err := bpfSyscall(bpfCmdMapLookupBatch, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		// ENOENT means that end of map reached, count is still valid
+		if err != nil && err != syscall.ENOENT {
+			if inBatch == nil && (err == syscall.EINVAL || err == syscall.ENOSPC || err == errnoENOTSUPP) {
+				// Old kernel / map type without batch support, or bucket does not fit into batch
+				return errBatchNotSupported
+			}
+			return newSyscallError("ebpf_map_lookup_batch()", err, nil)
+		}
+		for i := 0; i < int(attr.count); i++ {
+			if err := fn(keys[i*m.KeySize:(i+1)*m.KeySize], values[i*m.ValueSize:(i+1)*m.ValueSize]); err != nil {
+				return err
+			}
+		}
+		if err == syscall.ENOENT {
+			return nil
+		}
+		copy(batchIn, batchOut)
+		inBatch = unsafe.Pointer(&batchIn[0])
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForEachMapEntry(t *testing.T) {
+	m := newExpireTestMap()
+
+	var keys []byte
+	err := ForEachMapEntry(context.Background(), m, func(key, value []byte) error {
+		keys = append(keys, key...)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, keys)
+
+	// Error of callback stops iteration
+	errStop := errors.New("stop")
+	calls := 0
+	err = ForEachMapEntry(context.Background(), m, func(key, value []byte) error {
+		calls++
+		return errStop
+	})
+	assert.Equal(t, errStop, err)
+	assert.Equal(t, 1, calls)
+}
+
+func TestForEachMapEntryDeadline(t *testing.T) {
+	m := newExpireTestMap()
+
+	// Cancelled in the middle of walk
+	ctx, cancel := context.WithCancel(context.Background())
+	calls := 0
+	err := ForEachMapEntry(ctx, m, func(key, value []byte) error {
+		calls++
+		if calls == 3 {
+			cancel()
+		}
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+	assert.Equal(t, 3, calls)
+
+	// Deadline passed already: nothing is visited / removed
+	ctx, cancel = context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	err = ForEachMapEntry(ctx, m, func(key, value []byte) error {
+		t.Fatal("Unexpected call")
+		return nil
+	})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+
+	e := MapExpiry{TimestampOffset: 4, TTL: 5 * time.Second}
+	removed, err := sweepExpired(ctx, m, e, uint64(10*time.Second))
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, 0, removed)
+	assert.Len(t, m.items, 10)
+}
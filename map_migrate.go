@@ -0,0 +1,180 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+
+	"github.com/dropbox/goebpf/goebpf_btf"
+)
+
+// Persistent maps outlive application, so new version of it may find map
+// pinned by previous one with other value layout, e.g. field added:
+//
+//	struct stats {			struct stats {
+//		__u64 packets;			__u64 packets;
+//		__u64 bytes;			__u64 bytes;
+//	};					__u64 drops;
+//					};
+//
+// With MapPinMigrate policy (see WithMapMigration()) such map is not re-used:
+// new one is created, entries of pinned map are copied into it (converted by
+// EbpfMap.Migrate) and it replaces pinned one. Layout changes keeping value
+// size (e.g. fields reordered) are detected by BTF: maps described by
+// BPF_ANNOTATE_KV_PAIR() are created with BTF when migration is enabled,
+// so layout of pinned map is known to next versions.
+
+// Suffix of temporary pin of migrated map, renamed over pinned one when filled
+// (bpffs does not allow dots in names)
+const migratePinSuffix = "_migrate"
+
+// MapMigration describes map pinned by previous version of application
+type MapMigration struct {
+	// Definition of pinned map
+	Old *EbpfMap
+	// Key / value types of pinned map, nil if it has been created without BTF
+	OldKeyType   *goebpf_btf.Type
+	OldValueType *goebpf_btf.Type
+}
+
+// MapMigrateFunc converts entry of pinned map into entry of new map.
+// Values of per-CPU maps contain values of all possible CPUs,
+// each aligned to 8 bytes (see Lookup()).
+// Returning nil key drops entry.
+type MapMigrateFunc func(from *MapMigration, key, value []byte) ([]byte, []byte, error)
+
+// Decides whether pinned map can be re-used by MapPinMigrate policy,
+// sets m.migrateFrom if it needs migration
+func (m *EbpfMap) checkMigration(pinned *EbpfMap) error {
+	from := &MapMigration{Old: pinned}
+	if info, err := ebpfMapGetInfo(pinned.fd); err == nil && info.BtfId != 0 {
+		from.OldKeyType, from.OldValueType = mapBtfTypes(int(info.BtfId),
+			int(info.BtfKeyTypeId), int(info.BtfValueTypeId))
+	}
+
+	err := m.checkCompatible(pinned)
+	// Layout is compared when both versions have it
+	if err == nil && from.OldValueType != nil && m.btfValueType != nil &&
+		(!goebpf_btf.SameLayout(from.OldKeyType, m.btfKeyType) ||
+			!goebpf_btf.SameLayout(from.OldValueType, m.btfValueType)) {
+		err = errors.New("key / value layout changed")
+	}
+	if err == nil {
+		m.fd = pinned.fd
+		m.spinLock = pinned.spinLock
+		m.spinLockOffset = pinned.spinLockOffset
+		return nil
+	}
+	if m.Type != pinned.Type {
+		return fmt.Errorf("Map '%s' pinned at '%s' can't be migrated: %v", m.Name, m.PersistentPath, err)
+	}
+	if m.Migrate == nil && (m.KeySize != pinned.KeySize || m.ValueSize != pinned.ValueSize) {
+		return fmt.Errorf("Map '%s' pinned at '%s' has %v, no migration function to convert entries",
+			m.Name, m.PersistentPath, err)
+	}
+	m.migrateFrom = from
+
+	return nil
+}
+
+// Reads key / value types of map BTF, best effort like findSpinLock()
+func mapBtfTypes(btfId, keyTypeId, valueTypeId int) (*goebpf_btf.Type, *goebpf_btf.Type) {
+	data, err := ebpfBtfGetData(btfId)
+	if err != nil {
+		return nil, nil
+	}
+	spec, err := goebpf_btf.ParseSpec(data, hostByteOrder)
+	if err != nil {
+		return nil, nil
+	}
+	key, _ := spec.TypeByID(keyTypeId)
+	value, err := spec.TypeByID(valueTypeId)
+	if err != nil {
+		return nil, nil
+	}
+	return key, value
+}
+
+// Copies entries of m.migrateFrom into just created map and replaces pinned
+// map by it. Caller must hold write lock. Pinned map is left intact on error.
+func (m *EbpfMap) migrateLocked() error {
+	from := m.migrateFrom.Old
+	oldValueSize := from.ValueSize
+	if m.isPerCpu() {
+		numCpus, err := GetNumOfPossibleCpus()
+		if err != nil {
+			return err
+		}
+		oldValueSize = perCpuValueSize(oldValueSize) * numCpus
+	}
+
+	var key []byte
+	value := make([]byte, oldValueSize)
+	var keyPtr unsafe.Pointer
+	for {
+		next := make([]byte, from.KeySize)
+		err := ebpfMapElemOp(bpfCmdMapGetNextKey, from.fd, keyPtr, unsafe.Pointer(&next[0]), 0)
+		if err == syscall.ENOENT {
+			break
+		}
+		if err != nil {
+			return newSyscallError("ebpf_map_get_next_key()", err, nil)
+		}
+		key = next
+		keyPtr = unsafe.Pointer(&key[0])
+
+		err = ebpfMapElemOp(bpfCmdMapLookupElem, from.fd,
+			unsafe.Pointer(&key[0]), unsafe.Pointer(&value[0]), from.elemFlags(0))
+		if err == syscall.ENOENT {
+			// Removed meanwhile
+			continue
+		}
+		if err != nil {
+			return newSyscallError("ebpf_map_lookup_elem()", err, nil)
+		}
+		from.clearSpinLock(value)
+		newKey, newValue := key, value
+		if m.Migrate != nil {
+			if newKey, newValue, err = m.Migrate(m.migrateFrom, key, value); err != nil {
+				return fmt.Errorf("Map '%s': migration failed: %v", m.Name, err)
+			}
+			if newKey == nil {
+				continue
+			}
+		}
+		if len(newKey) != m.KeySize || len(newValue) != m.valueRealSize {
+			return fmt.Errorf("Map '%s': migrated key / value sizes %d / %d, expected %d / %d",
+				m.Name, len(newKey), len(newValue), m.KeySize, m.valueRealSize)
+		}
+		err = ebpfMapElemOp(bpfCmdMapUpdateElem, m.fd,
+			unsafe.Pointer(&newKey[0]), unsafe.Pointer(&newValue[0]), m.elemFlags(bpfAny))
+		if err != nil {
+			return newSyscallError("ebpf_map_update_elem()", err, nil)
+		}
+	}
+
+	// Programs of previous version keep using old map, new ones see all entries at once
+	tmpPath := m.PersistentPath + migratePinSuffix
+	unpinObject(tmpPath)
+	if err := ebpfObjPin(m.fd, tmpPath); err != nil {
+		return err
+	}
+	if err := renamePinned(tmpPath, m.PersistentPath); err != nil {
+		unpinObject(tmpPath)
+		return fmt.Errorf("Unable to replace pinned map '%s': %v", m.Name, err)
+	}
+
+	return nil
+}
+
+// Releases pinned map migration has been done from (or failed)
+func (m *EbpfMap) closeMigrateFrom() {
+	if m.migrateFrom != nil {
+		closeFd(m.migrateFrom.Old.fd)
+		m.migrateFrom = nil
+	}
+}
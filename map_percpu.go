@@ -0,0 +1,213 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// Max number of elements read by single BPF_MAP_LOOKUP_BATCH call
+const perCPUBatchSize = 1024
+
+// PerCPUCounter is key of Per-CPU map along with sum of its values from all CPUs
+type PerCPUCounter struct {
+	Key   []byte
+	Value uint64
+}
+
+// PerCPUCounterReader reads all counters of Per-CPU map (hash / array) and sums
+// per-CPU values in one pass. Buffers are re-used between Read() calls, so
+// keeping reader around makes periodic scraping of large maps allocation free.
+// Not safe for concurrent use.
+type PerCPUCounterReader struct {
+	m       *EbpfMap
+	numCpus int
+	// Kernel aligns value of every CPU to 8 bytes
+	stride int
+	// Batch lookups are not supported by kernel / map type, iterate over keys instead
+	noBatch bool
+
+	keys     []byte
+	values   []byte
+	batchIn  []byte
+	batchOut []byte
+	allKeys  []byte
+	counters []PerCPUCounter
+}
+
+// NewPerCPUCounterReader creates reader of counters of Per-CPU map m.
+// Map values must be integers (up to 8 bytes).
+func NewPerCPUCounterReader(m *EbpfMap) (*PerCPUCounterReader, error) {
+	if !m.isPerCpu() {
+		return nil, fmt.Errorf("Map '%s' (%v) is not Per-CPU map", m.Name, m.Type)
+	}
+	if m.ValueSize < 1 || m.ValueSize > 8 {
+		return nil, fmt.Errorf("Map '%s' value size %d is not integer", m.Name, m.ValueSize)
+	}
+	numCpus, err := GetNumOfPossibleCpus()
+	if err != nil {
+		return nil, err
+	}
+	batchSize := m.MaxEntries
+	if batchSize > perCPUBatchSize || batchSize < 1 {
+		batchSize = perCPUBatchSize
+	}
+	stride := perCpuValueSize(m.ValueSize)
+	// Batch token is bucket / index (u32) for all map types supporting batches
+	tokenSize := m.KeySize
+	if tokenSize < 4 {
+		tokenSize = 4
+	}
+
+	return &PerCPUCounterReader{
+		m:        m,
+		numCpus:  numCpus,
+		stride:   stride,
+		keys:     make([]byte, batchSize*m.KeySize),
+		values:   make([]byte, batchSize*stride*numCpus),
+		batchIn:  make([]byte, tokenSize),
+		batchOut: make([]byte, tokenSize),
+	}, nil
+}
+
+// ReadPerCPUCounters reads all counters of Per-CPU map m, summing values from all CPUs.
+// For periodic scraping use NewPerCPUCounterReader() to re-use buffers.
+func ReadPerCPUCounters(m *EbpfMap) ([]PerCPUCounter, error) {
+	r, err := NewPerCPUCounterReader(m)
+	if err != nil {
+		return nil, err
+	}
+	return r.Read()
+}
+
+// Read returns all counters of map. Returned slice (and keys) are valid till next Read().
+// Like GetNextKey() enumeration, read is not atomic for maps being modified concurrently.
+func (r *PerCPUCounterReader) Read() ([]PerCPUCounter, error) {
+	return r.ReadContext(context.Background())
+}
+
+// ReadContext is Read() which stops once ctx is done (checked between syscalls),
+// returning ctx.Err(): scraping huge map never takes longer than caller's deadline.
+func (r *PerCPUCounterReader) ReadContext(ctx context.Context) ([]PerCPUCounter, error) {
+	r.m.mu.RLock()
+	defer r.m.mu.RUnlock()
+
+	r.counters = r.counters[:0]
+	r.allKeys = r.allKeys[:0]
+
+	var err error
+	if !r.noBatch {
+		err = r.readBatches(ctx)
+		if err == errBatchNotSupported {
+			r.noBatch = true
+			r.counters = r.counters[:0]
+			r.allKeys = r.allKeys[:0]
+		}
+	}
+	if r.noBatch {
+		err = r.readByKeys(ctx)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// allKeys might be re-allocated while growing, so set keys at the end
+	keySize := r.m.KeySize
+	for i := range r.counters {
+		r.counters[i].Key = r.allKeys[i*keySize : (i+1)*keySize]
+	}
+
+	return r.counters, nil
+}
+
+var errBatchNotSupported = errors.New("batch lookup not supported")
+
+// Reads map by BPF_MAP_LOOKUP_BATCH (kernel 5.6+)
+func (r *PerCPUCounterReader) readBatches(ctx context.Context) error {
+	batchSize := len(r.keys) / r.m.KeySize
+	inBatch := unsafe.Pointer(nil)
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		attr := bpfMapBatchAttr{
+			inBatch:  newBpfPointer(inBatch),
+			outBatch: newBpfPointer(unsafe.Pointer(&r.batchOut[0])),
+			keys:     newBpfPointer(unsafe.Pointer(&r.keys[0])),
+			values:   newBpfPointer(unsafe.Pointer(&r.values[0])),
+			count:    uint32(batchSize),
+			mapFd:    uint32(r.m.fd),
+		}
+		_, err := bpfSyscall(bpfCmdMapLookupBatch, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		// ENOENT means that end of map reached, count is still valid
+		if err != nil && err != syscall.ENOENT {
+			switch err {
+			case syscall.EINVAL, syscall.ENOSPC, errnoENOTSUPP:
+				// Old kernel / map type without batch support, or bucket does not fit into batch
+				return errBatchNotSupported
+			}
+			return newSyscallError("ebpf_map_lookup_batch()", err, nil)
+		}
+		for i := 0; i < int(attr.count); i++ {
+			r.add(r.keys[i*r.m.KeySize:(i+1)*r.m.KeySize], r.values[i*r.stride*r.numCpus:])
+		}
+		if err == syscall.ENOENT {
+			return nil
+		}
+		copy(r.batchIn, r.batchOut)
+		inBatch = unsafe.Pointer(&r.batchIn[0])
+	}
+}
+
+// Reads map by enumerating keys, element by element
+func (r *PerCPUCounterReader) readByKeys(ctx context.Context) error {
+	key := r.keys[:r.m.KeySize]
+	var keyPtr unsafe.Pointer
+	for i := 0; ; i++ {
+		if i%perCPUBatchSize == 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+		}
+		err := ebpfMapElemOp(bpfCmdMapGetNextKey, r.m.fd, keyPtr, unsafe.Pointer(&key[0]), 0)
+		if err == syscall.ENOENT {
+			return nil
+		}
+		if err != nil {
+			return newSyscallError("ebpf_map_get_next_key()", err, nil)
+		}
+		keyPtr = unsafe.Pointer(&key[0])
+		err = ebpfMapElemOp(bpfCmdMapLookupElem, r.m.fd, keyPtr, unsafe.Pointer(&r.values[0]), 0)
+		if err == syscall.ENOENT {
+			// Element deleted in between
+			continue
+		}
+		if err != nil {
+			return newSyscallError("ebpf_map_lookup_elem()", err, nil)
+		}
+		r.add(key, r.values)
+	}
+}
+
+// Adds counter with values of all CPUs
+func (r *PerCPUCounterReader) add(key []byte, values []byte) {
+	r.allKeys = append(r.allKeys, key...)
+	r.counters = append(r.counters, PerCPUCounter{
+		Value: sumPerCPUValues(values, r.m.ValueSize, r.stride, r.numCpus),
+	})
+}
+
+// Sums integer values of all CPUs, value of every CPU takes stride bytes
+func sumPerCPUValues(values []byte, valueSize, stride, numCpus int) uint64 {
+	var sum uint64
+	for cpu := 0; cpu < numCpus; cpu++ {
+		offset := cpu * stride
+		sum += ParseFlexibleInteger(values[offset : offset+valueSize])
+	}
+	return sum
+}
@@ -0,0 +1,34 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSumPerCPUValues(t *testing.T) {
+	// 3 CPUs, 4 byte values aligned to 8 bytes
+	values := make([]byte, 3*8)
+	hostByteOrder.PutUint32(values[0:], 1)
+	hostByteOrder.PutUint32(values[8:], 20)
+	hostByteOrder.PutUint32(values[16:], 300)
+	// Padding must be ignored
+	values[4] = 0xff
+	assert.Equal(t, uint64(321), sumPerCPUValues(values, 4, 8, 3))
+
+	// 8 byte values
+	values = make([]byte, 2*8)
+	hostByteOrder.PutUint64(values[0:], 0x100000000)
+	hostByteOrder.PutUint64(values[8:], 1)
+	assert.Equal(t, uint64(0x100000001), sumPerCPUValues(values, 8, 8, 2))
+}
+
+func TestNewPerCPUCounterReaderInvalid(t *testing.T) {
+	_, err := NewPerCPUCounterReader(&EbpfMap{Type: MapTypeHash, KeySize: 4, ValueSize: 8})
+	assert.Error(t, err)
+	_, err = NewPerCPUCounterReader(&EbpfMap{Type: MapTypePerCPUHash, KeySize: 4, ValueSize: 16})
+	assert.Error(t, err)
+}
@@ -0,0 +1,84 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"unsafe"
+
+	"github.com/dropbox/goebpf/goebpf_btf"
+)
+
+// Size of struct bpf_spin_lock
+const bpfSpinLockSize = 4
+
+// Values of maps with struct bpf_spin_lock must be accessed with BPF_F_LOCK,
+// so userspace sees / writes consistent values while programs hold the lock.
+// Kernel allows spin locks only in maps with BTF, therefore lock is detected
+// from BTF reported by kernel for existing (pinned / opened by ID) maps.
+
+// Returns flags for lookup / update of element
+func (m *EbpfMap) elemFlags(op int) uint64 {
+	if m.spinLock {
+		op |= bpfFLock
+	}
+	return uint64(op)
+}
+
+// Zeroes lock field of value returned by kernel, its content is meaningless for userspace
+func (m *EbpfMap) clearSpinLock(value []byte) {
+	if !m.spinLock || len(value) < m.spinLockOffset+bpfSpinLockSize {
+		return
+	}
+	for i := m.spinLockOffset; i < m.spinLockOffset+bpfSpinLockSize; i++ {
+		value[i] = 0
+	}
+}
+
+// Finds offset of struct bpf_spin_lock in map value by kernel BTF object btfId.
+// Best effort: if BTF can't be read map is used without locking, as before.
+func findSpinLock(btfId int, valueTypeId int) (int, bool) {
+	data, err := ebpfBtfGetData(btfId)
+	if err != nil {
+		return 0, false
+	}
+	spec, err := goebpf_btf.ParseSpec(data, hostByteOrder)
+	if err != nil {
+		return 0, false
+	}
+	valueType, err := spec.TypeByID(valueTypeId)
+	if err != nil {
+		return 0, false
+	}
+	return goebpf_btf.SpinLockOffset(valueType)
+}
+
+// Reads raw BTF data of kernel BTF object by its ID
+func ebpfBtfGetData(id int) ([]byte, error) {
+	fd, err := ebpfGetFdById(bpfCmdBtfGetFdById, "ebpf_btf_get_fd_by_id()", id)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFd(fd)
+
+	// Beginning of struct bpf_btf_info: first call returns size of data only
+	var info struct {
+		btf     bpfPointer
+		btfSize uint32
+		id      uint32
+	}
+	infoBuf := (*[unsafe.Sizeof(info)]byte)(unsafe.Pointer(&info))
+	if err := ebpfObjGetInfoByFd(fd, infoBuf[:]); err != nil {
+		return nil, err
+	}
+	if info.btfSize == 0 {
+		return nil, nil
+	}
+	data := make([]byte, info.btfSize)
+	info.btf = newBpfPointer(unsafe.Pointer(&data[0]))
+	if err := ebpfObjGetInfoByFd(fd, infoBuf[:]); err != nil {
+		return nil, err
+	}
+
+	return data, nil
+}
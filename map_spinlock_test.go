@@ -0,0 +1,31 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSpinLockAccessors(t *testing.T) {
+	// Regular map: flags / values are left as is
+	m := &EbpfMap{Type: MapTypeHash, KeySize: 4, ValueSize: 8}
+	assert.Equal(t, uint64(bpfAny), m.elemFlags(bpfAny))
+	assert.Equal(t, uint64(bpfNoexist), m.elemFlags(bpfNoexist))
+	value := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	m.clearSpinLock(value)
+	assert.Equal(t, []byte{1, 2, 3, 4, 5, 6, 7, 8}, value)
+
+	// Value with lock at offset 4
+	m.spinLock = true
+	m.spinLockOffset = 4
+	assert.Equal(t, uint64(bpfFLock), m.elemFlags(bpfAny))
+	assert.Equal(t, uint64(bpfExist|bpfFLock), m.elemFlags(bpfExist))
+	m.clearSpinLock(value)
+	assert.Equal(t, []byte{1, 2, 3, 4, 0, 0, 0, 0}, value)
+
+	// Too short buffer must not panic
+	m.clearSpinLock(value[:6])
+}
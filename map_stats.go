@@ -0,0 +1,232 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"context"
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// MapStats is occupancy and churn of map, see EbpfMap.Stats()
+type MapStats struct {
+	Entries    int
+	MaxEntries int
+	// Elements updated (Insert / Update / Upsert) and deleted through this
+	// EbpfMap since it was created. Changes made by eBPF programs or other
+	// processes are not counted.
+	Updates uint64
+	Deletes uint64
+}
+
+// Fill returns fraction (0..1) of MaxEntries in use
+func (s *MapStats) Fill() float64 {
+	if s.MaxEntries == 0 {
+		return 0
+	}
+	return float64(s.Entries) / float64(s.MaxEntries)
+}
+
+// Stats counts entries of map and returns them along with churn counters.
+// Entries of hash maps are counted by batch lookups (linux 5.6+), element by
+// element otherwise, so counting huge maps takes time: use ctx to limit it.
+// All elements of arrays always exist, so Entries is MaxEntries for them.
+func (m *EbpfMap) Stats(ctx context.Context) (MapStats, error) {
+	stats := MapStats{
+		MaxEntries: m.MaxEntries,
+		Updates:    atomic.LoadUint64(&m.updates),
+		Deletes:    atomic.LoadUint64(&m.deletes),
+	}
+	var err error
+	stats.Entries, err = m.countEntries(ctx)
+
+	return stats, err
+}
+
+// Counts map elements, only keys are enumerated for maps without batch lookups
+func (m *EbpfMap) countEntries(ctx context.Context) (int, error) {
+	count := 0
+	switch m.Type {
+	case MapTypeArray, MapTypePerCPUArray:
+		return m.MaxEntries, nil
+	case MapTypeHash, MapTypeLRUHash:
+		err := forEachMapEntry(ctx, m, func(key, value []byte) error {
+			count++
+			return nil
+		})
+		return count, err
+	}
+
+	key, err := m.GetNextKey(nil)
+	for ; err == nil; key, err = m.GetNextKey(key) {
+		if err = ctx.Err(); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err != ErrNoMoreKeys {
+		return count, err
+	}
+
+	return count, nil
+}
+
+// MapSamplerParams configures MapSampler, zero value is valid
+type MapSamplerParams struct {
+	// How often maps are sampled, 10 seconds if zero
+	Interval time.Duration
+	// Time limit of counting entries of single map, Interval if zero
+	Timeout time.Duration
+	// Fill level (0..1) OnHighFill is called above, 0.9 if zero
+	HighFill float64
+	// Called from sampler goroutine on every sample of map filled above HighFill,
+	// i.e. before inserts start failing with ErrMapFull. Optional.
+	OnHighFill func(m *EbpfMap, stats MapStats)
+}
+
+// Default sampling interval / fill level of MapSamplerParams
+const (
+	defaultMapSampleInterval = 10 * time.Second
+	defaultMapHighFill       = 0.9
+)
+
+// MapSampler periodically samples stats of maps, see SampleMaps()
+type MapSampler struct {
+	maps     []*EbpfMap
+	params   MapSamplerParams
+	stop     chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+
+	mu    sync.Mutex
+	stats map[*EbpfMap]MapStats
+}
+
+// SampleMaps starts goroutine which samples stats of maps (see EbpfMap.Stats())
+// right away and then every params.Interval. Samples are published as library
+// metrics under MetricMaps: expvar.Map of map name to expvar.Map with
+// "entries", "max_entries", "fill", "updates" and "deletes".
+// Maps failed to be sampled (e.g. closed) are counted by MetricMapSampleErrors.
+func SampleMaps(params MapSamplerParams, maps ...*EbpfMap) *MapSampler {
+	if params.Interval <= 0 {
+		params.Interval = defaultMapSampleInterval
+	}
+	if params.Timeout <= 0 {
+		params.Timeout = params.Interval
+	}
+	if params.HighFill <= 0 {
+		params.HighFill = defaultMapHighFill
+	}
+	s := &MapSampler{
+		maps:   maps,
+		params: params,
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+		stats:  make(map[*EbpfMap]MapStats),
+	}
+	go s.run()
+
+	return s
+}
+
+// Stats returns last sample of map, false if it has not been sampled yet
+func (s *MapSampler) Stats(m *EbpfMap) (MapStats, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stats, ok := s.stats[m]
+	return stats, ok
+}
+
+// Done returns channel closed when sampler stopped
+func (s *MapSampler) Done() <-chan struct{} {
+	return s.done
+}
+
+// Stop stops sampling, sample in progress is aborted. Safe to call multiple times.
+func (s *MapSampler) Stop() {
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+}
+
+func (s *MapSampler) run() {
+	defer close(s.done)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ticker := time.NewTicker(s.params.Interval)
+	defer ticker.Stop()
+
+	for {
+		for _, m := range s.maps {
+			if ctx.Err() != nil {
+				return
+			}
+			s.sample(ctx, m)
+		}
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Samples single map, publishes result
+func (s *MapSampler) sample(ctx context.Context, m *EbpfMap) {
+	ctx, cancel := context.WithTimeout(ctx, s.params.Timeout)
+	defer cancel()
+
+	stats, err := m.Stats(ctx)
+	if err != nil {
+		metrics.Add(MetricMapSampleErrors, 1)
+		return
+	}
+	s.mu.Lock()
+	s.stats[m] = stats
+	s.mu.Unlock()
+	publishMapStats(m.Name, stats)
+
+	if stats.Fill() > s.params.HighFill && s.params.OnHighFill != nil {
+		s.params.OnHighFill(m, stats)
+	}
+}
+
+// Per map samples, published under MetricMaps on first use
+var (
+	mapMetrics     = new(expvar.Map).Init()
+	mapMetricsOnce sync.Once
+)
+
+func publishMapStats(name string, stats MapStats) {
+	mapMetricsOnce.Do(func() {
+		metrics.Set(MetricMaps, mapMetrics)
+	})
+
+	v := new(expvar.Map).Init()
+	setInt := func(key string, value int64) {
+		i := new(expvar.Int)
+		i.Set(value)
+		v.Set(key, i)
+	}
+	setInt("entries", int64(stats.Entries))
+	setInt("max_entries", int64(stats.MaxEntries))
+	setInt("updates", int64(stats.Updates))
+	setInt("deletes", int64(stats.Deletes))
+	fill := new(expvar.Float)
+	fill.Set(stats.Fill())
+	v.Set("fill", fill)
+	mapMetrics.Set(name, v)
+}
@@ -0,0 +1,64 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"context"
+	"expvar"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMapStatsFill(t *testing.T) {
+	stats := MapStats{Entries: 90, MaxEntries: 100}
+	assert.Equal(t, 0.9, stats.Fill())
+	stats.MaxEntries = 0
+	assert.Equal(t, 0.0, stats.Fill())
+}
+
+func TestMapStatsArray(t *testing.T) {
+	// All array elements exist, nothing is counted
+	m := &EbpfMap{Name: "array", Type: MapTypeArray, KeySize: 4, ValueSize: 4, MaxEntries: 16}
+	m.updates = 3
+	stats, err := m.Stats(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, MapStats{Entries: 16, MaxEntries: 16, Updates: 3}, stats)
+}
+
+func TestMapSampler(t *testing.T) {
+	m := &EbpfMap{Name: "sampled", Type: MapTypePerCPUArray, KeySize: 4, ValueSize: 8, MaxEntries: 4}
+	highFill := make(chan MapStats, 1)
+	s := SampleMaps(MapSamplerParams{
+		Interval: time.Hour,
+		OnHighFill: func(hm *EbpfMap, stats MapStats) {
+			assert.Equal(t, m, hm)
+			highFill <- stats
+		},
+	}, m)
+	defer s.Stop()
+
+	// First sample is taken right away
+	stats := <-highFill
+	assert.Equal(t, 4, stats.Entries)
+	sampled, ok := s.Stats(m)
+	assert.True(t, ok)
+	assert.Equal(t, stats, sampled)
+	_, ok = s.Stats(&EbpfMap{})
+	assert.False(t, ok)
+
+	published, ok := GetMetrics().Get(MetricMaps).(*expvar.Map)
+	require.True(t, ok)
+	v, ok := published.Get("sampled").(*expvar.Map)
+	require.True(t, ok)
+	assert.Equal(t, "4", v.Get("entries").String())
+	assert.Equal(t, "4", v.Get("max_entries").String())
+	assert.Equal(t, "1", v.Get("fill").String())
+
+	s.Stop()
+	s.Stop()
+	<-s.Done()
+}
@@ -4,9 +4,14 @@
 package goebpf
 
 import (
+	"encoding/binary"
+	"errors"
+	"sync"
+	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestMapFromElf(t *testing.T) {
@@ -22,15 +27,34 @@ func TestMapFromElf(t *testing.T) {
 		0, 0, 0, 0, 0, 0, 0, 0, // persistent path
 	}
 
-	m, err := newMapFromElfSection(payload1)
+	m, err := newMapFromElfSection(payload1, binary.LittleEndian)
 	assert.NoError(t, err)
 	assert.Equal(t, MapTypeHash, m.Type)
 	assert.Equal(t, 10, m.KeySize)
 	assert.Equal(t, 4096, m.ValueSize)
 	assert.Equal(t, 65536, m.MaxEntries)
 
+	// Big endian ELF (e.g. built for s390x)
+	payload2 := []byte{
+		0, 0, 0, 2, // map type array
+		0, 0, 0, 4, // key size is 4
+		0, 0, 0x10, 0, // value size is 4096
+		0, 0x1, 0, 0, // max items is 65536
+		0, 0, 0, 1, // flags
+		0, 0, 0, 0, // padding
+		0, 0, 0, 0, 0, 0, 0, 0, // inner map ptr
+		0, 0, 0, 0, 0, 0, 0, 0, // persistent path
+	}
+	m, err = newMapFromElfSection(payload2, binary.BigEndian)
+	assert.NoError(t, err)
+	assert.Equal(t, MapTypeArray, m.Type)
+	assert.Equal(t, 4, m.KeySize)
+	assert.Equal(t, 4096, m.ValueSize)
+	assert.Equal(t, 65536, m.MaxEntries)
+	assert.Equal(t, 1, m.Flags)
+
 	// Negative
-	m, err = newMapFromElfSection([]byte("123"))
+	m, err = newMapFromElfSection([]byte("123"), binary.LittleEndian)
 	assert.Error(t, err)
 	assert.Nil(t, m)
 }
@@ -54,3 +78,237 @@ func TestMapCloneTemplate(t *testing.T) {
 	cloned.(*EbpfMap).fd = 10
 	assert.Equal(t, m, cloned)
 }
+
+func TestMapConcurrentAccess(t *testing.T) {
+	// Real descriptor stands in for map fd, so Close() has something to close
+	var fds [2]int
+	require.NoError(t, syscall.Pipe(fds[:]))
+	defer syscall.Close(fds[1])
+	m := &EbpfMap{
+		fd:         fds[0],
+		Name:       "map1",
+		Type:       MapTypeHash,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 100,
+	}
+
+	// Readers always see either descriptor or 0 once it is closed, never
+	// half-closed state; clones never share descriptor
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if fd := m.GetFd(); fd != fds[0] && fd != 0 {
+					t.Errorf("Unexpected fd %d", fd)
+				}
+				if fd := m.CloneTemplate().GetFd(); fd != 0 {
+					t.Errorf("Clone has fd %d", fd)
+				}
+			}
+		}()
+	}
+	// Concurrent Close() calls: descriptor is closed once, the rest are no-op
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, m.Close())
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 0, m.GetFd())
+	assert.Equal(t, syscall.EBADF, syscall.Close(fds[0]))
+}
+
+func TestMapCheckCompatible(t *testing.T) {
+	m := &EbpfMap{
+		Name:       "map1",
+		Type:       MapTypeHash,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 100,
+	}
+
+	other := m.CloneTemplate().(*EbpfMap)
+	other.Name = "map2"
+	other.PersistentPath = "/sys/fs/bpf/map2"
+	assert.NoError(t, m.checkCompatible(other))
+
+	other.MaxEntries = 200
+	assert.EqualError(t, m.checkCompatible(other), "max entries 200, expected 100")
+	other = m.CloneTemplate().(*EbpfMap)
+	other.Type = MapTypeLRUHash
+	assert.EqualError(t, m.checkCompatible(other), "type LRU hash, expected Hash")
+	other = m.CloneTemplate().(*EbpfMap)
+	other.ValueSize = 4
+	assert.EqualError(t, m.checkCompatible(other), "value size 4, expected 8")
+	other = m.CloneTemplate().(*EbpfMap)
+	other.Flags = bpfNoPrealloc
+	assert.EqualError(t, m.checkCompatible(other), "flags 0x1, expected 0x0")
+}
+
+func TestMapLookupIntoInvalid(t *testing.T) {
+	m := &EbpfMap{
+		Type:       MapTypeHash,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 10,
+	}
+	// Key / buffer size mismatch is detected before syscall
+	assert.Error(t, m.LookupInto([]byte{1, 2}, make([]byte, 8)))
+	assert.Error(t, m.LookupInto([]byte{1, 2, 3, 4}, make([]byte, 4)))
+	assert.Error(t, m.LookupInto([]byte{1, 2, 3, 4}, nil))
+	assert.True(t, errors.Is(m.LookupInto([]byte{1, 2, 3, 4}, make([]byte, 4)), ErrInvalidSize))
+
+	// Per-CPU map of 2 CPUs: value of every CPU takes 8 bytes
+	m = &EbpfMap{
+		Type:          MapTypePerCPUArray,
+		KeySize:       4,
+		ValueSize:     4,
+		MaxEntries:    1,
+		valueRealSize: 2 * perCpuValueSize(4),
+	}
+	err := m.LookupInto([]byte{0, 0, 0, 0}, make([]byte, 2*4))
+	assert.True(t, errors.Is(err, ErrInvalidSize))
+	assert.EqualError(t, err, "Map '': invalid value size 8, expected 16 bytes")
+}
+
+func TestMapLookupTypedInvalid(t *testing.T) {
+	m := &EbpfMap{
+		Name:       "test",
+		Type:       MapTypeHash,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 10,
+	}
+	// Value size mismatch is detected before syscall
+	_, err := m.LookupUint32(uint32(0))
+	assert.EqualError(t, err, "Map 'test' value size is 8 bytes, not 4 (__u32)")
+
+	m.Type = MapTypePerCPUHash
+	var v Be64
+	err = m.LookupValue(uint32(0), &v)
+	assert.True(t, errors.Is(err, ErrNotSupported))
+}
+
+func TestMapKeyValueSize(t *testing.T) {
+	m := &EbpfMap{
+		Name:       "test",
+		Type:       MapTypeHash,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 10,
+	}
+	// Mismatches are detected before syscall
+	err := m.Insert([]byte{1, 2}, uint64(1))
+	assert.EqualError(t, err, "Map 'test': invalid key size 2, expected 4 bytes")
+	assert.True(t, errors.Is(err, ErrInvalidSize))
+	var sizeErr *MapSizeError
+	require.True(t, errors.As(err, &sizeErr))
+	assert.Equal(t, MapSizeError{Map: "test", Kind: "key", Expected: 4, Got: 2}, *sizeErr)
+
+	assert.EqualError(t, m.Upsert(uint32(1), uint32(1)), "Map 'test': invalid value size 4, expected 8 bytes")
+	assert.EqualError(t, m.Update(uint16(1), uint64(1)), "Map 'test': invalid key size 2, expected 4 bytes")
+	assert.EqualError(t, m.Delete(uint64(1)), "Map 'test': invalid key size 8, expected 4 bytes")
+	_, err = m.Lookup(MustIPv6Key("::1"))
+	assert.EqualError(t, err, "Map 'test': invalid key size 16, expected 4 bytes")
+	_, err = m.GetNextKey("12345")
+	assert.EqualError(t, err, "Map 'test': invalid key size 5, expected 4 bytes")
+	_, err = m.LookupUint64(Be16(1))
+	assert.True(t, errors.Is(err, ErrInvalidSize))
+	_, err = m.DeleteBatch([][]byte{{1, 2, 3, 4}, {1}})
+	assert.True(t, errors.Is(err, ErrInvalidSize))
+	assert.True(t, errors.Is(m.LookupInto([]byte{1}, make([]byte, 8)), ErrInvalidSize))
+	assert.EqualError(t, m.Upsert(uint32(1), VlanKey(4096)), "Map 'test': invalid value: Invalid VLAN ID 4096")
+
+	// IPv4 prefix in IPv6 LPM trie
+	m.KeySize = 20
+	err = m.Insert(CreateLPMtrieKey("10.0.0.0/8"), uint64(1))
+	assert.EqualError(t, err, "Map 'test': invalid key size 8, expected 20 bytes")
+
+	// Short strings are zero padded, flexible int fits whatever size is
+	m.KeySize = 4
+	key, err := m.keyBytes("ab")
+	require.NoError(t, err)
+	assert.Equal(t, []byte{'a', 'b', 0, 0}, key)
+	_, err = m.valueBytes(1)
+	assert.NoError(t, err)
+	_, err = m.keyBytes(1 << 40)
+	assert.EqualError(t, err, "Map 'test': invalid key: Key/Value is too long (must be at most 4)")
+
+	// Per-CPU map takes values of all CPUs, each aligned to 8 bytes
+	m.Type = MapTypePerCPUArray
+	m.ValueSize = 4
+	m.valueRealSize = 2 * perCpuValueSize(4)
+	assert.EqualError(t, m.Upsert(uint32(1), uint32(1)), "Map 'test': invalid value size 4, expected 16 bytes")
+	_, err = m.valueBytes(make([]byte, 16))
+	assert.NoError(t, err)
+}
+
+func TestMapSizedByCpus(t *testing.T) {
+	numCpus, err := GetNumOfPossibleCpus()
+	require.NoError(t, err)
+
+	for _, mapType := range []MapType{MapTypePerfEventArray, MapTypePerCPUArray, MapTypePerCPUHash} {
+		m := &EbpfMap{
+			Name:      "test",
+			Type:      mapType,
+			KeySize:   4,
+			ValueSize: 4,
+		}
+		require.NoError(t, m.prepare())
+		assert.Equal(t, numCpus, m.MaxEntries, mapType.String())
+	}
+
+	// Explicit max entries / regular maps are not touched
+	m := &EbpfMap{
+		Name:       "test",
+		Type:       MapTypePerfEventArray,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: 1024,
+	}
+	require.NoError(t, m.prepare())
+	assert.Equal(t, 1024, m.MaxEntries)
+	m = &EbpfMap{
+		Name:      "test",
+		Type:      MapTypePerCpuCGroupStorage,
+		KeySize:   4,
+		ValueSize: 4,
+	}
+	require.NoError(t, m.prepare())
+	assert.Equal(t, 0, m.MaxEntries)
+}
+
+func TestMapRingBufSize(t *testing.T) {
+	// Ring buffer has no keys / values
+	m := &EbpfMap{
+		Name:       "test",
+		Type:       MapTypeRingBuf,
+		MaxEntries: 1 << 20,
+	}
+	assert.NoError(t, m.prepare())
+
+	for _, size := range []int{0, 1000, 3 << 20} {
+		m.MaxEntries = size
+		assert.Error(t, m.prepare(), size)
+	}
+}
+
+func TestHandlePinnedReplaceFailed(t *testing.T) {
+	// Pipe fd stands for fd of pinned map
+	var fds [2]int
+	require.NoError(t, syscall.Pipe(fds[:]))
+	defer syscall.Close(fds[1])
+
+	m := &EbpfMap{Name: "map1", PersistentPath: "/non/existing/map1", PinPolicy: MapPinReplace}
+	err := m.handlePinned(fds[0])
+	assert.Error(t, err)
+	assert.Equal(t, 0, m.fd)
+	// fd is left to caller, closed exactly once
+	assert.NoError(t, syscall.Close(fds[0]))
+}
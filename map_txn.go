@@ -0,0 +1,293 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+// Number of banks (inner maps) of every double buffered map
+const doubleBufferBanks = 2
+
+// DoubleBufferedMap is array of maps (of at least 2 entries), along with
+// definition of its inner maps
+type DoubleBufferedMap struct {
+	Outer *EbpfMap
+	Inner *EbpfMap
+}
+
+// DoubleBuffer applies updates of configuration spread over several maps
+// atomically, so programs never observe partially applied configuration.
+// Every map is array of maps holding two inner maps (banks), while index map
+// (array, single __u32 value) selects active bank of all of them. Transaction
+// updates inactive banks, then flips index. Programs must read index once:
+//
+//	__u32 zero = 0;
+//	__u32 *bank = bpf_map_lookup_elem(&config_index, &zero);
+//	if (!bank)
+//		return XDP_PASS;
+//	void *rules = bpf_map_lookup_elem(&rules_outer, bank);
+//	void *routes = bpf_map_lookup_elem(&routes_outer, bank);
+//
+// Go side:
+//
+//	db, err := goebpf.NewDoubleBuffer(index, goebpf.DoubleBufferedMap{Outer: rulesOuter, Inner: rulesTemplate}, ...)
+//	txn := db.Begin()
+//	txn.Upsert("rules_outer", key, value)
+//	txn.Delete("routes_outer", otherKey)
+//	err = txn.Commit()
+type DoubleBuffer struct {
+	mu     sync.Mutex
+	index  *EbpfMap
+	maps   map[string]*bufferedMap
+	active int
+	// Operations of the last transaction: inactive banks are behind by them
+	lag []txnOp
+	// Inactive banks are in unknown state after failed commit, resync needed
+	dirty bool
+}
+
+type bufferedMap struct {
+	outer *EbpfMap
+	banks [doubleBufferBanks]*EbpfMap
+}
+
+type txnOp struct {
+	m      *bufferedMap
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// NewDoubleBuffer creates two (empty) inner maps for every map and makes
+// bank 0 active. Maps are identified by name of outer map in transactions.
+func NewDoubleBuffer(index *EbpfMap, maps ...DoubleBufferedMap) (*DoubleBuffer, error) {
+	if index.Type != MapTypeArray || index.ValueSize != 4 {
+		return nil, fmt.Errorf("Index map '%s' must be array of __u32", index.Name)
+	}
+	if len(maps) == 0 {
+		return nil, errors.New("No maps to double buffer")
+	}
+	b := &DoubleBuffer{
+		index: index,
+		maps:  make(map[string]*bufferedMap),
+	}
+	for _, dm := range maps {
+		if dm.Outer == nil || dm.Inner == nil {
+			return nil, errors.New("Both outer / inner maps must be set")
+		}
+		if dm.Outer.Type != MapTypeArrayOfMaps || dm.Outer.MaxEntries < doubleBufferBanks {
+			return nil, fmt.Errorf("Map '%s' must be array of maps of at least %d entries", dm.Outer.Name, doubleBufferBanks)
+		}
+		if _, ok := b.maps[dm.Outer.Name]; ok {
+			return nil, fmt.Errorf("Map '%s' is listed twice", dm.Outer.Name)
+		}
+		b.maps[dm.Outer.Name] = &bufferedMap{outer: dm.Outer}
+	}
+
+	for _, dm := range maps {
+		bm := b.maps[dm.Outer.Name]
+		for bank := range bm.banks {
+			inner := dm.Inner.CloneTemplate().(*EbpfMap)
+			inner.PersistentPath = ""
+			if err := inner.Create(); err != nil {
+				b.Close()
+				return nil, fmt.Errorf("Unable to create inner map of '%s': %v", dm.Outer.Name, err)
+			}
+			bm.banks[bank] = inner
+			if err := bm.outer.Upsert(uint32(bank), uint32(inner.GetFd())); err != nil {
+				b.Close()
+				return nil, fmt.Errorf("Unable to insert inner map into '%s': %v", dm.Outer.Name, err)
+			}
+		}
+	}
+	if err := index.Upsert(uint32(0), uint32(0)); err != nil {
+		b.Close()
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// Active returns index of active bank
+func (b *DoubleBuffer) Active() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.active
+}
+
+// Map returns active inner map of outer map name, e.g. to read it.
+// Map must not be modified directly.
+func (b *DoubleBuffer) Map(name string) Map {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bm, ok := b.maps[name]
+	if !ok {
+		return nil
+	}
+	return bm.banks[b.active]
+}
+
+// Begin starts transaction. Nothing is applied to maps until Commit().
+func (b *DoubleBuffer) Begin() *MapTxn {
+	return &MapTxn{b: b}
+}
+
+// Close frees inner maps. Outer / index maps are owned by caller.
+func (b *DoubleBuffer) Close() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, bm := range b.maps {
+		for _, inner := range bm.banks {
+			if inner != nil {
+				inner.Close()
+			}
+		}
+	}
+
+	return nil
+}
+
+// Applies operations to bank, deletes of missing keys are not errors
+func applyTxnOps(ops []txnOp, bank int) error {
+	for _, op := range ops {
+		m := op.m.banks[bank]
+		if op.delete {
+			if err := m.Delete(op.key); err != nil && !errors.Is(err, ErrKeyNotExist) {
+				return err
+			}
+			continue
+		}
+		if err := m.Upsert(op.key, op.value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Makes bank a copy of active one
+func (b *DoubleBuffer) resync(bank int) error {
+	for name, bm := range b.maps {
+		src, dst := bm.banks[b.active], bm.banks[bank]
+		current, err := takeMapSnapshot(src)
+		if err != nil {
+			return fmt.Errorf("Unable to read map '%s': %v", name, err)
+		}
+		if dst.Type != MapTypeArray {
+			old, err := takeMapSnapshot(dst)
+			if err != nil {
+				return fmt.Errorf("Unable to read map '%s': %v", name, err)
+			}
+			for key := range old {
+				if _, ok := current[key]; ok {
+					continue
+				}
+				if err = dst.Delete([]byte(key)); err != nil && !errors.Is(err, ErrKeyNotExist) {
+					return err
+				}
+			}
+		}
+		for key, value := range current {
+			if err = dst.Upsert([]byte(key), value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// MapTxn is set of updates of maps of DoubleBuffer, applied all at once by Commit()
+type MapTxn struct {
+	b   *DoubleBuffer
+	ops []txnOp
+}
+
+func (t *MapTxn) bufferedMap(name string) (*bufferedMap, error) {
+	bm, ok := t.b.maps[name]
+	if !ok {
+		return nil, fmt.Errorf("Map '%s' is not double buffered", name)
+	}
+	return bm, nil
+}
+
+// Upsert records update of map (by outer map name).
+// Supported key / value types are the same as of EbpfMap.Upsert().
+func (t *MapTxn) Upsert(name string, ikey, ivalue interface{}) error {
+	bm, err := t.bufferedMap(name)
+	if err != nil {
+		return err
+	}
+	inner := bm.banks[0]
+	key, err := inner.keyBytes(ikey)
+	if err != nil {
+		return err
+	}
+	value, err := inner.valueBytes(ivalue)
+	if err != nil {
+		return err
+	}
+	t.ops = append(t.ops, txnOp{m: bm, key: key, value: value})
+
+	return nil
+}
+
+// Delete records removal of key from map (by outer map name).
+// Removal of missing key is not an error.
+func (t *MapTxn) Delete(name string, ikey interface{}) error {
+	bm, err := t.bufferedMap(name)
+	if err != nil {
+		return err
+	}
+	if bm.banks[0].Type == MapTypeArray {
+		return fmt.Errorf("Map '%s' elements can't be deleted", name)
+	}
+	key, err := bm.banks[0].keyBytes(ikey)
+	if err != nil {
+		return err
+	}
+	t.ops = append(t.ops, txnOp{m: bm, key: key, delete: true})
+
+	return nil
+}
+
+// Commit applies updates to inactive banks, then makes them active.
+// On error active banks are not changed.
+func (t *MapTxn) Commit() error {
+	b := t.b
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bank := 1 - b.active
+	// Bring inactive banks up to date first
+	if b.dirty {
+		if err := b.resync(bank); err != nil {
+			return err
+		}
+		b.dirty = false
+	} else if err := applyTxnOps(b.lag, bank); err != nil {
+		b.dirty = true
+		return err
+	}
+	b.lag = nil
+	if err := applyTxnOps(t.ops, bank); err != nil {
+		b.dirty = true
+		return err
+	}
+	if err := b.index.Upsert(uint32(0), uint32(bank)); err != nil {
+		b.dirty = true
+		return err
+	}
+	b.active = bank
+	b.lag = t.ops
+	t.ops = nil
+
+	return nil
+}
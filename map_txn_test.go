@@ -0,0 +1,62 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewDoubleBufferNegative(t *testing.T) {
+	index := &EbpfMap{Name: "index", Type: MapTypeArray, KeySize: 4, ValueSize: 4, MaxEntries: 1}
+	outer := &EbpfMap{Name: "outer", Type: MapTypeArrayOfMaps, KeySize: 4, ValueSize: 4, MaxEntries: 2}
+	inner := &EbpfMap{Name: "inner", Type: MapTypeHash, KeySize: 4, ValueSize: 8, MaxEntries: 16}
+
+	_, err := NewDoubleBuffer(&EbpfMap{Name: "index", Type: MapTypeHash, KeySize: 4, ValueSize: 4}, DoubleBufferedMap{outer, inner})
+	assert.Error(t, err)
+	_, err = NewDoubleBuffer(index)
+	assert.Error(t, err)
+	_, err = NewDoubleBuffer(index, DoubleBufferedMap{Outer: outer})
+	assert.Error(t, err)
+	_, err = NewDoubleBuffer(index, DoubleBufferedMap{outer, inner}, DoubleBufferedMap{outer, inner})
+	assert.Error(t, err)
+	_, err = NewDoubleBuffer(index, DoubleBufferedMap{
+		Outer: &EbpfMap{Name: "outer", Type: MapTypeArrayOfMaps, KeySize: 4, ValueSize: 4, MaxEntries: 1},
+		Inner: inner,
+	})
+	assert.Error(t, err)
+}
+
+func TestMapTxnOps(t *testing.T) {
+	hash := &bufferedMap{}
+	array := &bufferedMap{}
+	for bank := range hash.banks {
+		hash.banks[bank] = &EbpfMap{Name: "inner", Type: MapTypeHash, KeySize: 4, ValueSize: 8}
+		array.banks[bank] = &EbpfMap{Name: "inner", Type: MapTypeArray, KeySize: 4, ValueSize: 2}
+	}
+	b := &DoubleBuffer{maps: map[string]*bufferedMap{"hash": hash, "array": array}}
+
+	txn := b.Begin()
+	require.NoError(t, txn.Upsert("hash", uint32(1), uint64(2)))
+	require.NoError(t, txn.Delete("hash", uint32(3)))
+	require.NoError(t, txn.Upsert("array", uint32(0), uint16(5)))
+	require.Len(t, txn.ops, 3)
+	assert.Equal(t, hash, txn.ops[0].m)
+	assert.Equal(t, uint32(1), HostByteOrder().Uint32(txn.ops[0].key))
+	assert.Equal(t, uint64(2), HostByteOrder().Uint64(txn.ops[0].value))
+	assert.True(t, txn.ops[1].delete)
+	assert.Len(t, txn.ops[2].value, 2)
+
+	// Unknown map, key / value sizes, delete from array
+	assert.Error(t, txn.Upsert("other", uint32(1), uint64(2)))
+	assert.Error(t, txn.Upsert("hash", uint64(1), uint64(2)))
+	assert.Error(t, txn.Upsert("array", uint32(1), uint64(2)))
+	assert.Error(t, txn.Delete("array", uint32(1)))
+	assert.Error(t, txn.Delete("other", uint32(1)))
+	assert.Len(t, txn.ops, 3)
+	assert.Nil(t, b.Map("other"))
+	assert.Equal(t, hash.banks[0], b.Map("hash"))
+}
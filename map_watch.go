@@ -0,0 +1,167 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+// MapEventType is kind of change of map entry reported by MapWatcher
+type MapEventType int
+
+const (
+	MapEntryAdded MapEventType = iota
+	MapEntryRemoved
+	MapEntryChanged
+)
+
+func (t MapEventType) String() string {
+	switch t {
+	case MapEntryAdded:
+		return "Added"
+	case MapEntryRemoved:
+		return "Removed"
+	case MapEntryChanged:
+		return "Changed"
+	}
+
+	return "Unknown"
+}
+
+// MapEvent describes change of single map entry between two snapshots
+type MapEvent struct {
+	Type MapEventType
+	Key  []byte
+	// Current value, nil for MapEntryRemoved
+	Value []byte
+	// Value from previous snapshot, nil for MapEntryAdded
+	OldValue []byte
+}
+
+// MapWatcher periodically takes snapshot of map and reports
+// added / removed / changed entries.
+type MapWatcher struct {
+	m        Map
+	interval time.Duration
+	events   chan MapEvent
+	stop     chan struct{}
+	stopOnce sync.Once
+	err      error
+	snapshot map[string][]byte
+}
+
+// Watch starts watching for changes of map content, see WatchMap()
+func (m *EbpfMap) Watch(interval time.Duration) *MapWatcher {
+	return WatchMap(m, interval)
+}
+
+// WatchMap starts goroutine which snapshots map every interval and sends
+// difference to previous snapshot into Events() channel.
+// All entries existing at the time of first snapshot are reported as MapEntryAdded.
+// Snapshot is not atomic: entries changed during enumeration may be reported
+// in next snapshot only.
+func WatchMap(m Map, interval time.Duration) *MapWatcher {
+	w := &MapWatcher{
+		m:        m,
+		interval: interval,
+		events:   make(chan MapEvent, 64),
+		stop:     make(chan struct{}),
+		snapshot: make(map[string][]byte),
+	}
+	go w.run()
+
+	return w
+}
+
+// Events returns channel of map changes. Channel is closed when watcher stopped
+// either by Stop() or because of error, see Err().
+func (w *MapWatcher) Events() <-chan MapEvent {
+	return w.events
+}
+
+// Err returns error caused watcher to stop. Valid after Events() channel closed.
+func (w *MapWatcher) Err() error {
+	return w.err
+}
+
+// Stop stops watching. Safe to call multiple times.
+func (w *MapWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+	})
+}
+
+func (w *MapWatcher) run() {
+	defer close(w.events)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if w.err = w.poll(); w.err != nil {
+			return
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Takes new snapshot and sends difference to previous one
+func (w *MapWatcher) poll() error {
+	current, err := takeMapSnapshot(w.m)
+	if err != nil {
+		return err
+	}
+
+	var events []MapEvent
+	for key, value := range current {
+		old, ok := w.snapshot[key]
+		if !ok {
+			events = append(events, MapEvent{Type: MapEntryAdded, Key: []byte(key), Value: value})
+		} else if !bytes.Equal(old, value) {
+			events = append(events, MapEvent{Type: MapEntryChanged, Key: []byte(key), Value: value, OldValue: old})
+		}
+	}
+	for key, old := range w.snapshot {
+		if _, ok := current[key]; !ok {
+			events = append(events, MapEvent{Type: MapEntryRemoved, Key: []byte(key), OldValue: old})
+		}
+	}
+	w.snapshot = current
+
+	for _, event := range events {
+		select {
+		case w.events <- event:
+		case <-w.stop:
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// Reads all map entries into memory
+func takeMapSnapshot(m Map) (map[string][]byte, error) {
+	result := make(map[string][]byte)
+
+	key, err := m.GetNextKey(nil)
+	for ; err == nil; key, err = m.GetNextKey(key) {
+		value, err := m.Lookup(key)
+		if err != nil {
+			// Element may be deleted in between
+			continue
+		}
+		result[string(key)] = value
+	}
+	if err != ErrNoMoreKeys {
+		return nil, err
+	}
+
+	return result, nil
+}
@@ -0,0 +1,85 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Map which fails to enumerate keys
+type failingWatchMap struct {
+	Map
+}
+
+func (m *failingWatchMap) GetNextKey(ikey interface{}) ([]byte, error) {
+	return nil, errors.New("boom")
+}
+
+// Reads all events currently available in channel
+func readMapEvents(w *MapWatcher) map[string]MapEvent {
+	result := make(map[string]MapEvent)
+	for {
+		select {
+		case event := <-w.events:
+			result[string(event.Key)] = event
+		default:
+			return result
+		}
+	}
+}
+
+func TestMapWatcherPoll(t *testing.T) {
+	m := newDumpTestMap()
+	// Create watcher manually to control snapshots
+	w := &MapWatcher{
+		m:        m,
+		events:   make(chan MapEvent, 64),
+		stop:     make(chan struct{}),
+		snapshot: make(map[string][]byte),
+	}
+
+	// Initial snapshot: everything is new
+	require.NoError(t, w.poll())
+	events := readMapEvents(w)
+	assert.Len(t, events, 2)
+	assert.Equal(t, MapEntryAdded, events["\x01\x00"].Type)
+
+	// No changes
+	require.NoError(t, w.poll())
+	assert.Len(t, readMapEvents(w), 0)
+
+	// Add / remove / change
+	delete(m.items, "\x01\x00")
+	m.items["\x02\x00"] = []byte{5, 0, 0, 0}
+	m.items["\x03\x00"] = []byte{3, 0, 0, 0}
+	require.NoError(t, w.poll())
+	events = readMapEvents(w)
+	assert.Equal(t, map[string]MapEvent{
+		"\x01\x00": {Type: MapEntryRemoved, Key: []byte{1, 0}, OldValue: []byte{1, 0, 0, 0}},
+		"\x02\x00": {Type: MapEntryChanged, Key: []byte{2, 0}, Value: []byte{5, 0, 0, 0}, OldValue: []byte{2, 0, 0, 0}},
+		"\x03\x00": {Type: MapEntryAdded, Key: []byte{3, 0}, Value: []byte{3, 0, 0, 0}},
+	}, events)
+}
+
+func TestMapWatcherStop(t *testing.T) {
+	w := WatchMap(newDumpTestMap(), time.Millisecond)
+	<-w.Events()
+	w.Stop()
+	w.Stop()
+	// Drain channel, it must be closed eventually
+	for range w.Events() {
+	}
+	assert.NoError(t, w.Err())
+
+	// Error stops watcher
+	w = WatchMap(&failingWatchMap{}, time.Millisecond)
+	_, ok := <-w.Events()
+	assert.False(t, ok)
+	assert.EqualError(t, w.Err(), "boom")
+}
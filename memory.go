@@ -0,0 +1,162 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"os"
+	"sort"
+)
+
+// Approximate sizes of kernel structures (64 bit kernels), used for memory estimations
+const (
+	memMapOverhead     = 256 // struct bpf_map and map type specific part
+	memHtabElemHeader  = 48  // struct htab_elem, precedes key / value
+	memHtabBucketSize  = 16  // struct bucket
+	memLpmNodeHeader   = 32  // struct lpm_trie_node
+	memStackBucketSize = 16  // struct stack_map_bucket
+	memProgHeader      = 72  // struct bpf_prog, precedes instructions
+)
+
+// MapMemoryUsage is approximate kernel memory consumed by map
+type MapMemoryUsage struct {
+	Name  string
+	Type  MapType
+	Flags int
+	// Estimated for fully populated map (all MaxEntries elements)
+	Bytes uint64
+}
+
+// ProgramMemoryUsage is kernel memory consumed by loaded program
+type ProgramMemoryUsage struct {
+	Name string
+	Type ProgramType
+	// Size of program after verifier rewrites / of JIT compiled machine code
+	XlatedSize int
+	JitedSize  int
+	Bytes      uint64
+}
+
+// MemoryUsage is approximate kernel memory consumed by maps / programs of eBPF system
+type MemoryUsage struct {
+	// Sorted by name
+	Maps     []MapMemoryUsage
+	Programs []ProgramMemoryUsage
+	// Sum of all maps / programs
+	Total uint64
+}
+
+// GetMemoryUsage reports approximate kernel memory consumed by maps / programs of system,
+// so capacity planning does not require bpftool. Maps are estimated from definition
+// (type, key / value sizes, max entries, flags) as if fully populated, so it works even
+// for ELF files read by WithParseOnly(). Programs not loaded into kernel are skipped.
+func GetMemoryUsage(s System) (*MemoryUsage, error) {
+	numCpus, err := GetNumOfPossibleCpus()
+	if err != nil {
+		return nil, err
+	}
+
+	res := &MemoryUsage{}
+	for name, m := range s.GetMaps() {
+		em, ok := m.(*EbpfMap)
+		if !ok {
+			continue
+		}
+		usage := MapMemoryUsage{
+			Name:  name,
+			Type:  em.Type,
+			Flags: em.Flags,
+			Bytes: em.estimateMemory(numCpus),
+		}
+		res.Maps = append(res.Maps, usage)
+		res.Total += usage.Bytes
+	}
+	for name, prog := range s.GetPrograms() {
+		fd := prog.GetFd()
+		if fd == 0 {
+			continue
+		}
+		usage := ProgramMemoryUsage{
+			Name: name,
+			Type: prog.GetType(),
+		}
+		if usage.XlatedSize, usage.JitedSize, err = ebpfObjGetProgSizes(fd); err != nil {
+			return nil, err
+		}
+		// Instructions live in pages along with struct bpf_prog, JIT image is separate
+		pageSize := uint64(os.Getpagesize())
+		usage.Bytes = roundUp(uint64(memProgHeader+usage.XlatedSize), pageSize) + uint64(usage.JitedSize)
+		res.Programs = append(res.Programs, usage)
+		res.Total += usage.Bytes
+	}
+	sort.Slice(res.Maps, func(i, j int) bool {
+		return res.Maps[i].Name < res.Maps[j].Name
+	})
+	sort.Slice(res.Programs, func(i, j int) bool {
+		return res.Programs[i].Name < res.Programs[j].Name
+	})
+
+	return res, nil
+}
+
+// Estimates kernel memory of fully populated map, the same way kernel allocates it
+func (m *EbpfMap) estimateMemory(numCpus int) uint64 {
+	maxEntries := uint64(m.MaxEntries)
+	key := roundUp(uint64(m.KeySize), 8)
+	value := roundUp(uint64(m.ValueSize), 8)
+	// Hash tables: power of two buckets, element is header + key + value
+	htab := func(elemValue uint64) uint64 {
+		return nextPowerOfTwo(maxEntries)*memHtabBucketSize + maxEntries*(memHtabElemHeader+key+elemValue)
+	}
+
+	var bytes uint64
+	switch m.Type {
+	case MapTypeArray, MapTypeProgArray, MapTypePerfEventArray, MapTypeCgroupArray,
+		MapTypeArrayOfMaps, MapTypeDevMap, MapTypeSockMap, MapTypeCPUMap,
+		MapTypeXSKMap, MapTypeReusePortSockArray:
+		// Arrays of fds actually keep pointers to objects, which is value rounded up to 8 as well
+		bytes = maxEntries * value
+	case MapTypePerCPUArray:
+		bytes = maxEntries * (8 + value*uint64(numCpus))
+	case MapTypeHash, MapTypeHashOfMaps, MapTypeSockHash, MapTypeDevMapHash:
+		bytes = htab(value)
+		// Preallocated hash tables keep extra element per CPU for updates of existing keys
+		if m.Flags&bpfNoPrealloc == 0 {
+			bytes += uint64(numCpus) * (memHtabElemHeader + key + value)
+		}
+	case MapTypeLRUHash:
+		bytes = htab(value)
+	case MapTypePerCPUHash, MapTypeLRUPerCPUHash:
+		// Element keeps pointer to per-CPU values
+		bytes = htab(8) + maxEntries*value*uint64(numCpus)
+	case MapTypeLPMTrie:
+		// Key starts with 4 bytes prefix length, which is not stored in node
+		bytes = maxEntries * (memLpmNodeHeader + value)
+		if m.KeySize > 4 {
+			bytes += maxEntries * uint64(m.KeySize-4)
+		}
+	case MapTypeQueue, MapTypeStack:
+		bytes = (maxEntries + 1) * uint64(m.ValueSize)
+	case MapTypeRingBuf:
+		// Data pages along with consumer / producer pages
+		bytes = maxEntries + 2*uint64(os.Getpagesize())
+	case MapTypeStackTrace:
+		bytes = nextPowerOfTwo(maxEntries)*8 + maxEntries*(memStackBucketSize+uint64(m.ValueSize))
+	default:
+		bytes = maxEntries * (key + value)
+	}
+
+	return memMapOverhead + bytes
+}
+
+func roundUp(n, to uint64) uint64 {
+	return (n + to - 1) / to * to
+}
+
+func nextPowerOfTwo(n uint64) uint64 {
+	res := uint64(1)
+	for res < n {
+		res <<= 1
+	}
+	return res
+}
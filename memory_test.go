@@ -0,0 +1,66 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEstimateMapMemory(t *testing.T) {
+	array := &EbpfMap{Type: MapTypeArray, KeySize: 4, ValueSize: 12, MaxEntries: 100}
+	assert.Equal(t, uint64(memMapOverhead+100*16), array.estimateMemory(4))
+
+	perCPUArray := &EbpfMap{Type: MapTypePerCPUArray, KeySize: 4, ValueSize: 8, MaxEntries: 10}
+	assert.Equal(t, uint64(memMapOverhead+10*(8+8*4)), perCPUArray.estimateMemory(4))
+
+	// 100 entries - 128 buckets
+	hash := &EbpfMap{Type: MapTypeHash, KeySize: 6, ValueSize: 4, MaxEntries: 100, Flags: bpfNoPrealloc}
+	assert.Equal(t, uint64(memMapOverhead+128*memHtabBucketSize+100*(memHtabElemHeader+8+8)),
+		hash.estimateMemory(4))
+
+	// Preallocated: extra element per CPU
+	hash.Flags = 0
+	assert.Equal(t, uint64(memMapOverhead+128*memHtabBucketSize+104*(memHtabElemHeader+8+8)),
+		hash.estimateMemory(4))
+
+	perCPUHash := &EbpfMap{Type: MapTypePerCPUHash, KeySize: 8, ValueSize: 8, MaxEntries: 64}
+	assert.Equal(t, uint64(memMapOverhead+64*memHtabBucketSize+64*(memHtabElemHeader+8+8)+64*8*4),
+		perCPUHash.estimateMemory(4))
+
+	lpm := &EbpfMap{Type: MapTypeLPMTrie, KeySize: 8, ValueSize: 8, MaxEntries: 10}
+	assert.Equal(t, uint64(memMapOverhead+10*(memLpmNodeHeader+4+8)), lpm.estimateMemory(4))
+
+	// Storage maps are allocated on demand
+	storage := &EbpfMap{Type: MapTypeSKStorage, KeySize: 4, ValueSize: 8}
+	assert.Equal(t, uint64(memMapOverhead), storage.estimateMemory(4))
+}
+
+func TestGetMemoryUsage(t *testing.T) {
+	s := NewDefaultEbpfSystem().(*ebpfSystem)
+	s.Maps = map[string]Map{
+		"b": &EbpfMap{Name: "b", Type: MapTypeArray, KeySize: 4, ValueSize: 8, MaxEntries: 10},
+		"a": &EbpfMap{Name: "a", Type: MapTypeArray, KeySize: 4, ValueSize: 8, MaxEntries: 20, Flags: bpfReadOnlyProgram},
+	}
+	// Not loaded programs are skipped
+	s.Programs = map[string]Program{
+		"prog": newXdpProgram("prog", "GPL", make([]byte, bpfInstructionLen)),
+	}
+
+	usage, err := GetMemoryUsage(s)
+	require.NoError(t, err)
+	require.Len(t, usage.Maps, 2)
+	assert.Equal(t, "a", usage.Maps[0].Name)
+	assert.Equal(t, bpfReadOnlyProgram, usage.Maps[0].Flags)
+	assert.Equal(t, uint64(memMapOverhead+20*8), usage.Maps[0].Bytes)
+	assert.Equal(t, "b", usage.Maps[1].Name)
+	assert.Empty(t, usage.Programs)
+	assert.Equal(t, uint64(2*memMapOverhead+30*8), usage.Total)
+
+	assert.Equal(t, uint64(1), nextPowerOfTwo(0))
+	assert.Equal(t, uint64(64), nextPowerOfTwo(64))
+	assert.Equal(t, uint64(128), nextPowerOfTwo(65))
+}
@@ -0,0 +1,88 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"expvar"
+
+	"github.com/dropbox/goebpf/goebpf_perf"
+)
+
+// Names of internal library metrics
+const (
+	// Total number of bpf(2) syscalls made / failed
+	MetricBpfSyscalls      = "bpf_syscalls"
+	MetricBpfSyscallErrors = "bpf_syscall_errors"
+	// eBPF maps created in kernel
+	MetricMapsCreated = "maps_created"
+	// eBPF programs loaded / failed to load into kernel (i.e. rejected by verifier)
+	MetricProgramsLoaded      = "programs_loaded"
+	MetricProgramLoadFailures = "program_load_failures"
+	// Program attach / detach operations (all attempts) / failed ones
+	MetricAttaches       = "attaches"
+	MetricAttachFailures = "attach_failures"
+	MetricDetaches       = "detaches"
+	MetricDetachFailures = "detach_failures"
+	// Retries of operations failed with transient errors, see SetRetryPolicy()
+	MetricRetries = "retries"
+	// Stats of maps sampled by SampleMaps(), failures to sample map
+	MetricMaps            = "maps"
+	MetricMapSampleErrors = "map_sample_errors"
+	// Samples read from perf rings (goebpf_perf) / lost by kernel because ring was full
+	MetricPerfSamples     = "perf_samples"
+	MetricPerfSamplesLost = "perf_samples_lost"
+	// Records read from ring buffer maps by RingBufReader / discarded by eBPF programs.
+	// Records kernel failed to reserve are reported to eBPF program only.
+	MetricRingBufRecords   = "ringbuf_records"
+	MetricRingBufDiscarded = "ringbuf_records_discarded"
+)
+
+// All library metrics live in one expvar.Map
+var metrics = newMetrics()
+
+func newMetrics() *expvar.Map {
+	m := new(expvar.Map).Init()
+	// goebpf_perf counts samples of its rings itself
+	m.Set(MetricPerfSamples, expvar.Func(func() interface{} {
+		read, _ := goebpf_perf.Stats()
+		return read
+	}))
+	m.Set(MetricPerfSamplesLost, expvar.Func(func() interface{} {
+		_, lost := goebpf_perf.Stats()
+		return lost
+	}))
+	return m
+}
+
+// GetMetrics returns internal metrics of library (counters of syscalls,
+// loaded programs, attach / detach operations, etc).
+// expvar.Map is returned, so it can be easily exported through any expvar compatible
+// monitoring system, or inspected by using Get() with one of Metric* names.
+func GetMetrics() *expvar.Map {
+	return metrics
+}
+
+// PublishMetrics makes library metrics available through standard expvar
+// HTTP handler (/debug/vars) under given name.
+// Like expvar.Publish() it panics if name is already in use.
+func PublishMetrics(name string) {
+	expvar.Publish(name, metrics)
+}
+
+// Helper to count result of bpf(2) syscall
+func countBpfSyscall(res int) {
+	metrics.Add(MetricBpfSyscalls, 1)
+	if res == -1 {
+		metrics.Add(MetricBpfSyscallErrors, 1)
+	}
+}
+
+// Helper to count result of operation which has separate
+// counters for total amount (successful and failed) and failures
+func countOperation(total, failures string, err error) {
+	metrics.Add(total, 1)
+	if err != nil {
+		metrics.Add(failures, 1)
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"expvar"
+	"testing"
+
+	"github.com/dropbox/goebpf/goebpf_perf"
+	"github.com/stretchr/testify/assert"
+)
+
+func getMetricValue(name string) int64 {
+	if v, ok := GetMetrics().Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestCountBpfSyscall(t *testing.T) {
+	total := getMetricValue(MetricBpfSyscalls)
+	errs := getMetricValue(MetricBpfSyscallErrors)
+
+	countBpfSyscall(10)
+	countBpfSyscall(-1)
+
+	assert.Equal(t, total+2, getMetricValue(MetricBpfSyscalls))
+	assert.Equal(t, errs+1, getMetricValue(MetricBpfSyscallErrors))
+}
+
+func TestCountOperation(t *testing.T) {
+	total := getMetricValue(MetricAttaches)
+	failures := getMetricValue(MetricAttachFailures)
+
+	countOperation(MetricAttaches, MetricAttachFailures, nil)
+	countOperation(MetricAttaches, MetricAttachFailures, nil)
+	countOperation(MetricAttaches, MetricAttachFailures, errors.New("failed"))
+
+	assert.Equal(t, total+3, getMetricValue(MetricAttaches))
+	assert.Equal(t, failures+1, getMetricValue(MetricAttachFailures))
+}
+
+func TestPerfMetrics(t *testing.T) {
+	read, lost := goebpf_perf.Stats()
+
+	samples, ok := GetMetrics().Get(MetricPerfSamples).(expvar.Func)
+	assert.True(t, ok)
+	assert.Equal(t, read, samples())
+	samplesLost, ok := GetMetrics().Get(MetricPerfSamplesLost).(expvar.Func)
+	assert.True(t, ok)
+	assert.Equal(t, lost, samplesLost())
+}
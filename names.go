@@ -0,0 +1,106 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"unsafe"
+)
+
+// Kernel keeps names of maps / programs in BPF_OBJ_NAME_LEN bytes (including
+// NULL terminator) and accepts only alphanumeric characters, '_' and '.' in
+// them. Longer names (e.g. C function names of programs) are not rejected:
+// they are truncated deterministically, with hash of full name appended so
+// names sharing long prefix stay distinct:
+//
+//	xdp_firewall_ipv6_ingress -> xdp_firewa_3fb4
+//
+// Full names are kept by Go side (EbpfMap.Name / program name), and are
+// reported back by info APIs of objects created by current process while
+// they are open: objects are matched by kernel ID, not by kernel name.
+
+// Number of hex digits of name hash in kernel name
+const objNameHashLen = 4
+
+// Full names of open maps / programs created by current process which
+// kernel names differ from them, by kernel ID (IDs of maps and programs
+// are allocated independently)
+var objectNames = struct {
+	sync.Mutex
+	maps     map[uint32]string
+	programs map[uint32]string
+}{
+	maps:     make(map[uint32]string),
+	programs: make(map[uint32]string),
+}
+
+// Characters allowed by kernel in object names (bpf_obj_name_cpy())
+func isObjNameChar(ch byte) bool {
+	return ch >= 'a' && ch <= 'z' || ch >= 'A' && ch <= 'Z' ||
+		ch >= '0' && ch <= '9' || ch == '_' || ch == '.'
+}
+
+// KernelObjectName returns name map / program with given name gets in kernel:
+// unsupported characters are replaced by '_', names longer than 15 bytes are
+// truncated and suffixed by hash of full name. Valid short names are kept as is.
+func KernelObjectName(name string) string {
+	res := []byte(name)
+	for i, ch := range res {
+		if !isObjNameChar(ch) {
+			res[i] = '_'
+		}
+	}
+	if len(res) < bpfObjNameLen {
+		return string(res)
+	}
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	prefixLen := bpfObjNameLen - 1 - objNameHashLen - 1
+	return fmt.Sprintf("%s_%0*x", res[:prefixLen], objNameHashLen, h.Sum32()&(1<<(4*objNameHashLen)-1))
+}
+
+// Remembers full name of object just created (fd) in names, if kernel name
+// differs from it. Returns ID of object to forget name by once object
+// is closed, 0 if there is nothing to forget.
+func registerObjectName(names map[uint32]string, fd int, name string) uint32 {
+	if KernelObjectName(name) == name {
+		return 0
+	}
+	// Names are informational, so object just reports kernel name
+	// if its ID can't be read
+	var info struct{ Type, Id uint32 }
+	if err := ebpfObjGetInfo(fd, unsafe.Pointer(&info), unsafe.Sizeof(info)); err != nil || info.Id == 0 {
+		return 0
+	}
+	objectNames.Lock()
+	names[info.Id] = name
+	objectNames.Unlock()
+	auditNameFd(fd, name)
+
+	return info.Id
+}
+
+// Forgets full name of closed object, its ID is going to be reused
+func unregisterObjectName(names map[uint32]string, id uint32) {
+	if id == 0 {
+		return
+	}
+	objectNames.Lock()
+	delete(names, id)
+	objectNames.Unlock()
+}
+
+// Returns full name of object by ID and name reported by kernel,
+// if it has been created by current process, kernel name otherwise
+func fullObjectName(names map[uint32]string, id uint32, kernelName string) string {
+	objectNames.Lock()
+	defer objectNames.Unlock()
+
+	if name, ok := names[id]; ok {
+		return name
+	}
+	return kernelName
+}
@@ -0,0 +1,51 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKernelObjectName(t *testing.T) {
+	// Valid names are kept as is
+	assert.Equal(t, "xdp_prog", KernelObjectName("xdp_prog"))
+	assert.Equal(t, "maps.rodata", KernelObjectName("maps.rodata"))
+	assert.Equal(t, "exactly_15_char", KernelObjectName("exactly_15_char"))
+	assert.Equal(t, "", KernelObjectName(""))
+	// Unsupported characters
+	assert.Equal(t, "my_prog_v2", KernelObjectName("my-prog/v2"))
+
+	// Truncated deterministically, names with common prefix differ
+	name := KernelObjectName("xdp_firewall_ipv6_ingress")
+	assert.Equal(t, "xdp_firewa_3fb4", name)
+	assert.Len(t, name, bpfObjNameLen-1)
+	assert.Equal(t, name, KernelObjectName("xdp_firewall_ipv6_ingress"))
+	assert.NotEqual(t, name, KernelObjectName("xdp_firewall_ipv6_egress"))
+	assert.Len(t, KernelObjectName("exactly_16_chars"), bpfObjNameLen-1)
+}
+
+func TestFullObjectName(t *testing.T) {
+	names := make(map[uint32]string)
+	// Kernel keeps valid short names as is, nothing to remember
+	assert.Zero(t, registerObjectName(names, 1000, "short"))
+	assert.Empty(t, names)
+	assert.Equal(t, "short", fullObjectName(names, 1, "short"))
+
+	kernelName := KernelObjectName("some_very_long_map_name")
+	objectNames.Lock()
+	names[7] = "some_very_long_map_name"
+	objectNames.Unlock()
+	assert.Equal(t, "some_very_long_map_name", fullObjectName(names, 7, kernelName))
+	// Objects of other processes, even with the same kernel name
+	assert.Equal(t, kernelName, fullObjectName(names, 8, kernelName))
+	assert.Equal(t, "other_proces_1", fullObjectName(names, 9, "other_proces_1"))
+
+	// Closed: ID may be reused by other object
+	unregisterObjectName(names, 7)
+	assert.Empty(t, names)
+	assert.Equal(t, kernelName, fullObjectName(names, 7, kernelName))
+	unregisterObjectName(names, 0)
+}
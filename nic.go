@@ -0,0 +1,94 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"sort"
+)
+
+// NicChannels is number of queues (channels) of network device, as shown by
+// "ethtool -l". Drivers have either separate RX / TX queues or combined ones.
+type NicChannels struct {
+	MaxRx       int
+	MaxTx       int
+	MaxOther    int
+	MaxCombined int
+	Rx          int
+	Tx          int
+	Other       int
+	Combined    int
+}
+
+// RxQueues returns number of queues device receives packets on,
+// i.e. queue IDs AF_XDP sockets can be bound to are [0, RxQueues())
+func (c *NicChannels) RxQueues() int {
+	return c.Rx + c.Combined
+}
+
+// TxQueues returns number of queues device transmits packets from
+func (c *NicChannels) TxQueues() int {
+	return c.Tx + c.Combined
+}
+
+// RssHashFunc is hash function RSS uses to select queue (ETH_RSS_HASH_*)
+type RssHashFunc uint32
+
+const (
+	RssHashToeplitz RssHashFunc = 1 << iota
+	RssHashXor
+	RssHashCrc32
+)
+
+func (f RssHashFunc) String() string {
+	switch f {
+	case 0:
+		return "none"
+	case RssHashToeplitz:
+		return "toeplitz"
+	case RssHashXor:
+		return "xor"
+	case RssHashCrc32:
+		return "crc32"
+	}
+
+	return fmt.Sprintf("RssHashFunc(%d)", uint32(f))
+}
+
+// NicRss is receive side scaling configuration of network device, as shown by
+// "ethtool -x": packets are spread over RX queues by hash of their flow
+type NicRss struct {
+	HashFunc RssHashFunc
+	// Queue of each hash bucket (packet goes to Indirection[hash % len(Indirection)])
+	Indirection []int
+	HashKey     []byte
+}
+
+// Queues returns sorted RX queues RSS spreads packets over,
+// e.g. ones needing AF_XDP socket / cpumap entry
+func (r *NicRss) Queues() []int {
+	seen := map[int]bool{}
+	var res []int
+	for _, queue := range r.Indirection {
+		if !seen[queue] {
+			seen[queue] = true
+			res = append(res, queue)
+		}
+	}
+	sort.Ints(res)
+	return res
+}
+
+// GetNicChannels returns queue counts of network device, for sizing
+// AF_XDP socket maps (MapTypeXSKMap) / cpumaps. Returns error matching
+// ErrNotSupported if driver doesn't report channels (e.g. virtual devices).
+func GetNicChannels(ifname string) (*NicChannels, error) {
+	return getNicChannels(ifname)
+}
+
+// GetNicRss returns RSS configuration of network device (kernel 6.0+).
+// Returns error matching ErrNotSupported if driver / kernel don't report it.
+func GetNicRss(ifname string) (*NicRss, error) {
+	return getNicRss(ifname)
+}
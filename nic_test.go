@@ -0,0 +1,33 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNicChannels(t *testing.T) {
+	// Separate RX / TX queues
+	c := &NicChannels{Rx: 4, Tx: 2, MaxRx: 8, MaxTx: 8}
+	assert.Equal(t, 4, c.RxQueues())
+	assert.Equal(t, 2, c.TxQueues())
+
+	// Combined ones, along with few extra RX
+	c = &NicChannels{Rx: 1, Combined: 8, MaxCombined: 16}
+	assert.Equal(t, 9, c.RxQueues())
+	assert.Equal(t, 8, c.TxQueues())
+}
+
+func TestNicRss(t *testing.T) {
+	assert.Equal(t, "none", RssHashFunc(0).String())
+	assert.Equal(t, "toeplitz", RssHashToeplitz.String())
+	assert.Equal(t, "crc32", RssHashCrc32.String())
+	assert.Equal(t, "RssHashFunc(3)", (RssHashToeplitz | RssHashXor).String())
+
+	rss := &NicRss{Indirection: []int{0, 3, 1, 3, 0, 1}}
+	assert.Equal(t, []int{0, 1, 3}, rss.Queues())
+	assert.Empty(t, (&NicRss{}).Queues())
+}
@@ -0,0 +1,268 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// Max length of BTF object name (module name) read by GetBtfInfoByFd()
+const btfNameLen = 64
+
+// LinkType is type of BPF link, program attachment owned by fd
+type LinkType int
+
+// Must be in sync with enum bpf_link_type from <linux/bpf.h>
+const (
+	LinkTypeUnspec LinkType = iota
+	LinkTypeRawTracepoint
+	LinkTypeTracing
+	LinkTypeCgroup
+	LinkTypeIter
+	LinkTypeNetns
+	LinkTypeXdp
+	LinkTypePerfEvent
+	LinkTypeKprobeMulti
+	LinkTypeStructOps
+	LinkTypeNetfilter
+	LinkTypeTcx
+	LinkTypeUprobeMulti
+	LinkTypeNetkit
+)
+
+func (t LinkType) String() string {
+	switch t {
+	case LinkTypeRawTracepoint:
+		return "RawTracepoint"
+	case LinkTypeTracing:
+		return "Tracing"
+	case LinkTypeCgroup:
+		return "Cgroup"
+	case LinkTypeIter:
+		return "Iter"
+	case LinkTypeNetns:
+		return "Netns"
+	case LinkTypeXdp:
+		return "XDP"
+	case LinkTypePerfEvent:
+		return "PerfEvent"
+	case LinkTypeKprobeMulti:
+		return "KprobeMulti"
+	case LinkTypeStructOps:
+		return "StructOps"
+	case LinkTypeNetfilter:
+		return "Netfilter"
+	case LinkTypeTcx:
+		return "TCX"
+	case LinkTypeUprobeMulti:
+		return "UprobeMulti"
+	case LinkTypeNetkit:
+		return "Netkit"
+	}
+
+	return "Unspecified"
+}
+
+// LinkInfo - information of BPF link (linux 5.8+): which program is attached
+// to what. Only fields related to link type are set.
+type LinkInfo struct {
+	Type      LinkType
+	Id        int // ID - external ID of link (to refer object)
+	Fd        int // fd - local process fd to be able to access the object.
+	ProgramId int // ID of attached program, see GetProgramInfoById()
+	// BPF_* attach type (Tracing, Cgroup, Netns, TCX, Netkit)
+	AttachType int
+	// Name of tracepoint (RawTracepoint), or iterator target (Iter)
+	TargetName string
+	// Target program ID or BTF object ID (0 - vmlinux) and BTF type ID of
+	// function program is attached to (Tracing)
+	TargetObjId int
+	TargetBtfId int
+	CgroupId    uint64 // Cgroup
+	NetnsIno    uint64 // Inode of network namespace (Netns)
+	Ifindex     int    // Network interface (XDP, TCX, Netkit)
+	MapId       int    // Map of struct_ops (StructOps)
+}
+
+// Target returns human readable description of what link is attached to
+func (l *LinkInfo) Target() string {
+	switch l.Type {
+	case LinkTypeRawTracepoint, LinkTypeIter:
+		return l.TargetName
+	case LinkTypeTracing:
+		return fmt.Sprintf("obj %d btf %d", l.TargetObjId, l.TargetBtfId)
+	case LinkTypeCgroup:
+		return fmt.Sprintf("cgroup %d", l.CgroupId)
+	case LinkTypeNetns:
+		return fmt.Sprintf("netns %d", l.NetnsIno)
+	case LinkTypeXdp, LinkTypeTcx, LinkTypeNetkit:
+		return fmt.Sprintf("ifindex %d", l.Ifindex)
+	case LinkTypeStructOps:
+		return fmt.Sprintf("map %d", l.MapId)
+	}
+
+	return ""
+}
+
+// struct bpf_link_info, union of type specific fields is kept raw
+type bpfLinkInfo struct {
+	linkType uint32
+	id       uint32
+	progId   uint32
+	_        uint32
+	data     [48]byte
+}
+
+// struct bpf_link_info of raw tracepoint / iterator links, with name buffer
+type bpfLinkInfoName struct {
+	linkType uint32
+	id       uint32
+	progId   uint32
+	_        uint32
+	name     bpfPointer
+	nameLen  uint32
+	_        [36]byte
+}
+
+// Decodes type specific part of struct bpf_link_info
+func newLinkInfo(fd int, raw *bpfLinkInfo) *LinkInfo {
+	info := &LinkInfo{
+		Type:      LinkType(raw.linkType),
+		Id:        int(raw.id),
+		Fd:        fd,
+		ProgramId: int(raw.progId),
+	}
+	data := raw.data[:]
+	switch info.Type {
+	case LinkTypeTracing:
+		info.AttachType = int(hostByteOrder.Uint32(data))
+		info.TargetObjId = int(hostByteOrder.Uint32(data[4:]))
+		info.TargetBtfId = int(hostByteOrder.Uint32(data[8:]))
+	case LinkTypeCgroup:
+		info.CgroupId = hostByteOrder.Uint64(data)
+		info.AttachType = int(hostByteOrder.Uint32(data[8:]))
+	case LinkTypeNetns:
+		info.NetnsIno = uint64(hostByteOrder.Uint32(data))
+		info.AttachType = int(hostByteOrder.Uint32(data[4:]))
+	case LinkTypeXdp:
+		info.Ifindex = int(hostByteOrder.Uint32(data))
+	case LinkTypeTcx, LinkTypeNetkit:
+		info.Ifindex = int(hostByteOrder.Uint32(data))
+		info.AttachType = int(hostByteOrder.Uint32(data[4:]))
+	case LinkTypeStructOps:
+		info.MapId = int(hostByteOrder.Uint32(data))
+	}
+
+	return info
+}
+
+// GetLinkInfoByFd queries information about BPF link by fd
+// (fd belongs to local process, cannot be shared)
+func GetLinkInfoByFd(fd int) (*LinkInfo, error) {
+	var raw bpfLinkInfo
+	if err := ebpfObjGetInfo(fd, unsafe.Pointer(&raw), unsafe.Sizeof(raw)); err != nil {
+		return nil, newSyscallError("ebpf_obj_get_info_by_fd()", err, nil)
+	}
+	info := newLinkInfo(fd, &raw)
+
+	// Name is read by second call: buffer pointer is interpreted by kernel
+	// differently depending on link type, which is not known in advance
+	if info.Type == LinkTypeRawTracepoint || info.Type == LinkTypeIter {
+		nameLen := hostByteOrder.Uint32(raw.data[8:])
+		if nameLen > 0 {
+			buf := make([]byte, nameLen)
+			named := bpfLinkInfoName{
+				name:    newBpfPointer(unsafe.Pointer(&buf[0])),
+				nameLen: nameLen,
+			}
+			if err := ebpfObjGetInfo(fd, unsafe.Pointer(&named), unsafe.Sizeof(named)); err != nil {
+				return nil, newSyscallError("ebpf_obj_get_info_by_fd()", err, nil)
+			}
+			info.TargetName = NullTerminatedStringToString(buf)
+		}
+	}
+
+	return info, nil
+}
+
+// GetLinkInfoById queries information about BPF link by external ID
+func GetLinkInfoById(id int) (*LinkInfo, error) {
+	fd, err := ebpfGetFdById(bpfCmdLinkGetFdById, "ebpf_link_get_fd_by_id()", id)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetLinkInfoByFd(fd)
+}
+
+// GetNextLinkId returns ID of BPF link which follows startId, see GetNextProgramId()
+func GetNextLinkId(startId int) (int, error) {
+	return ebpfGetNextId(bpfCmdLinkGetNextId, "ebpf_link_get_next_id()", startId)
+}
+
+// BtfInfo - information of BTF object: vmlinux / kernel module BTF or
+// one loaded along with programs / maps
+type BtfInfo struct {
+	Id   int // ID - external ID of BTF object, see ProgramInfo.BtfId
+	Fd   int // fd - local process fd to be able to access the object.
+	Size int // Size of raw BTF data
+	// Name of vmlinux / kernel module BTF, empty for loaded ones (linux 5.11+)
+	Name   string
+	Kernel bool // BTF of kernel / kernel module (linux 5.11+)
+}
+
+// struct bpf_btf_info
+type bpfBtfInfo struct {
+	btf       uint64
+	btfSize   uint32
+	id        uint32
+	name      bpfPointer
+	nameLen   uint32
+	kernelBtf uint32
+}
+
+// GetBtfInfoByFd queries information about BTF object by fd
+// (fd belongs to local process, cannot be shared)
+func GetBtfInfoByFd(fd int) (*BtfInfo, error) {
+	var name [btfNameLen]byte
+	raw := bpfBtfInfo{
+		name:    newBpfPointer(unsafe.Pointer(&name[0])),
+		nameLen: btfNameLen,
+	}
+	err := ebpfObjGetInfo(fd, unsafe.Pointer(&raw), unsafe.Sizeof(raw))
+	if err == syscall.E2BIG {
+		// Kernel without name / kernel_btf fields (before 5.11)
+		raw = bpfBtfInfo{}
+		err = ebpfObjGetInfo(fd, unsafe.Pointer(&raw), unsafe.Offsetof(raw.name))
+	}
+	// Names longer than buffer are truncated
+	if err != nil && err != syscall.ENOSPC {
+		return nil, newSyscallError("ebpf_obj_get_info_by_fd()", err, nil)
+	}
+
+	return &BtfInfo{
+		Id:     int(raw.id),
+		Fd:     fd,
+		Size:   int(raw.btfSize),
+		Name:   NullTerminatedStringToString(name[:]),
+		Kernel: raw.kernelBtf != 0,
+	}, nil
+}
+
+// GetBtfInfoById queries information about BTF object by external ID
+func GetBtfInfoById(id int) (*BtfInfo, error) {
+	fd, err := ebpfGetFdById(bpfCmdBtfGetFdById, "ebpf_btf_get_fd_by_id()", id)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetBtfInfoByFd(fd)
+}
+
+// GetNextBtfId returns ID of BTF object which follows startId, see GetNextProgramId()
+func GetNextBtfId(startId int) (int, error) {
+	return ebpfGetNextId(bpfCmdBtfGetNextId, "ebpf_btf_get_next_id()", startId)
+}
@@ -0,0 +1,59 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLinkInfoDecode(t *testing.T) {
+	// Layout of struct bpf_link_info
+	assert.Equal(t, uintptr(64), unsafe.Sizeof(bpfLinkInfo{}))
+	assert.Equal(t, unsafe.Sizeof(bpfLinkInfo{}), unsafe.Sizeof(bpfLinkInfoName{}))
+	assert.Equal(t, uintptr(32), unsafe.Sizeof(bpfBtfInfo{}))
+
+	raw := &bpfLinkInfo{linkType: uint32(LinkTypeCgroup), id: 7, progId: 12}
+	hostByteOrder.PutUint64(raw.data[:], 1234)
+	hostByteOrder.PutUint32(raw.data[8:], 2)
+	info := newLinkInfo(5, raw)
+	assert.Equal(t, &LinkInfo{Type: LinkTypeCgroup, Id: 7, Fd: 5, ProgramId: 12, CgroupId: 1234, AttachType: 2}, info)
+	assert.Equal(t, "cgroup 1234", info.Target())
+
+	raw = &bpfLinkInfo{linkType: uint32(LinkTypeTcx)}
+	hostByteOrder.PutUint32(raw.data[:], 3)
+	hostByteOrder.PutUint32(raw.data[4:], 46)
+	info = newLinkInfo(5, raw)
+	assert.Equal(t, 3, info.Ifindex)
+	assert.Equal(t, 46, info.AttachType)
+	assert.Equal(t, "ifindex 3", info.Target())
+
+	raw = &bpfLinkInfo{linkType: uint32(LinkTypeTracing)}
+	hostByteOrder.PutUint32(raw.data[4:], 0)
+	hostByteOrder.PutUint32(raw.data[8:], 100)
+	info = newLinkInfo(5, raw)
+	assert.Equal(t, 100, info.TargetBtfId)
+	assert.Equal(t, "obj 0 btf 100", info.Target())
+
+	info = &LinkInfo{Type: LinkTypeRawTracepoint, TargetName: "sys_enter"}
+	assert.Equal(t, "sys_enter", info.Target())
+	assert.Equal(t, "", (&LinkInfo{Type: LinkTypePerfEvent}).Target())
+}
+
+func TestLinkTypeString(t *testing.T) {
+	assert.Equal(t, "Netns", LinkTypeNetns.String())
+	assert.Equal(t, "TCX", LinkTypeTcx.String())
+	assert.Equal(t, "Unspecified", LinkType(100).String())
+}
+
+func TestLinkFilter(t *testing.T) {
+	info := &LinkInfo{Type: LinkTypeXdp, ProgramId: 10, Ifindex: 2}
+	assert.True(t, LinkFilter{}.match(info))
+	assert.True(t, LinkFilter{Type: LinkTypeXdp, ProgramId: 10, Ifindex: 2}.match(info))
+	assert.False(t, LinkFilter{Type: LinkTypeTcx}.match(info))
+	assert.False(t, LinkFilter{ProgramId: 11}.match(info))
+	assert.False(t, LinkFilter{Ifindex: 3}.match(info))
+}
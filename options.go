@@ -0,0 +1,248 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/dropbox/goebpf/goebpf_btf"
+)
+
+const (
+	// DefaultBpffsRoot is conventional mount point of bpffs
+	DefaultBpffsRoot = "/sys/fs/bpf"
+	// DefaultBtfPath is location of running kernel's BTF
+	DefaultBtfPath = goebpf_btf.VmlinuxPath
+)
+
+// KernelFeatures describes properties of target kernel which are
+// detected at runtime unless overridden by WithKernelFeatures()
+type KernelFeatures struct {
+	// Kernel version in KERNEL_VERSION(a, b, c) format, passed to kernel
+	// on program load (kprobe programs require it to match running kernel).
+	// Zero means detect from running kernel.
+	Version int
+}
+
+// Option configures eBPF system created by NewDefaultEbpfSystem()
+type Option func(*ebpfSystem)
+
+// WithLogger sets destination for debug messages, the same as SetLogger()
+func WithLogger(l Logger) Option {
+	return func(s *ebpfSystem) {
+		if l == nil {
+			l = nopLogger{}
+		}
+		s.logger = l
+	}
+}
+
+// WithOffload makes all maps and programs read by LoadElf() to be offloaded
+// into network device (SmartNIC) ifname, see NewOffloadEbpfSystem()
+func WithOffload(ifname string) Option {
+	return func(s *ebpfSystem) {
+		s.offloadIfname = ifname
+	}
+}
+
+// WithBpffsRoot sets location of bpffs used for persistent maps.
+// Relative persistent paths from ELF are resolved against root (DefaultBpffsRoot
+// by default), absolute ones inside of DefaultBpffsRoot are moved to root.
+// Useful when bpffs is mounted elsewhere, e.g. in containers / tests.
+func WithBpffsRoot(root string) Option {
+	return func(s *ebpfSystem) {
+		s.bpffsRoot = root
+	}
+}
+
+// WithBtfPath sets location of kernel BTF (DefaultBtfPath by default) LSM / tracing
+// programs and kernel function calls are resolved in, e.g. BTF of kernel built without
+// CONFIG_DEBUG_INFO_BTF generated by pahole. BTF of kernel modules is always read from
+// running kernel.
+func WithBtfPath(path string) Option {
+	return func(s *ebpfSystem) {
+		s.btfPath = path
+	}
+}
+
+// WithPinPathTemplate changes location of all persistent maps (ones with PersistentPath
+// defined in ELF) to template, where "{map}" is replaced by map name. Relative result is
+// resolved against bpffs root (see WithBpffsRoot()), missing directories are created.
+// This way multiple instances of the same ELF file can coexist without pin collisions:
+//
+//	// Maps pinned as /sys/fs/bpf/<app>/<map>
+//	bpf := goebpf.NewDefaultEbpfSystem(goebpf.WithPinPathTemplate(app + "/{map}"))
+func WithPinPathTemplate(template string) Option {
+	return func(s *ebpfSystem) {
+		s.pinPathTemplate = template
+	}
+}
+
+// WithMapMaxEntries overrides max_entries of map defined in ELF file,
+// so map sizes can be tuned at runtime without recompiling program
+func WithMapMaxEntries(name string, maxEntries int) Option {
+	return func(s *ebpfSystem) {
+		s.mapMaxEntries[name] = maxEntries
+	}
+}
+
+// WithMapPinPolicy sets policy for persistent maps already pinned by someone else,
+// see MapPinPolicy. Without names policy applies to all maps from ELF.
+// Map with relative PersistentPath (e.g. just map name) is pinned into bpffs root
+// (see WithBpffsRoot()), so MapPinReuse gives the same semantics as LIBBPF_PIN_BY_NAME of libbpf.
+func WithMapPinPolicy(policy MapPinPolicy, names ...string) Option {
+	return func(s *ebpfSystem) {
+		if len(names) == 0 {
+			s.mapPinPolicy = policy
+		}
+		for _, name := range names {
+			s.mapPinPolicies[name] = policy
+		}
+	}
+}
+
+// WithMapMigration sets MapPinMigrate policy for persistent map name: when map
+// pinned by previous version of application has other definition or key / value
+// layout, entries are converted by migrate into newly created map, which then
+// replaces pinned one. Nil migrate copies entries as is, which works for changes
+// keeping key / value sizes (e.g. MaxEntries). See map_migrate.go.
+func WithMapMigration(name string, migrate MapMigrateFunc) Option {
+	return func(s *ebpfSystem) {
+		s.mapPinPolicies[name] = MapPinMigrate
+		if migrate != nil {
+			s.mapMigrations[name] = migrate
+		}
+	}
+}
+
+// WithVerifierLogLevel sets verifier log level programs from ELF are loaded
+// with, see BaseProgram.SetVerifierLogLevel(). Without names level applies to all programs.
+func WithVerifierLogLevel(level VerifierLogLevel, names ...string) Option {
+	return func(s *ebpfSystem) {
+		if len(names) == 0 {
+			s.verifierLogLevel = level
+		}
+		for _, name := range names {
+			s.verifierLogLevels[name] = level
+		}
+	}
+}
+
+// WithLoadParallelism sets how many programs Reload() loads into kernel
+// concurrently, see LoadPrograms(). Programs are loaded one by one by default.
+func WithLoadParallelism(n int) Option {
+	return func(s *ebpfSystem) {
+		s.loadParallelism = n
+	}
+}
+
+// WithProgramFilter makes LoadElf() to read only programs for which filter returns true.
+// Maps not used by selected programs are not created, unless selected by WithMapFilter().
+// Useful for ELF files shared by multiple tools:
+//
+//	bpf := goebpf.NewDefaultEbpfSystem(goebpf.WithPrograms("xdp_firewall"))
+func WithProgramFilter(filter func(name string) bool) Option {
+	return func(s *ebpfSystem) {
+		s.programFilter = filter
+	}
+}
+
+// WithPrograms is WithProgramFilter() selecting programs by name
+func WithPrograms(names ...string) Option {
+	return WithProgramFilter(nameFilter(names))
+}
+
+// WithMapFilter makes LoadElf() to create maps for which filter returns true even if they are
+// not used by any program (e.g. maps used only by userspace). Maps used by programs are always created.
+// Setting filter enables selective loading: other, not used maps are not created.
+func WithMapFilter(filter func(name string) bool) Option {
+	return func(s *ebpfSystem) {
+		s.mapFilter = filter
+	}
+}
+
+// WithMaps is WithMapFilter() selecting maps by name
+func WithMaps(names ...string) Option {
+	return WithMapFilter(nameFilter(names))
+}
+
+// Creates filter matching given names only
+func nameFilter(names []string) func(name string) bool {
+	set := make(map[string]bool, len(names))
+	for _, name := range names {
+		set[name] = true
+	}
+	return func(name string) bool {
+		return set[name]
+	}
+}
+
+// WithAutoload makes LoadElf() to load all programs into kernel right away
+// (concurrently, see WithLoadParallelism()), so explicit Load() is not needed.
+// Programs from sections marked by "?" prefix, e.g. SEC("?xdp"), are load on demand:
+// they are never autoloaded and must be loaded by GetProgramByName(name).Load().
+func WithAutoload() Option {
+	return func(s *ebpfSystem) {
+		s.autoload = true
+	}
+}
+
+// WithAutoloadFilter makes LoadElf() to load into kernel programs for which filter
+// returns true, overriding both WithAutoload() and load on demand marks from ELF
+func WithAutoloadFilter(filter func(name string) bool) Option {
+	return func(s *ebpfSystem) {
+		s.autoloadFilter = filter
+	}
+}
+
+// WithToken makes LoadElf() to create all maps / programs using BPF token,
+// so they can be loaded by unprivileged process (e.g. in container), see NewToken().
+// Token fd is used as is, not duplicated: token must stay open as long as system may
+// create maps / load programs, i.e. not only during LoadElf() / Reload(), but also for
+// Load() of programs loaded on demand (see WithAutoload()). Simplest is to close token
+// after system is closed.
+func WithToken(token *Token) Option {
+	return func(s *ebpfSystem) {
+		s.tokenFd = token.Fd()
+	}
+}
+
+// WithKernelFeatures overrides runtime detected properties of kernel
+func WithKernelFeatures(features KernelFeatures) Option {
+	return func(s *ebpfSystem) {
+		s.features = features
+	}
+}
+
+// WithParseOnly makes LoadElf() to only read / validate ELF file
+// without creating any kernel objects (maps will have no fd assigned,
+// programs can't be loaded). Does not require any privileges.
+func WithParseOnly() Option {
+	return func(s *ebpfSystem) {
+		s.parseOnly = true
+	}
+}
+
+// Applies pin path template (if any) to persistent map, see WithPinPathTemplate()
+func (s *ebpfSystem) templatePersistentPath(name, path string) string {
+	if path == "" || s.pinPathTemplate == "" {
+		return path
+	}
+	return strings.Replace(s.pinPathTemplate, "{map}", name, -1)
+}
+
+// Resolves persistent path of map defined in ELF against bpffs root
+func (s *ebpfSystem) resolvePersistentPath(path string) string {
+	if path == "" || s.bpffsRoot == "" {
+		return path
+	}
+	if !filepath.IsAbs(path) {
+		return filepath.Join(s.bpffsRoot, path)
+	}
+	if path == DefaultBpffsRoot || strings.HasPrefix(path, DefaultBpffsRoot+"/") {
+		return filepath.Join(s.bpffsRoot, strings.TrimPrefix(path, DefaultBpffsRoot))
+	}
+	return path
+}
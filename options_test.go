@@ -0,0 +1,147 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOptions(t *testing.T) {
+	// Defaults
+	s := NewDefaultEbpfSystem().(*ebpfSystem)
+	assert.Equal(t, nopLogger{}, s.logger)
+	assert.Equal(t, DefaultBtfPath, s.btfPath)
+	assert.False(t, s.parseOnly)
+	assert.Equal(t, DefaultBpffsRoot, s.bpffsRoot)
+	assert.Equal(t, MapPinReuse, s.mapPinPolicy)
+	assert.Equal(t, 1, s.loadParallelism)
+	assert.Equal(t, VerifierLogOnFailure, s.verifierLogLevel)
+
+	logger := log.New(os.Stderr, "", 0)
+	s = NewDefaultEbpfSystem(
+		WithLogger(logger),
+		WithBpffsRoot("/tmp/bpffs"),
+		WithBtfPath("/tmp/vmlinux"),
+		WithMapMaxEntries("map1", 100),
+		WithMapMaxEntries("map2", 200),
+		WithKernelFeatures(KernelFeatures{Version: 0x050400}),
+		WithParseOnly(),
+		WithMapPinPolicy(MapPinExclusive),
+		WithMapPinPolicy(MapPinReplace, "map1"),
+		WithMapMigration("map2", nil),
+		WithLoadParallelism(8),
+		WithVerifierLogLevel(VerifierLogStats),
+		WithVerifierLogLevel(VerifierLogBasic|VerifierLogStats, "prog1"),
+	).(*ebpfSystem)
+	assert.Equal(t, logger, s.logger)
+	assert.Equal(t, "/tmp/bpffs", s.bpffsRoot)
+	assert.Equal(t, "/tmp/vmlinux", s.btfPath)
+	assert.Equal(t, map[string]int{"map1": 100, "map2": 200}, s.mapMaxEntries)
+	assert.Equal(t, 0x050400, s.features.Version)
+	assert.True(t, s.parseOnly)
+	assert.Equal(t, MapPinExclusive, s.mapPinPolicy)
+	assert.Equal(t, map[string]MapPinPolicy{"map1": MapPinReplace, "map2": MapPinMigrate}, s.mapPinPolicies)
+	assert.Empty(t, s.mapMigrations)
+	assert.Equal(t, 8, s.loadParallelism)
+	assert.Equal(t, VerifierLogStats, s.verifierLogLevel)
+	assert.Equal(t, map[string]VerifierLogLevel{"prog1": VerifierLogBasic | VerifierLogStats}, s.verifierLogLevels)
+
+	s = NewOffloadEbpfSystem("eth0", WithLogger(nil)).(*ebpfSystem)
+	assert.Equal(t, "eth0", s.offloadIfname)
+	assert.Equal(t, nopLogger{}, s.logger)
+}
+
+func TestSelectiveLoadOptions(t *testing.T) {
+	s := NewDefaultEbpfSystem().(*ebpfSystem)
+	assert.True(t, s.programSelected("any"))
+	assert.Nil(t, s.mapFilter)
+
+	s = NewDefaultEbpfSystem(WithPrograms("prog1", "prog2"), WithMaps("map1")).(*ebpfSystem)
+	assert.True(t, s.programSelected("prog1"))
+	assert.True(t, s.programSelected("prog2"))
+	assert.False(t, s.programSelected("prog3"))
+	assert.True(t, s.mapFilter("map1"))
+	assert.False(t, s.mapFilter("map2"))
+}
+
+func TestAutoloadOptions(t *testing.T) {
+	eager := &xdpProgram{BaseProgram: BaseProgram{name: "eager"}}
+	lazy := &xdpProgram{BaseProgram: BaseProgram{name: "lazy", onDemand: true}}
+
+	s := NewDefaultEbpfSystem().(*ebpfSystem)
+	assert.False(t, s.autoloadSelected(eager))
+	assert.False(t, s.autoloadSelected(lazy))
+
+	s = NewDefaultEbpfSystem(WithAutoload()).(*ebpfSystem)
+	assert.True(t, s.autoloadSelected(eager))
+	assert.False(t, s.autoloadSelected(lazy))
+
+	// Filter overrides marks from ELF
+	s = NewDefaultEbpfSystem(WithAutoload(), WithAutoloadFilter(func(name string) bool {
+		return name == "lazy"
+	})).(*ebpfSystem)
+	assert.False(t, s.autoloadSelected(eager))
+	assert.True(t, s.autoloadSelected(lazy))
+}
+
+func TestResolvePersistentPath(t *testing.T) {
+	s := NewDefaultEbpfSystem().(*ebpfSystem)
+	// Default root - only relative paths are changed
+	assert.Equal(t, "", s.resolvePersistentPath(""))
+	assert.Equal(t, "/sys/fs/bpf/map1", s.resolvePersistentPath("/sys/fs/bpf/map1"))
+	assert.Equal(t, "/sys/fs/bpf/map1", s.resolvePersistentPath("map1"))
+	assert.Equal(t, "/tmp/map1", s.resolvePersistentPath("/tmp/map1"))
+
+	s = NewDefaultEbpfSystem(WithBpffsRoot("/run/bpf")).(*ebpfSystem)
+	assert.Equal(t, "", s.resolvePersistentPath(""))
+	assert.Equal(t, "/run/bpf/map1", s.resolvePersistentPath("/sys/fs/bpf/map1"))
+	assert.Equal(t, "/run/bpf/app/map1", s.resolvePersistentPath("app/map1"))
+	assert.Equal(t, "/sys/fs/bpfother/map1", s.resolvePersistentPath("/sys/fs/bpfother/map1"))
+	assert.Equal(t, "/tmp/map1", s.resolvePersistentPath("/tmp/map1"))
+}
+
+func TestPinPathTemplate(t *testing.T) {
+	s := NewDefaultEbpfSystem().(*ebpfSystem)
+	assert.Equal(t, "map1", s.templatePersistentPath("map1", "map1"))
+	assert.Equal(t, "/tmp/map1", s.templatePersistentPath("map1", "/tmp/map1"))
+
+	s = NewDefaultEbpfSystem(WithPinPathTemplate("app1/{map}")).(*ebpfSystem)
+	// Non persistent maps are not affected
+	assert.Equal(t, "", s.templatePersistentPath("map1", ""))
+	assert.Equal(t, "/sys/fs/bpf/app1/map1",
+		s.resolvePersistentPath(s.templatePersistentPath("map1", "/sys/fs/bpf/shared")))
+
+	s = NewDefaultEbpfSystem(WithPinPathTemplate("/run/{map}/{map}.pin")).(*ebpfSystem)
+	assert.Equal(t, "/run/map1/map1.pin",
+		s.resolvePersistentPath(s.templatePersistentPath("map1", "map1")))
+}
+
+func TestWithBtfPath(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "vmlinux")
+	require.NoError(t, os.WriteFile(path, buildTestMapBtf(), 0644))
+
+	// Programs resolve kernel functions in BTF of system
+	s := NewDefaultEbpfSystem(WithBtfPath(path), WithParseOnly()).(*ebpfSystem)
+	_, err := s.parseElfData(buildTestElf())
+	require.NoError(t, err)
+	require.Len(t, s.Programs, 1)
+	assert.Equal(t, path, s.Programs["xdp_prog"].(baseProgramAccessor).base().btfPath)
+
+	_, err = findKernelFunc(path, "vmlinux:bpf_lsm_file_open")
+	var notFound *SymbolNotFoundError
+	assert.True(t, errors.As(err, &notFound))
+
+	// Missing BTF
+	_, err = lsmHookBtfID(filepath.Join(dir, "missing"), "file_open")
+	assert.True(t, errors.Is(err, ErrNotSupported))
+	assert.Contains(t, err.Error(), filepath.Join(dir, "missing"))
+}
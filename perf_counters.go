@@ -0,0 +1,152 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/dropbox/goebpf/goebpf_perf"
+)
+
+// PerfCounters is counter (e.g. CPU cycles, cache misses) opened on every CPU
+// and stored into perf event array map by CPU number, so programs read
+// counter of CPU they are running on:
+//
+//	struct bpf_map_def SEC("maps") cycles = {
+//		.type = BPF_MAP_TYPE_PERF_EVENT_ARRAY,
+//		.key_size = sizeof(__u32),
+//		.value_size = sizeof(__u32),
+//		.max_entries = 0,	// number of possible CPUs
+//	};
+//	...
+//	struct bpf_perf_event_value v;
+//	bpf_perf_event_read_value(&cycles, BPF_F_CURRENT_CPU, &v, sizeof(v));
+//
+// Go side:
+//
+//	c, err := goebpf.NewPerfCounters(cycles, goebpf_perf.Attr{
+//		Type:   goebpf_perf.TypeHardware,
+//		Config: goebpf_perf.CountHwCPUCycles,
+//	})
+//
+// Counters keep counting until Close().
+type PerfCounters struct {
+	mu     sync.Mutex
+	m      *EbpfMap
+	events map[int]*goebpf_perf.Event
+}
+
+// NewPerfCounters opens counter described by attr on every CPU of cpus
+// (all online CPUs by default) and puts it into perf event array m.
+// Counters are system wide (count all processes of CPU).
+func NewPerfCounters(m *EbpfMap, attr goebpf_perf.Attr, cpus ...int) (*PerfCounters, error) {
+	if m.Type != MapTypePerfEventArray {
+		return nil, fmt.Errorf("Map '%s' (%v) is not perf event array", m.Name, m.Type)
+	}
+	if m.GetFd() == 0 {
+		return nil, fmt.Errorf("Map '%s' is not created", m.Name)
+	}
+	if attr.SamplePeriod != 0 || attr.SampleFrequency != 0 || attr.Inherit {
+		return nil, errors.New("Counters must not sample / be inherited")
+	}
+	if len(cpus) == 0 {
+		var err error
+		if cpus, err = OnlineCPUs(); err != nil {
+			return nil, err
+		}
+	}
+	// Kernel does not allow bpf_perf_event_read_value() of disabled events
+	attr.Disabled = false
+	attr.ReadFormat |= goebpf_perf.ReadFormatTotalTimeEnabled | goebpf_perf.ReadFormatTotalTimeRunning
+
+	c := &PerfCounters{
+		m:      m,
+		events: make(map[int]*goebpf_perf.Event),
+	}
+	for _, cpu := range cpus {
+		if cpu >= m.MaxEntries {
+			c.Close()
+			return nil, fmt.Errorf("CPU %d is out of map '%s' (%d entries)", cpu, m.Name, m.MaxEntries)
+		}
+		ev, err := goebpf_perf.Open(&attr, -1, cpu, nil)
+		if err != nil {
+			c.Close()
+			return nil, fmt.Errorf("perf_event_open() on CPU %d failed: %v", cpu, err)
+		}
+		c.events[cpu] = ev
+		if err = m.Upsert(uint32(cpu), uint32(ev.Fd())); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("Unable to put counter of CPU %d into '%s': %v", cpu, m.Name, err)
+		}
+	}
+
+	return c, nil
+}
+
+// CPUs returns list of CPUs counter is opened on
+func (c *PerfCounters) CPUs() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cpus := make([]int, 0, len(c.events))
+	for cpu := range c.events {
+		cpus = append(cpus, cpu)
+	}
+	sort.Ints(cpus)
+
+	return cpus
+}
+
+// Read returns counter of cpu, as bpf_perf_event_read_value() would
+func (c *PerfCounters) Read(cpu int) (goebpf_perf.Value, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ev, ok := c.events[cpu]
+	if !ok {
+		return goebpf_perf.Value{}, fmt.Errorf("No counter on CPU %d", cpu)
+	}
+
+	return ev.ReadValue()
+}
+
+// Sum returns total of counters of all CPUs, scaled if counters are multiplexed
+func (c *PerfCounters) Sum() (uint64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var sum uint64
+	for cpu, ev := range c.events {
+		v, err := ev.ReadValue()
+		if err != nil {
+			return 0, fmt.Errorf("Unable to read counter of CPU %d: %v", cpu, err)
+		}
+		sum += v.Scaled()
+	}
+
+	return sum, nil
+}
+
+// Close removes counters from map and closes them
+func (c *PerfCounters) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var firstErr error
+	for cpu, ev := range c.events {
+		// Map holds reference to event, so it keeps counting until removed
+		if err := c.m.Delete(uint32(cpu)); err != nil && !errors.Is(err, ErrKeyNotExist) && firstErr == nil {
+			firstErr = err
+		}
+		if err := ev.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	c.events = make(map[int]*goebpf_perf.Event)
+
+	return firstErr
+}
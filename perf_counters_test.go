@@ -0,0 +1,35 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/dropbox/goebpf/goebpf_perf"
+)
+
+func TestNewPerfCountersNegative(t *testing.T) {
+	attr := goebpf_perf.Attr{Type: goebpf_perf.TypeSoftware, Config: goebpf_perf.CountSwCPUClock}
+
+	_, err := NewPerfCounters(&EbpfMap{Name: "arr", Type: MapTypeArray}, attr)
+	assert.Error(t, err)
+	// Not created
+	m := &EbpfMap{Name: "counters", Type: MapTypePerfEventArray, KeySize: 4, ValueSize: 4, MaxEntries: 4}
+	_, err = NewPerfCounters(m, attr)
+	assert.Error(t, err)
+	m.fd = 100
+	attr.SamplePeriod = 1000
+	_, err = NewPerfCounters(m, attr)
+	assert.Error(t, err)
+	attr.SamplePeriod = 0
+	attr.Inherit = true
+	_, err = NewPerfCounters(m, attr)
+	assert.Error(t, err)
+	// CPU out of map
+	attr.Inherit = false
+	_, err = NewPerfCounters(m, attr, 4)
+	assert.Error(t, err)
+}
@@ -0,0 +1,124 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"sort"
+	"syscall"
+)
+
+// Name of map keeping state of ProgArray, see ProgArrayState
+const progArrayStateMapName = "goebpf_pa_state"
+
+// ProgArrayState records which tail call programs (by name) are installed at which
+// index of ProgArray map. State is kept in map pinned next to pinned ProgArray,
+// so after restart of application ProgArray can be reconciled: entries are replaced
+// by new programs in place and only entries not used anymore are removed,
+// instead of clearing / repopulating whole array (when tail calls fail).
+//
+//	state, err := goebpf.NewProgArrayState(progArray, "/sys/fs/bpf/programs_state")
+//	err = state.Reconcile(map[int]goebpf.Program{
+//		0: bpf.GetProgramByName("parse_ipv4"),
+//		1: bpf.GetProgramByName("parse_ipv6"),
+//	})
+type ProgArrayState struct {
+	progArray *EbpfMap
+	state     *EbpfMap
+}
+
+// NewProgArrayState opens state of progArray pinned at path, creating it if needed
+func NewProgArrayState(progArray *EbpfMap, path string) (*ProgArrayState, error) {
+	if progArray.Type != MapTypeProgArray {
+		return nil, fmt.Errorf("Map '%s' is %v, not ProgArray", progArray.Name, progArray.Type)
+	}
+	state := &EbpfMap{
+		Name:           progArrayStateMapName,
+		Type:           MapTypeHash,
+		KeySize:        4,
+		ValueSize:      bpfObjNameLen,
+		MaxEntries:     progArray.MaxEntries,
+		PersistentPath: path,
+		PinPolicy:      MapPinReuse,
+	}
+	if err := state.Create(); err != nil {
+		return nil, fmt.Errorf("Unable to open state of ProgArray '%s': %v", progArray.Name, err)
+	}
+
+	return &ProgArrayState{
+		progArray: progArray,
+		state:     state,
+	}, nil
+}
+
+// Installed returns names of programs installed into ProgArray by index
+// as recorded by previous Reconcile() calls. Names are kernel names (see
+// KernelObjectName()), so they fit into state map values.
+func (s *ProgArrayState) Installed() (map[int]string, error) {
+	res := make(map[int]string)
+	key, err := s.state.GetNextKey(nil)
+	for ; err == nil; key, err = s.state.GetNextKey(key) {
+		name, err := s.state.LookupString(key)
+		if err != nil {
+			return nil, err
+		}
+		res[int(hostByteOrder.Uint32(key))] = name
+	}
+	if err != ErrNoMoreKeys {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// Reconcile makes ProgArray to contain exactly given programs (by index).
+// Entries are replaced atomically, so tail calls keep working during update;
+// entries installed before but not present in programs are removed afterwards.
+// State is updated after every change, so interrupted Reconcile() can be re-tried.
+func (s *ProgArrayState) Reconcile(programs map[int]Program) error {
+	installed, err := s.Installed()
+	if err != nil {
+		return err
+	}
+
+	indexes := make([]int, 0, len(programs))
+	for index := range programs {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+	for _, index := range indexes {
+		prog := programs[index]
+		if err := s.progArray.Upsert(uint32(index), uint32(prog.GetFd())); err != nil {
+			return fmt.Errorf("Unable to install program '%s' at index %d: %v", prog.GetName(), index, err)
+		}
+		if err := s.state.Upsert(uint32(index), KernelObjectName(prog.GetName())); err != nil {
+			return err
+		}
+	}
+
+	// Remove programs not used anymore
+	for index, name := range installed {
+		if _, ok := programs[index]; ok {
+			continue
+		}
+		err := s.progArray.Delete(uint32(index))
+		if serr, ok := err.(*SyscallError); ok && serr.Errno == syscall.ENOENT {
+			// Already removed by someone else
+			err = nil
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to remove program '%s' from index %d: %v", name, index, err)
+		}
+		if err := s.state.Delete(uint32(index)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Close closes state map, it stays pinned
+func (s *ProgArrayState) Close() error {
+	return s.state.Close()
+}
@@ -0,0 +1,17 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewProgArrayStateInvalid(t *testing.T) {
+	m := &EbpfMap{Name: "counters", Type: MapTypeHash, KeySize: 4, ValueSize: 4, MaxEntries: 4}
+	state, err := NewProgArrayState(m, "/sys/fs/bpf/counters_state")
+	assert.Error(t, err)
+	assert.Nil(t, state)
+}
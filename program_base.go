@@ -3,52 +3,10 @@
 
 package goebpf
 
-/*
-#include <string.h>
-#include <unistd.h>
-#include <errno.h>
-#include <stdlib.h>
-
-#include "bpf.h"
-#include "bpf_helpers.h"
-
-// Load eBPF program into kernel
-static int ebpf_prog_load(const char *name, __u32 prog_type, const void *insns, __u32 insns_cnt,
-	const char *license, __u32 kern_version, void *log_buf, size_t log_size)
-{
-	union bpf_attr attr = {};
-
-	// Try to load program without trace info - it takes too much memory
-	// for verifier to put all trace messages even for correct programs
-	// and may cause load error because of log buffer is too small.
-	attr.prog_type = prog_type;
-	attr.insn_cnt = insns_cnt;
-	attr.insns = ptr_to_u64(insns);
-	attr.license = ptr_to_u64(license);
-	attr.log_buf = ptr_to_u64(NULL);
-	attr.log_size = 0;
-	attr.log_level = 0;
-	attr.kern_version = kern_version;
-	// program name
-	strncpy((char*)&attr.prog_name, name, BPF_OBJ_NAME_LEN - 1);
-
-	int res = syscall(__NR_bpf, BPF_PROG_LOAD, &attr, sizeof(attr));
-	if (res == -1) {
-		// Try again with log
-		attr.log_buf = ptr_to_u64(log_buf);
-		attr.log_size = log_size;
-		attr.log_level = 1;
-		res = syscall(__NR_bpf, BPF_PROG_LOAD, &attr, sizeof(attr));
-	}
-
-	return res;
-}
-
-*/
-import "C"
 import (
-	"errors"
 	"fmt"
+	"sync"
+	"syscall"
 	"unsafe"
 )
 
@@ -71,6 +29,12 @@ const (
 	ProgramTypeLwtOut
 	ProgramTypeLwtXmit
 	ProgramTypeSockOps
+
+	// Only types supported by this library have Go names
+	ProgramTypeLwtSeg6Local ProgramType = 19
+	ProgramTypeTracing      ProgramType = 26
+	ProgramTypeLSM          ProgramType = 29
+	ProgramTypeSkLookup     ProgramType = 30
 )
 
 func (t ProgramType) String() string {
@@ -101,70 +65,211 @@ func (t ProgramType) String() string {
 		return "LWTxmit"
 	case ProgramTypeSockOps:
 		return "SockOps"
+	case ProgramTypeLwtSeg6Local:
+		return "LWTseg6local"
+	case ProgramTypeTracing:
+		return "Tracing"
+	case ProgramTypeLSM:
+		return "LSM"
+	case ProgramTypeSkLookup:
+		return "SkLookup"
 	}
 
 	return "Unknown"
 }
 
-// BaseProgram is common shared fields of eBPF programs
+// VerifierLogLevel is verbosity of verifier log of program load,
+// flags of BPF_PROG_LOAD log_level. Levels can be combined with VerifierLogStats.
+type VerifierLogLevel uint32
+
+const (
+	// Log is requested only when program is rejected (default), so loads
+	// of correct programs are fast and don't spend memory on log
+	VerifierLogOnFailure VerifierLogLevel = 0
+	// BPF_LOG_LEVEL1: verifier decisions
+	VerifierLogBasic VerifierLogLevel = 1
+	// BPF_LOG_LEVEL2: state of every instruction, may take hundreds of megabytes
+	VerifierLogVerbose VerifierLogLevel = 2
+	// BPF_LOG_STATS: verification statistics (linux 5.2+)
+	VerifierLogStats VerifierLogLevel = 4
+)
+
+// BaseProgram is common shared fields of eBPF programs.
+// Programs are safe for concurrent use: Load / Close / Attach / Detach
+// are serialized, getters may be called from any goroutine at any time.
 type BaseProgram struct {
-	fd            int // File Descriptor
+	mu            sync.RWMutex // Guards fd and attach state of program types
+	fd            int          // File Descriptor
 	name          string
 	programType   ProgramType
 	license       string // License
 	bytecode      []byte // eBPF instructions (each instruction - 8 bytes)
 	kernelVersion int    // Kernel requires version to match running for "kprobe" programs
+	ifindex       int    // Hardware offload: network interface to load program on
+	logger        Logger // Destination for debug messages, set by loader
+	onDemand      bool   // Never autoloaded by LoadElf(), SEC("?name") in ELF
+	tokenFd       int    // BPF token to load program with, set by loader
+	btfPath       string // Kernel BTF to resolve kernel functions in, set by loader
+	// Attach point kernel verifies program against, e.g. LSM hook
+	expectedAttachType int
+	attachBtfID        int
+	attachBtfObjFd     int // BTF of kernel module attachBtfID belongs to
+	// Kernel modules of functions called by program (CallKernelFunc()),
+	// by index of module in instructions minus one
+	kfuncModules []string
+	// bpf_metadata_* variables of ELF, bound to program on load
+	metadata *programMetadata
+	// Verifier log level / log of the last load
+	logLevel    VerifierLogLevel
+	verifierLog string
+	// ID full name of loaded program is remembered by, see registerObjectName()
+	nameId uint32
 }
 
 // Load loads program into linux kernel
 func (prog *BaseProgram) Load() error {
-	// Sanity checks
-	if len(prog.name) >= C.BPF_OBJ_NAME_LEN {
-		return fmt.Errorf("Program name '%s' is too long", prog.name)
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+
+	if err := prog.validate(); err != nil {
+		return err
 	}
 
-	// Buffer for kernel's verified debug messages
-	var logBuf [logBufferSize]byte
-	// Program name / license
-	name := C.CString(prog.name)
-	defer C.free(unsafe.Pointer(name))
-	license := C.CString(prog.license)
-	defer C.free(unsafe.Pointer(license))
-
-	// Load eBPF program
-	res := int(C.ebpf_prog_load(
-		name,
-		C.__u32(prog.GetType()),
-		unsafe.Pointer(&prog.bytecode[0]),
-		C.__u32(prog.GetSize())/bpfInstructionLen,
-		license,
-		C.__u32(prog.kernelVersion),
-		unsafe.Pointer(&logBuf[0]),
-		C.size_t(unsafe.Sizeof(logBuf))))
-	if res == -1 {
-		return fmt.Errorf("ebpf_prog_load() failed: %s",
-			NullTerminatedStringToString(logBuf[:]))
+	attr := bpfProgLoadAttr{
+		progType:    uint32(prog.programType),
+		insnCnt:     uint32(len(prog.bytecode) / bpfInstructionLen),
+		insns:       newBpfPointer(unsafe.Pointer(&prog.bytecode[0])),
+		license:     newBpfPointer(cString(prog.license)),
+		kernVersion: uint32(prog.kernelVersion),
+		progName:    objName(KernelObjectName(prog.name)),
+		// Hardware offload: ifindex of device to prepare program for
+		progIfindex:        uint32(prog.ifindex),
+		expectedAttachType: uint32(prog.expectedAttachType),
+		attachBtfID:        uint32(prog.attachBtfID),
+		attachBtfObjFd:     uint32(prog.attachBtfObjFd),
+	}
+	if len(prog.kfuncModules) > 0 {
+		// Calls of module functions refer module BTF by index in fd_array
+		fds, err := kernelModulesBtfFds(prog.kfuncModules)
+		if err != nil {
+			return err
+		}
+		defer closeBtfFds(fds)
+		attr.fdArray = newBpfPointer(unsafe.Pointer(&fds[0]))
+	}
+	if prog.tokenFd != 0 {
+		attr.progFlags |= bpfFTokenFd
+		attr.progTokenFd = int32(prog.tokenFd)
+	}
+	var res int
+	var errno error
+	var logBuf []byte
+	if prog.logLevel == VerifierLogOnFailure {
+		// Try to load program without trace info - it takes too much memory
+		// for verifier to put all trace messages even for correct programs
+		// and may cause load error because of log buffer is too small.
+		res, errno = bpfSyscall(bpfCmdProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		if errno != nil {
+			// Try again with log
+			res, logBuf, errno = progLoadWithLog(&attr, bpfLogLevelVerifierInfo)
+		}
+	} else {
+		res, logBuf, errno = progLoadWithLog(&attr, uint32(prog.logLevel))
+	}
+	prog.verifierLog = NullTerminatedStringToString(logBuf)
+	if errno != nil {
+		metrics.Add(MetricProgramLoadFailures, 1)
+		prog.log().Printf("goebpf: program '%s' load failed: %v", prog.name, errno)
+		verifierLog := prog.verifierLog
+		// Some errors (e.g. offload device does not support program / mismatch)
+		// are reported before verifier even started, so log may be empty
+		if verifierLog == "" {
+			return newSyscallError("ebpf_prog_load()", errno, nil)
+		}
+		verr := &VerifierError{
+			Program: prog.name,
+			Ifindex: prog.ifindex,
+			Log:     verifierLog,
+		}
+		if e, ok := errno.(syscall.Errno); ok {
+			verr.Errno = e
+		}
+		return verr
 	}
 	prog.fd = res
+	prog.nameId = registerObjectName(objectNames.programs, prog.fd, prog.name)
+	metrics.Add(MetricProgramsLoaded, 1)
+	prog.log().Printf("goebpf: program '%s' loaded, fd %d", prog.name, prog.fd)
+	// Metadata is informational only, so program works without it
+	if prog.metadata != nil && prog.ifindex == 0 {
+		if err := prog.metadata.bind(prog); err != nil {
+			prog.log().Printf("goebpf: program '%s' metadata not bound: %v", prog.name, err)
+		}
+	}
+
+	return nil
+}
+
+// Loads program with verifier log of level, growing log buffer while log
+// does not fit (ENOSPC): to size reported by kernel (log_true_size, linux 6.4+)
+// or twice as large on older kernels
+func progLoadWithLog(attr *bpfProgLoadAttr, level uint32) (int, []byte, error) {
+	size := logBufferSize
+	for {
+		logBuf := make([]byte, size)
+		attr.logBuf = newBpfPointer(unsafe.Pointer(&logBuf[0]))
+		attr.logSize = uint32(size)
+		attr.logLevel = level
+		attr.logTrueSize = 0
+		res, err := bpfSyscall(bpfCmdProgLoad, unsafe.Pointer(attr), unsafe.Sizeof(*attr))
+		if err != syscall.ENOSPC || size >= maxLogBufferSize {
+			return res, logBuf, err
+		}
+		if attr.logTrueSize > uint32(size) {
+			size = int(attr.logTrueSize)
+		} else {
+			size *= 2
+		}
+		if size > maxLogBufferSize {
+			size = maxLogBufferSize
+		}
+	}
+}
+
+// Performs sanity checks of program, doesn't interact with kernel
+func (prog *BaseProgram) validate() error {
+	if len(prog.bytecode) == 0 || len(prog.bytecode)%bpfInstructionLen != 0 {
+		return fmt.Errorf("Program '%s' has invalid bytecode size %d", prog.name, len(prog.bytecode))
+	}
 
 	return nil
 }
 
-// Close unloads program from kernel
+// Close unloads program from kernel.
+// Closing already closed / not loaded program does nothing.
 func (prog *BaseProgram) Close() error {
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+
 	if prog.fd == 0 {
-		return errors.New("Already closed / not created")
+		return nil
 	}
 	err := closeFd(prog.fd)
 	if err != nil {
 		return err
 	}
 
+	unregisterObjectName(objectNames.programs, prog.nameId)
 	prog.fd = 0
+	prog.nameId = 0
 	return nil
 }
 
+// Pin saves program into given location of bpffs
 func (prog *BaseProgram) Pin(path string) error {
+	prog.mu.RLock()
+	defer prog.mu.RUnlock()
+
 	return ebpfObjPin(prog.fd, path)
 }
 
@@ -173,6 +278,11 @@ func (prog *BaseProgram) GetName() string {
 	return prog.name
 }
 
+// KernelName returns name of program as kept by kernel, see KernelObjectName()
+func (prog *BaseProgram) KernelName() string {
+	return KernelObjectName(prog.name)
+}
+
 // GetType returns program type
 func (prog *BaseProgram) GetType() ProgramType {
 	return prog.programType
@@ -180,6 +290,9 @@ func (prog *BaseProgram) GetType() ProgramType {
 
 // GetFd returns program's file description
 func (prog *BaseProgram) GetFd() int {
+	prog.mu.RLock()
+	defer prog.mu.RUnlock()
+
 	return prog.fd
 }
 
@@ -188,6 +301,43 @@ func (prog *BaseProgram) GetSize() int {
 	return len(prog.bytecode)
 }
 
+// Gives loader access to common fields of all program types
+func (prog *BaseProgram) base() *BaseProgram {
+	return prog
+}
+
+// Returns logger for debug messages, never nil
+func (prog *BaseProgram) log() Logger {
+	if prog.logger == nil {
+		return nopLogger{}
+	}
+	return prog.logger
+}
+
+// SetVerifierLogLevel sets verifier log level of subsequent loads, see
+// VerifierLog(). Programs read from ELF get level from WithVerifierLogLevel().
+func (prog *BaseProgram) SetVerifierLogLevel(level VerifierLogLevel) {
+	prog.mu.Lock()
+	defer prog.mu.Unlock()
+
+	prog.logLevel = level
+}
+
+// VerifierLog returns verifier log of the last load: with VerifierLogOnFailure
+// level it is empty unless load failed
+func (prog *BaseProgram) VerifierLog() string {
+	prog.mu.RLock()
+	defer prog.mu.RUnlock()
+
+	return prog.verifierLog
+}
+
+// GetIfindex returns index of network interface program is offloaded to
+// (zero for regular, non offloaded programs)
+func (prog *BaseProgram) GetIfindex() int {
+	return prog.ifindex
+}
+
 // GetLicense returns program's license
 func (prog *BaseProgram) GetLicense() string {
 	return prog.license
@@ -0,0 +1,69 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Must be in sync with enum bpf_attach_type / BPF_F_* attach flags from <linux/bpf.h>
+const (
+	bpfAttachTypeCgroupInetIngress = 0
+	bpfAttachTypeCgroupInetEgress  = 1
+	bpfAttachTypeCgroupSockOps     = 3
+	bpfFAllowMulti                 = 2
+)
+
+// Wrapper for BPF_PROG_ATTACH / BPF_PROG_DETACH of program to cgroup
+func cgroupProgAttach(cmd, cgroupFd, progFd, attachType int, flags uint32) error {
+	attr := bpfProgAttachAttr{
+		targetFd:    uint32(cgroupFd),
+		attachBpfFd: uint32(progFd),
+		attachType:  uint32(attachType),
+		attachFlags: flags,
+	}
+	_, err := bpfSyscall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// Attachment of program to cgroup v2, shared by cgroup program types.
+// Cgroup fd is kept open for detach.
+type cgroupAttachment struct {
+	path       string
+	fd         int
+	attachType int
+	attached   bool
+}
+
+// Attaches program with BPF_F_ALLOW_MULTI, so it co-exists with
+// programs attached by others to the same cgroup
+func (a *cgroupAttachment) attach(progFd int, path string, attachType int) error {
+	fd, err := openDir(path)
+	if err != nil {
+		return fmt.Errorf("Unable to open cgroup '%s': %v", path, err)
+	}
+	err = cgroupProgAttach(bpfCmdProgAttach, fd, progFd, attachType, bpfFAllowMulti)
+	if err != nil {
+		closeFd(fd)
+		return newSyscallError("ebpf_prog_attach()", err, nil)
+	}
+	a.path = path
+	a.fd = fd
+	a.attachType = attachType
+	a.attached = true
+
+	return nil
+}
+
+func (a *cgroupAttachment) detach(progFd int) error {
+	err := cgroupProgAttach(bpfCmdProgDetach, a.fd, progFd, a.attachType, 0)
+	if err != nil {
+		return newSyscallError("ebpf_prog_detach()", err, nil)
+	}
+	closeFd(a.fd)
+	a.attached = false
+
+	return nil
+}
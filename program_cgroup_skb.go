@@ -0,0 +1,146 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+)
+
+// CgroupSkbDirection is direction of packets CgroupSkb program gets
+type CgroupSkbDirection int
+
+// Must be in sync with enum bpf_attach_type from <linux/bpf.h>
+const (
+	CgroupSkbIngress CgroupSkbDirection = bpfAttachTypeCgroupInetIngress
+	CgroupSkbEgress  CgroupSkbDirection = bpfAttachTypeCgroupInetEgress
+)
+
+func (d CgroupSkbDirection) String() string {
+	switch d {
+	case CgroupSkbIngress:
+		return "ingress"
+	case CgroupSkbEgress:
+		return "egress"
+	}
+
+	return "unknown"
+}
+
+// CgroupSkbAttachParams is accepted as argument to Program.Attach() of
+// CgroupSkb programs
+type CgroupSkbAttachParams struct {
+	// Path of cgroup v2 directory, e.g. "/sys/fs/cgroup"
+	// Program gets packets of sockets of cgroup and all its descendants.
+	CgroupPath string
+	Direction  CgroupSkbDirection
+}
+
+type cgroupSkbProgram struct {
+	BaseProgram
+
+	cgroup cgroupAttachment
+}
+
+func newCgroupSkbProgram(name, license string, bytecode []byte) Program {
+	return &cgroupSkbProgram{
+		BaseProgram: BaseProgram{
+			name:        name,
+			license:     license,
+			bytecode:    bytecode,
+			programType: ProgramTypeCgroupSkb,
+		},
+	}
+}
+
+// Attach attaches program to cgroup in given direction (CgroupSkbAttachParams).
+// Program returns 1 to pass packet, 0 to drop it. Like SockOps programs,
+// CgroupSkb ones co-exist with programs attached by others to the same cgroup.
+func (p *cgroupSkbProgram) Attach(data interface{}) error {
+	var params CgroupSkbAttachParams
+	switch x := data.(type) {
+	case CgroupSkbAttachParams:
+		params = x
+	case *CgroupSkbAttachParams:
+		params = *x
+	default:
+		return fmt.Errorf("CgroupSkbAttachParams expected, got %T", data)
+	}
+	if params.Direction != CgroupSkbIngress && params.Direction != CgroupSkbEgress {
+		return fmt.Errorf("Invalid direction %d", params.Direction)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cgroup.attached {
+		return fmt.Errorf("Program '%s' is already attached to '%s'", p.name, p.cgroup.path)
+	}
+	err := p.cgroup.attach(p.fd, params.CgroupPath, int(params.Direction))
+	countOperation(MetricAttaches, MetricAttachFailures, err)
+	if err != nil {
+		return err
+	}
+	p.log().Printf("goebpf: cgroup skb program '%s' attached to cgroup '%s' (%v)",
+		p.name, params.CgroupPath, params.Direction)
+
+	return nil
+}
+
+// Detach detaches program from cgroup. Like for SockOps programs,
+// Close() detaches program too.
+func (p *cgroupSkbProgram) Detach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.cgroup.attached {
+		return nil
+	}
+	err := p.cgroup.detach(p.fd)
+	countOperation(MetricDetaches, MetricDetachFailures, err)
+	if err != nil {
+		return err
+	}
+	p.log().Printf("goebpf: cgroup skb program '%s' detached from cgroup '%s'", p.name, p.cgroup.path)
+
+	return nil
+}
+
+func (p *cgroupSkbProgram) isAttached() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.cgroup.attached
+}
+
+// New program is attached next to current one first, so there is
+// no moment when cgroup has no program at all
+func (p *cgroupSkbProgram) moveAttachments(to Program) error {
+	p.mu.RLock()
+	attached := p.cgroup.attached
+	params := CgroupSkbAttachParams{
+		CgroupPath: p.cgroup.path,
+		Direction:  CgroupSkbDirection(p.cgroup.attachType),
+	}
+	p.mu.RUnlock()
+
+	if !attached {
+		return nil
+	}
+	if err := to.Attach(params); err != nil {
+		return err
+	}
+
+	return p.Detach()
+}
+
+// Close detaches program (if attached) and unloads it from kernel,
+// otherwise cgroup would keep running it
+func (p *cgroupSkbProgram) Close() error {
+	err := p.Detach()
+
+	if cerr := p.BaseProgram.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
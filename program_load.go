@@ -0,0 +1,72 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ProgramLoadResult is outcome of loading of single program by LoadPrograms()
+type ProgramLoadResult struct {
+	Name string
+	// Nil if program has been loaded successfully
+	Err error
+	// Time spent in kernel (mostly by verifier)
+	Duration time.Duration
+}
+
+// LoadPrograms loads programs into kernel concurrently, using at most parallelism
+// workers (zero or negative means runtime.NumCPU()). Since most of load time is spent
+// by kernel verifier, ELF files with many programs are loaded much faster this way:
+//
+//	results, err := goebpf.LoadPrograms(bpf.GetPrograms(), 0)
+//
+// All programs are tried regardless of failures, results are sorted by program name.
+// Returned error is the first failure (by program name), if any.
+func LoadPrograms(programs map[string]Program, parallelism int) ([]ProgramLoadResult, error) {
+	if parallelism <= 0 {
+		parallelism = runtime.NumCPU()
+	}
+
+	names := make([]string, 0, len(programs))
+	for name := range programs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	results := make([]ProgramLoadResult, len(names))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism && i < len(names); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				started := time.Now()
+				err := programs[names[idx]].Load()
+				results[idx] = ProgramLoadResult{
+					Name:     names[idx],
+					Err:      err,
+					Duration: time.Since(started),
+				}
+			}
+		}()
+	}
+	for idx := range names {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	for _, res := range results {
+		if res.Err != nil {
+			return results, &LoadError{Context: fmt.Sprintf("Program '%s'", res.Name), Err: res.Err}
+		}
+	}
+	return results, nil
+}
@@ -0,0 +1,75 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Program which only tracks number of concurrent Load() calls
+type loadTestProgram struct {
+	Program
+	err     error
+	mu      *sync.Mutex
+	active  *int
+	maxSeen *int
+}
+
+func (p *loadTestProgram) Load() error {
+	p.mu.Lock()
+	*p.active++
+	if *p.active > *p.maxSeen {
+		*p.maxSeen = *p.active
+	}
+	p.mu.Unlock()
+
+	time.Sleep(10 * time.Millisecond)
+
+	p.mu.Lock()
+	*p.active--
+	p.mu.Unlock()
+	return p.err
+}
+
+func TestLoadPrograms(t *testing.T) {
+	var mu sync.Mutex
+	var active, maxSeen int
+	programs := map[string]Program{}
+	for _, name := range []string{"p4", "p1", "p3", "p2", "p5"} {
+		programs[name] = &loadTestProgram{mu: &mu, active: &active, maxSeen: &maxSeen}
+	}
+
+	results, err := LoadPrograms(programs, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, maxSeen)
+	require.Len(t, results, 5)
+	for idx, name := range []string{"p1", "p2", "p3", "p4", "p5"} {
+		assert.Equal(t, name, results[idx].Name)
+		assert.NoError(t, results[idx].Err)
+		assert.True(t, results[idx].Duration > 0)
+	}
+
+	// Failures do not stop others from loading
+	maxSeen = 0
+	programs["p2"].(*loadTestProgram).err = errors.New("verifier failed")
+	programs["p4"].(*loadTestProgram).err = errors.New("verifier failed")
+	results, err = LoadPrograms(programs, 1)
+	assert.EqualError(t, err, "Program 'p2': verifier failed")
+	assert.Equal(t, 1, maxSeen)
+	require.Len(t, results, 5)
+	assert.NoError(t, results[0].Err)
+	assert.Error(t, results[1].Err)
+	assert.Error(t, results[3].Err)
+
+	// Nothing to load
+	results, err = LoadPrograms(nil, 0)
+	assert.NoError(t, err)
+	assert.Empty(t, results)
+}
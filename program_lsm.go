@@ -0,0 +1,183 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unsafe"
+)
+
+// BPF_LSM_MAC from enum bpf_attach_type of <linux/bpf.h>
+const bpfAttachTypeLSMMac = 27
+
+// ELF section prefix of LSM programs, SEC("lsm/file_open")
+const lsmSectionPrefix = "lsm/"
+
+// Kernel exposes every LSM hook as function bpf_lsm_<hook>,
+// program is verified against BTF of that function
+const lsmFuncPrefix = "bpf_lsm_"
+
+// BPF_RAW_TRACEPOINT_OPEN, used to attach tracing / LSM programs
+type bpfRawTracepointOpenAttr struct {
+	name   bpfPointer
+	progFd uint32
+}
+
+type lsmProgram struct {
+	BaseProgram
+
+	// LSM hook program is loaded for, e.g. "file_open", see <linux/lsm_hook_defs.h>
+	hook     string
+	linkFd   int
+	attached bool
+}
+
+// NewLSMProgram creates LSM program (linux 5.7+, CONFIG_BPF_LSM and "bpf" in
+// list of active LSMs) for hook, e.g. "file_open" or "inode_unlink". Unlike other
+// program types, LSM programs are bound to hook when loaded.
+// Program gets hook arguments as array of u64 in R1 and returns 0 to allow
+// operation or negative errno to deny it.
+func NewLSMProgram(name, hook, license string, insns Instructions) (Program, error) {
+	if len(insns) == 0 {
+		return nil, errors.New("Empty program")
+	}
+	bytecode, modules, err := insns.assemble()
+	if err != nil {
+		return nil, err
+	}
+	prog := newLSMProgram(hook)(name, license, bytecode)
+	prog.(baseProgramAccessor).base().kfuncModules = modules
+
+	return prog, nil
+}
+
+func newLSMProgram(hook string) programCreator {
+	return func(name, license string, bytecode []byte) Program {
+		return &lsmProgram{
+			BaseProgram: BaseProgram{
+				name:               name,
+				license:            license,
+				bytecode:           bytecode,
+				programType:        ProgramTypeLSM,
+				expectedAttachType: bpfAttachTypeLSMMac,
+			},
+			hook: hook,
+		}
+	}
+}
+
+// Returns BTF ID of kernel function of LSM hook, kernel BTF is read from btfPath
+func lsmHookBtfID(btfPath, hook string) (int, error) {
+	id, err := kernelFuncBtfID(btfPath, lsmFuncPrefix+hook)
+	if errors.Is(err, ErrNotSupported) {
+		return 0, err
+	}
+	if err != nil {
+		return 0, fmt.Errorf("Unknown LSM hook '%s': %v", hook, err)
+	}
+
+	return id, nil
+}
+
+// Load resolves LSM hook in kernel BTF and loads program into kernel
+func (p *lsmProgram) Load() error {
+	if p.hook == "" || strings.Contains(p.hook, "/") {
+		return fmt.Errorf("Invalid LSM hook '%s'", p.hook)
+	}
+	id, err := lsmHookBtfID(p.btfPath, p.hook)
+	if err != nil {
+		return err
+	}
+	p.mu.Lock()
+	p.attachBtfID = id
+	p.mu.Unlock()
+
+	return p.BaseProgram.Load()
+}
+
+// Attach attaches program to LSM hook it was loaded for, data is ignored
+func (p *lsmProgram) Attach(data interface{}) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.attached {
+		err := fmt.Errorf("Program '%s' is already attached to '%s'", p.name, p.hook)
+		countOperation(MetricAttaches, MetricAttachFailures, err)
+		return err
+	}
+	attr := bpfRawTracepointOpenAttr{
+		progFd: uint32(p.fd),
+	}
+	fd, err := bpfSyscall(bpfCmdRawTracepointOpen, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	countOperation(MetricAttaches, MetricAttachFailures, err)
+	if err != nil {
+		return newSyscallError("ebpf_raw_tracepoint_open()", err, nil)
+	}
+	p.linkFd = fd
+	p.attached = true
+	p.log().Printf("goebpf: LSM program '%s' attached to '%s'", p.name, p.hook)
+
+	return nil
+}
+
+// Detach detaches program from LSM hook, does nothing if not attached
+func (p *lsmProgram) Detach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.attached {
+		return nil
+	}
+	err := p.closeLink()
+	countOperation(MetricDetaches, MetricDetachFailures, err)
+	if err != nil {
+		return err
+	}
+	p.log().Printf("goebpf: LSM program '%s' detached from '%s'", p.name, p.hook)
+
+	return nil
+}
+
+func (p *lsmProgram) isAttached() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.attached
+}
+
+// New program is attached first, so hook is never left unguarded
+// (for a moment both programs are called)
+func (p *lsmProgram) moveAttachments(to Program) error {
+	if !p.isAttached() {
+		return nil
+	}
+	if err := to.Attach(nil); err != nil {
+		return err
+	}
+
+	return p.Detach()
+}
+
+// Close detaches program (if attached) and unloads it from kernel
+func (p *lsmProgram) Close() error {
+	p.mu.Lock()
+	err := p.closeLink()
+	p.mu.Unlock()
+
+	if cerr := p.BaseProgram.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (p *lsmProgram) closeLink() error {
+	if !p.attached {
+		return nil
+	}
+	p.attached = false
+
+	return closeFd(p.linkFd)
+}
@@ -0,0 +1,128 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+)
+
+// LwtAttachParams is accepted as argument to Program.Attach() of LwtIn /
+// LwtOut / LwtXmit / LwtSeg6Local programs. Lightweight tunnel programs
+// are run by route, so attaching program adds (or replaces) route, like
+//
+//	ip route replace 10.0.0.0/8 encap bpf xmit fd ... headroom ... dev eth0
+//	ip -6 route replace fc00::1/128 encap seg6local action End.BPF endpoint fd ... dev eth0
+type LwtAttachParams struct {
+	// Destination of route, e.g. "10.0.0.0/8".
+	// Seg6Local programs are attached to SID, e.g. "fc00::1/128".
+	Dst string
+	// Output interface of route
+	Device string
+	// Next hop, optional
+	Gateway string
+	// Routing table, zero means main one
+	Table int
+	// Room LwtXmit program needs for headers it pushes (encapsulation), at most 256
+	Headroom int
+}
+
+type lwtProgram struct {
+	BaseProgram
+
+	// Route program is attached by, nil if not attached
+	route *LwtAttachParams
+}
+
+// Creator of lightweight tunnel programs of given type
+func newLwtProgram(progType ProgramType) programCreator {
+	return func(name, license string, bytecode []byte) Program {
+		return &lwtProgram{
+			BaseProgram: BaseProgram{
+				name:        name,
+				license:     license,
+				bytecode:    bytecode,
+				programType: progType,
+			},
+		}
+	}
+}
+
+// Attach adds route running program (LwtAttachParams). Existing route
+// with the same destination / table is replaced, the same way as attaching
+// XDP program replaces one attached before.
+func (p *lwtProgram) Attach(data interface{}) error {
+	var params LwtAttachParams
+	switch x := data.(type) {
+	case LwtAttachParams:
+		params = x
+	case *LwtAttachParams:
+		params = *x
+	default:
+		return fmt.Errorf("LwtAttachParams expected, got %T", data)
+	}
+	if params.Headroom != 0 && p.programType != ProgramTypeLwtXmit {
+		return fmt.Errorf("Headroom is supported by %v programs only", ProgramTypeLwtXmit)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.route != nil {
+		return fmt.Errorf("Program '%s' is already attached to route '%s'", p.name, p.route.Dst)
+	}
+	err := lwtRouteReplace(p.programType, p.fd, p.name, &params)
+	countOperation(MetricAttaches, MetricAttachFailures, err)
+	if err != nil {
+		return err
+	}
+	p.route = &params
+	p.log().Printf("goebpf: %v program '%s' attached to route '%s'", p.programType, p.name, params.Dst)
+
+	return nil
+}
+
+// Detach deletes route program is attached by. Like XDP programs,
+// lightweight tunnel ones stay attached even after program is closed.
+func (p *lwtProgram) Detach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.route == nil {
+		return errors.New("Program isn't attached")
+	}
+	err := lwtRouteDelete(p.route)
+	countOperation(MetricDetaches, MetricDetachFailures, err)
+	if err != nil {
+		return err
+	}
+	p.log().Printf("goebpf: %v program '%s' detached from route '%s'", p.programType, p.name, p.route.Dst)
+	p.route = nil
+
+	return nil
+}
+
+func (p *lwtProgram) isAttached() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.route != nil
+}
+
+// Attaching other program to the same route atomically replaces route,
+// so there is no window without program
+func (p *lwtProgram) moveAttachments(to Program) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.route == nil {
+		return nil
+	}
+	if err := to.Attach(p.route); err != nil {
+		return err
+	}
+	p.route = nil
+
+	return nil
+}
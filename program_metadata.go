@@ -0,0 +1,184 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"debug/elf"
+	"fmt"
+	"strings"
+	"unsafe"
+
+	"github.com/dropbox/goebpf/goebpf_btf"
+)
+
+// Programs may embed metadata (version, build info, etc) the same way bpftool
+// expects it: read only global variables with "bpf_metadata_" prefix, e.g.
+//
+//	BPF_METADATA(version, "1.2.3");
+//
+// ELF must be compiled with BTF (clang -g). Content of ".rodata" section is put
+// into frozen array map described by BTF, which is bound to every program of ELF
+// on Load(), so metadata is shown by "bpftool prog show" / GetProgramInfoByFd().
+// Binding maps requires linux 5.10+, older kernels load programs without metadata.
+
+const (
+	metadataSectionName = ".rodata"
+	metadataPrefix      = "bpf_metadata_"
+)
+
+// Content of ".rodata" section along with BTF describing it
+type programMetadata struct {
+	btf       []byte
+	datasecId int
+	data      []byte
+}
+
+// Reads metadata of programs from ELF, nil if there is none
+func (s *ebpfSystem) readProgramMetadata(elfFile *elf.File, symbols []elf.Symbol) (*programMetadata, error) {
+	section := elfFile.Section(metadataSectionName)
+	if section == nil || section.Type != elf.SHT_PROGBITS {
+		return nil, nil
+	}
+	found := false
+	for _, sym := range symbols {
+		if strings.HasPrefix(sym.Name, metadataPrefix) && int(sym.Section) < len(elfFile.Sections) &&
+			elfFile.Sections[sym.Section] == section {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, nil
+	}
+	btfSection := elfFile.Section(goebpf_btf.ElfSectionName)
+	if btfSection == nil {
+		s.logger.Printf("goebpf: ELF has metadata, but no BTF (compiled without -g), skipped")
+		return nil, nil
+	}
+
+	data, err := btfSection.Data()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read '%s' section data: %v", btfSection.Name, err)
+	}
+	btf, err := fixupElfBtf(elfFile, data)
+	if err != nil {
+		return nil, err
+	}
+	spec, err := goebpf_btf.ParseSpec(btf, elfFile.ByteOrder)
+	if err != nil {
+		return nil, err
+	}
+	datasec, err := spec.TypeByName(metadataSectionName, goebpf_btf.KindDatasec)
+	if err != nil {
+		return nil, fmt.Errorf("No BTF for '%s' section: %v", metadataSectionName, err)
+	}
+	content, err := section.Data()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read '%s' section data: %v", section.Name, err)
+	}
+
+	return &programMetadata{
+		btf:       btf,
+		datasecId: datasec.ID,
+		data:      content,
+	}, nil
+}
+
+// Creates frozen map with metadata and binds it to program prog.
+// Program holds reference to map, so it is closed right away.
+func (md *programMetadata) bind(prog *BaseProgram) error {
+	btfFd, err := ebpfBtfLoad(md.btf, prog.tokenFd)
+	if err != nil {
+		return err
+	}
+	defer closeFd(btfFd)
+
+	m := &EbpfMap{
+		Name:           metadataSectionName,
+		Type:           MapTypeArray,
+		KeySize:        4,
+		ValueSize:      len(md.data),
+		MaxEntries:     1,
+		Flags:          bpfReadOnlyProgram,
+		TokenFd:        prog.tokenFd,
+		btfFd:          btfFd,
+		btfValueTypeId: md.datasecId,
+	}
+	if err = m.Create(); err != nil {
+		return err
+	}
+	defer m.Close()
+	if err = m.Update(0, md.data); err != nil {
+		return err
+	}
+
+	elemAttr := bpfMapElemAttr{
+		mapFd: uint32(m.GetFd()),
+	}
+	_, err = bpfSyscall(bpfCmdMapFreeze, unsafe.Pointer(&elemAttr), unsafe.Sizeof(elemAttr))
+	if err != nil {
+		return newSyscallError("ebpf_map_freeze()", err, nil)
+	}
+	bindAttr := bpfProgBindMapAttr{
+		progFd: uint32(prog.fd),
+		mapFd:  uint32(m.GetFd()),
+	}
+	_, err = bpfSyscall(bpfCmdProgBindMap, unsafe.Pointer(&bindAttr), unsafe.Sizeof(bindAttr))
+	if err != nil {
+		return newSyscallError("ebpf_prog_bind_map()", err, nil)
+	}
+
+	return nil
+}
+
+// Checks if map looks like metadata map (the same way as bpftool does)
+func isMetadataMap(info *bpfMapInfo) bool {
+	return MapType(info.Type) == MapTypeArray && info.KeySize == 4 && info.MaxEntries == 1 &&
+		info.BtfId != 0 && info.BtfValueTypeId != 0 &&
+		strings.HasSuffix(NullTerminatedStringToString(info.Name[:]), metadataSectionName)
+}
+
+// Reads bpf_metadata_* variables from metadata map m,
+// returns nil if m is not metadata map
+func readMapMetadata(m *EbpfMap) (map[string]string, error) {
+	info, err := ebpfMapGetInfo(m.GetFd())
+	if err != nil {
+		return nil, err
+	}
+	if !isMetadataMap(info) {
+		return nil, nil
+	}
+	btf, err := ebpfBtfGetData(int(info.BtfId))
+	if err != nil {
+		return nil, err
+	}
+	spec, err := goebpf_btf.ParseSpec(btf, hostByteOrder)
+	if err != nil {
+		return nil, err
+	}
+	datasec, err := spec.TypeByID(int(info.BtfValueTypeId))
+	if err != nil || datasec.Kind != goebpf_btf.KindDatasec {
+		return nil, nil
+	}
+	value := make([]byte, info.ValueSize)
+	if err = m.LookupInto(make([]byte, 4), value); err != nil {
+		return nil, err
+	}
+
+	res := map[string]string{}
+	for _, v := range datasec.Members {
+		if !strings.HasPrefix(v.Name, metadataPrefix) || v.Type.Target == nil {
+			continue
+		}
+		offset := v.BitOffset / 8
+		size, err := goebpf_btf.SizeOf(v.Type.Target)
+		if err != nil || offset+size > len(value) {
+			continue
+		}
+		res[strings.TrimPrefix(v.Name, metadataPrefix)] =
+			goebpf_btf.FormatValue(v.Type.Target, value[offset:offset+size], hostByteOrder)
+	}
+
+	return res, nil
+}
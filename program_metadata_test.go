@@ -0,0 +1,34 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsMetadataMap(t *testing.T) {
+	info := &bpfMapInfo{
+		Type:           uint32(MapTypeArray),
+		KeySize:        4,
+		ValueSize:      16,
+		MaxEntries:     1,
+		Name:           objName("app.rodata"),
+		BtfId:          1,
+		BtfValueTypeId: 10,
+	}
+	assert.True(t, isMetadataMap(info))
+
+	// Maps without BTF / other maps
+	noBtf := *info
+	noBtf.BtfValueTypeId = 0
+	assert.False(t, isMetadataMap(&noBtf))
+	other := *info
+	other.Name = objName("counters")
+	assert.False(t, isMetadataMap(&other))
+	hash := *info
+	hash.Type = uint32(MapTypeHash)
+	assert.False(t, isMetadataMap(&hash))
+}
@@ -0,0 +1,262 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+	"unsafe"
+)
+
+// PERF_TYPE_BREAKPOINT, HW_BREAKPOINT_R | HW_BREAKPOINT_W | HW_BREAKPOINT_X
+const (
+	perfTypeBreakpoint = 5
+	bpTypeMask         = 1 | 2 | 4
+)
+
+// BPF_PERF_EVENT from enum bpf_attach_type of <linux/bpf.h>
+const bpfAttachTypePerfEvent = 41
+
+// PerfEventAttachParams is accepted as argument to Program.Attach()
+// for PerfEvent programs. Program is attached to event on every CPU from Cpus.
+type PerfEventAttachParams struct {
+	// Event type / config, e.g. unix.PERF_TYPE_SOFTWARE / unix.PERF_COUNT_SW_CPU_CLOCK
+	Type   uint32
+	Config uint64
+	// Either SampleFrequency (Hz) or SamplePeriod (every N events) must be set,
+	// breakpoints are sampled on every hit by default
+	SampleFrequency uint64
+	SamplePeriod    uint64
+	// Hardware breakpoint (watchpoint) of unix.PERF_TYPE_BREAKPOINT events:
+	// type (e.g. goebpf_perf.BreakpointW), address and length (1, 2, 4 or 8)
+	// of watched memory. Address is in memory of Pid, or kernel one when Pid is -1.
+	BreakpointType uint32
+	BreakpointAddr uint64
+	BreakpointLen  uint64
+	// Process to monitor, -1 means all processes
+	Pid int
+	// List of CPUs to attach program on. Defaults to all online CPUs.
+	Cpus []int
+	// Value returned by bpf_get_attach_cookie() to program (linux 5.15+),
+	// to tell apart events one program is attached to
+	Cookie uint64
+}
+
+type perfEventProgram struct {
+	BaseProgram
+
+	// Opened perf events, one per CPU, and BPF links of them (Cookie only)
+	eventFds []int
+	linkFds  []int
+	// Parameters program attached with
+	params PerfEventAttachParams
+}
+
+func newPerfEventProgram(name, license string, bytecode []byte) Program {
+	return &perfEventProgram{
+		BaseProgram: BaseProgram{
+			name:        name,
+			license:     license,
+			bytecode:    bytecode,
+			programType: ProgramTypePerfEvent,
+		},
+	}
+}
+
+// Attach opens perf event on each CPU and attaches program to them.
+// Accepts PerfEventAttachParams or *PerfEventAttachParams
+func (p *perfEventProgram) Attach(data interface{}) error {
+	var params *PerfEventAttachParams
+	switch v := data.(type) {
+	case PerfEventAttachParams:
+		params = &v
+	case *PerfEventAttachParams:
+		params = v
+	default:
+		return fmt.Errorf("PerfEventAttachParams expected, got %T", data)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.attach(params)
+	countOperation(MetricAttaches, MetricAttachFailures, err)
+	return err
+}
+
+// Checks breakpoint part of params, sets default sample period
+func prepareBreakpoint(params *PerfEventAttachParams) error {
+	if params.BreakpointType == 0 || params.BreakpointType&^bpTypeMask != 0 {
+		return fmt.Errorf("Invalid breakpoint type %d", params.BreakpointType)
+	}
+	if params.BreakpointAddr == 0 {
+		return errors.New("Breakpoint address must be set")
+	}
+	switch params.BreakpointLen {
+	case 1, 2, 4, 8:
+	default:
+		return fmt.Errorf("Invalid breakpoint length %d", params.BreakpointLen)
+	}
+	if params.SampleFrequency == 0 && params.SamplePeriod == 0 {
+		params.SamplePeriod = 1
+	}
+
+	return nil
+}
+
+// Attaches program to perf event. Cookie can be set only through BPF link
+// (linux 5.15+), so link is created for non zero cookie, its fd is returned.
+func perfEventAttachProgram(eventFd, progFd int, cookie uint64) (int, error) {
+	if cookie == 0 {
+		if err := perfEventSetBpf(eventFd, progFd); err != nil {
+			return 0, fmt.Errorf("PERF_EVENT_IOC_SET_BPF failed: %v", err)
+		}
+		return 0, nil
+	}
+	attr := bpfLinkCreateAttr{
+		progFd:     uint32(progFd),
+		targetFd:   uint32(eventFd),
+		attachType: bpfAttachTypePerfEvent,
+	}
+	hostByteOrder.PutUint64(attr.data[:], cookie)
+	fd, err := bpfSyscall(bpfCmdLinkCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return 0, newSyscallError("ebpf_link_create()", err, nil)
+	}
+
+	return fd, nil
+}
+
+func (p *perfEventProgram) attach(params *PerfEventAttachParams) error {
+	if len(p.eventFds) > 0 {
+		return errors.New("Program is already attached")
+	}
+	if params.Type == perfTypeBreakpoint {
+		// Caller's params are kept intact
+		bp := *params
+		if err := prepareBreakpoint(&bp); err != nil {
+			return err
+		}
+		params = &bp
+	}
+	if (params.SampleFrequency == 0) == (params.SamplePeriod == 0) {
+		return errors.New("Either SampleFrequency or SamplePeriod must be set")
+	}
+	cpus := params.Cpus
+	if len(cpus) == 0 {
+		var err error
+		if cpus, err = OnlineCPUs(); err != nil {
+			return err
+		}
+	}
+
+	for _, cpu := range cpus {
+		fd, err := perfEventOpen(params, cpu)
+		if err == syscall.ENODEV && len(params.Cpus) == 0 {
+			// CPU went offline meanwhile
+			continue
+		}
+		if err != nil {
+			p.closeEvents()
+			return fmt.Errorf("perf_event_open() on CPU %d failed: %v", cpu, err)
+		}
+		p.eventFds = append(p.eventFds, fd)
+		linkFd, err := perfEventAttachProgram(fd, p.fd, params.Cookie)
+		if err != nil {
+			p.closeEvents()
+			return err
+		}
+		if linkFd != 0 {
+			p.linkFds = append(p.linkFds, linkFd)
+		}
+		if err = perfEventEnable(fd); err != nil {
+			p.closeEvents()
+			return fmt.Errorf("PERF_EVENT_IOC_ENABLE failed: %v", err)
+		}
+	}
+	p.params = *params
+	p.log().Printf("goebpf: perf event program '%s' attached to %d CPUs", p.name, len(p.eventFds))
+
+	return nil
+}
+
+// Detach disables and closes all perf events program is attached to
+func (p *perfEventProgram) Detach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.eventFds) == 0 {
+		err := errors.New("Program isn't attached")
+		countOperation(MetricDetaches, MetricDetachFailures, err)
+		return err
+	}
+	err := p.closeEvents()
+	countOperation(MetricDetaches, MetricDetachFailures, err)
+	p.log().Printf("goebpf: perf event program '%s' detached", p.name)
+
+	return err
+}
+
+func (p *perfEventProgram) isAttached() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return len(p.eventFds) > 0
+}
+
+// Kernel does not allow to replace program of perf event, so events are
+// re-opened for other program - there is short window without program.
+// In case of failure current program is attached back.
+func (p *perfEventProgram) moveAttachments(to Program) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.eventFds) == 0 {
+		return nil
+	}
+	if err := p.closeEvents(); err != nil {
+		return err
+	}
+	if err := to.Attach(p.params); err != nil {
+		if rerr := p.attach(&p.params); rerr != nil {
+			return fmt.Errorf("%v, also re-attach failed: %v", err, rerr)
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Close closes all perf events program is attached to (if any)
+// and unloads program from kernel
+func (p *perfEventProgram) Close() error {
+	p.mu.Lock()
+	err := p.closeEvents()
+	p.mu.Unlock()
+
+	if cerr := p.BaseProgram.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (p *perfEventProgram) closeEvents() error {
+	var result error
+	for _, fd := range p.linkFds {
+		if err := closeFd(fd); err != nil && result == nil {
+			result = err
+		}
+	}
+	p.linkFds = nil
+	for _, fd := range p.eventFds {
+		perfEventDisable(fd)
+		if err := closeFd(fd); err != nil && result == nil {
+			result = err
+		}
+	}
+	p.eventFds = nil
+
+	return result
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepareBreakpoint(t *testing.T) {
+	params := &PerfEventAttachParams{Type: perfTypeBreakpoint, BreakpointType: 2, BreakpointAddr: 0x1000, BreakpointLen: 8}
+	require.NoError(t, prepareBreakpoint(params))
+	assert.Equal(t, uint64(1), params.SamplePeriod)
+
+	params = &PerfEventAttachParams{Type: perfTypeBreakpoint, BreakpointType: 3, BreakpointAddr: 0x1000, BreakpointLen: 4, SampleFrequency: 10}
+	require.NoError(t, prepareBreakpoint(params))
+	assert.Zero(t, params.SamplePeriod)
+
+	invalid := []PerfEventAttachParams{
+		{BreakpointAddr: 0x1000, BreakpointLen: 8},
+		{BreakpointType: 8, BreakpointAddr: 0x1000, BreakpointLen: 8},
+		{BreakpointType: 2, BreakpointLen: 8},
+		{BreakpointType: 2, BreakpointAddr: 0x1000, BreakpointLen: 3},
+	}
+	for _, p := range invalid {
+		assert.Error(t, prepareBreakpoint(&p))
+	}
+
+	// Breakpoint params are validated before anything is opened
+	prog := &perfEventProgram{}
+	assert.Error(t, prog.Attach(PerfEventAttachParams{Type: perfTypeBreakpoint}))
+}
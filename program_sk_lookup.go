@@ -0,0 +1,153 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// BPF_SK_LOOKUP from enum bpf_attach_type of <linux/bpf.h>
+const bpfAttachTypeSkLookup = 36
+
+// Network namespace of current process
+const ownNetnsPath = "/proc/self/ns/net"
+
+// SkLookupAttachParams is accepted as argument to Program.Attach() of
+// SkLookup programs. Path of network namespace as string is accepted as well,
+// nil means network namespace of current process.
+type SkLookupAttachParams struct {
+	// Network namespace file, e.g. "/proc/self/ns/net" or "/run/netns/name"
+	NetnsPath string
+}
+
+type skLookupProgram struct {
+	BaseProgram
+
+	netnsPath string
+	linkFd    int
+	attached  bool
+}
+
+func newSkLookupProgram(name, license string, bytecode []byte) Program {
+	return &skLookupProgram{
+		BaseProgram: BaseProgram{
+			name:               name,
+			license:            license,
+			bytecode:           bytecode,
+			programType:        ProgramTypeSkLookup,
+			expectedAttachType: bpfAttachTypeSkLookup,
+		},
+	}
+}
+
+// Attach attaches program to network namespace (linux 5.9+), program is run
+// on every socket lookup of TCP connection request / UDP packet there, before
+// regular one. Multiple programs may be attached to the same namespace.
+func (p *skLookupProgram) Attach(data interface{}) error {
+	path := ownNetnsPath
+	switch x := data.(type) {
+	case nil:
+	case string:
+		path = x
+	case SkLookupAttachParams:
+		path = x.NetnsPath
+	case *SkLookupAttachParams:
+		path = x.NetnsPath
+	default:
+		return fmt.Errorf("Network namespace path as string or SkLookupAttachParams expected, got %T", data)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.attached {
+		return fmt.Errorf("Program '%s' is already attached to '%s'", p.name, p.netnsPath)
+	}
+	netnsFd, err := openReadOnly(path)
+	if err != nil {
+		return fmt.Errorf("Unable to open network namespace '%s': %v", path, err)
+	}
+	// Link keeps reference to namespace, so its fd is not needed anymore
+	defer closeFd(netnsFd)
+	attr := bpfLinkCreateAttr{
+		progFd:     uint32(p.fd),
+		targetFd:   uint32(netnsFd),
+		attachType: bpfAttachTypeSkLookup,
+	}
+	fd, err := bpfSyscall(bpfCmdLinkCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	countOperation(MetricAttaches, MetricAttachFailures, err)
+	if err != nil {
+		return newSyscallError("ebpf_link_create()", err, nil)
+	}
+	p.linkFd = fd
+	p.netnsPath = path
+	p.attached = true
+	p.log().Printf("goebpf: sk_lookup program '%s' attached to '%s'", p.name, path)
+
+	return nil
+}
+
+// Detach detaches program from network namespace
+func (p *skLookupProgram) Detach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.attached {
+		err := errors.New("Program isn't attached")
+		countOperation(MetricDetaches, MetricDetachFailures, err)
+		return err
+	}
+	err := p.closeLink()
+	countOperation(MetricDetaches, MetricDetachFailures, err)
+	p.log().Printf("goebpf: sk_lookup program '%s' detached from '%s'", p.name, p.netnsPath)
+
+	return err
+}
+
+func (p *skLookupProgram) isAttached() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.attached
+}
+
+// New program is attached first, so no lookup misses both programs
+// (for a moment both programs are run)
+func (p *skLookupProgram) moveAttachments(to Program) error {
+	p.mu.RLock()
+	attached, path := p.attached, p.netnsPath
+	p.mu.RUnlock()
+
+	if !attached {
+		return nil
+	}
+	if err := to.Attach(path); err != nil {
+		return err
+	}
+
+	return p.Detach()
+}
+
+// Close detaches program (if attached) and unloads it from kernel
+func (p *skLookupProgram) Close() error {
+	p.mu.Lock()
+	err := p.closeLink()
+	p.mu.Unlock()
+
+	if cerr := p.BaseProgram.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (p *skLookupProgram) closeLink() error {
+	if !p.attached {
+		return nil
+	}
+	p.attached = false
+
+	return closeFd(p.linkFd)
+}
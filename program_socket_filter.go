@@ -3,13 +3,8 @@
 
 package goebpf
 
-//#include "bpf_helpers.h"
-import "C"
-
 import (
 	"fmt"
-
-	"golang.org/x/sys/unix"
 )
 
 // SocketFilterResult is eBPF program return code enum
@@ -17,8 +12,8 @@ type SocketFilterResult int
 type SocketFilterAttachType int
 
 const (
-	SocketFilterDeny  SocketFilterResult = C.SOCKET_FILTER_DENY
-	SocketFilterAllow SocketFilterResult = C.SOCKET_FILTER_ALLOW
+	SocketFilterDeny  SocketFilterResult = 0
+	SocketFilterAllow SocketFilterResult = 1
 
 	SocketAttachTypeFilter    SocketFilterAttachType = SO_ATTACH_BPF
 	SocketAttachTypeReusePort SocketFilterAttachType = SO_ATTACH_REUSEPORT_EBPF
@@ -63,7 +58,9 @@ func (t SocketFilterAttachType) String() string {
 type socketFilterProgram struct {
 	BaseProgram
 
-	sockFd int
+	sockFd     int
+	attachType SocketFilterAttachType
+	attached   bool
 }
 
 func newSocketFilterProgram(name, license string, bytecode []byte) Program {
@@ -82,21 +79,60 @@ func (p *socketFilterProgram) Attach(data interface{}) error {
 	if !ok {
 		return fmt.Errorf("SocketFilterAttachParams expected, got %T", data)
 	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	p.sockFd = params.SocketFd
 
-	err := unix.SetsockoptInt(p.sockFd, unix.SOL_SOCKET, int(params.AttachType), p.GetFd())
+	err := setsockoptInt(p.sockFd, int(params.AttachType), p.fd)
+	countOperation(MetricAttaches, MetricAttachFailures, err)
 	if err != nil {
 		return fmt.Errorf("SetSockOpt with %v failed: %v", params.AttachType, err)
 	}
+	p.attachType = params.AttachType
+	p.attached = true
+	p.log().Printf("goebpf: socket filter '%s' attached to socket %d (%v)",
+		p.name, p.sockFd, params.AttachType)
 
 	return nil
 }
 
 func (p *socketFilterProgram) Detach() error {
-	err := unix.SetsockoptInt(p.sockFd, unix.SOL_SOCKET, SO_DETACH_FILTER, 0)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := setsockoptInt(p.sockFd, SO_DETACH_FILTER, 0)
+	countOperation(MetricDetaches, MetricDetachFailures, err)
 	if err != nil {
 		return fmt.Errorf("SetSockOpt with SO_DETACH_FILTER failed: %v", err)
 	}
+	p.attached = false
+	p.log().Printf("goebpf: socket filter '%s' detached from socket %d", p.name, p.sockFd)
+
+	return nil
+}
+
+func (p *socketFilterProgram) isAttached() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.attached
+}
+
+// Attaching other program to the same socket atomically replaces current one
+func (p *socketFilterProgram) moveAttachments(to Program) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.attached {
+		return nil
+	}
+	err := to.Attach(SocketFilterAttachParams{SocketFd: p.sockFd, AttachType: p.attachType})
+	if err != nil {
+		return err
+	}
+	p.attached = false
 
 	return nil
 }
@@ -0,0 +1,119 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+)
+
+// SockOpsAttachParams is accepted as argument to Program.Attach() of
+// SockOps programs. Path of cgroup as string is accepted as well.
+type SockOpsAttachParams struct {
+	// Path of cgroup v2 directory, e.g. "/sys/fs/cgroup"
+	// Program applies to TCP sockets of cgroup and all its descendants.
+	CgroupPath string
+}
+
+type sockOpsProgram struct {
+	BaseProgram
+
+	cgroup cgroupAttachment
+}
+
+func newSockOpsProgram(name, license string, bytecode []byte) Program {
+	return &sockOpsProgram{
+		BaseProgram: BaseProgram{
+			name:        name,
+			license:     license,
+			bytecode:    bytecode,
+			programType: ProgramTypeSockOps,
+		},
+	}
+}
+
+// Attach attaches program to cgroup (path as string or SockOpsAttachParams).
+// Programs are attached with BPF_F_ALLOW_MULTI, so they co-exist with
+// programs attached by others to the same cgroup.
+func (p *sockOpsProgram) Attach(data interface{}) error {
+	var path string
+	switch x := data.(type) {
+	case string:
+		path = x
+	case SockOpsAttachParams:
+		path = x.CgroupPath
+	case *SockOpsAttachParams:
+		path = x.CgroupPath
+	default:
+		return fmt.Errorf("Cgroup path as string or SockOpsAttachParams expected, got %T", data)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.cgroup.attached {
+		return fmt.Errorf("Program '%s' is already attached to '%s'", p.name, p.cgroup.path)
+	}
+	err := p.cgroup.attach(p.fd, path, bpfAttachTypeCgroupSockOps)
+	countOperation(MetricAttaches, MetricAttachFailures, err)
+	if err != nil {
+		return err
+	}
+	p.log().Printf("goebpf: sockops program '%s' attached to cgroup '%s'", p.name, path)
+
+	return nil
+}
+
+// Detach detaches program from cgroup. Unlike other program types, cgroup
+// keeps program attached even after its fd is closed, so Close() detaches too.
+func (p *sockOpsProgram) Detach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.cgroup.attached {
+		return nil
+	}
+	err := p.cgroup.detach(p.fd)
+	countOperation(MetricDetaches, MetricDetachFailures, err)
+	if err != nil {
+		return err
+	}
+	p.log().Printf("goebpf: sockops program '%s' detached from cgroup '%s'", p.name, p.cgroup.path)
+
+	return nil
+}
+
+func (p *sockOpsProgram) isAttached() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.cgroup.attached
+}
+
+// New program is attached next to current one first, so there is
+// no moment when cgroup has no program at all
+func (p *sockOpsProgram) moveAttachments(to Program) error {
+	p.mu.RLock()
+	attached, path := p.cgroup.attached, p.cgroup.path
+	p.mu.RUnlock()
+
+	if !attached {
+		return nil
+	}
+	if err := to.Attach(path); err != nil {
+		return err
+	}
+
+	return p.Detach()
+}
+
+// Close detaches program (if attached) and unloads it from kernel,
+// otherwise cgroup would keep running it
+func (p *sockOpsProgram) Close() error {
+	err := p.Detach()
+
+	if cerr := p.BaseProgram.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"time"
+	"unsafe"
+)
+
+// Extra room for packet modified by program under test (e.g. encapsulated by bpf_xdp_adjust_head())
+const testRunDataOutExtra = 256
+
+// TestRunParams describes single test run of program, see ProgramTestRun()
+type TestRunParams struct {
+	// Packet program runs on, starting from Ethernet header
+	Data []byte
+	// Number of times to run program, defaults to 1
+	Repeat int
+	// XDP only (linux 5.15+): interface / RX queue packet is received on,
+	// resolved in network namespace of calling thread. Required by helpers
+	// which depend on ingress device, e.g. bpf_fib_lookup() with BPF_FIB_LOOKUP_DIRECT
+	IngressIfindex int
+	RxQueueIndex   int
+}
+
+// TestRunResult is outcome of program test run
+type TestRunResult struct {
+	// Return code of program, e.g. XdpPass
+	ReturnValue int
+	// Packet after program has run
+	Data []byte
+	// Average run time of program
+	Duration time.Duration
+}
+
+// struct xdp_md, context of XDP program
+type xdpMd struct {
+	data           uint32
+	dataEnd        uint32
+	dataMeta       uint32
+	ingressIfindex uint32
+	rxQueueIndex   uint32
+	egressIfindex  uint32
+}
+
+// ProgramTestRun runs loaded program on given packet in kernel (BPF_PROG_TEST_RUN),
+// without attaching it anywhere. Helpers (e.g. map lookups, bpf_fib_lookup()) work
+// as usual, routing lookups are performed in network namespace of calling thread.
+//
+//	res, err := goebpf.ProgramTestRun(prog, goebpf.TestRunParams{Data: packet})
+//	if err == nil && res.ReturnValue == int(goebpf.XdpTx) {
+//		// res.Data is packet to be sent back
+//	}
+func ProgramTestRun(prog Program, params TestRunParams) (*TestRunResult, error) {
+	if prog.GetFd() == 0 {
+		return nil, errors.New("Program is not loaded")
+	}
+	if len(params.Data) == 0 {
+		return nil, errors.New("Data must not be empty")
+	}
+
+	dataOut := make([]byte, len(params.Data)+testRunDataOutExtra)
+	attr := bpfProgTestRunAttr{
+		progFd:      uint32(prog.GetFd()),
+		dataSizeIn:  uint32(len(params.Data)),
+		dataSizeOut: uint32(len(dataOut)),
+		dataIn:      newBpfPointer(unsafe.Pointer(&params.Data[0])),
+		dataOut:     newBpfPointer(unsafe.Pointer(&dataOut[0])),
+		repeat:      uint32(params.Repeat),
+	}
+	if params.IngressIfindex != 0 || params.RxQueueIndex != 0 {
+		if prog.GetType() != ProgramTypeXdp {
+			return nil, errors.New("IngressIfindex / RxQueueIndex are supported by XDP programs only")
+		}
+		ctx := xdpMd{
+			dataEnd:        uint32(len(params.Data)),
+			ingressIfindex: uint32(params.IngressIfindex),
+			rxQueueIndex:   uint32(params.RxQueueIndex),
+		}
+		attr.ctxSizeIn = uint32(unsafe.Sizeof(ctx))
+		attr.ctxIn = newBpfPointer(unsafe.Pointer(&ctx))
+	}
+	_, err := bpfSyscall(bpfCmdProgTestRun, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, newSyscallError("ebpf_prog_test_run()", err, nil)
+	}
+
+	return &TestRunResult{
+		ReturnValue: int(attr.retval),
+		Data:        dataOut[:attr.dataSizeOut],
+		Duration:    time.Duration(attr.duration),
+	}, nil
+}
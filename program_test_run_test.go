@@ -0,0 +1,28 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProgramTestRunErrors(t *testing.T) {
+	prog, err := NewProgram("pass", ProgramTypeXdp, "GPL", Instructions{
+		Mov64Imm(R0, int32(XdpPass)),
+		Exit(),
+	})
+	require.NoError(t, err)
+
+	// Not loaded
+	_, err = ProgramTestRun(prog, TestRunParams{Data: make([]byte, 64)})
+	assert.Error(t, err)
+
+	// No packet
+	prog.(*xdpProgram).fd = 1
+	_, err = ProgramTestRun(prog, TestRunParams{})
+	assert.Error(t, err)
+}
@@ -0,0 +1,205 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// PERF_TYPE_TRACEPOINT from <linux/perf_event.h>
+const perfTypeTracepoint = 2
+
+// Locations tracefs is usually mounted at
+var tracefsPaths = []string{"/sys/kernel/tracing", "/sys/kernel/debug/tracing"}
+
+// TracepointAttachParams is accepted as argument to Program.Attach() of
+// Tracepoint programs. "category/name" string is accepted as well.
+type TracepointAttachParams struct {
+	// Tracepoint, e.g. "sched" / "sched_process_exec",
+	// see /sys/kernel/tracing/events/ for available ones
+	Category string
+	Name     string
+	// Value returned by bpf_get_attach_cookie() to program (linux 5.15+),
+	// to tell apart tracepoints one program is attached to
+	Cookie uint64
+}
+
+func (t TracepointAttachParams) String() string {
+	return t.Category + "/" + t.Name
+}
+
+type tracepointProgram struct {
+	BaseProgram
+
+	// Perf event of tracepoint program is attached to, and its BPF link (Cookie only)
+	eventFd    int
+	linkFd     int
+	tracepoint TracepointAttachParams
+	attached   bool
+}
+
+func newTracepointProgram(name, license string, bytecode []byte) Program {
+	return &tracepointProgram{
+		BaseProgram: BaseProgram{
+			name:        name,
+			license:     license,
+			bytecode:    bytecode,
+			programType: ProgramTypeTracepoint,
+		},
+	}
+}
+
+// Returns ID of tracepoint from tracefs, which has to be mounted
+func tracepointID(tp TracepointAttachParams) (int, error) {
+	if tp.Category == "" || tp.Name == "" || strings.Contains(tp.Category+tp.Name, "/") {
+		return 0, fmt.Errorf("Invalid tracepoint '%v'", tp)
+	}
+	for _, root := range tracefsPaths {
+		data, err := ioutil.ReadFile(filepath.Join(root, "events", tp.Category, tp.Name, "id"))
+		if err != nil {
+			continue
+		}
+		return strconv.Atoi(strings.TrimSpace(string(data)))
+	}
+
+	return 0, fmt.Errorf("Tracepoint '%v' not found (is tracefs mounted?)", tp)
+}
+
+// Attach attaches program to tracepoint given as "category/name"
+// string or TracepointAttachParams
+func (p *tracepointProgram) Attach(data interface{}) error {
+	var tp TracepointAttachParams
+	switch x := data.(type) {
+	case string:
+		parts := strings.SplitN(x, "/", 2)
+		if len(parts) != 2 {
+			return fmt.Errorf("Invalid tracepoint '%s', must be 'category/name'", x)
+		}
+		tp = TracepointAttachParams{Category: parts[0], Name: parts[1]}
+	case TracepointAttachParams:
+		tp = x
+	case *TracepointAttachParams:
+		tp = *x
+	default:
+		return fmt.Errorf("Tracepoint as string or TracepointAttachParams expected, got %T", data)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.attach(tp)
+	countOperation(MetricAttaches, MetricAttachFailures, err)
+	return err
+}
+
+func (p *tracepointProgram) attach(tp TracepointAttachParams) error {
+	if p.attached {
+		return errors.New("Program is already attached")
+	}
+	id, err := tracepointID(tp)
+	if err != nil {
+		return err
+	}
+	// Program runs for tracepoint hits on every CPU, even though event is per CPU one
+	fd, err := perfEventOpen(&PerfEventAttachParams{
+		Type:         perfTypeTracepoint,
+		Config:       uint64(id),
+		SamplePeriod: 1,
+		Pid:          -1,
+	}, 0)
+	if err != nil {
+		return fmt.Errorf("perf_event_open() of tracepoint '%v' failed: %v", tp, err)
+	}
+	linkFd, err := perfEventAttachProgram(fd, p.fd, tp.Cookie)
+	if err != nil {
+		closeFd(fd)
+		return err
+	}
+	if err = perfEventEnable(fd); err != nil {
+		if linkFd != 0 {
+			closeFd(linkFd)
+		}
+		closeFd(fd)
+		return fmt.Errorf("PERF_EVENT_IOC_ENABLE failed: %v", err)
+	}
+	p.eventFd = fd
+	p.linkFd = linkFd
+	p.tracepoint = tp
+	p.attached = true
+	p.log().Printf("goebpf: tracepoint program '%s' attached to '%v'", p.name, tp)
+
+	return nil
+}
+
+// Detach detaches program from tracepoint
+func (p *tracepointProgram) Detach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.attached {
+		err := errors.New("Program isn't attached")
+		countOperation(MetricDetaches, MetricDetachFailures, err)
+		return err
+	}
+	err := p.closeEvent()
+	countOperation(MetricDetaches, MetricDetachFailures, err)
+	p.log().Printf("goebpf: tracepoint program '%s' detached from '%v'", p.name, p.tracepoint)
+
+	return err
+}
+
+func (p *tracepointProgram) isAttached() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.attached
+}
+
+// New program is attached to tracepoint first, so no hits are missed
+// (some may be seen by both programs)
+func (p *tracepointProgram) moveAttachments(to Program) error {
+	p.mu.RLock()
+	attached, tp := p.attached, p.tracepoint
+	p.mu.RUnlock()
+
+	if !attached {
+		return nil
+	}
+	if err := to.Attach(tp); err != nil {
+		return err
+	}
+
+	return p.Detach()
+}
+
+// Close detaches program (if attached) and unloads it from kernel
+func (p *tracepointProgram) Close() error {
+	p.mu.Lock()
+	err := p.closeEvent()
+	p.mu.Unlock()
+
+	if cerr := p.BaseProgram.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (p *tracepointProgram) closeEvent() error {
+	if !p.attached {
+		return nil
+	}
+	if p.linkFd != 0 {
+		closeFd(p.linkFd)
+		p.linkFd = 0
+	}
+	perfEventDisable(p.eventFd)
+	p.attached = false
+
+	return closeFd(p.eventFd)
+}
@@ -0,0 +1,241 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+)
+
+// BPF_TRACE_FENTRY / BPF_TRACE_FEXIT from enum bpf_attach_type of <linux/bpf.h>
+const (
+	bpfAttachTypeTraceFentry = 24
+	bpfAttachTypeTraceFexit  = 25
+)
+
+// ELF section prefixes of tracing programs, SEC("fentry/tcp_connect")
+const (
+	fentrySectionPrefix = "fentry/"
+	fexitSectionPrefix  = "fexit/"
+)
+
+// TracingKind is where tracing program is called: on entry into / exit from function
+type TracingKind int
+
+const (
+	// TracingFentry - program is called on function entry, gets its arguments
+	TracingFentry TracingKind = iota
+	// TracingFexit - program is called on function exit, gets its arguments
+	// followed by return value
+	TracingFexit
+)
+
+func (k TracingKind) String() string {
+	if k == TracingFexit {
+		return "fexit"
+	}
+	return "fentry"
+}
+
+func (k TracingKind) attachType() int {
+	if k == TracingFexit {
+		return bpfAttachTypeTraceFexit
+	}
+	return bpfAttachTypeTraceFentry
+}
+
+// TracingAttachParams is optional argument of Program.Attach() of Tracing programs
+type TracingAttachParams struct {
+	// Value returned by bpf_get_attach_cookie() to program (linux 6.0+)
+	Cookie uint64
+}
+
+type tracingProgram struct {
+	BaseProgram
+
+	// Kernel function program is loaded for, optionally prefixed by module
+	function string
+	kind     TracingKind
+	linkFd   int
+	attached bool
+	params   TracingAttachParams
+}
+
+// NewTracingProgram creates fentry / fexit program (linux 5.5+, BTF enabled
+// kernel) of kernel function, e.g. "tcp_connect". Functions of loaded kernel
+// modules are supported as well (linux 5.11+): module is found automatically,
+// or may be given explicitly, e.g. "nf_conntrack:nf_confirm".
+// Like LSM programs, tracing programs are bound to function when loaded.
+// Program gets function arguments as array of u64 in R1.
+func NewTracingProgram(name string, kind TracingKind, function, license string, insns Instructions) (Program, error) {
+	if len(insns) == 0 {
+		return nil, errors.New("Empty program")
+	}
+	bytecode, modules, err := insns.assemble()
+	if err != nil {
+		return nil, err
+	}
+	prog := newTracingProgram(kind, function)(name, license, bytecode)
+	prog.(baseProgramAccessor).base().kfuncModules = modules
+
+	return prog, nil
+}
+
+func newTracingProgram(kind TracingKind, function string) programCreator {
+	return func(name, license string, bytecode []byte) Program {
+		return &tracingProgram{
+			BaseProgram: BaseProgram{
+				name:               name,
+				license:            license,
+				bytecode:           bytecode,
+				programType:        ProgramTypeTracing,
+				expectedAttachType: kind.attachType(),
+			},
+			function: function,
+			kind:     kind,
+		}
+	}
+}
+
+// Load resolves function in kernel / kernel modules BTF and loads program into kernel
+func (p *tracingProgram) Load() error {
+	fn, err := findKernelFunc(p.btfPath, p.function)
+	if err != nil {
+		return err
+	}
+	btfFd := 0
+	if fn.module != "" {
+		if btfFd, err = kernelModuleBtfFd(fn.module); err != nil {
+			return err
+		}
+		// Program keeps reference to module BTF once loaded
+		defer closeFd(btfFd)
+	}
+	p.mu.Lock()
+	p.attachBtfID = fn.btfID
+	p.attachBtfObjFd = btfFd
+	p.mu.Unlock()
+
+	return p.BaseProgram.Load()
+}
+
+// Attach attaches program to function it was loaded for.
+// Accepts nil or TracingAttachParams / *TracingAttachParams.
+func (p *tracingProgram) Attach(data interface{}) error {
+	var params TracingAttachParams
+	switch x := data.(type) {
+	case nil:
+	case TracingAttachParams:
+		params = x
+	case *TracingAttachParams:
+		params = *x
+	default:
+		return fmt.Errorf("TracingAttachParams expected, got %T", data)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.attached {
+		err := fmt.Errorf("Program '%s' is already attached to '%s'", p.name, p.function)
+		countOperation(MetricAttaches, MetricAttachFailures, err)
+		return err
+	}
+	var fd int
+	var err error
+	if params.Cookie == 0 {
+		attr := bpfRawTracepointOpenAttr{
+			progFd: uint32(p.fd),
+		}
+		fd, err = bpfSyscall(bpfCmdRawTracepointOpen, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		if err != nil {
+			err = newSyscallError("ebpf_raw_tracepoint_open()", err, nil)
+		}
+	} else {
+		// Cookie can be set only by newer BPF_LINK_CREATE
+		attr := bpfLinkCreateAttr{
+			progFd:     uint32(p.fd),
+			attachType: uint32(p.expectedAttachType),
+		}
+		// struct { u32 target_btf_id; u64 cookie; }
+		hostByteOrder.PutUint64(attr.data[8:], params.Cookie)
+		fd, err = bpfSyscall(bpfCmdLinkCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		if err != nil {
+			err = newSyscallError("ebpf_link_create()", err, nil)
+		}
+	}
+	countOperation(MetricAttaches, MetricAttachFailures, err)
+	if err != nil {
+		return err
+	}
+	p.linkFd = fd
+	p.attached = true
+	p.params = params
+	p.log().Printf("goebpf: %s program '%s' attached to '%s'", p.kind, p.name, p.function)
+
+	return nil
+}
+
+// Detach detaches program from function
+func (p *tracingProgram) Detach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.attached {
+		err := errors.New("Program isn't attached")
+		countOperation(MetricDetaches, MetricDetachFailures, err)
+		return err
+	}
+	err := p.closeLink()
+	countOperation(MetricDetaches, MetricDetachFailures, err)
+	p.log().Printf("goebpf: %s program '%s' detached from '%s'", p.kind, p.name, p.function)
+
+	return err
+}
+
+func (p *tracingProgram) isAttached() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.attached
+}
+
+// New program is attached first, so no function call is missed
+// (for a moment both programs are called)
+func (p *tracingProgram) moveAttachments(to Program) error {
+	p.mu.RLock()
+	attached, params := p.attached, p.params
+	p.mu.RUnlock()
+
+	if !attached {
+		return nil
+	}
+	if err := to.Attach(params); err != nil {
+		return err
+	}
+
+	return p.Detach()
+}
+
+// Close detaches program (if attached) and unloads it from kernel
+func (p *tracingProgram) Close() error {
+	p.mu.Lock()
+	err := p.closeLink()
+	p.mu.Unlock()
+
+	if cerr := p.BaseProgram.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (p *tracingProgram) closeLink() error {
+	if !p.attached {
+		return nil
+	}
+	p.attached = false
+
+	return closeFd(p.linkFd)
+}
@@ -0,0 +1,274 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/dropbox/goebpf/goebpf_container"
+	"github.com/dropbox/goebpf/goebpf_usym"
+)
+
+// Dynamic PMU of uprobes (linux 4.17+), its type and retprobe flag are in sysfs
+const (
+	uprobePmuType     = "/sys/bus/event_source/devices/uprobe/type"
+	uprobePmuRetprobe = "/sys/bus/event_source/devices/uprobe/format/retprobe"
+)
+
+// Symbol tables of binaries uprobes are attached to, shared with stack symbolization
+var userSymbols = goebpf_usym.NewCache()
+
+// UserSymbols returns symbol cache used to resolve functions of
+// UprobeAttachParams, to share it with symbolization of user stacks:
+//
+//	proc, err := goebpf.UserSymbols().Process(pid)
+//	frames := proc.Symbolize(stack)
+func UserSymbols() *goebpf_usym.Cache {
+	return userSymbols
+}
+
+// UprobeAttachParams is accepted as argument to Program.Attach() of
+// Uprobe programs
+type UprobeAttachParams struct {
+	// Binary / shared library, e.g. "/usr/lib/x86_64-linux-gnu/libc.so.6"
+	Path string
+	// Function to attach to, e.g. "malloc". When empty, program is attached
+	// to Offset of file, otherwise Offset is added to offset of function.
+	Symbol string
+	Offset uint64
+	// Program is called on return from function (uretprobe) instead of entry
+	Retprobe bool
+	// Process to trace, 0 means all processes running binary. Path is
+	// resolved in mount namespace of Pid (/proc/<pid>/root), so binaries
+	// of containers can be given as seen inside container.
+	Pid int
+	// Value returned by bpf_get_attach_cookie() to program (linux 5.15+),
+	// to tell apart functions one program is attached to
+	Cookie uint64
+}
+
+func (u UprobeAttachParams) String() string {
+	target := u.Symbol
+	if target == "" || u.Offset != 0 {
+		target += fmt.Sprintf("+0x%x", u.Offset)
+	}
+	res := u.Path + ":" + target
+	if u.Pid != 0 {
+		res += fmt.Sprintf(" (pid %d)", u.Pid)
+	}
+	return res
+}
+
+type uprobeProgram struct {
+	BaseProgram
+
+	// Program is uretprobe by ELF section name, SEC("uretprobe")
+	retprobe bool
+	// Perf event of uprobe program is attached to, and its BPF link (Cookie only)
+	eventFd  int
+	linkFd   int
+	params   UprobeAttachParams
+	attached bool
+}
+
+func newUprobeProgram(retprobe bool) programCreator {
+	return func(name, license string, bytecode []byte) Program {
+		return &uprobeProgram{
+			BaseProgram: BaseProgram{
+				name:        name,
+				license:     license,
+				bytecode:    bytecode,
+				programType: ProgramTypeKprobe,
+			},
+			retprobe: retprobe,
+		}
+	}
+}
+
+// Reads sysfs file of uprobe PMU
+func readPmuFile(path string) (string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", fmt.Errorf("Uprobe PMU is not available (linux 4.17+ required): %v", err)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// Returns type of uprobe PMU and config bit of retprobe flag
+func uprobePmu() (uint32, uint64, error) {
+	data, err := readPmuFile(uprobePmuType)
+	if err != nil {
+		return 0, 0, err
+	}
+	pmuType, err := strconv.ParseUint(data, 10, 32)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid uprobe PMU type '%s'", data)
+	}
+	// "config:0"
+	data, err = readPmuFile(uprobePmuRetprobe)
+	if err != nil {
+		return 0, 0, err
+	}
+	bit, err := strconv.ParseUint(strings.TrimPrefix(data, "config:"), 10, 6)
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid uprobe PMU retprobe format '%s'", data)
+	}
+
+	return uint32(pmuType), 1 << bit, nil
+}
+
+// Returns path of binary as seen from host and offset in it to attach uprobe to
+func resolveUprobe(params *UprobeAttachParams) (string, uint64, error) {
+	if params.Path == "" {
+		return "", 0, errors.New("Path of binary must be set")
+	}
+	path := params.Path
+	if params.Pid > 0 {
+		path = goebpf_container.HostPath(params.Pid, params.Path)
+	}
+	if params.Symbol == "" {
+		if params.Offset == 0 {
+			return "", 0, errors.New("Either Symbol or Offset must be set")
+		}
+		return path, params.Offset, nil
+	}
+	offset, err := userSymbols.SymbolOffset(path, params.Symbol)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return path, offset + params.Offset, nil
+}
+
+// Attach attaches program to function of binary (UprobeAttachParams)
+func (p *uprobeProgram) Attach(data interface{}) error {
+	var params UprobeAttachParams
+	switch x := data.(type) {
+	case UprobeAttachParams:
+		params = x
+	case *UprobeAttachParams:
+		params = *x
+	default:
+		return fmt.Errorf("UprobeAttachParams expected, got %T", data)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	err := p.attach(params)
+	countOperation(MetricAttaches, MetricAttachFailures, err)
+	return err
+}
+
+func (p *uprobeProgram) attach(params UprobeAttachParams) error {
+	if p.attached {
+		return fmt.Errorf("Program '%s' is already attached to '%v'", p.name, p.params)
+	}
+	path, offset, err := resolveUprobe(&params)
+	if err != nil {
+		return err
+	}
+	pmuType, retprobeBit, err := uprobePmu()
+	if err != nil {
+		return err
+	}
+	var config uint64
+	if params.Retprobe || p.retprobe {
+		config = retprobeBit
+	}
+	fd, err := uprobeEventOpen(pmuType, config, path, offset, params.Pid)
+	if err != nil {
+		return fmt.Errorf("perf_event_open() of uprobe '%v' failed: %v", params, err)
+	}
+	linkFd, err := perfEventAttachProgram(fd, p.fd, params.Cookie)
+	if err != nil {
+		closeFd(fd)
+		return err
+	}
+	if err = perfEventEnable(fd); err != nil {
+		if linkFd != 0 {
+			closeFd(linkFd)
+		}
+		closeFd(fd)
+		return fmt.Errorf("PERF_EVENT_IOC_ENABLE failed: %v", err)
+	}
+	p.eventFd = fd
+	p.linkFd = linkFd
+	p.params = params
+	p.attached = true
+	p.log().Printf("goebpf: uprobe program '%s' attached to '%v'", p.name, params)
+
+	return nil
+}
+
+// Detach detaches program from function
+func (p *uprobeProgram) Detach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.attached {
+		err := errors.New("Program isn't attached")
+		countOperation(MetricDetaches, MetricDetachFailures, err)
+		return err
+	}
+	err := p.closeEvent()
+	countOperation(MetricDetaches, MetricDetachFailures, err)
+	p.log().Printf("goebpf: uprobe program '%s' detached from '%v'", p.name, p.params)
+
+	return err
+}
+
+func (p *uprobeProgram) isAttached() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.attached
+}
+
+// New program is attached to function first, so no calls are missed
+// (some may be seen by both programs)
+func (p *uprobeProgram) moveAttachments(to Program) error {
+	p.mu.RLock()
+	attached, params := p.attached, p.params
+	p.mu.RUnlock()
+
+	if !attached {
+		return nil
+	}
+	if err := to.Attach(params); err != nil {
+		return err
+	}
+
+	return p.Detach()
+}
+
+// Close detaches program (if attached) and unloads it from kernel
+func (p *uprobeProgram) Close() error {
+	p.mu.Lock()
+	err := p.closeEvent()
+	p.mu.Unlock()
+
+	if cerr := p.BaseProgram.Close(); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+func (p *uprobeProgram) closeEvent() error {
+	if !p.attached {
+		return nil
+	}
+	if p.linkFd != 0 {
+		closeFd(p.linkFd)
+		p.linkFd = 0
+	}
+	perfEventDisable(p.eventFd)
+	p.attached = false
+
+	return closeFd(p.eventFd)
+}
@@ -0,0 +1,41 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUprobeAttachParamsString(t *testing.T) {
+	assert.Equal(t, "/bin/app:main", UprobeAttachParams{Path: "/bin/app", Symbol: "main"}.String())
+	assert.Equal(t, "/bin/app:main+0x4 (pid 42)", UprobeAttachParams{Path: "/bin/app", Symbol: "main", Offset: 4, Pid: 42}.String())
+	assert.Equal(t, "/bin/app:+0x1000", UprobeAttachParams{Path: "/bin/app", Offset: 0x1000}.String())
+}
+
+func TestResolveUprobe(t *testing.T) {
+	path, offset, err := resolveUprobe(&UprobeAttachParams{Path: "/bin/app", Offset: 0x1000, Pid: 42})
+	require.NoError(t, err)
+	assert.Equal(t, "/proc/42/root/bin/app", path)
+	assert.Equal(t, uint64(0x1000), offset)
+
+	_, _, err = resolveUprobe(&UprobeAttachParams{Path: "/bin/app"})
+	assert.Error(t, err)
+	_, _, err = resolveUprobe(&UprobeAttachParams{Symbol: "main"})
+	assert.Error(t, err)
+
+	const libc = "/usr/lib/x86_64-linux-gnu/libc.so.6"
+	if _, err := os.Stat(libc); err != nil {
+		t.Skip("No libc: ", err)
+	}
+	_, offset, err = resolveUprobe(&UprobeAttachParams{Path: libc, Symbol: "malloc"})
+	require.NoError(t, err)
+	_, withOffset, err := resolveUprobe(&UprobeAttachParams{Path: libc, Symbol: "malloc", Offset: 4})
+	require.NoError(t, err)
+	assert.Equal(t, offset+4, withOffset)
+	assert.True(t, UserSymbols().Len() > 0)
+}
@@ -3,9 +3,6 @@
 
 package goebpf
 
-//#include "bpf_helpers.h"
-import "C"
-
 import (
 	"errors"
 	"fmt"
@@ -17,11 +14,11 @@ import (
 type XdpResult int
 
 const (
-	XdpAborted  XdpResult = C.XDP_ABORTED
-	XdpDrop     XdpResult = C.XDP_DROP
-	XdpPass     XdpResult = C.XDP_PASS
-	XdpTx       XdpResult = C.XDP_TX
-	XdpRedirect XdpResult = C.XDP_REDIRECT
+	XdpAborted  XdpResult = 0
+	XdpDrop     XdpResult = 1
+	XdpPass     XdpResult = 2
+	XdpTx       XdpResult = 3
+	XdpRedirect XdpResult = 4
 )
 
 func (t XdpResult) String() string {
@@ -41,12 +38,58 @@ func (t XdpResult) String() string {
 	return "UNKNOWN"
 }
 
+// XdpAttachMode selects a way how XDP program will be attached to interface
+type XdpAttachMode int
+
+const (
+	// XdpAttachModeNone stands for "best effort" - kernel automatically
+	// selects best mode (would try Drv first, then fallback to Generic).
+	XdpAttachModeNone XdpAttachMode = 0
+	// XdpAttachModeSkb is "generic", kernel mode, less performant comparing to native,
+	// but does not requires driver support.
+	XdpAttachModeSkb XdpAttachMode = (1 << 1)
+	// XdpAttachModeDrv is native, driver mode (support from driver side required)
+	XdpAttachModeDrv XdpAttachMode = (1 << 2)
+	// XdpAttachModeHw suitable for NICs with hardware XDP support (SmartNICs).
+	// Program (and all maps it uses) must be offloaded to the same NIC.
+	XdpAttachModeHw XdpAttachMode = (1 << 3)
+)
+
+func (t XdpAttachMode) String() string {
+	switch t {
+	case XdpAttachModeNone:
+		return "None"
+	case XdpAttachModeSkb:
+		return "Generic"
+	case XdpAttachModeDrv:
+		return "Native"
+	case XdpAttachModeHw:
+		return "Offload"
+	}
+
+	return "UNKNOWN"
+}
+
+// XdpAttachParams used to pass parameters to Attach() call.
+type XdpAttachParams struct {
+	// Interface is string name of interface to attach program to
+	Interface string
+	// Mode is one of XdpAttachMode.
+	Mode XdpAttachMode
+	// Attach in generic mode when native one is not possible, either because
+	// device fails checks (see XdpDeviceInfo.CheckNative()) or kernel refused it.
+	// Applies to XdpAttachModeDrv / XdpAttachModeNone.
+	FallbackToGeneric bool
+}
+
 // XDP eBPF program (implements Program interface)
 type xdpProgram struct {
 	BaseProgram
 
 	// Name of interface where XDP program attached to.
 	ifname string
+	// Mode program attached with
+	mode XdpAttachMode
 }
 
 func newXdpProgram(name, license string, bytecode []byte) Program {
@@ -60,44 +103,144 @@ func newXdpProgram(name, license string, bytecode []byte) Program {
 	}
 }
 
+// Attach attaches XDP program to network interface.
+// Accepts either interface name (string) or *XdpAttachParams
 func (p *xdpProgram) Attach(data interface{}) error {
-	ifname, ok := data.(string)
-	if !ok {
-		return fmt.Errorf("Interface name as string expected, got %T", data)
+	var ifname string
+	var mode = XdpAttachModeNone
+	var fallback bool
+
+	switch x := data.(type) {
+	case string:
+		ifname = x
+	case *XdpAttachParams:
+		ifname = x.Interface
+		mode = x.Mode
+		fallback = x.FallbackToGeneric
+	case XdpAttachParams:
+		ifname = x.Interface
+		mode = x.Mode
+		fallback = x.FallbackToGeneric
+	default:
+		return fmt.Errorf("Interface name as string or XdpAttachParams expected, got %T", data)
 	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	// Lookup interface by given name, we need to extract iface index
 	iface, err := netlink.LinkByName(ifname)
+	RecordAudit(AuditSourceNetlink, "LinkByName", ifname, err)
 	if err != nil {
 		// Most likely no such interface
 		return fmt.Errorf("LinkByName() failed: %v", err)
 	}
 
-	err = netlink.LinkSetXdpFd(iface, p.fd)
+	// Offloaded program must be loaded for the same device it attaches to,
+	// otherwise kernel simply returns EINVAL
+	if mode == XdpAttachModeHw && p.ifindex != iface.Attrs().Index {
+		return fmt.Errorf("Program '%s' is not offloaded to '%s'", p.name, ifname)
+	}
+
+	// Native mode has driver specific limits, explain them upfront
+	// rather than relying on kernel message
+	if mode == XdpAttachModeDrv || (mode == XdpAttachModeNone && fallback) {
+		if err = checkNativeXdp(ifname); err != nil {
+			if !fallback {
+				return err
+			}
+			p.log().Printf("goebpf: %v, falling back to generic mode", err)
+			mode = XdpAttachModeSkb
+		}
+	}
+
+	err = linkSetXdpFd(iface, ifname, p.fd, mode)
+	if err != nil && fallback && (mode == XdpAttachModeDrv || mode == XdpAttachModeNone) {
+		p.log().Printf("goebpf: native XDP attach to '%s' failed: %v, falling back to generic mode",
+			ifname, newNetlinkError("LinkSetXdpFdWithFlags()", err))
+		mode = XdpAttachModeSkb
+		err = linkSetXdpFd(iface, ifname, p.fd, mode)
+	}
+	countOperation(MetricAttaches, MetricAttachFailures, err)
 	if err != nil {
-		return fmt.Errorf("LinkSetXdpFd() failed: %v", err)
+		return newNetlinkError("LinkSetXdpFdWithFlags()", err)
 	}
 	p.ifname = ifname
+	p.mode = mode
+	p.log().Printf("goebpf: XDP program '%s' attached to '%s', mode %v", p.name, ifname, mode)
 
 	return nil
 }
 
+// Attaches program fd to interface (-1 detaches), retrying transient failures
+func linkSetXdpFd(iface netlink.Link, ifname string, fd int, mode XdpAttachMode) error {
+	return RetryTransient(func() error {
+		err := netlink.LinkSetXdpFdWithFlags(iface, fd, int(mode))
+		RecordAudit(AuditSourceNetlink, "LinkSetXdpFd", ifname, err)
+		return err
+	})
+}
+
+// Checks if device allows native XDP, devices unable to report
+// their capabilities are left to kernel to decide
+func checkNativeXdp(ifname string) error {
+	info, err := GetXdpDeviceInfo(ifname)
+	if err != nil {
+		return nil
+	}
+	return info.CheckNative()
+}
+
 func (p *xdpProgram) Detach() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	if p.ifname == "" {
 		return errors.New("Program isn't attached")
 	}
 	// Lookup interface by given name, we need to extract iface index
 	iface, err := netlink.LinkByName(p.ifname)
+	RecordAudit(AuditSourceNetlink, "LinkByName", p.ifname, err)
 	if err != nil {
 		// Most likely no such interface
 		return fmt.Errorf("LinkByName() failed: %v", err)
 	}
 
-	// Setting eBPF program with FD -1 actually removes it from interface
-	err = netlink.LinkSetXdpFd(iface, -1)
+	// Setting eBPF program with FD -1 actually removes it from interface.
+	// Mode must match the one used for Attach()
+	err = linkSetXdpFd(iface, p.ifname, -1, p.mode)
+	countOperation(MetricDetaches, MetricDetachFailures, err)
 	if err != nil {
-		return fmt.Errorf("LinkSetXdpFd() failed: %v", err)
+		return newNetlinkError("LinkSetXdpFdWithFlags()", err)
+	}
+	p.log().Printf("goebpf: XDP program '%s' detached from '%s'", p.name, p.ifname)
+	p.ifname = ""
+	p.mode = XdpAttachModeNone
+
+	return nil
+}
+
+func (p *xdpProgram) isAttached() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	return p.ifname != ""
+}
+
+// Attaching other program to the same interface with the same mode
+// atomically replaces current one, so there is no window without program
+func (p *xdpProgram) moveAttachments(to Program) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.ifname == "" {
+		return nil
+	}
+	if err := to.Attach(&XdpAttachParams{Interface: p.ifname, Mode: p.mode}); err != nil {
+		return err
 	}
 	p.ifname = ""
+	p.mode = XdpAttachModeNone
 
 	return nil
 }
@@ -0,0 +1,402 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+)
+
+// On hosts running several eBPF agents it is hard to tell whose maps /
+// programs / links are pinned in bpffs, and what is left by agents which are
+// gone. Registry is optional convention for that: agents record objects they
+// create in shared pinned hash map along with owner name, version and PID,
+// so anyone can list them and clean up pins of dead owners:
+//
+//	reg, err := goebpf.OpenRegistry("/sys/fs/bpf/goebpf_registry", goebpf.Owner{Name: "firewall", Version: "1.2.0"})
+//	err = reg.RegisterSystem(bpf)
+//	err = reg.RegisterLink(link, "/sys/fs/bpf/firewall/xdp_link")
+//	...
+//	// E.g. by any agent on startup
+//	removed, err := reg.CollectGarbage()
+//
+// Owner is identified by PID along with process start time, so owners are
+// not confused with unrelated processes re-using PID.
+
+// Location of process information, variable for tests
+var procRoot = "/proc"
+
+// Limits of registry strings, longer names are truncated
+const (
+	registryMaxEntries = 4096
+	registryOwnerLen   = 32
+	registryVersionLen = 32
+	registryNameLen    = 64
+	registryPathLen    = 256
+)
+
+// ObjectKind is kind of registered BPF object
+type ObjectKind int
+
+const (
+	ObjectMap ObjectKind = iota + 1
+	ObjectProgram
+	ObjectLink
+)
+
+func (k ObjectKind) String() string {
+	switch k {
+	case ObjectMap:
+		return "Map"
+	case ObjectProgram:
+		return "Program"
+	case ObjectLink:
+		return "Link"
+	}
+
+	return "Unknown"
+}
+
+// Owner describes application registering objects
+type Owner struct {
+	Name    string
+	Version string
+}
+
+// RegistryEntry is object recorded in registry
+type RegistryEntry struct {
+	Kind ObjectKind
+	Id   int
+	// Full name of map / program, empty for links
+	Name string
+	// Location object is pinned at, empty if it isn't pinned
+	PinPath string
+	Owner   Owner
+	Pid     int
+	// Time of the first / the last registration
+	Created time.Time
+	Updated time.Time
+	// Owner process is still running
+	Alive bool
+}
+
+// Layouts of registry map key / value
+type registryKey struct {
+	Kind uint32
+	Id   uint32
+}
+
+type registryValue struct {
+	Owner    [registryOwnerLen]byte
+	Version  [registryVersionLen]byte
+	Name     [registryNameLen]byte
+	PinPath  [registryPathLen]byte
+	Pid      uint32
+	_        uint32
+	PidStart uint64
+	Created  int64
+	Updated  int64
+}
+
+// Registry of BPF objects shared by applications, see OpenRegistry()
+type Registry struct {
+	m        *EbpfMap
+	owner    Owner
+	pid      int
+	pidStart uint64
+}
+
+// OpenRegistry opens registry pinned at path, creating it if needed.
+// Objects are registered on behalf of owner (current process).
+func OpenRegistry(path string, owner Owner) (*Registry, error) {
+	if owner.Name == "" {
+		return nil, errors.New("Owner name must be set")
+	}
+	if len(owner.Name) >= registryOwnerLen || len(owner.Version) >= registryVersionLen {
+		return nil, fmt.Errorf("Owner name / version must be shorter than %d / %d bytes",
+			registryOwnerLen, registryVersionLen)
+	}
+	pid := os.Getpid()
+	pidStart, err := processStartTime(pid)
+	if err != nil {
+		return nil, err
+	}
+	m := &EbpfMap{
+		Name:           "goebpf_registry",
+		Type:           MapTypeHash,
+		KeySize:        int(unsafe.Sizeof(registryKey{})),
+		ValueSize:      int(unsafe.Sizeof(registryValue{})),
+		MaxEntries:     registryMaxEntries,
+		PersistentPath: path,
+		PinPolicy:      MapPinReuse,
+	}
+	if err := makePinDir(filepath.Dir(path)); err != nil {
+		return nil, err
+	}
+	if err := m.Create(); err != nil {
+		return nil, fmt.Errorf("Unable to open registry '%s': %v", path, err)
+	}
+
+	return &Registry{
+		m:        m,
+		owner:    owner,
+		pid:      pid,
+		pidStart: pidStart,
+	}, nil
+}
+
+// Reads start time of process (in clock ticks since boot), which along with
+// PID identifies process
+func processStartTime(pid int) (uint64, error) {
+	if pid == os.Getpid() && !isProcAvailable() {
+		// Emulated platforms: only own process is known
+		return 0, nil
+	}
+	data, err := ioutil.ReadFile(filepath.Join(procRoot, strconv.Itoa(pid), "stat"))
+	if err != nil {
+		return 0, err
+	}
+	return parseProcessStartTime(string(data))
+}
+
+func isProcAvailable() bool {
+	_, err := os.Stat(filepath.Join(procRoot, "self"))
+	return err == nil
+}
+
+// Parses starttime (22nd field) of /proc/<pid>/stat. Command name (2nd field)
+// is in parentheses and may contain spaces / parentheses itself.
+func parseProcessStartTime(stat string) (uint64, error) {
+	end := strings.LastIndexByte(stat, ')')
+	if end < 0 {
+		return 0, errors.New("Invalid process stat")
+	}
+	// Fields after command name start from 3rd one (state)
+	fields := strings.Fields(stat[end+1:])
+	if len(fields) < 20 {
+		return 0, errors.New("Invalid process stat")
+	}
+	start, err := strconv.ParseUint(fields[19], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Invalid process start time '%s'", fields[19])
+	}
+
+	return start, nil
+}
+
+// Checks whether process registered entry is still running
+func (r *Registry) isAlive(pid int, pidStart uint64) bool {
+	if pid == r.pid {
+		return pidStart == r.pidStart
+	}
+	start, err := processStartTime(pid)
+	return err == nil && start == pidStart
+}
+
+// Returns ID of BPF object (map / program / link) by its fd
+func objectId(fd int) (int, error) {
+	// The same prefix of bpf_map_info / bpf_prog_info / bpf_link_info
+	var info struct {
+		Type uint32
+		Id   uint32
+	}
+	if err := ebpfObjGetInfo(fd, unsafe.Pointer(&info), unsafe.Sizeof(info)); err != nil {
+		return 0, newSyscallError("ebpf_obj_get_info_by_fd()", err, nil)
+	}
+	return int(info.Id), nil
+}
+
+// Register records object by its fd on behalf of owner, replacing previous
+// record of the same object (e.g. by owner which re-used pinned map).
+// pinPath is location object is pinned at, if any: pins of objects of dead
+// owners are removed by CollectGarbage().
+func (r *Registry) Register(kind ObjectKind, fd int, name, pinPath string) error {
+	if kind.String() == "Unknown" {
+		return fmt.Errorf("Invalid object kind %d", kind)
+	}
+	if len(pinPath) >= registryPathLen {
+		return fmt.Errorf("Pin path '%s' is too long", pinPath)
+	}
+	id, err := objectId(fd)
+	if err != nil {
+		return err
+	}
+	key := registryKey{Kind: uint32(kind), Id: uint32(id)}
+	now := time.Now().UnixNano()
+	value := registryValue{
+		Pid:      uint32(r.pid),
+		PidStart: r.pidStart,
+		Created:  now,
+		Updated:  now,
+	}
+	// Registration time is kept when owner registers object again
+	if prev, err := r.lookup(key); err == nil && int(prev.Pid) == r.pid && prev.PidStart == r.pidStart {
+		value.Created = prev.Created
+	}
+	copy(value.Owner[:registryOwnerLen-1], r.owner.Name)
+	copy(value.Version[:registryVersionLen-1], r.owner.Version)
+	copy(value.Name[:registryNameLen-1], name)
+	copy(value.PinPath[:], pinPath)
+
+	return r.m.Upsert(encodeRegistryItem(&key), encodeRegistryItem(&value))
+}
+
+// RegisterMap records created map, along with its PersistentPath
+func (r *Registry) RegisterMap(m *EbpfMap) error {
+	return r.Register(ObjectMap, m.GetFd(), m.Name, m.PersistentPath)
+}
+
+// RegisterProgram records loaded program, pinned at pinPath (if not empty)
+func (r *Registry) RegisterProgram(prog Program, pinPath string) error {
+	return r.Register(ObjectProgram, prog.GetFd(), prog.GetName(), pinPath)
+}
+
+// RegisterLink records link, pinned at pinPath (if not empty)
+func (r *Registry) RegisterLink(l *Link, pinPath string) error {
+	return r.Register(ObjectLink, l.GetFd(), "", pinPath)
+}
+
+// RegisterSystem records all created maps and loaded programs of system
+func (r *Registry) RegisterSystem(s System) error {
+	for _, m := range s.GetMaps() {
+		if em, ok := m.(*EbpfMap); ok && em.GetFd() != 0 {
+			if err := r.RegisterMap(em); err != nil {
+				return fmt.Errorf("Unable to register map '%s': %v", em.Name, err)
+			}
+		}
+	}
+	for _, prog := range s.GetPrograms() {
+		if prog.GetFd() != 0 {
+			if err := r.RegisterProgram(prog, ""); err != nil {
+				return fmt.Errorf("Unable to register program '%s': %v", prog.GetName(), err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// Unregister removes record of object, e.g. on its removal.
+// Removal of missing record is not an error.
+func (r *Registry) Unregister(kind ObjectKind, id int) error {
+	key := registryKey{Kind: uint32(kind), Id: uint32(id)}
+	err := r.m.Delete(encodeRegistryItem(&key))
+	if err != nil && !errors.Is(err, ErrKeyNotExist) {
+		return err
+	}
+	return nil
+}
+
+// List returns all registered objects, of all owners
+func (r *Registry) List() ([]RegistryEntry, error) {
+	var res []RegistryEntry
+
+	key, err := r.m.GetNextKey(nil)
+	for ; err == nil; key, err = r.m.GetNextKey(key) {
+		var rk registryKey
+		if err := binary.Read(bytes.NewReader(key), hostByteOrder, &rk); err != nil {
+			return nil, err
+		}
+		value, err := r.lookup(rk)
+		if errors.Is(err, ErrKeyNotExist) {
+			// Unregistered meanwhile
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, RegistryEntry{
+			Kind:    ObjectKind(rk.Kind),
+			Id:      int(rk.Id),
+			Name:    NullTerminatedStringToString(value.Name[:]),
+			PinPath: NullTerminatedStringToString(value.PinPath[:]),
+			Owner: Owner{
+				Name:    NullTerminatedStringToString(value.Owner[:]),
+				Version: NullTerminatedStringToString(value.Version[:]),
+			},
+			Pid:     int(value.Pid),
+			Created: time.Unix(0, value.Created),
+			Updated: time.Unix(0, value.Updated),
+			Alive:   r.isAlive(int(value.Pid), value.PidStart),
+		})
+	}
+	if err != ErrNoMoreKeys {
+		return nil, err
+	}
+
+	return res, nil
+}
+
+// CollectGarbage removes records of objects whose owners aren't running
+// anymore, unpinning them (unless something else has been pinned at the
+// same location since). Unpinned objects are destroyed by kernel once no
+// one else holds them, e.g. link detaches its program. Returns removed records.
+func (r *Registry) CollectGarbage() ([]RegistryEntry, error) {
+	entries, err := r.List()
+	if err != nil {
+		return nil, err
+	}
+
+	var res []RegistryEntry
+	for _, entry := range entries {
+		if entry.Alive {
+			continue
+		}
+		if entry.PinPath != "" && isPinnedObject(entry.PinPath, entry.Id) {
+			if err := unpinObject(entry.PinPath); err != nil && !os.IsNotExist(err) {
+				return res, fmt.Errorf("Unable to unpin %v '%s' of '%s': %v",
+					entry.Kind, entry.PinPath, entry.Owner.Name, err)
+			}
+		}
+		if err := r.Unregister(entry.Kind, entry.Id); err != nil {
+			return res, err
+		}
+		res = append(res, entry)
+	}
+
+	return res, nil
+}
+
+// Close closes registry map, it stays pinned
+func (r *Registry) Close() error {
+	return r.m.Close()
+}
+
+func (r *Registry) lookup(key registryKey) (*registryValue, error) {
+	data, err := r.m.Lookup(encodeRegistryItem(&key))
+	if err != nil {
+		return nil, err
+	}
+	var value registryValue
+	if err := binary.Read(bytes.NewReader(data), hostByteOrder, &value); err != nil {
+		return nil, err
+	}
+	return &value, nil
+}
+
+// Checks whether object with id is pinned at path
+func isPinnedObject(path string, id int) bool {
+	fd, err := ebpfObjGet(path, 0)
+	if err != nil {
+		return false
+	}
+	defer closeFd(fd)
+	pinnedId, err := objectId(fd)
+	return err == nil && pinnedId == id
+}
+
+func encodeRegistryItem(item interface{}) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, hostByteOrder, item)
+	return buf.Bytes()
+}
@@ -0,0 +1,42 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseProcessStartTime(t *testing.T) {
+	start, err := parseProcessStartTime("1234 (agent (v2) x) S 1 1234 1234 0 -1 4194560 " +
+		"1020 0 0 0 5 3 0 0 20 0 8 0 987654 12345678 1000 18446744073709551615")
+	require.NoError(t, err)
+	assert.Equal(t, uint64(987654), start)
+
+	_, err = parseProcessStartTime("1234 agent S 1")
+	assert.Error(t, err)
+	_, err = parseProcessStartTime("1234 (agent) S 1 1234")
+	assert.Error(t, err)
+}
+
+func TestRegistryLayout(t *testing.T) {
+	// Value is serialized without padding
+	value := registryValue{Pid: 1, PidStart: 2, Created: 3, Updated: 4}
+	assert.Len(t, encodeRegistryItem(&value), int(unsafe.Sizeof(value)))
+	key := registryKey{Kind: uint32(ObjectLink), Id: 5}
+	assert.Len(t, encodeRegistryItem(&key), int(unsafe.Sizeof(key)))
+
+	assert.Equal(t, "Program", ObjectProgram.String())
+	assert.Equal(t, "Unknown", ObjectKind(0).String())
+}
+
+func TestOpenRegistryNegative(t *testing.T) {
+	_, err := OpenRegistry("/sys/fs/bpf/registry", Owner{})
+	assert.Error(t, err)
+	_, err = OpenRegistry("/sys/fs/bpf/registry", Owner{Name: "owner_name_longer_than_32_characters"})
+	assert.Error(t, err)
+}
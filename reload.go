@@ -0,0 +1,85 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import "fmt"
+
+// Programs which are able to move their attachments (interface, socket, events)
+// to another program of the same type, used by Reload()
+type attachmentMover interface {
+	isAttached() bool
+	moveAttachments(to Program) error
+}
+
+// Reload replaces maps / programs of system by ones from ELF file fn
+// without losing data or dropping traffic:
+//   - Maps with the same name and definition are re-used (so data survives),
+//     pinned maps are re-opened by PersistentPath as usual
+//   - All programs from new ELF are loaded into kernel (concurrently, see WithLoadParallelism())
+//   - Every attached program is replaced by new program with the same name,
+//     XDP and socket filter programs are replaced atomically
+//   - Old programs and maps which are not used anymore are closed
+//
+// In case of any failure everything is rolled back: old programs stay attached
+// and system keeps previous maps / programs.
+func (s *ebpfSystem) Reload(fn string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.parseOnly {
+		return &NotSupportedError{Feature: "Reload in parse only mode"}
+	}
+
+	maps, programs, err := s.readElf(fn, s.Maps)
+	if err != nil {
+		return err
+	}
+	rollback := func() {
+		for _, prog := range programs {
+			prog.Close()
+		}
+		closeMaps(maps, s.Maps)
+	}
+
+	if _, err := LoadPrograms(programs, s.loadParallelism); err != nil {
+		rollback()
+		return err
+	}
+
+	// Move attachments from old programs to new ones
+	var moved []string
+	for name, old := range s.Programs {
+		mover, ok := old.(attachmentMover)
+		if !ok || !mover.isAttached() {
+			continue
+		}
+		prog, ok := programs[name]
+		if ok && prog.GetType() == old.GetType() {
+			err = mover.moveAttachments(prog)
+		} else {
+			err = fmt.Errorf("attached program '%s' (%v) not found", name, old.GetType())
+		}
+		if err != nil {
+			// Attach old programs back
+			for _, name := range moved {
+				programs[name].(attachmentMover).moveAttachments(s.Programs[name])
+			}
+			rollback()
+			return fmt.Errorf("Reload of program '%s' failed: %v", name, err)
+		}
+		s.logger.Printf("goebpf: attachments of program '%s' moved to new program", name)
+		moved = append(moved, name)
+	}
+
+	// New programs are in place, release old objects
+	for _, prog := range s.Programs {
+		prog.Close()
+	}
+	closeMaps(s.Maps, maps)
+	s.Maps = maps
+	s.Programs = programs
+	s.logger.Printf("goebpf: reloaded from '%s'", fn)
+
+	return nil
+}
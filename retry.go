@@ -0,0 +1,129 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"math/rand"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// RetryPolicy controls retrying of bpf(2) syscalls / netlink requests which
+// failed with transient error, e.g. ENOMEM / EAGAIN when many programs are
+// loaded at once (memory cgroup pressure, RCU freeing of previous objects
+// not completed yet). Only operations on objects (create / load / attach /
+// pin / get) are retried, never map element operations on hot paths.
+type RetryPolicy struct {
+	// Number of retries after first attempt, no retries if zero
+	MaxRetries int
+	// Delay before first retry, doubled for every next one up to MaxDelay
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	// Delay is randomized by up to this fraction (0..1) in both directions,
+	// so concurrent callers don't retry in lockstep
+	Jitter float64
+	// Errors worth retrying, EAGAIN / EINTR / ENOMEM if empty
+	Errnos []syscall.Errno
+}
+
+// DefaultRetryPolicy returns policy suitable for most agents:
+// up to 5 retries within ~1 second
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:   5,
+		InitialDelay: 20 * time.Millisecond,
+		MaxDelay:     500 * time.Millisecond,
+		Jitter:       0.2,
+	}
+}
+
+var defaultRetryErrnos = []syscall.Errno{syscall.EAGAIN, syscall.EINTR, syscall.ENOMEM}
+
+// Retry policy in effect, set by SetRetryPolicy()
+var retry = struct {
+	sync.RWMutex
+	policy RetryPolicy
+	// Replaced by tests
+	sleep func(time.Duration)
+}{sleep: time.Sleep}
+
+// SetRetryPolicy sets policy of retrying transient failures of bpf(2) syscalls
+// and netlink requests made by library. By default nothing is retried.
+//
+//	goebpf.SetRetryPolicy(goebpf.DefaultRetryPolicy())
+func SetRetryPolicy(policy RetryPolicy) {
+	retry.Lock()
+	defer retry.Unlock()
+
+	retry.policy = policy
+}
+
+// Checks if error is one policy retries
+func (p *RetryPolicy) retryable(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	errnos := p.Errnos
+	if len(errnos) == 0 {
+		errnos = defaultRetryErrnos
+	}
+	for _, item := range errnos {
+		if item == errno {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns delay before retry number attempt (starting from 0)
+func (p *RetryPolicy) delay(attempt int) time.Duration {
+	delay := p.InitialDelay
+	for i := 0; i < attempt && (p.MaxDelay == 0 || delay < p.MaxDelay); i++ {
+		delay *= 2
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if p.Jitter > 0 {
+		delay += time.Duration((rand.Float64()*2 - 1) * p.Jitter * float64(delay))
+	}
+	return delay
+}
+
+// RetryTransient runs op, retrying it according to retry policy while it fails
+// with transient error (see SetRetryPolicy()). Returns error of last attempt.
+// For extension packages making netlink requests / syscalls on their own.
+func RetryTransient(op func() error) error {
+	retry.RLock()
+	policy := retry.policy
+	sleep := retry.sleep
+	retry.RUnlock()
+
+	err := op()
+	for attempt := 0; attempt < policy.MaxRetries && err != nil && policy.retryable(err); attempt++ {
+		metrics.Add(MetricRetries, 1)
+		sleep(policy.delay(attempt))
+		err = op()
+	}
+	return err
+}
+
+// bpf(2) commands retried on transient errors: ones creating / attaching objects
+var bpfCmdRetryable = map[int]bool{
+	bpfCmdMapCreate:         true,
+	bpfCmdProgLoad:          true,
+	bpfCmdBtfLoad:           true,
+	bpfCmdObjPin:            true,
+	bpfCmdObjGet:            true,
+	bpfCmdProgAttach:        true,
+	bpfCmdProgDetach:        true,
+	bpfCmdRawTracepointOpen: true,
+	bpfCmdLinkCreate:        true,
+	bpfCmdLinkUpdate:        true,
+	bpfCmdLinkDetach:        true,
+	bpfCmdTokenCreate:       true,
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"expvar"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Sets retry policy for test, records delays instead of sleeping
+func withRetryPolicy(t *testing.T, policy RetryPolicy) *[]time.Duration {
+	var delays []time.Duration
+	retry.Lock()
+	retry.policy = policy
+	retry.sleep = func(d time.Duration) {
+		delays = append(delays, d)
+	}
+	retry.Unlock()
+	t.Cleanup(func() {
+		retry.Lock()
+		retry.policy = RetryPolicy{}
+		retry.sleep = time.Sleep
+		retry.Unlock()
+	})
+	return &delays
+}
+
+// Returns op failing with given errors, then succeeding
+func failingOp(errs ...error) (func() error, *int) {
+	calls := 0
+	return func() error {
+		calls++
+		if calls <= len(errs) {
+			return errs[calls-1]
+		}
+		return nil
+	}, &calls
+}
+
+func TestRetryTransient(t *testing.T) {
+	// Nothing is retried by default
+	op, calls := failingOp(syscall.EAGAIN)
+	assert.Equal(t, syscall.EAGAIN, RetryTransient(op))
+	assert.Equal(t, 1, *calls)
+
+	delays := withRetryPolicy(t, RetryPolicy{
+		MaxRetries:   3,
+		InitialDelay: 10 * time.Millisecond,
+		MaxDelay:     25 * time.Millisecond,
+	})
+	retries := func() int64 {
+		if v, ok := metrics.Get(MetricRetries).(*expvar.Int); ok {
+			return v.Value()
+		}
+		return 0
+	}
+	before := retries()
+
+	// Errors wrapped by library are recognized as well
+	op, calls = failingOp(syscall.EINTR, newSyscallError("ebpf_map_create()", syscall.ENOMEM, nil))
+	assert.NoError(t, RetryTransient(op))
+	assert.Equal(t, 3, *calls)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond}, *delays)
+	assert.Equal(t, before+2, retries())
+
+	// Limited number of retries, delay is capped
+	*delays = nil
+	op, calls = failingOp(syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN, syscall.EAGAIN)
+	assert.Equal(t, syscall.EAGAIN, RetryTransient(op))
+	assert.Equal(t, 4, *calls)
+	assert.Equal(t, []time.Duration{10 * time.Millisecond, 20 * time.Millisecond, 25 * time.Millisecond}, *delays)
+
+	// Permanent errors are returned right away
+	op, calls = failingOp(syscall.EPERM)
+	assert.Equal(t, syscall.EPERM, RetryTransient(op))
+	assert.Equal(t, 1, *calls)
+	op, calls = failingOp(errors.New("Some error"))
+	assert.Error(t, RetryTransient(op))
+	assert.Equal(t, 1, *calls)
+
+	// Custom set of errors
+	withRetryPolicy(t, RetryPolicy{MaxRetries: 3, Errnos: []syscall.Errno{syscall.EBUSY}})
+	op, calls = failingOp(syscall.EBUSY)
+	assert.NoError(t, RetryTransient(op))
+	assert.Equal(t, 2, *calls)
+	op, calls = failingOp(syscall.EAGAIN)
+	assert.Equal(t, syscall.EAGAIN, RetryTransient(op))
+	assert.Equal(t, 1, *calls)
+}
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := DefaultRetryPolicy()
+	for attempt := 0; attempt < p.MaxRetries; attempt++ {
+		base := p.InitialDelay << uint(attempt)
+		if base > p.MaxDelay {
+			base = p.MaxDelay
+		}
+		for i := 0; i < 20; i++ {
+			delay := p.delay(attempt)
+			assert.True(t, delay >= time.Duration(float64(base)*(1-p.Jitter)), "%v < %v", delay, base)
+			assert.True(t, delay <= time.Duration(float64(base)*(1+p.Jitter)), "%v > %v", delay, base)
+		}
+	}
+
+	// No cap
+	p = RetryPolicy{InitialDelay: time.Millisecond}
+	assert.Equal(t, 8*time.Millisecond, p.delay(3))
+}
@@ -0,0 +1,192 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Bits of ring buffer record header length, see linux/bpf.h
+const (
+	ringBufBusyBit    = 1 << 31
+	ringBufDiscardBit = 1 << 30
+	ringBufHeaderSize = 8
+)
+
+// ErrRingBufClosed is returned by RingBufReader.Read() once reader is closed
+var ErrRingBufClosed = errors.New("Ring buffer reader is closed")
+
+// RingBufReader reads records eBPF programs put into ring buffer map
+// (MapTypeRingBuf, linux 5.8+) by bpf_ringbuf_output() / bpf_ringbuf_submit():
+//
+//	m := &goebpf.EbpfMap{Name: "events", Type: goebpf.MapTypeRingBuf, MaxEntries: 1 << 20}
+//	...
+//	r, err := goebpf.NewRingBufReader(m)
+//	...
+//	for {
+//		record, err := r.Read()
+//		if err != nil {
+//			break
+//		}
+//		// process record
+//	}
+//
+// Read() may be called from single goroutine only, Close() - from any.
+// Latency sensitive consumers may enable busy polling, see SetBusyPoll().
+type RingBufReader struct {
+	// Guards memory mappings: held by Read() for the whole call
+	mu     sync.Mutex
+	closed int32
+	poller *fdPoller
+	// Time to poll for new records before blocking in epoll, see SetBusyPoll()
+	spinBudget int64
+
+	// Consumer page (writable) and producer page followed by data (mapped twice)
+	consumer []byte
+	producer []byte
+	data     []byte
+	mask     uint64
+}
+
+// NewRingBufReader creates reader of ring buffer map m
+func NewRingBufReader(m *EbpfMap) (*RingBufReader, error) {
+	if m.Type != MapTypeRingBuf {
+		return nil, fmt.Errorf("Map '%s' (%v) is not ring buffer", m.Name, m.Type)
+	}
+	fd := m.GetFd()
+	if fd == 0 {
+		return nil, fmt.Errorf("Map '%s' is not created", m.Name)
+	}
+	pageSize := os.Getpagesize()
+	size := m.MaxEntries
+
+	consumer, err := mmapFd(fd, 0, pageSize, true)
+	if err != nil {
+		return nil, newSyscallError("mmap()", err, nil)
+	}
+	// Data pages are mapped twice in a row, so records wrapping
+	// around end of buffer are contiguous in memory
+	producer, err := mmapFd(fd, int64(pageSize), pageSize+2*size, false)
+	if err != nil {
+		munmap(consumer)
+		return nil, newSyscallError("mmap()", err, nil)
+	}
+	poller, err := newFdPoller(fd)
+	if err != nil {
+		munmap(consumer)
+		munmap(producer)
+		return nil, newSyscallError("epoll()", err, nil)
+	}
+
+	return &RingBufReader{
+		poller:   poller,
+		consumer: consumer,
+		producer: producer,
+		data:     producer[pageSize:],
+		mask:     uint64(size - 1),
+	}, nil
+}
+
+// SetBusyPoll makes Read() poll ring buffer for new records up to budget
+// before blocking in epoll_wait(). It saves wakeup latency of records coming
+// in quick succession at the cost of CPU time. Zero budget (default) disables
+// busy polling. May be called at any time, affects next wait of Read().
+func (r *RingBufReader) SetBusyPoll(budget time.Duration) {
+	if budget < 0 {
+		budget = 0
+	}
+	atomic.StoreInt64(&r.spinBudget, int64(budget))
+}
+
+// Read returns next record, blocking until there is one.
+// Returns ErrRingBufClosed when reader has been closed.
+func (r *RingBufReader) Read() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var spinUntil time.Time
+	for {
+		if atomic.LoadInt32(&r.closed) != 0 {
+			return nil, ErrRingBufClosed
+		}
+		if record := r.next(); record != nil {
+			return record, nil
+		}
+		if budget := time.Duration(atomic.LoadInt64(&r.spinBudget)); budget > 0 {
+			now := time.Now()
+			if spinUntil.IsZero() {
+				spinUntil = now.Add(budget)
+			}
+			if now.Before(spinUntil) {
+				runtime.Gosched()
+				continue
+			}
+		}
+		if _, err := r.poller.wait(); err != nil {
+			return nil, newSyscallError("epoll_wait()", err, nil)
+		}
+		// Woken up by kernel: spin again before next wait
+		spinUntil = time.Time{}
+	}
+}
+
+// Returns copy of next committed record, nil if there is none
+func (r *RingBufReader) next() []byte {
+	consumerPos := (*uint64)(unsafe.Pointer(&r.consumer[0]))
+	producerPos := (*uint64)(unsafe.Pointer(&r.producer[0]))
+
+	cons := atomic.LoadUint64(consumerPos)
+	for cons < atomic.LoadUint64(producerPos) {
+		offset := cons & r.mask
+		header := atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.data[offset])))
+		if header&ringBufBusyBit != 0 {
+			// Reserved, but not yet submitted
+			return nil
+		}
+		size := uint64(header &^ (ringBufBusyBit | ringBufDiscardBit))
+		var record []byte
+		if header&ringBufDiscardBit == 0 {
+			start := offset + ringBufHeaderSize
+			record = make([]byte, size)
+			copy(record, r.data[start:start+size])
+			metrics.Add(MetricRingBufRecords, 1)
+		} else {
+			metrics.Add(MetricRingBufDiscarded, 1)
+		}
+		// Records are 8 bytes aligned
+		cons += (size + ringBufHeaderSize + 7) &^ 7
+		atomic.StoreUint64(consumerPos, cons)
+		if record != nil {
+			return record
+		}
+	}
+
+	return nil
+}
+
+// Close interrupts pending Read() and releases resources of reader.
+// Map itself is not closed.
+func (r *RingBufReader) Close() error {
+	if !atomic.CompareAndSwapInt32(&r.closed, 0, 1) {
+		return nil
+	}
+	r.poller.wakeup()
+
+	// Wait for Read() to return before unmapping memory it uses
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.poller.close()
+	munmap(r.consumer)
+	munmap(r.producer)
+
+	return nil
+}
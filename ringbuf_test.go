@@ -0,0 +1,106 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Ring buffer laid out in plain memory, the way kernel maps it
+type testRingBuf struct {
+	size     int
+	producer []byte
+	reader   *RingBufReader
+}
+
+func newTestRingBuf(size int) *testRingBuf {
+	const pageSize = 64
+	producer := make([]byte, pageSize+2*size)
+	return &testRingBuf{
+		size:     size,
+		producer: producer,
+		reader: &RingBufReader{
+			consumer: make([]byte, pageSize),
+			producer: producer,
+			data:     producer[pageSize:],
+			mask:     uint64(size - 1),
+		},
+	}
+}
+
+// Puts record like bpf_ringbuf_output() with flags of header
+func (rb *testRingBuf) put(record []byte, flags uint32) {
+	producerPos := (*uint64)(unsafe.Pointer(&rb.producer[0]))
+	pos := atomic.LoadUint64(producerPos)
+	data := rb.reader.data
+	offset := int(pos) & (rb.size - 1)
+	entry := make([]byte, ringBufHeaderSize+len(record))
+	hostByteOrder.PutUint32(entry, uint32(len(record))|flags)
+	copy(entry[ringBufHeaderSize:], record)
+	// Data pages are mapped twice
+	for i, b := range entry {
+		data[(offset+i)%rb.size] = b
+		data[rb.size+(offset+i)%rb.size] = b
+	}
+	// Committed like smp_store_release() of kernel
+	atomic.StoreUint64(producerPos, pos+uint64((len(entry)+7)&^7))
+}
+
+func TestRingBufReaderNext(t *testing.T) {
+	rb := newTestRingBuf(64)
+	assert.Nil(t, rb.reader.next())
+	records := getMetricValue(MetricRingBufRecords)
+	discarded := getMetricValue(MetricRingBufDiscarded)
+
+	rb.put([]byte("first"), 0)
+	rb.put([]byte("discarded"), ringBufDiscardBit)
+	rb.put([]byte("second"), 0)
+	assert.Equal(t, []byte("first"), rb.reader.next())
+	// Discarded records are skipped
+	assert.Equal(t, []byte("second"), rb.reader.next())
+	assert.Nil(t, rb.reader.next())
+	assert.Equal(t, uint64(56), hostByteOrder.Uint64(rb.reader.consumer))
+	assert.Equal(t, records+2, getMetricValue(MetricRingBufRecords))
+	assert.Equal(t, discarded+1, getMetricValue(MetricRingBufDiscarded))
+
+	// Record wrapping around end of buffer
+	rb.put([]byte("wrapped record"), 0)
+	assert.Equal(t, []byte("wrapped record"), rb.reader.next())
+
+	// Not yet submitted record blocks following ones
+	rb.put([]byte("busy"), ringBufBusyBit)
+	rb.put([]byte("after"), 0)
+	assert.Nil(t, rb.reader.next())
+}
+
+func TestRingBufReaderBusyPoll(t *testing.T) {
+	// Test reader has no poller: Read() must find record while spinning
+	rb := newTestRingBuf(64)
+	rb.reader.SetBusyPoll(time.Minute)
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		rb.put([]byte("record"), 0)
+	}()
+	record, err := rb.reader.Read()
+	require.NoError(t, err)
+	assert.Equal(t, []byte("record"), record)
+
+	// Close() interrupts spinning
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		atomic.StoreInt32(&rb.reader.closed, 1)
+	}()
+	_, err = rb.reader.Read()
+	assert.Equal(t, ErrRingBufClosed, err)
+
+	rb.reader.SetBusyPoll(-time.Second)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&rb.reader.spinBudget))
+}
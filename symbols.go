@@ -0,0 +1,135 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/dropbox/goebpf/goebpf_ksym"
+)
+
+// Max amount of similar names reported by SymbolNotFoundError
+const maxSymbolSuggestions = 5
+
+// Kernel symbols table is shared by all checks, it refreshes itself
+// when kernel modules are loaded / unloaded
+var (
+	kallsymsMu sync.Mutex
+	kallsyms   *goebpf_ksym.Table
+)
+
+func kernelSymbols() (*goebpf_ksym.Table, error) {
+	kallsymsMu.Lock()
+	defer kallsymsMu.Unlock()
+
+	if kallsyms == nil {
+		table, err := goebpf_ksym.NewTable()
+		if err != nil {
+			return nil, err
+		}
+		kallsyms = table
+	}
+
+	return kallsyms, nil
+}
+
+// CheckKernelSymbol checks that running kernel (or one of loaded modules)
+// has symbol, e.g. function to attach kprobe to, by /proc/kallsyms.
+// Returns *SymbolNotFoundError (matching ErrSymbolNotFound) with similar
+// symbols if not, so agents running on different kernels may skip
+// optional probes gracefully:
+//
+//	if err := goebpf.CheckKernelSymbol("tcp_v4_connect"); errors.Is(err, goebpf.ErrSymbolNotFound) {
+//		// probe is not available on this kernel
+//	}
+func CheckKernelSymbol(name string) error {
+	table, err := kernelSymbols()
+	if err != nil {
+		return err
+	}
+	if table.Exists(name) {
+		return nil
+	}
+
+	return &SymbolNotFoundError{
+		Symbol:      name,
+		Suggestions: similarSymbols(name, table.Names()),
+	}
+}
+
+// Returns up to maxSymbolSuggestions candidates closest to name: within small
+// edit distance, or containing name (e.g. "__x64_sys_" prefixed syscalls).
+func similarSymbols(name string, candidates []string) []string {
+	if name == "" {
+		return nil
+	}
+	type match struct {
+		name     string
+		distance int
+	}
+	maxDistance := len(name) / 4
+	if maxDistance < 1 {
+		maxDistance = 1
+	}
+	var matches []match
+	for _, c := range candidates {
+		if c == name {
+			continue
+		}
+		if strings.Contains(c, name) {
+			matches = append(matches, match{c, len(c) - len(name)})
+			continue
+		}
+		// Distance is at least difference of lengths, skip expensive calculation
+		if diff := len(c) - len(name); diff > maxDistance || -diff > maxDistance {
+			continue
+		}
+		if d := editDistance(name, c); d <= maxDistance {
+			matches = append(matches, match{c, d})
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if matches[i].distance != matches[j].distance {
+			return matches[i].distance < matches[j].distance
+		}
+		return matches[i].name < matches[j].name
+	})
+
+	var res []string
+	for idx := 0; idx < len(matches) && idx < maxSymbolSuggestions; idx++ {
+		res = append(res, matches[idx].name)
+	}
+	return res
+}
+
+// Levenshtein distance of a and b
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = minInt(minInt(prev[j]+1, cur[j-1]+1), prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(b)]
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
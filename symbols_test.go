@@ -0,0 +1,43 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEditDistance(t *testing.T) {
+	assert.Equal(t, 0, editDistance("", ""))
+	assert.Equal(t, 3, editDistance("abc", ""))
+	assert.Equal(t, 0, editDistance("tcp_connect", "tcp_connect"))
+	assert.Equal(t, 1, editDistance("tcp_conect", "tcp_connect"))
+	assert.Equal(t, 2, editDistance("tcp_sendmsg", "udp_sendmsg"))
+	assert.Equal(t, 3, editDistance("kitten", "sitting"))
+}
+
+func TestSimilarSymbols(t *testing.T) {
+	candidates := []string{
+		"tcp_connect",
+		"tcp_v4_connect",
+		"tcp_v6_connect",
+		"tcp_sendmsg",
+		"udp_sendmsg",
+		"__x64_sys_connect",
+		"do_sys_openat2",
+	}
+	assert.Equal(t, []string{"tcp_connect"}, similarSymbols("tcp_conect", candidates))
+	assert.Equal(t, []string{"tcp_sendmsg", "udp_sendmsg"}, similarSymbols("tcp_sendmsgs", candidates))
+	assert.Equal(t, []string{"__x64_sys_connect"}, similarSymbols("sys_connect", candidates))
+	assert.Equal(t, []string{"do_sys_openat2"}, similarSymbols("do_sys_openat", candidates))
+	assert.Empty(t, similarSymbols("xdp_do_redirect", candidates))
+	assert.Empty(t, similarSymbols("", candidates))
+
+	var many []string
+	for _, c := range "abcdefgh" {
+		many = append(many, "func_"+string(c))
+	}
+	assert.Equal(t, []string{"func_a", "func_b", "func_c", "func_d", "func_e"}, similarSymbols("func_x", many))
+}
@@ -0,0 +1,341 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"bytes"
+	"unsafe"
+)
+
+// bpf(2) commands, must be in sync with enum bpf_cmd from <linux/bpf.h>
+const (
+	bpfCmdMapCreate         = 0
+	bpfCmdMapLookupElem     = 1
+	bpfCmdMapUpdateElem     = 2
+	bpfCmdMapDeleteElem     = 3
+	bpfCmdMapGetNextKey     = 4
+	bpfCmdProgLoad          = 5
+	bpfCmdObjPin            = 6
+	bpfCmdObjGet            = 7
+	bpfCmdProgAttach        = 8
+	bpfCmdProgDetach        = 9
+	bpfCmdProgTestRun       = 10
+	bpfCmdProgGetNextId     = 11
+	bpfCmdMapGetNextId      = 12
+	bpfCmdProgGetFdById     = 13
+	bpfCmdMapGetFdById      = 14
+	bpfCmdObjGetInfoByFd    = 15
+	bpfCmdRawTracepointOpen = 17
+	bpfCmdBtfLoad           = 18
+	bpfCmdBtfGetFdById      = 19
+	bpfCmdMapFreeze         = 22
+	bpfCmdBtfGetNextId      = 23
+	bpfCmdMapLookupBatch    = 24
+	bpfCmdMapDeleteBatch    = 27
+	bpfCmdLinkCreate        = 28
+	bpfCmdLinkUpdate        = 29
+	bpfCmdLinkGetFdById     = 30
+	bpfCmdLinkGetNextId     = 31
+	bpfCmdLinkDetach        = 34
+	bpfCmdProgBindMap       = 35
+	bpfCmdTokenCreate       = 36
+	bpfObjNameLen           = 16 // BPF_OBJ_NAME_LEN
+	bpfTagSize              = 8  // BPF_TAG_SIZE
+	bpfLogLevelVerifierInfo = 1
+	bpfFTokenFd             = 1 << 16 // BPF_F_TOKEN_FD: attr has token fd set
+	bpfFReplace             = 1 << 2  // BPF_F_REPLACE: replace only if old program matches
+)
+
+// Parts of union bpf_attr used by library, one struct per command group.
+// Pointers are kept as bpfPointer, so referenced memory stays alive / is not moved
+// while syscall is in progress and layout is the same on 32 / 64 bit architectures.
+
+// BPF_MAP_CREATE
+type bpfMapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+	innerMapFd uint32
+	numaNode   uint32
+	mapName    [bpfObjNameLen]byte
+	mapIfindex uint32
+	// BTF of key / value, used only by maps with special fields (e.g. bpf_timer)
+	btfFd          uint32
+	btfKeyTypeId   uint32
+	btfValueTypeId uint32
+	_              [16]byte // btf_vmlinux_value_type_id, map_extra, value_type_btf_obj_fd
+	mapTokenFd     int32
+}
+
+// BPF_MAP_*_ELEM, BPF_MAP_GET_NEXT_KEY
+type bpfMapElemAttr struct {
+	mapFd uint32
+	_     uint32
+	key   bpfPointer
+	value bpfPointer // or next_key
+	flags uint64
+}
+
+// BPF_MAP_*_BATCH
+type bpfMapBatchAttr struct {
+	inBatch   bpfPointer
+	outBatch  bpfPointer
+	keys      bpfPointer
+	values    bpfPointer
+	count     uint32
+	mapFd     uint32
+	elemFlags uint64
+	flags     uint64
+}
+
+// BPF_PROG_LOAD
+type bpfProgLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       bpfPointer
+	license     bpfPointer
+	logLevel    uint32
+	logSize     uint32
+	logBuf      bpfPointer
+	kernVersion uint32
+	progFlags   uint32
+	progName    [bpfObjNameLen]byte
+	progIfindex uint32
+	// BPF_LSM_MAC etc., required by some program types to be known at load
+	expectedAttachType uint32
+	_                  [36]byte // prog_btf_fd ... line_info_cnt
+	attachBtfID        uint32   // BTF ID of kernel function to attach to
+	attachBtfObjFd     uint32   // BTF object of attachBtfID, 0 - vmlinux (5.11+)
+	_                  uint32   // core_relo_cnt
+	fdArray            bpfPointer
+	_                  [12]byte // core_relos, core_relo_rec_size
+	logTrueSize        uint32   // Log size needed, set by kernel (6.4+)
+	progTokenFd        int32
+}
+
+// BPF_PROG_ATTACH, BPF_PROG_DETACH
+type bpfProgAttachAttr struct {
+	targetFd    uint32
+	attachBpfFd uint32
+	attachType  uint32
+	attachFlags uint32
+}
+
+// BPF_LINK_CREATE
+type bpfLinkCreateAttr struct {
+	progFd     uint32
+	targetFd   uint32
+	attachType uint32
+	flags      uint32
+	// Union of link type specific fields, e.g. perf_event.bpf_cookie
+	data [16]byte
+}
+
+// BPF_LINK_UPDATE, BPF_LINK_DETACH
+type bpfLinkUpdateAttr struct {
+	linkFd    uint32
+	newProgFd uint32
+	flags     uint32
+	oldProgFd uint32
+}
+
+// BPF_PROG_TEST_RUN
+type bpfProgTestRunAttr struct {
+	progFd      uint32
+	retval      uint32
+	dataSizeIn  uint32
+	dataSizeOut uint32
+	dataIn      bpfPointer
+	dataOut     bpfPointer
+	repeat      uint32
+	duration    uint32
+	ctxSizeIn   uint32
+	ctxSizeOut  uint32
+	ctxIn       bpfPointer
+	ctxOut      bpfPointer
+	flags       uint32
+	cpu         uint32
+}
+
+// BPF_BTF_LOAD
+type bpfBtfLoadAttr struct {
+	btf            bpfPointer
+	btfLogBuf      bpfPointer
+	btfSize        uint32
+	btfLogSize     uint32
+	btfLogLevel    uint32
+	btfLogTrueSize uint32
+	btfFlags       uint32
+	btfTokenFd     int32
+}
+
+// BPF_PROG_BIND_MAP
+type bpfProgBindMapAttr struct {
+	progFd uint32
+	mapFd  uint32
+	flags  uint32
+}
+
+// BPF_TOKEN_CREATE
+type bpfTokenCreateAttr struct {
+	flags   uint32
+	bpffsFd uint32
+}
+
+// BPF_OBJ_PIN, BPF_OBJ_GET
+type bpfObjAttr struct {
+	pathname  bpfPointer
+	bpfFd     uint32
+	fileFlags uint32
+}
+
+// BPF_*_GET_NEXT_ID, BPF_*_GET_FD_BY_ID
+type bpfGetIdAttr struct {
+	id        uint32 // start_id / prog_id / map_id
+	nextId    uint32
+	openFlags uint32
+}
+
+// BPF_OBJ_GET_INFO_BY_FD
+type bpfObjInfoAttr struct {
+	bpfFd   uint32
+	infoLen uint32
+	info    bpfPointer
+}
+
+// Converts Go string into NULL terminated C string
+func cString(s string) unsafe.Pointer {
+	buf := make([]byte, len(s)+1)
+	copy(buf, s)
+	return unsafe.Pointer(&buf[0])
+}
+
+// Converts NULL terminated C string into Go string
+func goString(ptr unsafe.Pointer) string {
+	var buf bytes.Buffer
+	for i := uintptr(0); ptr != nil; i++ {
+		ch := *(*byte)(unsafe.Pointer(uintptr(ptr) + i))
+		if ch == 0 {
+			break
+		}
+		buf.WriteByte(ch)
+	}
+	return buf.String()
+}
+
+// Copies object name into fixed size array, truncating it if needed
+func objName(name string) [bpfObjNameLen]byte {
+	var res [bpfObjNameLen]byte
+	copy(res[:bpfObjNameLen-1], name)
+	return res
+}
+
+// Wrapper for BPF_OBJ_GET_INFO_BY_FD
+func ebpfObjGetInfoByFd(fd int, info []byte) error {
+	if err := ebpfObjGetInfo(fd, unsafe.Pointer(&info[0]), uintptr(len(info))); err != nil {
+		return newSyscallError("ebpf_obj_get_info_by_fd()", err, nil)
+	}
+	return nil
+}
+
+// Wrapper for BPF_OBJ_GET_INFO_BY_FD with info struct (which may hold
+// pointers to buffers), returns raw errno
+func ebpfObjGetInfo(fd int, info unsafe.Pointer, size uintptr) error {
+	attr := bpfObjInfoAttr{
+		bpfFd:   uint32(fd),
+		infoLen: uint32(size),
+		info:    newBpfPointer(info),
+	}
+	_, err := bpfSyscall(bpfCmdObjGetInfoByFd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// Wrapper for BPF_*_GET_FD_BY_ID commands
+func ebpfGetFdById(cmd int, op string, id int) (int, error) {
+	attr := bpfGetIdAttr{
+		id: uint32(id),
+	}
+	fd, err := bpfSyscall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return 0, newSyscallError(op, err, nil)
+	}
+	return fd, nil
+}
+
+// Wrapper for BPF_MAP_*_ELEM / BPF_MAP_GET_NEXT_KEY commands, returns raw errno
+func ebpfMapElemOp(cmd int, fd int, key, value unsafe.Pointer, flags uint64) error {
+	attr := bpfMapElemAttr{
+		mapFd: uint32(fd),
+		key:   newBpfPointer(key),
+		value: newBpfPointer(value),
+		flags: flags,
+	}
+	_, err := bpfSyscall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+// Wrapper for BPF_OBJ_GET, returns raw errno.
+// fileFlags restricts access of fd (bpfReadOnly / bpfWriteOnly).
+func ebpfObjGet(path string, fileFlags int) (int, error) {
+	attr := bpfObjAttr{
+		pathname:  newBpfPointer(cString(path)),
+		fileFlags: uint32(fileFlags),
+	}
+	return bpfSyscall(bpfCmdObjGet, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+// Reads IDs of maps used by program fd (via BPF_OBJ_GET_INFO_BY_FD)
+func ebpfObjGetInfoMaps(fd int, mapsNum int) ([]uint32, error) {
+	mapIds := make([]uint32, mapsNum)
+	// Beginning of struct bpf_prog_info, up to map_ids field
+	info := struct {
+		_        [52]byte
+		nrMapIds uint32
+		mapIds   bpfPointer
+	}{
+		nrMapIds: uint32(mapsNum),
+		mapIds:   newBpfPointer(unsafe.Pointer(&mapIds[0])),
+	}
+	attr := bpfObjInfoAttr{
+		bpfFd:   uint32(fd),
+		infoLen: uint32(unsafe.Sizeof(info)),
+		info:    newBpfPointer(unsafe.Pointer(&info)),
+	}
+	_, err := bpfSyscall(bpfCmdObjGetInfoByFd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, newSyscallError("ebpf_obj_get_info_maps()", err, nil)
+	}
+
+	return mapIds, nil
+}
+
+// Reads xlated / jited sizes of program fd (via BPF_OBJ_GET_INFO_BY_FD)
+func ebpfObjGetProgSizes(fd int) (int, int, error) {
+	// Beginning of struct bpf_prog_info, up to xlated_prog_len field
+	var info struct {
+		progType      uint32
+		id            uint32
+		tag           [bpfTagSize]byte
+		jitedProgLen  uint32
+		xlatedProgLen uint32
+	}
+	attr := bpfObjInfoAttr{
+		bpfFd:   uint32(fd),
+		infoLen: uint32(unsafe.Sizeof(info)),
+		info:    newBpfPointer(unsafe.Pointer(&info)),
+	}
+	_, err := bpfSyscall(bpfCmdObjGetInfoByFd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return 0, 0, newSyscallError("ebpf_obj_get_info_by_fd()", err, nil)
+	}
+
+	return int(info.xlatedProgLen), int(info.jitedProgLen), nil
+}
+
+// Wraps pointer into bpf_attr / bpf_*_info field
+func newBpfPointer(p unsafe.Pointer) bpfPointer {
+	return bpfPointer{ptr: p}
+}
@@ -0,0 +1,636 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package goebpf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"runtime"
+	"sort"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// There is no eBPF outside of Linux, so on other platforms (darwin, windows)
+// bpf(2) is emulated in process memory: maps are fully functional (create /
+// lookup / update / delete / iterate / pin), everything else (programs, BTF,
+// tokens) fails with EOPNOTSUPP, i.e. ErrNotSupported. This allows to develop
+// and run control plane logic on laptops before deploying to Linux.
+//
+// Pinned maps live as long as process does, bpffs paths are not touched.
+
+// In-process eBPF object (map)
+type emuMap struct {
+	id         int
+	mapType    MapType
+	keySize    int
+	valueSize  int
+	maxEntries int
+	flags      int
+	name       string
+	// Size of value as seen by user space: all CPUs for Per-CPU maps
+	valueRealSize int
+	// Number of fds / pins referring to map
+	refs int
+	// Elements, keys are kept sorted for get_next_key
+	data map[string][]byte
+	keys []string
+	// LRU maps: last use of element
+	used  map[string]uint64
+	clock uint64
+}
+
+var emu = struct {
+	sync.Mutex
+	fds  map[int]*emuMap
+	ids  map[int]*emuMap
+	pins map[string]*emuMap
+	// Access restrictions (bpfReadOnly / bpfWriteOnly) of fds
+	fdFlags map[int]int
+	nextFd  int
+	nextId  int
+}{
+	fds:     make(map[int]*emuMap),
+	ids:     make(map[int]*emuMap),
+	pins:    make(map[string]*emuMap),
+	fdFlags: make(map[int]int),
+	// Avoid collisions with stdin / stdout / stderr
+	nextFd: 100,
+}
+
+// Performs emulated bpf(2) syscall, returns result (usually fd) or errno
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	emu.Lock()
+	res, err := emuSyscall(cmd, attr)
+	emu.Unlock()
+
+	if err != nil {
+		countBpfSyscall(-1)
+		auditBpfSyscall(cmd, attr, -1, err)
+		return -1, err
+	}
+	countBpfSyscall(res)
+	auditBpfSyscall(cmd, attr, res, nil)
+	return res, nil
+}
+
+func emuSyscall(cmd int, attr unsafe.Pointer) (int, error) {
+	switch cmd {
+	case bpfCmdMapCreate:
+		return emuMapCreate((*bpfMapCreateAttr)(attr))
+	case bpfCmdMapLookupElem, bpfCmdMapUpdateElem, bpfCmdMapDeleteElem, bpfCmdMapGetNextKey:
+		a := (*bpfMapElemAttr)(attr)
+		m, ok := emu.fds[int(a.mapFd)]
+		if !ok {
+			return 0, syscall.EBADF
+		}
+		if !emuAccessAllowed(cmd, emu.fdFlags[int(a.mapFd)]) {
+			return 0, syscall.EPERM
+		}
+		return 0, m.elemOp(cmd, a)
+	case bpfCmdObjPin:
+		a := (*bpfObjAttr)(attr)
+		m, ok := emu.fds[int(a.bpfFd)]
+		if !ok {
+			return 0, syscall.EBADF
+		}
+		path := goString(a.pathname.ptr)
+		if _, ok := emu.pins[path]; ok {
+			return 0, syscall.EEXIST
+		}
+		emu.pins[path] = m
+		m.refs++
+		return 0, nil
+	case bpfCmdObjGet:
+		a := (*bpfObjAttr)(attr)
+		if a.fileFlags&^(bpfReadOnly|bpfWriteOnly) != 0 || a.fileFlags == bpfReadOnly|bpfWriteOnly {
+			return 0, syscall.EINVAL
+		}
+		m, ok := emu.pins[goString(a.pathname.ptr)]
+		if !ok {
+			return 0, syscall.ENOENT
+		}
+		fd := emuNewFd(m)
+		if a.fileFlags != 0 {
+			emu.fdFlags[fd] = int(a.fileFlags)
+		}
+		return fd, nil
+	case bpfCmdMapGetNextId:
+		a := (*bpfGetIdAttr)(attr)
+		next := 0
+		for id := range emu.ids {
+			if id > int(a.id) && (next == 0 || id < next) {
+				next = id
+			}
+		}
+		if next == 0 {
+			return 0, syscall.ENOENT
+		}
+		a.nextId = uint32(next)
+		return 0, nil
+	case bpfCmdMapGetFdById:
+		m, ok := emu.ids[int((*bpfGetIdAttr)(attr).id)]
+		if !ok {
+			return 0, syscall.ENOENT
+		}
+		return emuNewFd(m), nil
+	case bpfCmdProgGetNextId, bpfCmdProgGetFdById, bpfCmdLinkGetNextId, bpfCmdLinkGetFdById,
+		bpfCmdBtfGetNextId, bpfCmdBtfGetFdById:
+		// There are no programs / links / BTF objects
+		return 0, syscall.ENOENT
+	case bpfCmdObjGetInfoByFd:
+		a := (*bpfObjInfoAttr)(attr)
+		m, ok := emu.fds[int(a.bpfFd)]
+		if !ok {
+			return 0, syscall.EINVAL
+		}
+		m.info(emuBytes(a.info.ptr, int(a.infoLen)))
+		return 0, nil
+	case bpfCmdMapLookupBatch, bpfCmdMapDeleteBatch:
+		// Callers fall back to element by element operations
+		return 0, syscall.EINVAL
+	case bpfCmdBtfLoad:
+		// Rejected like by kernel without BTF support, maps are created without BTF
+		return 0, syscall.EINVAL
+	}
+
+	return 0, syscall.EOPNOTSUPP
+}
+
+func emuMapCreate(a *bpfMapCreateAttr) (int, error) {
+	if a.keySize == 0 || a.valueSize == 0 || a.maxEntries == 0 {
+		return 0, syscall.EINVAL
+	}
+	m := &emuMap{
+		mapType:       MapType(a.mapType),
+		keySize:       int(a.keySize),
+		valueSize:     int(a.valueSize),
+		maxEntries:    int(a.maxEntries),
+		flags:         int(a.mapFlags),
+		name:          NullTerminatedStringToString(a.mapName[:]),
+		valueRealSize: int(a.valueSize),
+		data:          make(map[string][]byte),
+		used:          make(map[string]uint64),
+	}
+	switch m.mapType {
+	case MapTypeQueue, MapTypeStack:
+		// No keys, elements are pushed / popped by dedicated commands
+		return 0, syscall.EOPNOTSUPP
+	case MapTypePerCPUArray, MapTypePerCPUHash, MapTypeLRUPerCPUHash, MapTypePerCpuCGroupStorage:
+		// Value of all CPUs, see EbpfMap.Create()
+		numCpus, err := GetNumOfPossibleCpus()
+		if err != nil {
+			return 0, err
+		}
+		m.valueRealSize = perCpuValueSize(m.valueSize) * numCpus
+	}
+	emu.nextId++
+	m.id = emu.nextId
+	emu.ids[m.id] = m
+
+	return emuNewFd(m), nil
+}
+
+// Checks whether element operation is allowed by access flags of fd
+func emuAccessAllowed(cmd int, flags int) bool {
+	switch cmd {
+	case bpfCmdMapLookupElem, bpfCmdMapGetNextKey:
+		return flags&bpfWriteOnly == 0
+	}
+	return flags&bpfReadOnly == 0
+}
+
+func emuNewFd(m *emuMap) int {
+	emu.nextFd++
+	emu.fds[emu.nextFd] = m
+	m.refs++
+	return emu.nextFd
+}
+
+// Converts C buffer into Go slice, without copying
+func emuBytes(ptr unsafe.Pointer, size int) []byte {
+	return (*[1 << 30]byte)(ptr)[:size:size]
+}
+
+func (m *emuMap) isArray() bool {
+	switch m.mapType {
+	case MapTypeArray, MapTypePerCPUArray, MapTypeProgArray, MapTypePerfEventArray,
+		MapTypeCgroupArray, MapTypeArrayOfMaps, MapTypeDevMap, MapTypeCPUMap,
+		MapTypeXSKMap, MapTypeSockMap, MapTypeReusePortSockArray:
+		return true
+	}
+	return false
+}
+
+func (m *emuMap) isLRU() bool {
+	return m.mapType == MapTypeLRUHash || m.mapType == MapTypeLRUPerCPUHash
+}
+
+// Fills struct bpf_map_info, see NewMapFromExistingMapByFd()
+func (m *emuMap) info(buf []byte) {
+	info := struct {
+		Type       uint32
+		Id         uint32
+		KeySize    uint32
+		ValueSize  uint32
+		MaxEntries uint32
+		Flags      uint32
+		Name       [bpfObjNameLen]byte
+	}{
+		Type:       uint32(m.mapType),
+		Id:         uint32(m.id),
+		KeySize:    uint32(m.keySize),
+		ValueSize:  uint32(m.valueSize),
+		MaxEntries: uint32(m.maxEntries),
+		Flags:      uint32(m.flags),
+		Name:       objName(m.name),
+	}
+	var out bytes.Buffer
+	binary.Write(&out, hostByteOrder, &info)
+	copy(buf, out.Bytes())
+}
+
+func (m *emuMap) elemOp(cmd int, a *bpfMapElemAttr) error {
+	var key []byte
+	if a.key.ptr != nil {
+		key = emuBytes(a.key.ptr, m.keySize)
+	}
+
+	switch cmd {
+	case bpfCmdMapLookupElem:
+		val, err := m.lookup(key)
+		if err != nil {
+			return err
+		}
+		copy(emuBytes(a.value.ptr, m.valueRealSize), val)
+		return nil
+	case bpfCmdMapUpdateElem:
+		return m.update(key, emuBytes(a.value.ptr, m.valueRealSize), a.flags&^bpfFLock)
+	case bpfCmdMapDeleteElem:
+		return m.delete(key)
+	}
+	next, err := m.nextKey(key)
+	if err != nil {
+		return err
+	}
+	copy(emuBytes(a.value.ptr, m.keySize), next)
+	return nil
+}
+
+// Returns index of array element, checking bounds
+func (m *emuMap) arrayIndex(key []byte) (int, error) {
+	idx := int(hostByteOrder.Uint32(append(append([]byte(nil), key...), 0, 0, 0, 0)))
+	if idx >= m.maxEntries {
+		return 0, syscall.ENOENT
+	}
+	return idx, nil
+}
+
+func (m *emuMap) lookup(key []byte) ([]byte, error) {
+	if m.isArray() {
+		if _, err := m.arrayIndex(key); err != nil {
+			return nil, err
+		}
+		if val, ok := m.data[string(key)]; ok {
+			return val, nil
+		}
+		return make([]byte, m.valueRealSize), nil
+	}
+	if m.mapType == MapTypeLPMTrie {
+		key = m.lpmMatch(key)
+	}
+	val, ok := m.data[string(key)]
+	if !ok {
+		return nil, syscall.ENOENT
+	}
+	m.touch(string(key))
+
+	return val, nil
+}
+
+// Finds longest prefix element matching key, nil if there is none.
+// Key of LPM trie is 4 byte prefix length followed by data
+func (m *emuMap) lpmMatch(key []byte) []byte {
+	prefixLen := int(hostByteOrder.Uint32(key))
+	var best []byte
+	bestLen := -1
+	for _, k := range m.keys {
+		candidate := []byte(k)
+		candidateLen := int(hostByteOrder.Uint32(candidate))
+		if candidateLen > prefixLen || candidateLen <= bestLen ||
+			!prefixEqual(candidate[4:], key[4:], candidateLen) {
+			continue
+		}
+		best, bestLen = candidate, candidateLen
+	}
+
+	return best
+}
+
+// Checks if first bits of a and b are equal
+func prefixEqual(a, b []byte, bits int) bool {
+	full := bits / 8
+	if !bytes.Equal(a[:full], b[:full]) {
+		return false
+	}
+	if rest := uint(bits % 8); rest != 0 {
+		mask := byte(0xff << (8 - rest))
+		return a[full]&mask == b[full]&mask
+	}
+	return true
+}
+
+func (m *emuMap) update(key, value []byte, flags uint64) error {
+	if flags > bpfExist {
+		return syscall.EINVAL
+	}
+	if m.isArray() {
+		if _, err := m.arrayIndex(key); err != nil {
+			return syscall.E2BIG
+		}
+		if flags == bpfNoexist {
+			// Elements of arrays always exist
+			return syscall.EEXIST
+		}
+		if _, ok := m.data[string(key)]; !ok {
+			m.insertKey(string(key))
+		}
+		m.data[string(key)] = append([]byte(nil), value...)
+		return nil
+	}
+	if m.mapType == MapTypeLPMTrie && int(hostByteOrder.Uint32(key)) > (m.keySize-4)*8 {
+		return syscall.EINVAL
+	}
+
+	_, exists := m.data[string(key)]
+	switch {
+	case flags == bpfExist && !exists:
+		return syscall.ENOENT
+	case flags == bpfNoexist && exists:
+		return syscall.EEXIST
+	case !exists && len(m.data) >= m.maxEntries:
+		if !m.isLRU() {
+			return syscall.E2BIG
+		}
+		m.evict()
+	}
+	if !exists {
+		m.insertKey(string(key))
+	}
+	m.data[string(key)] = append([]byte(nil), value...)
+	m.touch(string(key))
+
+	return nil
+}
+
+func (m *emuMap) delete(key []byte) error {
+	if m.isArray() {
+		return syscall.EINVAL
+	}
+	if _, ok := m.data[string(key)]; !ok {
+		return syscall.ENOENT
+	}
+	m.deleteKey(string(key))
+
+	return nil
+}
+
+// Like kernel: nil or non existing key means the first one
+func (m *emuMap) nextKey(key []byte) ([]byte, error) {
+	if m.isArray() {
+		next := 0
+		if key != nil {
+			if idx, err := m.arrayIndex(key); err == nil {
+				next = idx + 1
+			}
+		}
+		if next >= m.maxEntries {
+			return nil, syscall.ENOENT
+		}
+		res := make([]byte, 4)
+		hostByteOrder.PutUint32(res, uint32(next))
+		return res[:m.keySize], nil
+	}
+
+	idx := 0
+	if key != nil {
+		if _, ok := m.data[string(key)]; ok {
+			idx = sort.SearchStrings(m.keys, string(key)) + 1
+		}
+	}
+	if idx >= len(m.keys) {
+		return nil, syscall.ENOENT
+	}
+
+	return []byte(m.keys[idx]), nil
+}
+
+func (m *emuMap) insertKey(key string) {
+	idx := sort.SearchStrings(m.keys, key)
+	m.keys = append(m.keys, "")
+	copy(m.keys[idx+1:], m.keys[idx:])
+	m.keys[idx] = key
+}
+
+func (m *emuMap) deleteKey(key string) {
+	idx := sort.SearchStrings(m.keys, key)
+	m.keys = append(m.keys[:idx], m.keys[idx+1:]...)
+	delete(m.data, key)
+	delete(m.used, key)
+}
+
+func (m *emuMap) touch(key string) {
+	if m.isLRU() {
+		m.clock++
+		m.used[key] = m.clock
+	}
+}
+
+// Removes least recently used element
+func (m *emuMap) evict() {
+	var oldest string
+	for _, key := range m.keys {
+		if oldest == "" || m.used[key] < m.used[oldest] {
+			oldest = key
+		}
+	}
+	m.deleteKey(oldest)
+}
+
+// Drops reference to map, map is destroyed when the last one is gone
+func (m *emuMap) release() {
+	m.refs--
+	if m.refs == 0 {
+		delete(emu.ids, m.id)
+	}
+}
+
+// Closes emulated fd
+func closeFd(fd int) error {
+	auditCloseFd(fd)
+	emu.Lock()
+	defer emu.Unlock()
+
+	m, ok := emu.fds[fd]
+	if !ok {
+		return newSyscallError("close()", syscall.EBADF, nil)
+	}
+	delete(emu.fds, fd)
+	delete(emu.fdFlags, fd)
+	m.release()
+
+	return nil
+}
+
+// Pinned maps are kept in memory, no directories needed
+func makePinDir(path string) error {
+	return nil
+}
+
+// Removes pinned map
+func unpinObject(path string) error {
+	emu.Lock()
+	defer emu.Unlock()
+
+	m, ok := emu.pins[path]
+	if !ok {
+		return fmt.Errorf("remove %s: %v", path, syscall.ENOENT)
+	}
+	delete(emu.pins, path)
+	m.release()
+
+	return nil
+}
+
+// Atomically replaces pinned map newPath by one pinned at oldPath
+func renamePinned(oldPath, newPath string) error {
+	emu.Lock()
+	defer emu.Unlock()
+
+	m, ok := emu.pins[oldPath]
+	if !ok {
+		return fmt.Errorf("rename %s: %v", oldPath, syscall.ENOENT)
+	}
+	if replaced, ok := emu.pins[newPath]; ok {
+		replaced.release()
+	}
+	delete(emu.pins, oldPath)
+	emu.pins[newPath] = m
+
+	return nil
+}
+
+// Process start time is as good as system boot time, nothing is loaded by kernel anyway
+var emuStartTime = time.Now().Unix()
+
+func getSystemBootTimestamp() int64 {
+	return emuStartTime
+}
+
+func getMonotonicClockOffset() int64 {
+	return emuStartTime * int64(time.Second)
+}
+
+// Monotonic / boot time clocks start along with process
+func getClockTime(clock ClockSource) uint64 {
+	now := time.Now().UnixNano()
+	if clock == ClockRealtime {
+		return uint64(now)
+	}
+	return uint64(now - getMonotonicClockOffset())
+}
+
+func getKernelRelease() (string, error) {
+	return "", fmt.Errorf("eBPF is not supported on %s", runtime.GOOS)
+}
+
+func readPossibleCpus() (string, error) {
+	return fmt.Sprintf("0-%d", runtime.NumCPU()-1), nil
+}
+
+func readOnlineCpus() (string, error) {
+	return readPossibleCpus()
+}
+
+func openDir(path string) (int, error) {
+	return 0, syscall.EOPNOTSUPP
+}
+
+func openReadOnly(path string) (int, error) {
+	return 0, syscall.EOPNOTSUPP
+}
+
+func lwtRouteReplace(progType ProgramType, progFd int, progName string, params *LwtAttachParams) error {
+	return syscall.EOPNOTSUPP
+}
+
+func lwtRouteDelete(params *LwtAttachParams) error {
+	return syscall.EOPNOTSUPP
+}
+
+func queryXdpDevice(info *XdpDeviceInfo) error {
+	return syscall.EOPNOTSUPP
+}
+
+func getNicChannels(ifname string) (*NicChannels, error) {
+	return nil, syscall.EOPNOTSUPP
+}
+
+func getNicRss(ifname string) (*NicRss, error) {
+	return nil, syscall.EOPNOTSUPP
+}
+
+func setsockoptInt(fd, opt, value int) error {
+	return syscall.EOPNOTSUPP
+}
+
+func perfEventOpen(params *PerfEventAttachParams, cpu int) (int, error) {
+	return 0, syscall.EOPNOTSUPP
+}
+
+func uprobeEventOpen(pmuType uint32, config uint64, path string, offset uint64, pid int) (int, error) {
+	return 0, syscall.EOPNOTSUPP
+}
+
+func perfEventSetBpf(fd, progFd int) error {
+	return syscall.EOPNOTSUPP
+}
+
+func perfEventEnable(fd int) error {
+	return syscall.EOPNOTSUPP
+}
+
+func perfEventDisable(fd int) error {
+	return syscall.EOPNOTSUPP
+}
+
+func mmapFd(fd int, offset int64, length int, writable bool) ([]byte, error) {
+	return nil, syscall.EOPNOTSUPP
+}
+
+func munmap(data []byte) error {
+	return syscall.EOPNOTSUPP
+}
+
+type fdPoller struct{}
+
+func newFdPoller(fd int) (*fdPoller, error) {
+	return nil, syscall.EOPNOTSUPP
+}
+
+func (p *fdPoller) wait() (bool, error) {
+	return false, syscall.EOPNOTSUPP
+}
+
+func (p *fdPoller) wakeup() error {
+	return syscall.EOPNOTSUPP
+}
+
+func (p *fdPoller) close() {}
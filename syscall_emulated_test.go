@@ -0,0 +1,198 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+//go:build !linux
+// +build !linux
+
+package goebpf
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEmulatedMapHash(t *testing.T) {
+	m := &EbpfMap{
+		Name:       "hash",
+		Type:       MapTypeHash,
+		KeySize:    4,
+		ValueSize:  8,
+		MaxEntries: 2,
+	}
+	require.NoError(t, m.Create())
+	defer m.Close()
+
+	require.NoError(t, m.Insert(1, 100))
+	assert.Error(t, m.Insert(1, 100))
+	assert.Error(t, m.Update(2, 200))
+	require.NoError(t, m.Upsert(2, 200))
+	err := m.Upsert(3, 300)
+	require.IsType(t, &SyscallError{}, err)
+	assert.Equal(t, ErrMapFull, err.(*SyscallError).Cause())
+
+	val, err := m.LookupInt(2)
+	require.NoError(t, err)
+	assert.Equal(t, 200, val)
+
+	keys := 0
+	for key, err := m.GetNextKey(nil); err == nil; key, err = m.GetNextKey(key) {
+		keys++
+	}
+	assert.Equal(t, 2, keys)
+
+	require.NoError(t, m.Delete(1))
+	_, err = m.Lookup(1)
+	require.IsType(t, &SyscallError{}, err)
+	assert.Equal(t, ErrKeyNotExist, err.(*SyscallError).Cause())
+
+	// Batch delete falls back to element by element one
+	deleted, err := m.DeleteBatch([][]byte{{1, 0, 0, 0}, {2, 0, 0, 0}})
+	require.NoError(t, err)
+	assert.Equal(t, 1, deleted)
+}
+
+func TestEmulatedMapArray(t *testing.T) {
+	m := &EbpfMap{
+		Type:       MapTypePerCPUArray,
+		ValueSize:  4,
+		MaxEntries: 10,
+	}
+	require.NoError(t, m.Create())
+	defer m.Close()
+
+	val, err := m.LookupUint64(9)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), val)
+	// Value of every CPU is aligned to 8 bytes, like by kernel
+	numCpus, err := GetNumOfPossibleCpus()
+	require.NoError(t, err)
+	value := make([]byte, 8*numCpus)
+	for idx := range value {
+		value[idx] = byte(idx + 1)
+	}
+	require.NoError(t, m.Upsert(9, value))
+	raw, err := m.Lookup(9)
+	require.NoError(t, err)
+	assert.Equal(t, value, raw)
+	_, err = m.Lookup(10)
+	assert.Error(t, err)
+	assert.Error(t, m.Delete(1))
+	assert.Error(t, m.Insert(1, 1))
+}
+
+func TestEmulatedMapLPMTrie(t *testing.T) {
+	m := &EbpfMap{
+		Type:       MapTypeLPMTrie,
+		KeySize:    8,
+		ValueSize:  4,
+		MaxEntries: 10,
+	}
+	require.NoError(t, m.Create())
+	defer m.Close()
+
+	require.NoError(t, m.Insert(CreateLPMtrieKey("10.0.0.0/8"), 8))
+	require.NoError(t, m.Insert(CreateLPMtrieKey("10.1.0.0/16"), 16))
+
+	val, err := m.LookupInt(CreateLPMtrieKey("10.1.2.3/32"))
+	require.NoError(t, err)
+	assert.Equal(t, 16, val)
+	val, err = m.LookupInt(CreateLPMtrieKey("10.2.2.3/32"))
+	require.NoError(t, err)
+	assert.Equal(t, 8, val)
+	_, err = m.Lookup(&net.IPNet{IP: net.IPv4(11, 0, 0, 1), Mask: net.CIDRMask(32, 32)})
+	assert.Error(t, err)
+}
+
+func TestEmulatedMapPin(t *testing.T) {
+	m := &EbpfMap{
+		Type:           MapTypeHash,
+		KeySize:        4,
+		ValueSize:      4,
+		MaxEntries:     10,
+		PersistentPath: "/sys/fs/bpf/emulated",
+	}
+	require.NoError(t, m.Create())
+	require.NoError(t, m.Upsert(1, 1))
+	require.NoError(t, m.Close())
+
+	// Pinned map outlives its fd
+	clone := m.CloneTemplate().(*EbpfMap)
+	require.NoError(t, clone.Create())
+	defer clone.Close()
+	val, err := clone.LookupInt(1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, val)
+}
+
+func TestEmulatedOpenPinnedMap(t *testing.T) {
+	m := &EbpfMap{
+		Type:           MapTypeHash,
+		KeySize:        4,
+		ValueSize:      4,
+		MaxEntries:     10,
+		PersistentPath: "/sys/fs/bpf/emulated_access",
+	}
+	require.NoError(t, m.Create())
+	defer m.Close()
+	require.NoError(t, m.Upsert(1, 1))
+
+	ro, err := OpenPinnedMap(m.PersistentPath, MapAccessReadOnly)
+	require.NoError(t, err)
+	defer ro.Close()
+	val, err := ro.LookupInt(1)
+	require.NoError(t, err)
+	assert.Equal(t, 1, val)
+	assert.True(t, errors.Is(ro.Upsert(2, 2), ErrPermission))
+	assert.True(t, errors.Is(ro.Delete(1), ErrPermission))
+
+	wo, err := OpenPinnedMap(m.PersistentPath, MapAccessWriteOnly)
+	require.NoError(t, err)
+	defer wo.Close()
+	require.NoError(t, wo.Upsert(2, 2))
+	_, err = wo.LookupInt(2)
+	assert.True(t, errors.Is(err, ErrPermission))
+	val, err = m.LookupInt(2)
+	require.NoError(t, err)
+	assert.Equal(t, 2, val)
+
+	_, err = OpenPinnedMap(m.PersistentPath, MapAccessReadOnly|MapAccessWriteOnly)
+	assert.Error(t, err)
+	_, err = OpenPinnedMap("/sys/fs/bpf/emulated_missing", MapAccessReadOnly)
+	assert.True(t, errors.Is(err, ErrKeyNotExist))
+}
+
+func TestEmulatedMapMigration(t *testing.T) {
+	m := &EbpfMap{
+		Type:           MapTypeHash,
+		KeySize:        4,
+		ValueSize:      4,
+		MaxEntries:     10,
+		PersistentPath: "/sys/fs/bpf/emulated_migration",
+	}
+	require.NoError(t, m.Create())
+	defer m.Close()
+	require.NoError(t, m.Upsert(1, 1))
+
+	migrated := m.CloneTemplate().(*EbpfMap)
+	migrated.ValueSize = 8
+	migrated.PinPolicy = MapPinMigrate
+	migrated.Migrate = func(from *MapMigration, key, value []byte) ([]byte, []byte, error) {
+		return key, append(value, 0, 0, 0, 0), nil
+	}
+	require.NoError(t, migrated.Create())
+	defer migrated.Close()
+	val, err := migrated.LookupUint64(1)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), val)
+}
+
+func TestEmulatedProgramLoad(t *testing.T) {
+	prog := newXdpProgram("xdp", "GPL", make([]byte, bpfInstructionLen))
+	err := prog.Load()
+	require.IsType(t, &SyscallError{}, err)
+	assert.Equal(t, ErrNotSupported, err.(*SyscallError).Cause())
+}
@@ -0,0 +1,605 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"syscall"
+	"unsafe"
+
+	"github.com/vishvananda/netlink"
+	"github.com/vishvananda/netlink/nl"
+	"golang.org/x/sys/unix"
+
+	"github.com/dropbox/goebpf/goebpf_perf"
+)
+
+func init() {
+	// Ask kernel for extended ACK of netlink requests, so errors come with
+	// message explaining them (e.g. "MTU too large w/ XDP enabled")
+	// instead of bare errno, see newNetlinkError()
+	nl.EnableErrorMessageReporting = true
+}
+
+// Performs bpf(2) syscall, returns result (usually fd) or errno.
+// Object operations are retried according to retry policy.
+func bpfSyscall(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	if !bpfCmdRetryable[cmd] {
+		return bpfSyscallOnce(cmd, attr, size)
+	}
+	var res int
+	err := RetryTransient(func() error {
+		var err error
+		res, err = bpfSyscallOnce(cmd, attr, size)
+		return err
+	})
+	return res, err
+}
+
+func bpfSyscallOnce(cmd int, attr unsafe.Pointer, size uintptr) (int, error) {
+	res, _, errno := unix.Syscall(unix.SYS_BPF, uintptr(cmd), uintptr(attr), size)
+	if errno != 0 {
+		countBpfSyscall(-1)
+		auditBpfSyscall(cmd, attr, -1, errno)
+		return -1, errno
+	}
+	countBpfSyscall(int(res))
+	auditBpfSyscall(cmd, attr, int(res), nil)
+	return int(res), nil
+}
+
+// Helper to close linux file descriptor
+func closeFd(fd int) error {
+	auditCloseFd(fd)
+	if err := unix.Close(fd); err != nil {
+		return newSyscallError("close()", err, nil)
+	}
+	return nil
+}
+
+// Returns system's boot timestamp (in seconds since epoch)
+func getSystemBootTimestamp() int64 {
+	var realTime, bootTime unix.Timespec
+
+	unix.ClockGettime(unix.CLOCK_REALTIME, &realTime)
+	unix.ClockGettime(unix.CLOCK_BOOTTIME, &bootTime)
+
+	return int64(realTime.Sec - bootTime.Sec)
+}
+
+// Returns difference between CLOCK_REALTIME and CLOCK_MONOTONIC (in nanoseconds)
+func getMonotonicClockOffset() int64 {
+	var realTime, monoTime unix.Timespec
+
+	unix.ClockGettime(unix.CLOCK_REALTIME, &realTime)
+	unix.ClockGettime(unix.CLOCK_MONOTONIC, &monoTime)
+
+	return realTime.Nano() - monoTime.Nano()
+}
+
+// Returns current time of clock, in nanoseconds
+func getClockTime(clock ClockSource) uint64 {
+	var ts unix.Timespec
+
+	switch clock {
+	case ClockBoottime:
+		unix.ClockGettime(unix.CLOCK_BOOTTIME, &ts)
+	case ClockRealtime:
+		unix.ClockGettime(unix.CLOCK_REALTIME, &ts)
+	default:
+		unix.ClockGettime(unix.CLOCK_MONOTONIC, &ts)
+	}
+
+	return uint64(ts.Nano())
+}
+
+// Returns release of running kernel, e.g. "5.15.0-91-generic"
+func getKernelRelease() (string, error) {
+	var uts unix.Utsname
+	if err := unix.Uname(&uts); err != nil {
+		return "", err
+	}
+	return NullTerminatedStringToString(uts.Release[:]), nil
+}
+
+// Returns list of possible CPUs, e.g. "0-7"
+func readPossibleCpus() (string, error) {
+	data, err := ioutil.ReadFile("/sys/devices/system/cpu/possible")
+	return string(data), err
+}
+
+// Returns list of online CPUs, e.g. "0-3,6"
+func readOnlineCpus() (string, error) {
+	data, err := ioutil.ReadFile("/sys/devices/system/cpu/online")
+	return string(data), err
+}
+
+// Creates directory (along with parents) on bpffs to pin objects into
+func makePinDir(path string) error {
+	return os.MkdirAll(path, 0755)
+}
+
+// Removes object pinned at path of bpffs
+func unpinObject(path string) error {
+	return os.Remove(path)
+}
+
+// Atomically replaces pinned object newPath by one pinned at oldPath
+func renamePinned(oldPath, newPath string) error {
+	return os.Rename(oldPath, newPath)
+}
+
+// Opens directory, e.g. bpffs mount point
+func openDir(path string) (int, error) {
+	return unix.Open(path, unix.O_RDONLY|unix.O_DIRECTORY, 0)
+}
+
+// Opens file read only, e.g. network namespace
+func openReadOnly(path string) (int, error) {
+	return unix.Open(path, unix.O_RDONLY|unix.O_CLOEXEC, 0)
+}
+
+// Route lightweight tunnel program is attached by, without encapsulation
+func lwtRoute(params *LwtAttachParams) (*netlink.Route, error) {
+	_, dst, err := net.ParseCIDR(params.Dst)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid route destination '%s': %v", params.Dst, err)
+	}
+	route := &netlink.Route{
+		Dst:   dst,
+		Table: params.Table,
+	}
+	if params.Device != "" {
+		link, err := netlink.LinkByName(params.Device)
+		RecordAudit(AuditSourceNetlink, "LinkByName", params.Device, err)
+		if err != nil {
+			return nil, fmt.Errorf("LinkByName() failed: %v", err)
+		}
+		route.LinkIndex = link.Attrs().Index
+	}
+	if params.Gateway != "" {
+		if route.Gw = net.ParseIP(params.Gateway); route.Gw == nil {
+			return nil, fmt.Errorf("Invalid gateway '%s'", params.Gateway)
+		}
+	}
+
+	return route, nil
+}
+
+// Adds (or replaces) route with BPF encapsulation running program
+func lwtRouteReplace(progType ProgramType, progFd int, progName string, params *LwtAttachParams) error {
+	route, err := lwtRoute(params)
+	if err != nil {
+		return err
+	}
+	if progType == ProgramTypeLwtSeg6Local {
+		encap := &netlink.SEG6LocalEncap{Action: nl.SEG6_LOCAL_ACTION_END_BPF}
+		encap.Flags[nl.SEG6_LOCAL_ACTION] = true
+		encap.Flags[nl.SEG6_LOCAL_BPF] = true
+		if err = encap.SetProg(progFd, progName); err != nil {
+			return err
+		}
+		route.Encap = encap
+	} else {
+		modes := map[ProgramType]int{
+			ProgramTypeLwtIn:   nl.LWT_BPF_IN,
+			ProgramTypeLwtOut:  nl.LWT_BPF_OUT,
+			ProgramTypeLwtXmit: nl.LWT_BPF_XMIT,
+		}
+		encap := &netlink.BpfEncap{}
+		if err = encap.SetProg(modes[progType], progFd, progName); err != nil {
+			return err
+		}
+		if params.Headroom > 0 {
+			if err = encap.SetXmitHeadroom(params.Headroom); err != nil {
+				return err
+			}
+		}
+		route.Encap = encap
+	}
+	err = RetryTransient(func() error {
+		err := netlink.RouteReplace(route)
+		RecordAudit(AuditSourceNetlink, "RouteReplace", params.Dst, err)
+		return err
+	})
+	if err != nil {
+		return newNetlinkError("RouteReplace()", err)
+	}
+
+	return nil
+}
+
+func lwtRouteDelete(params *LwtAttachParams) error {
+	route, err := lwtRoute(params)
+	if err != nil {
+		return err
+	}
+	err = RetryTransient(func() error {
+		err := netlink.RouteDel(route)
+		RecordAudit(AuditSourceNetlink, "RouteDel", params.Dst, err)
+		return err
+	})
+	if err != nil {
+		return newNetlinkError("RouteDel()", err)
+	}
+
+	return nil
+}
+
+// Generic netlink "netdev" family (kernel 6.3+): NETDEV_CMD_DEV_GET and attributes
+const (
+	netdevCmdDevGet       = 1
+	netdevAttrIfindex     = 1
+	netdevAttrXdpFeatures = 3
+)
+
+// Attributes of ETHTOOL_MSG_RSS_GET reply (kernel 6.0+), newer than x/sys
+const (
+	ethtoolAttrRssHfunc = 3
+	ethtoolAttrRssIndir = 4
+	ethtoolAttrRssHkey  = 5
+)
+
+// Generic netlink message header. Not nl.Genlmsg: it serializes 4 bytes
+// of 2 byte struct, so reserved field is garbage rejected by kernel.
+type genlHeader struct {
+	cmd     uint8
+	version uint8
+}
+
+func (h genlHeader) Len() int {
+	return nl.SizeofGenlmsg
+}
+
+func (h genlHeader) Serialize() []byte {
+	return []byte{h.cmd, h.version, 0, 0}
+}
+
+// Returns generic netlink family, nil if kernel is too old to have it
+func genlFamily(name string) *netlink.GenlFamily {
+	family, err := netlink.GenlFamilyGet(name)
+	if err != nil {
+		return nil
+	}
+	return family
+}
+
+// Sends generic netlink request, returns attributes of reply messages.
+// Op is name of request for errors / audit, object is device request is about.
+func genlRequest(family *netlink.GenlFamily, cmd uint8, op, object string, attrs ...*nl.RtAttr) ([][]syscall.NetlinkRouteAttr, error) {
+	req := nl.NewNetlinkRequest(int(family.ID), unix.NLM_F_ACK)
+	req.AddData(genlHeader{cmd: cmd, version: uint8(family.Version)})
+	for _, attr := range attrs {
+		req.AddData(attr)
+	}
+	msgs, err := req.Execute(unix.NETLINK_GENERIC, 0)
+	RecordAudit(AuditSourceNetlink, op, object, err)
+	if err != nil {
+		return nil, newNetlinkError(op, err)
+	}
+
+	var res [][]syscall.NetlinkRouteAttr
+	for _, m := range msgs {
+		parsed, err := nl.ParseRouteAttr(m[nl.SizeofGenlmsg:])
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, parsed)
+	}
+	return res, nil
+}
+
+// Request header of ethtool netlink messages, selecting device by name
+func ethtoolHeader(ifname string) *nl.RtAttr {
+	header := nl.NewRtAttr(unix.NLA_F_NESTED|unix.ETHTOOL_A_CHANNELS_HEADER, nil)
+	header.AddRtAttr(unix.ETHTOOL_A_HEADER_DEV_NAME, nl.ZeroTerminated(ifname))
+	return header
+}
+
+// Fills XDP device info with limits reported by netlink (IFLA_MAX_MTU),
+// netdev family of generic netlink (XDP features) and ethtool (driver, channels)
+func queryXdpDevice(info *XdpDeviceInfo) error {
+	req := nl.NewNetlinkRequest(unix.RTM_GETLINK, unix.NLM_F_ACK)
+	msg := nl.NewIfInfomsg(unix.AF_UNSPEC)
+	msg.Index = int32(info.Ifindex)
+	req.AddData(msg)
+	msgs, err := req.Execute(unix.NETLINK_ROUTE, unix.RTM_NEWLINK)
+	RecordAudit(AuditSourceNetlink, "LinkGet", info.Ifname, err)
+	if err != nil {
+		return newNetlinkError("RTM_GETLINK", err)
+	}
+	for _, m := range msgs {
+		attrs, err := nl.ParseRouteAttr(m[unix.SizeofIfInfomsg:])
+		if err != nil {
+			return err
+		}
+		for _, attr := range attrs {
+			if attr.Attr.Type == unix.IFLA_MAX_MTU && len(attr.Value) >= 4 {
+				info.MaxMTU = int(nl.NativeEndian().Uint32(attr.Value))
+			}
+		}
+	}
+
+	// Older kernels have no netdev family, features stay unknown
+	if family := genlFamily("netdev"); family != nil {
+		replies, err := genlRequest(family, netdevCmdDevGet, "NETDEV_CMD_DEV_GET", info.Ifname,
+			nl.NewRtAttr(netdevAttrIfindex, nl.Uint32Attr(uint32(info.Ifindex))))
+		if err != nil {
+			return err
+		}
+		for _, attrs := range replies {
+			for _, attr := range attrs {
+				if attr.Attr.Type == netdevAttrXdpFeatures && len(attr.Value) >= 8 {
+					info.Features = XdpFeatures(nl.NativeEndian().Uint64(attr.Value))
+					info.FeaturesKnown = true
+				}
+			}
+		}
+	}
+
+	// Virtual devices (e.g. loopback) may not implement ethtool at all
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return newSyscallError("socket()", err, nil)
+	}
+	defer unix.Close(fd)
+	if drvinfo, err := unix.IoctlGetEthtoolDrvinfo(fd, info.Ifname); err == nil {
+		info.Driver = NullTerminatedStringToString(drvinfo.Driver[:])
+	}
+	if channels, err := getNicChannels(info.Ifname); err == nil {
+		info.MaxChannels = channels.MaxCombined
+		info.Channels = channels.Combined
+	}
+
+	return nil
+}
+
+// Queries channels of device by ethtool netlink (kernel 5.6+) or by ioctl
+func getNicChannels(ifname string) (*NicChannels, error) {
+	family := genlFamily(unix.ETHTOOL_GENL_NAME)
+	if family == nil {
+		return getNicChannelsIoctl(ifname)
+	}
+	replies, err := genlRequest(family, unix.ETHTOOL_MSG_CHANNELS_GET, "ETHTOOL_MSG_CHANNELS_GET",
+		ifname, ethtoolHeader(ifname))
+	if err != nil {
+		return nil, err
+	}
+
+	res := &NicChannels{}
+	fields := map[uint16]*int{
+		unix.ETHTOOL_A_CHANNELS_RX_MAX:         &res.MaxRx,
+		unix.ETHTOOL_A_CHANNELS_TX_MAX:         &res.MaxTx,
+		unix.ETHTOOL_A_CHANNELS_OTHER_MAX:      &res.MaxOther,
+		unix.ETHTOOL_A_CHANNELS_COMBINED_MAX:   &res.MaxCombined,
+		unix.ETHTOOL_A_CHANNELS_RX_COUNT:       &res.Rx,
+		unix.ETHTOOL_A_CHANNELS_TX_COUNT:       &res.Tx,
+		unix.ETHTOOL_A_CHANNELS_OTHER_COUNT:    &res.Other,
+		unix.ETHTOOL_A_CHANNELS_COMBINED_COUNT: &res.Combined,
+	}
+	for _, attrs := range replies {
+		for _, attr := range attrs {
+			if field, ok := fields[attr.Attr.Type]; ok && len(attr.Value) >= 4 {
+				*field = int(nl.NativeEndian().Uint32(attr.Value))
+			}
+		}
+	}
+	return res, nil
+}
+
+// ETHTOOL_GCHANNELS ioctl, for kernels without ethtool netlink
+func getNicChannelsIoctl(ifname string) (*NicChannels, error) {
+	fd, err := unix.Socket(unix.AF_INET, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, newSyscallError("socket()", err, nil)
+	}
+	defer unix.Close(fd)
+
+	// struct ethtool_channels: cmd, max_{rx,tx,other,combined}, {rx,tx,other,combined}_count
+	channels := [9]uint32{unix.ETHTOOL_GCHANNELS}
+	if err = ethtoolIoctl(fd, ifname, unsafe.Pointer(&channels[0])); err != nil {
+		return nil, newSyscallError("ETHTOOL_GCHANNELS", err, nil)
+	}
+	return &NicChannels{
+		MaxRx:       int(channels[1]),
+		MaxTx:       int(channels[2]),
+		MaxOther:    int(channels[3]),
+		MaxCombined: int(channels[4]),
+		Rx:          int(channels[5]),
+		Tx:          int(channels[6]),
+		Other:       int(channels[7]),
+		Combined:    int(channels[8]),
+	}, nil
+}
+
+// Queries RSS configuration of device by ethtool netlink (kernel 6.0+)
+func getNicRss(ifname string) (*NicRss, error) {
+	family := genlFamily(unix.ETHTOOL_GENL_NAME)
+	if family == nil {
+		return nil, &NotSupportedError{Feature: "ethtool netlink"}
+	}
+	replies, err := genlRequest(family, unix.ETHTOOL_MSG_RSS_GET, "ETHTOOL_MSG_RSS_GET",
+		ifname, ethtoolHeader(ifname))
+	if err != nil {
+		return nil, err
+	}
+
+	res := &NicRss{}
+	for _, attrs := range replies {
+		for _, attr := range attrs {
+			switch attr.Attr.Type {
+			case ethtoolAttrRssHfunc:
+				if len(attr.Value) >= 4 {
+					res.HashFunc = RssHashFunc(nl.NativeEndian().Uint32(attr.Value))
+				}
+			case ethtoolAttrRssIndir:
+				for i := 0; i+4 <= len(attr.Value); i += 4 {
+					res.Indirection = append(res.Indirection, int(nl.NativeEndian().Uint32(attr.Value[i:])))
+				}
+			case ethtoolAttrRssHkey:
+				res.HashKey = append([]byte{}, attr.Value...)
+			}
+		}
+	}
+	return res, nil
+}
+
+// Performs SIOCETHTOOL ioctl with command structure data
+func ethtoolIoctl(fd int, ifname string, data unsafe.Pointer) error {
+	// struct ifreq: interface name and pointer to command
+	var ifr struct {
+		name [unix.IFNAMSIZ]byte
+		data unsafe.Pointer
+		_    [16]byte
+	}
+	copy(ifr.name[:unix.IFNAMSIZ-1], ifname)
+	ifr.data = data
+	_, _, errno := unix.Syscall(unix.SYS_IOCTL, uintptr(fd), unix.SIOCETHTOOL, uintptr(unsafe.Pointer(&ifr)))
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// Sets SOL_SOCKET level socket option
+func setsockoptInt(fd, opt, value int) error {
+	return unix.SetsockoptInt(fd, unix.SOL_SOCKET, opt, value)
+}
+
+// Opens perf event described by params on given CPU, returns raw errno
+func perfEventOpen(params *PerfEventAttachParams, cpu int) (int, error) {
+	ev, err := goebpf_perf.Open(&goebpf_perf.Attr{
+		Type:            params.Type,
+		Config:          params.Config,
+		SamplePeriod:    params.SamplePeriod,
+		SampleFrequency: params.SampleFrequency,
+		BpType:          params.BreakpointType,
+		Config1:         params.BreakpointAddr,
+		Config2:         params.BreakpointLen,
+	}, params.Pid, cpu, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	return ev.Fd(), nil
+}
+
+// Opens uprobe perf event of dynamic PMU pmuType at offset of binary path,
+// for process pid (0 means all processes), returns raw errno
+func uprobeEventOpen(pmuType uint32, config uint64, path string, offset uint64, pid int) (int, error) {
+	cpu := -1
+	if pid <= 0 {
+		// Program runs for hits on every CPU, even though event is per CPU one
+		pid = -1
+		cpu = 0
+	}
+	pathBytes := append([]byte(path), 0)
+	ev, err := goebpf_perf.Open(&goebpf_perf.Attr{
+		Type:         pmuType,
+		Config:       config,
+		SamplePeriod: 1,
+		Config1:      uint64(uintptr(unsafe.Pointer(&pathBytes[0]))),
+		Config2:      offset,
+	}, pid, cpu, nil)
+	// Kernel reads path during perf_event_open() only
+	runtime.KeepAlive(pathBytes)
+	if err != nil {
+		return 0, err
+	}
+
+	return ev.Fd(), nil
+}
+
+// Attaches eBPF program to perf event
+func perfEventSetBpf(fd, progFd int) error {
+	return unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_SET_BPF, progFd)
+}
+
+func perfEventEnable(fd int) error {
+	return unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_ENABLE, 0)
+}
+
+func perfEventDisable(fd int) error {
+	return unix.IoctlSetInt(fd, unix.PERF_EVENT_IOC_DISABLE, 0)
+}
+
+// Maps length bytes of object fd at offset into memory
+func mmapFd(fd int, offset int64, length int, writable bool) ([]byte, error) {
+	prot := unix.PROT_READ
+	if writable {
+		prot |= unix.PROT_WRITE
+	}
+	return unix.Mmap(fd, offset, length, prot, unix.MAP_SHARED)
+}
+
+func munmap(data []byte) error {
+	return unix.Munmap(data)
+}
+
+// Waits (by epoll) for fd to become readable, wait can be interrupted by wakeup()
+type fdPoller struct {
+	epollFd int
+	eventFd int
+}
+
+func newFdPoller(fd int) (*fdPoller, error) {
+	epollFd, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	eventFd, err := unix.Eventfd(0, unix.EFD_CLOEXEC|unix.EFD_NONBLOCK)
+	if err != nil {
+		unix.Close(epollFd)
+		return nil, err
+	}
+	p := &fdPoller{
+		epollFd: epollFd,
+		eventFd: eventFd,
+	}
+	for _, f := range []int{fd, eventFd} {
+		event := unix.EpollEvent{Events: unix.EPOLLIN, Fd: int32(f)}
+		if err = unix.EpollCtl(epollFd, unix.EPOLL_CTL_ADD, f, &event); err != nil {
+			p.close()
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+// Blocks until fd is readable or wakeup() called, returns true in latter case
+func (p *fdPoller) wait() (bool, error) {
+	events := make([]unix.EpollEvent, 2)
+	for {
+		n, err := unix.EpollWait(p.epollFd, events, -1)
+		if err == unix.EINTR {
+			continue
+		}
+		if err != nil {
+			return false, err
+		}
+		for _, event := range events[:n] {
+			if int(event.Fd) == p.eventFd {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+}
+
+func (p *fdPoller) wakeup() error {
+	buf := make([]byte, 8)
+	hostByteOrder.PutUint64(buf, 1)
+	_, err := unix.Write(p.eventFd, buf)
+	return err
+}
+
+func (p *fdPoller) close() {
+	unix.Close(p.epollFd)
+	unix.Close(p.eventFd)
+}
@@ -0,0 +1,76 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBpfAttrLayout(t *testing.T) {
+	// Offsets must match union bpf_attr from <linux/bpf.h> on 32 / 64 bit architectures
+	assert.Equal(t, uintptr(8), unsafe.Sizeof(bpfPointer{}))
+
+	var mapAttr bpfMapCreateAttr
+	assert.Equal(t, uintptr(28), unsafe.Offsetof(mapAttr.mapName))
+	assert.Equal(t, uintptr(44), unsafe.Offsetof(mapAttr.mapIfindex))
+	assert.Equal(t, uintptr(48), unsafe.Offsetof(mapAttr.btfFd))
+	assert.Equal(t, uintptr(56), unsafe.Offsetof(mapAttr.btfValueTypeId))
+	assert.Equal(t, uintptr(76), unsafe.Offsetof(mapAttr.mapTokenFd))
+
+	var btfAttr bpfBtfLoadAttr
+	assert.Equal(t, uintptr(16), unsafe.Offsetof(btfAttr.btfSize))
+	assert.Equal(t, uintptr(24), unsafe.Offsetof(btfAttr.btfLogLevel))
+	assert.Equal(t, uintptr(32), unsafe.Offsetof(btfAttr.btfFlags))
+	assert.Equal(t, uintptr(36), unsafe.Offsetof(btfAttr.btfTokenFd))
+
+	var bindAttr bpfProgBindMapAttr
+	assert.Equal(t, uintptr(4), unsafe.Offsetof(bindAttr.mapFd))
+
+	var tokenAttr bpfTokenCreateAttr
+	assert.Equal(t, uintptr(4), unsafe.Offsetof(tokenAttr.bpffsFd))
+
+	var elemAttr bpfMapElemAttr
+	assert.Equal(t, uintptr(8), unsafe.Offsetof(elemAttr.key))
+	assert.Equal(t, uintptr(16), unsafe.Offsetof(elemAttr.value))
+	assert.Equal(t, uintptr(24), unsafe.Offsetof(elemAttr.flags))
+
+	var progAttr bpfProgLoadAttr
+	assert.Equal(t, uintptr(8), unsafe.Offsetof(progAttr.insns))
+	assert.Equal(t, uintptr(16), unsafe.Offsetof(progAttr.license))
+	assert.Equal(t, uintptr(32), unsafe.Offsetof(progAttr.logBuf))
+	assert.Equal(t, uintptr(40), unsafe.Offsetof(progAttr.kernVersion))
+	assert.Equal(t, uintptr(48), unsafe.Offsetof(progAttr.progName))
+	assert.Equal(t, uintptr(112), unsafe.Offsetof(progAttr.attachBtfObjFd))
+	assert.Equal(t, uintptr(120), unsafe.Offsetof(progAttr.fdArray))
+	assert.Equal(t, uintptr(64), unsafe.Offsetof(progAttr.progIfindex))
+	assert.Equal(t, uintptr(144), unsafe.Offsetof(progAttr.progTokenFd))
+
+	var linkAttr bpfLinkCreateAttr
+	assert.Equal(t, uintptr(16), unsafe.Offsetof(linkAttr.data))
+
+	var testRunAttr bpfProgTestRunAttr
+	assert.Equal(t, uintptr(16), unsafe.Offsetof(testRunAttr.dataIn))
+	assert.Equal(t, uintptr(32), unsafe.Offsetof(testRunAttr.repeat))
+	assert.Equal(t, uintptr(48), unsafe.Offsetof(testRunAttr.ctxIn))
+	assert.Equal(t, uintptr(64), unsafe.Offsetof(testRunAttr.flags))
+
+	var objAttr bpfObjAttr
+	assert.Equal(t, uintptr(8), unsafe.Offsetof(objAttr.bpfFd))
+
+	var infoAttr bpfObjInfoAttr
+	assert.Equal(t, uintptr(8), unsafe.Offsetof(infoAttr.info))
+}
+
+func TestObjName(t *testing.T) {
+	name := objName("test")
+	assert.Equal(t, "test", NullTerminatedStringToString(name[:]))
+
+	// Too long names are truncated, keeping NULL terminator
+	name = objName("very_long_name_of_object")
+	assert.Equal(t, "very_long_name_", NullTerminatedStringToString(name[:]))
+	assert.Equal(t, byte(0), name[bpfObjNameLen-1])
+}
@@ -0,0 +1,63 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"unsafe"
+)
+
+// Token is BPF token (linux 6.9+). It delegates subset of BPF functionality to
+// unprivileged process, e.g. running in user namespace of container. What exactly
+// is allowed is defined by privileged side by delegate_cmds / delegate_maps /
+// delegate_progs / delegate_attachs mount options of bpffs instance token is created from:
+//
+//	// Privileged side
+//	mount -t bpf bpffs /run/app/bpf -o delegate_cmds=any,delegate_maps=any,delegate_progs=any
+//
+//	// Application, in user namespace
+//	token, err := goebpf.NewToken("/run/app/bpf")
+//	defer token.Close()
+//	bpf := goebpf.NewDefaultEbpfSystem(goebpf.WithToken(token))
+type Token struct {
+	fd int
+}
+
+// NewToken creates BPF token from bpffs instance mounted at path
+func NewToken(path string) (*Token, error) {
+	bpffsFd, err := openDir(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open bpffs '%s': %v", path, err)
+	}
+	defer closeFd(bpffsFd)
+
+	attr := bpfTokenCreateAttr{
+		bpffsFd: uint32(bpffsFd),
+	}
+	fd, err := bpfSyscall(bpfCmdTokenCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return nil, newSyscallError("ebpf_token_create()", err, nil)
+	}
+
+	return &Token{fd: fd}, nil
+}
+
+// Fd returns file descriptor of token
+func (t *Token) Fd() int {
+	return t.fd
+}
+
+// Close releases token. Maps / programs created with token stay alive,
+// but systems using token (see WithToken()) can't create / load new ones.
+// Closing already closed token does nothing.
+func (t *Token) Close() error {
+	if t.fd == 0 {
+		return nil
+	}
+	if err := closeFd(t.fd); err != nil {
+		return err
+	}
+	t.fd = 0
+	return nil
+}
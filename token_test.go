@@ -0,0 +1,22 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestToken(t *testing.T) {
+	token, err := NewToken("/non/existing/bpffs")
+	assert.Error(t, err)
+	assert.Nil(t, token)
+
+	// Closing already closed token does nothing
+	assert.NoError(t, (&Token{}).Close())
+
+	s := NewDefaultEbpfSystem(WithToken(&Token{fd: 42})).(*ebpfSystem)
+	assert.Equal(t, 42, s.tokenFd)
+}
@@ -0,0 +1,187 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TraceEvent is single line of tracefs trace_pipe, e.g. output of
+// bpf_printk() (bpf_trace_printk() helper):
+//
+//	ping-1234    [003] d.s21  5123.456789: bpf_trace_printk: xdp: dropped 10.0.0.1
+type TraceEvent struct {
+	// Command (comm) and PID of task program has been running in context of
+	Task string
+	Pid  int
+	Cpu  int
+	// irqs-off / need-resched / hardirq / softirq / preempt-depth flags, if enabled
+	Flags string
+	// Time since boot
+	Timestamp time.Duration
+	// Trace event / function, "bpf_trace_printk" for bpf_printk()
+	Function string
+	Message  string
+}
+
+// Format of trace_pipe line: task-pid, optional (tgid), [cpu], optional flags, timestamp, function
+var traceLineRegexp = regexp.MustCompile(
+	`^\s*(.*)-(\d+)\s+(?:\(\s*[-\d]+\)\s+)?\[(\d+)\]\s+(?:(\S+)\s+)?(\d+)\.(\d+):\s+([^:]+):\s?(.*)$`)
+
+// ParseTraceLine parses line of trace_pipe (trailing newline is optional)
+func ParseTraceLine(line string) (*TraceEvent, error) {
+	m := traceLineRegexp.FindStringSubmatch(strings.TrimRight(line, "\n"))
+	if m == nil {
+		return nil, fmt.Errorf("Invalid trace line '%s'", line)
+	}
+	pid, _ := strconv.Atoi(m[2])
+	cpu, _ := strconv.Atoi(m[3])
+	sec, _ := strconv.ParseInt(m[5], 10, 64)
+	// Fraction is microseconds / nanoseconds, depending on trace clock
+	frac, _ := strconv.ParseInt(m[6], 10, 64)
+	for i := len(m[6]); i < 9; i++ {
+		frac *= 10
+	}
+
+	return &TraceEvent{
+		Task:      strings.TrimSpace(m[1]),
+		Pid:       pid,
+		Cpu:       cpu,
+		Flags:     m[4],
+		Timestamp: time.Duration(sec)*time.Second + time.Duration(frac),
+		Function:  m[7],
+		Message:   m[8],
+	}, nil
+}
+
+// TraceFilter selects trace_pipe lines delivered by TraceReader, zero value selects all
+type TraceFilter struct {
+	// Message prefixes, e.g. tags programs start their bpf_printk() output with
+	Prefixes []string
+	// Only events of given process (0 - any)
+	Pid int
+	// Only bpf_printk() output, not other trace events enabled in tracefs
+	PrintkOnly bool
+}
+
+func (f *TraceFilter) match(ev *TraceEvent) bool {
+	if f.Pid != 0 && ev.Pid != f.Pid {
+		return false
+	}
+	// Older kernels don't name function of bpf_trace_printk() output
+	if f.PrintkOnly && ev.Function != "bpf_trace_printk" && ev.Function != "0" {
+		return false
+	}
+	if len(f.Prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range f.Prefixes {
+		if strings.HasPrefix(ev.Message, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// TraceReader reads trace_pipe in background, see ReadTracePipe()
+type TraceReader struct {
+	file     *os.File
+	filter   TraceFilter
+	events   chan TraceEvent
+	stop     chan struct{}
+	stopOnce sync.Once
+	err      error
+}
+
+// Returns path of trace_pipe, tracefs has to be mounted
+func tracePipePath() (string, error) {
+	for _, root := range tracefsPaths {
+		path := filepath.Join(root, "trace_pipe")
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return "", errors.New("trace_pipe not found (is tracefs mounted?)")
+}
+
+// ReadTracePipe starts goroutine reading tracefs trace_pipe, events matching
+// filter are sent into Events() channel, so callers never block on pipe
+// (e.g. poll channel with select / default). Lines not in trace format
+// (e.g. "CPU:3 [LOST 10 EVENTS]") are skipped.
+// trace_pipe is consuming: line read by one reader is not seen by others.
+func ReadTracePipe(filter TraceFilter) (*TraceReader, error) {
+	path, err := tracePipePath()
+	if err != nil {
+		return nil, err
+	}
+	// trace_pipe supports poll, so os.File reads are interrupted by Close()
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r := &TraceReader{
+		file:   file,
+		filter: filter,
+		events: make(chan TraceEvent, 256),
+		stop:   make(chan struct{}),
+	}
+	go r.run()
+
+	return r, nil
+}
+
+// Events returns channel of trace events. Channel is closed when reader stopped
+// either by Stop() or because of error, see Err().
+func (r *TraceReader) Events() <-chan TraceEvent {
+	return r.events
+}
+
+// Err returns error caused reader to stop. Valid after Events() channel closed.
+func (r *TraceReader) Err() error {
+	return r.err
+}
+
+// Stop stops reading and closes trace_pipe. Safe to call multiple times.
+func (r *TraceReader) Stop() {
+	r.stopOnce.Do(func() {
+		close(r.stop)
+		r.file.Close()
+	})
+}
+
+func (r *TraceReader) run() {
+	defer close(r.events)
+
+	reader := bufio.NewReader(r.file)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			select {
+			case <-r.stop:
+			default:
+				r.err = err
+			}
+			return
+		}
+		ev, err := ParseTraceLine(line)
+		if err != nil || !r.filter.match(ev) {
+			continue
+		}
+		select {
+		case r.events <- *ev:
+		case <-r.stop:
+			return
+		}
+	}
+}
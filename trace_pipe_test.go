@@ -0,0 +1,67 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseTraceLine(t *testing.T) {
+	ev, err := ParseTraceLine("            ping-1234    [003] d.s21  5123.456789: bpf_trace_printk: xdp: dropped 10.0.0.1\n")
+	require.NoError(t, err)
+	assert.Equal(t, &TraceEvent{
+		Task:      "ping",
+		Pid:       1234,
+		Cpu:       3,
+		Flags:     "d.s21",
+		Timestamp: 5123*time.Second + 456789*time.Microsecond,
+		Function:  "bpf_trace_printk",
+		Message:   "xdp: dropped 10.0.0.1",
+	}, ev)
+
+	// Task name with dashes / spaces, tgid column, no flags, older kernels
+	ev, err = ParseTraceLine(" kworker/u8:2-my task-77 (   70) [000] 12.000001: 0: hello")
+	require.NoError(t, err)
+	assert.Equal(t, "kworker/u8:2-my task", ev.Task)
+	assert.Equal(t, 77, ev.Pid)
+	assert.Equal(t, "", ev.Flags)
+	assert.Equal(t, 12*time.Second+time.Microsecond, ev.Timestamp)
+	assert.Equal(t, "0", ev.Function)
+	assert.Equal(t, "hello", ev.Message)
+
+	// Nanosecond trace clock, empty message
+	ev, err = ParseTraceLine("<idle>-0 [001] ..... 1.000000002: bpf_trace_printk: ")
+	require.NoError(t, err)
+	assert.Equal(t, "<idle>", ev.Task)
+	assert.Equal(t, time.Second+2, ev.Timestamp)
+	assert.Equal(t, "", ev.Message)
+
+	_, err = ParseTraceLine("CPU:3 [LOST 10 EVENTS]")
+	assert.Error(t, err)
+}
+
+func TestTraceFilter(t *testing.T) {
+	ev := &TraceEvent{Pid: 10, Function: "bpf_trace_printk", Message: "fw: drop"}
+	other := &TraceEvent{Pid: 11, Function: "sched_switch", Message: "prev_comm=a"}
+
+	assert.True(t, (&TraceFilter{}).match(ev))
+	assert.True(t, (&TraceFilter{}).match(other))
+
+	f := &TraceFilter{Prefixes: []string{"lb:", "fw:"}}
+	assert.True(t, f.match(ev))
+	assert.False(t, f.match(other))
+
+	f = &TraceFilter{Pid: 11}
+	assert.False(t, f.match(ev))
+	assert.True(t, f.match(other))
+
+	f = &TraceFilter{PrintkOnly: true}
+	assert.True(t, f.match(ev))
+	assert.False(t, f.match(other))
+	assert.True(t, f.match(&TraceEvent{Function: "0"}))
+}
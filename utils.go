@@ -3,121 +3,22 @@
 
 package goebpf
 
-/*
-#include <errno.h>
-#include <string.h>
-#include <time.h>
-#include <unistd.h>
-#include <stdlib.h>
-
-#include "bpf.h"
-#include "bpf_helpers.h"
-
-static int ebpf_obj_pin(__u32 fd, const char *pathname,
-		void *log_buf, size_t log_size)
-{
-	union bpf_attr attr = {};
-
-	attr.pathname = ptr_to_u64((void *)pathname);
-	attr.bpf_fd = fd;
-
-	int res = syscall(__NR_bpf, BPF_OBJ_PIN, &attr, sizeof(attr));
-	strncpy(log_buf, strerror(errno), log_size);
-	return res;
-}
-
-static int ebpf_prog_get_fd_by_id(__u32 id,
-		void *log_buf, size_t log_size)
-{
-	union bpf_attr attr = {};
-	attr.prog_id = id;
-
-	int res = syscall(__NR_bpf, BPF_PROG_GET_FD_BY_ID, &attr, sizeof(attr));
-	strncpy(log_buf, strerror(errno), log_size);
-
-	return res;
-}
-
-static int ebpf_obj_get_info_by_fd(__u32 fd, void *info, __u32 info_len,
-		void *log_buf, size_t log_size)
-{
-	union bpf_attr attr = {};
-
-	attr.info.bpf_fd = fd;
-	attr.info.info = ptr_to_u64(info);
-	attr.info.info_len = info_len;
-
-	int res = syscall(__NR_bpf, BPF_OBJ_GET_INFO_BY_FD, &attr, sizeof(attr));
-	strncpy(log_buf, strerror(errno), log_size);
-
-	return res;
-}
-
-static int ebpf_obj_get_info_maps(__u32 fd, void *map_ids, __u32 maps_num,
-		void *log_buf, size_t log_size)
-{
-	struct bpf_prog_info info = {};
-	union bpf_attr attr = {};
-
-	info.nr_map_ids = maps_num;
-	info.map_ids = ptr_to_u64(map_ids);
-
-	attr.info.bpf_fd = fd;
-	attr.info.info = ptr_to_u64(&info);
-	attr.info.info_len = sizeof(info);
-
-	int res = syscall(__NR_bpf, BPF_OBJ_GET_INFO_BY_FD, &attr, sizeof(attr));
-	strncpy(log_buf, strerror(errno), log_size);
-
-	return res;
-}
-
-static int ebpf_close(int fd, void *log_buf, size_t log_size)
-{
-	int res = close(fd);
-	strncpy(log_buf, strerror(errno), log_size);
-
-	return res;
-}
-
-// Workaround for MAC
-#ifndef CLOCK_BOOTTIME
-	#define CLOCK_BOOTTIME 0
-#endif
-
-// Returns system's boot timestamp
-static __u64 get_system_boot_timestamp()
-{
-	struct timespec boot_time_ts, real_time_ts;
-
-	clock_gettime(CLOCK_REALTIME, &real_time_ts);
-	clock_gettime(CLOCK_BOOTTIME, &boot_time_ts);
-
-	return real_time_ts.tv_sec - boot_time_ts.tv_sec;
-}
-
-*/
-import "C"
-
 import (
 	"bytes"
+	"encoding"
 	"encoding/binary"
 	"encoding/hex"
 	"errors"
 	"fmt"
-	"io/ioutil"
 	"net"
 	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 	"unsafe"
 )
 
-const (
-	errCodeBufferSize = 512
-)
-
 // Number of CPUs - in order to work with Per-CPU eBPF maps.
 var numPossibleCpus int
 var getPossibleCpusOnce sync.Once
@@ -126,7 +27,10 @@ var getPossibleCpusOnce sync.Once
 //
 // Main use case is to inspect already loaded into kernel programs.
 type ProgramInfo struct {
+	// Full name of program if it has been loaded by current process,
+	// name kept by kernel otherwise, see KernelObjectName()
 	Name             string
+	KernelName       string
 	Tag              string // Program tag (unclear what this for)
 	Type             ProgramType
 	Id               int // ID - external ID of program (to refer object)
@@ -136,6 +40,11 @@ type ProgramInfo struct {
 	LoadTime         time.Time
 	CreatedByUid     int            // UID of creator
 	Maps             map[string]Map // Associated eBPF maps
+	Ifindex          int            // Network interface program offloaded to (hardware offload)
+	// bpf_metadata_* variables of program (names without prefix), see program_metadata.go
+	Metadata map[string]string
+	// BTF object of program, see GetBtfInfoById() (0 - program has no BTF)
+	BtfId int
 }
 
 // NullTerminatedStringToString is helper to convert null terminated string to GO string
@@ -154,25 +63,18 @@ func NullTerminatedStringToString(val []byte) string {
 // GetProgramInfoByFd queries information about already loaded eBPF program by fd
 // (fd belongs to local process, cannot be shared)
 func GetProgramInfoByFd(fd int) (*ProgramInfo, error) {
-	var logBuf [errCodeBufferSize]byte
 	var infoBuf [1024]byte
 
 	// Get program information
-	{
-		res := C.ebpf_obj_get_info_by_fd(C.__u32(fd),
-			unsafe.Pointer(&infoBuf[0]), C.__u32(len(infoBuf)),
-			unsafe.Pointer(&logBuf[0]), C.size_t(unsafe.Sizeof(logBuf)))
-		if res == -1 {
-			return nil, fmt.Errorf("ebpf_obj_get_info_by_fd() failed: %v",
-				NullTerminatedStringToString(logBuf[:]))
-		}
+	if err := ebpfObjGetInfoByFd(fd, infoBuf[:]); err != nil {
+		return nil, err
 	}
 
 	// Read program info from buffer
 	var rawInfo struct {
 		Type                      uint32
 		Id                        uint32
-		Tag                       [C.BPF_TAG_SIZE]byte
+		Tag                       [bpfTagSize]byte
 		JitedProgramLen           uint32
 		XlatedProgramLen          uint32
 		JitedProgramInstructions  uint64
@@ -181,23 +83,29 @@ func GetProgramInfoByFd(fd int) (*ProgramInfo, error) {
 		CreatedByUid              uint32
 		MapIdsLen                 uint32
 		MapIds                    uint64
-		Name                      [C.BPF_OBJ_NAME_LEN]byte
+		Name                      [bpfObjNameLen]byte
+		Ifindex                   uint32
+		GplCompatible             uint32
+		NetnsDev                  uint64
+		NetnsIno                  uint64
+		NrJitedKsyms              uint32
+		NrJitedFuncLens           uint32
+		JitedKsyms                uint64
+		JitedFuncLens             uint64
+		BtfId                     uint32
 	}
 	reader := bytes.NewReader(infoBuf[:])
-	if err := binary.Read(reader, binary.LittleEndian, &rawInfo); err != nil {
+	if err := binary.Read(reader, hostByteOrder, &rawInfo); err != nil {
 		return nil, err
 	}
 
 	maps := make(map[string]Map)
+	var metadata map[string]string
 	if rawInfo.MapIdsLen > 0 {
 		// In case of program is using maps - get all map IDs associated with program
-		mapsArray := make([]uint32, rawInfo.MapIdsLen)
-		res := C.ebpf_obj_get_info_maps(C.__u32(fd),
-			unsafe.Pointer(&mapsArray[0]), C.__u32(len(mapsArray)),
-			unsafe.Pointer(&logBuf[0]), C.size_t(unsafe.Sizeof(logBuf)))
-		if res == -1 {
-			return nil, fmt.Errorf("ebpf_obj_get_info_maps() failed: %v",
-				NullTerminatedStringToString(logBuf[:]))
+		mapsArray, err := ebpfObjGetInfoMaps(fd, int(rawInfo.MapIdsLen))
+		if err != nil {
+			return nil, err
 		}
 		// Create maps from IDs
 		for _, id := range mapsArray {
@@ -206,15 +114,20 @@ func GetProgramInfoByFd(fd int) (*ProgramInfo, error) {
 				return nil, err
 			}
 			maps[m.Name] = m
+			// Metadata is optional, so unreadable one is just not reported
+			if md, err := readMapMetadata(m); err == nil && md != nil {
+				metadata = md
+			}
 		}
 	}
 
 	// Calculate program's load date
-	systemBootTime := int64(C.get_system_boot_timestamp())
+	systemBootTime := getSystemBootTimestamp()
 	loadTimestamp := systemBootTime + (rawInfo.LoadTime / 1000000000)
 
 	return &ProgramInfo{
-		Name:             NullTerminatedStringToString(rawInfo.Name[:]),
+		Name:             fullObjectName(objectNames.programs, rawInfo.Id, NullTerminatedStringToString(rawInfo.Name[:])),
+		KernelName:       NullTerminatedStringToString(rawInfo.Name[:]),
 		Tag:              hex.EncodeToString(rawInfo.Tag[:]),
 		Type:             ProgramType(rawInfo.Type),
 		Id:               int(rawInfo.Id),
@@ -224,93 +137,160 @@ func GetProgramInfoByFd(fd int) (*ProgramInfo, error) {
 		LoadTime:         time.Unix(loadTimestamp, 0),
 		CreatedByUid:     int(rawInfo.CreatedByUid),
 		Maps:             maps,
+		Ifindex:          int(rawInfo.Ifindex),
+		Metadata:         metadata,
+		BtfId:            int(rawInfo.BtfId),
 	}, nil
 }
 
 // GetProgramInfoById queries information about already loaded eBPF
 // program by external ID.
 func GetProgramInfoById(id int) (*ProgramInfo, error) {
-	var logBuf [errCodeBufferSize]byte
-
 	// Resolve object FD from ID
-	fd := C.ebpf_prog_get_fd_by_id(C.__u32(id),
-		unsafe.Pointer(&logBuf[0]), C.size_t(unsafe.Sizeof(logBuf)))
-	if fd == -1 {
-		return nil, fmt.Errorf("ebpf_prog_get_fd_by_id() failed: %v",
-			NullTerminatedStringToString(logBuf[:]))
+	fd, err := ebpfGetFdById(bpfCmdProgGetFdById, "ebpf_prog_get_fd_by_id()", id)
+	if err != nil {
+		return nil, err
+	}
+
+	return GetProgramInfoByFd(fd)
+}
+
+// ErrNoMoreIds returned by GetNextProgramId / GetNextMapId when all objects enumerated
+var ErrNoMoreIds = errors.New("No more IDs")
+
+// Wrapper for BPF_*_GET_NEXT_ID commands
+func ebpfGetNextId(cmd int, op string, startId int) (int, error) {
+	attr := bpfGetIdAttr{
+		id: uint32(startId),
 	}
+	_, err := bpfSyscall(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		if err == syscall.ENOENT {
+			return 0, ErrNoMoreIds
+		}
+		return 0, newSyscallError(op, err, nil)
+	}
+
+	return int(attr.nextId), nil
+}
 
-	return GetProgramInfoByFd(int(fd))
+// GetNextProgramId returns ID of loaded into kernel eBPF program which follows startId,
+// can be used to enumerate all programs in the system:
+//
+//	id, err := goebpf.GetNextProgramId(0)
+//	for ; err == nil; id, err = goebpf.GetNextProgramId(id) {
+//		info, err := goebpf.GetProgramInfoById(id)
+//		...
+//	}
+//	if err != goebpf.ErrNoMoreIds {
+//		// handle error
+//	}
+func GetNextProgramId(startId int) (int, error) {
+	return ebpfGetNextId(bpfCmdProgGetNextId, "ebpf_prog_get_next_id()", startId)
+}
+
+// GetNextMapId returns ID of eBPF map which follows startId, see GetNextProgramId()
+func GetNextMapId(startId int) (int, error) {
+	return ebpfGetNextId(bpfCmdMapGetNextId, "ebpf_map_get_next_id()", startId)
 }
 
 // Wrapper for ebpf_obj_pin() syscall
 func ebpfObjPin(fd int, path string) error {
-	var logBuf [errCodeBufferSize]byte
-	pathCStr := C.CString(path)
-	defer C.free(unsafe.Pointer(pathCStr))
 	if fd == 0 {
 		return errors.New("ebpfObjPin: invalid fd")
 	}
 	if strings.TrimSpace(path) == "" {
 		return errors.New("ebpfObjPin: empty path")
 	}
-	res := int(C.ebpf_obj_pin(
-		C.__u32(fd),
-		pathCStr,
-		unsafe.Pointer(&logBuf[0]),
-		C.size_t(unsafe.Sizeof(logBuf)),
-	))
-	if res == -1 {
-		return fmt.Errorf("ebpfObjPin to '%s' failed: %s",
-			path, NullTerminatedStringToString(logBuf[:]))
+	attr := bpfObjAttr{
+		pathname: newBpfPointer(cString(path)),
+		bpfFd:    uint32(fd),
+	}
+	_, err := bpfSyscall(bpfCmdObjPin, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return newSyscallError(fmt.Sprintf("ebpfObjPin to '%s'", path), err, nil)
 	}
 
 	return nil
 }
 
-// Helper to close linux file descriptor
-func closeFd(fd int) error {
-	var logBuf [errCodeBufferSize]byte
-
-	res := int(C.ebpf_close(
-		C.int(fd),
-		unsafe.Pointer(&logBuf[0]),
-		C.size_t(unsafe.Sizeof(logBuf))))
+// Parses kernel CPU list format (cpulist_parse()), used by files like
+// /sys/devices/system/cpu/possible, e.g. "0-3,8,10-11", into sorted CPU IDs
+func parseCpuList(data string) ([]int, error) {
+	data = strings.TrimSpace(data)
+	if data == "" {
+		return nil, errors.New("Empty CPU list")
+	}
 
-	if res == -1 {
-		return fmt.Errorf("close() failed: %s",
-			NullTerminatedStringToString(logBuf[:]))
+	var cpus []int
+	for _, item := range strings.Split(data, ",") {
+		bounds := strings.SplitN(item, "-", 2)
+		first, err := strconv.Atoi(bounds[0])
+		if err != nil || first < 0 {
+			return nil, fmt.Errorf("Invalid CPU list '%s'", data)
+		}
+		last := first
+		if len(bounds) == 2 {
+			last, err = strconv.Atoi(bounds[1])
+			if err != nil || last < first {
+				return nil, fmt.Errorf("Invalid CPU list '%s'", data)
+			}
+		}
+		if len(cpus) > 0 && first <= cpus[len(cpus)-1] {
+			return nil, fmt.Errorf("Invalid CPU list '%s': ranges are not sorted", data)
+		}
+		for cpu := first; cpu <= last; cpu++ {
+			cpus = append(cpus, cpu)
+		}
 	}
-	return nil
+
+	return cpus, nil
 }
 
 // Helper to get number of possible system CPUs from string
 func parseNumOfPossibleCpus(data string) (int, error) {
-	eInvalid := errors.New("Unable to get # of possible CPUs: invalid file format")
-	// VM support: when machine has only one CPU input is "0"
-	if strings.TrimSpace(data) == "0" {
-		return 1, nil
+	cpus, err := parseCpuList(data)
+	// CPU 0 (boot CPU) is always possible
+	if err != nil || cpus[0] != 0 {
+		return 0, errors.New("Unable to get # of possible CPUs: invalid file format")
 	}
-	// Otherwise input looks like:
-	// 0-14
-	// where 0 is first possible CPU and 14 is the last
-	items := strings.Split(strings.TrimSpace(data), "-")
-	if len(items) != 2 {
-		return 0, eInvalid
-	}
-	first, err := strconv.Atoi(items[0])
-	if err != nil || first != 0 {
-		return 0, eInvalid
+
+	return len(cpus), nil
+}
+
+// PossibleCPUs returns IDs of CPUs which can ever be online in system, i.e. ones
+// per-CPU maps hold value for. Values returned by per-CPU map lookups are in
+// order of this list, so i-th value belongs to CPU PossibleCPUs()[i].
+// NOTE: this is not the same as runtime.NumCPU(), which counts CPUs
+// available to current process only.
+func PossibleCPUs() ([]int, error) {
+	data, err := readPossibleCpus()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read possible CPUs: %v", err)
 	}
-	second, err := strconv.Atoi(items[1])
+
+	return parseCpuList(data)
+}
+
+// OnlineCPUs returns IDs of CPUs currently online, e.g. ones to open
+// per-CPU perf events on. It is subset of PossibleCPUs().
+func OnlineCPUs() ([]int, error) {
+	data, err := readOnlineCpus()
 	if err != nil {
-		return 0, eInvalid
+		return nil, fmt.Errorf("Unable to read online CPUs: %v", err)
 	}
 
-	return second + 1, nil
+	return parseCpuList(data)
 }
 
-// GetNumOfPossibleCpus returns number of CPU available to eBPF program
+// KtimeToTime converts timestamp taken by eBPF program with bpf_ktime_get_ns()
+// (CLOCK_MONOTONIC) into wall clock time
+func KtimeToTime(ns uint64) time.Time {
+	return time.Unix(0, getMonotonicClockOffset()+int64(ns))
+}
+
+// GetNumOfPossibleCpus returns number of CPU available to eBPF program,
+// i.e. number of values per-CPU map holds for each key (see PossibleCPUs())
 // NOTE: this is not the same as runtime.NumCPU()
 func GetNumOfPossibleCpus() (int, error) {
 	// Idea taken from
@@ -319,10 +299,10 @@ func GetNumOfPossibleCpus() (int, error) {
 	var err error
 
 	getPossibleCpusOnce.Do(func() {
-		var data []byte
-		data, err = ioutil.ReadFile("/sys/devices/system/cpu/possible")
+		var data string
+		data, err = readPossibleCpus()
 		if err == nil {
-			numPossibleCpus, err = parseNumOfPossibleCpus(string(data))
+			numPossibleCpus, err = parseNumOfPossibleCpus(data)
 		}
 	})
 
@@ -332,7 +312,7 @@ func GetNumOfPossibleCpus() (int, error) {
 // ParseFlexibleIntegerLittleEndian converts flexible amount of bytes
 // into little endian integer, e.g.:
 // {1} -> 1
-// {0xe8, 0x3} -> 10000
+// {0xe8, 0x3} -> 1000
 func ParseFlexibleIntegerLittleEndian(rawVal []byte) uint64 {
 	var result uint64
 	for idx, val := range rawVal {
@@ -341,7 +321,35 @@ func ParseFlexibleIntegerLittleEndian(rawVal []byte) uint64 {
 	return result
 }
 
-// KeyValueToBytes coverts interface representation of key/value into bytes
+// ParseFlexibleIntegerBigEndian converts flexible amount of bytes
+// into big endian integer, e.g. {0x3, 0xe8} -> 1000
+func ParseFlexibleIntegerBigEndian(rawVal []byte) uint64 {
+	var result uint64
+	for _, val := range rawVal {
+		result = (result << 8) | uint64(val)
+	}
+	return result
+}
+
+// ParseFlexibleInteger converts flexible amount of bytes into integer
+// using host byte order, i.e. how eBPF programs store integers in maps
+func ParseFlexibleInteger(rawVal []byte) uint64 {
+	if hostByteOrder == binary.BigEndian {
+		return ParseFlexibleIntegerBigEndian(rawVal)
+	}
+	return ParseFlexibleIntegerLittleEndian(rawVal)
+}
+
+// KeyValueToBytes converts interface representation of key/value into bytes.
+// Supported types are:
+//   - uint8, uint16, uint32, int32, uint64: integers of fixed size in host byte
+//     order, the same way eBPF program sees them (__u32, __u64, etc)
+//   - Be16, Be32, Be64, PortKey: integers in network byte order (__be16, __be32, ...)
+//   - string, []byte: raw bytes, zero padded to size
+//   - *net.IPNet: LPM trie key (struct bpf_lpm_trie_key)
+//   - encoding.BinaryMarshaler: typed keys / values, e.g. IPv4Key, FlowKey
+//   - int: deprecated, integer of the whole key / value size (host byte order),
+//     so its width silently depends on map definition, use sized types instead
 func KeyValueToBytes(ival interface{}, size int) ([]byte, error) {
 	overflow := fmt.Errorf("Key/Value is too long (must be at most %d)", size)
 
@@ -358,6 +366,10 @@ func KeyValueToBytes(ival interface{}, size int) ([]byte, error) {
 			res[idx] = byte(remainder & 0xff)
 			remainder >>= 8
 		}
+		// Integer of size bytes: on big endian hosts lowest byte goes last
+		if hostByteOrder == binary.BigEndian {
+			reverseBytes(res)
+		}
 	case uint8:
 		if size < 1 {
 			return nil, overflow
@@ -367,22 +379,22 @@ func KeyValueToBytes(ival interface{}, size int) ([]byte, error) {
 		if size < 2 {
 			return nil, overflow
 		}
-		binary.LittleEndian.PutUint16(res, val)
+		hostByteOrder.PutUint16(res, val)
 	case uint32:
 		if size < 4 {
 			return nil, overflow
 		}
-		binary.LittleEndian.PutUint32(res, val)
+		hostByteOrder.PutUint32(res, val)
 	case int32:
 		if size < 4 {
 			return nil, overflow
 		}
-		binary.LittleEndian.PutUint32(res, uint32(val))
+		hostByteOrder.PutUint32(res, uint32(val))
 	case uint64:
 		if size < 8 {
 			return nil, overflow
 		}
-		binary.LittleEndian.PutUint64(res, val)
+		hostByteOrder.PutUint64(res, val)
 	case string:
 		if size < len(val) {
 			return nil, overflow
@@ -400,15 +412,50 @@ func KeyValueToBytes(ival interface{}, size int) ([]byte, error) {
 			return nil, overflow
 		}
 		// Put prefix len
-		binary.LittleEndian.PutUint32(res, uint32(ones))
+		hostByteOrder.PutUint32(res, uint32(ones))
 		// Put IP address as is:
 		// usually we have to htonl() address (change host to network byte order)
 		// however, for eBPF IP addr must be in BIG endian (network byte order)
 		copy(res[4:], val.IP)
 		return res, nil
+	case encoding.BinaryMarshaler:
+		// Typed keys (IPv4Key, FlowKey, etc), already in required byte order
+		data, err := val.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		if size < len(data) {
+			return nil, overflow
+		}
+		copy(res, data)
 	default:
 		return nil, fmt.Errorf("Type %T is not supported yet", val)
 	}
 
 	return res, nil
 }
+
+// GetKernelVersion returns version of running kernel
+// in KERNEL_VERSION(a, b, c) format, i.e. (a << 16) + (b << 8) + c
+func GetKernelVersion() (int, error) {
+	release, err := getKernelRelease()
+	if err != nil {
+		return 0, err
+	}
+	return parseKernelVersion(release)
+}
+
+// Helper to convert kernel release string (e.g. "5.4.0-42-generic")
+// into KERNEL_VERSION(a, b, c) format
+func parseKernelVersion(release string) (int, error) {
+	var major, minor, patch int
+	n, _ := fmt.Sscanf(release, "%d.%d.%d", &major, &minor, &patch)
+	if n < 2 {
+		return 0, fmt.Errorf("Unable to parse kernel release '%s'", release)
+	}
+	// Like kernel itself does - sublevel is capped to 255
+	if patch > 255 {
+		patch = 255
+	}
+	return (major << 16) + (minor << 8) + patch, nil
+}
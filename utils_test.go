@@ -4,7 +4,9 @@
 package goebpf
 
 import (
+	"encoding/binary"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -41,11 +43,46 @@ func TestParseNumOfPossibleCpus(t *testing.T) {
 	}
 }
 
+func TestParseCpuList(t *testing.T) {
+	runs := map[string][]int{
+		"0":             {0},
+		"0-3":           {0, 1, 2, 3},
+		"0-1,4,6-7\n":   {0, 1, 4, 6, 7},
+		"2,5":           {2, 5},
+		" 0-0 \r\n":     {0},
+		"0,2-3,10-11\n": {0, 2, 3, 10, 11},
+	}
+	for str, expected := range runs {
+		cpus, err := parseCpuList(str)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, cpus)
+	}
+
+	// Negative runs
+	for _, str := range []string{"", "\n", "a", "0-", "3-1", "0,,1", "0-2,1", "-1", "0-1-2"} {
+		_, err := parseCpuList(str)
+		assert.Error(t, err, str)
+	}
+
+	// Possible CPUs mask with holes
+	num, err := parseNumOfPossibleCpus("0-1,4-5")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, num)
+}
+
 // Negative test for closeFd()
+func TestKtimeToTime(t *testing.T) {
+	boot := KtimeToTime(0)
+	assert.True(t, boot.Before(time.Now()))
+	// Offset is the same (up to clock adjustments in between)
+	diff := KtimeToTime(uint64(time.Hour)).Sub(boot)
+	assert.InDelta(t, float64(time.Hour), float64(diff), float64(time.Millisecond))
+}
+
 func TestCloseFd(t *testing.T) {
 	err := closeFd(1111) // Some non-existing fd
 	assert.Error(t, err)
-	assert.Equal(t, "close() failed: Bad file descriptor", err.Error())
+	assert.Equal(t, "close() failed: bad file descriptor", err.Error())
 }
 
 func TestNullTerminatedStringToString(t *testing.T) {
@@ -56,6 +93,9 @@ func TestNullTerminatedStringToString(t *testing.T) {
 }
 
 func TestKeyValueToBytes(t *testing.T) {
+	if hostByteOrder != binary.LittleEndian {
+		t.Skip("Expected values are for little endian host, see TestKeyValueToBytesBigEndian")
+	}
 	type run struct {
 		val   interface{}
 		size  int
@@ -164,6 +204,13 @@ func TestKeyValueToBytesNegative(t *testing.T) {
 	}
 }
 
+func BenchmarkKeyValueToBytes(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		KeyValueToBytes(uint32(i), 4)
+	}
+}
+
 func TestParseFlexibleInteger(t *testing.T) {
 	type run struct {
 		rawValue []byte
@@ -196,19 +243,20 @@ func TestParseFlexibleMultiInteger(t *testing.T) {
 		expected  uint64
 	}
 
+	// Value of every CPU is aligned to 8 bytes
 	runs := []run{
 		// uint8
-		{1, []byte{255}, 255},
-		{1, []byte{255, 1}, 255 + 1},
-		{1, []byte{255, 1, 2}, 255 + 1 + 2},
+		{1, []byte{255, 0, 0, 0, 0, 0, 0, 0}, 255},
+		{1, []byte{255, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0}, 255 + 1},
+		{1, []byte{255, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 2, 0, 0, 0, 0, 0, 0, 0}, 255 + 1 + 2},
 		// uint16
-		{2, []byte{0x01, 0x0}, 1},
-		{2, []byte{0xe8, 0x3}, 1000},
-		{2, []byte{0xe8, 0x3, 0x1, 0x0}, 1000 + 1},
+		{2, []byte{0x01, 0x0, 0, 0, 0, 0, 0, 0}, 1},
+		{2, []byte{0xe8, 0x3, 0, 0, 0, 0, 0, 0}, 1000},
+		{2, []byte{0xe8, 0x3, 0, 0, 0, 0, 0, 0, 0x1, 0x0, 0, 0, 0, 0, 0, 0}, 1000 + 1},
 		// uint32
-		{4, []byte{0x01, 0x0, 0x0, 0x0}, 1},
-		{4, []byte{0xA0, 0x86, 0x01, 0x0}, 100000},
-		{4, []byte{0xA0, 0x86, 0x01, 0x0, 0x01, 0x0, 0x0, 0x0}, 100000 + 1},
+		{4, []byte{0x01, 0x0, 0x0, 0x0, 0, 0, 0, 0}, 1},
+		{4, []byte{0xA0, 0x86, 0x01, 0x0, 0, 0, 0, 0}, 100000},
+		{4, []byte{0xA0, 0x86, 0x01, 0x0, 0, 0, 0, 0, 0x01, 0x0, 0x0, 0x0, 0, 0, 0, 0}, 100000 + 1},
 		// uint64
 		{8, []byte{0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0}, 0x100000000},
 		{8, []byte{0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0}, 0x100000000 + 1},
@@ -224,3 +272,21 @@ func TestParseFlexibleMultiInteger(t *testing.T) {
 		assert.Equal(t, r.expected, val)
 	}
 }
+
+func TestParseKernelVersion(t *testing.T) {
+	runs := map[string]int{
+		"4.15.0":           0x040f00,
+		"5.4.0-42-generic": 0x050400,
+		"6.1":              0x060100,
+		"4.9.300":          0x0409ff,
+	}
+	for str, expected := range runs {
+		ver, err := parseKernelVersion(str)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, ver, str)
+	}
+
+	// Negative
+	_, err := parseKernelVersion("linux")
+	assert.Error(t, err)
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// XdpFeatures are XDP capabilities of network device driver (NETDEV_XDP_ACT_*)
+type XdpFeatures uint64
+
+const (
+	// Native mode with XDP_PASS / XDP_DROP / XDP_ABORTED / XDP_TX
+	XdpFeatureBasic XdpFeatures = 1 << iota
+	// XDP_REDIRECT from device
+	XdpFeatureRedirect
+	// XDP_REDIRECT to device
+	XdpFeatureNdoXmit
+	// AF_XDP zero copy
+	XdpFeatureXskZerocopy
+	// Hardware offload
+	XdpFeatureHwOffload
+	// Multi-buffer packets (frags) on receive / on redirect to device
+	XdpFeatureRxSg
+	XdpFeatureNdoXmitSg
+)
+
+var xdpFeatureNames = []string{"basic", "redirect", "ndo-xmit", "xsk-zerocopy", "hw-offload", "rx-sg", "ndo-xmit-sg"}
+
+func (f XdpFeatures) String() string {
+	var names []string
+	for i, name := range xdpFeatureNames {
+		if f&(1<<i) != 0 {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	return strings.Join(names, ",")
+}
+
+// Room kernel reserves in front of / behind packet in page for XDP:
+// XDP_PACKET_HEADROOM and struct skb_shared_info (aligned),
+// along with Ethernet header with two VLAN tags not included into MTU
+const (
+	xdpPacketHeadroom = 256
+	xdpSharedInfoSize = 320
+	xdpL2Overhead     = 14 + 2*4
+)
+
+// XdpDeviceInfo describes what network device allows native (driver) mode XDP with
+type XdpDeviceInfo struct {
+	Ifname  string
+	Ifindex int
+	// Driver name (ethtool -i), empty if not reported
+	Driver string
+	MTU    int
+	// Largest MTU supported by device (0 if not reported), suitable for
+	// programs supporting multi-buffer packets on XdpFeatureRxSg devices
+	MaxMTU int
+	// Largest MTU for native mode programs without multi-buffer support
+	// (all programs loaded by library): packet must fit single page along
+	// with XDP headroom. Approximate, exact limit depends on driver.
+	MaxXdpMTU   int
+	NumRxQueues int
+	NumTxQueues int
+	// Current / maximum number of combined channels (ethtool -l), 0 if not reported
+	Channels    int
+	MaxChannels int
+	// XDP features of driver, known on kernels 6.3+ only (FeaturesKnown)
+	Features      XdpFeatures
+	FeaturesKnown bool
+	// ID of XDP program attached to device, 0 if none
+	AttachedProgramId int
+}
+
+// XdpDeviceError explains why program can't be attached to device in native mode
+type XdpDeviceError struct {
+	Ifname string
+	Reason string
+	// What to do about it, e.g. command to run
+	Hint string
+}
+
+func (e *XdpDeviceError) Error() string {
+	msg := fmt.Sprintf("Native XDP is not possible on '%s': %s", e.Ifname, e.Reason)
+	if e.Hint != "" {
+		msg += " (" + e.Hint + ")"
+	}
+	return msg
+}
+
+// Is implements matching against ErrNotSupported for errors.Is()
+func (e *XdpDeviceError) Is(target error) bool {
+	return target == ErrNotSupported
+}
+
+// GetXdpDeviceInfo queries network device for XDP related capabilities / limits
+// by netlink and ethtool. Capabilities not reported by driver / kernel are left zero.
+func GetXdpDeviceInfo(ifname string) (*XdpDeviceInfo, error) {
+	link, err := netlink.LinkByName(ifname)
+	RecordAudit(AuditSourceNetlink, "LinkByName", ifname, err)
+	if err != nil {
+		return nil, fmt.Errorf("LinkByName() failed: %v", err)
+	}
+	attrs := link.Attrs()
+	info := &XdpDeviceInfo{
+		Ifname:      ifname,
+		Ifindex:     attrs.Index,
+		MTU:         attrs.MTU,
+		MaxXdpMTU:   os.Getpagesize() - xdpPacketHeadroom - xdpSharedInfoSize - xdpL2Overhead,
+		NumRxQueues: attrs.NumRxQueues,
+		NumTxQueues: attrs.NumTxQueues,
+	}
+	if attrs.Xdp != nil && attrs.Xdp.Attached {
+		info.AttachedProgramId = int(attrs.Xdp.ProgId)
+	}
+	if err = queryXdpDevice(info); err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// Queue constraints of drivers which reject XDP (rather than falling back to
+// slower shared TX queues) if there are no free queues for XDP_TX / XDP_REDIRECT.
+// Checked when channels are reported.
+var xdpQueueChecks = map[string]func(d *XdpDeviceInfo) *XdpDeviceError{
+	// XDP TX queues are taken from the same pool as regular ones
+	"ena": func(d *XdpDeviceInfo) *XdpDeviceError {
+		if d.Channels <= d.MaxChannels/2 {
+			return nil
+		}
+		return &XdpDeviceError{
+			Reason: fmt.Sprintf("%d channels in use, at most half of %d allowed", d.Channels, d.MaxChannels),
+			Hint:   fmt.Sprintf("reduce channels by 'ethtool -L %s combined %d'", d.Ifname, d.MaxChannels/2),
+		}
+	},
+}
+
+// CheckNative checks whether program loaded by library can be attached to
+// device in native mode: driver support, MTU and queue count constraints.
+// Returns *XdpDeviceError describing problem, nil if attach is expected to
+// succeed (kernel may still reject it for reasons not visible from outside).
+func (d *XdpDeviceInfo) CheckNative() error {
+	if d.FeaturesKnown && d.Features&XdpFeatureBasic == 0 {
+		reason := "driver does not support XDP"
+		if d.Driver != "" {
+			reason = fmt.Sprintf("driver '%s' does not support XDP", d.Driver)
+		}
+		return &XdpDeviceError{
+			Ifname: d.Ifname,
+			Reason: reason,
+			Hint:   "use generic mode",
+		}
+	}
+	if d.MTU > d.MaxXdpMTU {
+		return &XdpDeviceError{
+			Ifname: d.Ifname,
+			Reason: fmt.Sprintf("MTU %d exceeds %d, packets would not fit single page",
+				d.MTU, d.MaxXdpMTU),
+			Hint: fmt.Sprintf("lower MTU by 'ip link set dev %s mtu %d' or use generic mode",
+				d.Ifname, d.MaxXdpMTU),
+		}
+	}
+	if check, ok := xdpQueueChecks[d.Driver]; ok && d.MaxChannels > 0 {
+		if err := check(d); err != nil {
+			err.Ifname = d.Ifname
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXdpFeatures(t *testing.T) {
+	assert.Equal(t, "none", XdpFeatures(0).String())
+	assert.Equal(t, "basic,redirect,rx-sg", (XdpFeatureBasic | XdpFeatureRedirect | XdpFeatureRxSg).String())
+	assert.Equal(t, "ndo-xmit-sg", XdpFeatureNdoXmitSg.String())
+}
+
+func TestXdpDeviceCheckNative(t *testing.T) {
+	device := func() *XdpDeviceInfo {
+		return &XdpDeviceInfo{
+			Ifname:        "eth0",
+			Driver:        "ena",
+			MTU:           1500,
+			MaxXdpMTU:     3498,
+			Features:      XdpFeatureBasic | XdpFeatureRedirect,
+			FeaturesKnown: true,
+			Channels:      4,
+			MaxChannels:   8,
+		}
+	}
+	assert.NoError(t, device().CheckNative())
+
+	// Features are checked only if reported
+	d := device()
+	d.Features = 0
+	err := d.CheckNative()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "driver 'ena' does not support XDP")
+	assert.True(t, errors.Is(err, ErrNotSupported))
+	d.FeaturesKnown = false
+	assert.NoError(t, d.CheckNative())
+
+	d = device()
+	d.MTU = 9001
+	err = d.CheckNative()
+	require.Error(t, err)
+	assert.Equal(t, "Native XDP is not possible on 'eth0': MTU 9001 exceeds 3498, packets would not fit single page "+
+		"(lower MTU by 'ip link set dev eth0 mtu 3498' or use generic mode)", err.Error())
+
+	// Driver specific queue constraints
+	d = device()
+	d.Channels = 5
+	err = d.CheckNative()
+	require.Error(t, err)
+	var deviceErr *XdpDeviceError
+	require.True(t, errors.As(err, &deviceErr))
+	assert.Equal(t, "eth0", deviceErr.Ifname)
+	assert.Equal(t, "reduce channels by 'ethtool -L eth0 combined 4'", deviceErr.Hint)
+	d.Driver = "mlx5_core"
+	assert.NoError(t, d.CheckNative())
+	d.Driver = "ena"
+	d.MaxChannels = 0
+	assert.NoError(t, d.CheckNative())
+}
@@ -0,0 +1,189 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/vishvananda/netlink"
+)
+
+// NicRxQueues returns number of RX queues of network device, i.e. valid
+// rx_queue_index values of XDP programs attached to it. Taken from channels
+// (see GetNicChannels()), or from netlink for devices not reporting them.
+func NicRxQueues(ifname string) (int, error) {
+	channels, err := GetNicChannels(ifname)
+	if err == nil && channels.RxQueues() > 0 {
+		return channels.RxQueues(), nil
+	}
+	if err != nil && !errors.Is(err, ErrNotSupported) {
+		return 0, err
+	}
+
+	iface, err := netlink.LinkByName(ifname)
+	RecordAudit(AuditSourceNetlink, "LinkByName", ifname, err)
+	if err != nil {
+		return 0, fmt.Errorf("LinkByName() failed: %v", err)
+	}
+	if iface.Attrs().NumRxQueues <= 0 {
+		return 0, &NotSupportedError{Feature: fmt.Sprintf("RX queue count of '%s'", ifname)}
+	}
+	return iface.Attrs().NumRxQueues, nil
+}
+
+// ValidateNicQueue checks that network device has RX queue, e.g. before
+// binding AF_XDP socket to it
+func ValidateNicQueue(ifname string, queue int) error {
+	queues, err := NicRxQueues(ifname)
+	if err != nil {
+		return err
+	}
+	if queue < 0 || queue >= queues {
+		return fmt.Errorf("Queue %d of '%s' does not exist, it has %d RX queues", queue, ifname, queues)
+	}
+	return nil
+}
+
+// XskMap manages MapTypeXSKMap of AF_XDP sockets of single network device,
+// indexed by RX queue ID. XDP program hands packets over to socket of queue
+// they are received on:
+//
+//	struct bpf_map_def SEC("maps") xsks = {
+//		.map_type = BPF_MAP_TYPE_XSKMAP,
+//		.key_size = sizeof(__u32),
+//		.value_size = sizeof(__u32),
+//		.max_entries = 64,
+//	};
+//
+//	SEC("xdp")
+//	int to_xsk(struct xdp_md *ctx) {
+//		// Packets of queues without socket are passed to kernel (linux 5.3+)
+//		return bpf_redirect_map(&xsks, ctx->rx_queue_index, XDP_PASS);
+//	}
+//
+// Go side, with AF_XDP sockets bound to queues of eth0:
+//
+//	xsks, err := goebpf.NewXskMap(bpf.GetMapByName("xsks").(*goebpf.EbpfMap), "eth0")
+//	err = xsks.Populate(map[int]int{0: xsk0Fd, 1: xsk1Fd})
+//
+// Queue count is taken when XskMap is created: re-create it after
+// changing channels of device (ethtool -L).
+type XskMap struct {
+	m      *EbpfMap
+	ifname string
+	queues int
+}
+
+// NewXskMap creates helper for XSKMap of network device ifname.
+// Map must have room for all RX queues of device.
+func NewXskMap(m *EbpfMap, ifname string) (*XskMap, error) {
+	if m.Type != MapTypeXSKMap {
+		return nil, fmt.Errorf("Map '%s' is %v, not XSKMap", m.Name, m.Type)
+	}
+	queues, err := NicRxQueues(ifname)
+	if err != nil {
+		return nil, err
+	}
+	if m.MaxEntries < queues {
+		return nil, fmt.Errorf("Map '%s' has %d entries, '%s' has %d RX queues",
+			m.Name, m.MaxEntries, ifname, queues)
+	}
+
+	return &XskMap{
+		m:      m,
+		ifname: ifname,
+		queues: queues,
+	}, nil
+}
+
+// CreateXskMap creates XSKMap sized to RX queues of network device ifname
+func CreateXskMap(name, ifname string) (*XskMap, error) {
+	queues, err := NicRxQueues(ifname)
+	if err != nil {
+		return nil, err
+	}
+	m := &EbpfMap{
+		Name:       name,
+		Type:       MapTypeXSKMap,
+		KeySize:    4,
+		ValueSize:  4,
+		MaxEntries: queues,
+	}
+	if err := m.Create(); err != nil {
+		return nil, err
+	}
+
+	return &XskMap{
+		m:      m,
+		ifname: ifname,
+		queues: queues,
+	}, nil
+}
+
+// Map returns underlying map
+func (x *XskMap) Map() *EbpfMap {
+	return x.m
+}
+
+// Queues returns number of RX queues of device
+func (x *XskMap) Queues() int {
+	return x.queues
+}
+
+// ValidateQueue checks that device has RX queue
+func (x *XskMap) ValidateQueue(queue int) error {
+	if queue < 0 || queue >= x.queues {
+		return fmt.Errorf("Queue %d of '%s' does not exist, it has %d RX queues", queue, x.ifname, x.queues)
+	}
+	return nil
+}
+
+// Set puts AF_XDP socket into map at queue. Socket must be bound
+// to the same queue of device and have RX ring.
+func (x *XskMap) Set(queue, xskFd int) error {
+	if err := x.ValidateQueue(queue); err != nil {
+		return err
+	}
+	return x.m.Upsert(uint32(queue), uint32(xskFd))
+}
+
+// Remove removes socket of queue, no-op if there is none
+func (x *XskMap) Remove(queue int) error {
+	if err := x.ValidateQueue(queue); err != nil {
+		return err
+	}
+	err := x.m.Delete(uint32(queue))
+	if err != nil && !errors.Is(err, ErrKeyNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Populate makes map to contain exactly given sockets (by queue):
+// all queues are validated upfront, sockets of queues not present are removed
+func (x *XskMap) Populate(xskFds map[int]int) error {
+	for queue := range xskFds {
+		if err := x.ValidateQueue(queue); err != nil {
+			return err
+		}
+	}
+	for queue := 0; queue < x.queues; queue++ {
+		var err error
+		if fd, ok := xskFds[queue]; ok {
+			err = x.Set(queue, fd)
+		} else {
+			err = x.Remove(queue)
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to update queue %d of '%s': %v", queue, x.ifname, err)
+		}
+	}
+	return nil
+}
+
+// Close closes underlying map
+func (x *XskMap) Close() error {
+	return x.m.Close()
+}
@@ -0,0 +1,35 @@
+// Copyright (c) 2019 Dropbox, Inc.
+// Full license can be found in the LICENSE file.
+
+package goebpf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestXskMapQueues(t *testing.T) {
+	x := &XskMap{
+		m:      &EbpfMap{Name: "xsks", Type: MapTypeXSKMap, KeySize: 4, ValueSize: 4, MaxEntries: 4},
+		ifname: "eth0",
+		queues: 4,
+	}
+	assert.Equal(t, 4, x.Queues())
+	assert.NoError(t, x.ValidateQueue(0))
+	assert.NoError(t, x.ValidateQueue(3))
+	assert.Error(t, x.ValidateQueue(4))
+	assert.Error(t, x.ValidateQueue(-1))
+
+	// Invalid queues are rejected before map is touched
+	assert.Error(t, x.Set(4, 10))
+	assert.Error(t, x.Remove(-1))
+	assert.Error(t, x.Populate(map[int]int{0: 10, 7: 11}))
+}
+
+func TestNewXskMapInvalid(t *testing.T) {
+	m := &EbpfMap{Name: "xsks", Type: MapTypeDevMap, KeySize: 4, ValueSize: 4, MaxEntries: 4}
+	x, err := NewXskMap(m, "eth0")
+	assert.Error(t, err)
+	assert.Nil(t, x)
+}